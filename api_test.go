@@ -0,0 +1,261 @@
+// api_test.go - stable API compatibility tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// apiFile is the file listing the stable API of the
+// first major version, see apiFileName
+const apiFile = "testdata/api.txt"
+
+// stablePackages are the directories of the packages
+// whose exported identifiers form the stable API
+var stablePackages = []string{
+	"clock",
+	"config",
+	"crypto/block",
+	"crypto/vault",
+	"daemon",
+	"mix_pki",
+	"storage",
+	"user_pki",
+}
+
+// importComment matches the import comment of doc.go
+var importComment = regexp.MustCompile(`(?m)^package client // import "([^"]+)"$`)
+
+var updateAPI = flag.Bool("update-api", false, "add the new identifiers to the stable API file")
+
+// modulePath returns the module path, the module directive
+// of go.mod if there is one, or the import comment of doc.go
+func modulePath() (string, error) {
+	if raw, err := ioutil.ReadFile("go.mod"); err == nil {
+		for _, line := range strings.Split(string(raw), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "module" {
+				return strings.Trim(fields[1], `"`), nil
+			}
+		}
+	}
+	raw, err := ioutil.ReadFile("doc.go")
+	if err != nil {
+		return "", err
+	}
+	m := importComment.FindSubmatch(raw)
+	if m == nil {
+		return "", fmt.Errorf("doc.go has no import comment")
+	}
+	return string(m[1]), nil
+}
+
+// majorVersion returns the major version of the given module
+// path, the path of the first one has no version suffix
+func majorVersion(path string) int {
+	suffix := path[strings.LastIndex(path, "/")+1:]
+	if strings.HasPrefix(suffix, "v") {
+		if major, err := strconv.Atoi(suffix[1:]); err == nil && major >= 2 {
+			return major
+		}
+	}
+	return 1
+}
+
+// apiFileName returns the file listing the
+// stable API of the given major version
+func apiFileName(major int) string {
+	if major == 1 {
+		return apiFile
+	}
+	return fmt.Sprintf("testdata/api.v%d.txt", major)
+}
+
+// readAPI returns the lines of the given
+// API file, none if it doesn't exist
+func readAPI(name string) ([]string, error) {
+	raw, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(raw)), "\n"), nil
+}
+
+// nodeString returns the source representation of the given node
+func nodeString(fset *token.FileSet, node interface{}) string {
+	buf := new(bytes.Buffer)
+	printer.Fprint(buf, fset, node)
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+// exportedAPI returns one line per exported identifier
+// of the package in the given directory
+func exportedAPI(dir string) ([]string, error) {
+	fset := token.NewFileSet()
+	notTest := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}
+	pkgs, err := parser.ParseDir(fset, dir, notTest, 0)
+	if err != nil {
+		return nil, err
+	}
+	api := []string{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				switch d := decl.(type) {
+				case *ast.FuncDecl:
+					if !d.Name.IsExported() {
+						continue
+					}
+					if d.Recv != nil && !ast.IsExported(receiverName(d.Recv.List[0].Type)) {
+						continue
+					}
+					d.Body = nil
+					d.Doc = nil
+					api = append(api, fmt.Sprintf("%s: %s", dir, nodeString(fset, d)))
+				case *ast.GenDecl:
+					api = append(api, genDeclAPI(fset, dir, d)...)
+				}
+			}
+		}
+	}
+	return api, nil
+}
+
+// receiverName returns the type name of a method receiver
+func receiverName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// genDeclAPI returns the exported identifiers of a
+// const, var or type declaration, including the
+// exported fields of struct types
+func genDeclAPI(fset *token.FileSet, dir string, d *ast.GenDecl) []string {
+	api := []string{}
+	for _, spec := range d.Specs {
+		switch s := spec.(type) {
+		case *ast.ValueSpec:
+			for _, name := range s.Names {
+				if name.IsExported() {
+					api = append(api, fmt.Sprintf("%s: %s %s", dir, d.Tok, name.Name))
+				}
+			}
+		case *ast.TypeSpec:
+			if !s.Name.IsExported() {
+				continue
+			}
+			st, ok := s.Type.(*ast.StructType)
+			if !ok {
+				api = append(api, fmt.Sprintf("%s: type %s %s", dir, s.Name.Name, nodeString(fset, s.Type)))
+				continue
+			}
+			api = append(api, fmt.Sprintf("%s: type %s struct", dir, s.Name.Name))
+			for _, field := range st.Fields.List {
+				for _, name := range field.Names {
+					if name.IsExported() {
+						api = append(api, fmt.Sprintf("%s: field %s.%s %s", dir, s.Name.Name, name.Name, nodeString(fset, field.Type)))
+					}
+				}
+				if len(field.Names) == 0 {
+					api = append(api, fmt.Sprintf("%s: embedded %s.%s", dir, s.Name.Name, nodeString(fset, field.Type)))
+				}
+			}
+		}
+	}
+	return api
+}
+
+// TestStableAPI ensures that no identifier of the stable API was
+// removed or changed. Run with -update-api after adding identifiers,
+// the identifiers are only ever added to the API file of the major
+// version of the module path. Removing or changing one takes a new
+// major version, which has it's own API file, see doc.go.
+func TestStableAPI(t *testing.T) {
+	require := require.New(t)
+
+	current := []string{}
+	for _, dir := range stablePackages {
+		api, err := exportedAPI(dir)
+		require.NoError(err, "exportedAPI failed")
+		current = append(current, api...)
+	}
+	path, err := modulePath()
+	require.NoError(err, "modulePath failed")
+	major := majorVersion(path)
+	name := apiFileName(major)
+	recorded, err := readAPI(name)
+	require.NoError(err, "readAPI failed")
+
+	if *updateAPI {
+		lines := make(map[string]bool)
+		for _, line := range append(recorded, current...) {
+			lines[line] = true
+		}
+		updated := make([]string, 0, len(lines))
+		for line := range lines {
+			updated = append(updated, line)
+		}
+		sort.Strings(updated)
+		err := ioutil.WriteFile(name, []byte(strings.Join(updated, "\n")+"\n"), 0644)
+		require.NoError(err, "WriteFile failed")
+		return
+	}
+	require.NotEmpty(recorded, "no stable API file of major version %d, run with -update-api", major)
+	currentMap := make(map[string]bool)
+	for _, line := range current {
+		currentMap[line] = true
+	}
+	for _, line := range recorded {
+		require.True(currentMap[line], "stable API removed or changed, this requires the module path of a new major version, see doc.go: %s", line)
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(1, majorVersion("github.com/katzenpost/client"))
+	require.Equal(2, majorVersion("github.com/katzenpost/client/v2"))
+	require.Equal(1, majorVersion("github.com/katzenpost/client/v1"))
+	require.Equal(1, majorVersion("github.com/katzenpost/client/vault"))
+	require.Equal(apiFile, apiFileName(1))
+	require.Equal("testdata/api.v2.txt", apiFileName(2))
+}
@@ -0,0 +1,94 @@
+// clock.go - injectable clock
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package clock provides the Clock interface of the timing logic so
+// that tests can substitute the real clock with a Fake one, which
+// simulates hours of protocol behavior in milliseconds.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time and creates timers
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// NewTimer creates a Timer firing once after the given duration
+	NewTimer(d time.Duration) Timer
+	// NewTicker creates a Ticker firing every given duration
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls the given function in it's own
+	// goroutine after the given duration
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event timer, see time.Timer
+type Timer interface {
+	// C returns the channel the time is sent on once the
+	// Timer fires, it's nil for the Timers of AfterFunc
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing, it returns
+	// false if the Timer has already fired or was stopped
+	Stop() bool
+	// Reset changes the Timer to fire after the given duration
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a periodic timer, see time.Ticker
+type Ticker interface {
+	// C returns the channel the ticks are sent on
+	C() <-chan time.Time
+	// Stop turns off the Ticker
+	Stop()
+}
+
+// Real is the Clock of the time package
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,108 @@
+// clock_test.go - clock tests
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Unix(1500000000, 0)
+	f := NewFake(start)
+	require.Equal(start, f.Now())
+
+	fired := []string{}
+	f.AfterFunc(2*time.Hour, func() {
+		fired = append(fired, "late")
+		require.Equal(start.Add(2*time.Hour), f.Now())
+	})
+	f.AfterFunc(time.Hour, func() {
+		fired = append(fired, "early")
+		// a timer created by a firing timer fires within the same Advance
+		f.AfterFunc(30*time.Minute, func() {
+			fired = append(fired, "chained")
+		})
+	})
+	stopped := f.AfterFunc(time.Minute, func() {
+		fired = append(fired, "stopped")
+	})
+	require.True(stopped.Stop())
+	require.False(stopped.Stop())
+
+	timer := f.NewTimer(90 * time.Minute)
+	ticker := f.NewTicker(time.Hour)
+	f.Advance(3 * time.Hour)
+	require.Equal(start.Add(3*time.Hour), f.Now())
+	require.Equal([]string{"early", "chained", "late"}, fired)
+	require.Equal(start.Add(90*time.Minute), <-timer.C())
+	require.False(timer.Stop())
+
+	// a ticker drops the ticks which aren't received
+	require.Equal(start.Add(time.Hour), <-ticker.C())
+	f.Advance(time.Hour)
+	require.Equal(start.Add(4*time.Hour), <-ticker.C())
+	ticker.Stop()
+	require.Equal(0, f.Pending())
+
+	require.True(timer.Reset(time.Minute) == false)
+	f.Advance(time.Minute)
+	require.Equal(start.Add(4*time.Hour+time.Minute), <-timer.C())
+}
+
+func TestFakeClockNext(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Unix(1500000000, 0)
+	f := NewFake(start)
+	timer := f.NewTimer(time.Minute)
+	ticks := make(chan time.Time, 1)
+	go func() {
+		// the goroutine waits for another timer once woken up
+		ticks <- <-timer.C()
+		f.NewTimer(time.Hour)
+	}()
+	f.AfterFunc(2*time.Minute, func() {})
+
+	end := start.Add(time.Hour)
+	require.True(f.Next(end))
+	require.Equal(start.Add(time.Minute), f.Now())
+	f.BlockUntil(1)
+	require.Equal(start.Add(time.Minute), <-ticks)
+	require.True(f.Next(end))
+	require.Equal(start.Add(2*time.Minute), f.Now())
+	require.False(f.Next(end), "a timer past the end fired")
+	require.Equal(1, f.Pending())
+}
+
+func TestRealClock(t *testing.T) {
+	require := require.New(t)
+
+	timer := Real.NewTimer(time.Millisecond)
+	<-timer.C()
+	ticker := Real.NewTicker(time.Millisecond)
+	<-ticker.C()
+	ticker.Stop()
+	done := make(chan struct{})
+	Real.AfterFunc(time.Millisecond, func() { close(done) })
+	<-done
+	require.False(Real.Now().IsZero())
+}
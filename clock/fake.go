@@ -0,0 +1,223 @@
+// fake.go - fake clock for tests
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when Advance is called,
+// the timers which expire meanwhile fire in the order of their
+// deadlines. The functions of AfterFunc are called synchronously
+// by Advance, at their deadline.
+type Fake struct {
+	sync.Mutex
+
+	now    time.Time
+	timers []*fakeTimer
+
+	// changed is signaled when a timer is added or removed
+	changed *sync.Cond
+}
+
+// NewFake creates a new Fake clock set to the given time
+func NewFake(now time.Time) *Fake {
+	f := Fake{
+		now: now,
+	}
+	f.changed = sync.NewCond(&f.Mutex)
+	return &f
+}
+
+// Now returns the current time of the Fake clock
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+// NewTimer creates a Timer firing once after the given duration
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: f,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// NewTicker creates a Ticker firing every given duration
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{
+		clock:  f,
+		c:      make(chan time.Time, 1),
+		period: d,
+	}
+	t.Reset(d)
+	return fakeTicker{t}
+}
+
+// AfterFunc calls the given function once the Fake
+// clock is advanced by the given duration
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{
+		clock: f,
+		fn:    fn,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the time of the Fake clock forward by the
+// given duration and fires the timers which expire meanwhile
+func (f *Fake) Advance(d time.Duration) {
+	f.Lock()
+	end := f.now.Add(d)
+	f.Unlock()
+	for f.Next(end) {
+	}
+	f.Lock()
+	f.now = end
+	f.Unlock()
+}
+
+// Pending returns the number of active timers
+func (f *Fake) Pending() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil blocks until the given number of timers created by
+// NewTimer or NewTicker are active, i.e. until the goroutines woken
+// up by the timers Next fired wait for their next timer
+func (f *Fake) BlockUntil(n int) {
+	f.Lock()
+	defer f.Unlock()
+	for f.waiting() < n {
+		f.changed.Wait()
+	}
+}
+
+// waiting returns the number of active timers created by NewTimer
+// or NewTicker, the caller must hold the lock
+func (f *Fake) waiting() int {
+	n := 0
+	for _, t := range f.timers {
+		if t.fn == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Next fires the first timer expiring by the given time, moving
+// the time of the Fake clock to it's deadline, and returns true,
+// or returns false if there is no such timer. Unlike Advance it
+// lets the caller wait for the goroutines the timer wakes up.
+func (f *Fake) Next(end time.Time) bool {
+	f.Lock()
+	if len(f.timers) == 0 || f.timers[0].deadline.After(end) {
+		f.Unlock()
+		return false
+	}
+	t := f.timers[0]
+	f.timers = f.timers[1:]
+	f.now = t.deadline
+	if t.period > 0 {
+		t.deadline = t.deadline.Add(t.period)
+		f.add(t)
+	}
+	now := f.now
+	f.Unlock()
+	if t.fn != nil {
+		t.fn()
+		return true
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+	return true
+}
+
+// add inserts the given timer ordered by deadline,
+// the caller must hold the lock
+func (f *Fake) add(t *fakeTimer) {
+	i := sort.Search(len(f.timers), func(i int) bool {
+		return f.timers[i].deadline.After(t.deadline)
+	})
+	f.timers = append(f.timers, nil)
+	copy(f.timers[i+1:], f.timers[i:])
+	f.timers[i] = t
+	f.changed.Broadcast()
+}
+
+// remove removes the given timer and returns
+// true if it was active, the caller must hold the lock
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			f.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTicker is the Ticker of the Fake clock
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// fakeTimer is the Timer of the Fake clock
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	fn       func()
+	period   time.Duration
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := t.clock.remove(t)
+	t.deadline = t.clock.now.Add(d)
+	t.clock.add(t)
+	return active
+}
@@ -0,0 +1,80 @@
+// main.go - database integrity checking command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mixclient-fsck checks the integrity of the client database after a
+// crash, reporting the undecodable and orphaned records, and repairs
+// it with -repair while the client is stopped:
+//
+//	mixclient-fsck /path/to/client.db
+//	mixclient-fsck -repair /path/to/client.db
+//
+// The repair moves the undecodable records into the corrupt bucket,
+// removes the orphaned records and rebuilds the replay cache indexes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/katzenpost/client/storage"
+)
+
+// exit codes from sysexits.h
+const (
+	exitUsage    = 64
+	exitFailure  = 1
+	exitProblems = 2
+)
+
+func main() {
+	flags := flag.NewFlagSet("mixclient-fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the problems, the client must be stopped")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: mixclient-fsck [-repair] database\n")
+		os.Exit(exitUsage)
+	}
+	var store *storage.Store
+	var err error
+	if *repair {
+		// the exclusive lock can't be taken while the client runs
+		store, err = storage.New(flags.Arg(0))
+	} else {
+		store, err = storage.OpenReadOnly(flags.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-fsck: failed to open %s: %s\n", flags.Arg(0), err)
+		os.Exit(exitFailure)
+	}
+	defer store.Close()
+	report, err := store.Fsck(*repair)
+	if report != nil {
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		fmt.Printf("%d records checked, %d problems, %d orphans, %d repaired\n", report.Records, len(report.Problems), report.Orphans(), report.Repaired)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-fsck: %s\n", err)
+		store.Close()
+		os.Exit(exitFailure)
+	}
+	if len(report.Problems) > report.Repaired {
+		store.Close()
+		os.Exit(exitProblems)
+	}
+}
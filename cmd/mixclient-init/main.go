@@ -0,0 +1,142 @@
+// main.go - configuration wizard command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mixclient-init generates a commented configuration file and the
+// account keys, asking for the account and the Provider unless they
+// are given as flags:
+//
+//	mixclient-init -config client.toml
+//	mixclient-init -config client.toml -email alice@acme.com -non-interactive
+//
+// The passphrase sealing the keys is read from the file given with
+// -passphrase-file, from the MIXCLIENT_PASSPHRASE environment variable
+// or, interactively, from the terminal without echoing it. The optional
+// duress passphrase, which opens decoy keys, is read from the file
+// given with -duress-passphrase-file.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/katzenpost/client/internal/config_wizard"
+	"golang.org/x/term"
+)
+
+// exitFailure is the exit code of a failure
+const exitFailure = 1
+
+// passphraseEnv is the environment variable holding the passphrase
+const passphraseEnv = "MIXCLIENT_PASSPHRASE"
+
+// readPassphrase returns the passphrase from the given
+// file, the environment or the terminal
+func readPassphrase(file string, interactive bool) (string, error) {
+	if file != "" {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	if !interactive {
+		return "", fmt.Errorf("no passphrase, use -passphrase-file or %s", passphraseEnv)
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no terminal to read the passphrase from, use -passphrase-file or %s", passphraseEnv)
+	}
+	fmt.Print("Passphrase of the keys: ")
+	raw, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	passphrase := string(raw)
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+func run() error {
+	flags := flag.NewFlagSet("mixclient-init", flag.ExitOnError)
+	path := flags.String("config", "client.toml", "configuration file to write")
+	email := flags.String("email", "", "e-mail address of the account, name@provider")
+	providerAddress := flags.String("provider-address", "", "optional host:port of the Provider")
+	providerKey := flags.String("provider-key", "", "optional PEM file of the Provider key to pin")
+	keysDir := flags.String("keys", "keys", "directory of the account keys")
+	smtp := flags.String("smtp", "", "SMTP proxy listen address, a free port by default")
+	pop3 := flags.String("pop3", "", "POP3 proxy listen address, a free port by default")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase of the keys")
+	duressPassphraseFile := flags.String("duress-passphrase-file", "", "optional file holding the duress passphrase opening decoy keys")
+	nonInteractive := flags.Bool("non-interactive", false, "don't ask, use the flags and defaults")
+	flags.Parse(os.Args[1:])
+
+	answers, err := config_wizard.Defaults(*keysDir)
+	if err != nil {
+		return err
+	}
+	answers.Email = *email
+	answers.ProviderAddress = *providerAddress
+	answers.ProviderKeyFile = *providerKey
+	if *smtp != "" {
+		answers.SMTPAddress = *smtp
+	}
+	if *pop3 != "" {
+		answers.POP3Address = *pop3
+	}
+	if *nonInteractive {
+		err = answers.Validate()
+	} else {
+		err = config_wizard.Prompt(os.Stdin, os.Stdout, answers)
+	}
+	if err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase(*passphraseFile, !*nonInteractive)
+	if err != nil {
+		return err
+	}
+	if *duressPassphraseFile != "" {
+		answers.DuressPassphrase, err = readPassphrase(*duressPassphraseFile, false)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = config_wizard.Write(*path, answers, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and the keys of %s to %s\n", *path, answers.Email, answers.KeysDir)
+	fmt.Printf("configure the mail client with SMTP %s and POP3 %s\n", answers.SMTPAddress, answers.POP3Address)
+	return nil
+}
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-init: %s\n", err)
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,165 @@
+// main.go - mnemonic key backup command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mixclient-mnemonic exports the keys of an account as a mnemonic
+// phrase, which is printed to be written down, and restores them from
+// the mnemonic after the loss of the device:
+//
+//	mixclient-mnemonic export -email alice@acme.com -keys keys
+//	mixclient-mnemonic restore -email alice@acme.com -keys keys
+//
+// restore reads the mnemonic from the standard input. The 18 word
+// mnemonics of the first version, from which new keys were derived
+// with the new command, are still restored: export the restored keys
+// to get the mnemonic replacing it. The passphrase
+// sealing the keys is read from the file given with -passphrase-file
+// or from the MIXCLIENT_PASSPHRASE environment variable.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/recovery_kit"
+)
+
+// exit codes from sysexits.h
+const (
+	exitUsage   = 64
+	exitFailure = 1
+)
+
+// passphraseEnv is the environment variable holding the passphrase
+const passphraseEnv = "MIXCLIENT_PASSPHRASE"
+
+// readPassphrase returns the passphrase from
+// the given file or from the environment
+func readPassphrase(file string) (string, error) {
+	if file != "" {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	return "", fmt.Errorf("no passphrase, use -passphrase-file or %s", passphraseEnv)
+}
+
+// parseArgs returns the account, the keys
+// directory and the passphrase given by the arguments
+func parseArgs(command string, args []string) (*config.Account, string, string, error) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	email := flags.String("email", "", "e-mail address of the account, name@provider")
+	keysDir := flags.String("keys", "keys", "directory of the account keys")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase of the keys")
+	flags.Parse(args)
+	if *email == "" {
+		return nil, "", "", errors.New("-email is required")
+	}
+	name, provider, err := config.SplitEmail(*email)
+	if err != nil {
+		return nil, "", "", err
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return &config.Account{Name: name, Provider: provider}, *keysDir, passphrase, nil
+}
+
+// exportKeys prints the mnemonic of the keys of
+// the account given by the arguments
+func exportKeys(args []string) error {
+	account, keysDir, passphrase, err := parseArgs("export", args)
+	if err != nil {
+		return err
+	}
+	cfg := config.Config{}
+	linkKey, err := cfg.GetAccountKey(constants.LinkLayerKeyType, *account, keysDir, passphrase)
+	if err != nil {
+		return err
+	}
+	endToEndKey, err := cfg.GetAccountKey(constants.EndToEndKeyType, *account, keysDir, passphrase)
+	if err != nil {
+		return err
+	}
+	mnemonic := recovery_kit.Mnemonic(&recovery_kit.Account{
+		Address:     account.Name + "@" + account.Provider,
+		LinkKey:     linkKey,
+		EndToEndKey: endToEndKey,
+	})
+	fmt.Fprintln(os.Stderr, "Write down the mnemonic below and keep it in a safe place,")
+	fmt.Fprintln(os.Stderr, "anyone knowing it has the keys of the account:")
+	fmt.Println(mnemonic)
+	return nil
+}
+
+// restoreKeys writes the keys of the mnemonic read from the standard
+// input to the keys directory given by the arguments
+func restoreKeys(args []string) error {
+	account, keysDir, passphrase, err := parseArgs("restore", args)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Mnemonic, terminated by end of file:")
+	mnemonic, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	restored, err := recovery_kit.MnemonicAccount(string(mnemonic), account.Name+"@"+account.Provider)
+	if err != nil {
+		return err
+	}
+	kit := recovery_kit.Kit{
+		Accounts: []*recovery_kit.Account{restored},
+	}
+	_, err = kit.Restore(keysDir, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote the keys of %s to %s\n", restored.Address, keysDir)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: mixclient-mnemonic export|restore [options]\n")
+		os.Exit(exitUsage)
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = exportKeys(os.Args[2:])
+	case "restore":
+		err = restoreKeys(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "mixclient-mnemonic: unknown command %s\n", os.Args[1])
+		os.Exit(exitUsage)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-mnemonic: %s\n", err)
+		os.Exit(exitFailure)
+	}
+}
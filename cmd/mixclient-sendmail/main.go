@@ -0,0 +1,47 @@
+// main.go - sendmail compatible message injection
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mixclient-sendmail reads a message from stdin and submits it to
+// the SMTP proxy of a running client, it can be installed as
+// /usr/sbin/sendmail. See package sendmail for the supported options.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/katzenpost/client/internal/sendmail"
+)
+
+// exit codes from sysexits.h
+const (
+	exitUsage    = 64
+	exitTempFail = 75
+)
+
+func main() {
+	options, err := sendmail.ParseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-sendmail: %s\n", err)
+		os.Exit(exitUsage)
+	}
+	options.Password = os.Getenv(sendmail.PasswordEnv)
+	err = sendmail.Submit(options, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-sendmail: %s\n", err)
+		os.Exit(exitTempFail)
+	}
+}
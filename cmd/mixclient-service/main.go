@@ -0,0 +1,80 @@
+// main.go - service installation command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// mixclient-service installs the client daemon as a Windows service
+// or as a macOS launchd agent so that it runs without a foreground
+// terminal, and removes it again:
+//
+//	mixclient-service install -name mixclient /path/to/daemon -c client.toml
+//	mixclient-service uninstall -name mixclient
+//
+// On Linux the daemon is run by systemd, see package systemd.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/client/internal/service"
+)
+
+// exit codes from sysexits.h
+const (
+	exitUsage   = 64
+	exitFailure = 1
+)
+
+// install registers the daemon given by
+// the arguments with the service manager
+func install(args []string) error {
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	name := flags.String("name", service.DefaultName, "service name")
+	displayName := flags.String("display-name", "Panoramix mix network client", "human readable service name")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return errors.New("install requires the daemon executable")
+	}
+	executable, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return service.Install(&service.Config{
+		Name:        *name,
+		DisplayName: *displayName,
+		Description: "SMTP and POP3 proxies of the mix network client",
+		Executable:  executable,
+		Args:        flags.Args()[1:],
+	})
+}
+
+// uninstall removes the service
+func uninstall(args []string) error {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	name := flags.String("name", service.DefaultName, "service name")
+	flags.Parse(args)
+	return service.Uninstall(&service.Config{Name: *name})
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: mixclient-service install|uninstall [options]\n")
+		os.Exit(exitUsage)
+	}
+	var err error
+	switch os.Args[1] {
+	case "install":
+		err = install(os.Args[2:])
+	case "uninstall":
+		err = uninstall(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "mixclient-service: unknown command %s\n", os.Args[1])
+		os.Exit(exitUsage)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-service: %s\n", err)
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,125 @@
+// main.go - mixnet simulation command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mixclient-simulate runs many in-process clients over a modeled
+// mix network and prints the latency, loss and queue statistics,
+// to tune the λ parameters shipped as defaults:
+//
+//	mixclient-simulate -clients 20 -duration 2h -loss 0.05 -delay exp:2s
+//
+// The network delays are given as const:<d>, uniform:<min>-<max>
+// or exp:<mean>, they're disabled by default.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/client/internal/mock_mixnet"
+	"github.com/katzenpost/client/internal/simulation"
+)
+
+// exitFailure is the exit code of a failure
+const exitFailure = 1
+
+// parseDelay returns the Delay of the given description
+func parseDelay(s string) (mock_mixnet.Delay, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid delay %q", s)
+	}
+	switch fields[0] {
+	case "const":
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return mock_mixnet.ConstantDelay(d), nil
+	case "uniform":
+		bounds := strings.SplitN(fields[1], "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid uniform delay %q", s)
+		}
+		min, err := time.ParseDuration(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		max, err := time.ParseDuration(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		return mock_mixnet.UniformDelay(min, max), nil
+	case "exp":
+		mean, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return mock_mixnet.ExponentialDelay(mean), nil
+	}
+	return nil, fmt.Errorf("unknown delay distribution %q", fields[0])
+}
+
+func run() error {
+	flags := flag.NewFlagSet("mixclient-simulate", flag.ExitOnError)
+	clients := flags.Int("clients", 10, "number of clients")
+	providers := flags.Int("providers", 2, "number of Providers")
+	duration := flags.Duration("duration", time.Hour, "duration of the synthetic traffic")
+	drain := flags.Duration("drain", 30*time.Minute, "duration without new messages for the retransmissions to complete")
+	step := flags.Duration("step", time.Second, "simulation step")
+	messageInterval := flags.Duration("message-interval", 10*time.Minute, "mean interval between the messages of a client")
+	messageSize := flags.Int("message-size", 1024, "size in bytes of the message bodies")
+	loss := flags.Float64("loss", 0, "probability of a packet to be dropped")
+	delay := flags.String("delay", "", "network delay distribution, const:<d>, uniform:<min>-<max> or exp:<mean>")
+	lambda := flags.Float64("lambda", mock_mixnet.Lambda, "inverse of the mean per hop delay in milliseconds")
+	sendInterval := flags.Duration("send-interval", 0, "mean interval between two send slots, disabled if zero")
+	flags.Parse(os.Args[1:])
+
+	d, err := parseDelay(*delay)
+	if err != nil {
+		return err
+	}
+	report, err := simulation.Run(&simulation.Config{
+		Clients:         *clients,
+		Providers:       *providers,
+		Duration:        *duration,
+		Drain:           *drain,
+		Step:            *step,
+		MessageInterval: *messageInterval,
+		MessageSize:     *messageSize,
+		Loss:            *loss,
+		Delay:           d,
+		Lambda:          *lambda,
+		SendInterval:    *sendInterval,
+	})
+	if err != nil {
+		return err
+	}
+	return report.Write(os.Stdout)
+}
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-simulate: %s\n", err)
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,127 @@
+// main.go - static PKI file writer
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mixclient-staticpki writes the CBOR static PKI files read by
+// mix_pki.StaticPKIFromFile, for integration tests and air-gapped
+// deployments:
+//
+//	mixclient-staticpki generate -out pki.cbor -keys keys.cbor -providers acme.com,nsa.gov
+//	mixclient-staticpki merge -out pki.cbor old.cbor new.cbor
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/katzenpost/client/mix_pki"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+)
+
+// exit codes from sysexits.h
+const (
+	exitUsage   = 64
+	exitFailure = 1
+)
+
+// generate writes a synthetic topology with fresh keys
+func generate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := flags.String("out", "", "static PKI file to write")
+	keys := flags.String("keys", "", "optional file to write the CBOR private mix keys to")
+	layers := flags.Int("layers", 3, "number of mix layers")
+	mixes := flags.Int("mixes", 2, "number of mixes per layer")
+	providers := flags.String("providers", "", "comma separated Provider names")
+	epochs := flags.Int("epochs", 4, "number of epochs, starting with the current one")
+	basePort := flags.Int("port", 0, "port of the first node on 127.0.0.1, no addresses if zero")
+	flags.Parse(args)
+	if *out == "" || *providers == "" {
+		return errors.New("generate requires -out and -providers")
+	}
+	epoch, _, _ := epochtime.Now()
+	staticPKI, mixKeys, err := mix_pki.GenerateStaticPKI(rand.Reader, &mix_pki.Topology{
+		Layers:        *layers,
+		MixesPerLayer: *mixes,
+		Providers:     strings.Split(*providers, ","),
+		StartEpoch:    epoch,
+		Epochs:        *epochs,
+		BasePort:      *basePort,
+	})
+	if err != nil {
+		return err
+	}
+	err = staticPKI.WriteFile(*out)
+	if err != nil {
+		return err
+	}
+	if *keys == "" {
+		return nil
+	}
+	b, err := mix_pki.CBORKeysFromMap(mixKeys)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*keys, b, 0600)
+}
+
+// merge writes the documents of several static PKI files to one
+func merge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := flags.String("out", "", "static PKI file to write")
+	flags.Parse(args)
+	if *out == "" || flags.NArg() == 0 {
+		return errors.New("merge requires -out and one or more static PKI files")
+	}
+	documents := []*pki.Document{}
+	for _, fileName := range flags.Args() {
+		staticPKI, err := mix_pki.StaticPKIFromFile(fileName)
+		if err != nil {
+			return fmt.Errorf("%s: %s", fileName, err)
+		}
+		documents = append(documents, staticPKI.Documents()...)
+	}
+	staticPKI, err := mix_pki.StaticPKIFromDocuments(documents)
+	if err != nil {
+		return err
+	}
+	return staticPKI.WriteFile(*out)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: mixclient-staticpki generate|merge [options]\n")
+		os.Exit(exitUsage)
+	}
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = generate(os.Args[2:])
+	case "merge":
+		err = merge(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "mixclient-staticpki: unknown command %s\n", os.Args[1])
+		os.Exit(exitUsage)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixclient-staticpki: %s\n", err)
+		os.Exit(exitFailure)
+	}
+}
@@ -21,14 +21,20 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"strings"
+	"time"
 
-	"github.com/katzenpost/client/constants"
 	"github.com/katzenpost/client/crypto/vault"
+	"github.com/katzenpost/client/internal/auth"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/key_store"
 	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/crypto/rand"
 	"github.com/op/go-logging"
 	"github.com/pelletier/go-toml"
 )
@@ -44,6 +50,57 @@ type Account struct {
 	// Provider is the second part of an e-mail address
 	// after the @-sign.
 	Provider string
+	// SendChannels is the number of wire protocol sessions
+	// the account's egress Blocks are striped across, if
+	// the Provider permits concurrent sessions. One
+	// session is used if zero.
+	SendChannels int
+	// SendWindow is the maximum number of un-ACKed Blocks
+	// in flight on each send channel, unlimited if zero
+	SendWindow int
+	// MonthlyUsageCap is the maximum number of bytes sent and
+	// received per month, once reached sending is paused until
+	// the next month. Unlimited if zero.
+	MonthlyUsageCap int
+	// MailboxQuota is the maximum number of bytes of the messages
+	// in the account's mailbox, the messages which don't fit are
+	// deferred until space is freed. Unlimited if zero.
+	MailboxQuota int
+	// Language is the language of the messages the client
+	// generates for the account, e.g. "de" or "pt-BR". English
+	// if empty or if no catalog of the language is registered.
+	Language string
+	// FallbackAddresses are the addresses of the Provider which
+	// are tried after it's published endpoints, e.g. those of a
+	// standby host. They must present the Provider's identity key.
+	FallbackAddresses []string
+	// FailoverAttempts is the number of connection attempts to
+	// an endpoint before failing over to the next one, one if zero
+	FailoverAttempts int
+	// InvitationToken is the invitation token of a new account,
+	// which is registered with the Provider before the proxies
+	// are started, see package registration
+	InvitationToken string
+	// RegistrationURL is the http URL of the Provider's user
+	// registration service, e.g. http://provider.example:36968,
+	// required with InvitationToken. It's connected to over the
+	// Provider's Transport, see package registration.
+	RegistrationURL string
+	// ProxyPassword is the password the mail clients must present
+	// to the POP3 proxy to access the account's mailbox and to the
+	// SMTP proxy to send as the account, neither is possible if
+	// both it and ProxyPasswordHash are empty. It's also the secret
+	// of the APOP authentication.
+	ProxyPassword string
+	// ProxyPasswordHash is the hash of the POP3 proxy password, see
+	// auth.HashPassword, which keeps the password out of the
+	// configuration file. The mail clients must then authenticate
+	// with USER and PASS or AUTH PLAIN instead of APOP.
+	ProxyPasswordHash string
+	// TrafficProfile is the name of the account's traffic profile,
+	// a built-in one or one of the TrafficProfile sections. If empty
+	// the SendSlots section applies, see AccountTrafficProfile
+	TrafficProfile string
 }
 
 // ProviderPinning is used to deserialize the
@@ -55,26 +112,840 @@ type ProviderPinning struct {
 	Name string
 }
 
+// Alias is used to deserialize the optional alias sections of
+// the configuration file, which name recipients for the SMTP proxy
+type Alias struct {
+	// Name is the local name used as the recipient address
+	Name string
+	// Address is the e-mail address the name expands to, it
+	// may carry a plus tag, e.g. bob+lists@acme
+	Address string
+}
+
+// Splitting is used to deserialize the optional message
+// splitting section of the configuration file
+type Splitting struct {
+	// MaxBlocks is the maximum number of Blocks of a mixnet message,
+	// larger messages are split into several mixnet messages which
+	// the recipient joins. If zero, the limit of the 16 bit
+	// TotalBlocks field of the Block header applies.
+	MaxBlocks int
+	// MaxParts is the maximum number of mixnet messages a message
+	// is split into, larger messages are rejected. If zero,
+	// constants.DefaultMaxSplitParts is used.
+	MaxParts int
+}
+
+// MailFilter is used to deserialize the optional mail filter
+// section of the configuration file, see package mail_filter
+type MailFilter struct {
+	// ContactsOnly discards the received messages whose
+	// senders aren't in the contact book
+	ContactsOnly bool
+	// MessagesPerMinute is the maximum rate of messages received
+	// from a single sender, further messages are discarded.
+	// If zero, the rate is unlimited.
+	MessagesPerMinute int
+	// Command is the path of the optional filter command, the
+	// message is written to it's standard input and it's
+	// discarded if the command exits with status 1
+	Command string
+	// Args are the arguments of the command
+	Args []string
+	// Rule are the optional rules filing the received messages
+	// into folders, the first matching rule applies
+	Rule []Rule
+	// Sieve is the path of an optional script in a subset of the
+	// Sieve language (RFC 5228) filing the received messages into
+	// folders, it's exclusive with Rule
+	Sieve string
+}
+
+// Rule is used to deserialize the optional mail filtering rule
+// sections of the configuration file, a rule matches a message if
+// all of it's conditions are met
+type Rule struct {
+	// Header is the name of a header the message must have
+	Header string
+	// Contains is a string the Header must contain, the
+	// comparison is case insensitive
+	Contains string
+	// Sender is a pattern the address of the From header must
+	// match, where * matches any string, e.g. *@lists.acme.com
+	Sender string
+	// LargerThan is the size in bytes the message must exceed
+	LargerThan int
+	// SmallerThan is the size in bytes the message must be below
+	SmallerThan int
+	// Folder is the folder the matching messages are filed into
+	Folder string
+	// MarkRead marks the matching messages as read
+	MarkRead bool
+	// Discard drops the matching messages
+	Discard bool
+}
+
+// Transport is used to deserialize the optional transport sections
+// of the configuration file which select how the client connects to
+// a Provider, the Provider is dialed over plain TCP if unspecified
+type Transport struct {
+	// Provider is the name of the Provider
+	Provider string
+	// Type is the transport type, "tcp", "socks5" or "obfs4"
+	Type string
+	// ProxyAddress is the address of the SOCKS5 proxy, or the
+	// SOCKS5 listener of the obfs4 client e.g. obfs4proxy
+	ProxyAddress string
+	// ProxyUser and ProxyPassword are the optional
+	// credentials of the SOCKS5 proxy
+	ProxyUser     string
+	ProxyPassword string
+	// Address is dialed instead of the Provider's endpoints
+	// if not empty, e.g. the address of it's obfs4 bridge
+	Address string
+	// Args are the arguments of the obfs4 bridge,
+	// e.g. "cert=...;iat-mode=0"
+	Args string
+}
+
 // Proxy is used to deserialize the proxy
 // configuration sections of the configuration
 // for the SMTP and POP3 proxies.
 type Proxy struct {
 	// Network is the transport type e.g. "tcp"
 	Network string
-	// Address is the transport address
+	// Address is the transport address, a port
+	// of 0 binds the listener to a random free port
+	Address string
+}
+
+// AutoConfig is used to deserialize the optional auto-configuration
+// section of the configuration file, see package autoconfig
+type AutoConfig struct {
+	// File is the path of the file describing the active
+	// proxy ports and account credentials, it isn't
+	// written if empty
+	File string
+	// ThunderbirdFile is the path of the optional Thunderbird
+	// autoconfig XML file for the first account
+	ThunderbirdFile string
+}
+
+// Ordering is used to deserialize the optional
+// conversation ordering section of the configuration file
+type Ordering struct {
+	// Enabled adds sequence numbers to outgoing messages
+	// and delivers incoming messages of a conversation
+	// to the mailbox in order
+	Enabled bool
+	// HoldTime is the maximum number of seconds an out of order
+	// message is held back waiting for the preceding messages.
+	// If zero, constants.DefaultOrderingHoldTime is used.
+	HoldTime int
+}
+
+// Maildir is used to deserialize the optional Maildir
+// delivery section of the configuration file
+type Maildir struct {
+	// Path is the directory below which a Maildir is
+	// created for each account, Maildir delivery is
+	// disabled if empty
+	Path string
+	// KeepPOP3 also delivers the messages to the
+	// pop3 mailbox served by the POP3 proxy
+	KeepPOP3 bool
+}
+
+// RateLimit is used to deserialize the optional rate limit
+// section of the configuration file, a limit of zero
+// selects the default from package constants
+type RateLimit struct {
+	// MessagesPerMinute is the maximum number of messages
+	// submitted per minute from a single source IP address
+	MessagesPerMinute int
+	// AccountMessagesPerMinute is the maximum number of
+	// messages submitted per minute by a single account
+	AccountMessagesPerMinute int
+	// MaxConnections is the maximum number of concurrent
+	// connections from a single source IP address
+	MaxConnections int
+}
+
+// Spool is used to deserialize the optional spool section of the
+// configuration file which fragments large messages from disk. The
+// submitted message is still received in memory, the spool spares
+// the copies made while it's fragmented, see proxy.SubmitProxy.SetSpool.
+type Spool struct {
+	// Directory is the directory of the encrypted spool files,
+	// the default temporary directory is used if empty
+	Directory string
+	// Threshold is the size in bytes above which submitted
+	// messages are spooled, spooling is disabled if zero
+	Threshold int
+}
+
+// FlowControl is used to deserialize the optional flow control
+// section of the configuration file, the watermarks count the
+// Blocks queued for sending, see proxy.SendScheduler.SetWatermarks
+type FlowControl struct {
+	// HighWatermark is the number of queued Blocks above which
+	// submissions are refused with a temporary failure. If zero,
+	// constants.DefaultQueueHighWatermark is used.
+	HighWatermark int
+	// LowWatermark is the number of queued Blocks below which
+	// submissions are accepted again. If zero, three quarters
+	// of the high watermark.
+	LowWatermark int
+}
+
+// SendLedger is used to deserialize the optional send ledger
+// section of the configuration file, see package send_ledger
+type SendLedger struct {
+	// Directory is the directory of the encrypted ledger of the
+	// sent messages, no ledger is kept if empty. The ledger key
+	// is sealed with the passphrase of the account keys.
+	Directory string
+}
+
+// Duress is used to deserialize the optional duress section of the
+// configuration file. The keys generated with a duress passphrase,
+// see GenerateKeysWithDuress, open as decoys with it.
+type Duress struct {
+	// DestroyKeys replaces the real account keys with random
+	// data once they're opened with the duress passphrase
+	DestroyKeys bool
+}
+
+// PKIPrefetch is used to deserialize the optional PKI prefetch
+// section of the configuration file, see mix_pki.Prefetcher
+type PKIPrefetch struct {
+	// MinLeadTime is the minimum number of seconds before an epoch
+	// boundary at which the next PKI document is fetched. If zero,
+	// constants.DefaultPKIPrefetchLead is used.
+	MinLeadTime int
+	// Jitter is the maximum number of seconds randomly added to the
+	// lead time of each prefetch. If zero,
+	// constants.DefaultPKIPrefetchJitter is used.
+	Jitter int
+}
+
+// PKIAuthority is used to deserialize the authority
+// sections of the PKI consensus configuration
+type PKIAuthority struct {
+	// Name is the name of the authority
+	Name string
+	// URL is the base URL of the authority's signed PKI documents
+	URL string
+	// PublicKey is the hex or base64 encoded signing key of the authority
+	PublicKey string
+}
+
+// PKIConsensus is used to deserialize the optional PKI consensus
+// section of the configuration file, see mix_pki.ConsensusPKI
+type PKIConsensus struct {
+	// Threshold is the number of authorities which must sign
+	// the same PKI document for the client to accept it
+	Threshold int
+	// Authority are the PKI authorities
+	Authority []PKIAuthority
+}
+
+// DiskSpace is used to deserialize the optional disk space section
+// of the configuration file, see package disk_space
+type DiskSpace struct {
+	// MinFree is the number of MiB which must be free on each volume
+	// holding the database, the spool files and the Maildirs for
+	// submissions to be accepted. If zero,
+	// constants.DefaultMinFreeDiskSpace is used.
+	MinFree int
+}
+
+// ClockSkew is used to deserialize the optional clock skew section
+// of the configuration file, see mix_pki.SkewMonitor
+type ClockSkew struct {
+	// MaxSkew is the number of seconds the local clock may be off
+	// the clocks of the PKI authorities before it's reported. If
+	// zero, constants.DefaultMaxClockSkew is used.
+	MaxSkew int
+	// RefuseSend holds back the Blocks while the skew exceeds
+	// MaxSkew instead of only logging a warning
+	RefuseSend bool
+}
+
+// SendSlots is used to deserialize the optional send slot section
+// of the configuration file which sends the Blocks in exponentially
+// distributed slots, one Block per slot, instead of immediately
+type SendSlots struct {
+	// Enabled sends the Blocks in send slots
+	Enabled bool
+	// MeanInterval is the mean number of milliseconds between two
+	// slots. If zero, constants.DefaultSendSlotInterval is used.
+	MeanInterval int
+	// PrioritizeInteractive sends the Blocks of interactive
+	// messages ahead of the queued bulk transfers
+	PrioritizeInteractive bool
+}
+
+// Fetch is used to deserialize the optional fetch section of the
+// configuration file which sets how often the queued messages are
+// retrieved from the Provider
+type Fetch struct {
+	// MeanInterval is the mean number of milliseconds between two
+	// retrievals. If zero, constants.DefaultFetchInterval is used.
+	MeanInterval int
+	// MaxBatch is the maximum number of messages retrieved back to
+	// back while the Provider reports more queued messages. If zero,
+	// constants.DefaultMaxFetchBatch is used.
+	MaxBatch int
+	// ReassemblyWorkers is the number of workers reassembling the
+	// retrieved messages in parallel. If zero,
+	// constants.DefaultReassemblyWorkers is used.
+	ReassemblyWorkers int
+}
+
+// Services is used to deserialize the optional services section
+// of the configuration file which disables individual subsystems
+// so that minimal deployments don't expose unnecessary surfaces
+type Services struct {
+	// DisableSMTP disables the SMTP submission proxy listener
+	DisableSMTP bool
+	// DisablePOP3 disables the POP3 receive proxy listener
+	DisablePOP3 bool
+	// DisableCoverTraffic disables the sending of decoy traffic
+	DisableCoverTraffic bool
+	// SendOnly disables the POP3 listener and discards received
+	// messages, retrieval still runs so that ACKs are processed
+	SendOnly bool
+	// ReceiveOnly disables the SMTP listener and message sending
+	ReceiveOnly bool
+}
+
+// Notifier is used to deserialize the optional notifier sections
+// of the configuration file, see package notify
+type Notifier struct {
+	// Type is the type of the notifier, "command", "desktop",
+	// "fifo" or "audit"
+	Type string
+	// Command is the path of the command run by a command notifier,
+	// the event is passed in MIXCLIENT_EVENT_* environment variables
+	Command string
+	// Args are the arguments of the command
+	Args []string
+	// Path is the path of the FIFO a fifo notifier writes the
+	// events to as JSON lines, or of the audit log file, whose
+	// secret is sealed next to it with the keys' passphrase
+	Path string
+	// Events are the types of the events which are notified,
+	// if empty message_acked, message_arrived, session_lost
+	// and message_bounced, or every event for an audit notifier
+	Events []string
+}
+
+// HealthCheck is used to deserialize the optional health check
+// section of the configuration file, see package health_check
+type HealthCheck struct {
+	// Address is the localhost address of the /healthz and
+	// /readyz HTTP endpoints, they are disabled if empty
 	Address string
 }
 
+// Management is used to deserialize the optional management socket
+// section of the configuration file, see package management
+type Management struct {
+	// Path is the path of the unix domain management
+	// socket, it's disabled if empty
+	Path string
+}
+
+// The names of the built-in traffic profiles
+const (
+	ParanoidProfile     = "paranoid"
+	BalancedProfile     = "balanced"
+	LowBandwidthProfile = "low-bandwidth"
+)
+
+// TrafficProfile is used to deserialize the optional traffic profile
+// sections of the configuration file. A profile is a named set of
+// the parameters trading latency and bandwidth for anonymity, the
+// intervals are the mean number of milliseconds between two events
+// of the exponentially distributed (Poisson) processes
+type TrafficProfile struct {
+	// Name is the name of the profile, a profile named
+	// after a built-in profile replaces the built-in one
+	Name string
+	// PayloadInterval is the mean interval between two send slots
+	// of the account (1/λP), SendSlots MeanInterval applies if zero
+	PayloadInterval int
+	// LoopInterval is the mean interval between two
+	// loop decoy messages (1/λL)
+	LoopInterval int
+	// DropInterval is the mean interval between two
+	// drop decoy messages (1/λD)
+	DropInterval int
+	// MaxBurst is the maximum number of queued Blocks
+	// sent in one send slot, one if zero
+	MaxBurst int
+}
+
+// builtinTrafficProfiles returns the built-in traffic profiles
+func builtinTrafficProfiles() map[string]*TrafficProfile {
+	return map[string]*TrafficProfile{
+		ParanoidProfile: &TrafficProfile{
+			Name:            ParanoidProfile,
+			PayloadInterval: 2000,
+			LoopInterval:    2000,
+			DropInterval:    2000,
+			MaxBurst:        1,
+		},
+		BalancedProfile: &TrafficProfile{
+			Name:            BalancedProfile,
+			PayloadInterval: 10000,
+			LoopInterval:    30000,
+			DropInterval:    30000,
+			MaxBurst:        2,
+		},
+		LowBandwidthProfile: &TrafficProfile{
+			Name:            LowBandwidthProfile,
+			PayloadInterval: 60000,
+			LoopInterval:    300000,
+			DropInterval:    300000,
+			MaxBurst:        4,
+		},
+	}
+}
+
 // Config is used to deserialize the configuration file
 type Config struct {
 	// Account is the list of accounts represented by this client configuration
 	Account []Account
 	// ProviderPinning is an optional list of pinned Provider public keys
 	ProviderPinning []ProviderPinning
+	// Alias is an optional list of local recipient aliases
+	Alias []Alias
+	// Transport optionally selects how the client connects
+	// to each Provider, see package transport
+	Transport []Transport
 	// SMTPProxy is the transport configuration of the SMTP submission proxy
 	SMTPProxy Proxy
 	// POP3Proxy is the transport configuration of the POP3 receive proxy
 	POP3Proxy Proxy
+	// DisableCompression disables compression of bulk wire protocol
+	// payloads even if the Provider advertises support for it
+	DisableCompression bool
+	// Ordering is the optional conversation ordering configuration
+	Ordering Ordering
+	// EndToEndEncryption encrypts outgoing messages to the
+	// recipient's key published in the user PKI
+	EndToEndEncryption bool
+	// HybridEncryption enables the experimental post-quantum hybrid
+	// end to end encryption with the recipients which advertise an
+	// ML-KEM key, it implies EndToEndEncryption
+	HybridEncryption bool
+	// MaxMessageSize is the maximum size in bytes of a submitted
+	// message. If zero, constants.DefaultMaxMessageSize is used.
+	MaxMessageSize int
+	// CompressOversizeMessages compresses messages exceeding
+	// MaxMessageSize instead of rejecting them outright
+	CompressOversizeMessages bool
+	// Splitting is the optional message splitting configuration
+	Splitting Splitting
+	// MailFilter is the optional received mail filter configuration
+	MailFilter MailFilter
+	// Services optionally disables individual subsystems
+	Services Services
+	// Maildir is the optional Maildir delivery configuration
+	Maildir Maildir
+	// AutoConfig is the optional mail client auto-configuration
+	AutoConfig AutoConfig
+	// RateLimit is the optional local proxy rate limit configuration
+	RateLimit RateLimit
+	// SendSlots is the optional send slot configuration
+	SendSlots SendSlots
+	// Fetch is the optional message retrieval configuration
+	Fetch Fetch
+	// Spool is the optional large message spool configuration
+	Spool Spool
+	// FlowControl is the optional send queue flow control configuration
+	FlowControl FlowControl
+	// Ephemeral keeps all the client state in memory, nothing
+	// is persisted and it's all lost when the client stops,
+	// see storage.NewEphemeral
+	Ephemeral bool
+	// StatusFile is the path of the optional file holding the
+	// number of unread messages of each account for desktop
+	// status bars, see package status_file
+	StatusFile string
+	// PKIPrefetch is the optional PKI prefetch configuration
+	PKIPrefetch PKIPrefetch
+	// PKIConsensus is the optional PKI consensus configuration
+	PKIConsensus PKIConsensus
+	// ClockSkew is the optional clock skew detection configuration
+	ClockSkew ClockSkew
+	// DiskSpace is the optional disk space monitoring configuration
+	DiskSpace DiskSpace
+	// SendLedger is the optional send ledger configuration
+	SendLedger SendLedger
+	// Duress is the optional duress passphrase configuration
+	Duress Duress
+	// HealthCheck is the optional health check endpoint configuration
+	HealthCheck HealthCheck
+	// Notifier are the optional user facing notifiers
+	Notifier []Notifier
+	// TrafficProfile are the optional custom traffic profiles
+	TrafficProfile []TrafficProfile
+	// Management is the optional management socket configuration
+	Management Management
+	// LowPower starts the client in the low power mode for mobile
+	// devices on battery, see package power
+	LowPower bool
+	// AuditGC only logs the records which the retention and
+	// garbage collection policies would remove, nothing is removed
+	AuditGC bool
+	// Debug enables the debugging capabilities which weaken the
+	// anonymity of the client, e.g. the route pinning of
+	// path_selection.RouteFactory, never enable it in production
+	Debug bool
+}
+
+// SMTPEnabled returns true if the SMTP submission proxy is enabled
+func (c *Config) SMTPEnabled() bool {
+	return !c.Services.DisableSMTP && !c.Services.ReceiveOnly
+}
+
+// POP3Enabled returns true if the POP3 receive proxy is enabled
+func (c *Config) POP3Enabled() bool {
+	return !c.Services.DisablePOP3 && !c.Services.SendOnly
+}
+
+// SendEnabled returns true if messages may be sent
+func (c *Config) SendEnabled() bool {
+	return !c.Services.ReceiveOnly
+}
+
+// DeliveryEnabled returns true if received messages
+// are delivered to the mailboxes
+func (c *Config) DeliveryEnabled() bool {
+	return !c.Services.SendOnly
+}
+
+// CoverTrafficEnabled returns true if decoy traffic may be sent
+func (c *Config) CoverTrafficEnabled() bool {
+	return !c.Services.DisableCoverTraffic && !c.Services.ReceiveOnly
+}
+
+// validate returns an error if the configuration is inconsistent
+func (c *Config) validate() error {
+	if c.Services.SendOnly && c.Services.ReceiveOnly {
+		return errors.New("SendOnly and ReceiveOnly are mutually exclusive")
+	}
+	for _, acct := range c.Account {
+		if acct.FailoverAttempts < 0 {
+			return fmt.Errorf("%s@%s: FailoverAttempts must not be negative", acct.Name, acct.Provider)
+		}
+		if acct.InvitationToken != "" && acct.RegistrationURL == "" {
+			return fmt.Errorf("%s@%s: InvitationToken without RegistrationURL", acct.Name, acct.Provider)
+		}
+		for _, address := range acct.FallbackAddresses {
+			_, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("%s@%s: invalid fallback address %s: %s", acct.Name, acct.Provider, address, err)
+			}
+		}
+		if acct.ProxyPasswordHash != "" {
+			if acct.ProxyPassword != "" {
+				return fmt.Errorf("%s@%s: ProxyPassword and ProxyPasswordHash are mutually exclusive", acct.Name, acct.Provider)
+			}
+			err := auth.ValidatePasswordHash(acct.ProxyPasswordHash)
+			if err != nil {
+				return fmt.Errorf("%s@%s: %s", acct.Name, acct.Provider, err)
+			}
+		}
+	}
+	if c.FlowControl.HighWatermark < 0 || c.FlowControl.LowWatermark < 0 {
+		return errors.New("FlowControl watermarks must not be negative")
+	}
+	if high, low := c.QueueWatermarks(); low >= high {
+		return errors.New("FlowControl LowWatermark must be below HighWatermark")
+	}
+	if c.HealthCheck.Address != "" {
+		host, _, err := net.SplitHostPort(c.HealthCheck.Address)
+		if err != nil {
+			return fmt.Errorf("invalid HealthCheck address %s: %s", c.HealthCheck.Address, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("HealthCheck address %s is not a localhost address", c.HealthCheck.Address)
+		}
+	}
+	for _, p := range c.TrafficProfile {
+		if p.Name == "" {
+			return errors.New("TrafficProfile without Name")
+		}
+		if p.PayloadInterval < 0 || p.LoopInterval < 0 || p.DropInterval < 0 || p.MaxBurst < 0 {
+			return fmt.Errorf("TrafficProfile %s: parameters must not be negative", p.Name)
+		}
+	}
+	if c.Splitting.MaxBlocks < 0 || c.Splitting.MaxBlocks > math.MaxUint16 {
+		return fmt.Errorf("Splitting MaxBlocks must be within [0, %d]", math.MaxUint16)
+	}
+	if c.PKIPrefetch.MinLeadTime < 0 || c.PKIPrefetch.Jitter < 0 {
+		return errors.New("PKIPrefetch parameters must not be negative")
+	}
+	if c.DiskSpace.MinFree < 0 {
+		return errors.New("DiskSpace MinFree must not be negative")
+	}
+	if c.ClockSkew.MaxSkew < 0 {
+		return errors.New("ClockSkew MaxSkew must not be negative")
+	}
+	if c.Fetch.MeanInterval < 0 || c.Fetch.MaxBatch < 0 || c.Fetch.ReassemblyWorkers < 0 {
+		return errors.New("Fetch parameters must not be negative")
+	}
+	if c.Splitting.MaxParts < 0 {
+		return errors.New("Splitting MaxParts must not be negative")
+	}
+	if c.MailFilter.MessagesPerMinute < 0 {
+		return errors.New("MailFilter MessagesPerMinute must not be negative")
+	}
+	if len(c.MailFilter.Rule) > 0 && c.MailFilter.Sieve != "" {
+		return errors.New("MailFilter Rule and Sieve are mutually exclusive")
+	}
+	for i, rule := range c.MailFilter.Rule {
+		if rule.Header == "" && rule.Contains != "" {
+			return fmt.Errorf("MailFilter Rule %d: Contains without Header", i)
+		}
+		if rule.Header == "" && rule.Sender == "" && rule.LargerThan == 0 && rule.SmallerThan == 0 {
+			return fmt.Errorf("MailFilter Rule %d: no condition", i)
+		}
+		if rule.LargerThan < 0 || rule.SmallerThan < 0 {
+			return fmt.Errorf("MailFilter Rule %d: sizes must not be negative", i)
+		}
+		if rule.Folder == "" && !rule.MarkRead && !rule.Discard {
+			return fmt.Errorf("MailFilter Rule %d: no action", i)
+		}
+	}
+	for _, alias := range c.Alias {
+		if alias.Name == "" {
+			return errors.New("Alias without Name")
+		}
+		_, _, err := SplitEmail(alias.Address)
+		if err != nil {
+			return fmt.Errorf("Alias %s: invalid Address %s", alias.Name, alias.Address)
+		}
+	}
+	profiles := c.TrafficProfiles()
+	for _, acct := range c.Account {
+		if _, ok := profiles[acct.TrafficProfile]; acct.TrafficProfile != "" && !ok {
+			return fmt.Errorf("%s@%s: unknown TrafficProfile %s", acct.Name, acct.Provider, acct.TrafficProfile)
+		}
+	}
+	for i, n := range c.Notifier {
+		switch n.Type {
+		case "command":
+			if n.Command == "" {
+				return fmt.Errorf("Notifier %d: command notifier without Command", i)
+			}
+		case "fifo", "audit":
+			if n.Path == "" {
+				return fmt.Errorf("Notifier %d: %s notifier without Path", i, n.Type)
+			}
+		case "desktop":
+		default:
+			return fmt.Errorf("Notifier %d: unknown type %q", i, n.Type)
+		}
+	}
+	n := len(c.PKIConsensus.Authority)
+	if n > 0 && (c.PKIConsensus.Threshold < 1 || c.PKIConsensus.Threshold > n) {
+		return fmt.Errorf("PKI consensus threshold must be between 1 and %d", n)
+	}
+	return nil
+}
+
+// ProviderFailoverAttempts returns the number of connection
+// attempts to an endpoint before failing over to the next one
+func (a *Account) ProviderFailoverAttempts() int {
+	if a.FailoverAttempts == 0 {
+		return 1
+	}
+	return a.FailoverAttempts
+}
+
+// OrderingHoldTime returns the maximum duration an out of
+// order message is held back waiting for the preceding messages
+func (c *Config) OrderingHoldTime() time.Duration {
+	if c.Ordering.HoldTime == 0 {
+		return constants.DefaultOrderingHoldTime
+	}
+	return time.Duration(c.Ordering.HoldTime) * time.Second
+}
+
+// MessageSizeLimit returns the maximum size
+// in bytes of a submitted message
+func (c *Config) MessageSizeLimit() int {
+	if c.MaxMessageSize == 0 {
+		return constants.DefaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+// SourceLimits returns the message rate and concurrent
+// connection limits per source IP address
+func (c *Config) SourceLimits() (int, int) {
+	messages := c.RateLimit.MessagesPerMinute
+	if messages == 0 {
+		messages = constants.DefaultMessagesPerMinute
+	}
+	connections := c.RateLimit.MaxConnections
+	if connections == 0 {
+		connections = constants.DefaultMaxConnections
+	}
+	return messages, connections
+}
+
+// AccountMessagesPerMinute returns the message rate limit per account
+func (c *Config) AccountMessagesPerMinute() int {
+	if c.RateLimit.AccountMessagesPerMinute == 0 {
+		return constants.DefaultAccountMessagesPerMinute
+	}
+	return c.RateLimit.AccountMessagesPerMinute
+}
+
+// QueueWatermarks returns the high and low watermarks
+// of the number of Blocks queued for sending
+func (c *Config) QueueWatermarks() (int, int) {
+	high := c.FlowControl.HighWatermark
+	if high == 0 {
+		high = constants.DefaultQueueHighWatermark
+	}
+	low := c.FlowControl.LowWatermark
+	if low == 0 {
+		low = high * 3 / 4
+	}
+	return high, low
+}
+
+// SendSlotInterval returns the mean interval between two send slots
+func (c *Config) SendSlotInterval() time.Duration {
+	if c.SendSlots.MeanInterval == 0 {
+		return constants.DefaultSendSlotInterval
+	}
+	return time.Duration(c.SendSlots.MeanInterval) * time.Millisecond
+}
+
+// FetchInterval returns the mean interval between two
+// retrievals of the queued messages from the Provider
+func (c *Config) FetchInterval() time.Duration {
+	if c.Fetch.MeanInterval == 0 {
+		return constants.DefaultFetchInterval
+	}
+	return time.Duration(c.Fetch.MeanInterval) * time.Millisecond
+}
+
+// FetchMaxBatch returns the maximum number of messages
+// retrieved back to back
+func (c *Config) FetchMaxBatch() int {
+	if c.Fetch.MaxBatch == 0 {
+		return constants.DefaultMaxFetchBatch
+	}
+	return c.Fetch.MaxBatch
+}
+
+// FetchReassemblyWorkers returns the number of workers
+// reassembling the retrieved messages of an account
+func (c *Config) FetchReassemblyWorkers() int {
+	if c.Fetch.ReassemblyWorkers == 0 {
+		return constants.DefaultReassemblyWorkers
+	}
+	return c.Fetch.ReassemblyWorkers
+}
+
+// TrafficProfiles returns the built-in and the custom
+// traffic profiles keyed by their name
+func (c *Config) TrafficProfiles() map[string]*TrafficProfile {
+	profiles := builtinTrafficProfiles()
+	for i := range c.TrafficProfile {
+		profiles[c.TrafficProfile[i].Name] = &c.TrafficProfile[i]
+	}
+	return profiles
+}
+
+// AccountTrafficProfile returns the traffic profile of the
+// given account or nil if the account has none
+func (c *Config) AccountTrafficProfile(account Account) *TrafficProfile {
+	if account.TrafficProfile == "" {
+		return nil
+	}
+	return c.TrafficProfiles()[account.TrafficProfile]
+}
+
+// SlotInterval returns the mean interval between two send slots
+func (p *TrafficProfile) SlotInterval() time.Duration {
+	return time.Duration(p.PayloadInterval) * time.Millisecond
+}
+
+// Burst returns the maximum number of Blocks sent in one send slot
+func (p *TrafficProfile) Burst() int {
+	if p.MaxBurst == 0 {
+		return 1
+	}
+	return p.MaxBurst
+}
+
+// LoopDecoyInterval returns the mean interval between two
+// loop decoys, zero if the profile sends none
+func (p *TrafficProfile) LoopDecoyInterval() time.Duration {
+	return time.Duration(p.LoopInterval) * time.Millisecond
+}
+
+// DropDecoyInterval returns the mean interval between two
+// drop decoys, zero if the profile sends none
+func (p *TrafficProfile) DropDecoyInterval() time.Duration {
+	return time.Duration(p.DropInterval) * time.Millisecond
+}
+
+// ProviderTransport returns the transport configuration
+// of the given Provider or nil if there is none
+func (c *Config) ProviderTransport(provider string) *Transport {
+	for i := range c.Transport {
+		if strings.EqualFold(c.Transport[i].Provider, provider) {
+			return &c.Transport[i]
+		}
+	}
+	return nil
+}
+
+// PKIPrefetchLead returns the minimum duration before an epoch
+// boundary at which the next PKI document is fetched
+func (c *Config) PKIPrefetchLead() time.Duration {
+	if c.PKIPrefetch.MinLeadTime == 0 {
+		return constants.DefaultPKIPrefetchLead
+	}
+	return time.Duration(c.PKIPrefetch.MinLeadTime) * time.Second
+}
+
+// MinFreeDiskSpace returns the number of bytes which must be
+// free on the volumes holding the data for submissions
+func (c *Config) MinFreeDiskSpace() uint64 {
+	if c.DiskSpace.MinFree == 0 {
+		return constants.DefaultMinFreeDiskSpace
+	}
+	return uint64(c.DiskSpace.MinFree) << 20
+}
+
+// MaxClockSkew returns the skew of the local clock
+// against the PKI authorities above which it's reported
+func (c *Config) MaxClockSkew() time.Duration {
+	if c.ClockSkew.MaxSkew == 0 {
+		return constants.DefaultMaxClockSkew
+	}
+	return time.Duration(c.ClockSkew.MaxSkew) * time.Second
+}
+
+// PKIPrefetchJitter returns the maximum random
+// duration added to the PKI prefetch lead time
+func (c *Config) PKIPrefetchJitter() time.Duration {
+	if c.PKIPrefetch.Jitter == 0 {
+		return constants.DefaultPKIPrefetchJitter
+	}
+	return time.Duration(c.PKIPrefetch.Jitter) * time.Second
 }
 
 // AccountsMap map of email to user private key
@@ -91,7 +962,8 @@ func (a *AccountsMap) GetIdentityKey(email string) (*ecdh.PrivateKey, error) {
 	return nil, errors.New("identity key not found")
 }
 
-// CreateKeyFileName composes a filename given several arguments
+// CreateKeyFileName composes a filename given several arguments,
+// see key_store for the layout of the keys directory
 // arguments:
 // * keysDir - a filepath to the directory containing the key files.
 //   must not end in a forward slash /.
@@ -106,7 +978,7 @@ func (a *AccountsMap) GetIdentityKey(email string) (*ecdh.PrivateKey, error) {
 //   * constants.KeyStatusPrivate
 //   * constants.KeyStatusPublic
 func CreateKeyFileName(keysDir, keyType, name, provider, keyStatus string) string {
-	return fmt.Sprintf("%s/%s_%s@%s.%s.pem", keysDir, keyType, name, provider, keyStatus)
+	return key_store.KeyFileName(keysDir, keyType, name, provider, keyStatus)
 }
 
 // GetAccountKey decrypts and returns a private key material or an error
@@ -120,15 +992,31 @@ func CreateKeyFileName(keysDir, keyType, name, provider, keyStatus string) strin
 //   must not end in a forward slash /.
 // * passphrase - a secret passphrase which is used to decrypt keys on disk
 func (c *Config) GetAccountKey(keyType string, account Account, keysDir, passphrase string) (*ecdh.PrivateKey, error) {
-	privateKeyFile := CreateKeyFileName(keysDir, keyType, account.Name, account.Provider, constants.KeyStatusPrivate)
+	return c.getAccountKey(keyType, account, keysDir, passphrase, nil)
+}
+
+// getAccountKey decrypts and returns a private key material as
+// GetAccountKey, calling onDuress if the decoy key is opened
+func (c *Config) getAccountKey(keyType string, account Account, keysDir, passphrase string, onDuress func()) (*ecdh.PrivateKey, error) {
+	store, err := key_store.Open(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyFile := store.KeyFile(keyType, account.Name, account.Provider, constants.KeyStatusPrivate)
+	pemPayload, err := store.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
 	email := fmt.Sprintf("%s@%s", account.Name, account.Provider)
 	v := vault.Vault{
-		Type:       constants.KeyStatusPrivate,
-		Email:      email,
-		Passphrase: passphrase,
-		Path:       privateKeyFile,
+		Type:            constants.KeyStatusPrivate,
+		Email:           email,
+		Passphrase:      passphrase,
+		Path:            privateKeyFile,
+		DestroyOnDuress: c.Duress.DestroyKeys,
+		OnDuress:        onDuress,
 	}
-	plaintext, err := v.Open()
+	plaintext, err := v.Decrypt(pemPayload)
 	if err != nil {
 		return nil, err
 	}
@@ -148,16 +1036,28 @@ func (c *Config) GetAccountKey(keyType string, account Account, keysDir, passphr
 //   must not end in a forward slash /.
 // * passphrase - a secret passphrase which is used to decrypt keys on disk
 func (c *Config) AccountsMap(keyType, keysDir, passphrase string) (*AccountsMap, error) {
+	accounts, _, err := c.OpenAccountsMap(keyType, keysDir, passphrase)
+	return accounts, err
+}
+
+// OpenAccountsMap returns the map of the private keys of the accounts
+// as AccountsMap and true if the decoy keys were opened with the
+// duress passphrase, the data of the real keys must then be covered
+func (c *Config) OpenAccountsMap(keyType, keysDir, passphrase string) (*AccountsMap, bool, error) {
 	accounts := make(AccountsMap)
+	duress := false
+	onDuress := func() {
+		duress = true
+	}
 	for _, account := range c.Account {
 		email := fmt.Sprintf("%s@%s", account.Name, account.Provider)
-		privateKey, err := c.GetAccountKey(keyType, account, keysDir, passphrase)
+		privateKey, err := c.getAccountKey(keyType, account, keysDir, passphrase, onDuress)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		accounts[strings.ToLower(email)] = privateKey
 	}
-	return &accounts, nil
+	return &accounts, duress, nil
 }
 
 // AccountIdentities returns a list of e-mail addresses or
@@ -171,28 +1071,86 @@ func (c *Config) AccountIdentities() []string {
 	return accounts
 }
 
-// writeKey generates and encrypts a key to disk
-func writeKey(keysDir, prefix, name, provider, passphrase string) error {
-	privateKeyFile := CreateKeyFileName(keysDir, prefix, name, provider, constants.KeyStatusPrivate)
+// Aliases returns the recipient addresses keyed
+// by the lower case names of the aliases
+func (c *Config) Aliases() map[string]string {
+	aliases := make(map[string]string)
+	for _, alias := range c.Alias {
+		aliases[strings.ToLower(alias.Name)] = strings.ToLower(alias.Address)
+	}
+	return aliases
+}
+
+// ProxyPasswords returns the proxy passwords of the
+// accounts which have one, keyed by the lower case
+// e-mail address of the account
+func (c *Config) ProxyPasswords() map[string]string {
+	passwords := make(map[string]string)
+	for _, account := range c.Account {
+		if account.ProxyPassword == "" {
+			continue
+		}
+		email := strings.ToLower(fmt.Sprintf("%s@%s", account.Name, account.Provider))
+		passwords[email] = account.ProxyPassword
+	}
+	return passwords
+}
+
+// ProxyPasswordHashes returns the proxy password hashes
+// of the accounts which have one, keyed by the lower case
+// e-mail address of the account
+func (c *Config) ProxyPasswordHashes() map[string]string {
+	hashes := make(map[string]string)
+	for _, account := range c.Account {
+		if account.ProxyPasswordHash == "" {
+			continue
+		}
+		email := strings.ToLower(fmt.Sprintf("%s@%s", account.Name, account.Provider))
+		hashes[email] = account.ProxyPasswordHash
+	}
+	return hashes
+}
+
+// writeKey generates and encrypts a key to disk. If the duress
+// passphrase isn't empty it opens a decoy: the same key for the link
+// layer, so that the decoy still authenticates to the Provider, and
+// a new key for the end to end encryption, which can't open the
+// messages sent to the real one.
+func writeKey(randReader io.Reader, store *key_store.Store, prefix, name, provider, passphrase, duressPassphrase string) error {
+	privateKeyFile := store.KeyFile(prefix, name, provider, constants.KeyStatusPrivate)
 	_, err := os.Stat(privateKeyFile)
 	if os.IsNotExist(err) {
-		privateKey, err := ecdh.NewKeypair(rand.Reader)
+		privateKey, err := ecdh.NewKeypair(randReader)
 		if err != nil {
 			return err
 		}
 		email := fmt.Sprintf("%s@%s", name, provider)
 		v := vault.Vault{
-			Type:       constants.KeyStatusPrivate,
-			Email:      email,
-			Passphrase: passphrase,
-			Path:       privateKeyFile,
+			Type:             constants.KeyStatusPrivate,
+			Email:            email,
+			Passphrase:       passphrase,
+			DuressPassphrase: duressPassphrase,
+			Path:             privateKeyFile,
+			RandomReader:     randReader,
 		}
 		log.Notice("performing key stretching computation")
-		err = v.Seal(privateKey.Bytes())
+		var pemPayload []byte
+		if duressPassphrase == "" {
+			pemPayload, err = v.Encrypt(privateKey.Bytes())
+		} else {
+			decoy := privateKey
+			if prefix != constants.LinkLayerKeyType {
+				decoy, err = ecdh.NewKeypair(randReader)
+				if err != nil {
+					return err
+				}
+			}
+			pemPayload, err = v.EncryptWithDecoy(privateKey.Bytes(), decoy.Bytes())
+		}
 		if err != nil {
 			return err
 		}
-		return nil
+		return store.WriteFile(privateKeyFile, pemPayload)
 	} else {
 		return errors.New("key file already exists. aborting")
 	}
@@ -206,7 +1164,35 @@ func SplitEmail(email string) (string, string, error) {
 	return fields[0], fields[1], nil
 }
 
+// SplitPlusAddress returns the canonical address of the given plus
+// address and it's tag, e.g. alice@acme and lists for alice+lists@acme.
+// Addresses without a tag are returned unchanged with an empty tag.
+func SplitPlusAddress(address string) (string, string) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return address, ""
+	}
+	plus := strings.Index(address[:at], "+")
+	if plus < 1 {
+		return address, ""
+	}
+	return address[:plus] + address[at:], address[plus+1 : at]
+}
+
 func FromFile(fileName string) (*Config, error) {
+	config, err := readFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile reads the given configuration file without validating it
+func readFile(fileName string) (*Config, error) {
 	config := Config{}
 	fileData, err := ioutil.ReadFile(fileName)
 	if err != nil {
@@ -221,16 +1207,33 @@ func FromFile(fileName string) (*Config, error) {
 
 // GenerateKeys creates the key files necessary to use the client
 func (c *Config) GenerateKeys(keysDir, passphrase string) error {
-	var err error
+	return c.GenerateKeysWithReader(entropy.Reader, keysDir, passphrase)
+}
+
+// GenerateKeysWithReader creates the key files necessary to use the
+// client using the given entropy source, this is useful for
+// deterministic tests and simulations
+func (c *Config) GenerateKeysWithReader(randReader io.Reader, keysDir, passphrase string) error {
+	return c.GenerateKeysWithDuress(randReader, keysDir, passphrase, "")
+}
+
+// GenerateKeysWithDuress creates the key files as GenerateKeysWithReader
+// which open decoy keys with the given duress passphrase, if it's not
+// empty, see vault.SealWithDecoy and the Duress section
+func (c *Config) GenerateKeysWithDuress(randReader io.Reader, keysDir, passphrase, duressPassphrase string) error {
+	store, err := key_store.Open(keysDir)
+	if err != nil {
+		return err
+	}
 	for i := 0; i < len(c.Account); i++ {
 		name := c.Account[i].Name
 		provider := c.Account[i].Provider
 		if name != "" && provider != "" {
-			err = writeKey(keysDir, constants.LinkLayerKeyType, name, provider, passphrase)
+			err = writeKey(randReader, store, constants.LinkLayerKeyType, name, provider, passphrase, duressPassphrase)
 			if err != nil {
 				return err
 			}
-			err = writeKey(keysDir, constants.EndToEndKeyType, name, provider, passphrase)
+			err = writeKey(randReader, store, constants.EndToEndKeyType, name, provider, passphrase, duressPassphrase)
 			if err != nil {
 				return err
 			}
@@ -18,9 +18,12 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 
+	"github.com/katzenpost/client/internal/auth"
 	"github.com/stretchr/testify/require"
 )
 
@@ -56,3 +59,255 @@ func TestConfig(t *testing.T) {
 	require.NoError(err, "FromFile failed")
 	t.Log(config)
 }
+
+func TestServicesConfig(t *testing.T) {
+	require := require.New(t)
+
+	tomlConfigStr := `
+[[Account]]
+  Name = "Alice"
+  Provider = "Acme"
+
+[Services]
+  SendOnly = true
+`
+	tmpConfigFile, err := ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr))
+	require.NoError(err, "Write failed")
+	config, err := FromFile(tmpConfigFile.Name())
+	require.NoError(err, "FromFile failed")
+	require.True(config.SMTPEnabled())
+	require.True(config.SendEnabled())
+	require.False(config.POP3Enabled())
+	require.False(config.DeliveryEnabled())
+	require.True(config.CoverTrafficEnabled())
+
+	tmpConfigFile, err = ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr + "  ReceiveOnly = true\n"))
+	require.NoError(err, "Write failed")
+	_, err = FromFile(tmpConfigFile.Name())
+	require.Error(err, "FromFile should've failed")
+}
+
+func TestFlowControlConfig(t *testing.T) {
+	require := require.New(t)
+
+	tomlConfigStr := `
+[[Account]]
+  Name = "Alice"
+  Provider = "Acme"
+
+[FlowControl]
+  HighWatermark = 100
+`
+	tmpConfigFile, err := ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr))
+	require.NoError(err, "Write failed")
+	config, err := FromFile(tmpConfigFile.Name())
+	require.NoError(err, "FromFile failed")
+	high, low := config.QueueWatermarks()
+	require.Equal(100, high)
+	require.Equal(75, low)
+
+	tmpConfigFile, err = ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr + "  LowWatermark = 100\n"))
+	require.NoError(err, "Write failed")
+	_, err = FromFile(tmpConfigFile.Name())
+	require.Error(err, "FromFile should've failed")
+}
+
+func TestSplittingConfig(t *testing.T) {
+	require := require.New(t)
+
+	for _, splitting := range []Splitting{{}, {MaxBlocks: 1, MaxParts: 1}, {MaxBlocks: 65535}} {
+		c := Config{Splitting: splitting}
+		require.NoError(c.validate(), "unexpected validate() error for %v", splitting)
+	}
+	for _, splitting := range []Splitting{{MaxBlocks: -1}, {MaxBlocks: 65536}, {MaxParts: -1}} {
+		c := Config{Splitting: splitting}
+		require.Error(c.validate(), "invalid Splitting %v not detected", splitting)
+	}
+}
+
+func TestMailFilterConfig(t *testing.T) {
+	require := require.New(t)
+
+	c := Config{MailFilter: MailFilter{ContactsOnly: true, MessagesPerMinute: 10}}
+	require.NoError(c.validate(), "unexpected validate() error")
+	c = Config{MailFilter: MailFilter{MessagesPerMinute: -1}}
+	require.Error(c.validate(), "negative MessagesPerMinute not detected")
+
+	rule := Rule{Header: "List-Id", Contains: "golang", Folder: "Junk"}
+	c = Config{MailFilter: MailFilter{Rule: []Rule{rule}}}
+	require.NoError(c.validate(), "unexpected validate() error")
+	c = Config{MailFilter: MailFilter{Rule: []Rule{rule}, Sieve: "/etc/mixclient.sieve"}}
+	require.Error(c.validate(), "Rule and Sieve not exclusive")
+	for _, rule := range []Rule{{Folder: "Junk"}, {Contains: "x", Folder: "Junk"}, {Sender: "*@acme.com"}, {LargerThan: -1, Discard: true}} {
+		c = Config{MailFilter: MailFilter{Rule: []Rule{rule}}}
+		require.Error(c.validate(), "invalid Rule %v not detected", rule)
+	}
+}
+
+func TestHealthCheckConfig(t *testing.T) {
+	require := require.New(t)
+
+	for _, address := range []string{"", "127.0.0.1:8080", "[::1]:8080", "localhost:8080"} {
+		c := Config{HealthCheck: HealthCheck{Address: address}}
+		require.NoError(c.validate(), "unexpected validate() error for %q", address)
+	}
+	for _, address := range []string{"0.0.0.0:8080", "192.168.1.1:8080", "example.com:8080", "127.0.0.1"} {
+		c := Config{HealthCheck: HealthCheck{Address: address}}
+		require.Error(c.validate(), "invalid HealthCheck address %q not detected", address)
+	}
+}
+
+func TestNotifierConfig(t *testing.T) {
+	require := require.New(t)
+
+	tomlConfigStr := `
+[[Account]]
+  Name = "Alice"
+  Provider = "Acme"
+
+[[Notifier]]
+  Type = "command"
+  Command = "/usr/local/bin/notify.sh"
+  Events = ["message_arrived"]
+
+[[Notifier]]
+  Type = "desktop"
+`
+	tmpConfigFile, err := ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr))
+	require.NoError(err, "Write failed")
+	config, err := FromFile(tmpConfigFile.Name())
+	require.NoError(err, "FromFile failed")
+	require.Equal(2, len(config.Notifier))
+	require.Equal([]string{"message_arrived"}, config.Notifier[0].Events)
+
+	tmpConfigFile, err = ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr + "\n[[Notifier]]\n  Type = \"fifo\"\n"))
+	require.NoError(err, "Write failed")
+	_, err = FromFile(tmpConfigFile.Name())
+	require.Error(err, "fifo notifier without Path not detected")
+}
+
+func TestProxyPasswords(t *testing.T) {
+	require := require.New(t)
+
+	tomlConfigStr := `
+[[Account]]
+  Name = "Alice"
+  Provider = "Acme"
+  ProxyPassword = "s3cret"
+
+[[Account]]
+  Name = "bob"
+  Provider = "acme"
+  ProxyPasswordHash = "%s"
+
+[[Account]]
+  Name = "carol"
+  Provider = "acme"
+`
+	hash, err := auth.HashPassword("hunter2")
+	require.NoError(err, "HashPassword failed")
+	tmpConfigFile, err := ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = fmt.Fprintf(tmpConfigFile, tomlConfigStr, hash)
+	require.NoError(err, "Write failed")
+	config, err := FromFile(tmpConfigFile.Name())
+	require.NoError(err, "FromFile failed")
+	require.Equal(map[string]string{"alice@acme": "s3cret"}, config.ProxyPasswords())
+	require.Equal(map[string]string{"bob@acme": hash}, config.ProxyPasswordHashes())
+
+	config.Account[1].ProxyPasswordHash = "hunter2"
+	require.Error(config.validate(), "invalid hash not detected")
+	config.Account[1].ProxyPasswordHash = hash
+	config.Account[1].ProxyPassword = "hunter2"
+	require.Error(config.validate(), "password and hash not detected")
+}
+
+func TestAliases(t *testing.T) {
+	require := require.New(t)
+
+	c := Config{Alias: []Alias{
+		{Name: "Boss", Address: "Bob+Work@acme"},
+		{Name: "lists@local", Address: "alice@acme"},
+	}}
+	require.NoError(c.validate())
+	require.Equal(map[string]string{"boss": "bob+work@acme", "lists@local": "alice@acme"}, c.Aliases())
+	c.Alias = append(c.Alias, Alias{Name: "nobody", Address: "nobody"})
+	require.Error(c.validate(), "invalid alias address not detected")
+	c.Alias = []Alias{{Address: "alice@acme"}}
+	require.Error(c.validate(), "alias without name not detected")
+
+	for address, expected := range map[string][2]string{
+		"alice+lists@acme":   {"alice@acme", "lists"},
+		"alice+a+b@acme":     {"alice@acme", "a+b"},
+		"alice+@acme":        {"alice@acme", ""},
+		"alice@acme":         {"alice@acme", ""},
+		"+lists@acme":        {"+lists@acme", ""},
+		"alice@plus+dns.com": {"alice@plus+dns.com", ""},
+		"alice":              {"alice", ""},
+	} {
+		canonical, tag := SplitPlusAddress(address)
+		require.Equal(expected[0], canonical, address)
+		require.Equal(expected[1], tag, address)
+	}
+}
+
+func TestTrafficProfiles(t *testing.T) {
+	require := require.New(t)
+
+	tomlConfigStr := `
+[[Account]]
+  Name = "Alice"
+  Provider = "Acme"
+  TrafficProfile = "paranoid"
+
+[[Account]]
+  Name = "Bob"
+  Provider = "Acme"
+  TrafficProfile = "commute"
+
+[[Account]]
+  Name = "Carol"
+  Provider = "Acme"
+
+[[TrafficProfile]]
+  Name = "commute"
+  PayloadInterval = 5000
+  LoopInterval = 20000
+  DropInterval = 20000
+`
+	tmpConfigFile, err := ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr))
+	require.NoError(err, "Write failed")
+	config, err := FromFile(tmpConfigFile.Name())
+	require.NoError(err, "FromFile failed")
+	require.Equal(4, len(config.TrafficProfiles()))
+
+	alice := config.AccountTrafficProfile(config.Account[0])
+	require.Equal(ParanoidProfile, alice.Name)
+	require.Equal(2*time.Second, alice.SlotInterval())
+	require.Equal(1, alice.Burst())
+	bob := config.AccountTrafficProfile(config.Account[1])
+	require.Equal(5*time.Second, bob.SlotInterval())
+	require.Equal(1, bob.Burst())
+	require.Nil(config.AccountTrafficProfile(config.Account[2]))
+
+	tmpConfigFile, err = ioutil.TempFile("/tmp", "configTomlTest")
+	require.NoError(err, "TempFile failed")
+	_, err = tmpConfigFile.Write([]byte("[[Account]]\n  Name = \"Alice\"\n  Provider = \"Acme\"\n  TrafficProfile = \"unknown\"\n"))
+	require.NoError(err, "Write failed")
+	_, err = FromFile(tmpConfigFile.Name())
+	require.Error(err, "FromFile should've failed")
+}
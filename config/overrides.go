@@ -0,0 +1,248 @@
+// overrides.go - environment and flag configuration overrides
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding
+// configuration values, e.g. MIXCLIENT_SMTPPROXY_ADDRESS
+const EnvPrefix = "MIXCLIENT_"
+
+// Overrides are configuration values overriding those of the
+// configuration file, each a key=value pair whose key is the dot
+// separated path of the value, e.g. SMTPProxy.Address=127.0.0.1:2525
+// or Account.0.Name=alice. Overrides implements flag.Value, so that
+// the values may be given by repeating a command line flag.
+type Overrides []string
+
+// String returns the overrides separated by commas
+func (o *Overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+// Set adds the given key=value override
+func (o *Overrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("override %q is not a key=value pair", value)
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// nonConfigEnv are the environment variables, without EnvPrefix,
+// which start with EnvPrefix but don't name a configuration value
+var nonConfigEnv = map[string]bool{
+	// the passphrase of the keys, see mixclient-init
+	"PASSPHRASE": true,
+	// the proxy password of mixclient-sendmail
+	"PROXY_PASSWORD": true,
+	// the listeners handed off on a restart, see package handoff
+	"HANDOFF_LISTENERS": true,
+	"HANDOFF_READY_FD":  true,
+}
+
+// Load reads the given configuration file and overrides it's values,
+// first with the environment variables starting with EnvPrefix and
+// then with the given flag overrides, before validating it. So the
+// flags take precedence over the environment, which takes precedence
+// over the file. The path of an environment variable is separated by
+// underscores, e.g. MIXCLIENT_ACCOUNT_0_NAME.
+func Load(fileName string, environ []string, overrides Overrides) (*Config, error) {
+	config := &Config{}
+	if fileName != "" {
+		var err error
+		config, err = readFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := config.ApplyEnv(environ)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		fields := strings.SplitN(o, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("override %q is not a key=value pair", o)
+		}
+		err = config.Override(fields[0], fields[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ApplyEnv overrides the configuration values named by the given
+// environment variables, in the KEY=value format of os.Environ. The
+// variables are applied in the order of their paths, so that the
+// elements of a list are appended in the order of their indexes.
+// A variable starting with EnvPrefix which names no configuration
+// value is an error, unless it's one of the client's other variables,
+// e.g. MIXCLIENT_PASSPHRASE.
+func (c *Config) ApplyEnv(environ []string) error {
+	type variable struct {
+		key   string
+		path  []string
+		value string
+	}
+	variables := []*variable{}
+	for _, v := range environ {
+		if !strings.HasPrefix(v, EnvPrefix) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(v, EnvPrefix), "=", 2)
+		if len(fields) != 2 || nonConfigEnv[fields[0]] {
+			continue
+		}
+		variables = append(variables, &variable{
+			key:   fields[0],
+			path:  strings.Split(fields[0], "_"),
+			value: fields[1],
+		})
+	}
+	sort.SliceStable(variables, func(i, j int) bool {
+		return pathLess(variables[i].path, variables[j].path)
+	})
+	for _, v := range variables {
+		err := assign(reflect.ValueOf(c).Elem(), v.path, v.value)
+		if err != nil {
+			return fmt.Errorf("%s%s: %s", EnvPrefix, v.key, err)
+		}
+	}
+	return nil
+}
+
+// pathLess returns true if the path a sorts before b, the
+// list indexes are compared as numbers, e.g. 2 before 10
+func pathLess(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errX := strconv.Atoi(a[i])
+		y, errY := strconv.Atoi(b[i])
+		if errX == nil && errY == nil {
+			return x < y
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// Override sets the configuration value with the given dot
+// separated path, e.g. SMTPProxy.Address, to the given value
+func (c *Config) Override(key, value string) error {
+	err := assign(reflect.ValueOf(c).Elem(), strings.Split(key, "."), value)
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+	return nil
+}
+
+// assign sets the value with the given path below v to the given
+// value, the field names are matched case insensitively and the
+// elements of a slice of structs are indexed. The index one past the
+// end appends an element, once it's value is set.
+func assign(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 {
+		return setValue(v, value)
+	}
+	switch {
+	case v.Kind() == reflect.Struct:
+		field := v.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, path[0])
+		})
+		if !field.IsValid() {
+			return fmt.Errorf("unknown field %s", path[0])
+		}
+		return assign(field, path[1:], value)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > v.Len() {
+			return fmt.Errorf("invalid index %s", path[0])
+		}
+		if i < v.Len() {
+			return assign(v.Index(i), path[1:], value)
+		}
+		element := reflect.New(v.Type().Elem()).Elem()
+		err = assign(element, path[1:], value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, element))
+		return nil
+	default:
+		return fmt.Errorf("%s has no field %s", v.Type(), path[0])
+	}
+}
+
+// setValue parses the given value into v, the elements
+// of a slice value are separated by commas
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return fmt.Errorf("a list of sections can't be set, set the fields of it's elements")
+		}
+		elements := reflect.MakeSlice(v.Type(), 0, 0)
+		if value != "" {
+			for _, s := range strings.Split(value, ",") {
+				element := reflect.New(v.Type().Elem()).Elem()
+				err := setValue(element, strings.TrimSpace(s))
+				if err != nil {
+					return err
+				}
+				elements = reflect.Append(elements, element)
+			}
+		}
+		v.Set(elements)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
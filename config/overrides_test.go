@@ -0,0 +1,101 @@
+// overrides_test.go - configuration override tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrides(t *testing.T) {
+	require := require.New(t)
+
+	tomlConfigStr := `
+[[Account]]
+  Name = "Alice"
+  Provider = "Acme"
+
+[SMTPProxy]
+  Address = "127.0.0.1:2525"
+  Network = "tcp"
+
+[POP3Proxy]
+  Address = "127.0.0.1:1110"
+  Network = "tcp"
+`
+	tmpConfigFile, err := ioutil.TempFile("", "configOverridesTest")
+	require.NoError(err)
+	defer os.Remove(tmpConfigFile.Name())
+	_, err = tmpConfigFile.Write([]byte(tomlConfigStr))
+	require.NoError(err)
+
+	// the variables arrive in no particular order
+	environ := []string{
+		"MIXCLIENT_SMTPPROXY_ADDRESS=127.0.0.1:2526",
+		"MIXCLIENT_POP3PROXY_ADDRESS=127.0.0.1:1111",
+		"MIXCLIENT_ACCOUNT_2_NAME=Carol",
+		"MIXCLIENT_ACCOUNT_1_NAME=Bob",
+		"MIXCLIENT_ACCOUNT_1_PROVIDER=Acme",
+		"MIXCLIENT_ACCOUNT_2_PROVIDER=Acme",
+		"MIXCLIENT_PASSPHRASE=ignored",
+		"HOME=/root",
+	}
+	overrides := Overrides{}
+	require.NoError(overrides.Set("pop3proxy.address=127.0.0.1:1112"))
+	require.Error(overrides.Set("pop3proxy.address"))
+
+	config, err := Load(tmpConfigFile.Name(), environ, overrides)
+	require.NoError(err)
+	require.Equal("127.0.0.1:2526", config.SMTPProxy.Address)
+	require.Equal("127.0.0.1:1112", config.POP3Proxy.Address)
+	require.Len(config.Account, 3)
+	require.Equal("Alice", config.Account[0].Name)
+	require.Equal("Bob", config.Account[1].Name)
+	require.Equal("Carol", config.Account[2].Name)
+
+	require.Error(config.Override("SMTPProxy.Nonexistent", "x"))
+	require.Error(config.Override("Account.5.Name", "x"))
+	require.Error(config.Override("Account", "x"))
+
+	// an element is only appended once it's value is set
+	require.Error(config.Override("Account.3.Nonexistent", "x"))
+	require.Error(config.Override("Account.3.MailboxQuota", "many"))
+	require.Len(config.Account, 3)
+
+	// the indexes are ordered as numbers
+	environ = []string{}
+	for i := 10; i >= 0; i-- {
+		environ = append(environ, fmt.Sprintf("MIXCLIENT_ACCOUNT_%d_NAME=a%d", i, i), fmt.Sprintf("MIXCLIENT_ACCOUNT_%d_PROVIDER=Acme", i))
+	}
+	config, err = Load("", environ, nil)
+	require.NoError(err)
+	require.Len(config.Account, 11)
+	require.Equal("a10", config.Account[10].Name)
+
+	// a mistyped variable isn't ignored
+	_, err = Load(tmpConfigFile.Name(), []string{"MIXCLIENT_SMTPPROXY_ADRESS=127.0.0.1:2526"}, nil)
+	require.Error(err)
+	_, err = Load(tmpConfigFile.Name(), []string{"MIXCLIENT_ACCOUNT_2_NAME=Carol"}, nil)
+	require.Error(err)
+
+	_, err = Load(tmpConfigFile.Name(), []string{"MIXCLIENT_ACCOUNT_0_NAME"}, nil)
+	require.NoError(err)
+}
@@ -21,9 +21,10 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
-	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/client/internal/constants"
 	coreConstants "github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/utils"
@@ -36,6 +37,13 @@ const (
 	blockCipherOverhead = keyLen + macLen + keyLen + macLen // -> e, es, s, ss
 	blockOverhead       = 24
 
+	// CiphertextLength is the size of every encrypted Block in
+	// bytes, the serialized Blocks are padded to BlockLength
+	CiphertextLength = blockCipherOverhead + blockOverhead + BlockLength
+
+	// SerializedLength is the size of every serialized Block in bytes
+	SerializedLength = blockOverhead + BlockLength
+
 	totalOff = constants.MessageIDLength
 	idOff    = totalOff + 2
 	lenOff   = idOff + 2
@@ -66,18 +74,32 @@ type JsonBlock struct {
 
 // ToBlock deserializes a JsonBlock into a Block
 func (j *JsonBlock) ToBlock() (*Block, error) {
+	totalBlocks, err := constants.Uint16(j.TotalBlocks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TotalBlocks: %s", err)
+	}
+	blockID, err := constants.Uint16(j.BlockID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BlockID: %s", err)
+	}
 	b := Block{
-		TotalBlocks: uint16(j.TotalBlocks),
-		BlockID:     uint16(j.BlockID),
+		TotalBlocks: totalBlocks,
+		BlockID:     blockID,
 	}
 	messageID, err := base64.StdEncoding.DecodeString(j.MessageID)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid MessageID: %s", err)
+	}
+	err = constants.CopyID(b.MessageID[:], messageID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MessageID: %s", err)
 	}
-	copy(b.MessageID[:], messageID)
 	b.Block, err = base64.StdEncoding.DecodeString(j.Block)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid Block payload: %s", err)
+	}
+	if len(b.Block) > BlockLength {
+		return nil, errors.New("client/block: oversized Block payload")
 	}
 	return &b, nil
 }
@@ -95,17 +117,25 @@ func (b *Block) ToJsonBlock() *JsonBlock {
 
 // ToBytes serializes a Block into bytes
 func (b *Block) ToBytes() ([]byte, error) {
+	return b.AppendBinary(make([]byte, 0, SerializedLength))
+}
+
+// AppendBinary appends the serialized Block to the given buffer
+// and returns the extended buffer, so that the caller may reuse
+// it's buffers
+func (b *Block) AppendBinary(out []byte) ([]byte, error) {
 	if len(b.Block) > BlockLength {
 		return nil, errors.New("client/block: oversized Block payload")
 	}
 
 	var zeroBytes [BlockLength]byte
 
-	out := make([]byte, blockOverhead, blockOverhead+BlockLength)
-	copy(out, b.MessageID[:])
-	binary.BigEndian.PutUint16(out[totalOff:], b.TotalBlocks)
-	binary.BigEndian.PutUint16(out[idOff:], b.BlockID)
-	binary.BigEndian.PutUint32(out[lenOff:], uint32(len(b.Block)))
+	var header [blockOverhead]byte
+	copy(header[:], b.MessageID[:])
+	binary.BigEndian.PutUint16(header[totalOff:], b.TotalBlocks)
+	binary.BigEndian.PutUint16(header[idOff:], b.BlockID)
+	binary.BigEndian.PutUint32(header[lenOff:], uint32(len(b.Block)))
+	out = append(out, header[:]...)
 	out = append(out, b.Block...)
 	out = append(out, zeroBytes[:BlockLength-len(b.Block)]...)
 
@@ -115,21 +145,37 @@ func (b *Block) ToBytes() ([]byte, error) {
 // FromBytes deserializes bytes in JSON format to a Block
 // or it returns an error if any
 func FromBytes(raw []byte) (*Block, error) {
-	if len(raw) != blockOverhead+BlockLength {
-		return nil, errors.New("client/block: invalid block size")
+	b := new(Block)
+	err := b.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// UnmarshalBinary deserializes the given bytes into the Block,
+// the capacity of it's payload is reused so that the caller may
+// decode many Blocks into the same one
+func (b *Block) UnmarshalBinary(raw []byte) error {
+	if len(raw) != SerializedLength {
+		return errors.New("client/block: invalid block size")
 	}
 
-	b := new(Block)
 	copy(b.MessageID[:], raw[:totalOff])
 	b.TotalBlocks = binary.BigEndian.Uint16(raw[totalOff:idOff])
 	b.BlockID = binary.BigEndian.Uint16(raw[idOff:lenOff])
 	blockLen := binary.BigEndian.Uint32(raw[lenOff:blockOff])
-	b.Block = make([]byte, blockLen)
-	copy(b.Block, raw[blockOff:blockOff+blockLen])
+	if blockLen > BlockLength {
+		return errors.New("client/block: invalid payload length")
+	}
+	if b.Block == nil {
+		b.Block = make([]byte, 0, blockLen)
+	}
+	b.Block = append(b.Block[:0], raw[blockOff:blockOff+blockLen]...)
 	if !utils.CtIsZero(raw[blockOff+blockLen:]) {
-		return nil, errors.New("client/block: invalid padding")
+		return errors.New("client/block: invalid padding")
 	}
-	return b, nil
+	return nil
 }
 
 // Handler is a block plaintext/ciphertext handler.
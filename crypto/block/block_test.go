@@ -20,6 +20,7 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+	"testing/quick"
 
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
@@ -64,4 +65,90 @@ func TestBlock(t *testing.T) {
 
 	testSize(len(payload))
 	testSize(23)
+
+	// the payload length is spec'd as a plain 32 bit
+	// length, none of it's bits may carry anything else
+	raw, err := blkA.ToBytes()
+	require.NoError(err, "unexpected ToBytes() error")
+	raw[lenOff] = 0x80
+	_, err = FromBytes(raw)
+	require.Error(err, "invalid payload length was accepted")
+}
+
+func TestCiphertextLength(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(constants.ForwardPayloadLength, CiphertextLength)
+	idKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	h := NewHandler(idKey, rand.Reader)
+
+	// the serialized and encrypted Blocks are padded to a
+	// constant size whatever the length of their payload
+	property := func(payload []byte) bool {
+		if len(payload) > BlockLength {
+			payload = payload[:BlockLength]
+		}
+		b := Block{TotalBlocks: 1, Block: payload}
+		raw, err := b.ToBytes()
+		if err != nil || len(raw) != blockOverhead+BlockLength {
+			return false
+		}
+		ciphertext, err := h.Encrypt(idKey.PublicKey(), &b)
+		return err == nil && len(ciphertext) == CiphertextLength
+	}
+	err = quick.Check(property, nil)
+	require.NoError(err, "non-uniform Block size")
+}
+
+func FuzzFromBytes(f *testing.F) {
+	b := Block{
+		TotalBlocks: 2,
+		BlockID:     1,
+		Block:       []byte("the quick brown fox"),
+	}
+	raw, err := b.ToBytes()
+	require.NoError(f, err, "unexpected ToBytes() error")
+	f.Add(raw)
+	// a payload length beyond the Block used to panic
+	oversized := append([]byte{}, raw...)
+	oversized[lenOff] = 0xff
+	f.Add(oversized)
+	f.Add(raw[:blockOverhead])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := FromBytes(data)
+		if err != nil {
+			return
+		}
+		// a decoded Block must encode to the same bytes
+		encoded, err := b.ToBytes()
+		require.NoError(t, err, "unexpected ToBytes() error")
+		require.Equal(t, data, encoded)
+	})
+}
+
+func TestBlockReuse(t *testing.T) {
+	require := require.New(t)
+
+	long := &Block{TotalBlocks: 2, BlockID: 0, Block: []byte("the first and longer payload")}
+	short := &Block{TotalBlocks: 2, BlockID: 1, Block: []byte("second")}
+	buf, err := long.AppendBinary(nil)
+	require.NoError(err, "AppendBinary failed")
+	require.Len(buf, blockOverhead+BlockLength)
+
+	// the buffer and the payload of the decoded Block are reused
+	b := new(Block)
+	err = b.UnmarshalBinary(buf)
+	require.NoError(err, "UnmarshalBinary failed")
+	require.Equal(long, b)
+	payload := b.Block
+	buf, err = short.AppendBinary(buf[:0])
+	require.NoError(err, "AppendBinary failed")
+	err = b.UnmarshalBinary(buf)
+	require.NoError(err, "UnmarshalBinary failed")
+	require.Equal(short, b)
+	require.True(&payload[0] == &b.Block[0], "payload not reused")
+
+	err = b.UnmarshalBinary(buf[1:])
+	require.Error(err, "truncated Block decoded")
 }
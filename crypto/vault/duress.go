@@ -0,0 +1,215 @@
+// duress.go - duress passphrase of the vault
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/client/internal/entropy"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// A vault sealed with SealWithDecoy holds two slots of the same
+// size in random order, one sealed with the passphrase and one with
+// the duress passphrase. Each slot is the nonce followed by the
+// SecretBox of the slot kind, the length of the data, the data and
+// zero padding up to the length of the larger of the two, so that
+// neither the file nor the time taken by Open tells which of the
+// passphrases was given.
+const (
+	// slotReal is the kind of the slot of the sealed plaintext
+	slotReal = 0
+
+	// slotDecoy is the kind of the slot of the decoy
+	slotDecoy = 1
+
+	// slotHeaderSize is the size of the kind and the data length
+	slotHeaderSize = 5
+)
+
+// SealWithDecoy encrypts the given plaintext with the passphrase and
+// the given decoy, which may be empty, with the duress passphrase
+// and writes both into the vault. Seal replaces the decoy.
+func (v *Vault) SealWithDecoy(plaintext, decoy []byte) error {
+	payload, err := v.EncryptWithDecoy(plaintext, decoy)
+	if err != nil {
+		return err
+	}
+	return writeFile(v.Path, payload)
+}
+
+// EncryptWithDecoy returns the PEM encoded vault contents sealed as
+// by SealWithDecoy without writing them, e.g. to write them with a
+// key_store
+func (v *Vault) EncryptWithDecoy(plaintext, decoy []byte) ([]byte, error) {
+	if len(v.DuressPassphrase) < passphraseMinSize {
+		return nil, errors.New("duress passphrase too short")
+	}
+	if v.DuressPassphrase == v.Passphrase {
+		return nil, errors.New("duress passphrase equals the passphrase")
+	}
+	size := len(plaintext)
+	if len(decoy) > size {
+		size = len(decoy)
+	}
+	first, err := v.sealSlot(v.Passphrase, slotReal, plaintext, size)
+	if err != nil {
+		return nil, err
+	}
+	second, err := v.sealSlot(v.DuressPassphrase, slotDecoy, decoy, size)
+	if err != nil {
+		return nil, err
+	}
+	order := [1]byte{}
+	_, err = io.ReadFull(v.randomReader(), order[:])
+	if err != nil {
+		return nil, err
+	}
+	if order[0]&1 == 1 {
+		first, second = second, first
+	}
+	block := pem.Block{
+		Type: v.Type,
+		Headers: map[string]string{
+			"email": v.Email,
+		},
+		Bytes: append(first, second...),
+	}
+	return pem.EncodeToMemory(&block), nil
+}
+
+// randomReader returns the entropy source of the vault
+func (v *Vault) randomReader() io.Reader {
+	if v.RandomReader == nil {
+		return entropy.Reader
+	}
+	return v.RandomReader
+}
+
+// sealSlot returns a slot of the given kind and data,
+// padded to size, sealed with the given passphrase
+func (v *Vault) sealSlot(passphrase string, kind byte, data []byte, size int) ([]byte, error) {
+	key, err := v.stretch(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sealKey := [32]byte{}
+	copy(sealKey[:], key)
+	nonce := [secretboxNonceSize]byte{}
+	_, err = io.ReadFull(v.randomReader(), nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, slotHeaderSize+size)
+	plaintext[0] = kind
+	binary.BigEndian.PutUint32(plaintext[1:slotHeaderSize], uint32(len(data)))
+	copy(plaintext[slotHeaderSize:], data)
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &sealKey), nil
+}
+
+// writeFile atomically replaces the vault file at the given path
+// with the given contents, the contents are written to a temporary
+// file in the same directory which is then renamed
+func writeFile(path string, contents []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// openSlots opens the slot of the given vault contents sealed with
+// key, both slots are always tried so that opening the real slot
+// and opening the decoy take the same time
+func (v *Vault) openSlots(block *pem.Block, key *[32]byte) ([]byte, error) {
+	failed := errors.New("NaCl secretBox MAC failed")
+	half := len(block.Bytes) / 2
+	if len(block.Bytes)%2 != 0 || half < secretboxNonceSize+secretbox.Overhead+slotHeaderSize {
+		return nil, failed
+	}
+	var opened []byte
+	index := -1
+	for i := 0; i < 2; i++ {
+		slot := block.Bytes[i*half : (i+1)*half]
+		nonce := [secretboxNonceSize]byte{}
+		copy(nonce[:], slot[:secretboxNonceSize])
+		plaintext, ok := secretbox.Open(nil, slot[secretboxNonceSize:], &nonce, key)
+		if ok {
+			opened = plaintext
+			index = i
+		}
+	}
+	if opened == nil {
+		return nil, failed
+	}
+	length := binary.BigEndian.Uint32(opened[1:slotHeaderSize])
+	if uint64(length) > uint64(len(opened)-slotHeaderSize) {
+		return nil, errors.New("vault slot corrupted")
+	}
+	data := opened[slotHeaderSize : slotHeaderSize+int(length)]
+	if opened[0] == slotDecoy {
+		v.duress(block, index, half)
+	}
+	return data, nil
+}
+
+// duress destroys the real slot of the given vault contents if
+// DestroyOnDuress is set, the decoy slot at the given index is
+// kept, and calls OnDuress
+func (v *Vault) duress(block *pem.Block, decoyIndex, half int) {
+	if v.DestroyOnDuress && v.Path != "" {
+		payload := make([]byte, len(block.Bytes))
+		copy(payload, block.Bytes)
+		realIndex := 1 - decoyIndex
+		_, err := io.ReadFull(v.randomReader(), payload[realIndex*half:(realIndex+1)*half])
+		if err == nil {
+			err = writeFile(v.Path, pem.EncodeToMemory(&pem.Block{
+				Type:    block.Type,
+				Headers: block.Headers,
+				Bytes:   payload,
+			}))
+		}
+		if err != nil {
+			log.Errorf("failed to destroy the sealed plaintext of %s: %s", v.Path, err)
+		}
+	}
+	if v.OnDuress != nil {
+		v.OnDuress()
+	}
+}
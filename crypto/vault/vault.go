@@ -19,16 +19,19 @@ package vault
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
-	"os"
 
+	"github.com/katzenpost/client/internal/entropy"
 	"github.com/magical/argon2"
+	"github.com/op/go-logging"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+var log = logging.MustGetLogger("mixclient")
+
 const (
 	// argon2SaltSize is the salt size in bytes for use with argon2
 	argon2SaltSize = 8
@@ -67,6 +70,24 @@ type Vault struct {
 	Passphrase string
 	Path       string
 	Email      string
+
+	// RandomReader is the entropy source used to generate
+	// nonces, if nil entropy.Reader is used
+	RandomReader io.Reader
+
+	// DuressPassphrase is the secondary passphrase of a vault
+	// sealed with SealWithDecoy, which opens the decoy
+	DuressPassphrase string
+
+	// DestroyOnDuress replaces the sealed plaintext with random
+	// data once the vault is opened with the duress passphrase
+	DestroyOnDuress bool
+
+	// OnDuress is called once the vault is opened with the duress
+	// passphrase, and the sealed plaintext destroyed if
+	// DestroyOnDuress is set, before the decoy is returned, e.g. to
+	// cover the data of the client. It should return quickly.
+	OnDuress func()
 }
 
 // New creates a new Vault
@@ -103,7 +124,12 @@ func (v *Vault) stretch(passphrase string) ([]byte, error) {
 	pass := passphrase[argon2SaltSize:]
 	// length in bytes of output key
 	keyLen := 32
-	out, err := argon2.Key([]byte(pass), []byte(salt), v.options.NumIter, v.options.Parallelism, v.options.Memory, keyLen)
+	options := v.options
+	if options == nil {
+		// the Vault wasn't created with New
+		options = &defaultOptions
+	}
+	out, err := argon2.Key([]byte(pass), []byte(salt), options.NumIter, options.Parallelism, options.Memory, keyLen)
 	if err != nil {
 		return nil, err
 	}
@@ -116,6 +142,12 @@ func (v *Vault) Open() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return v.Decrypt(pemPayload)
+}
+
+// Decrypt returns the decrypted data of the given
+// PEM encoded vault contents, e.g. read by a key_store
+func (v *Vault) Decrypt(pemPayload []byte) ([]byte, error) {
 	block, _ := pem.Decode(pemPayload)
 	if block == nil {
 		return nil, errors.New("failed to decode pem file")
@@ -133,7 +165,7 @@ func (v *Vault) Open() ([]byte, error) {
 	out := []byte{}
 	plaintext, isAuthed := secretbox.Open(out, ciphertext, &nonce, &key)
 	if !isAuthed {
-		return nil, errors.New("NaCl secretBox MAC failed")
+		return v.openSlots(block, &key)
 	}
 	return plaintext, nil
 }
@@ -141,20 +173,33 @@ func (v *Vault) Open() ([]byte, error) {
 // Seal encrypts given plaintext and writes
 // it into the vault, saving it to a file on disk
 func (v *Vault) Seal(plaintext []byte) error {
-	key, err := v.stretch(v.Passphrase)
+	payload, err := v.Encrypt(plaintext)
 	if err != nil {
 		return err
 	}
+	return writeFile(v.Path, payload)
+}
+
+// Encrypt returns the PEM encoded vault contents of the given
+// plaintext without writing them, e.g. to write them with a key_store
+func (v *Vault) Encrypt(plaintext []byte) ([]byte, error) {
+	key, err := v.stretch(v.Passphrase)
+	if err != nil {
+		return nil, err
+	}
 	sealKey := [32]byte{}
 	copy(sealKey[:], key)
 	nonce := [secretboxNonceSize]byte{}
-	_, err = rand.Reader.Read(nonce[:])
+	randReader := v.RandomReader
+	if randReader == nil {
+		randReader = entropy.Reader
+	}
+	_, err = io.ReadFull(randReader, nonce[:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	out := []byte{}
 	ciphertext := secretbox.Seal(out, plaintext, &nonce, &sealKey)
-	fileMode := os.FileMode(0600)
 	payload := make([]byte, len(ciphertext)+secretboxNonceSize)
 	copy(payload, nonce[:])
 	copy(payload[secretboxNonceSize:], ciphertext)
@@ -168,9 +213,5 @@ func (v *Vault) Seal(plaintext []byte) error {
 	}
 	buf := new(bytes.Buffer)
 	pem.Encode(buf, &block)
-	err = ioutil.WriteFile(v.Path, buf.Bytes(), fileMode)
-	if err != nil {
-		return err
-	}
-	return nil
+	return buf.Bytes(), nil
 }
@@ -42,3 +42,92 @@ func TestVaultOpenSeal(t *testing.T) {
 	assert.Equal(plaintext1, string(plaintext2))
 	os.Remove(tmpfile.Name())
 }
+
+func TestVaultDuress(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpfile, err := ioutil.TempFile("", "example")
+	assert.NoError(err, "TempFile failed")
+	defer os.Remove(tmpfile.Name())
+	passphrase := "up up down down left right right left"
+	duressPassphrase := "b a b a select start"
+	v, err := New("type1", passphrase, tmpfile.Name(), "alice@acme.com", nil)
+	assert.NoError(err, "Vault creation failed")
+	v.DuressPassphrase = duressPassphrase
+	plaintext := []byte("war is peace freedom is slavery ignorance is strength")
+	err = v.SealWithDecoy(plaintext, []byte("nothing to see"))
+	assert.NoError(err, "Vault SealWithDecoy failed")
+
+	opened, err := v.Open()
+	assert.NoError(err, "Vault Open failed")
+	assert.Equal(plaintext, opened)
+
+	duress := false
+	d, err := New("type1", duressPassphrase, tmpfile.Name(), "alice@acme.com", nil)
+	assert.NoError(err, "Vault creation failed")
+	d.DestroyOnDuress = true
+	d.OnDuress = func() {
+		duress = true
+	}
+	opened, err = d.Open()
+	assert.NoError(err, "Vault Open with the duress passphrase failed")
+	assert.Equal([]byte("nothing to see"), opened)
+	assert.True(duress, "OnDuress not called before Open returned")
+
+	// the sealed plaintext is destroyed, the decoy is kept
+	_, err = v.Open()
+	assert.Error(err, "Vault Open succeeded after the duress")
+	d.DestroyOnDuress = false
+	d.OnDuress = nil
+	opened, err = d.Open()
+	assert.NoError(err, "Vault Open with the duress passphrase failed")
+	assert.Equal([]byte("nothing to see"), opened)
+}
+
+// newBenchmarkVault returns a Vault in a temporary file with the
+// default key stretching cost, and the function removing the file
+func newBenchmarkVault(b *testing.B) (*Vault, func()) {
+	tmpfile, err := ioutil.TempFile("", "vault_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tmpfile.Close()
+	v, err := New("type1", "up up down down left right right left", tmpfile.Name(), "alice@acme.com", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return v, func() {
+		os.Remove(tmpfile.Name())
+	}
+}
+
+func BenchmarkVaultSeal(b *testing.B) {
+	v, cleanup := newBenchmarkVault(b)
+	defer cleanup()
+	plaintext := make([]byte, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := v.Seal(plaintext)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVaultOpen(b *testing.B) {
+	v, cleanup := newBenchmarkVault(b)
+	defer cleanup()
+	err := v.Seal(make([]byte, 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := v.Open()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
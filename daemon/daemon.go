@@ -0,0 +1,277 @@
+// daemon.go - assembly of the client daemon's services
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package daemon assembles the services of the client daemon from
+// it's configuration: the store, the registration of the new
+// accounts, the sessions with the Providers, the senders and the
+// fetchers retrieving the queued messages on their Poisson schedule.
+// The daemon binary, see the daemons repo, creates a Daemon, starts
+// it, serves it's management commands and halts it on shutdown.
+package daemon
+
+import (
+	"context"
+	"errors"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/account_removal"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/mail_filter"
+	"github.com/katzenpost/client/internal/management"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/internal/proxy"
+	"github.com/katzenpost/client/internal/registration"
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/client/internal/wipe"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/client/user_pki"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// Options are the dependencies of a Daemon
+// which aren't part of it's configuration
+type Options struct {
+	// KeysDir is the keys directory, see key_store
+	KeysDir string
+	// Passphrase decrypts the keys
+	Passphrase string
+	// DBFile is the database file, unused by ephemeral clients
+	DBFile string
+	// MixPKI is the PKI of the mix network
+	MixPKI pki.Client
+	// UserPKI provides the keys of the recipients
+	UserPKI user_pki.UserPKI
+	// ProviderAuthenticator authenticates the Providers
+	ProviderAuthenticator wire.PeerAuthenticator
+}
+
+// validate returns an error if a dependency is missing
+func (o *Options) validate() error {
+	if o.MixPKI == nil {
+		return errors.New("daemon: no mix PKI")
+	}
+	if o.UserPKI == nil {
+		return errors.New("daemon: no user PKI")
+	}
+	if o.ProviderAuthenticator == nil {
+		return errors.New("daemon: no Provider authenticator")
+	}
+	return nil
+}
+
+// Daemon holds the services of a running client
+type Daemon struct {
+	Config         *config.Config
+	Store          *storage.Store
+	Pool           *session_pool.SessionPool
+	Supervisor     *supervisor.Supervisor
+	SendScheduler  *proxy.SendScheduler
+	FetchScheduler *proxy.FetchScheduler
+	Senders        map[string]*proxy.Sender
+	Fetchers       map[string]*proxy.Fetcher
+	// Wiper destroys the local data of the client, e.g.
+	// on a signal, see wipe.Wiper.WipeOn
+	Wiper *wipe.Wiper
+	// Management serves the wipe and account removal
+	// commands, see ServeManagement
+	Management *management.Server
+
+	remover *account_removal.Remover
+}
+
+// New creates the services of the client with the given configuration,
+// they are started by Start. The Providers are connected to.
+func New(cfg *config.Config, opts *Options) (*Daemon, error) {
+	err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	d := Daemon{
+		Config:     cfg,
+		Supervisor: supervisor.New(),
+		Senders:    make(map[string]*proxy.Sender),
+		Fetchers:   make(map[string]*proxy.Fetcher),
+	}
+	err = d.init(opts)
+	if err != nil {
+		d.close()
+		return nil, err
+	}
+	d.Wiper = d.newWiper(opts)
+	d.Management = d.newManagement(d.remover)
+	return &d, nil
+}
+
+// init creates the services, those created
+// before a failure are released by close
+func (d *Daemon) init(opts *Options) error {
+	cfg := d.Config
+	linkKeys, linkDuress, err := cfg.OpenAccountsMap(constants.LinkLayerKeyType, opts.KeysDir, opts.Passphrase)
+	if err != nil {
+		return err
+	}
+	e2eKeys, e2eDuress, err := cfg.OpenAccountsMap(constants.EndToEndKeyType, opts.KeysDir, opts.Passphrase)
+	if err != nil {
+		return err
+	}
+	if linkDuress || e2eDuress {
+		// nothing is logged, the client looks like it starts afresh
+		err = d.coverData(opts)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Ephemeral {
+		d.Store, err = storage.NewEphemeral()
+	} else {
+		d.Store, err = storage.New(opts.DBFile)
+	}
+	if err != nil {
+		return err
+	}
+	err = d.Store.CreateAccountBuckets(cfg.AccountIdentities())
+	if err != nil {
+		return err
+	}
+	rules, err := mail_filter.RulesFromConfig(&cfg.MailFilter)
+	if err != nil {
+		return err
+	}
+	if rules != nil {
+		// the received messages are filed into the folders
+		d.Store.SetSorter(rules)
+	}
+	// the accounts must exist before their sessions are established
+	err = registration.RegisterAccounts(context.Background(), cfg, linkKeys, d.Store)
+	if err != nil {
+		return err
+	}
+	d.Pool, err = session_pool.NewWithHealth(linkKeys, cfg, opts.ProviderAuthenticator, opts.MixPKI, d.Store)
+	if err != nil {
+		return err
+	}
+	d.Pool.SetSupervisor(d.Supervisor)
+	routeFactory := path_selection.New(opts.MixPKI, constants.HopsPerPath, constants.PoissonLambda)
+	handlers := make(map[string]*block.Handler)
+	for _, acct := range cfg.Account {
+		identity := acct.Name + "@" + acct.Provider
+		key, err := e2eKeys.GetIdentityKey(identity)
+		if err != nil {
+			return err
+		}
+		handlers[identity] = block.NewHandler(key, entropy.Reader)
+		// the Fetcher and the Sender share the session through it's Mux
+		_, err = d.Pool.Multiplex(identity)
+		if err != nil {
+			return err
+		}
+		sender, err := proxy.NewSender(identity, d.Pool, d.Store, routeFactory, opts.UserPKI, handlers[identity])
+		if err != nil {
+			return err
+		}
+		sender.SetSendWindow(acct.SendWindow)
+		sender.SetMonthlyCap(uint64(acct.MonthlyUsageCap))
+		d.Senders[identity] = sender
+	}
+	d.SendScheduler = proxy.NewSendScheduler(d.Senders)
+	d.SendScheduler.SetSupervisor(d.Supervisor)
+	d.SendScheduler.SetWatermarks(cfg.QueueWatermarks())
+	filter := mail_filter.FromConfig(&cfg.MailFilter)
+	for _, acct := range cfg.Account {
+		identity := acct.Name + "@" + acct.Provider
+		fetcher := proxy.NewFetcher(identity, d.Pool, d.Store, d.SendScheduler, handlers[identity])
+		fetcher.SetFilter(filter)
+		if cfg.EndToEndEncryption {
+			key, _ := e2eKeys.GetIdentityKey(identity)
+			fetcher.SetIdentityKey(key)
+		}
+		if !cfg.DeliveryEnabled() {
+			fetcher.DiscardMessages()
+		}
+		fetcher.SetMailboxQuota(uint64(acct.MailboxQuota))
+		fetcher.SetSupervisor(d.Supervisor)
+		fetcher.SetReassemblyWorkers(cfg.FetchReassemblyWorkers())
+		d.Fetchers[identity] = fetcher
+	}
+	d.FetchScheduler = proxy.NewFetchScheduler(d.Fetchers, cfg.FetchInterval())
+	d.FetchScheduler.SetMaxBatch(cfg.FetchMaxBatch())
+	d.FetchScheduler.SetSupervisor(d.Supervisor)
+	d.remover, err = d.newRemover(opts, linkKeys, e2eKeys)
+	return err
+}
+
+// Start starts retrieving the queued messages of the accounts
+// from their Providers and sending the queued Blocks, in the
+// send slots and with the decoys of the accounts' traffic profiles
+func (d *Daemon) Start() error {
+	cfg := d.Config
+	if cfg.SendSlots.Enabled {
+		d.SendScheduler.EnableSendSlots(cfg.SendSlotInterval(), cfg.SendSlots.PrioritizeInteractive)
+	}
+	d.SendScheduler.SetCoverTraffic(cfg.CoverTrafficEnabled())
+	for _, acct := range cfg.Account {
+		profile := cfg.AccountTrafficProfile(acct)
+		if profile == nil {
+			continue
+		}
+		err := d.SendScheduler.SetTrafficProfile(acct.Name+"@"+acct.Provider, profile)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := d.SendScheduler.Recover()
+	if err != nil {
+		return err
+	}
+	d.FetchScheduler.Start()
+	log.Noticef("client started with %d accounts", len(d.Fetchers))
+	return nil
+}
+
+// Halt stops the services and closes the
+// management listener, the sessions and the store
+func (d *Daemon) Halt() {
+	err := d.Management.Halt()
+	if err != nil {
+		log.Errorf("failed to close the management listener: %s", err)
+	}
+	d.Supervisor.Halt()
+	d.close()
+}
+
+// close stops the reassembly workers once the received
+// messages are reassembled and releases the sessions and the store
+func (d *Daemon) close() {
+	for _, fetcher := range d.Fetchers {
+		fetcher.Halt()
+	}
+	if d.Pool != nil {
+		d.Pool.Close()
+	}
+	if d.Store != nil {
+		err := d.Store.Close()
+		if err != nil {
+			log.Errorf("failed to close the store: %s", err)
+		}
+	}
+}
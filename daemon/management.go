@@ -0,0 +1,69 @@
+// management.go - the management commands of the daemon
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"net"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/account_removal"
+	"github.com/katzenpost/client/internal/key_store"
+	"github.com/katzenpost/client/internal/management"
+)
+
+// newRemover creates the Remover of the accounts of the daemon,
+// which forgets the keys of the removed accounts from the given maps
+func (d *Daemon) newRemover(opts *Options, keys ...*config.AccountsMap) (*account_removal.Remover, error) {
+	store, err := key_store.Open(opts.KeysDir)
+	if err != nil {
+		return nil, err
+	}
+	r := account_removal.New(d.Config, d.Store, store)
+	r.SetSessions(d.Pool)
+	for _, k := range keys {
+		r.AddKeys(k)
+	}
+	return r, nil
+}
+
+// newManagement creates the management Server of the daemon
+// with the wipe and the account removal commands
+func (d *Daemon) newManagement(remover *account_removal.Remover) *management.Server {
+	s := management.New()
+	s.Handle(management.WipeCommand, management.WipeHandler(d.Wiper))
+	s.Handle(management.RemoveAccountCommand, management.RemoveAccountHandler(remover))
+	return s
+}
+
+// ServeManagement serves the management commands on the given
+// listener, e.g. the systemd.ManagementListener passed by socket
+// activation, or if it's nil on the socket of the configuration,
+// if any. The listener is closed by Halt.
+func (d *Daemon) ServeManagement(l net.Listener) error {
+	if l == nil {
+		if d.Config.Management.Path == "" {
+			return nil
+		}
+		var err error
+		l, err = management.Listen(d.Config.Management.Path)
+		if err != nil {
+			return err
+		}
+	}
+	d.Management.Serve(l)
+	return nil
+}
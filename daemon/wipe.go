@@ -0,0 +1,110 @@
+// wipe.go - the local data destroyed by the emergency wipe
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/client/internal/notify"
+	"github.com/katzenpost/client/internal/proxy"
+	"github.com/katzenpost/client/internal/send_ledger"
+	"github.com/katzenpost/client/internal/wipe"
+	"github.com/katzenpost/client/storage"
+)
+
+// newWiper creates the Wiper of the local data of the client, the
+// keys and the data stores, see dataFiles. The Wiper halts the
+// daemon before destroying them.
+func (d *Daemon) newWiper(opts *Options) *wipe.Wiper {
+	w := wipe.New()
+	w.OnWipe(func() error {
+		d.Halt()
+		return nil
+	})
+	if opts.KeysDir != "" {
+		w.AddPath(opts.KeysDir)
+	}
+	paths, patterns := d.dataFiles(opts)
+	for _, path := range paths {
+		w.AddPath(path)
+	}
+	for _, pattern := range patterns {
+		w.AddPattern(pattern)
+	}
+	return w
+}
+
+// coverData shreds the data stores once the decoy keys were opened
+// with the duress passphrase, so that the client starts with the
+// empty state of the decoy instead of the data of the real keys
+func (d *Daemon) coverData(opts *Options) error {
+	var first error
+	paths, patterns := d.dataFiles(opts)
+	for _, path := range paths {
+		err := wipe.Shred(path)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	for _, pattern := range patterns {
+		err := wipe.ShredPattern(pattern)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// dataFiles returns the paths and the patterns, see filepath.Match,
+// of the data stores of the client: the database and it's temporary
+// copies, the spool files, the Maildirs, the send ledger, the status
+// file and the audit logs with their secret
+func (d *Daemon) dataFiles(opts *Options) ([]string, []string) {
+	cfg := d.Config
+	paths := []string{}
+	patterns := []string{}
+	if !cfg.Ephemeral && opts.DBFile != "" {
+		paths = append(paths, opts.DBFile)
+		patterns = append(patterns, storage.TemporaryFiles(opts.DBFile)...)
+	}
+	spoolDir := cfg.Spool.Directory
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+	patterns = append(patterns, filepath.Join(spoolDir, proxy.SpoolFilePrefix+"*"))
+	if cfg.Maildir.Path != "" {
+		for _, identity := range cfg.AccountIdentities() {
+			paths = append(paths, filepath.Join(cfg.Maildir.Path, identity))
+		}
+	}
+	if cfg.SendLedger.Directory != "" {
+		// the key first, so that the entries are unreadable
+		// even if the ledger file can't be destroyed
+		paths = append(paths, filepath.Join(cfg.SendLedger.Directory, send_ledger.KeyFileName))
+		patterns = append(patterns, filepath.Join(cfg.SendLedger.Directory, send_ledger.LedgerFileName+"*"))
+	}
+	if cfg.StatusFile != "" {
+		paths = append(paths, cfg.StatusFile)
+	}
+	for _, n := range cfg.Notifier {
+		if n.Type == "audit" {
+			paths = append(paths, n.Path, n.Path+notify.AuditSecretSuffix)
+		}
+	}
+	return paths, patterns
+}
@@ -0,0 +1,48 @@
+// doc.go - mixnet client library documentation
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package client is the Panoramix decryption mix network client library.
+//
+// The exported identifiers of the following packages form the stable
+// API of the library:
+//
+//	github.com/katzenpost/client/clock
+//	github.com/katzenpost/client/config
+//	github.com/katzenpost/client/crypto/block
+//	github.com/katzenpost/client/crypto/vault
+//	github.com/katzenpost/client/daemon
+//	github.com/katzenpost/client/mix_pki
+//	github.com/katzenpost/client/storage
+//	github.com/katzenpost/client/user_pki
+//
+// All the other packages are under internal/, they may change at any
+// time and can't be imported by other programs.
+//
+// Identifiers of the stable API are never removed nor changed in an
+// incompatible way within a major version, new identifiers may be
+// added at any time. This is enforced by TestStableAPI which compares
+// the exported API against the API file of the major version of the
+// module path, testdata/api.txt for the first one. Running it with
+// -update-api only adds the new identifiers to the API file.
+//
+// An incompatible change requires a new major version: the module
+// path, the import comment below or the module directive of go.mod,
+// gets the next major version suffix, e.g.
+// github.com/katzenpost/client/v2, and TestStableAPI then checks the
+// API file of that version, e.g. testdata/api.v2.txt, which is
+// created by running it with -update-api. The API files of the
+// previous major versions are left as they are.
+package client // import "github.com/katzenpost/client"
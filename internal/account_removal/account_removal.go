@@ -0,0 +1,183 @@
+// account_removal.go - removal of an account from the running client
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package account_removal removes an account from the running
+// client and destroys it's local data: it's keys are forgotten, it's
+// session is logged out of it's Provider, it's records are deleted
+// from the database, which is compacted when it's next opened, it's
+// Maildir and key files are shredded and it's send ledger entries are
+// removed. The Account
+// section must then be removed from the configuration file, the
+// client doesn't start with an account whose keys are missing.
+package account_removal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/wipe"
+	"github.com/katzenpost/client/storage"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// Store deletes the buckets of the accounts, it's
+// implemented by storage.Store
+type Store interface {
+	DeleteAccount(accountName string) error
+}
+
+// Keys removes the key files of the accounts, it's
+// implemented by key_store.Store
+type Keys interface {
+	RemoveAccount(email string) error
+}
+
+// Ledger removes the send ledger entries of the
+// accounts, it's implemented by send_ledger.Ledger
+type Ledger interface {
+	RemoveAccount(account string) error
+}
+
+// Sessions logs the accounts out of their Provider,
+// it's implemented by session_pool.SessionPool
+type Sessions interface {
+	Remove(identity string) error
+}
+
+// Remover removes accounts from the running client
+type Remover struct {
+	sync.Mutex
+
+	cfg      *config.Config
+	store    Store
+	keys     Keys
+	sessions Sessions
+	ledger   Ledger
+	accounts []*config.AccountsMap
+	halts    []func(account string) error
+}
+
+// New creates a new Remover of the accounts of the given
+// configuration whose data is kept in the given Store and Keys
+func New(cfg *config.Config, store Store, keys Keys) *Remover {
+	r := Remover{
+		cfg:   cfg,
+		store: store,
+		keys:  keys,
+	}
+	return &r
+}
+
+// SetSessions sets the Sessions which log the removed
+// accounts out of their Provider
+func (r *Remover) SetSessions(sessions Sessions) {
+	r.Lock()
+	defer r.Unlock()
+	r.sessions = sessions
+}
+
+// SetLedger sets the send ledger from which the
+// entries of the removed accounts are removed
+func (r *Remover) SetLedger(ledger Ledger) {
+	r.Lock()
+	defer r.Unlock()
+	r.ledger = ledger
+}
+
+// AddKeys adds a map of the keys of the accounts from
+// which the keys of the removed accounts are forgotten
+func (r *Remover) AddKeys(accounts *config.AccountsMap) {
+	r.Lock()
+	defer r.Unlock()
+	r.accounts = append(r.accounts, accounts)
+}
+
+// OnRemove registers a function which stops the use of an
+// account, e.g. it's fetching, it's called with the removed
+// account before it's data is destroyed
+func (r *Remover) OnRemove(halt func(account string) error) {
+	r.Lock()
+	defer r.Unlock()
+	r.halts = append(r.halts, halt)
+}
+
+// identity returns the configured identity of the given
+// account, e-mail addresses are case insensitive
+func (r *Remover) identity(account string) (string, error) {
+	for _, identity := range r.cfg.AccountIdentities() {
+		if strings.EqualFold(identity, account) {
+			return identity, nil
+		}
+	}
+	return "", fmt.Errorf("unknown account %s", account)
+}
+
+// RemoveAccount removes the given account. Every step is run
+// even if an earlier one fails, so that as much of the data as
+// possible is destroyed, the first failure is returned.
+func (r *Remover) RemoveAccount(account string) error {
+	r.Lock()
+	defer r.Unlock()
+	identity, err := r.identity(account)
+	if err != nil {
+		return err
+	}
+	var first error
+	fail := func(step string, err error) {
+		log.Errorf("%s: failed to %s: %s", identity, step, err)
+		if first == nil {
+			first = fmt.Errorf("failed to %s: %s", step, err)
+		}
+	}
+	for _, accounts := range r.accounts {
+		delete(*accounts, strings.ToLower(identity))
+	}
+	for _, halt := range r.halts {
+		if err := halt(identity); err != nil {
+			fail("stop the account", err)
+		}
+	}
+	if r.sessions != nil {
+		if err := r.sessions.Remove(identity); err != nil {
+			fail("log out", err)
+		}
+	}
+	if err := r.store.DeleteAccount(identity); err != nil && err != storage.ErrNoSuchAccount {
+		fail("delete the records", err)
+	}
+	if r.cfg.Maildir.Path != "" {
+		if err := wipe.Shred(filepath.Join(r.cfg.Maildir.Path, identity)); err != nil {
+			fail("shred the Maildir", err)
+		}
+	}
+	if r.ledger != nil {
+		if err := r.ledger.RemoveAccount(identity); err != nil {
+			fail("remove the send ledger entries", err)
+		}
+	}
+	if err := r.keys.RemoveAccount(identity); err != nil {
+		fail("remove the key files", err)
+	}
+	if first == nil {
+		log.Noticef("%s: account removed", identity)
+	}
+	return first
+}
@@ -0,0 +1,115 @@
+// account_removal_test.go - tests for the removal of accounts
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package account_removal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/key_store"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/stretchr/testify/require"
+)
+
+type testSessions []string
+
+func (s *testSessions) Remove(identity string) error {
+	*s = append(*s, identity)
+	return nil
+}
+
+type testLedger []string
+
+func (l *testLedger) RemoveAccount(account string) error {
+	*l = append(*l, account)
+	return nil
+}
+
+func TestRemoveAccount(t *testing.T) {
+	require := require.New(t)
+
+	cfg := &config.Config{
+		Account: []config.Account{
+			{Name: "Alice", Provider: "acme.com"},
+			{Name: "bob", Provider: "nsa.gov"},
+		},
+	}
+	store, err := storage.NewEphemeral()
+	require.NoError(err, "NewEphemeral failed")
+	defer store.Close()
+	err = store.CreateAccountBuckets(cfg.AccountIdentities())
+	require.NoError(err, "CreateAccountBuckets failed")
+	dir, err := ioutil.TempDir("", "account_removal_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	keys, err := key_store.Open(dir)
+	require.NoError(err, "key_store.Open failed")
+	for _, account := range cfg.Account {
+		keyFile := keys.KeyFile(constants.EndToEndKeyType, account.Name, account.Provider, constants.KeyStatusPrivate)
+		err = keys.WriteFile(keyFile, []byte("key"))
+		require.NoError(err, "WriteFile failed")
+	}
+	accounts := config.AccountsMap{
+		"alice@acme.com": new(ecdh.PrivateKey),
+		"bob@nsa.gov":    new(ecdh.PrivateKey),
+	}
+	cfg.Maildir.Path = filepath.Join(dir, "Maildir")
+	for _, identity := range cfg.AccountIdentities() {
+		_, err = storage.NewMaildir(filepath.Join(cfg.Maildir.Path, identity))
+		require.NoError(err, "NewMaildir failed")
+	}
+	sessions := &testSessions{}
+	ledger := &testLedger{}
+	halted := []string{}
+
+	r := New(cfg, store, keys)
+	r.SetSessions(sessions)
+	r.SetLedger(ledger)
+	r.AddKeys(&accounts)
+	r.OnRemove(func(account string) error {
+		halted = append(halted, account)
+		return nil
+	})
+	err = r.RemoveAccount("carol@fsb.ru")
+	require.Error(err, "unknown account removed")
+
+	err = r.RemoveAccount("alice@acme.com")
+	require.NoError(err, "RemoveAccount failed")
+	require.Equal([]string{"Alice@acme.com"}, halted)
+	require.Equal([]string{"Alice@acme.com"}, []string(*sessions))
+	require.Equal([]string{"Alice@acme.com"}, []string(*ledger))
+	_, err = accounts.GetIdentityKey("alice@acme.com")
+	require.Error(err, "key of the removed account not forgotten")
+	_, err = accounts.GetIdentityKey("bob@nsa.gov")
+	require.NoError(err, "key of another account forgotten")
+	names, err := store.Accounts()
+	require.NoError(err, "Accounts failed")
+	require.Equal([]string{"bob@nsa.gov"}, names)
+	_, err = os.Stat(filepath.Join(dir, "alice@acme.com"))
+	require.True(os.IsNotExist(err), "key files of the removed account not removed")
+	_, err = os.Stat(filepath.Join(dir, "bob@nsa.gov"))
+	require.NoError(err, "key files of another account removed")
+	_, err = os.Stat(filepath.Join(cfg.Maildir.Path, "Alice@acme.com"))
+	require.True(os.IsNotExist(err), "Maildir of the removed account not shredded")
+	_, err = os.Stat(filepath.Join(cfg.Maildir.Path, "bob@nsa.gov"))
+	require.NoError(err, "Maildir of another account shredded")
+}
@@ -0,0 +1,121 @@
+// password.go - local proxy password hashing
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/magical/argon2"
+)
+
+const (
+	// passwordHashPrefix identifies the encoding of a password hash
+	passwordHashPrefix = "$argon2i$"
+
+	// the argon2 cost parameters of the password hashes, lower than
+	// those of the key vaults as a hash is checked at each login
+	passwordNumIter     = 4
+	passwordParallelism = 2
+	passwordMemory      = int64(1 << 15)
+
+	passwordSaltSize = 16
+	passwordHashSize = 32
+)
+
+// ErrInvalidPasswordHash is the error returned when
+// a password hash isn't in the encoding of HashPassword
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// HashPassword returns the salted argon2 hash of the given password,
+// encoded as $argon2i$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+// with the salt and hash base64 encoded, suitable for the configuration
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	_, err := io.ReadFull(entropy.Reader, salt)
+	if err != nil {
+		return "", err
+	}
+	hash, err := argon2.Key([]byte(password), salt, passwordNumIter, passwordParallelism, passwordMemory, passwordHashSize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%sm=%d,t=%d,p=%d$%s$%s", passwordHashPrefix, passwordMemory, passwordNumIter, passwordParallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// parsePasswordHash returns the parameters, salt and hash of the
+// given password hash in the encoding of HashPassword
+func parsePasswordHash(encoded string) (memory int64, numIter, parallelism int, salt, hash []byte, err error) {
+	if !strings.HasPrefix(encoded, passwordHashPrefix) {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	fields := strings.Split(encoded[len(passwordHashPrefix):], "$")
+	if len(fields) != 3 {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	_, err = fmt.Sscanf(fields[0], "m=%d,t=%d,p=%d", &memory, &numIter, &parallelism)
+	if err != nil || memory <= 0 || numIter <= 0 || parallelism <= 0 {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil || len(salt) == 0 {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	hash, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil || len(hash) == 0 {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	return memory, numIter, parallelism, salt, hash, nil
+}
+
+// ValidatePasswordHash returns an error if the given password
+// hash isn't in the encoding of HashPassword
+func ValidatePasswordHash(encoded string) error {
+	_, _, _, _, _, err := parsePasswordHash(encoded)
+	return err
+}
+
+// CheckPassword returns true if the given
+// password matches the given password hash
+func CheckPassword(encoded string, password []byte) bool {
+	memory, numIter, parallelism, salt, hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+	computed, err := argon2.Key(password, salt, numIter, parallelism, memory, len(hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed, hash) == 1
+}
+
+// CheckAPOP returns true if the given hex encoded digest is the
+// APOP digest of the given greeting timestamp and shared secret,
+// RFC 1939 section 7
+func CheckAPOP(secret, timestamp string, digest []byte) bool {
+	sum := md5.Sum([]byte(timestamp + secret))
+	expected := []byte(hex.EncodeToString(sum[:]))
+	return subtle.ConstantTimeCompare(expected, []byte(strings.ToLower(string(digest)))) == 1
+}
@@ -0,0 +1,56 @@
+// password_test.go - local proxy password hashing tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassword(t *testing.T) {
+	require := require.New(t)
+
+	hash, err := HashPassword("hunter2")
+	require.NoError(err, "HashPassword failed")
+	require.True(strings.HasPrefix(hash, passwordHashPrefix))
+	require.NoError(ValidatePasswordHash(hash))
+	require.True(CheckPassword(hash, []byte("hunter2")))
+	require.False(CheckPassword(hash, []byte("hunter3")))
+
+	// the hashes are salted
+	other, err := HashPassword("hunter2")
+	require.NoError(err, "HashPassword failed")
+	require.NotEqual(hash, other)
+
+	for _, invalid := range []string{"", "hunter2", "$argon2i$m=0,t=4,p=2$c2FsdA$aGFzaA", "$argon2i$m=32768,t=4,p=2$c2FsdA"} {
+		require.Equal(ErrInvalidPasswordHash, ValidatePasswordHash(invalid))
+		require.False(CheckPassword(invalid, []byte("hunter2")))
+	}
+}
+
+func TestCheckAPOP(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 1939 section 7
+	timestamp := "<1896.697170952@dbc.mtview.ca.us>"
+	require.True(CheckAPOP("tanstaaf", timestamp, []byte("c4c9334bac560ecc979e58001b3e22fb")))
+	require.True(CheckAPOP("tanstaaf", timestamp, []byte("C4C9334BAC560ECC979E58001B3E22FB")))
+	require.False(CheckAPOP("tanstaafl", timestamp, []byte("c4c9334bac560ecc979e58001b3e22fb")))
+	require.False(CheckAPOP("tanstaaf", timestamp, nil))
+}
@@ -0,0 +1,203 @@
+// autoconfig.go - mail client auto-configuration
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package autoconfig describes the active SMTP and POP3 proxy
+// listeners so that mail clients can be pointed at a file instead
+// of hard-coded ports, which is needed when the listeners are bound
+// to random ports.
+package autoconfig
+
+import (
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Server is the address of a proxy listener
+type Server struct {
+	// Host is the IP address of the listener
+	Host string
+	// Port is the TCP port of the listener
+	Port int
+}
+
+// Account is the mail client configuration of a client account.
+// The proxies accept any password for the given user name.
+type Account struct {
+	// Address is the e-mail address of the account
+	Address string
+	// UserName is the SMTP and POP3 user name of the account
+	UserName string
+}
+
+// AutoConfig describes the active proxy listeners
+// and the accounts served by them
+type AutoConfig struct {
+	SMTP    Server
+	POP3    Server
+	Account []Account
+}
+
+// serverFromAddr returns the Server of the given listener address
+func serverFromAddr(addr net.Addr) (Server, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return Server{}, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return Server{}, err
+	}
+	return Server{Host: host, Port: portNumber}, nil
+}
+
+// New returns a new *AutoConfig given the bound SMTP and POP3
+// listeners and the account e-mail addresses. Listeners bound to
+// port 0 are described with the port picked by the kernel.
+func New(smtpListener, pop3Listener net.Listener, accounts []string) (*AutoConfig, error) {
+	smtpServer, err := serverFromAddr(smtpListener.Addr())
+	if err != nil {
+		return nil, err
+	}
+	pop3Server, err := serverFromAddr(pop3Listener.Addr())
+	if err != nil {
+		return nil, err
+	}
+	a := AutoConfig{
+		SMTP: smtpServer,
+		POP3: pop3Server,
+	}
+	for _, account := range accounts {
+		a.Account = append(a.Account, Account{
+			Address:  account,
+			UserName: strings.ToLower(account),
+		})
+	}
+	return &a, nil
+}
+
+// writeFile atomically replaces the contents of the given file
+// so that mail clients never read a partially written file
+func writeFile(fileName string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// WriteFile writes the auto-configuration in TOML
+// format, the same as the client configuration file
+func (a *AutoConfig) WriteFile(fileName string) error {
+	data, err := toml.Marshal(*a)
+	if err != nil {
+		return err
+	}
+	return writeFile(fileName, data)
+}
+
+// thunderbirdServer is a server of the Thunderbird autoconfig format
+type thunderbirdServer struct {
+	Type           string `xml:"type,attr"`
+	Hostname       string `xml:"hostname"`
+	Port           int    `xml:"port"`
+	SocketType     string `xml:"socketType"`
+	Authentication string `xml:"authentication"`
+	Username       string `xml:"username"`
+}
+
+// thunderbirdProvider is the email provider
+// of the Thunderbird autoconfig format
+type thunderbirdProvider struct {
+	ID             string            `xml:"id,attr"`
+	Domain         string            `xml:"domain"`
+	DisplayName    string            `xml:"displayName"`
+	IncomingServer thunderbirdServer `xml:"incomingServer"`
+	OutgoingServer thunderbirdServer `xml:"outgoingServer"`
+}
+
+// thunderbirdConfig is the root element of the Thunderbird
+// autoconfig format, see
+// https://wiki.mozilla.org/Thunderbird:Autoconfiguration:ConfigFileFormat
+type thunderbirdConfig struct {
+	XMLName  xml.Name            `xml:"clientConfig"`
+	Version  string              `xml:"version,attr"`
+	Provider thunderbirdProvider `xml:"emailProvider"`
+}
+
+// WriteThunderbirdFile writes a Thunderbird autoconfig
+// XML file for the account with the given e-mail address
+func (a *AutoConfig) WriteThunderbirdFile(fileName, address string) error {
+	var account *Account
+	for i := range a.Account {
+		if strings.EqualFold(a.Account[i].Address, address) {
+			account = &a.Account[i]
+		}
+	}
+	if account == nil {
+		return errors.New("account not found")
+	}
+	fields := strings.Split(account.Address, "@")
+	if len(fields) != 2 {
+		return errors.New("invalid account e-mail address")
+	}
+	c := thunderbirdConfig{
+		Version: "1.1",
+		Provider: thunderbirdProvider{
+			ID:          fields[1],
+			Domain:      fields[1],
+			DisplayName: "Katzenpost " + fields[1],
+			IncomingServer: thunderbirdServer{
+				Type:           "pop3",
+				Hostname:       a.POP3.Host,
+				Port:           a.POP3.Port,
+				SocketType:     "plain",
+				Authentication: "password-cleartext",
+				Username:       account.UserName,
+			},
+			OutgoingServer: thunderbirdServer{
+				Type:           "smtp",
+				Hostname:       a.SMTP.Host,
+				Port:           a.SMTP.Port,
+				SocketType:     "plain",
+				Authentication: "none",
+				Username:       account.UserName,
+			},
+		},
+	}
+	data, err := xml.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(fileName, append([]byte(xml.Header), data...))
+}
@@ -0,0 +1,74 @@
+// autoconfig_test.go - mail client auto-configuration tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package autoconfig
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoConfig(t *testing.T) {
+	require := require.New(t)
+
+	smtpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "unexpected Listen error")
+	defer smtpListener.Close()
+	pop3Listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "unexpected Listen error")
+	defer pop3Listener.Close()
+
+	a, err := New(smtpListener, pop3Listener, []string{"Alice@acme.com"})
+	require.NoError(err, "unexpected New() error")
+	require.Equal(smtpListener.Addr().(*net.TCPAddr).Port, a.SMTP.Port)
+	require.NotEqual(0, a.POP3.Port)
+
+	dir, err := ioutil.TempDir("", "autoconfig_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "autoconfig.toml")
+	err = a.WriteFile(fileName)
+	require.NoError(err, "unexpected WriteFile() error")
+	data, err := ioutil.ReadFile(fileName)
+	require.NoError(err, "unexpected ReadFile error")
+	b := AutoConfig{}
+	err = toml.Unmarshal(data, &b)
+	require.NoError(err, "unexpected Unmarshal error")
+	require.Equal(*a, b)
+
+	xmlFileName := filepath.Join(dir, "config-v1.1.xml")
+	err = a.WriteThunderbirdFile(xmlFileName, "alice@acme.com")
+	require.NoError(err, "unexpected WriteThunderbirdFile() error")
+	data, err = ioutil.ReadFile(xmlFileName)
+	require.NoError(err, "unexpected ReadFile error")
+	c := thunderbirdConfig{}
+	err = xml.Unmarshal(data, &c)
+	require.NoError(err, "unexpected xml.Unmarshal error")
+	require.Equal("acme.com", c.Provider.Domain)
+	require.Equal(a.POP3.Port, c.Provider.IncomingServer.Port)
+	require.Equal("alice@acme.com", c.Provider.OutgoingServer.Username)
+
+	err = a.WriteThunderbirdFile(xmlFileName, "bob@nsa.gov")
+	require.Error(err, "expected WriteThunderbirdFile() error for unknown account")
+}
@@ -0,0 +1,198 @@
+// cbor_test.go - canonical CBOR tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package canonical_cbor
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type tagged struct {
+	Epoch     uint64            `cbor:"epoch"`
+	Name      string            `cbor:"name"`
+	Key       [4]byte           `cbor:"key"`
+	Lambda    float64           `cbor:"lambda"`
+	Kaetzchen map[string]string `cbor:"kaetzchen,omitempty"`
+	Cache     []byte            `cbor:"-"`
+	Layers    [][]int8
+	Next      *tagged `cbor:"next"`
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 7049 appendix A
+	vectors := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{uint64(0), []byte{0x00}},
+		{23, []byte{0x17}},
+		{24, []byte{0x18, 0x18}},
+		{1000000, []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{-1000, []byte{0x39, 0x03, 0xe7}},
+		{1.5, []byte{0xfa, 0x3f, 0xc0, 0x00, 0x00}},
+		{1.1, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{"IETF", []byte{0x64, 0x49, 0x45, 0x54, 0x46}},
+		{[]byte{1, 2}, []byte{0x42, 0x01, 0x02}},
+		{nil, []byte{0xf6}},
+		{map[string]interface{}{"b": []int{2, 3}, "a": 1}, []byte{0xa2, 0x61, 0x61, 0x01, 0x61, 0x62, 0x82, 0x02, 0x03}},
+		// shorter keys sort first
+		{map[string]int{"aa": 1, "b": 2}, []byte{0xa2, 0x61, 0x62, 0x02, 0x62, 0x61, 0x61, 0x01}},
+	}
+	for _, vector := range vectors {
+		b, err := Marshal(vector.value)
+		require.NoError(err, "unexpected Marshal() error")
+		require.Equal(vector.expected, b, "%v", vector.value)
+	}
+
+	m := make(map[[2]byte]uint64)
+	for i := 0; i < 100; i++ {
+		m[[2]byte{byte(i), byte(i * 7)}] = uint64(i)
+	}
+	first, err := Marshal(m)
+	require.NoError(err, "unexpected Marshal() error")
+	for i := 0; i < 10; i++ {
+		b, err := Marshal(m)
+		require.NoError(err, "unexpected Marshal() error")
+		require.Equal(first, b, "map encoding isn't deterministic")
+	}
+
+	_, err = Marshal(make(chan int))
+	require.Error(err, "a channel was encoded")
+	loop := &tagged{}
+	loop.Next = loop
+	_, err = Marshal(loop)
+	require.Equal(ErrTooDeep, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	value := &tagged{
+		Epoch:     1234567890123,
+		Name:      "mix1_0",
+		Key:       [4]byte{1, 2, 3, 4},
+		Lambda:    0.00025,
+		Kaetzchen: map[string]string{"loop": "+loop"},
+		Cache:     []byte{9},
+		Layers:    [][]int8{{-1, 2}, {3}},
+		Next: &tagged{
+			Name: "provider",
+		},
+	}
+	b, err := Marshal(value)
+	require.NoError(err, "unexpected Marshal() error")
+	decoded := &tagged{}
+	err = Unmarshal(b, decoded)
+	require.NoError(err, "unexpected Unmarshal() error")
+	value.Cache = nil
+	require.Equal(value, decoded)
+
+	// unknown keys are skipped, the self-describe tag is accepted
+	var generic map[string]interface{}
+	err = Unmarshal(append(append([]byte{}, SelfDescribe...), b...), &generic)
+	require.NoError(err, "unexpected Unmarshal() error")
+	require.Equal(uint64(1234567890123), generic["epoch"])
+	generic["unknown"] = []interface{}{"x", uint64(1)}
+	b, err = Marshal(generic)
+	require.NoError(err, "unexpected Marshal() error")
+	decoded = &tagged{}
+	err = Unmarshal(b, decoded)
+	require.NoError(err, "unexpected Unmarshal() error")
+	require.Equal("mix1_0", decoded.Name)
+
+	// stream several items
+	buf := new(bytes.Buffer)
+	encoder := NewEncoder(buf)
+	for i := 0; i < 3; i++ {
+		err = encoder.Encode(&tagged{Epoch: uint64(i)})
+		require.NoError(err, "unexpected Encode() error")
+	}
+	decoder := NewDecoder(buf)
+	for i := 0; i < 3; i++ {
+		decoded = &tagged{}
+		err = decoder.Decode(decoded)
+		require.NoError(err, "unexpected Decode() error")
+		require.Equal(uint64(i), decoded.Epoch)
+	}
+	err = decoder.Decode(decoded)
+	require.Equal(io.EOF, err)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	require := require.New(t)
+
+	var u uint8
+	require.Error(Unmarshal([]byte{0x19, 0x01, 0x00}, &u), "an overflowing integer was decoded")
+	var s string
+	require.Error(Unmarshal([]byte{0x62, 0xff, 0xfe}, &s), "invalid UTF-8 was decoded")
+	require.Equal(io.ErrUnexpectedEOF, Unmarshal([]byte{0x62, 0x61}, &s))
+	require.Equal(ErrTrailingData, Unmarshal([]byte{0x00, 0x00}, &u))
+	require.Equal(ErrIndefiniteLength, Unmarshal([]byte{0x9f, 0xff}, &[]int{}))
+	var m map[string]int
+	require.Error(Unmarshal([]byte{0xa2, 0x61, 0x61, 0x01, 0x61, 0x61, 0x02}, &m), "a duplicate key was decoded")
+	var a []int
+	// a forged length doesn't allocate the array
+	require.Equal(io.ErrUnexpectedEOF, Unmarshal([]byte{0x9b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, &a))
+	var generic interface{}
+	require.Error(Unmarshal(bytes.Repeat([]byte{0x81}, MaxDepth+2), &generic), "too deep nesting was decoded")
+	require.Error(Unmarshal([]byte{0xa1, 0x41, 0x00, 0x00}, &generic), "a byte string key was decoded")
+
+	var f float64
+	require.NoError(Unmarshal([]byte{0xf9, 0x3c, 0x00}, &f))
+	require.Equal(1.0, f)
+	require.NoError(Unmarshal([]byte{0xf9, 0x7c, 0x00}, &f))
+	require.True(math.IsInf(f, 1))
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	seeds := []interface{}{
+		uint64(1), -500, 1.1, "text", []byte{1, 2, 3}, true, nil,
+		[]interface{}{"a", uint64(2), []interface{}{}},
+		map[string]interface{}{"a": uint64(1), "bb": []byte{2}},
+		map[interface{}]interface{}{uint64(1): "one", "two": uint64(2)},
+		&tagged{Epoch: 1, Name: "n", Layers: [][]int8{{1}}},
+	}
+	for _, seed := range seeds {
+		b, err := Marshal(seed)
+		require.NoError(f, err, "unexpected Marshal() error")
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var generic interface{}
+		if Unmarshal(data, &generic) != nil {
+			// must not panic on typed decoding either
+			Unmarshal(data, &tagged{})
+			return
+		}
+		// the canonical encoding of any decoded
+		// value must be stable
+		b, err := Marshal(generic)
+		require.NoError(t, err, "unexpected Marshal() error")
+		var decoded interface{}
+		err = Unmarshal(b, &decoded)
+		require.NoError(t, err, "unexpected Unmarshal() error")
+		again, err := Marshal(decoded)
+		require.NoError(t, err, "unexpected Marshal() error")
+		require.Equal(t, b, again)
+	})
+}
@@ -0,0 +1,501 @@
+// decode.go - streaming CBOR decoder
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package canonical_cbor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"unicode/utf8"
+)
+
+const (
+	// maxPrealloc is the maximum number of array elements
+	// preallocated, so that a forged length can't exhaust
+	// the memory before the elements are read
+	maxPrealloc = 1024
+
+	// MaxLength is the maximum length of a byte or text string
+	MaxLength = 1 << 30
+)
+
+var (
+	// ErrTrailingData is the error returned by Unmarshal
+	// when data follows the decoded item
+	ErrTrailingData = errors.New("cbor data follows the item")
+
+	// ErrIndefiniteLength is the error returned when an item
+	// has an indefinite length, these are never encoded
+	ErrIndefiniteLength = errors.New("cbor indefinite lengths are not supported")
+
+	errMalformed = errors.New("malformed cbor item")
+)
+
+// head is the initial byte and argument of an item
+type head struct {
+	major byte
+	info  byte
+	n     uint64
+}
+
+// Decoder reads CBOR items from an io.Reader
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a new Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{
+		r: br,
+	}
+}
+
+// Decode reads the next item into the value pointed to by v,
+// io.EOF is returned if there are no more items
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("cbor requires a non-nil pointer to decode into")
+	}
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	return d.decode(rv.Elem(), 0)
+}
+
+// Unmarshal decodes the single item of data into
+// the value pointed to by v
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	err := d.Decode(v)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = d.r.Peek(1); err != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+func (d *Decoder) readFull(b []byte) error {
+	_, err := io.ReadFull(d.r, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *Decoder) readHead() (head, error) {
+	initial, err := d.r.ReadByte()
+	if err == io.EOF {
+		return head{}, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return head{}, err
+	}
+	h := head{
+		major: initial >> 5,
+		info:  initial & 0x1f,
+	}
+	b := make([]byte, 8)
+	switch {
+	case h.info < 24:
+		h.n = uint64(h.info)
+	case h.info == 24:
+		err = d.readFull(b[:1])
+		h.n = uint64(b[0])
+	case h.info == 25:
+		err = d.readFull(b[:2])
+		h.n = uint64(binary.BigEndian.Uint16(b))
+	case h.info == 26:
+		err = d.readFull(b[:4])
+		h.n = uint64(binary.BigEndian.Uint32(b))
+	case h.info == 27:
+		err = d.readFull(b)
+		h.n = binary.BigEndian.Uint64(b)
+	case h.info == 31:
+		return h, ErrIndefiniteLength
+	default:
+		return h, errMalformed
+	}
+	return h, err
+}
+
+// readString reads the n bytes of a byte or text string
+func (d *Decoder) readString(n uint64) ([]byte, error) {
+	if n > MaxLength {
+		return nil, fmt.Errorf("cbor string length %d exceeds the maximum", n)
+	}
+	buf := new(bytes.Buffer)
+	_, err := io.CopyN(buf, d.r, int64(n))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// halfToFloat returns the value of the given half precision float
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	frac := uint64(h & 0x3ff)
+	f := 0.0
+	switch exp {
+	case 0:
+		f = math.Ldexp(float64(frac), -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if frac != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(float64(frac|0x400), exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+func (h head) float() (float64, bool) {
+	if h.major != majorSimple {
+		return 0, false
+	}
+	switch h.info {
+	case simpleFloat16:
+		return halfToFloat(uint16(h.n)), true
+	case simpleFloat32:
+		return float64(math.Float32frombits(uint32(h.n))), true
+	case simpleFloat64:
+		return math.Float64frombits(h.n), true
+	}
+	return 0, false
+}
+
+func (h head) isNull() bool {
+	return h.major == majorSimple && (h.info == simpleNull || h.info == simpleUndef)
+}
+
+func typeError(h head, t reflect.Type) error {
+	return fmt.Errorf("cbor cannot decode major type %d into %s", h.major, t)
+}
+
+func (d *Decoder) decode(v reflect.Value, depth int) error {
+	if depth > MaxDepth {
+		return ErrTooDeep
+	}
+	h, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	if h.major == majorTag {
+		if h.n != selfDescribeTag {
+			return fmt.Errorf("cbor tag %d is not supported", h.n)
+		}
+		return d.decode(v, depth+1)
+	}
+	if h.isNull() {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	return d.decodeHead(v, h, depth)
+}
+
+// decodeHead decodes the item with the given head into v
+func (d *Decoder) decodeHead(v reflect.Value, h head, depth int) error {
+	if depth > MaxDepth {
+		return ErrTooDeep
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeHead(v.Elem(), h, depth+1)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError(h, v.Type())
+		}
+		generic, err := d.generic(h, depth)
+		if err != nil {
+			return err
+		}
+		if generic == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	case reflect.Bool:
+		if h.major != majorSimple || (h.info != simpleFalse && h.info != simpleTrue) {
+			return typeError(h, v.Type())
+		}
+		v.SetBool(h.info == simpleTrue)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if (h.major != majorUint && h.major != majorNegInt) || h.n > math.MaxInt64 {
+			return typeError(h, v.Type())
+		}
+		i := int64(h.n)
+		if h.major == majorNegInt {
+			i = -1 - i
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("cbor integer %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if h.major != majorUint {
+			return typeError(h, v.Type())
+		}
+		if v.OverflowUint(h.n) {
+			return fmt.Errorf("cbor integer %d overflows %s", h.n, v.Type())
+		}
+		v.SetUint(h.n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, ok := h.float()
+		if !ok {
+			return typeError(h, v.Type())
+		}
+		if v.OverflowFloat(f) {
+			return fmt.Errorf("cbor float %g overflows %s", f, v.Type())
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.String:
+		if h.major != majorText {
+			return typeError(h, v.Type())
+		}
+		b, err := d.readString(h.n)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(b) {
+			return errors.New("cbor text string is not valid UTF-8")
+		}
+		v.SetString(string(b))
+		return nil
+	case reflect.Slice:
+		return d.decodeSlice(v, h, depth)
+	case reflect.Array:
+		return d.decodeArray(v, h, depth)
+	case reflect.Map:
+		return d.decodeMap(v, h, depth)
+	case reflect.Struct:
+		return d.decodeStruct(v, h, depth)
+	}
+	return fmt.Errorf("cbor cannot decode into values of type %s", v.Type())
+}
+
+func (d *Decoder) decodeSlice(v reflect.Value, h head, depth int) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		if h.major != majorBytes {
+			return typeError(h, v.Type())
+		}
+		b, err := d.readString(h.n)
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			b = nil
+		}
+		v.SetBytes(b)
+		return nil
+	}
+	if h.major != majorArray {
+		return typeError(h, v.Type())
+	}
+	if h.n == 0 {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	capacity := h.n
+	if capacity > maxPrealloc {
+		capacity = maxPrealloc
+	}
+	s := reflect.MakeSlice(v.Type(), 0, int(capacity))
+	for i := uint64(0); i < h.n; i++ {
+		elem := reflect.New(v.Type().Elem()).Elem()
+		err := d.decode(elem, depth+1)
+		if err != nil {
+			return err
+		}
+		s = reflect.Append(s, elem)
+	}
+	v.Set(s)
+	return nil
+}
+
+func (d *Decoder) decodeArray(v reflect.Value, h head, depth int) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		if h.major != majorBytes {
+			return typeError(h, v.Type())
+		}
+		if h.n != uint64(v.Len()) {
+			return fmt.Errorf("cbor byte string of length %d doesn't fit %s", h.n, v.Type())
+		}
+		b, err := d.readString(h.n)
+		if err != nil {
+			return err
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+		return nil
+	}
+	if h.major != majorArray {
+		return typeError(h, v.Type())
+	}
+	if h.n != uint64(v.Len()) {
+		return fmt.Errorf("cbor array of length %d doesn't fit %s", h.n, v.Type())
+	}
+	for i := 0; i < v.Len(); i++ {
+		err := d.decode(v.Index(i), depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeMap(v reflect.Value, h head, depth int) error {
+	if h.major != majorMap {
+		return typeError(h, v.Type())
+	}
+	m := reflect.MakeMap(v.Type())
+	for i := uint64(0); i < h.n; i++ {
+		key := reflect.New(v.Type().Key()).Elem()
+		err := d.decode(key, depth+1)
+		if err != nil {
+			return err
+		}
+		if !key.Type().Comparable() || (key.Kind() == reflect.Interface && key.Elem().IsValid() && !key.Elem().Type().Comparable()) {
+			return errors.New("cbor map key is not comparable")
+		}
+		if m.MapIndex(key).IsValid() {
+			return errors.New("cbor map has a duplicate key")
+		}
+		value := reflect.New(v.Type().Elem()).Elem()
+		err = d.decode(value, depth+1)
+		if err != nil {
+			return err
+		}
+		m.SetMapIndex(key, value)
+	}
+	v.Set(m)
+	return nil
+}
+
+func (d *Decoder) decodeStruct(v reflect.Value, h head, depth int) error {
+	if h.major != majorMap {
+		return typeError(h, v.Type())
+	}
+	fields := structFields(v.Type())
+	seen := make(map[string]bool)
+	for i := uint64(0); i < h.n; i++ {
+		name := ""
+		err := d.decode(reflect.ValueOf(&name).Elem(), depth+1)
+		if err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("cbor map has a duplicate key %s", name)
+		}
+		seen[name] = true
+		target := reflect.Value{}
+		for _, f := range fields {
+			if f.name == name {
+				target = v.Field(f.index)
+				break
+			}
+		}
+		if !target.IsValid() {
+			// skip unknown keys
+			var discard interface{}
+			target = reflect.ValueOf(&discard).Elem()
+		}
+		err = d.decode(target, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generic returns the item with the given head as an uint64, int64,
+// float64, bool, string, []byte, []interface{}, map[string]interface{}
+// if all it's keys are text strings, map[interface{}]interface{}
+// or nil
+func (d *Decoder) generic(h head, depth int) (interface{}, error) {
+	switch h.major {
+	case majorUint:
+		return h.n, nil
+	case majorNegInt:
+		if h.n > math.MaxInt64 {
+			return nil, errors.New("cbor negative integer overflows int64")
+		}
+		return -1 - int64(h.n), nil
+	case majorBytes:
+		var b []byte
+		err := d.decodeSlice(reflect.ValueOf(&b).Elem(), h, depth)
+		return b, err
+	case majorText:
+		s := ""
+		err := d.decodeHead(reflect.ValueOf(&s).Elem(), h, depth)
+		return s, err
+	case majorArray:
+		var a []interface{}
+		err := d.decodeSlice(reflect.ValueOf(&a).Elem(), h, depth)
+		return a, err
+	case majorMap:
+		m := make(map[interface{}]interface{})
+		err := d.decodeMap(reflect.ValueOf(&m).Elem(), h, depth)
+		if err != nil {
+			return nil, err
+		}
+		textKeys := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			s, ok := key.(string)
+			if !ok {
+				return m, nil
+			}
+			textKeys[s] = value
+		}
+		return textKeys, nil
+	}
+	if f, ok := h.float(); ok {
+		return f, nil
+	}
+	switch h.info {
+	case simpleFalse, simpleTrue:
+		return h.info == simpleTrue, nil
+	case simpleNull, simpleUndef:
+		return nil, nil
+	}
+	return nil, errMalformed
+}
@@ -0,0 +1,390 @@
+// encode.go - deterministic streaming CBOR encoder
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package canonical_cbor implements the canonical CBOR encoding of
+// RFC 7049 section 3.9: integers and lengths use their shortest
+// form, lengths are always definite and map keys are sorted by
+// length and then bytewise, so equal values always have equal
+// encodings and may be hashed and signed.
+//
+// Structs are encoded as maps with text keys, the key of a field is
+// given by it's cbor struct tag:
+//
+//	Epoch     uint64            `cbor:"epoch"`
+//	Kaetzchen map[string]string `cbor:"kaetzchen,omitempty"`
+//	Cache     []byte            `cbor:"-"`
+//
+// and defaults to the field name. Byte slices and arrays are encoded
+// as byte strings. Nil slices and maps are encoded like empty ones,
+// decoding empty arrays and byte strings yields nil slices.
+// Floating point numbers are encoded in the shortest of single and
+// double precision which preserves their value.
+//
+// The Encoder and Decoder stream the items to and from their
+// io.Writer and io.Reader.
+package canonical_cbor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The CBOR major types
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+// The simple values and floating point additional information
+const (
+	simpleFalse   = 20
+	simpleTrue    = 21
+	simpleNull    = 22
+	simpleUndef   = 23
+	simpleFloat16 = 25
+	simpleFloat32 = 26
+	simpleFloat64 = 27
+)
+
+const (
+	// MaxDepth is the maximum nesting depth of
+	// the encoded and decoded items
+	MaxDepth = 32
+
+	// selfDescribeTag is the tag marking CBOR data, see
+	// RFC 7049 section 2.4.5
+	selfDescribeTag = 55799
+)
+
+// SelfDescribe is the encoded self-describe tag, it may prefix an item
+// to mark it as CBOR. The Decoder skips it.
+var SelfDescribe = []byte{0xd9, 0xd9, 0xf7}
+
+// ErrTooDeep is the error returned when items
+// are nested deeper than MaxDepth
+var ErrTooDeep = errors.New("cbor items nested too deep")
+
+// field is a struct field encoded as a map entry
+type field struct {
+	index     int
+	name      string
+	key       []byte
+	omitEmpty bool
+}
+
+// fieldsCache maps struct types to their fields
+// sorted in canonical key order
+var fieldsCache sync.Map
+
+// structFields returns the encoded fields of the given struct
+// type sorted in canonical key order
+func structFields(t reflect.Type) []field {
+	if fields, ok := fieldsCache.Load(t); ok {
+		return fields.([]field)
+	}
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		omitEmpty := false
+		if tag, ok := f.Tag.Lookup("cbor"); ok {
+			if tag == "-" {
+				continue
+			}
+			options := strings.Split(tag, ",")
+			if options[0] != "" {
+				name = options[0]
+			}
+			for _, option := range options[1:] {
+				if option == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+		key := appendHead(nil, majorText, uint64(len(name)))
+		key = append(key, name...)
+		fields = append(fields, field{
+			index:     i,
+			name:      name,
+			key:       key,
+			omitEmpty: omitEmpty,
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return keyLess(fields[i].key, fields[j].key)
+	})
+	fieldsCache.Store(t, fields)
+	return fields
+}
+
+// keyLess returns true if the encoded map key a
+// sorts before b in the canonical order
+func keyLess(a, b []byte) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// appendHead appends the shortest encoding of the
+// given major type and argument
+func appendHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major<<5|27), n)
+}
+
+// isEmpty returns true if the given value is omitted by omitempty
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Encoder writes canonically encoded CBOR items to an io.Writer
+type Encoder struct {
+	w       *bufio.Writer
+	scratch []byte
+}
+
+// NewEncoder returns a new Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:       bufio.NewWriter(w),
+		scratch: make([]byte, 0, 9),
+	}
+}
+
+// Encode writes the encoding of v
+func (e *Encoder) Encode(v interface{}) error {
+	err := e.encode(reflect.ValueOf(v), 0)
+	if err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// Marshal returns the canonical encoding of v
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := NewEncoder(buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *Encoder) writeHead(major byte, n uint64) error {
+	_, err := e.w.Write(appendHead(e.scratch[:0], major, n))
+	return err
+}
+
+func (e *Encoder) encodeFloat(f float64) error {
+	b := e.scratch[:0]
+	switch {
+	case math.IsNaN(f):
+		b = binary.BigEndian.AppendUint32(append(b, majorSimple<<5|simpleFloat32), 0x7fc00000)
+	case float64(float32(f)) == f:
+		b = binary.BigEndian.AppendUint32(append(b, majorSimple<<5|simpleFloat32), math.Float32bits(float32(f)))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, majorSimple<<5|simpleFloat64), math.Float64bits(f))
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) encodeBytes(v reflect.Value) error {
+	err := e.writeHead(majorBytes, uint64(v.Len()))
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Slice {
+		_, err = e.w.Write(v.Bytes())
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		err = e.w.WriteByte(byte(v.Index(i).Uint()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMap writes the entries of the given map sorted by
+// their encoded keys
+func (e *Encoder) encodeMap(v reflect.Value, depth int) error {
+	type entry struct {
+		key   []byte
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := Marshal(iter.Key().Interface())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return keyLess(entries[i].key, entries[j].key)
+	})
+	err := e.writeHead(majorMap, uint64(len(entries)))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		_, err = e.w.Write(entry.key)
+		if err != nil {
+			return err
+		}
+		err = e.encode(entry.value, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) encodeStruct(v reflect.Value, depth int) error {
+	fields := structFields(v.Type())
+	n := 0
+	for _, f := range fields {
+		if !f.omitEmpty || !isEmpty(v.Field(f.index)) {
+			n++
+		}
+	}
+	err := e.writeHead(majorMap, uint64(n))
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.omitEmpty && isEmpty(v.Field(f.index)) {
+			continue
+		}
+		_, err = e.w.Write(f.key)
+		if err != nil {
+			return err
+		}
+		err = e.encode(v.Field(f.index), depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) encode(v reflect.Value, depth int) error {
+	if depth > MaxDepth {
+		return ErrTooDeep
+	}
+	if !v.IsValid() {
+		return e.w.WriteByte(majorSimple<<5 | simpleNull)
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return e.w.WriteByte(majorSimple<<5 | simpleNull)
+		}
+		return e.encode(v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.IsNil() {
+			return e.w.WriteByte(majorSimple<<5 | simpleNull)
+		}
+		return e.encode(v.Elem(), depth)
+	case reflect.Bool:
+		if v.Bool() {
+			return e.w.WriteByte(majorSimple<<5 | simpleTrue)
+		}
+		return e.w.WriteByte(majorSimple<<5 | simpleFalse)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := v.Int()
+		if i < 0 {
+			return e.writeHead(majorNegInt, uint64(-1-i))
+		}
+		return e.writeHead(majorUint, uint64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return e.writeHead(majorUint, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return e.encodeFloat(v.Float())
+	case reflect.String:
+		err := e.writeHead(majorText, uint64(v.Len()))
+		if err != nil {
+			return err
+		}
+		_, err = e.w.WriteString(v.String())
+		return err
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(v)
+		}
+		err := e.writeHead(majorArray, uint64(v.Len()))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			err = e.encode(v.Index(i), depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		return e.encodeMap(v, depth)
+	case reflect.Struct:
+		return e.encodeStruct(v, depth)
+	}
+	return fmt.Errorf("cbor cannot encode values of type %s", v.Type())
+}
@@ -0,0 +1,270 @@
+// config_wizard.go - configuration file generation
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package config_wizard generates a complete, commented configuration
+// file and the account keys for first-time users, from the answers
+// given interactively or on the command line, see mixclient-init.
+package config_wizard
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/pelletier/go-toml"
+)
+
+// portAttempts is the number of consecutive ports
+// FreeAddress tries before letting the system choose
+const portAttempts = 100
+
+// Answers are the answers to the questions of the wizard
+type Answers struct {
+	// Email is the e-mail address of the account, name@provider
+	Email string
+	// ProviderAddress is the optional host:port at which the
+	// Provider is reached besides it's published endpoints
+	ProviderAddress string
+	// ProviderKeyFile is the optional PEM file of the
+	// Provider's public key which is pinned
+	ProviderKeyFile string
+	// KeysDir is the directory the account keys are written to
+	KeysDir string
+	// SMTPAddress is the listen address of the SMTP proxy
+	SMTPAddress string
+	// POP3Address is the listen address of the POP3 proxy
+	POP3Address string
+	// DuressPassphrase is the optional duress passphrase which
+	// opens decoy keys, it's not written to the configuration
+	// file, see config.Config.GenerateKeysWithDuress
+	DuressPassphrase string
+}
+
+// Validate returns an error if the answers are incomplete
+func (a *Answers) Validate() error {
+	name, provider, err := config.SplitEmail(a.Email)
+	if err != nil || name == "" || provider == "" {
+		return fmt.Errorf("invalid e-mail address %q", a.Email)
+	}
+	if a.ProviderAddress != "" {
+		if _, _, err := net.SplitHostPort(a.ProviderAddress); err != nil {
+			return fmt.Errorf("invalid Provider address %q: %s", a.ProviderAddress, err)
+		}
+	}
+	if a.KeysDir == "" {
+		return errors.New("no keys directory")
+	}
+	for _, address := range []string{a.SMTPAddress, a.POP3Address} {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid listen address %q: %s", address, err)
+		}
+	}
+	return nil
+}
+
+// FreeAddress returns the first address of the given default
+// address, or of the following ports, which can be listened on.
+// If none is free the address of a port chosen by the system is
+// returned.
+func FreeAddress(defaultAddress string) (string, error) {
+	host, portString, err := net.SplitHostPort(defaultAddress)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < portAttempts; i++ {
+		address := net.JoinHostPort(host, strconv.Itoa(port+i))
+		l, err := net.Listen("tcp", address)
+		if err == nil {
+			l.Close()
+			return address, nil
+		}
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// Defaults returns the answers defaulting the keys directory to the
+// given one and the proxies to free ports near their default ports
+func Defaults(keysDir string) (*Answers, error) {
+	smtp, err := FreeAddress(constants.DefaultSMTPAddress)
+	if err != nil {
+		return nil, err
+	}
+	pop3, err := FreeAddress(constants.DefaultPOP3Address)
+	if err != nil {
+		return nil, err
+	}
+	a := Answers{
+		KeysDir:     keysDir,
+		SMTPAddress: smtp,
+		POP3Address: pop3,
+	}
+	return &a, nil
+}
+
+// Prompt asks the questions on w whose answers are read from r,
+// the given answers are offered as the defaults
+func Prompt(r io.Reader, w io.Writer, a *Answers) error {
+	in := bufio.NewReader(r)
+	questions := []struct {
+		question string
+		answer   *string
+	}{
+		{"E-mail address of the account (name@provider)", &a.Email},
+		{"Provider address (host:port, empty for the published endpoints)", &a.ProviderAddress},
+		{"Provider public key file to pin (empty for none)", &a.ProviderKeyFile},
+		{"Directory of the account keys", &a.KeysDir},
+		{"SMTP proxy listen address", &a.SMTPAddress},
+		{"POP3 proxy listen address", &a.POP3Address},
+	}
+	for _, q := range questions {
+		if *q.answer == "" {
+			fmt.Fprintf(w, "%s: ", q.question)
+		} else {
+			fmt.Fprintf(w, "%s [%s]: ", q.question, *q.answer)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return err
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			*q.answer = line
+		}
+	}
+	return a.Validate()
+}
+
+// configTemplate is the template of the generated configuration file
+var configTemplate = template.Must(template.New("config").Parse(`# mixnet client configuration generated by mixclient-init
+#
+# The keys of the accounts are stored in {{.KeysDir}}, sealed with
+# the passphrase given to mixclient-init.
+
+# Each Account section is an e-mail address of the client, the
+# proxies accept the messages of and serve the mailboxes of
+# these addresses.
+[[Account]]
+  Name = {{printf "%q" .Name}}
+  Provider = {{printf "%q" .Provider}}
+{{- if .ProviderAddress}}
+  # FallbackAddresses are tried after the published endpoints
+  # of the Provider, they must present the Provider's key
+  FallbackAddresses = [{{printf "%q" .ProviderAddress}}]
+{{- end}}
+{{- if .ProviderKeyFile}}
+
+# ProviderPinning pins the public key of the Provider, the
+# connections to a Provider presenting another key fail
+[[ProviderPinning]]
+  Name = {{printf "%q" .Provider}}
+  PublicKeyFile = {{printf "%q" .ProviderKeyFile}}
+{{- end}}
+
+# SMTPProxy is where the mail client submits the outgoing messages
+[SMTPProxy]
+  Network = "tcp"
+  Address = {{printf "%q" .SMTPAddress}}
+
+# POP3Proxy is where the mail client retrieves the received messages
+[POP3Proxy]
+  Network = "tcp"
+  Address = {{printf "%q" .POP3Address}}
+`))
+
+// Render returns the commented configuration file of the answers,
+// it's checked to be a valid configuration
+func Render(a *Answers) ([]byte, error) {
+	err := a.Validate()
+	if err != nil {
+		return nil, err
+	}
+	name, provider, _ := config.SplitEmail(a.Email)
+	data := struct {
+		*Answers
+		Name     string
+		Provider string
+	}{a, name, provider}
+	buf := new(bytes.Buffer)
+	err = configTemplate.Execute(buf, data)
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.Config{}
+	err = toml.Unmarshal(buf.Bytes(), &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("generated an invalid configuration: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Write writes the configuration file of the answers to the given
+// path, which must not exist yet, and generates the account keys
+// sealed with the given passphrase and the duress passphrase, if any
+func Write(path string, a *Answers, passphrase string) (*config.Config, error) {
+	raw, err := Render(a)
+	if err != nil {
+		return nil, err
+	}
+	// the file is created exclusively so that an existing
+	// configuration is never overwritten
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(raw)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.MkdirAll(a.KeysDir, 0700)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	cfg, err := config.FromFile(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	err = cfg.GenerateKeysWithDuress(entropy.Reader, a.KeysDir, passphrase, a.DuressPassphrase)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,123 @@
+// config_wizard_test.go - configuration file generation tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config_wizard
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeAddress(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	// the taken port is skipped
+	address, err := FreeAddress(l.Addr().String())
+	require.NoError(err)
+	require.NotEqual(l.Addr().String(), address)
+}
+
+func TestWizard(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "config_wizard")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	a, err := Defaults(filepath.Join(dir, "keys"))
+	require.NoError(err)
+	input := "alice@acme.com\nprovider.acme.com:29483\n\n\n\n127.0.0.1:40025\n"
+	out := new(strings.Builder)
+	err = Prompt(strings.NewReader(input), out, a)
+	require.NoError(err)
+	require.Equal("alice@acme.com", a.Email)
+	require.Equal("provider.acme.com:29483", a.ProviderAddress)
+	require.Equal(filepath.Join(dir, "keys"), a.KeysDir)
+	require.Equal("127.0.0.1:40025", a.POP3Address)
+	require.True(strings.Contains(out.String(), "SMTP proxy listen address ["+a.SMTPAddress+"]"))
+
+	path := filepath.Join(dir, "client.toml")
+	cfg, err := Write(path, a, "passphrase")
+	require.NoError(err)
+	require.Equal([]string{"alice@acme.com"}, cfg.AccountIdentities())
+	require.Equal([]string{"provider.acme.com:29483"}, cfg.Account[0].FallbackAddresses)
+	require.Equal("127.0.0.1:40025", cfg.POP3Proxy.Address)
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.True(strings.Contains(string(raw), "# SMTPProxy is where"))
+	_, err = cfg.GetAccountKey(constants.EndToEndKeyType, cfg.Account[0], a.KeysDir, "passphrase")
+	require.NoError(err)
+
+	// an existing configuration isn't overwritten
+	_, err = Write(path, a, "passphrase")
+	require.Error(err)
+	kept, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(raw, kept)
+
+	a.Email = "alice"
+	_, err = Render(a)
+	require.Error(err)
+}
+
+func TestWizardDuress(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "config_wizard")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	a, err := Defaults(filepath.Join(dir, "keys"))
+	require.NoError(err)
+	a.Email = "alice@acme.com"
+	a.DuressPassphrase = "b a b a select start"
+	passphrase := "up up down down left right"
+	cfg, err := Write(filepath.Join(dir, "client.toml"), a, passphrase)
+	require.NoError(err)
+
+	linkKeys, duress, err := cfg.OpenAccountsMap(constants.LinkLayerKeyType, a.KeysDir, passphrase)
+	require.NoError(err)
+	require.False(duress)
+	e2eKeys, _, err := cfg.OpenAccountsMap(constants.EndToEndKeyType, a.KeysDir, passphrase)
+	require.NoError(err)
+
+	// the decoy authenticates with the real link key but
+	// can't open the messages sent to the real account
+	cfg.Duress.DestroyKeys = true
+	decoyLinkKeys, duress, err := cfg.OpenAccountsMap(constants.LinkLayerKeyType, a.KeysDir, a.DuressPassphrase)
+	require.NoError(err)
+	require.True(duress)
+	require.Equal((*linkKeys)["alice@acme.com"].Bytes(), (*decoyLinkKeys)["alice@acme.com"].Bytes())
+	decoyE2EKeys, duress, err := cfg.OpenAccountsMap(constants.EndToEndKeyType, a.KeysDir, a.DuressPassphrase)
+	require.NoError(err)
+	require.True(duress)
+	require.NotEqual((*e2eKeys)["alice@acme.com"].Bytes(), (*decoyE2EKeys)["alice@acme.com"].Bytes())
+
+	// the real keys are destroyed
+	_, _, err = cfg.OpenAccountsMap(constants.EndToEndKeyType, a.KeysDir, passphrase)
+	require.Error(err)
+}
@@ -0,0 +1,263 @@
+// constants.go - Katzenpost client constants.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package constants contains the client constants for Katzenpost.
+package constants
+
+import (
+	"time"
+
+	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
+)
+
+const (
+	// RoundTripTimeSlop represents the time duration added to the Poisson mix strategy
+	// round trip delay for a forward message and it's ACKnowledgement. That is, the
+	// additional time we should wait around for the ACK to arrive before a retransmission.
+	// (XXX: fix me, we need to set this appropriately.
+	// Current value may be too conservative. )
+	RoundTripTimeSlop = 3 * time.Minute
+
+	// MaxSendAttempts is the number of times a Block is transmitted
+	// without being ACKed before the delivery of it's message is given up.
+	MaxSendAttempts = 8
+
+	// SURBKeyRetentionEpochs is the number of mixnet epochs after it's
+	// creation during which a SURB may be used. Mix keys are published
+	// at most three epochs in advance, after that the ACK can't arrive
+	// and the SURB's decryption keys are retired.
+	SURBKeyRetentionEpochs = 3
+
+	// SURBPoolSize is the default number of unissued SURBs an account
+	// keeps pre-generated per correspondent and mixnet epoch.
+	SURBPoolSize = 4
+
+	// SURBsPerMessage is the number of pooled SURBs attached to each
+	// outgoing message, so that it's recipient may reply to us even
+	// when it can't retrieve the PKI document.
+	SURBsPerMessage = 2
+
+	// MaxReceivedSURBs is the maximum number of SURBs received from a
+	// correspondent an account keeps, those of the earliest epochs
+	// are evicted so that a correspondent can't fill the store.
+	MaxReceivedSURBs = 16
+
+	// EpochBoundarySlack is the minimum duration between the expected
+	// arrival of a packet at a hop and a mixnet epoch boundary. Routes
+	// with hops arriving closer to a boundary are rejected because the
+	// hop may already have rotated the key the packet was composed with.
+	EpochBoundarySlack = 2 * time.Minute
+
+	// ErrorLogInterval is the minimum duration between two log lines
+	// reporting the same class of error, repeated occurrences within
+	// this interval are aggregated into a single line.
+	ErrorLogInterval = 5 * time.Minute
+
+	// DefaultOrderingHoldTime is the default maximum duration an out
+	// of order message is held back waiting for the preceding messages
+	// of it's conversation, when in order delivery is enabled.
+	DefaultOrderingHoldTime = 10 * time.Minute
+
+	// VacationReplyInterval is the minimum duration between two
+	// vacation auto-replies sent by an account to the same sender.
+	VacationReplyInterval = 7 * 24 * time.Hour
+
+	// DefaultMaxMessageSize is the default maximum size in bytes of
+	// a message accepted by our SMTP proxy. Each message is sent as
+	// one Sphinx packet per Block, so large messages are slow to send
+	// and stand out in the traffic of the mix network.
+	DefaultMaxMessageSize = 1 << 20
+
+	// DefaultMessagesPerMinute is the default maximum number of
+	// messages submitted per minute from a single source IP address.
+	DefaultMessagesPerMinute = 30
+
+	// DefaultAccountMessagesPerMinute is the default maximum number
+	// of messages submitted per minute by a single account.
+	DefaultAccountMessagesPerMinute = 20
+
+	// DefaultMaxConnections is the default maximum number of concurrent
+	// proxy connections from a single source IP address.
+	DefaultMaxConnections = 10
+
+	// DefaultSendSlotInterval is the default mean interval between
+	// two send slots when the Blocks are sent in send slots.
+	DefaultSendSlotInterval = 10 * time.Second
+
+	// DefaultFetchInterval is the default mean interval between
+	// two retrievals of the queued messages from the Provider.
+	DefaultFetchInterval = time.Minute
+
+	// DefaultMaxFetchBatch is the default maximum number of messages
+	// retrieved back to back while the Provider reports more queued
+	// messages before waiting for the next scheduled retrieval.
+	DefaultMaxFetchBatch = 32
+
+	// DefaultReassemblyWorkers is the default number of workers
+	// reassembling the received messages of an account in parallel
+	DefaultReassemblyWorkers = 4
+
+	// DefaultMaxSplitParts is the default maximum number of mixnet
+	// messages a message exceeding the Blocks allowed per message ID
+	// is split into, larger messages are rejected.
+	DefaultMaxSplitParts = 16
+
+	// DefaultQueueHighWatermark is the default number of Blocks queued
+	// for sending above which the SMTP proxy refuses submissions with
+	// a temporary failure, until the queue drains to the low watermark.
+	DefaultQueueHighWatermark = 4096
+
+	// DefaultQueueLowWatermark is the default number of queued Blocks
+	// below which the SMTP proxy accepts submissions again.
+	DefaultQueueLowWatermark = 3072
+
+	// DefaultPKIPrefetchLead is the default minimum duration before
+	// an epoch boundary at which the PKI document of the next epoch
+	// is fetched, it's widened when the authorities are slow.
+	DefaultPKIPrefetchLead = 10 * time.Minute
+
+	// PKIPrefetchLatencyFactor is the multiple of the observed
+	// authority latency the PKI prefetch lead time is at least,
+	// which leaves room for retries before the epoch boundary.
+	PKIPrefetchLatencyFactor = 4
+
+	// DefaultPKIPrefetchJitter is the default maximum random duration
+	// added to the PKI prefetch lead time, so that the clients don't
+	// query the authorities in lock-step ahead of each epoch boundary.
+	DefaultPKIPrefetchJitter = 5 * time.Minute
+
+	// PKIRefreshMinBackoff is the delay before a failed PKI document
+	// fetch is first retried, it doubles with each failure up to
+	// PKIRefreshMaxBackoff.
+	PKIRefreshMinBackoff = 5 * time.Second
+
+	// PKIRefreshMaxBackoff is the maximum delay
+	// before a failed PKI document fetch is retried.
+	PKIRefreshMaxBackoff = 5 * time.Minute
+
+	// PKIExpiryWarning is the duration before an epoch boundary
+	// from which a missing PKI document of the next epoch is
+	// logged as an error rather than a warning.
+	PKIExpiryWarning = 5 * time.Minute
+
+	// PKIStaleRecheckInterval is the interval at which the held back
+	// Blocks are checked for the PKI document of the current epoch.
+	PKIStaleRecheckInterval = 10 * time.Second
+
+	// DefaultMaxClockSkew is the default skew of the local clock
+	// against the PKI authorities above which it's reported, the
+	// mixes drop the packets built for the wrong epoch.
+	DefaultMaxClockSkew = time.Minute
+
+	// DefaultMinFreeDiskSpace is the default number of bytes free on
+	// a volume holding the data below which the submissions
+	// are refused, so that the writes of the client don't fail.
+	DefaultMinFreeDiskSpace = 64 << 20
+
+	// DiskSpaceCheckInterval is the interval between two
+	// checks of the free space of the data volumes.
+	DiskSpaceCheckInterval = 30 * time.Second
+
+	// LowPowerSlotFactor is the factor by which the mean interval
+	// between two send slots is lengthened in the low power mode.
+	LowPowerSlotFactor = 4
+
+	// LowPowerTimerGranularity is the granularity to which the timers
+	// are coalesced in the low power mode, so that the host and it's
+	// radio wake up at most once per interval for them.
+	LowPowerTimerGranularity = time.Minute
+
+	// ProviderReconnectMinBackoff is the delay before a lost Provider
+	// session is first reestablished again after a failed attempt, it
+	// doubles with each failure up to ProviderReconnectMaxBackoff.
+	ProviderReconnectMinBackoff = time.Second
+
+	// ProviderReconnectMaxBackoff is the maximum delay before
+	// a lost Provider session is reestablished again.
+	ProviderReconnectMaxBackoff = 5 * time.Minute
+
+	// SupervisorMinBackoff is the delay before a crashed worker
+	// goroutine is first restarted, it doubles with each failure
+	// up to SupervisorMaxBackoff.
+	SupervisorMinBackoff = time.Second
+
+	// SupervisorMaxBackoff is the maximum delay
+	// before a crashed worker goroutine is restarted.
+	SupervisorMaxBackoff = time.Minute
+
+	// SupervisorMaxFailures is the number of failures of a worker
+	// goroutine within SupervisorFailureWindow after which it's no
+	// longer restarted and the whole daemon is shut down instead.
+	SupervisorMaxFailures = 5
+
+	// SupervisorFailureWindow is the duration during which the
+	// failures of a worker goroutine are counted.
+	SupervisorFailureWindow = 10 * time.Minute
+
+	// DatabaseConnectTimeout is a duration used as the connect timeout
+	// when we access our local databases (for POP3&SMTP proxies).
+	DatabaseConnectTimeout = 3 * time.Second
+
+	// PoissonLambda is the poisson distribution's lambda parameter
+	// used for setting mix hop delays.
+	// (XXX Ania Piotrowska and Claudia Diaz fix me: the team of mathematicians
+	// should decide on the value that this Poisson Lambda parameter should be set to)
+	PoissonLambda = float64(.234)
+
+	// HopsPerPath is the number of mix hops per path through the mix network
+	HopsPerPath = 3
+
+	// MessageIDLength is the length of a message ID in bytes.
+	MessageIDLength = 16
+
+	// BlockIDLength is the length of our storage block IDs
+	// which uniquely identify the Blocks of the egress queue.
+	BlockIDLength = 8
+
+	// RecipientIDLength is the length of a Sphinx recipient ID in bytes.
+	RecipientIDLength = sphinxconstants.RecipientIDLength
+
+	// SURBIDLength is the length of a SURB ID in bytes.
+	SURBIDLength = sphinxconstants.SURBIDLength
+
+	// PrivateKey is used in our key file naming convention to indicate
+	// that the given key is private.
+	KeyStatusPrivate = "private"
+
+	// PublicKey is used in our key file naming convention to indicate
+	// that the given key is public.
+	KeyStatusPublic = "public"
+
+	// EndToEndKeyType is the string representing the end to end
+	// messaging key type
+	EndToEndKeyType = "e2e"
+
+	// LinkLayerKeyType is the string representing the link layer
+	// wire protocol key type
+	LinkLayerKeyType = "wire"
+
+	// DefaultSMTPNetwork is the default network type used for our SMTP proxy service
+	DefaultSMTPNetwork = "tcp"
+
+	// DefaultSMTPAddress is the default address used for our SMTP proxy service
+	DefaultSMTPAddress = "127.0.0.1:2525"
+
+	// DefaultPOP3Network is the default network type used for our POP3 proxy service
+	DefaultPOP3Network = "tcp"
+
+	// DefaultPOP3Address is the default address type used for our POP3 proxy service
+	DefaultPOP3Address = "127.0.0.1:1110"
+)
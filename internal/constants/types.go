@@ -0,0 +1,88 @@
+// types.go - sized identifier types and checked conversions
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package constants
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MessageID is a message ID, it's an alias so that
+// the existing array typed identifiers remain assignable
+type MessageID = [MessageIDLength]byte
+
+// BlockID is a storage block ID
+type BlockID = [BlockIDLength]byte
+
+// RecipientID is a Sphinx recipient ID
+type RecipientID = [RecipientIDLength]byte
+
+// SURBID is a SURB ID
+type SURBID = [SURBIDLength]byte
+
+// ErrOverflow is the error returned when a value
+// doesn't fit into the destination integer type
+var ErrOverflow = errors.New("integer conversion overflow")
+
+// checkRange returns ErrOverflow if n isn't within [0, max]
+func checkRange(n int, max uint64) error {
+	if n < 0 || uint64(n) > max {
+		return fmt.Errorf("%w: %d not in [0, %d]", ErrOverflow, n, max)
+	}
+	return nil
+}
+
+// Uint8 converts n to an uint8 or returns an error
+// instead of truncating it
+func Uint8(n int) (uint8, error) {
+	err := checkRange(n, math.MaxUint8)
+	if err != nil {
+		return 0, err
+	}
+	return uint8(n), nil
+}
+
+// Uint16 converts n to an uint16 or returns an error
+// instead of truncating it
+func Uint16(n int) (uint16, error) {
+	err := checkRange(n, math.MaxUint16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(n), nil
+}
+
+// Uint32 converts n to an uint32 or returns an error
+// instead of truncating it
+func Uint32(n int) (uint32, error) {
+	err := checkRange(n, math.MaxUint32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(n), nil
+}
+
+// CopyID copies the decoded identifier src into dst,
+// which must be of exactly the same length
+func CopyID(dst, src []byte) error {
+	if len(src) != len(dst) {
+		return fmt.Errorf("invalid identifier length %d, expected %d", len(src), len(dst))
+	}
+	copy(dst, src)
+	return nil
+}
@@ -0,0 +1,49 @@
+// types_test.go - checked conversion tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package constants
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckedConversions(t *testing.T) {
+	require := require.New(t)
+
+	v8, err := Uint8(255)
+	require.NoError(err, "Uint8 failed")
+	require.Equal(uint8(255), v8)
+	_, err = Uint8(256)
+	require.True(errors.Is(err, ErrOverflow))
+	_, err = Uint8(-1)
+	require.True(errors.Is(err, ErrOverflow))
+
+	v16, err := Uint16(65535)
+	require.NoError(err, "Uint16 failed")
+	require.Equal(uint16(65535), v16)
+	_, err = Uint16(65536)
+	require.True(errors.Is(err, ErrOverflow))
+
+	_, err = Uint32(-5)
+	require.True(errors.Is(err, ErrOverflow))
+
+	id := MessageID{}
+	require.NoError(CopyID(id[:], make([]byte, MessageIDLength)))
+	require.Error(CopyID(id[:], make([]byte, MessageIDLength-1)))
+}
@@ -0,0 +1,104 @@
+// envelope.go - end to end encrypted message envelopes
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package envelope provides end to end encryption of entire messages
+// to the recipient's published key, independently of the per Block
+// encryption. Each envelope is sealed with a fresh ephemeral X25519
+// key which is discarded afterwards, so that a compromise of the
+// sender's keys doesn't reveal previously sent messages.
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// magic identifies sealed envelopes, which are told apart
+	// from plaintext messages by the framing of the messages,
+	// it only identifies the suite of the envelope.
+	magic = "KPE1"
+
+	keyLen    = 32
+	nonceLen  = 24
+	lengthLen = 4
+
+	// Overhead is the number of bytes an envelope adds to a message.
+	Overhead = len(magic) + keyLen + nonceLen + lengthLen + box.Overhead
+)
+
+// IsSealed returns true if the given message is a sealed envelope
+func IsSealed(message []byte) bool {
+	return len(message) >= Overhead && string(message[:len(magic)]) == magic
+}
+
+// Seal encrypts the message to the recipient's public key
+func Seal(randReader io.Reader, recipientKey *ecdh.PublicKey, message []byte) ([]byte, error) {
+	ephemeralKey, err := ecdh.NewKeypair(randReader)
+	if err != nil {
+		return nil, err
+	}
+	defer ephemeralKey.Reset()
+	nonce := [nonceLen]byte{}
+	_, err = io.ReadFull(randReader, nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	privateKey := [keyLen]byte{}
+	copy(privateKey[:], ephemeralKey.Bytes())
+	publicKey := [keyLen]byte{}
+	copy(publicKey[:], recipientKey.Bytes())
+
+	out := make([]byte, 0, len(message)+Overhead)
+	out = append(out, magic...)
+	out = append(out, ephemeralKey.PublicKey().Bytes()...)
+	out = append(out, nonce[:]...)
+	length := [lengthLen]byte{}
+	binary.BigEndian.PutUint32(length[:], uint32(len(message)+box.Overhead))
+	out = append(out, length[:]...)
+	return box.Seal(out, message, &nonce, &publicKey, &privateKey), nil
+}
+
+// Open decrypts and authenticates the envelope using the
+// recipient's private key, trailing padding is ignored
+func Open(identityKey *ecdh.PrivateKey, envelope []byte) ([]byte, error) {
+	if !IsSealed(envelope) {
+		return nil, errors.New("envelope: not a sealed envelope")
+	}
+	off := len(magic)
+	ephemeralKey := [keyLen]byte{}
+	copy(ephemeralKey[:], envelope[off:off+keyLen])
+	off += keyLen
+	nonce := [nonceLen]byte{}
+	copy(nonce[:], envelope[off:off+nonceLen])
+	off += nonceLen
+	length := int(binary.BigEndian.Uint32(envelope[off : off+lengthLen]))
+	off += lengthLen
+	if length < box.Overhead || length > len(envelope)-off {
+		return nil, errors.New("envelope: invalid length")
+	}
+	privateKey := [keyLen]byte{}
+	copy(privateKey[:], identityKey.Bytes())
+	message, ok := box.Open(nil, envelope[off:off+length], &nonce, &ephemeralKey, &privateKey)
+	if !ok {
+		return nil, errors.New("envelope: authentication failed")
+	}
+	return message, nil
+}
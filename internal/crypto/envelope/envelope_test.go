@@ -0,0 +1,60 @@
+// envelope_test.go - end to end encrypted message envelope tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	require := require.New(t)
+
+	recipientKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	message := []byte("Curiouser and curiouser!")
+
+	require.False(IsSealed(message), "plaintext reported as sealed")
+	sealed, err := Seal(rand.Reader, recipientKey.PublicKey(), message)
+	require.NoError(err, "Seal failed")
+	require.True(IsSealed(sealed), "envelope not reported as sealed")
+	require.Equal(len(message)+Overhead, len(sealed), "wrong envelope size")
+
+	sealed2, err := Seal(rand.Reader, recipientKey.PublicKey(), message)
+	require.NoError(err, "Seal failed")
+	require.NotEqual(sealed, sealed2, "envelopes must use fresh ephemeral keys")
+
+	opened, err := Open(recipientKey, sealed)
+	require.NoError(err, "Open failed")
+	require.Equal(message, opened)
+
+	opened, err = Open(recipientKey, append(sealed, make([]byte, 100)...))
+	require.NoError(err, "Open of a padded envelope failed")
+	require.Equal(message, opened)
+
+	otherKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	_, err = Open(otherKey, sealed)
+	require.Error(err, "Open with the wrong key should've failed")
+
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = Open(recipientKey, sealed)
+	require.Error(err, "Open of a tampered envelope should've failed")
+}
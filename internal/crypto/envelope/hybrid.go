@@ -0,0 +1,154 @@
+// hybrid.go - experimental post-quantum hybrid envelopes
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// SuiteClassical is the name of the X25519 envelope suite, see Seal
+	SuiteClassical = "x25519"
+
+	// SuiteHybrid is the name of the experimental X25519 and
+	// ML-KEM-768 hybrid envelope suite, see SealHybrid
+	SuiteHybrid = "x25519-mlkem768"
+
+	// hybridMagic identifies sealed hybrid envelopes
+	hybridMagic = "KPH1"
+
+	// kemRandomLen is the length of the randomness
+	// of a derandomized ML-KEM encapsulation
+	kemRandomLen = 32
+
+	// HybridOverhead is the number of bytes a hybrid
+	// envelope adds to a message.
+	HybridOverhead = len(hybridMagic) + keyLen + mlkem.CiphertextSize768 + nonceLen + lengthLen + secretbox.Overhead
+)
+
+// IsHybridSealed returns true if the given message is a sealed hybrid envelope
+func IsHybridSealed(message []byte) bool {
+	return len(message) >= HybridOverhead && string(message[:len(hybridMagic)]) == hybridMagic
+}
+
+// hybridKey derives the symmetric key of a hybrid envelope from both
+// shared secrets, binding it to the ephemeral key, the ML-KEM ciphertext
+// and the recipient's key. The envelope remains confidential as long as
+// either X25519 or ML-KEM-768 is unbroken.
+func hybridKey(x25519Secret, kemSecret, ephemeralKey, kemCiphertext, recipientKey []byte) (*[keyLen]byte, error) {
+	secret := append(append([]byte{}, x25519Secret...), kemSecret...)
+	info := []byte(hybridMagic)
+	info = append(info, ephemeralKey...)
+	info = append(info, kemCiphertext...)
+	info = append(info, recipientKey...)
+	key := [keyLen]byte{}
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// SealHybrid encrypts the message to both the recipient's X25519
+// public key and ML-KEM-768 encapsulation key. The ephemeral key, the
+// nonce and the ML-KEM encapsulation are all derived from randReader.
+func SealHybrid(randReader io.Reader, recipientKey *ecdh.PublicKey, kemKey *mlkem.EncapsulationKey768, message []byte) ([]byte, error) {
+	ephemeralKey, err := ecdh.NewKeypair(randReader)
+	if err != nil {
+		return nil, err
+	}
+	defer ephemeralKey.Reset()
+	nonce := [nonceLen]byte{}
+	_, err = io.ReadFull(randReader, nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	x25519Secret := [keyLen]byte{}
+	ephemeralKey.Exp(&x25519Secret, recipientKey)
+	kemRandom := [kemRandomLen]byte{}
+	_, err = io.ReadFull(randReader, kemRandom[:])
+	if err != nil {
+		return nil, err
+	}
+	kemSecret, kemCiphertext, err := mlkemtest.Encapsulate768(kemKey, kemRandom[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := hybridKey(x25519Secret[:], kemSecret, ephemeralKey.PublicKey().Bytes(), kemCiphertext, recipientKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(message)+HybridOverhead)
+	out = append(out, hybridMagic...)
+	out = append(out, ephemeralKey.PublicKey().Bytes()...)
+	out = append(out, kemCiphertext...)
+	out = append(out, nonce[:]...)
+	length := [lengthLen]byte{}
+	binary.BigEndian.PutUint32(length[:], uint32(len(message)+secretbox.Overhead))
+	out = append(out, length[:]...)
+	return secretbox.Seal(out, message, &nonce, key), nil
+}
+
+// OpenHybrid decrypts and authenticates the hybrid envelope using
+// the recipient's private keys, trailing padding is ignored
+func OpenHybrid(identityKey *ecdh.PrivateKey, kemKey *mlkem.DecapsulationKey768, envelope []byte) ([]byte, error) {
+	if !IsHybridSealed(envelope) {
+		return nil, errors.New("envelope: not a sealed hybrid envelope")
+	}
+	off := len(hybridMagic)
+	ephemeralKey := ecdh.PublicKey{}
+	err := ephemeralKey.FromBytes(envelope[off : off+keyLen])
+	if err != nil {
+		return nil, err
+	}
+	off += keyLen
+	kemCiphertext := envelope[off : off+mlkem.CiphertextSize768]
+	off += mlkem.CiphertextSize768
+	nonce := [nonceLen]byte{}
+	copy(nonce[:], envelope[off:off+nonceLen])
+	off += nonceLen
+	length := int(binary.BigEndian.Uint32(envelope[off : off+lengthLen]))
+	off += lengthLen
+	if length < secretbox.Overhead || length > len(envelope)-off {
+		return nil, errors.New("envelope: invalid length")
+	}
+	kemSecret, err := kemKey.Decapsulate(kemCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	x25519Secret := [keyLen]byte{}
+	identityKey.Exp(&x25519Secret, &ephemeralKey)
+	key, err := hybridKey(x25519Secret[:], kemSecret, ephemeralKey.Bytes(), kemCiphertext, identityKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	message, ok := secretbox.Open(nil, envelope[off:off+length], &nonce, key)
+	if !ok {
+		return nil, errors.New("envelope: authentication failed")
+	}
+	return message, nil
+}
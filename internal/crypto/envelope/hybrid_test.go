@@ -0,0 +1,96 @@
+// hybrid_test.go - experimental post-quantum hybrid envelope tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func TestHybridEnvelopeSealOpen(t *testing.T) {
+	require := require.New(t)
+
+	recipientKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	kemKey, err := mlkem.GenerateKey768()
+	require.NoError(err, "GenerateKey768 failed")
+	message := []byte("Curiouser and curiouser!")
+
+	sealed, err := SealHybrid(rand.Reader, recipientKey.PublicKey(), kemKey.EncapsulationKey(), message)
+	require.NoError(err, "SealHybrid failed")
+	require.True(IsHybridSealed(sealed), "envelope not reported as sealed")
+	require.False(IsSealed(sealed), "hybrid envelope reported as classical")
+	require.Equal(len(message)+HybridOverhead, len(sealed), "wrong envelope size")
+
+	opened, err := OpenHybrid(recipientKey, kemKey, append(sealed, make([]byte, 100)...))
+	require.NoError(err, "OpenHybrid of a padded envelope failed")
+	require.Equal(message, opened)
+
+	otherKemKey, err := mlkem.GenerateKey768()
+	require.NoError(err, "GenerateKey768 failed")
+	_, err = OpenHybrid(recipientKey, otherKemKey, sealed)
+	require.Error(err, "OpenHybrid with the wrong ML-KEM key should've failed")
+	otherKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	_, err = OpenHybrid(otherKey, kemKey, sealed)
+	require.Error(err, "OpenHybrid with the wrong X25519 key should've failed")
+}
+
+// sequence returns n consecutive byte values from start
+func sequence(start, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(start + i)
+	}
+	return b
+}
+
+func TestHybridEnvelopeKnownAnswer(t *testing.T) {
+	require := require.New(t)
+
+	recipientKey, err := ecdh.NewKeypair(bytes.NewReader(sequence(0x80, 32)))
+	require.NoError(err, "NewKeypair failed")
+	kemKey, err := mlkem.NewDecapsulationKey768(sequence(0x40, mlkem.SeedSize))
+	require.NoError(err, "NewDecapsulationKey768 failed")
+	message := []byte("Curiouser and curiouser!")
+	// the ephemeral key, the nonce and the ML-KEM randomness
+	random := sequence(0, keyLen+nonceLen+kemRandomLen)
+
+	sealed, err := SealHybrid(bytes.NewReader(random), recipientKey.PublicKey(), kemKey.EncapsulationKey(), message)
+	require.NoError(err, "SealHybrid failed")
+	header := sealed[:HybridOverhead-secretbox.Overhead]
+	digest := sha256.Sum256(header)
+	require.Equal("bb6157bc3508d4c6cd6932a173c8d957a3846fa831cf4167a9ab8c7a49471131", hex.EncodeToString(digest[:]))
+
+	again, err := SealHybrid(bytes.NewReader(random), recipientKey.PublicKey(), kemKey.EncapsulationKey(), message)
+	require.NoError(err, "SealHybrid failed")
+	require.Equal(sealed, again, "envelope not derived from the given randomness")
+	opened, err := OpenHybrid(recipientKey, kemKey, sealed)
+	require.NoError(err, "OpenHybrid failed")
+	require.Equal(message, opened)
+
+	_, err = SealHybrid(bytes.NewReader(random[:keyLen+nonceLen]), recipientKey.PublicKey(), kemKey.EncapsulationKey(), message)
+	require.Error(err, "SealHybrid without the ML-KEM randomness should've failed")
+}
@@ -0,0 +1,39 @@
+// available_windows.go - free disk space of windows volumes
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build windows
+// +build windows
+
+package disk_space
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// available returns the number of bytes available
+// to the user on the volume holding dir
+func available(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(path, &free, &total, &totalFree)
+	if err != nil {
+		return 0, err
+	}
+	return free, nil
+}
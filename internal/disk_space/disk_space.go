@@ -0,0 +1,196 @@
+// disk_space.go - free disk space monitoring
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package disk_space monitors the free space of the volumes holding
+// the data of the client: the database, the spool files and the
+// Maildirs. Below a threshold the client enters an emergency
+// read-only mode in which the SMTP proxy refuses new submissions,
+// while the messages and ACKs are still received, rather than
+// corrupting it's state with failed writes.
+package disk_space
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// Monitor periodically checks the free space of the volumes holding
+// the given directories, see proxy.SubmitProxy.SetDiskSpaceCheck
+type Monitor struct {
+	sync.Mutex
+
+	dirs      []string
+	minFree   uint64
+	interval  time.Duration
+	store     *storage.Store
+	clock     clock.Clock
+	timer     clock.Timer
+	stopped   bool
+	low       map[string]bool
+	available func(dir string) (uint64, error)
+}
+
+// New creates a new Monitor of the volume holding the given file,
+// which is low on space below minFree bytes. The transitions are
+// recorded as events of the given Store, if any.
+func New(path string, minFree uint64, interval time.Duration, store *storage.Store) *Monitor {
+	m := Monitor{
+		dirs:      []string{filepath.Dir(path)},
+		minFree:   minFree,
+		interval:  interval,
+		store:     store,
+		clock:     clock.Real,
+		low:       make(map[string]bool),
+		available: available,
+	}
+	return &m
+}
+
+// FromConfig creates a new Monitor of the volumes holding the
+// database of the given Store, the spool files and the Maildirs
+func FromConfig(cfg *config.Config, store *storage.Store) *Monitor {
+	m := New(store.Path(), cfg.MinFreeDiskSpace(), constants.DiskSpaceCheckInterval, store)
+	spoolDir := cfg.Spool.Directory
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+	m.AddDirectory(spoolDir)
+	if cfg.Maildir.Path != "" {
+		m.AddDirectory(cfg.Maildir.Path)
+	}
+	return m
+}
+
+// AddDirectory adds the volume holding the given directory to the
+// monitored ones, it must be called before Start. The Monitor is low
+// on space while any of it's volumes is.
+func (m *Monitor) AddDirectory(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	dir = filepath.Clean(dir)
+	for _, d := range m.dirs {
+		if d == dir {
+			return
+		}
+	}
+	m.dirs = append(m.dirs, dir)
+}
+
+// SetClock sets the Clock of the checks, e.g.
+// a clock.Fake in tests. It must be set before Start.
+func (m *Monitor) SetClock(c clock.Clock) {
+	m.Lock()
+	defer m.Unlock()
+	m.clock = c
+}
+
+// Low returns true while any of the volumes is low on space
+func (m *Monitor) Low() bool {
+	m.Lock()
+	defer m.Unlock()
+	for _, low := range m.low {
+		if low {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks the free space of the volumes, the first error is
+// returned once all of them were checked
+func (m *Monitor) Check() error {
+	m.Lock()
+	dirs := m.dirs
+	m.Unlock()
+	var first error
+	for _, dir := range dirs {
+		err := m.check(dir)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// check checks the free space of the volume holding the given
+// directory and records an event when it becomes or ceases to be low
+func (m *Monitor) check(dir string) error {
+	free, err := m.available(dir)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	low := free < m.minFree
+	changed := low != m.low[dir]
+	m.low[dir] = low
+	m.Unlock()
+	if !changed {
+		return nil
+	}
+	e := storage.Event{
+		Detail: fmt.Sprintf("%d MiB free in %s", free>>20, dir),
+	}
+	if low {
+		log.Errorf("only %d MiB are free in %s, refusing new submissions until space is freed", free>>20, dir)
+		e.Type = storage.EventDiskSpaceLow
+	} else {
+		log.Noticef("%d MiB are free in %s again", free>>20, dir)
+		e.Type = storage.EventDiskSpaceRecovered
+	}
+	if m.store == nil {
+		return nil
+	}
+	return m.store.RecordEvent(&e)
+}
+
+// Start checks the free space now and then periodically
+func (m *Monitor) Start() {
+	m.run()
+}
+
+// Stop stops the checks
+func (m *Monitor) Stop() {
+	m.Lock()
+	defer m.Unlock()
+	m.stopped = true
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
+
+// run checks the free space and schedules the next check
+func (m *Monitor) run() {
+	err := m.Check()
+	if err != nil {
+		log.Errorf("failed to check the free disk space: %s", err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if !m.stopped {
+		m.timer = m.clock.AfterFunc(m.interval, m.run)
+	}
+}
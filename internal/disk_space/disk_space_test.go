@@ -0,0 +1,108 @@
+// disk_space_test.go - free disk space monitoring tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package disk_space
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvailable(t *testing.T) {
+	require := require.New(t)
+
+	free, err := available(os.TempDir())
+	require.NoError(err)
+	require.NotEqual(uint64(0), free)
+}
+
+func TestMonitor(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "disk_space")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "db"))
+	require.NoError(err)
+	defer store.Close()
+
+	free := uint64(100 << 20)
+	m := New(store.Path(), 64<<20, time.Minute, store)
+	m.available = func(d string) (uint64, error) {
+		require.Equal(dir, d)
+		return free, nil
+	}
+	fake := clock.NewFake(time.Now())
+	m.SetClock(fake)
+	m.Start()
+	defer m.Stop()
+	require.False(m.Low())
+
+	// the volume fills up
+	free = 10 << 20
+	fake.Advance(time.Minute)
+	require.True(m.Low())
+	events, err := store.Events(time.Time{}, 0)
+	require.NoError(err)
+	require.Equal(1, len(events))
+	require.Equal(storage.EventDiskSpaceLow, events[0].Type)
+
+	// and space is freed
+	free = 1 << 30
+	fake.Advance(time.Minute)
+	require.False(m.Low())
+	events, err = store.Events(time.Time{}, 0)
+	require.NoError(err)
+	require.Equal(2, len(events))
+	require.Equal(storage.EventDiskSpaceRecovered, events[1].Type)
+}
+
+func TestMonitorDirectories(t *testing.T) {
+	require := require.New(t)
+
+	free := map[string]uint64{
+		"/var/lib/mixclient": 1 << 30,
+		"/var/spool":         1 << 30,
+		"/home/alice/Mail":   1 << 30,
+	}
+	m := New("/var/lib/mixclient/db", 64<<20, time.Minute, nil)
+	m.AddDirectory("/var/spool/")
+	m.AddDirectory("/home/alice/Mail")
+	m.AddDirectory("/var/lib/mixclient")
+	m.available = func(d string) (uint64, error) {
+		f, ok := free[d]
+		require.True(ok, "unexpected directory %s", d)
+		return f, nil
+	}
+	require.Equal(3, len(m.dirs))
+	require.NoError(m.Check())
+	require.False(m.Low())
+
+	// any volume low on space refuses the submissions
+	free["/home/alice/Mail"] = 1 << 20
+	require.NoError(m.Check())
+	require.True(m.Low())
+	free["/home/alice/Mail"] = 1 << 30
+	require.NoError(m.Check())
+	require.False(m.Low())
+}
@@ -0,0 +1,82 @@
+// deterministic.go - deterministic entropy source
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build deterministic
+// +build deterministic
+
+package entropy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// Deterministic is true in builds with the deterministic build tag,
+// in which SetSeed makes the entropy source predictable. Such builds
+// must never be used for anything but tests and simulations.
+const Deterministic = true
+
+// SetSeed replaces the entropy source with a deterministic one
+// seeded with the given seed, so that the runs with the same seed
+// draw the same keys, IDs, paths and timings. A nil seed restores
+// the default source.
+func SetSeed(seed []byte) {
+	if seed == nil {
+		setSource(nil)
+		return
+	}
+	setSource(NewDeterministicReader(seed))
+}
+
+// DeterministicReader is an io.Reader of the SHA-256 hashes of
+// it's seed and an incrementing counter, it's reproducible and
+// therefore offers no secrecy
+type DeterministicReader struct {
+	sync.Mutex
+
+	seed    [sha256.Size]byte
+	counter uint64
+	buf     []byte
+}
+
+// NewDeterministicReader creates a DeterministicReader of the given seed
+func NewDeterministicReader(seed []byte) *DeterministicReader {
+	return &DeterministicReader{
+		seed: sha256.Sum256(seed),
+	}
+}
+
+// Read fills p with the next bytes of the stream, it never fails
+func (r *DeterministicReader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			block := make([]byte, len(r.seed)+8)
+			copy(block, r.seed[:])
+			binary.BigEndian.PutUint64(block[len(r.seed):], r.counter)
+			r.counter++
+			sum := sha256.Sum256(block)
+			r.buf = sum[:]
+		}
+		copied := copy(p[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+	return n, nil
+}
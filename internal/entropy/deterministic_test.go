@@ -0,0 +1,48 @@
+// deterministic_test.go - deterministic entropy source tests
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build deterministic
+// +build deterministic
+
+package entropy
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeterministicSource(t *testing.T) {
+	require := require.New(t)
+
+	require.True(Deterministic)
+	draw := func(seed []byte) ([]byte, int64) {
+		SetSeed(seed)
+		defer SetSeed(nil)
+		buf := make([]byte, 100)
+		_, err := io.ReadFull(Reader, buf)
+		require.NoError(err, "ReadFull failed")
+		return buf, NewMath().Int63()
+	}
+	a, aMath := draw([]byte("seed"))
+	b, bMath := draw([]byte("seed"))
+	require.Equal(a, b)
+	require.Equal(aMath, bMath)
+	c, _ := draw([]byte("other seed"))
+	require.NotEqual(a, c)
+	require.Nil(current())
+}
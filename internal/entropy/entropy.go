@@ -0,0 +1,124 @@
+// entropy.go - the entropy source of the client
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package entropy is the source of randomness of the client, the
+// keys, the message and Block IDs, the paths and the timings are all
+// drawn from it unless a component is given another io.Reader. It's
+// the katzenpost core/crypto/rand source, which can be replaced by a
+// seeded deterministic source only in builds with the deterministic
+// build tag, for reproducible integration tests and simulations.
+package entropy
+
+import (
+	"encoding/binary"
+	"io"
+	mathrand "math/rand"
+	"sync"
+
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+var (
+	sourceLock sync.RWMutex
+	// source is nil while the default source is used
+	source io.Reader
+)
+
+// setSource replaces the entropy source, nil restores the default
+func setSource(r io.Reader) {
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+	source = r
+}
+
+// current returns the current entropy source or nil
+// if it's the default source
+func current() io.Reader {
+	sourceLock.RLock()
+	defer sourceLock.RUnlock()
+	return source
+}
+
+// Reader is an io.Reader of the entropy source, each
+// Read reads from the source current at the time
+var Reader io.Reader = reader{}
+
+type reader struct{}
+
+func (reader) Read(p []byte) (int, error) {
+	if r := current(); r != nil {
+		return r.Read(p)
+	}
+	return rand.Reader.Read(p)
+}
+
+// NewMath returns a math/rand.Rand drawing from the entropy source,
+// e.g. for the sampling of exponentially distributed delays
+func NewMath() *mathrand.Rand {
+	r := current()
+	if r == nil {
+		return rand.NewMath()
+	}
+	return mathrand.New(NewSource(r))
+}
+
+// Source is a math/rand.Source which reads from an io.Reader, e.g.
+// so that the delays are sampled from the entropy source given to
+// a component. Once the reader fails it draws zeros and Err
+// returns the failure.
+type Source struct {
+	sync.Mutex
+	reader io.Reader
+	err    error
+}
+
+// NewSource creates a new Source reading from the given reader
+func NewSource(r io.Reader) *Source {
+	return &Source{
+		reader: r,
+	}
+}
+
+// Uint64 returns a random uint64 read from the reader
+func (s *Source) Uint64() uint64 {
+	var tmp [8]byte
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return 0
+	}
+	_, err := io.ReadFull(s.reader, tmp[:])
+	if err != nil {
+		s.err = err
+		return 0
+	}
+	return binary.LittleEndian.Uint64(tmp[:])
+}
+
+// Int63 returns a random non-negative int64 read from the reader
+func (s *Source) Int63() int64 {
+	return int64(s.Uint64() & ((1 << 63) - 1))
+}
+
+// Seed is a no-op, the reader is the seed
+func (s *Source) Seed(int64) {}
+
+// Err returns the error of the reader, if it failed
+func (s *Source) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
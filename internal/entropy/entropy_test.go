@@ -0,0 +1,52 @@
+// entropy_test.go - entropy source tests
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package entropy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntropySource(t *testing.T) {
+	require := require.New(t)
+
+	a := make([]byte, 32)
+	b := make([]byte, 32)
+	_, err := io.ReadFull(Reader, a)
+	require.NoError(err, "ReadFull failed")
+	_, err = io.ReadFull(Reader, b)
+	require.NoError(err, "ReadFull failed")
+	require.NotEqual(a, b)
+	require.NotEqual(make([]byte, 32), a)
+
+	// a replaced source is used by Reader and NewMath
+	setSource(bytes.NewReader(bytes.Repeat([]byte{1}, 16)))
+	defer setSource(nil)
+	_, err = io.ReadFull(Reader, a[:8])
+	require.NoError(err, "ReadFull failed")
+	require.Equal(bytes.Repeat([]byte{1}, 8), a[:8])
+	require.Equal(int64(0x0101010101010101), NewMath().Int63())
+
+	// a Source draws zeros once it's reader fails
+	source := NewSource(bytes.NewReader([]byte{1, 2, 3}))
+	require.Equal(uint64(0), source.Uint64())
+	require.Equal(io.ErrUnexpectedEOF, source.Err())
+	require.Equal(int64(0), source.Int63())
+}
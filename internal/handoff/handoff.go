@@ -0,0 +1,173 @@
+// handoff.go - zero downtime upgrade handoff
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+// Package handoff provides zero downtime upgrades of the client
+// daemon. The old process passes it's SMTP and POP3 listener
+// file descriptors to the new process and exits once the new
+// process is ready. Queued messages aren't passed along because
+// they are persisted in the bolt database which the new process
+// opens after the old process has closed it.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ListenersEnv is the environment variable holding the comma
+	// separated names of the listeners passed to the new process
+	ListenersEnv = "MIXCLIENT_HANDOFF_LISTENERS"
+
+	// ReadyFDEnv is the environment variable holding the file
+	// descriptor the new process writes to once it's ready
+	ReadyFDEnv = "MIXCLIENT_HANDOFF_READY_FD"
+
+	// firstFD is the first file descriptor passed to the new
+	// process, after stdin, stdout and stderr
+	firstFD = 3
+)
+
+// fileListener is implemented by listeners whose
+// file descriptor can be passed to another process
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// Exec starts the new binary, passing it the given named listeners,
+// and waits for it to signal that it's ready by calling Ready. The
+// caller must then stop accepting connections, close the database
+// and exit without closing the listeners' other copies.
+func Exec(binary string, args []string, listeners map[string]net.Listener, timeout time.Duration) (*os.Process, error) {
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+
+	names := []string{}
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			readyWriter.Close()
+			return nil, fmt.Errorf("listener %s can't be handed off", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			readyWriter.Close()
+			return nil, err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", ListenersEnv, strings.Join(names, ",")),
+		fmt.Sprintf("%s=%d", ReadyFDEnv, firstFD+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyReader.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return nil, errors.New("new process exited before becoming ready")
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return nil, errors.New("timed out waiting for the new process")
+	}
+	return cmd.Process, nil
+}
+
+// Listeners returns the named listeners inherited from the old
+// process, or an empty map if this process wasn't started by Exec
+func Listeners() (map[string]net.Listener, error) {
+	env := os.Getenv(ListenersEnv)
+	if env == "" {
+		return make(map[string]net.Listener), nil
+	}
+	names := strings.Split(env, ",")
+	files := []*os.File{}
+	for i, name := range names {
+		files = append(files, os.NewFile(uintptr(firstFD+i), name))
+	}
+	return listenersFromFiles(names, files)
+}
+
+// listenersFromFiles returns the named listeners
+// of the given listener file descriptors
+func listenersFromFiles(names []string, files []*os.File) (map[string]net.Listener, error) {
+	if len(names) != len(files) {
+		return nil, errors.New("listener names and files mismatch")
+	}
+	listeners := make(map[string]net.Listener)
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners[names[i]] = l
+	}
+	return listeners, nil
+}
+
+// Ready signals the old process that this process
+// has taken over and that it may exit
+func Ready() error {
+	fd := os.Getenv(ReadyFDEnv)
+	if fd == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(n), "handoff-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,65 @@
+// handoff_test.go - zero downtime upgrade handoff tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package handoff
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenersFromFiles(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen failed")
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(err, "File failed")
+
+	listeners, err := listenersFromFiles([]string{"smtp"}, []*os.File{f})
+	require.NoError(err, "listenersFromFiles failed")
+	inherited, ok := listeners["smtp"]
+	require.True(ok, "smtp listener not found")
+	defer inherited.Close()
+	require.Equal(l.Addr().String(), inherited.Addr().String())
+
+	// the old listener is closed, the inherited one must keep accepting
+	l.Close()
+	go func() {
+		conn, err := net.Dial("tcp", inherited.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := inherited.Accept()
+	require.NoError(err, "Accept failed")
+	conn.Close()
+
+	_, err = listenersFromFiles([]string{"smtp", "pop3"}, []*os.File{})
+	require.Error(err, "listenersFromFiles should've failed")
+
+	listeners, err = Listeners()
+	require.NoError(err, "Listeners failed")
+	require.Equal(0, len(listeners))
+	require.NoError(Ready(), "Ready failed")
+}
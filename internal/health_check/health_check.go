@@ -0,0 +1,171 @@
+// health_check.go - health check and readiness endpoints
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package health_check serves the /healthz and /readyz HTTP endpoints
+// for supervisors such as Kubernetes, the systemd watchdog or monit.
+// /healthz reports whether the storage is writable, without writing
+// to it, and /readyz additionally whether the session of every
+// account with it's Provider is usable and the PKI document of the
+// current epoch is available.
+// Both respond with 200 OK or 503 Service Unavailable and a JSON
+// Report. The endpoints are meant to be served on localhost only.
+package health_check
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// pkiTimeout is the maximum time the PKI document
+// of the current epoch is waited for
+const pkiTimeout = 5 * time.Second
+
+// SessionSource checks the Provider session of an account and
+// tells the Provider endpoint it's established with, it's
+// implemented by session_pool.SessionPool
+type SessionSource interface {
+	Check(identity string) error
+	Endpoint(identity string) string
+}
+
+// WritableChecker checks that the storage
+// is writable, it's implemented by storage.Store
+type WritableChecker interface {
+	CheckWritable() error
+}
+
+// Report is the JSON body of the responses
+type Report struct {
+	// OK is true if all the checks passed
+	OK bool
+	// Checks maps the name of each check to "ok"
+	// or to the reason why it failed
+	Checks map[string]string
+	// Endpoints maps the accounts to the Provider endpoint their
+	// current session is established with, see Ready
+	Endpoints map[string]string
+}
+
+// Checker runs the health checks and serves the endpoints
+type Checker struct {
+	accounts []string
+	sessions SessionSource
+	mixPKI   pki.Client
+	store    WritableChecker
+	epoch    func() uint64
+	server   *http.Server
+}
+
+// New creates a new Checker of the given accounts
+func New(accounts []string, sessions SessionSource, mixPKI pki.Client, store WritableChecker) *Checker {
+	c := Checker{
+		accounts: accounts,
+		sessions: sessions,
+		mixPKI:   mixPKI,
+		store:    store,
+		epoch: func() uint64 {
+			epoch, _, _ := epochtime.Now()
+			return epoch
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, c.Healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, c.Ready())
+	})
+	c.server = &http.Server{Handler: mux}
+	return &c
+}
+
+// Healthy returns the liveness Report, which only checks
+// that the storage is writable and has no side effects
+func (c *Checker) Healthy() *Report {
+	r := Report{
+		OK:     true,
+		Checks: make(map[string]string),
+	}
+	r.check("storage", c.store.CheckWritable())
+	return &r
+}
+
+// Ready returns the readiness Report, which checks the storage,
+// that the Provider session of every account is usable, which sends
+// a NoOp command over it, and the PKI document of the current epoch.
+// It also reports the endpoint each session is established with,
+// which changes once a lost session fails over.
+func (c *Checker) Ready() *Report {
+	r := c.Healthy()
+	r.Endpoints = make(map[string]string)
+	for _, account := range c.accounts {
+		r.check("session "+account, c.sessions.Check(account))
+		if endpoint := c.sessions.Endpoint(account); endpoint != "" {
+			r.Endpoints[account] = endpoint
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pkiTimeout)
+	defer cancel()
+	_, err := c.mixPKI.Get(ctx, c.epoch())
+	r.check("pki", err)
+	return r
+}
+
+// check records the result of the named check
+func (r *Report) check(name string, err error) {
+	if err != nil {
+		r.OK = false
+		r.Checks[name] = err.Error()
+		return
+	}
+	r.Checks[name] = "ok"
+}
+
+// respond writes the given Report
+func respond(w http.ResponseWriter, r *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if !r.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(r)
+	if err != nil {
+		log.Debugf("health check: failed to write response: %s", err)
+	}
+}
+
+// Serve serves the endpoints on the given listener until Halt
+func (c *Checker) Serve(l net.Listener) {
+	go func() {
+		err := c.server.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("health check: %s", err)
+		}
+	}()
+}
+
+// Halt stops serving the endpoints
+func (c *Checker) Halt() error {
+	return c.server.Close()
+}
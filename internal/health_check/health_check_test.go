@@ -0,0 +1,125 @@
+// health_check_test.go - health check and readiness endpoint tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package health_check
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/client/mix_pki"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore is a WritableChecker of a full disk
+type failingStore struct{}
+
+func (failingStore) CheckWritable() error {
+	return errors.New("no space left on device")
+}
+
+// failedOverPool is a SessionPool whose sessions
+// failed over to another endpoint
+type failedOverPool struct {
+	*session_pool.SessionPool
+}
+
+func (failedOverPool) Endpoint(identity string) string {
+	return "127.0.0.1:2"
+}
+
+func TestHealthCheck(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "health_check_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	pool := &session_pool.SessionPool{
+		Sessions: make(map[string]wire.SessionInterface),
+		Locks:    make(map[string]*sync.Mutex),
+	}
+	staticPKI := mix_pki.NewStaticPKI()
+	c := New([]string{"alice@acme.com"}, pool, staticPKI, store)
+	c.epoch = func() uint64 { return 42 }
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "unexpected Listen error")
+	c.Serve(l)
+	defer c.Halt()
+	get := func(path string) (int, *Report) {
+		response, err := http.Get("http://" + l.Addr().String() + path)
+		require.NoError(err, "unexpected Get error")
+		defer response.Body.Close()
+		r := Report{}
+		err = json.NewDecoder(response.Body).Decode(&r)
+		require.NoError(err, "unexpected Decode error")
+		return response.StatusCode, &r
+	}
+
+	status, r := get("/healthz")
+	require.Equal(http.StatusOK, status)
+	require.True(r.OK)
+	require.Equal("ok", r.Checks["storage"])
+
+	// neither session nor PKI document yet
+	status, r = get("/readyz")
+	require.Equal(http.StatusServiceUnavailable, status)
+	require.False(r.OK)
+	require.Equal("ok", r.Checks["storage"])
+	require.NotEqual("ok", r.Checks["session alice@acme.com"])
+	require.NotEqual("ok", r.Checks["pki"])
+
+	session := session_pool.NewFakeSession()
+	pool.Add("alice@acme.com", session)
+	err = staticPKI.Set(42, &pki.Document{Epoch: 42})
+	require.NoError(err, "unexpected Set() error")
+	status, r = get("/readyz")
+	require.Equal(http.StatusOK, status)
+	require.True(r.OK)
+
+	// a lost session isn't ready although it's in the pool
+	session.SetError(errors.New("link lost"))
+	status, r = get("/readyz")
+	require.Equal(http.StatusServiceUnavailable, status)
+	require.Equal("link lost", r.Checks["session alice@acme.com"])
+	session.SetError(nil)
+
+	// the endpoint of the current session is reported
+	require.Empty(r.Endpoints)
+	c.sessions = failedOverPool{pool}
+	status, r = get("/readyz")
+	require.Equal(http.StatusOK, status)
+	require.Equal("127.0.0.1:2", r.Endpoints["alice@acme.com"])
+
+	c.store = failingStore{}
+	status, r = get("/healthz")
+	require.Equal(http.StatusServiceUnavailable, status)
+	require.Equal("no space left on device", r.Checks["storage"])
+}
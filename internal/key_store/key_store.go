@@ -0,0 +1,221 @@
+// key_store.go - layout and permissions of the keys directory
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package key_store owns the layout of the keys directory. The keys
+// of each account are kept in a subdirectory named after the lower
+// cased e-mail address of the account:
+//
+//	keys/alice@acme.com/e2e.private.pem
+//	keys/alice@acme.com/wire.private.pem
+//
+// Directories are created with mode 0700 and key files are written
+// atomically with mode 0600. Key files of the older flat layout,
+// e.g. keys/e2e_alice@acme.com.private.pem, are moved into their
+// account directory by Open.
+package key_store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/wipe"
+)
+
+const (
+	// dirMode is the mode of the keys directory
+	// and of the account directories
+	dirMode = os.FileMode(0700)
+
+	// fileMode is the mode of the key files
+	fileMode = os.FileMode(0600)
+)
+
+// ErrInsecurePermissions is the error returned for private
+// key files accessible to the group or to other users
+var ErrInsecurePermissions = errors.New("private key file is accessible to other users")
+
+// legacyKeyFile matches the key file names of the flat layout,
+// the key type, e-mail address and key status
+var legacyKeyFile = regexp.MustCompile(`^([a-z0-9]+)_(.+@.+)\.(` + constants.KeyStatusPrivate + `|` + constants.KeyStatusPublic + `)\.pem$`)
+
+// KeyFileName returns the path of the given key of the account
+// name@provider in the keys directory dir
+func KeyFileName(dir, keyType, name, provider, keyStatus string) string {
+	return filepath.Join(accountDir(dir, fmt.Sprintf("%s@%s", name, provider)), fmt.Sprintf("%s.%s.pem", keyType, keyStatus))
+}
+
+// accountDir returns the directory of the keys of
+// the account with the given e-mail address
+func accountDir(dir, email string) string {
+	return filepath.Join(dir, strings.ToLower(email))
+}
+
+// Store is a keys directory
+type Store struct {
+	dir string
+}
+
+// Open creates the keys directory if it doesn't exist, moves key
+// files of the flat layout into their account directories and
+// returns ErrInsecurePermissions if any private key file is
+// accessible to the group or to other users
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, dirMode)
+	if err != nil {
+		return nil, err
+	}
+	s := Store{
+		dir: dir,
+	}
+	err = s.migrate()
+	if err != nil {
+		return nil, err
+	}
+	err = s.Check()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Dir returns the path of the keys directory
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// KeyFile returns the path of the given key of the account name@provider
+func (s *Store) KeyFile(keyType, name, provider, keyStatus string) string {
+	return KeyFileName(s.dir, keyType, name, provider, keyStatus)
+}
+
+// migrate moves the key files of the flat layout into their
+// account directories, existing files are never overwritten
+func (s *Store) migrate() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m := legacyKeyFile.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		keyType, email, keyStatus := m[1], m[2], m[3]
+		destination := filepath.Join(accountDir(s.dir, email), fmt.Sprintf("%s.%s.pem", keyType, keyStatus))
+		if _, err := os.Stat(destination); !os.IsNotExist(err) {
+			return fmt.Errorf("cannot move %s, %s already exists", entry.Name(), destination)
+		}
+		err = os.MkdirAll(filepath.Dir(destination), dirMode)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(s.dir, entry.Name()), destination)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPrivate returns true if the given file name is a private key file
+func isPrivate(fileName string) bool {
+	return strings.HasSuffix(fileName, fmt.Sprintf(".%s.pem", constants.KeyStatusPrivate))
+}
+
+// checkFile returns ErrInsecurePermissions if the given
+// file is a private key file accessible to other users
+func checkFile(path string, info os.FileInfo) error {
+	if isPrivate(info.Name()) && insecure(info) {
+		return fmt.Errorf("%w: %s has mode %s", ErrInsecurePermissions, path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Check returns ErrInsecurePermissions if any private key file
+// of the keys directory is accessible to the group or to other
+// users, these must be made private with chmod 600
+func (s *Store) Check() error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return checkFile(path, info)
+	})
+}
+
+// ReadFile returns the contents of the given key file,
+// refusing private key files accessible to other users
+func (s *Store) ReadFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFile(path, info)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// WriteFile atomically replaces the contents of the given key
+// file with mode 0600, creating it's account directory if needed,
+// so that a crash never leaves a truncated key behind
+func (s *Store) WriteFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), dirMode)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(fileMode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// RemoveAccount shreds the key files of the account with
+// the given e-mail address and removes it's account directory,
+// an account without keys is ignored
+func (s *Store) RemoveAccount(email string) error {
+	return wipe.Shred(accountDir(s.dir, email))
+}
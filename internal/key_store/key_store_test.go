@@ -0,0 +1,106 @@
+// key_store_test.go - keys directory tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package key_store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "key_store_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+
+	// key files of the flat layout are moved into their account directory
+	legacy := filepath.Join(dir, "e2e_Alice@acme.com.private.pem")
+	err = ioutil.WriteFile(legacy, []byte("e2e key"), 0600)
+	require.NoError(err, "unexpected WriteFile error")
+
+	s, err := Open(dir)
+	require.NoError(err, "Open failed")
+	keyFile := s.KeyFile(constants.EndToEndKeyType, "Alice", "acme.com", constants.KeyStatusPrivate)
+	require.Equal(filepath.Join(dir, "alice@acme.com", "e2e.private.pem"), keyFile)
+	_, err = os.Stat(legacy)
+	require.True(os.IsNotExist(err), "legacy key file not moved")
+	data, err := s.ReadFile(keyFile)
+	require.NoError(err, "ReadFile failed")
+	require.Equal([]byte("e2e key"), data)
+
+	wireFile := s.KeyFile(constants.LinkLayerKeyType, "bob", "acme.com", constants.KeyStatusPrivate)
+	err = s.WriteFile(wireFile, []byte("wire key"))
+	require.NoError(err, "WriteFile failed")
+	data, err = s.ReadFile(wireFile)
+	require.NoError(err, "ReadFile failed")
+	require.Equal([]byte("wire key"), data)
+	entries, err := ioutil.ReadDir(filepath.Dir(wireFile))
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(1, len(entries), "temporary file left behind")
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(wireFile)
+	require.NoError(err, "unexpected Stat error")
+	require.Equal(os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(wireFile))
+	require.NoError(err, "unexpected Stat error")
+	require.Equal(os.FileMode(0700), info.Mode().Perm())
+
+	// group or world readable private keys are refused
+	err = os.Chmod(wireFile, 0644)
+	require.NoError(err, "unexpected Chmod error")
+	_, err = s.ReadFile(wireFile)
+	require.True(errors.Is(err, ErrInsecurePermissions))
+	_, err = Open(dir)
+	require.True(errors.Is(err, ErrInsecurePermissions))
+}
+
+func TestRemoveAccount(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "key_store_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	require.NoError(err, "Open failed")
+	aliceFile := s.KeyFile(constants.EndToEndKeyType, "alice", "acme.com", constants.KeyStatusPrivate)
+	err = s.WriteFile(aliceFile, []byte("alice key"))
+	require.NoError(err, "WriteFile failed")
+	bobFile := s.KeyFile(constants.EndToEndKeyType, "bob", "acme.com", constants.KeyStatusPrivate)
+	err = s.WriteFile(bobFile, []byte("bob key"))
+	require.NoError(err, "WriteFile failed")
+
+	err = s.RemoveAccount("Alice@acme.com")
+	require.NoError(err, "RemoveAccount failed")
+	_, err = os.Stat(filepath.Dir(aliceFile))
+	require.True(os.IsNotExist(err), "account directory not removed")
+	data, err := s.ReadFile(bobFile)
+	require.NoError(err, "ReadFile failed")
+	require.Equal([]byte("bob key"), data)
+	err = s.RemoveAccount("alice@acme.com")
+	require.NoError(err, "RemoveAccount of a removed account failed")
+}
@@ -0,0 +1,30 @@
+// mode_windows.go - key file permissions on windows
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build windows
+// +build windows
+
+package key_store
+
+import (
+	"os"
+)
+
+// insecure always returns false, the permission bits don't
+// reflect the access control lists of windows files
+func insecure(info os.FileInfo) bool {
+	return false
+}
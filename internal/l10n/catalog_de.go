@@ -0,0 +1,45 @@
+// catalog_de.go - German message catalog
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package l10n
+
+func init() {
+	err := Register("de", Catalog{
+		DSNSuccessSubject: "Zustellbenachrichtigung (Erfolg)",
+		DSNSuccessBody: "Ihre Nachricht an %s wurde an den Provider des Empfängers zugestellt.\n" +
+			"Alle %d Blöcke der Nachricht wurden bestätigt.",
+		DSNRelayedBody: "Ihre Nachricht an %s wurde an den Provider des Empfängers gesendet.\n" +
+			"Einige ihrer %d Blöcke wurden mit einem SURB des Empfängers\n" +
+			"gesendet und konnten nicht bestätigt werden.",
+		DSNFailureSubject: "Zustellbenachrichtigung (Fehler)",
+		DSNFailureBody: "Ihre Nachricht an %s konnte nicht zugestellt werden.\n" +
+			"Ein Block der Nachricht wurde nach %d Sendeversuchen nicht bestätigt.",
+		UsageCapSubject: "Monatliches Datenlimit erreicht",
+		UsageCapBody: "Ihr Konto hat sein monatliches Datenlimit erreicht.\n" +
+			"Der Versand ist bis %s pausiert, die wartenden Nachrichten\n" +
+			"werden dann gesendet. Nachrichten werden weiterhin empfangen.\n",
+		DeferredSubject: "Nachricht zurückgestellt, Postfach fast voll",
+		DeferredBody: "Eine Nachricht mit %d Bytes (ID %x) wurde empfangen, aber\n" +
+			"Ihr Postfach hat nur noch %d Bytes frei. Sie wird zugestellt,\n" +
+			"sobald Sie Nachrichten löschen, kleinere Nachrichten werden\n" +
+			"zuerst zugestellt.\n",
+		VacationSubject:     "Automatische Antwort: %s",
+		VacationSubjectNone: "Automatische Antwort",
+	})
+	if err != nil {
+		panic(err)
+	}
+}
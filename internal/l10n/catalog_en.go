@@ -0,0 +1,41 @@
+// catalog_en.go - English message catalog
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package l10n
+
+// english is the reference catalog, it has every key
+var english = Catalog{
+	DSNSuccessSubject: "Delivery Status Notification (Success)",
+	DSNSuccessBody: "Your message to %s was delivered to the recipient's Provider.\n" +
+		"All %d blocks of the message were acknowledged.",
+	DSNRelayedBody: "Your message to %s was sent to the recipient's Provider.\n" +
+		"Some of it's %d blocks were sent with a SURB of the recipient\n" +
+		"and could not be acknowledged.",
+	DSNFailureSubject: "Delivery Status Notification (Failure)",
+	DSNFailureBody: "Your message to %s could not be delivered.\n" +
+		"A block of the message was not acknowledged after %d transmission attempts.",
+	UsageCapSubject: "Monthly usage cap reached",
+	UsageCapBody: "Your account reached it's monthly bandwidth usage cap.\n" +
+		"Sending is paused until %s, the queued messages\n" +
+		"will be sent then. Messages are still received.\n",
+	DeferredSubject: "Message deferred, mailbox nearly full",
+	DeferredBody: "A message of %d bytes (ID %x) was received but only\n" +
+		"%d bytes are left in your mailbox quota. It will be delivered\n" +
+		"once you delete messages to free space, smaller messages are\n" +
+		"delivered first.\n",
+	VacationSubject:     "Auto: %s",
+	VacationSubjectNone: "Auto-reply",
+}
@@ -0,0 +1,156 @@
+// l10n.go - localization of client generated messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package l10n localizes the user visible text of the messages the
+// client generates: delivery status notifications, system mailbox
+// notices and vacation auto-replies. Each language has a Catalog
+// mapping message keys to fmt format strings, English is built in
+// and used for the missing languages and keys.
+//
+// To add a language, write a TOML file with one line per key,
+// e.g. for Spanish:
+//
+//	usage_cap_subject = "Límite de uso mensual alcanzado"
+//
+// and register it with LoadCatalog and Register, or add a built-in
+// catalog_<language>.go file registering it in it's init function.
+// A translation must keep the format verbs of the English text in
+// the same order. The language of an account is set with
+// storage.Store.SetLanguage or the Language of it's configuration.
+package l10n
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+)
+
+// DefaultLanguage is the language used when a
+// catalog or a key of a catalog is missing
+const DefaultLanguage = "en"
+
+// The message keys
+const (
+	DSNSuccessSubject   = "dsn_success_subject"
+	DSNSuccessBody      = "dsn_success_body"
+	DSNRelayedBody      = "dsn_relayed_body"
+	DSNFailureSubject   = "dsn_failure_subject"
+	DSNFailureBody      = "dsn_failure_body"
+	UsageCapSubject     = "usage_cap_subject"
+	UsageCapBody        = "usage_cap_body"
+	DeferredSubject     = "deferred_subject"
+	DeferredBody        = "deferred_body"
+	VacationSubject     = "vacation_subject"
+	VacationSubjectNone = "vacation_subject_none"
+)
+
+// Catalog maps the message keys to fmt format strings
+type Catalog map[string]string
+
+var (
+	catalogsLock sync.RWMutex
+	catalogs     = map[string]Catalog{
+		DefaultLanguage: english,
+	}
+
+	// verbPattern matches the fmt format verbs
+	verbPattern = regexp.MustCompile(`%[-+# 0]*[0-9]*(\.[0-9]+)?[a-zA-Z%]`)
+)
+
+// verbs returns the format verbs of the given format string
+func verbs(format string) string {
+	return strings.Join(verbPattern.FindAllString(format, -1), " ")
+}
+
+// Register registers the catalog of the given language, replacing
+// it's existing catalog. An error is returned if a key is unknown or
+// if the format verbs of a text differ from the English ones.
+func Register(language string, catalog Catalog) error {
+	for key, format := range catalog {
+		reference, ok := english[key]
+		if !ok {
+			return fmt.Errorf("unknown message key %s", key)
+		}
+		if verbs(format) != verbs(reference) {
+			return fmt.Errorf("the format verbs of %s differ from the English ones", key)
+		}
+	}
+	catalogsLock.Lock()
+	defer catalogsLock.Unlock()
+	catalogs[strings.ToLower(language)] = catalog
+	return nil
+}
+
+// LoadCatalog loads a catalog from the given TOML file
+func LoadCatalog(fileName string) (Catalog, error) {
+	fileData, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	catalog := Catalog{}
+	err = toml.Unmarshal(fileData, &catalog)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Languages returns the sorted registered languages
+func Languages() []string {
+	catalogsLock.RLock()
+	defer catalogsLock.RUnlock()
+	languages := []string{}
+	for language := range catalogs {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// lookup returns the format string of the given key in the given
+// language, "pt-BR" falls back to "pt" and then to English
+func lookup(language, key string) string {
+	catalogsLock.RLock()
+	defer catalogsLock.RUnlock()
+	language = strings.ToLower(language)
+	candidates := []string{language}
+	if i := strings.IndexAny(language, "-_"); i > 0 {
+		candidates = append(candidates, language[:i])
+	}
+	for _, candidate := range candidates {
+		if format, ok := catalogs[candidate][key]; ok {
+			return format
+		}
+	}
+	return english[key]
+}
+
+// Sprintf formats the text of the given key in the given language
+func Sprintf(language, key string, args ...interface{}) string {
+	return fmt.Sprintf(lookup(language, key), args...)
+}
+
+// Header formats the text of the given key in the given language
+// for a message header, non ASCII text is RFC 2047 encoded
+func Header(language, key string, args ...interface{}) string {
+	return mime.QEncoding.Encode("utf-8", Sprintf(language, key, args...))
+}
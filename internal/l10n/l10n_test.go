@@ -0,0 +1,63 @@
+// l10n_test.go - localization tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package l10n
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSprintf(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("Monthly usage cap reached", Sprintf("", UsageCapSubject))
+	require.Equal("Monthly usage cap reached", Sprintf("xx", UsageCapSubject))
+	require.Equal("Monatliches Datenlimit erreicht", Sprintf("de", UsageCapSubject))
+	require.Equal("Monatliches Datenlimit erreicht", Sprintf("de-AT", UsageCapSubject))
+	require.Equal("Automatische Antwort: hi", Sprintf("DE", VacationSubject, "hi"))
+	require.Equal("Monthly usage cap reached", Header("en", UsageCapSubject))
+	require.Equal("=?utf-8?q?Nachricht_zur=C3=BCckgestellt,_Postfach_fast_voll?=", Header("de", DeferredSubject))
+}
+
+func TestRegister(t *testing.T) {
+	require := require.New(t)
+
+	err := Register("xx", Catalog{"no_such_key": "x"})
+	require.Error(err, "an unknown key was registered")
+	err = Register("xx", Catalog{VacationSubject: "Auto"})
+	require.Error(err, "a text without the format verbs was registered")
+	err = Register("xx", Catalog{DSNFailureBody: "%d %s"})
+	require.Error(err, "a text with reordered format verbs was registered")
+
+	catalogFile, err := ioutil.TempFile("", "l10n_test")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(catalogFile.Name())
+	_, err = catalogFile.WriteString("vacation_subject = \"Respuesta automática: %s\"\n")
+	require.NoError(err, "unexpected WriteString error")
+	catalogFile.Close()
+	catalog, err := LoadCatalog(catalogFile.Name())
+	require.NoError(err, "unexpected LoadCatalog() error")
+	err = Register("es", catalog)
+	require.NoError(err, "unexpected Register() error")
+	require.Contains(Languages(), "es")
+	require.Equal("Respuesta automática: hola", Sprintf("es-MX", VacationSubject, "hola"))
+	// missing keys fall back to English
+	require.Equal("Auto-reply", Sprintf("es", VacationSubjectNone))
+}
@@ -0,0 +1,145 @@
+// limiter.go - rate limited error logging
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package log_limiter provides rate limited error logging so that
+// a persistent failure, such as an unreachable Provider, doesn't
+// flood the log with identical lines.
+package log_limiter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// ClassStats describes the occurrences of a given error class
+// and is used to surface error conditions as metrics and status
+// even while their log lines are suppressed.
+type ClassStats struct {
+	// Count is the total number of occurrences of the error class.
+	Count uint64
+	// Suppressed is the number of occurrences not yet logged.
+	Suppressed uint64
+	// LastSeen is the time of the most recent occurrence.
+	LastSeen time.Time
+	// LastMessage is the most recent error message.
+	LastMessage string
+}
+
+// errorClass tracks the log state of a single error class
+type errorClass struct {
+	stats      ClassStats
+	lastLogged time.Time
+}
+
+// Limiter logs at most one line per error class per interval,
+// aggregating the suppressed occurrences into the next line
+// that is logged for that class, e.g.
+// "dial failed (repeated 512 times in last 5m0s)"
+type Limiter struct {
+	sync.Mutex
+
+	log      *logging.Logger
+	interval time.Duration
+	classes  map[string]*errorClass
+	now      func() time.Time
+}
+
+// New creates a new Limiter which writes to the given
+// logger at most once per interval for each error class
+func New(log *logging.Logger, interval time.Duration) *Limiter {
+	l := Limiter{
+		log:      log,
+		interval: interval,
+		classes:  make(map[string]*errorClass),
+		now:      time.Now,
+	}
+	return &l
+}
+
+// Error reports an error belonging to the given error class
+func (l *Limiter) Error(class string, err error) {
+	l.report(class, err.Error())
+}
+
+// Errorf reports a formatted error message belonging
+// to the given error class
+func (l *Limiter) Errorf(class string, format string, args ...interface{}) {
+	l.report(class, fmt.Sprintf(format, args...))
+}
+
+// report logs the message unless the error class was already
+// logged within the current interval, in which case the
+// occurrence is counted and reported later
+func (l *Limiter) report(class, message string) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	c, ok := l.classes[class]
+	if !ok {
+		c = new(errorClass)
+		l.classes[class] = c
+	}
+	c.stats.Count += 1
+	c.stats.LastSeen = now
+	c.stats.LastMessage = message
+	if !c.lastLogged.IsZero() && now.Sub(c.lastLogged) < l.interval {
+		c.stats.Suppressed += 1
+		return
+	}
+	l.emit(c, message, now)
+}
+
+// emit writes a log line for the given error class,
+// including the count of any suppressed occurrences
+func (l *Limiter) emit(c *errorClass, message string, now time.Time) {
+	if c.stats.Suppressed == 0 {
+		l.log.Error(message)
+	} else {
+		l.log.Errorf("%s (repeated %d times in last %s)", message, c.stats.Suppressed, now.Sub(c.lastLogged))
+	}
+	c.stats.Suppressed = 0
+	c.lastLogged = now
+}
+
+// Flush logs a summary line for every error class
+// which has suppressed occurrences
+func (l *Limiter) Flush() {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	for _, c := range l.classes {
+		if c.stats.Suppressed != 0 {
+			l.emit(c, c.stats.LastMessage, now)
+		}
+	}
+}
+
+// Stats returns a snapshot of the statistics of every error class
+func (l *Limiter) Stats() map[string]ClassStats {
+	l.Lock()
+	defer l.Unlock()
+
+	stats := make(map[string]ClassStats)
+	for name, c := range l.classes {
+		stats[name] = c.stats
+	}
+	return stats
+}
@@ -0,0 +1,77 @@
+// limiter_test.go - rate limited error logging tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package log_limiter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+func logMessages(backend *logging.MemoryBackend) []string {
+	messages := []string{}
+	for n := backend.Head(); n != nil; n = n.Next() {
+		messages = append(messages, n.Record.Message())
+	}
+	return messages
+}
+
+func TestLimiter(t *testing.T) {
+	require := require.New(t)
+
+	backend := logging.NewMemoryBackend(32)
+	log := logging.MustGetLogger("log_limiter_test")
+	log.SetBackend(logging.AddModuleLevel(backend))
+
+	now := time.Unix(1500000000, 0)
+	l := New(log, 5*time.Minute)
+	l.now = func() time.Time { return now }
+
+	dialErr := errors.New("dial failed")
+	for i := 0; i < 513; i++ {
+		l.Error("dial", dialErr)
+		now = now.Add(100 * time.Millisecond)
+	}
+	l.Errorf("auth", "authentication failed for %s", "alice@acme.com")
+	require.Equal([]string{
+		"dial failed",
+		"authentication failed for alice@acme.com",
+	}, logMessages(backend))
+
+	stats := l.Stats()
+	require.Equal(uint64(513), stats["dial"].Count)
+	require.Equal(uint64(512), stats["dial"].Suppressed)
+	require.Equal("dial failed", stats["dial"].LastMessage)
+	require.Equal(uint64(1), stats["auth"].Count)
+	require.Equal(uint64(0), stats["auth"].Suppressed)
+
+	now = now.Add(5 * time.Minute)
+	l.Error("dial", dialErr)
+	messages := logMessages(backend)
+	require.Equal(3, len(messages))
+	require.Contains(messages[2], "dial failed (repeated 512 times in last")
+	require.Equal(uint64(0), l.Stats()["dial"].Suppressed)
+
+	l.Error("dial", dialErr)
+	l.Flush()
+	messages = logMessages(backend)
+	require.Equal(4, len(messages))
+	require.Contains(messages[3], "dial failed (repeated 1 times in last")
+}
@@ -0,0 +1,83 @@
+// command.go - external command mail filter
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// commandTimeout is the maximum run time of a filter command
+const commandTimeout = 10 * time.Second
+
+// discardStatus is the exit status of a filter
+// command which discards the message
+const discardStatus = 1
+
+// Command is a Filter running an external command for each message,
+// a lightweight take on milters. The message is written to the
+// command's standard input, it's sender is passed in the
+// MIXCLIENT_FILTER_ACCOUNT, MIXCLIENT_FILTER_SENDER,
+// MIXCLIENT_FILTER_AUTHENTICATED and MIXCLIENT_FILTER_CONTACT
+// environment variables. The message is accepted if the command
+// exits with status 0 and discarded if it exits with status 1,
+// any other outcome is an error.
+type Command struct {
+	path string
+	args []string
+}
+
+// NewCommand creates a new Command filter
+// running the given command with the given arguments
+func NewCommand(path string, args []string) *Command {
+	return &Command{
+		path: path,
+		args: args,
+	}
+}
+
+// Filter runs the command on the message
+func (c *Command) Filter(m *Message) (Verdict, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	authenticated, contact := "", ""
+	if m.Authenticated {
+		authenticated = "1"
+	}
+	if m.Contact != nil {
+		contact = m.Contact.Alias
+	}
+	cmd.Env = append(os.Environ(),
+		"MIXCLIENT_FILTER_ACCOUNT="+m.Account,
+		"MIXCLIENT_FILTER_SENDER="+m.Sender,
+		"MIXCLIENT_FILTER_AUTHENTICATED="+authenticated,
+		"MIXCLIENT_FILTER_CONTACT="+contact)
+	cmd.Stdin = bytes.NewReader(m.Raw)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return Accept, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil && exitErr.ExitCode() == discardStatus {
+		return Discard, nil
+	}
+	return Accept, fmt.Errorf("filter command %s: %s: %s", c.path, err, output)
+}
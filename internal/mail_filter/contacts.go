@@ -0,0 +1,48 @@
+// contacts.go - contact book mail filter
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+// Contacts is a Filter discarding the messages from the Blocked
+// contacts and optionally from the senders which aren't in the
+// contact book. A sender only counts as a contact if the message
+// is authenticated with the contact's pinned key, the From header
+// alone is easily forged.
+type Contacts struct {
+	contactsOnly bool
+}
+
+// NewContacts creates a new Contacts filter, if contactsOnly is
+// true the senders missing from the contact book are discarded
+func NewContacts(contactsOnly bool) *Contacts {
+	return &Contacts{
+		contactsOnly: contactsOnly,
+	}
+}
+
+// Filter filters the message by it's sender
+func (c *Contacts) Filter(m *Message) (Verdict, error) {
+	if m.Contact != nil && m.Contact.Blocked {
+		return Discard, nil
+	}
+	if !c.contactsOnly {
+		return Accept, nil
+	}
+	if m.Contact == nil || !m.Authenticated {
+		return Discard, nil
+	}
+	return Accept, nil
+}
@@ -0,0 +1,109 @@
+// mail_filter.go - mail filters of received messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package mail_filter filters the received messages before they're
+// delivered to the mailbox so that garbage mail can be discarded. It
+// provides filters by the contact book, by the message rate of each
+// sender and by an external command which may for instance score
+// the messages for spam.
+package mail_filter
+
+import (
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/storage"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// Verdict is the decision of a Filter on a message
+type Verdict int
+
+const (
+	// Accept delivers the message to the mailbox
+	Accept Verdict = iota
+	// Discard drops the message
+	Discard
+)
+
+// String returns the name of the verdict
+func (v Verdict) String() string {
+	if v == Discard {
+		return "discard"
+	}
+	return "accept"
+}
+
+// Message is a received message submitted to the Filters
+type Message struct {
+	// Account is the e-mail address of the recipient account
+	Account string
+	// Sender is the lower case address of the message's From
+	// header, empty if it has none
+	Sender string
+	// Authenticated is true if the message was encrypted with
+	// the key pinned in the contact book for the Sender
+	Authenticated bool
+	// Contact is the contact book entry of the Sender, nil if
+	// the Sender isn't in the contact book
+	Contact *storage.Contact
+	// Raw is the message as it would be delivered
+	Raw []byte
+}
+
+// Filter decides whether a received message is delivered. Filters
+// are run before the message store is updated, the contact book
+// entry of the sender is passed in the Message. A message whose
+// Filter fails isn't delivered to the INBOX but quarantined.
+type Filter interface {
+	Filter(m *Message) (Verdict, error)
+}
+
+// Chain is a Filter running the Filters in order until one of
+// them discards the message. A failing Filter doesn't stop the
+// Chain, but unless a later Filter discards the message the
+// Chain fails with it's error so that it's quarantined.
+type Chain []Filter
+
+// Filter runs the Filters of the Chain
+func (c Chain) Filter(m *Message) (Verdict, error) {
+	var failure error
+	for _, f := range c {
+		verdict, err := f.Filter(m)
+		if err != nil {
+			failure = err
+			continue
+		}
+		if verdict != Accept {
+			return verdict, nil
+		}
+	}
+	return Accept, failure
+}
+
+// FromConfig creates a Chain of the configured Filters, the
+// contact book filter always runs so that the Blocked contacts
+// are discarded
+func FromConfig(cfg *config.MailFilter) Chain {
+	chain := Chain{NewContacts(cfg.ContactsOnly)}
+	if cfg.MessagesPerMinute > 0 {
+		chain = append(chain, NewRate(cfg.MessagesPerMinute))
+	}
+	if cfg.Command != "" {
+		chain = append(chain, NewCommand(cfg.Command, cfg.Args))
+	}
+	return chain
+}
@@ -0,0 +1,147 @@
+// mail_filter_test.go - mail filter tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+// failing is a Filter which always fails
+type failing struct{}
+
+func (failing) Filter(m *Message) (Verdict, error) {
+	return Discard, errors.New("broken filter")
+}
+
+func TestContacts(t *testing.T) {
+	require := require.New(t)
+
+	key, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair() error")
+	alice := &storage.Contact{Alias: "alice", Address: "alice@acme.com"}
+	bob := &storage.Contact{Alias: "bob", Address: "bob@nsa.gov", PinnedKey: key.PublicKey()}
+	mallory := &storage.Contact{Alias: "mallory", Address: "mallory@evil.com", Blocked: true}
+
+	for _, c := range []struct {
+		contactsOnly bool
+		m            Message
+		verdict      Verdict
+	}{
+		{false, Message{Sender: "carol@fsb.ru"}, Accept},
+		{false, Message{Sender: "mallory@evil.com", Contact: mallory}, Discard},
+		{true, Message{Sender: "carol@fsb.ru"}, Discard},
+		{true, Message{Sender: "alice@acme.com", Contact: alice}, Discard},
+		{true, Message{Sender: "alice@acme.com", Contact: alice, Authenticated: true}, Accept},
+		{true, Message{Sender: "bob@nsa.gov", Contact: bob}, Discard},
+		{true, Message{Sender: "bob@nsa.gov", Contact: bob, Authenticated: true}, Accept},
+		{true, Message{Sender: "mallory@evil.com", Contact: mallory}, Discard},
+	} {
+		verdict, err := NewContacts(c.contactsOnly).Filter(&c.m)
+		require.NoError(err, "unexpected Filter() error")
+		require.Equal(c.verdict, verdict, "wrong verdict on %s, contactsOnly %v", c.m.Sender, c.contactsOnly)
+	}
+}
+
+func TestRate(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRate(2)
+	alice := &Message{Account: "bob@nsa.gov", Sender: "alice@acme.com", Authenticated: true}
+	for _, verdict := range []Verdict{Accept, Accept, Discard} {
+		v, err := r.Filter(alice)
+		require.NoError(err, "unexpected Filter() error")
+		require.Equal(verdict, v)
+	}
+	v, err := r.Filter(&Message{Account: "bob@nsa.gov", Sender: "carol@fsb.ru", Authenticated: true})
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Accept, v, "senders must be limited independently")
+	v, err = r.Filter(&Message{Account: "dave@acme.com", Sender: "alice@acme.com", Authenticated: true})
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Accept, v, "accounts must be limited independently")
+
+	// forged senders share the rate of the unauthenticated messages
+	for i, verdict := range []Verdict{Accept, Accept, Discard} {
+		v, err := r.Filter(&Message{Account: "bob@nsa.gov", Sender: fmt.Sprintf("sender%d@fsb.ru", i)})
+		require.NoError(err, "unexpected Filter() error")
+		require.Equal(verdict, v)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "mail_filter_test")
+	require.NoError(err, "unexpected TempDir() error")
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "filter.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+grep -q "^Subject: V1AGRA" && exit 1
+[ "$MIXCLIENT_FILTER_SENDER" = "mallory@evil.com" ] && exit 2
+exit 0
+`), 0700)
+	require.NoError(err, "unexpected WriteFile() error")
+
+	c := NewCommand(script, nil)
+	v, err := c.Filter(&Message{Sender: "alice@acme.com", Raw: []byte("Subject: hi\n\nhello\n")})
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Accept, v)
+	v, err = c.Filter(&Message{Sender: "alice@acme.com", Raw: []byte("Subject: V1AGRA\n\ncheap\n")})
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Discard, v)
+	_, err = c.Filter(&Message{Sender: "mallory@evil.com", Raw: []byte("Subject: hi\n\nhello\n")})
+	require.Error(err, "unexpected exit status not reported")
+	_, err = NewCommand(filepath.Join(dir, "missing"), nil).Filter(&Message{})
+	require.Error(err, "missing command not reported")
+}
+
+func TestChain(t *testing.T) {
+	require := require.New(t)
+
+	chain := FromConfig(&config.MailFilter{ContactsOnly: true, MessagesPerMinute: 1})
+	require.Len(chain, 2)
+	alice := &Message{Sender: "alice@acme.com", Contact: &storage.Contact{Address: "alice@acme.com"}, Authenticated: true}
+	v, err := chain.Filter(alice)
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Accept, v)
+	v, err = chain.Filter(alice)
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Discard, v, "rate not limited")
+	v, err = chain.Filter(&Message{Sender: "carol@fsb.ru"})
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Discard, v, "unknown sender not discarded")
+
+	_, err = Chain{failing{}}.Filter(alice)
+	require.Error(err, "a failing filter must fail the chain")
+	v, err = Chain{failing{}, NewContacts(true)}.Filter(&Message{Sender: "carol@fsb.ru"})
+	require.NoError(err, "unexpected Filter() error")
+	require.Equal(Discard, v, "a failing filter must not prevent a discard")
+}
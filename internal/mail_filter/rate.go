@@ -0,0 +1,50 @@
+// rate.go - sender rate mail filter
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+import (
+	"github.com/katzenpost/client/internal/rate_limit"
+)
+
+// Rate is a Filter discarding the messages of the senders
+// exceeding a maximum message rate. The rates of the accounts
+// are limited independently. The messages whose sender isn't
+// authenticated share a single rate per account, so that the
+// limit can't be evaded by forging the From header.
+type Rate struct {
+	limiter *rate_limit.Limiter
+}
+
+// NewRate creates a new Rate filter accepting bursts of up
+// to messagesPerMinute messages per sender and account
+func NewRate(messagesPerMinute int) *Rate {
+	return &Rate{
+		limiter: rate_limit.New(messagesPerMinute, 0),
+	}
+}
+
+// Filter filters the message by the rate of it's sender
+func (r *Rate) Filter(m *Message) (Verdict, error) {
+	key := m.Account + " "
+	if m.Authenticated {
+		key += m.Sender
+	}
+	if !r.limiter.Allow(key) {
+		return Discard, nil
+	}
+	return Accept, nil
+}
@@ -0,0 +1,371 @@
+// rules.go - rule engine filing messages into folders
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/storage"
+)
+
+// envelope is a message being sorted by the Rules
+type envelope struct {
+	header mail.Header
+	size   int
+}
+
+// test is a condition of a rule
+type test interface {
+	match(e *envelope) bool
+}
+
+// matchType is the way a test compares strings
+type matchType int
+
+const (
+	matchIs matchType = iota
+	matchContains
+	matchMatches
+)
+
+// compare compares the value to the key, case insensitively
+// as the Sieve i;ascii-casemap comparator does
+func (t matchType) compare(value, key string) bool {
+	value, key = strings.ToLower(value), strings.ToLower(key)
+	switch t {
+	case matchContains:
+		return strings.Contains(value, key)
+	case matchMatches:
+		return wildcardMatch(value, key)
+	default:
+		return value == key
+	}
+}
+
+// wildcardMatch returns true if the value matches the pattern,
+// where * matches any string and ? matches any character. The
+// stars match greedily, on a mismatch the last star extends it's
+// match by one character, so that the matching is linear in the
+// length of the value times that of the pattern at worst.
+func wildcardMatch(value, pattern string) bool {
+	v, p := 0, 0
+	star, mark := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, v
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			v++
+			p++
+		case star >= 0:
+			mark++
+			v, p = mark, star+1
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// headerTest matches the values of headers
+type headerTest struct {
+	comparison matchType
+	names      []string
+	keys       []string
+}
+
+func (t *headerTest) match(e *envelope) bool {
+	for _, name := range t.names {
+		for _, value := range e.header[textproto.CanonicalMIMEHeaderKey(name)] {
+			for _, key := range t.keys {
+				if t.comparison.compare(value, key) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// addressTest matches the addresses of address headers
+type addressTest struct {
+	comparison matchType
+	names      []string
+	keys       []string
+}
+
+func (t *addressTest) match(e *envelope) bool {
+	for _, name := range t.names {
+		addresses, err := e.header.AddressList(name)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			for _, key := range t.keys {
+				if t.comparison.compare(address.Address, key) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// existsTest matches if all the headers are present
+type existsTest struct {
+	names []string
+}
+
+func (t *existsTest) match(e *envelope) bool {
+	for _, name := range t.names {
+		if len(e.header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sizeTest matches the messages over or under a size
+type sizeTest struct {
+	over  bool
+	limit int
+}
+
+func (t *sizeTest) match(e *envelope) bool {
+	if t.over {
+		return e.size > t.limit
+	}
+	return e.size < t.limit
+}
+
+// constTest is the true or false test
+type constTest bool
+
+func (t constTest) match(e *envelope) bool {
+	return bool(t)
+}
+
+// notTest inverts a test
+type notTest struct {
+	test test
+}
+
+func (t *notTest) match(e *envelope) bool {
+	return !t.test.match(e)
+}
+
+// allOf matches if all the tests match
+type allOf []test
+
+func (t allOf) match(e *envelope) bool {
+	for _, test := range t {
+		if !test.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyOf matches if any of the tests match
+type anyOf []test
+
+func (t anyOf) match(e *envelope) bool {
+	for _, test := range t {
+		if test.match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// command is a command of the Rules, run returns
+// false if the evaluation stops
+type command interface {
+	run(e *envelope, d *storage.Disposition) bool
+}
+
+// branch is a test and the commands run if it matches
+type branch struct {
+	test     test
+	commands []command
+}
+
+// ifCommand runs the commands of the first matching
+// branch or otherwise the commands of the else block
+type ifCommand struct {
+	branches  []branch
+	otherwise []command
+}
+
+func (c *ifCommand) run(e *envelope, d *storage.Disposition) bool {
+	for _, b := range c.branches {
+		if b.test.match(e) {
+			return runCommands(b.commands, e, d)
+		}
+	}
+	return runCommands(c.otherwise, e, d)
+}
+
+// fileInto files the message into a folder
+type fileInto string
+
+func (c fileInto) run(e *envelope, d *storage.Disposition) bool {
+	d.Folder = string(c)
+	d.Discard = false
+	return true
+}
+
+// discard drops the message
+type discard struct{}
+
+func (discard) run(e *envelope, d *storage.Disposition) bool {
+	d.Discard = true
+	return true
+}
+
+// markSeen marks the message as read
+type markSeen struct{}
+
+func (markSeen) run(e *envelope, d *storage.Disposition) bool {
+	d.Seen = true
+	return true
+}
+
+// stop stops the evaluation
+type stop struct{}
+
+func (stop) run(e *envelope, d *storage.Disposition) bool {
+	return false
+}
+
+// runCommands runs the commands in order and
+// returns false if the evaluation stopped
+func runCommands(commands []command, e *envelope, d *storage.Disposition) bool {
+	for _, c := range commands {
+		if !c.run(e, d) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rules is a storage.Sorter filing the received messages into the
+// folders, marking them as read or discarding them. The messages
+// which no rule files elsewhere are kept in the INBOX, a message is
+// filed into the single folder chosen last.
+type Rules struct {
+	commands []command
+}
+
+// Sort returns the Disposition of the message
+func (r *Rules) Sort(accountName string, message []byte) *storage.Disposition {
+	d := storage.Disposition{Folder: storage.FolderInbox}
+	e := envelope{
+		header: mail.Header{},
+		size:   len(message),
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err == nil {
+		e.header = m.Header
+	}
+	runCommands(r.commands, &e, &d)
+	return &d
+}
+
+// folder returns the canonical name of the given folder
+func folder(name string) (string, error) {
+	for _, f := range storage.Folders {
+		if strings.EqualFold(f, name) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("no such folder %q", name)
+}
+
+// NewRules creates new Rules of the given configured rules, the
+// first matching rule applies
+func NewRules(rules []config.Rule) (*Rules, error) {
+	r := Rules{}
+	for i, rule := range rules {
+		conditions := allOf{}
+		if rule.Header != "" && rule.Contains != "" {
+			conditions = append(conditions, &headerTest{comparison: matchContains, names: []string{rule.Header}, keys: []string{rule.Contains}})
+		} else if rule.Header != "" {
+			conditions = append(conditions, &existsTest{names: []string{rule.Header}})
+		}
+		if rule.Sender != "" {
+			conditions = append(conditions, &addressTest{comparison: matchMatches, names: []string{"From"}, keys: []string{rule.Sender}})
+		}
+		if rule.LargerThan > 0 {
+			conditions = append(conditions, &sizeTest{over: true, limit: rule.LargerThan})
+		}
+		if rule.SmallerThan > 0 {
+			conditions = append(conditions, &sizeTest{limit: rule.SmallerThan})
+		}
+		if len(conditions) == 0 {
+			return nil, fmt.Errorf("rule %d: no condition", i)
+		}
+		actions := []command{}
+		if rule.Folder != "" {
+			f, err := folder(rule.Folder)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i, err)
+			}
+			actions = append(actions, fileInto(f))
+		}
+		if rule.MarkRead {
+			actions = append(actions, markSeen{})
+		}
+		if rule.Discard {
+			actions = append(actions, discard{})
+		}
+		actions = append(actions, stop{})
+		r.commands = append(r.commands, &ifCommand{
+			branches: []branch{{test: conditions, commands: actions}},
+		})
+	}
+	return &r, nil
+}
+
+// RulesFromConfig creates the configured Rules, nil if none
+func RulesFromConfig(cfg *config.MailFilter) (*Rules, error) {
+	if len(cfg.Rule) > 0 && cfg.Sieve != "" {
+		return nil, errors.New("rules and a Sieve script are mutually exclusive")
+	}
+	if len(cfg.Rule) > 0 {
+		return NewRules(cfg.Rule)
+	}
+	if cfg.Sieve == "" {
+		return nil, nil
+	}
+	script, err := ioutil.ReadFile(cfg.Sieve)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSieve(string(script))
+}
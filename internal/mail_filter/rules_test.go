@@ -0,0 +1,154 @@
+// rules_test.go - mail filtering rule tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// testMessages are messages sorted by the rule tests
+var testMessages = map[string]string{
+	"list":    "From: Gopher <gopher@lists.golang.org>\nList-Id: <golang-nuts.googlegroups.com>\nSubject: generics\n\nhi\n",
+	"spam":    "From: mallory@evil.com\nSubject: Cheap V1AGRA\n\nbuy\n",
+	"large":   "From: alice@acme.com\nSubject: pictures\n\n" + strings.Repeat("a", 2048) + "\n",
+	"regular": "From: alice@acme.com\nTo: bob@nsa.gov\nSubject: lunch?\n\nnoon\n",
+}
+
+// sortAll sorts the testMessages with the given Rules
+func sortAll(r *Rules) map[string]storage.Disposition {
+	dispositions := make(map[string]storage.Disposition)
+	for name, message := range testMessages {
+		dispositions[name] = *r.Sort("bob@nsa.gov", []byte(message))
+	}
+	return dispositions
+}
+
+func TestWildcardMatch(t *testing.T) {
+	require := require.New(t)
+
+	for _, c := range []struct {
+		value, pattern string
+		match          bool
+	}{
+		{"gopher@lists.golang.org", "*@lists.golang.org", true},
+		{"gopher@lists.golang.org", "*@golang.org", false},
+		{"bob", "b?b", true},
+		{"bob", "b?", false},
+		{"", "*", true},
+		{"abc", "a*c*", true},
+		{"abcbc", "a*bc", true},
+		{"a*b", "a?b", true},
+		{"ab", "a**b*", true},
+		{"ab", "a*?*?", false},
+		// the stars don't backtrack exponentially
+		{strings.Repeat("a", 100), strings.Repeat("*a", 50) + "b", false},
+	} {
+		require.Equal(c.match, wildcardMatch(c.value, c.pattern), "%q %q", c.value, c.pattern)
+	}
+}
+
+func TestNewRules(t *testing.T) {
+	require := require.New(t)
+
+	r, err := NewRules([]config.Rule{
+		{Header: "List-Id", Folder: "Trash", MarkRead: true},
+		{Header: "subject", Contains: "v1agra", Folder: "junk"},
+		{Sender: "*@evil.com", Discard: true},
+		{Sender: "*@acme.com", LargerThan: 1024, Folder: "Junk"},
+	})
+	require.NoError(err, "unexpected NewRules() error")
+	dispositions := sortAll(r)
+	require.Equal(storage.Disposition{Folder: storage.FolderTrash, Seen: true}, dispositions["list"])
+	require.Equal(storage.Disposition{Folder: storage.FolderJunk}, dispositions["spam"], "the first matching rule must apply")
+	require.Equal(storage.Disposition{Folder: storage.FolderJunk}, dispositions["large"])
+	require.Equal(storage.Disposition{Folder: storage.FolderInbox}, dispositions["regular"])
+
+	_, err = NewRules([]config.Rule{{Header: "List-Id", Folder: "Archive"}})
+	require.Error(err, "unknown folder not detected")
+}
+
+func TestParseSieve(t *testing.T) {
+	require := require.New(t)
+
+	r, err := ParseSieve(`require ["fileinto", "imap4flags"];
+# mailing lists are read on the web
+if exists "list-id" {
+	fileinto "Trash";
+	addflag "\\Seen";
+	stop;
+}
+/* spam */
+if anyof (header :contains "Subject" ["viagra", "v1agra"],
+          address :matches "from" "*@evil.com") {
+	discard;
+} elsif allof (size :over 1K, not address :is "from" "bob@nsa.gov") {
+	fileinto "Junk";
+} else {
+	keep;
+}
+`)
+	require.NoError(err, "unexpected ParseSieve() error")
+	dispositions := sortAll(r)
+	require.Equal(storage.Disposition{Folder: storage.FolderTrash, Seen: true}, dispositions["list"])
+	require.True(dispositions["spam"].Discard, "spam not discarded")
+	require.Equal(storage.Disposition{Folder: storage.FolderJunk}, dispositions["large"])
+	require.Equal(storage.Disposition{Folder: storage.FolderInbox}, dispositions["regular"])
+
+	for _, script := range []string{
+		`require "vacation";`,
+		`fileinto "Archive";`,
+		`addflag "\\Flagged";`,
+		`if true { keep; } else { keep; } else { keep; }`,
+		`elsif true { keep; }`,
+		`if size :between 1K { keep; }`,
+		`if header "subject" { keep; }`,
+		`keep`,
+		`if true { keep; `,
+		`fileinto "Junk`,
+		`redirect "alice@acme.com";`,
+		`keep { stop; }`,
+	} {
+		_, err = ParseSieve(script)
+		require.Error(err, "invalid script %q not detected", script)
+	}
+}
+
+func TestRulesFromConfig(t *testing.T) {
+	require := require.New(t)
+
+	r, err := RulesFromConfig(&config.MailFilter{})
+	require.NoError(err, "unexpected RulesFromConfig() error")
+	require.Nil(r)
+
+	dir, err := ioutil.TempDir("", "rules_test")
+	require.NoError(err, "unexpected TempDir() error")
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "mixclient.sieve")
+	err = ioutil.WriteFile(script, []byte(`if header :contains "subject" "lunch" { addflag "\\Seen"; }`), 0600)
+	require.NoError(err, "unexpected WriteFile() error")
+	r, err = RulesFromConfig(&config.MailFilter{Sieve: script})
+	require.NoError(err, "unexpected RulesFromConfig() error")
+	require.Equal(storage.Disposition{Folder: storage.FolderInbox, Seen: true}, sortAll(r)["regular"])
+}
@@ -0,0 +1,602 @@
+// sieve.go - Sieve subset parser
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mail_filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/katzenpost/client/storage"
+)
+
+// sieveExtensions are the Sieve extensions which may be required
+var sieveExtensions = map[string]bool{
+	"fileinto":   true,
+	"imap4flags": true,
+}
+
+// seenFlag is the only IMAP flag supported by the subset
+const seenFlag = `\seen`
+
+// token kinds of the Sieve lexer
+const (
+	tokenEOF = iota
+	tokenIdentifier
+	tokenTag
+	tokenString
+	tokenNumber
+	tokenSpecial
+)
+
+// token is a lexical token of a Sieve script
+type token struct {
+	kind  int
+	text  string
+	value int
+	line  int
+}
+
+// lexer splits a Sieve script into tokens
+type lexer struct {
+	script string
+	pos    int
+	line   int
+}
+
+// skip skips the white space and the comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.script) {
+		c := l.script[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.script) && l.script[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.script[l.pos:], "/*"):
+			end := strings.Index(l.script[l.pos+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("line %d: unterminated comment", l.line)
+			}
+			l.line += strings.Count(l.script[l.pos:l.pos+end+4], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// next returns the next token
+func (l *lexer) next() (*token, error) {
+	err := l.skip()
+	if err != nil {
+		return nil, err
+	}
+	if l.pos == len(l.script) {
+		return &token{kind: tokenEOF, line: l.line}, nil
+	}
+	start := l.pos
+	c := l.script[l.pos]
+	switch {
+	case c == '"':
+		return l.quoted()
+	case c == ':' || c == '_' || unicode.IsLetter(rune(c)):
+		l.pos++
+		for l.pos < len(l.script) && isIdentifierChar(l.script[l.pos]) {
+			l.pos++
+		}
+		text := strings.ToLower(l.script[start:l.pos])
+		if c == ':' {
+			if len(text) == 1 {
+				return nil, fmt.Errorf("line %d: empty tag", l.line)
+			}
+			return &token{kind: tokenTag, text: text, line: l.line}, nil
+		}
+		return &token{kind: tokenIdentifier, text: text, line: l.line}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.script) && l.script[l.pos] >= '0' && l.script[l.pos] <= '9' {
+			l.pos++
+		}
+		value, err := strconv.Atoi(l.script[start:l.pos])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid number", l.line)
+		}
+		if l.pos < len(l.script) {
+			switch unicode.ToUpper(rune(l.script[l.pos])) {
+			case 'K':
+				value <<= 10
+				l.pos++
+			case 'M':
+				value <<= 20
+				l.pos++
+			case 'G':
+				value <<= 30
+				l.pos++
+			}
+		}
+		return &token{kind: tokenNumber, value: value, line: l.line}, nil
+	case strings.IndexByte("[](){},;", c) >= 0:
+		l.pos++
+		return &token{kind: tokenSpecial, text: string(c), line: l.line}, nil
+	}
+	return nil, fmt.Errorf("line %d: unexpected character %q", l.line, c)
+}
+
+// quoted returns the quoted string token at the current position
+func (l *lexer) quoted() (*token, error) {
+	line := l.line
+	s := new(strings.Builder)
+	for l.pos++; l.pos < len(l.script); l.pos++ {
+		c := l.script[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return &token{kind: tokenString, text: s.String(), line: line}, nil
+		case '\\':
+			if l.pos+1 == len(l.script) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			l.pos++
+			c = l.script[l.pos]
+		case '\n':
+			l.line++
+		}
+		s.WriteByte(c)
+	}
+	return nil, fmt.Errorf("line %d: unterminated string", line)
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || unicode.IsLetter(rune(c))
+}
+
+// argument is an argument of a Sieve command or test,
+// a tag, a number or a string list
+type argument struct {
+	tag     string
+	number  int
+	strings []string
+	kind    int
+}
+
+// node is a Sieve command or test
+type node struct {
+	name      string
+	line      int
+	arguments []*argument
+	tests     []*node
+	block     []*node
+	hasBlock  bool
+}
+
+// parser parses a Sieve script into nodes
+type parser struct {
+	lexer *lexer
+	token *token
+}
+
+// advance reads the next token
+func (p *parser) advance() error {
+	t, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = t
+	return nil
+}
+
+// special returns true if the current token is the given special
+func (p *parser) special(s string) bool {
+	return p.token.kind == tokenSpecial && p.token.text == s
+}
+
+// expect consumes the given special
+func (p *parser) expect(s string) error {
+	if !p.special(s) {
+		return fmt.Errorf("line %d: expected %q", p.token.line, s)
+	}
+	return p.advance()
+}
+
+// stringList parses a string or a bracketed list of strings
+func (p *parser) stringList() ([]string, error) {
+	if p.token.kind == tokenString {
+		s := p.token.text
+		return []string{s}, p.advance()
+	}
+	err := p.expect("[")
+	if err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for {
+		if p.token.kind != tokenString {
+			return nil, fmt.Errorf("line %d: expected a string", p.token.line)
+		}
+		list = append(list, p.token.text)
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+		if p.special("]") {
+			return list, p.advance()
+		}
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// arguments parses the arguments and the tests of a command or test
+func (p *parser) arguments(n *node) error {
+	for {
+		switch {
+		case p.token.kind == tokenTag:
+			n.arguments = append(n.arguments, &argument{kind: tokenTag, tag: p.token.text})
+			err := p.advance()
+			if err != nil {
+				return err
+			}
+		case p.token.kind == tokenNumber:
+			n.arguments = append(n.arguments, &argument{kind: tokenNumber, number: p.token.value})
+			err := p.advance()
+			if err != nil {
+				return err
+			}
+		case p.token.kind == tokenString || p.special("["):
+			list, err := p.stringList()
+			if err != nil {
+				return err
+			}
+			n.arguments = append(n.arguments, &argument{kind: tokenString, strings: list})
+		case p.token.kind == tokenIdentifier:
+			t, err := p.test()
+			if err != nil {
+				return err
+			}
+			n.tests = []*node{t}
+			return nil
+		case p.special("("):
+			err := p.advance()
+			if err != nil {
+				return err
+			}
+			for {
+				t, err := p.test()
+				if err != nil {
+					return err
+				}
+				n.tests = append(n.tests, t)
+				if p.special(")") {
+					return p.advance()
+				}
+				err = p.expect(",")
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// test parses a test
+func (p *parser) test() (*node, error) {
+	if p.token.kind != tokenIdentifier {
+		return nil, fmt.Errorf("line %d: expected a test", p.token.line)
+	}
+	n := node{name: p.token.text, line: p.token.line}
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+	return &n, p.arguments(&n)
+}
+
+// commands parses commands up to the end of
+// the script or of the enclosing block
+func (p *parser) commands() ([]*node, error) {
+	nodes := []*node{}
+	for p.token.kind == tokenIdentifier {
+		n := node{name: p.token.text, line: p.token.line}
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		err = p.arguments(&n)
+		if err != nil {
+			return nil, err
+		}
+		if p.special("{") {
+			err = p.advance()
+			if err != nil {
+				return nil, err
+			}
+			n.block, err = p.commands()
+			if err != nil {
+				return nil, err
+			}
+			n.hasBlock = true
+			err = p.expect("}")
+		} else {
+			err = p.expect(";")
+		}
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, &n)
+	}
+	return nodes, nil
+}
+
+// ParseSieve parses a script in a subset of the Sieve language
+// (RFC 5228) into Rules. The subset supports the require, if,
+// elsif, else, keep, discard, stop, fileinto (RFC 5228) and
+// addflag and setflag commands with the \Seen flag (RFC 5232),
+// and the address, header, exists, size, not, allof, anyof, true
+// and false tests with the :is, :contains and :matches match types.
+// Strings are compared case insensitively.
+func ParseSieve(script string) (*Rules, error) {
+	p := parser{lexer: &lexer{script: script, line: 1}}
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEOF {
+		return nil, fmt.Errorf("line %d: expected a command", p.token.line)
+	}
+	commands, err := compileCommands(nodes)
+	if err != nil {
+		return nil, err
+	}
+	return &Rules{commands: commands}, nil
+}
+
+// compileCommands compiles the command nodes
+func compileCommands(nodes []*node) ([]command, error) {
+	commands := []command{}
+	var last *ifCommand
+	for _, n := range nodes {
+		if n.hasBlock != (n.name == "if" || n.name == "elsif" || n.name == "else") {
+			return nil, fmt.Errorf("line %d: unexpected block", n.line)
+		}
+		switch n.name {
+		case "require":
+			extensions, err := n.stringArgument()
+			if err != nil {
+				return nil, err
+			}
+			for _, extension := range extensions {
+				if !sieveExtensions[strings.ToLower(extension)] {
+					return nil, fmt.Errorf("line %d: unsupported extension %q", n.line, extension)
+				}
+			}
+			continue
+		case "if", "elsif":
+			t, err := compileTest(n)
+			if err != nil {
+				return nil, err
+			}
+			block, err := compileCommands(n.block)
+			if err != nil {
+				return nil, err
+			}
+			b := branch{test: t, commands: block}
+			if n.name == "if" {
+				last = &ifCommand{branches: []branch{b}}
+				commands = append(commands, last)
+				continue
+			}
+			if last == nil || last.otherwise != nil {
+				return nil, fmt.Errorf("line %d: elsif without if", n.line)
+			}
+			last.branches = append(last.branches, b)
+			continue
+		case "else":
+			if last == nil || last.otherwise != nil || len(n.arguments) > 0 || len(n.tests) > 0 {
+				return nil, fmt.Errorf("line %d: misplaced else", n.line)
+			}
+			block, err := compileCommands(n.block)
+			if err != nil {
+				return nil, err
+			}
+			last.otherwise = block
+			last = nil
+			continue
+		}
+		last = nil
+		c, err := compileAction(n)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+	return commands, nil
+}
+
+// compileAction compiles an action command node
+func compileAction(n *node) (command, error) {
+	if len(n.tests) > 0 {
+		return nil, fmt.Errorf("line %d: unexpected test", n.line)
+	}
+	switch n.name {
+	case "keep":
+		return fileInto(storage.FolderInbox), n.noArguments()
+	case "discard":
+		return discard{}, n.noArguments()
+	case "stop":
+		return stop{}, n.noArguments()
+	case "fileinto":
+		names, err := n.stringArgument()
+		if err != nil {
+			return nil, err
+		}
+		if len(names) != 1 {
+			return nil, fmt.Errorf("line %d: fileinto takes a single folder", n.line)
+		}
+		f, err := folder(names[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n.line, err)
+		}
+		return fileInto(f), nil
+	case "addflag", "setflag":
+		flags, err := n.stringArgument()
+		if err != nil {
+			return nil, err
+		}
+		for _, flag := range flags {
+			for _, f := range strings.Fields(flag) {
+				if strings.ToLower(f) != seenFlag {
+					return nil, fmt.Errorf("line %d: unsupported flag %q", n.line, f)
+				}
+			}
+		}
+		return markSeen{}, nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported command %q", n.line, n.name)
+}
+
+// compileTest compiles the single test of an if or elsif node
+func compileTest(n *node) (test, error) {
+	if len(n.tests) != 1 || len(n.arguments) > 0 {
+		return nil, fmt.Errorf("line %d: %s takes a single test", n.line, n.name)
+	}
+	return compileTestNode(n.tests[0])
+}
+
+// compileTests compiles the tests of a test list
+func compileTests(n *node) ([]test, error) {
+	if len(n.tests) == 0 || len(n.arguments) > 0 {
+		return nil, fmt.Errorf("line %d: %s takes a test list", n.line, n.name)
+	}
+	tests := []test{}
+	for _, t := range n.tests {
+		compiled, err := compileTestNode(t)
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, compiled)
+	}
+	return tests, nil
+}
+
+// compileTestNode compiles a test node
+func compileTestNode(n *node) (test, error) {
+	switch n.name {
+	case "true", "false":
+		if len(n.arguments) > 0 || len(n.tests) > 0 {
+			return nil, fmt.Errorf("line %d: %s takes no arguments", n.line, n.name)
+		}
+		return constTest(n.name == "true"), nil
+	case "not":
+		t, err := compileTest(n)
+		if err != nil {
+			return nil, err
+		}
+		return &notTest{test: t}, nil
+	case "allof":
+		tests, err := compileTests(n)
+		if err != nil {
+			return nil, err
+		}
+		return allOf(tests), nil
+	case "anyof":
+		tests, err := compileTests(n)
+		if err != nil {
+			return nil, err
+		}
+		return anyOf(tests), nil
+	}
+	if len(n.tests) > 0 {
+		return nil, fmt.Errorf("line %d: unexpected test", n.line)
+	}
+	switch n.name {
+	case "exists":
+		names, err := n.stringArgument()
+		if err != nil {
+			return nil, err
+		}
+		return &existsTest{names: names}, nil
+	case "size":
+		if len(n.arguments) != 2 || n.arguments[0].kind != tokenTag || n.arguments[1].kind != tokenNumber {
+			return nil, fmt.Errorf("line %d: size takes :over or :under and a number", n.line)
+		}
+		switch n.arguments[0].tag {
+		case ":over":
+			return &sizeTest{over: true, limit: n.arguments[1].number}, nil
+		case ":under":
+			return &sizeTest{limit: n.arguments[1].number}, nil
+		}
+		return nil, fmt.Errorf("line %d: size takes :over or :under", n.line)
+	case "header", "address":
+		comparison := matchIs
+		lists := [][]string{}
+		for _, a := range n.arguments {
+			switch {
+			case a.kind == tokenString:
+				lists = append(lists, a.strings)
+			case a.tag == ":is":
+				comparison = matchIs
+			case a.tag == ":contains":
+				comparison = matchContains
+			case a.tag == ":matches":
+				comparison = matchMatches
+			case a.tag == ":all" && n.name == "address":
+			default:
+				return nil, fmt.Errorf("line %d: unsupported argument of %s", n.line, n.name)
+			}
+		}
+		if len(lists) != 2 {
+			return nil, fmt.Errorf("line %d: %s takes header names and keys", n.line, n.name)
+		}
+		if n.name == "address" {
+			return &addressTest{comparison: comparison, names: lists[0], keys: lists[1]}, nil
+		}
+		return &headerTest{comparison: comparison, names: lists[0], keys: lists[1]}, nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported test %q", n.line, n.name)
+}
+
+// noArguments returns an error if the node has arguments
+func (n *node) noArguments() error {
+	if len(n.arguments) > 0 || len(n.tests) > 0 {
+		return fmt.Errorf("line %d: %s takes no arguments", n.line, n.name)
+	}
+	return nil
+}
+
+// stringArgument returns the strings of the single
+// string list argument of the node
+func (n *node) stringArgument() ([]string, error) {
+	if len(n.arguments) != 1 || n.arguments[0].kind != tokenString || len(n.tests) > 0 {
+		return nil, fmt.Errorf("line %d: %s takes a string list", n.line, n.name)
+	}
+	return n.arguments[0].strings, nil
+}
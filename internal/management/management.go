@@ -0,0 +1,232 @@
+// management.go - management socket
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package management serves the management socket, a unix domain
+// socket over which the running client is reconfigured. A command
+// is one line of space separated words, the command name followed
+// by it's arguments, and it's answered with one line, "OK" followed
+// by the result or "ERR" followed by the error. A connection may
+// carry any number of commands. The socket is created accessible
+// to it's owner only, anyone able to connect controls the client.
+package management
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// maxLineLength is the maximum length of a command line
+const maxLineLength = 4096
+
+// ErrUsage is the error returned by a Handler
+// given the wrong number of arguments
+var ErrUsage = errors.New("wrong number of arguments")
+
+// Handler handles a command given it's arguments
+// and returns the result or an error
+type Handler func(args []string) (string, error)
+
+// Server serves the management commands
+type Server struct {
+	sync.Mutex
+	sync.WaitGroup
+
+	handlers map[string]Handler
+	listener net.Listener
+	conns    map[net.Conn]bool
+}
+
+// New creates a new Server without any command
+// but "help" which lists the available commands
+func New() *Server {
+	s := Server{
+		handlers: make(map[string]Handler),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.handlers["help"] = s.help
+	return &s
+}
+
+// Handle registers the Handler of the given command
+func (s *Server) Handle(command string, h Handler) {
+	s.Lock()
+	defer s.Unlock()
+	s.handlers[command] = h
+}
+
+// help lists the available commands
+func (s *Server) help(args []string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	commands := []string{}
+	for command := range s.handlers {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return strings.Join(commands, " "), nil
+}
+
+// Listen creates the management socket at the given path,
+// replacing the stale socket of a previous run. The socket is created
+// in a directory only accessible to it's owner and moved into place
+// once it's permissions are restricted, so that nobody else can
+// connect in between.
+func Listen(path string) (net.Listener, error) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".management")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tempPath := filepath.Join(dir, "socket")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tempPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed from it's final path by socketListener
+	l.SetUnlinkOnClose(false)
+	err = os.Chmod(tempPath, 0600)
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &socketListener{UnixListener: l, path: path}, nil
+}
+
+// socketListener is the listener of the management
+// socket, which is removed once the listener is closed
+type socketListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Close closes the listener and removes the socket
+func (l *socketListener) Close() error {
+	err := l.UnixListener.Close()
+	removeErr := os.Remove(l.path)
+	if err == nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
+	return err
+}
+
+// Serve accepts the connections of the given listener until Halt
+func (s *Server) Serve(l net.Listener) {
+	s.Lock()
+	s.listener = l
+	s.Unlock()
+	s.Add(1)
+	go func() {
+		defer s.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			if s.listener == nil {
+				s.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = true
+			s.Unlock()
+			s.Add(1)
+			go func() {
+				defer s.Done()
+				s.handleConnection(conn)
+			}()
+		}
+	}()
+}
+
+// Halt stops accepting connections, closes the open
+// ones and waits for the commands in progress
+func (s *Server) Halt() error {
+	s.Lock()
+	l := s.listener
+	s.listener = nil
+	s.Unlock()
+	if l == nil {
+		return nil
+	}
+	err := l.Close()
+	s.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.Unlock()
+	s.Wait()
+	return err
+}
+
+// handleConnection handles the commands of the given connection
+func (s *Server) handleConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, maxLineLength), maxLineLength)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		result, err := s.execute(fields[0], fields[1:])
+		if err != nil {
+			_, err = fmt.Fprintf(conn, "ERR %s\n", err)
+		} else {
+			_, err = fmt.Fprintf(conn, "OK %s\n", result)
+		}
+		if err != nil {
+			log.Debugf("management: failed to write response: %s", err)
+			return
+		}
+	}
+}
+
+// execute runs the Handler of the given command
+func (s *Server) execute(command string, args []string) (string, error) {
+	s.Lock()
+	h, ok := s.handlers[command]
+	s.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown command %s", command)
+	}
+	log.Debugf("management: %s %s", command, strings.Join(args, " "))
+	return h(args)
+}
@@ -0,0 +1,146 @@
+// management_test.go - management socket tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/stretchr/testify/require"
+)
+
+type testSwitcher map[string]*config.TrafficProfile
+
+func (s testSwitcher) SetTrafficProfile(sender string, profile *config.TrafficProfile) error {
+	if _, ok := s[sender]; !ok {
+		return fmt.Errorf("unknown sender")
+	}
+	s[sender] = profile
+	return nil
+}
+
+func (s testSwitcher) TrafficProfile(sender string) *config.TrafficProfile {
+	return s[sender]
+}
+
+func TestManagementSocket(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "management")
+	require.NoError(err, "TempDir failed")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "management.sock")
+
+	cfg := config.Config{}
+	switcher := testSwitcher{"alice@acme.com": nil}
+	s := New()
+	s.Handle(TrafficProfileCommand, TrafficProfileHandler(cfg.TrafficProfiles(), switcher))
+	l, err := Listen(path)
+	require.NoError(err, "Listen failed")
+	s.Serve(l)
+	defer s.Halt()
+
+	info, err := os.Stat(path)
+	require.NoError(err, "Stat failed")
+	require.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(err, "Dial failed")
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command := func(line string) string {
+		_, err := fmt.Fprintf(conn, "%s\n", line)
+		require.NoError(err, "Fprintf failed")
+		response, err := reader.ReadString('\n')
+		require.NoError(err, "ReadString failed")
+		return response
+	}
+
+	require.Equal("OK help traffic-profile\n", command("help"))
+	require.Equal("OK none\n", command("traffic-profile alice@acme.com"))
+	require.Equal("OK paranoid\n", command("traffic-profile alice@acme.com paranoid"))
+	require.Equal(config.ParanoidProfile, switcher["alice@acme.com"].Name)
+	require.Equal("OK paranoid\n", command("traffic-profile alice@acme.com"))
+	require.Equal("OK none\n", command("traffic-profile alice@acme.com none"))
+	require.Nil(switcher["alice@acme.com"])
+
+	require.Equal("ERR unknown traffic profile fast\n", command("traffic-profile alice@acme.com fast"))
+	require.Equal("ERR unknown sender\n", command("traffic-profile bob@acme.com paranoid"))
+	require.Equal("ERR wrong number of arguments\n", command("traffic-profile"))
+	require.Equal("ERR unknown command reboot\n", command("reboot"))
+
+	// a stale socket is replaced
+	require.NoError(s.Halt(), "Halt failed")
+	l, err = Listen(path)
+	require.NoError(err, "Listen failed")
+	require.NoError(l.Close(), "Close failed")
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(err, "ReadDir failed")
+	require.Len(entries, 0, "the socket or it's temporary directory was left behind")
+}
+
+type testWiper chan struct{}
+
+func (w testWiper) Wipe() error {
+	close(w)
+	return nil
+}
+
+func TestWipeHandler(t *testing.T) {
+	require := require.New(t)
+
+	w := make(testWiper)
+	h := WipeHandler(w)
+	_, err := h(nil)
+	require.Equal(ErrUsage, err)
+	_, err = h([]string{"yes"})
+	require.Error(err, "wipe run without confirmation")
+
+	result, err := h([]string{WipeConfirmation})
+	require.NoError(err, "wipe failed")
+	require.Equal("wiping", result)
+	<-w
+}
+
+type testRemover []string
+
+func (r *testRemover) RemoveAccount(account string) error {
+	*r = append(*r, account)
+	return nil
+}
+
+func TestRemoveAccountHandler(t *testing.T) {
+	require := require.New(t)
+
+	r := &testRemover{}
+	h := RemoveAccountHandler(r)
+	_, err := h([]string{"alice@acme.com"})
+	require.Equal(ErrUsage, err)
+	_, err = h([]string{"alice@acme.com", "bob@nsa.gov"})
+	require.Error(err, "removal run without confirmation")
+
+	result, err := h([]string{"alice@acme.com", "alice@acme.com"})
+	require.NoError(err, "removal failed")
+	require.Equal("removed alice@acme.com", result)
+	require.Equal([]string{"alice@acme.com"}, []string(*r))
+}
@@ -0,0 +1,52 @@
+// remove_account.go - the remove account command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"errors"
+)
+
+// RemoveAccountCommand is the name of the command which removes an
+// account from the running client and destroys it's local data, see
+// package account_removal. The account must be given twice so that
+// it isn't removed by accident:
+//
+//	remove-account <account> <account>
+const RemoveAccountCommand = "remove-account"
+
+// AccountRemover removes the accounts of the client,
+// it's implemented by account_removal.Remover
+type AccountRemover interface {
+	RemoveAccount(account string) error
+}
+
+// RemoveAccountHandler returns the Handler of RemoveAccountCommand
+func RemoveAccountHandler(r AccountRemover) Handler {
+	return func(args []string) (string, error) {
+		if len(args) != 2 {
+			return "", ErrUsage
+		}
+		if args[0] != args[1] {
+			return "", errors.New("account removal not confirmed")
+		}
+		err := r.RemoveAccount(args[0])
+		if err != nil {
+			return "", err
+		}
+		return "removed " + args[0], nil
+	}
+}
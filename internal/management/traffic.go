@@ -0,0 +1,71 @@
+// traffic.go - traffic profile management command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"fmt"
+
+	"github.com/katzenpost/client/config"
+)
+
+// TrafficProfileCommand is the name of the command which shows or
+// switches the traffic profile of an account:
+//
+//	traffic-profile <account>
+//	traffic-profile <account> <profile>
+const TrafficProfileCommand = "traffic-profile"
+
+// noProfile is the result shown for an account without a profile
+const noProfile = "none"
+
+// ProfileSwitcher switches the traffic profiles of the accounts,
+// it's implemented by proxy.SendScheduler
+type ProfileSwitcher interface {
+	SetTrafficProfile(sender string, profile *config.TrafficProfile) error
+	TrafficProfile(sender string) *config.TrafficProfile
+}
+
+// TrafficProfileHandler returns the Handler of TrafficProfileCommand
+// given the available profiles, see config.Config.TrafficProfiles
+func TrafficProfileHandler(profiles map[string]*config.TrafficProfile, switcher ProfileSwitcher) Handler {
+	return func(args []string) (string, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return "", ErrUsage
+		}
+		account := args[0]
+		if len(args) == 1 {
+			profile := switcher.TrafficProfile(account)
+			if profile == nil {
+				return noProfile, nil
+			}
+			return profile.Name, nil
+		}
+		var profile *config.TrafficProfile
+		if args[1] != noProfile {
+			var ok bool
+			profile, ok = profiles[args[1]]
+			if !ok {
+				return "", fmt.Errorf("unknown traffic profile %s", args[1])
+			}
+		}
+		err := switcher.SetTrafficProfile(account, profile)
+		if err != nil {
+			return "", err
+		}
+		return args[1], nil
+	}
+}
@@ -0,0 +1,53 @@
+// wipe.go - emergency wipe command
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"errors"
+)
+
+// WipeCommand is the name of the command which destroys the local
+// data of the client and exits, see package wipe. It must be given
+// WipeConfirmation so that it isn't run by accident:
+//
+//	wipe destroy-everything
+const WipeCommand = "wipe"
+
+// WipeConfirmation is the required argument of WipeCommand
+const WipeConfirmation = "destroy-everything"
+
+// Wiper destroys the local data of the client,
+// it's implemented by wipe.Wiper
+type Wiper interface {
+	Wipe() error
+}
+
+// WipeHandler returns the Handler of WipeCommand. The wipe is run
+// in the background since it halts the Server, the command is
+// answered before the connection is closed.
+func WipeHandler(w Wiper) Handler {
+	return func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", ErrUsage
+		}
+		if args[0] != WipeConfirmation {
+			return "", errors.New("wipe not confirmed")
+		}
+		go w.Wipe()
+		return "wiping", nil
+	}
+}
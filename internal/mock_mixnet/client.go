@@ -0,0 +1,281 @@
+// client.go - full client connected to the mock mixnet
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mock_mixnet
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/internal/proxy"
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/wire"
+)
+
+// proxyPassword is the SMTP and POP3 proxy password of the Clients
+const proxyPassword = "any_password"
+
+// Client is a full client of a single account connected to
+// it's Provider in a Mixnet, messages are submitted with Send
+// and read back with Retrieve after being fetched with Fetch
+type Client struct {
+	Identity  string
+	Key       *ecdh.PrivateKey
+	Store     *storage.Store
+	Pool      *session_pool.SessionPool
+	Sender    *proxy.Sender
+	Scheduler *proxy.SendScheduler
+	Fetcher   *proxy.Fetcher
+	Submit    *proxy.SubmitProxy
+	POP3      *proxy.Pop3Service
+
+	session *Session
+}
+
+// NewClient creates a new Client of the given account whose
+// state is stored in dbFile, it's identity key is published
+// in the user PKI of the Mixnet
+func (m *Mixnet) NewClient(identity, dbFile string) (*Client, error) {
+	identity = strings.ToLower(identity)
+	key, err := ecdh.NewKeypair(entropy.Reader)
+	if err != nil {
+		return nil, err
+	}
+	session, err := m.Session(identity)
+	if err != nil {
+		return nil, err
+	}
+	m.Register(identity, key.PublicKey())
+	pool := &session_pool.SessionPool{
+		Sessions: make(map[string]wire.SessionInterface),
+		Locks:    make(map[string]*sync.Mutex),
+	}
+	pool.Add(identity, session)
+	store, err := storage.New(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	err = store.CreateAccountBuckets([]string{identity})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	handler := block.NewHandler(key, entropy.Reader)
+	m.Lock()
+	lambda := m.lambda
+	m.Unlock()
+	routeFactory := path_selection.New(m.PKI(), Hops, lambda)
+	sender, err := proxy.NewSender(identity, pool, store, routeFactory, m, handler)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	scheduler := proxy.NewSendScheduler(map[string]*proxy.Sender{
+		identity: sender,
+	})
+	accounts := config.AccountsMap(map[string]*ecdh.PrivateKey{
+		identity: key,
+	})
+	c := Client{
+		Identity:  identity,
+		Key:       key,
+		Store:     store,
+		Pool:      pool,
+		Sender:    sender,
+		Scheduler: scheduler,
+		Fetcher:   proxy.NewFetcher(identity, pool, store, scheduler, handler),
+		Submit:    proxy.NewSmtpProxy(&accounts, entropy.Reader, m, store, pool, routeFactory, scheduler),
+		POP3:      proxy.NewPop3Service(store),
+		session:   session,
+	}
+	c.Submit.SetPasswords(map[string]string{identity: proxyPassword})
+	c.POP3.SetPasswords(map[string]string{identity: proxyPassword})
+	return &c, nil
+}
+
+// Close closes the Store of the Client
+func (c *Client) Close() error {
+	return c.Store.Close()
+}
+
+// expect reads the reply to the previous SMTP command
+// and fails unless it has the given code
+func expect(conn *textproto.Conn, code int) error {
+	_, _, err := conn.ReadResponse(code)
+	return err
+}
+
+// Send submits the given message to the given recipient over
+// SMTP, the message must include it's header. It returns once the
+// message is queued, or the error of the submission.
+func (c *Client) Send(recipient, message string) error {
+	serverConn, clientConn := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		errCh <- c.Submit.HandleSMTPSubmission(serverConn)
+	}()
+	err := func() error {
+		conn := textproto.NewConn(clientConn)
+		defer conn.Close()
+		err := expect(conn, 220)
+		if err != nil {
+			return err
+		}
+		dialog := []struct {
+			command string
+			code    int
+		}{
+			{"EHLO localhost", 250},
+			{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+c.Identity+"\x00"+proxyPassword)), 235},
+			{fmt.Sprintf("MAIL FROM:<%s>", c.Identity), 250},
+			{fmt.Sprintf("RCPT TO:<%s>", recipient), 250},
+			{"DATA", 354},
+		}
+		for _, step := range dialog {
+			err = conn.PrintfLine("%s", step.command)
+			if err != nil {
+				return err
+			}
+			err = expect(conn, step.code)
+			if err != nil {
+				return err
+			}
+		}
+		w := conn.DotWriter()
+		_, err = w.Write([]byte(message))
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	}()
+	if err != nil {
+		clientConn.Close()
+		<-errCh
+		return err
+	}
+	// the proxy doesn't reply to the end of the data
+	// until it's done with the message
+	err = <-errCh
+	clientConn.Close()
+	return err
+}
+
+// Fetch retrieves the messages and ACKs queued
+// for the Client by it's Provider
+func (c *Client) Fetch() error {
+	for c.session.Queued() > 0 {
+		_, err := c.Fetcher.Fetch()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retrieve returns the messages of the Client's mailbox,
+// read over POP3, without deleting them
+func (c *Client) Retrieve() ([]string, error) {
+	serverConn, clientConn := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.POP3.HandleConnection(serverConn)
+	}()
+	messages, err := func() ([]string, error) {
+		conn := textproto.NewConn(clientConn)
+		defer conn.Close()
+		dialog := []string{
+			"",
+			fmt.Sprintf("USER %s", c.Identity),
+			fmt.Sprintf("PASS %s", proxyPassword),
+		}
+		for _, command := range dialog {
+			if command != "" {
+				err := conn.PrintfLine("%s", command)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err := expectOK(conn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err := conn.PrintfLine("STAT")
+		if err != nil {
+			return nil, err
+		}
+		line, err := conn.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		_, err = fmt.Sscanf(line, "+OK %d", &count)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected STAT response: %s", line)
+		}
+		messages := []string{}
+		for i := 1; i <= count; i++ {
+			err = conn.PrintfLine("RETR %d", i)
+			if err != nil {
+				return nil, err
+			}
+			err = expectOK(conn)
+			if err != nil {
+				return nil, err
+			}
+			message, err := ioutil.ReadAll(conn.DotReader())
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, string(message))
+		}
+		err = conn.PrintfLine("QUIT")
+		if err != nil {
+			return nil, err
+		}
+		return messages, nil
+	}()
+	clientConn.Close()
+	popErr := <-errCh
+	if err != nil {
+		return nil, err
+	}
+	return messages, popErr
+}
+
+// expectOK reads a POP3 response and fails unless it's positive
+func expectOK(conn *textproto.Conn) error {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("unexpected POP3 response: %s", line)
+	}
+	return nil
+}
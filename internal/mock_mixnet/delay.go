@@ -0,0 +1,52 @@
+// delay.go - network delay distributions
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mock_mixnet
+
+import (
+	mathrand "math/rand"
+	"time"
+)
+
+// Delay returns the duration a packet takes to cross the network
+// drawn from the given random source, see Mixnet.SetDelay
+type Delay func(rng *mathrand.Rand) time.Duration
+
+// ConstantDelay returns a Delay which always is the given duration
+func ConstantDelay(d time.Duration) Delay {
+	return func(*mathrand.Rand) time.Duration {
+		return d
+	}
+}
+
+// UniformDelay returns a Delay uniformly
+// distributed between min and max
+func UniformDelay(min, max time.Duration) Delay {
+	return func(rng *mathrand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rng.Int63n(int64(max-min)))
+	}
+}
+
+// ExponentialDelay returns a Delay exponentially distributed
+// with the given mean, as that of the Poisson mix strategy
+func ExponentialDelay(mean time.Duration) Delay {
+	return func(rng *mathrand.Rand) time.Duration {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+}
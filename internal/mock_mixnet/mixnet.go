@@ -0,0 +1,372 @@
+// mixnet.go - in-process mock of the mix network
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package mock_mixnet provides an in-process mock of the mix network
+// whose Providers speak the client side of the wire protocol, so that
+// the full path of a message, from SMTP submission through the Sphinx
+// hops and the SURB ACK back to POP3 retrieval, can be tested without
+// standing up a real mix network. See Mixnet.NewClient.
+package mock_mixnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/mix_pki"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx"
+	sphinxcommands "github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/utils"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+const (
+	// layers is the number of mix layers
+	layers = 3
+
+	// mixesPerLayer is the number of mixes of each layer
+	mixesPerLayer = 2
+
+	// epochs is the number of epochs following
+	// the current one the PKI has documents of
+	epochs = 3
+
+	// Hops is the number of hops of the routes: the
+	// Provider of the sender, a mix of each layer
+	// and the Provider of the recipient
+	Hops = layers + 2
+
+	// Lambda is the default inverse of the mean per hop delay
+	// in milliseconds, the mock mixes delay the packets by the
+	// hop delays on the clock of the Mixnet, see SetClock
+	Lambda = 0.123
+)
+
+// Mixnet is an in-process mock of the mix network: each packet
+// sent by a client is unwrapped hop by hop with the mix keys of the
+// PKI it publishes, and queued for retrieval by the recipient at
+// the terminal Provider which sends the ACK back with it's SURB.
+// Packets are delayed at each hop and may be dropped and delayed
+// further to simulate a lossy network.
+type Mixnet struct {
+	sync.Mutex
+
+	pki       *mix_pki.StaticPKI
+	keys      map[[constants.NodeIDLength]byte]*ecdh.PrivateKey
+	owners    map[[constants.NodeIDLength]byte]string
+	providers map[string]*Provider
+	users     map[string]*ecdh.PublicKey
+	loss      float64
+	delay     Delay
+	lambda    float64
+	clock     clock.Clock
+	rng       *mathrand.Rand
+	wg        sync.WaitGroup
+}
+
+// New creates a new Mixnet with the given Providers
+func New(providers ...string) (*Mixnet, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("a mixnet needs at least one Provider")
+	}
+	m := Mixnet{
+		pki:       mix_pki.NewStaticPKI(),
+		keys:      make(map[[constants.NodeIDLength]byte]*ecdh.PrivateKey),
+		owners:    make(map[[constants.NodeIDLength]byte]string),
+		providers: make(map[string]*Provider),
+		users:     make(map[string]*ecdh.PublicKey),
+		lambda:    Lambda,
+		clock:     clock.Real,
+		rng:       entropy.NewMath(),
+	}
+	startEpoch, _, _ := epochtime.Now()
+	descriptors := []*pki.MixDescriptor{}
+	for _, name := range providers {
+		name = strings.ToLower(name)
+		descriptor, err := m.newDescriptor(name, 0, startEpoch)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, descriptor)
+		m.providers[name] = newProvider(name, &m)
+	}
+	for layer := 1; layer <= layers; layer++ {
+		for i := 0; i < mixesPerLayer; i++ {
+			descriptor, err := m.newDescriptor(fmt.Sprintf("mix%d-%d", layer, i), uint8(layer), startEpoch)
+			if err != nil {
+				return nil, err
+			}
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+	for epoch := startEpoch; epoch <= startEpoch+epochs; epoch++ {
+		doc := pki.Document{
+			Epoch:    epoch,
+			Topology: make([][]*pki.MixDescriptor, layers+1),
+		}
+		for _, descriptor := range descriptors {
+			if descriptor.Layer == 0 {
+				doc.Providers = append(doc.Providers, descriptor)
+			} else {
+				doc.Topology[descriptor.Layer] = append(doc.Topology[descriptor.Layer], descriptor)
+			}
+		}
+		err := m.pki.Set(epoch, &doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// newDescriptor creates the descriptor of a mix or Provider, if layer
+// is zero, whose mix keys of each epoch are used to unwrap the packets
+func (m *Mixnet) newDescriptor(name string, layer uint8, startEpoch uint64) (*pki.MixDescriptor, error) {
+	linkKey, err := ecdh.NewKeypair(entropy.Reader)
+	if err != nil {
+		return nil, err
+	}
+	descriptor := pki.MixDescriptor{
+		Name:    name,
+		LinkKey: linkKey.PublicKey(),
+		MixKeys: make(map[uint64]*ecdh.PublicKey),
+		Layer:   layer,
+	}
+	for epoch := startEpoch; epoch <= startEpoch+epochs; epoch++ {
+		mixKey, err := ecdh.NewKeypair(entropy.Reader)
+		if err != nil {
+			return nil, err
+		}
+		descriptor.MixKeys[epoch] = mixKey.PublicKey()
+		id := [constants.NodeIDLength]byte{}
+		copy(id[:], mixKey.PublicKey().Bytes())
+		m.keys[id] = mixKey
+		if layer == 0 {
+			m.owners[id] = name
+		}
+	}
+	return &descriptor, nil
+}
+
+// PKI returns the mix PKI of the Mixnet
+func (m *Mixnet) PKI() pki.Client {
+	return m.pki
+}
+
+// Register publishes the given identity key of a
+// user in the user PKI implemented by the Mixnet
+func (m *Mixnet) Register(email string, key *ecdh.PublicKey) {
+	m.Lock()
+	defer m.Unlock()
+	m.users[strings.ToLower(email)] = key
+}
+
+// GetKey returns the identity key of the given
+// user, the Mixnet implements user_pki.UserPKI
+func (m *Mixnet) GetKey(email string) (*ecdh.PublicKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	key, ok := m.users[strings.ToLower(email)]
+	if !ok {
+		return nil, fmt.Errorf("mock mixnet: user %s not found", email)
+	}
+	return key, nil
+}
+
+// Provider returns the Provider of the given name or nil
+func (m *Mixnet) Provider(name string) *Provider {
+	return m.providers[strings.ToLower(name)]
+}
+
+// SetLoss sets the probability of each packet, including
+// the ACKs, to be dropped by the network
+func (m *Mixnet) SetLoss(loss float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.loss = loss
+}
+
+// SetLatency sets the duration each packet,
+// including the ACKs, takes to cross the network
+func (m *Mixnet) SetLatency(latency time.Duration) {
+	m.SetDelay(ConstantDelay(latency))
+}
+
+// SetDelay sets the distribution of the durations the
+// packets, including the ACKs, take to cross the network
+func (m *Mixnet) SetDelay(delay Delay) {
+	m.Lock()
+	defer m.Unlock()
+	m.delay = delay
+}
+
+// SetLambda sets the inverse of the mean per hop delay in
+// milliseconds of the routes of the Clients created afterwards
+func (m *Mixnet) SetLambda(lambda float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.lambda = lambda
+}
+
+// SetClock sets the Clock delaying the packets by their network and
+// hop delays, e.g. a clock.Fake driving a simulation, it must be set
+// before any packet is sent
+func (m *Mixnet) SetClock(c clock.Clock) {
+	m.Lock()
+	defer m.Unlock()
+	m.clock = c
+}
+
+// Wait waits for the delayed packets to be delivered,
+// it must not be called while a clock.Fake is set
+func (m *Mixnet) Wait() {
+	m.wg.Wait()
+}
+
+// send injects the given packet sent on behalf of the given user,
+// it's then dropped or unwrapped and delivered once the network
+// delay and the delays of it's hops elapsed on the clock
+func (m *Mixnet) send(packet []byte, origin string) {
+	m.Lock()
+	lost := m.loss > 0 && m.rng.Float64() < m.loss
+	latency := time.Duration(0)
+	if m.delay != nil {
+		latency = m.delay(m.rng)
+	}
+	c := m.clock
+	m.Unlock()
+	if lost {
+		log.Debugf("mock mixnet: dropping a packet of %s", origin)
+		return
+	}
+	deliver, hopDelays := m.forward(append([]byte{}, packet...), origin)
+	if deliver == nil {
+		return
+	}
+	latency += hopDelays
+	if latency == 0 {
+		deliver()
+		return
+	}
+	m.wg.Add(1)
+	c.AfterFunc(latency, func() {
+		defer m.wg.Done()
+		deliver()
+	})
+}
+
+// firstHop returns the mix key the given packet was
+// composed for, trying each key of the network in turn
+func (m *Mixnet) firstHop(packet []byte) [constants.NodeIDLength]byte {
+	for id, key := range m.keys {
+		// a failed Unwrap leaves the packet untouched
+		probe := append([]byte{}, packet...)
+		_, _, _, err := sphinx.Unwrap(key, probe)
+		if err == nil {
+			return id
+		}
+	}
+	return [constants.NodeIDLength]byte{}
+}
+
+// forward unwraps the given packet at each hop and returns the sum
+// of the hop delays and the function handing it over to the Provider
+// of the terminal hop, or nil if the packet can't be delivered
+func (m *Mixnet) forward(packet []byte, origin string) (func(), time.Duration) {
+	id := m.firstHop(packet)
+	hopDelays := time.Duration(0)
+	for {
+		key, ok := m.keys[id]
+		if !ok {
+			log.Errorf("mock mixnet: packet of %s routed to unknown node %x", origin, id)
+			return nil, 0
+		}
+		payload, _, cmds, err := sphinx.Unwrap(key, packet)
+		if err != nil {
+			log.Errorf("mock mixnet: failed to unwrap a packet of %s: %s", origin, err)
+			return nil, 0
+		}
+		var next *sphinxcommands.NextNodeHop
+		var recipient *sphinxcommands.Recipient
+		var surbReply *sphinxcommands.SURBReply
+		for _, cmd := range cmds {
+			switch c := cmd.(type) {
+			case *sphinxcommands.NextNodeHop:
+				next = c
+			case *sphinxcommands.NodeDelay:
+				hopDelays += time.Duration(c.Delay) * time.Millisecond
+			case *sphinxcommands.Recipient:
+				recipient = c
+			case *sphinxcommands.SURBReply:
+				surbReply = c
+			}
+		}
+		if next != nil {
+			id = next.ID
+			continue
+		}
+		provider, ok := m.providers[m.owners[id]]
+		if !ok {
+			log.Errorf("mock mixnet: packet of %s terminates at a mix", origin)
+			return nil, 0
+		}
+		switch {
+		case surbReply != nil:
+			return func() {
+				provider.deliverReply(surbReply.ID, payload, origin)
+			}, hopDelays
+		case recipient != nil:
+			user := string(bytes.TrimRight(recipient.ID[:], "\x00"))
+			return func() {
+				provider.deliver(user, payload, origin)
+			}, hopDelays
+		}
+		log.Errorf("mock mixnet: packet of %s has no recipient", origin)
+		return nil, 0
+	}
+}
+
+// ack sends the ACK of a packet received by the
+// recipient with the SURB the packet carries
+func (m *Mixnet) ack(surb []byte, length int, origin string) {
+	if utils.CtIsZero(surb) {
+		return
+	}
+	packet, _, err := sphinx.NewPacketFromSURB(surb, make([]byte, length))
+	if err != nil {
+		log.Errorf("mock mixnet: failed to compose the ACK to %s: %s", origin, err)
+		return
+	}
+	m.send(packet, origin)
+}
+
+// errUnknownProvider returns the error of
+// a Provider missing from the Mixnet
+func errUnknownProvider(name string) error {
+	return fmt.Errorf("mock mixnet: unknown Provider %s", name)
+}
@@ -0,0 +1,183 @@
+// mixnet_test.go - mock mixnet tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mock_mixnet
+
+import (
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	aliceEmail = "alice@acme.com"
+	bobEmail   = "bob@nsa.gov"
+)
+
+func newTestClient(require *require.Assertions, m *Mixnet, identity string) *Client {
+	dbFile, err := ioutil.TempFile("", "mock_mixnet_test")
+	require.NoError(err, "unexpected TempFile error")
+	dbFile.Close()
+	os.Remove(dbFile.Name())
+	c, err := m.NewClient(identity, dbFile.Name())
+	require.NoError(err, "unexpected NewClient error")
+	return c
+}
+
+// queueBlock sends the given short message in a
+// single Block, bypassing the SMTP proxy
+func queueBlock(require *require.Assertions, c *Client, recipient, message string) {
+	b := block.Block{
+		TotalBlocks: 1,
+		Block:       []byte(message),
+	}
+	_, err := io.ReadFull(rand.Reader, b.MessageID[:])
+	require.NoError(err, "unexpected ReadFull error")
+	recipientID := [constants.RecipientIDLength]byte{}
+	copy(recipientID[:], "bob")
+	storageBlock := storage.EgressBlock{
+		Sender:            c.Identity,
+		SenderProvider:    "acme.com",
+		Recipient:         recipient,
+		RecipientID:       recipientID,
+		RecipientProvider: "nsa.gov",
+		Priority:          storage.PriorityInteractive,
+		Block:             b,
+	}
+	blockID, err := c.Store.PutEgressBlock(&storageBlock)
+	require.NoError(err, "unexpected PutEgressBlock error")
+	err = c.Scheduler.Send(c.Identity, blockID, &storageBlock)
+	require.NoError(err, "unexpected Send error")
+}
+
+func TestMixnetRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	m, err := New("acme.com", "nsa.gov")
+	require.NoError(err, "unexpected New error")
+	alice := newTestClient(require, m, aliceEmail)
+	defer alice.Close()
+	bob := newTestClient(require, m, bobEmail)
+	defer bob.Close()
+
+	queueBlock(require, alice, bobEmail, "Subject: hello\r\n\r\nthrough the mock mixnet\r\n")
+	m.Wait()
+	err = bob.Fetch()
+	require.NoError(err, "unexpected Fetch error")
+	messages, err := bob.Retrieve()
+	require.NoError(err, "unexpected Retrieve error")
+	require.Len(messages, 1)
+	require.Contains(messages[0], "through the mock mixnet")
+
+	// the ACK came back with the SURB and completed the message
+	m.Wait()
+	err = alice.Fetch()
+	require.NoError(err, "unexpected Fetch error")
+	queue, err := alice.Scheduler.Queue()
+	require.NoError(err, "unexpected Queue error")
+	require.Empty(queue)
+	messages, err = alice.Retrieve()
+	require.NoError(err, "unexpected Retrieve error")
+	require.Len(messages, 1)
+}
+
+func TestMixnetLossAndLatency(t *testing.T) {
+	require := require.New(t)
+
+	m, err := New("acme.com", "nsa.gov")
+	require.NoError(err, "unexpected New error")
+	alice := newTestClient(require, m, aliceEmail)
+	defer alice.Close()
+	bob := newTestClient(require, m, bobEmail)
+	defer bob.Close()
+
+	m.SetLoss(1)
+	queueBlock(require, alice, bobEmail, "lost")
+	require.Equal(0, bob.session.Queued())
+
+	m.SetLoss(0)
+	m.SetLatency(50 * time.Millisecond)
+	queueBlock(require, alice, bobEmail, "delayed")
+	require.Equal(0, bob.session.Queued())
+	m.Wait()
+	require.Equal(1, bob.session.Queued())
+	m.Wait()
+	require.Equal(1, alice.session.Queued())
+}
+
+func TestMixnetHopDelays(t *testing.T) {
+	require := require.New(t)
+
+	m, err := New("acme.com", "nsa.gov")
+	require.NoError(err, "unexpected New error")
+	c := clock.NewFake(time.Now())
+	m.SetClock(c)
+	// a mean delay of a second per hop
+	m.SetLambda(0.001)
+	alice := newTestClient(require, m, aliceEmail)
+	defer alice.Close()
+	bob := newTestClient(require, m, bobEmail)
+	defer bob.Close()
+
+	queueBlock(require, alice, bobEmail, "delayed by the mixes")
+	c.Advance(time.Millisecond)
+	require.Equal(0, bob.session.Queued(), "the hop delays were ignored")
+	c.Advance(time.Hour)
+	require.Equal(1, bob.session.Queued())
+}
+
+func TestDelay(t *testing.T) {
+	require := require.New(t)
+
+	rng := mathrand.New(mathrand.NewSource(1))
+	require.Equal(time.Second, ConstantDelay(time.Second)(rng))
+	for i := 0; i < 100; i++ {
+		d := UniformDelay(time.Second, 2*time.Second)(rng)
+		require.True(d >= time.Second && d < 2*time.Second, "uniform delay out of range")
+		require.True(ExponentialDelay(time.Second)(rng) >= 0, "negative exponential delay")
+	}
+}
+
+func TestClientSMTPToPOP3(t *testing.T) {
+	require := require.New(t)
+
+	m, err := New("acme.com", "nsa.gov")
+	require.NoError(err, "unexpected New error")
+	alice := newTestClient(require, m, aliceEmail)
+	defer alice.Close()
+	bob := newTestClient(require, m, bobEmail)
+	defer bob.Close()
+
+	err = alice.Send(bobEmail, "To: bob@nsa.gov\r\nSubject: hello\r\n\r\nfrom SMTP to POP3\r\n")
+	require.NoError(err, "unexpected Send error")
+	m.Wait()
+	err = bob.Fetch()
+	require.NoError(err, "unexpected Fetch error")
+	messages, err := bob.Retrieve()
+	require.NoError(err, "unexpected Retrieve error")
+	require.Len(messages, 1)
+	require.Contains(messages[0], "from SMTP to POP3")
+}
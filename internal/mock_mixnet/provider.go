@@ -0,0 +1,148 @@
+// provider.go - mock Provider of the mock mixnet
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mock_mixnet
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/core/sphinx"
+	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// Provider is a mock Provider which queues the messages and
+// ACKs of it's users for retrieval by their Sessions
+type Provider struct {
+	sync.Mutex
+
+	name     string
+	mixnet   *Mixnet
+	sessions map[string]*Session
+}
+
+// newProvider creates a new Provider of the given Mixnet
+func newProvider(name string, mixnet *Mixnet) *Provider {
+	return &Provider{
+		name:     name,
+		mixnet:   mixnet,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Session is the wire protocol session of a user with it's mock
+// Provider, the Sphinx packets sent are injected into the Mixnet
+// and each RetrieveMessage is answered with the next message or
+// ACK queued for the user, or MessageEmpty
+type Session struct {
+	*session_pool.FakeSession
+
+	identity string
+	provider *Provider
+}
+
+// Session returns the session of the given user with
+// it's Provider, which is created on first use
+func (m *Mixnet) Session(identity string) (*Session, error) {
+	user, providerName, err := config.SplitEmail(strings.ToLower(identity))
+	if err != nil {
+		return nil, err
+	}
+	provider := m.Provider(providerName)
+	if provider == nil {
+		return nil, errUnknownProvider(providerName)
+	}
+	provider.Lock()
+	defer provider.Unlock()
+	session, ok := provider.sessions[user]
+	if !ok {
+		session = &Session{
+			FakeSession: session_pool.NewFakeSession(),
+			identity:    identity,
+			provider:    provider,
+		}
+		provider.sessions[user] = session
+	}
+	return session, nil
+}
+
+// SendCommand injects the sent Sphinx packets into
+// the Mixnet and answers the message retrievals
+func (s *Session) SendCommand(cmd commands.Command) error {
+	var packet []byte
+	switch c := cmd.(type) {
+	case *commands.SendPacket:
+		packet = c.SphinxPacket
+	case commands.SendPacket:
+		packet = c.SphinxPacket
+	}
+	err := s.FakeSession.SendCommand(cmd)
+	if err != nil || packet == nil {
+		return err
+	}
+	s.provider.mixnet.send(packet, s.identity)
+	return nil
+}
+
+// session returns the session of the given user or nil
+func (p *Provider) session(user string) *Session {
+	p.Lock()
+	defer p.Unlock()
+	return p.sessions[user]
+}
+
+// deliver queues the Block carried by the given forward payload for
+// the given user, and sends the ACK back with the payload's SURB
+func (p *Provider) deliver(user string, payload []byte, origin string) {
+	if len(payload) < sphinx.SURBLength {
+		log.Errorf("mock provider %s: truncated payload from %s", p.name, origin)
+		return
+	}
+	session := p.session(user)
+	if session == nil {
+		log.Debugf("mock provider %s: dropping message from %s to unknown user %s", p.name, origin, user)
+		return
+	}
+	session.Deliver(append([]byte{}, payload[sphinx.SURBLength:]...))
+	p.mixnet.ack(payload[:sphinx.SURBLength], len(payload), origin)
+}
+
+// deliverReply queues the given SURB reply payload, an ACK or a
+// reply, for it's user. The reply path carries no recipient, so
+// it's queued for the sender of the packet if it's a user of this
+// Provider, and otherwise for the sole user of the Provider.
+func (p *Provider) deliverReply(id [sphinxconstants.SURBIDLength]byte, payload []byte, origin string) {
+	user, provider, err := config.SplitEmail(strings.ToLower(origin))
+	p.Lock()
+	session, ok := p.sessions[user]
+	if err != nil || provider != p.name || !ok {
+		session = nil
+		if len(p.sessions) == 1 {
+			for _, s := range p.sessions {
+				session = s
+			}
+		}
+	}
+	p.Unlock()
+	if session == nil {
+		log.Debugf("mock provider %s: dropping SURB reply %x with no user", p.name, id)
+		return
+	}
+	session.DeliverACK(id, append([]byte{}, payload...))
+}
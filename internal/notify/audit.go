@@ -0,0 +1,134 @@
+// audit.go - redacted audit log notifier
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/client/crypto/vault"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/storage"
+)
+
+const (
+	// auditSecretSize is the size in bytes of the per-install secret
+	auditSecretSize = 32
+
+	// auditSecretVaultType is the PEM type of the secret's vault
+	auditSecretVaultType = "AUDIT LOG SECRET"
+
+	// AuditSecretSuffix is appended to the path of the audit
+	// log to name the vault file holding it's secret
+	AuditSecretSuffix = ".secret.pem"
+)
+
+// address matches the e-mail addresses in the event details
+var address = regexp.MustCompile(`[^\s<>"]+@[^\s<>",]+`)
+
+// Audit is a Notifier which appends the events to an audit log as
+// JSON lines, for users debugging delivery problems to share with
+// developers. The message IDs, the accounts and the e-mail addresses
+// of the details are replaced by pseudonyms, keyed hashes under a
+// per-install secret sealed in a vault next to the log, so that the
+// events of a message can be correlated without revealing the
+// correspondents. It should be subscribed with SubscribeSync so
+// that the log doesn't miss events.
+type Audit struct {
+	sync.Mutex
+
+	path   string
+	secret []byte
+}
+
+// NewAudit creates a new Audit notifier appending to the given file,
+// the secret is decrypted with the given passphrase from the vault at
+// the file's path followed by AuditSecretSuffix, which is created on
+// first use
+func NewAudit(path, passphrase string) (*Audit, error) {
+	v, err := vault.New(auditSecretVaultType, passphrase, path+AuditSecretSuffix, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := v.Open()
+	if os.IsNotExist(err) {
+		secret = make([]byte, auditSecretSize)
+		_, err = io.ReadFull(entropy.Reader, secret)
+		if err == nil {
+			err = v.Seal(secret)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != auditSecretSize {
+		return nil, errors.New("invalid audit log secret")
+	}
+	a := Audit{
+		path:   path,
+		secret: secret,
+	}
+	return &a, nil
+}
+
+// pseudonym returns the pseudonym of the given identifier
+func (a *Audit) pseudonym(identifier string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(strings.ToLower(identifier)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// redact returns a copy of the given event with the
+// identifiers replaced by their pseudonyms
+func (a *Audit) redact(e *storage.Event) *storage.Event {
+	redacted := *e
+	if e.Account != "" {
+		redacted.Account = a.pseudonym(e.Account)
+	}
+	if e.MessageID != "" {
+		redacted.MessageID = a.pseudonym(e.MessageID)
+	}
+	redacted.Detail = address.ReplaceAllStringFunc(e.Detail, a.pseudonym)
+	return &redacted
+}
+
+// Notify appends the redacted event to the audit log
+func (a *Audit) Notify(e *storage.Event) error {
+	line, err := json.Marshal(a.redact(e))
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+// audit_test.go - redacted audit log notifier tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "audit_test")
+	require.NoError(err, "TempDir failed")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := NewAudit(path, "correct horse battery staple")
+	require.NoError(err, "NewAudit failed")
+	queued := &storage.Event{
+		Type:      storage.EventMessageQueued,
+		Account:   "alice@acme.com",
+		MessageID: "00112233445566778899aabbccddeeff",
+		Detail:    "to bob@nsa.gov in 3 blocks",
+	}
+	require.NoError(a.Notify(queued), "Notify failed")
+	acked := &storage.Event{
+		Type:      storage.EventMessageAcked,
+		Account:   "alice@acme.com",
+		MessageID: "00112233445566778899aabbccddeeff",
+		Detail:    "to Bob@nsa.gov",
+	}
+	require.NoError(a.Notify(acked), "Notify failed")
+
+	// the pseudonyms persist across restarts
+	a, err = NewAudit(path, "correct horse battery staple")
+	require.NoError(err, "NewAudit failed")
+	require.NoError(a.Notify(acked), "Notify failed")
+
+	// the secret is sealed in a vault
+	sealed, err := ioutil.ReadFile(path + AuditSecretSuffix)
+	require.NoError(err, "ReadFile failed")
+	require.False(bytes.Contains(sealed, a.secret), "secret not sealed")
+	_, err = NewAudit(path, "wrong horse battery staple")
+	require.Error(err, "secret opened with the wrong passphrase")
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(err, "ReadFile failed")
+	require.False(strings.Contains(string(raw), "alice"), "account not redacted")
+	require.False(strings.Contains(strings.ToLower(string(raw)), "bob"), "correspondent not redacted")
+	require.False(strings.Contains(string(raw), queued.MessageID), "message ID not redacted")
+
+	events := []*storage.Event{}
+	scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+	for scanner.Scan() {
+		e := storage.Event{}
+		require.NoError(json.Unmarshal(scanner.Bytes(), &e), "Unmarshal failed")
+		events = append(events, &e)
+	}
+	require.Equal(3, len(events))
+	require.Equal(storage.EventMessageQueued, events[0].Type)
+	require.Equal(events[0].MessageID, events[1].MessageID)
+	require.Equal(events[1], events[2])
+	require.True(strings.HasSuffix(events[0].Detail, " in 3 blocks"))
+	require.Equal(strings.TrimSuffix(events[0].Detail, " in 3 blocks"), events[1].Detail)
+}
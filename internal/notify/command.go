@@ -0,0 +1,66 @@
+// command.go - command notifier
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/katzenpost/client/storage"
+)
+
+// commandTimeout is the maximum run time of a notification command
+const commandTimeout = 30 * time.Second
+
+// Command is a Notifier which runs a command for each event. The
+// event is passed in the MIXCLIENT_EVENT_TYPE, MIXCLIENT_EVENT_TIME,
+// MIXCLIENT_EVENT_ACCOUNT, MIXCLIENT_EVENT_MESSAGE_ID and
+// MIXCLIENT_EVENT_DETAIL environment variables.
+type Command struct {
+	path string
+	args []string
+}
+
+// NewCommand creates a new Command notifier
+// running the given command with the given arguments
+func NewCommand(path string, args []string) *Command {
+	return &Command{
+		path: path,
+		args: args,
+	}
+}
+
+// Notify runs the command
+func (c *Command) Notify(e *storage.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Env = append(os.Environ(),
+		"MIXCLIENT_EVENT_TYPE="+string(e.Type),
+		"MIXCLIENT_EVENT_TIME="+e.Time.UTC().Format(time.RFC3339),
+		"MIXCLIENT_EVENT_ACCOUNT="+e.Account,
+		"MIXCLIENT_EVENT_MESSAGE_ID="+e.MessageID,
+		"MIXCLIENT_EVENT_DETAIL="+e.Detail)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notification command %s: %s: %s", c.path, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// desktop.go - desktop notifier
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/katzenpost/client/storage"
+)
+
+// desktopTimeout is the number of milliseconds
+// a desktop notification is shown for
+const desktopTimeout = 5000
+
+// summaries are the desktop notification summaries of the events
+var summaries = map[storage.EventType]string{
+	storage.EventMessageQueued:    "Message queued",
+	storage.EventBlockSent:        "Block sent",
+	storage.EventBlockAcked:       "Block delivered",
+	storage.EventMessageAcked:     "Message delivered",
+	storage.EventMessageBounced:   "Message not delivered",
+	storage.EventMessageArrived:   "New message",
+	storage.EventSessionConnected: "Connected to the Provider",
+	storage.EventSessionLost:      "Disconnected from the Provider",
+	storage.EventEpochRollover:    "New mixnet epoch",
+}
+
+// Desktop is a Notifier which shows desktop notifications with the
+// org.freedesktop.Notifications D-Bus service of the session bus,
+// by way of gdbus so that no D-Bus library is needed
+type Desktop struct{}
+
+// NewDesktop creates a new Desktop notifier
+func NewDesktop() *Desktop {
+	return &Desktop{}
+}
+
+// Notify shows a desktop notification of the event
+func (d *Desktop) Notify(e *storage.Event) error {
+	output, err := exec.Command("gdbus", desktopArgs(e)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("desktop notification: %s: %s", err, output)
+	}
+	return nil
+}
+
+// desktopArgs returns the gdbus arguments calling the
+// Notify method of org.freedesktop.Notifications
+func desktopArgs(e *storage.Event) []string {
+	summary, ok := summaries[e.Type]
+	if !ok {
+		summary = string(e.Type)
+	}
+	body := e.Account
+	if e.Detail != "" {
+		body += ": " + e.Detail
+	}
+	return []string{
+		"call", "--session",
+		"--dest", "org.freedesktop.Notifications",
+		"--object-path", "/org/freedesktop/Notifications",
+		"--method", "org.freedesktop.Notifications.Notify",
+		gvariantString("mixclient"), // app_name
+		"0",                         // replaces_id
+		gvariantString(""),          // app_icon
+		gvariantString(summary),
+		gvariantString(body),
+		"@as []",    // actions
+		"@a{sv} {}", // hints
+		fmt.Sprintf("%d", desktopTimeout),
+	}
+}
+
+// gvariantString returns the GVariant text format of the given
+// string, which gdbus parses it's arguments as
+func gvariantString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `\'`, -1)
+	return "'" + s + "'"
+}
@@ -0,0 +1,61 @@
+// fifo.go - FIFO notifier
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notify
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+
+	"github.com/katzenpost/client/storage"
+)
+
+// FIFO is a Notifier which writes each event as a JSON line to a
+// FIFO, e.g. created with mkfifo(1), for status bars and scripts.
+// The events are dropped while no process is reading the FIFO.
+type FIFO struct {
+	path string
+}
+
+// NewFIFO creates a new FIFO notifier writing to the given path
+func NewFIFO(path string) *FIFO {
+	return &FIFO{
+		path: path,
+	}
+}
+
+// Notify writes the event to the FIFO
+func (f *FIFO) Notify(e *storage.Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// opening a FIFO for writing without blocking
+	// fails with ENXIO if there is no reader
+	w, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+// notify.go - user facing notifications
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package notify notifies the user of the client's events, such
+// as the delivery or arrival of a message, by running a command,
+// showing a desktop notification, writing JSON lines to a FIFO or
+// appending them to a redacted audit log.
+// A Dispatcher is fed the events of the storage.Store's event log,
+// see storage.Store.SetEventObserver.
+package notify
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/storage"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// queueLength is the number of events waiting to be notified, further
+// events are dropped so that a slow notifier doesn't stall the client
+const queueLength = 64
+
+// DefaultEvents are the types of the events notified by default
+var DefaultEvents = []storage.EventType{
+	storage.EventMessageAcked,
+	storage.EventMessageArrived,
+	storage.EventSessionLost,
+	storage.EventMessageBounced,
+	storage.EventDiskSpaceLow,
+}
+
+// eventTypes are all the types of events
+var eventTypes = []storage.EventType{
+	storage.EventMessageQueued,
+	storage.EventBlockSent,
+	storage.EventBlockAcked,
+	storage.EventMessageAcked,
+	storage.EventMessageBounced,
+	storage.EventMessageArrived,
+	storage.EventMessageFiltered,
+	storage.EventMessageDropped,
+	storage.EventSessionConnected,
+	storage.EventSessionLost,
+	storage.EventEpochRollover,
+	storage.EventGarbageCollected,
+	storage.EventDiskSpaceLow,
+	storage.EventDiskSpaceRecovered,
+}
+
+// Notifier notifies the user of an event
+type Notifier interface {
+	Notify(e *storage.Event) error
+}
+
+// subscription is a Notifier and the types of the events it notifies
+type subscription struct {
+	notifier Notifier
+	types    map[storage.EventType]bool
+	// synchronous is set if the events are notified by Observe
+	// instead of being queued, see SubscribeSync
+	synchronous bool
+}
+
+// Dispatcher passes the events to the Notifiers subscribed to them
+type Dispatcher struct {
+	sync.WaitGroup
+
+	subscriptions []*subscription
+	queue         chan *storage.Event
+	haltCh        chan struct{}
+}
+
+// New creates a new Dispatcher without Notifiers
+func New() *Dispatcher {
+	return &Dispatcher{
+		queue:  make(chan *storage.Event, queueLength),
+		haltCh: make(chan struct{}),
+	}
+}
+
+// FromConfig creates a new Dispatcher of the configured Notifiers,
+// the secrets of the audit logs are decrypted with the passphrase
+func FromConfig(notifiers []config.Notifier, passphrase string) (*Dispatcher, error) {
+	d := New()
+	for i, n := range notifiers {
+		types := []storage.EventType{}
+		for _, name := range n.Events {
+			eventType, err := parseEventType(name)
+			if err != nil {
+				return nil, fmt.Errorf("Notifier %d: %s", i, err)
+			}
+			types = append(types, eventType)
+		}
+		switch n.Type {
+		case "command":
+			d.Subscribe(NewCommand(n.Command, n.Args), types)
+		case "desktop":
+			d.Subscribe(NewDesktop(), types)
+		case "fifo":
+			d.Subscribe(NewFIFO(n.Path), types)
+		case "audit":
+			audit, err := NewAudit(n.Path, passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("Notifier %d: %s", i, err)
+			}
+			if len(types) == 0 {
+				types = eventTypes
+			}
+			d.SubscribeSync(audit, types)
+		default:
+			return nil, fmt.Errorf("Notifier %d: unknown type %q", i, n.Type)
+		}
+	}
+	return d, nil
+}
+
+// parseEventType returns the EventType of the given name
+func parseEventType(name string) (storage.EventType, error) {
+	for _, eventType := range eventTypes {
+		if string(eventType) == name {
+			return eventType, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event %q", name)
+}
+
+// Subscribe subscribes the Notifier to the events of the
+// given types, or to the DefaultEvents if none
+func (d *Dispatcher) Subscribe(n Notifier, types []storage.EventType) {
+	d.subscribe(n, types, false)
+}
+
+// SubscribeSync subscribes the Notifier to the events like Subscribe,
+// but the events are notified by Observe rather than queued so that
+// none of them is dropped, e.g. for an Audit log. The Notifier must
+// return quickly.
+func (d *Dispatcher) SubscribeSync(n Notifier, types []storage.EventType) {
+	d.subscribe(n, types, true)
+}
+
+func (d *Dispatcher) subscribe(n Notifier, types []storage.EventType, synchronous bool) {
+	if len(types) == 0 {
+		types = DefaultEvents
+	}
+	s := subscription{
+		notifier:    n,
+		types:       make(map[storage.EventType]bool),
+		synchronous: synchronous,
+	}
+	for _, eventType := range types {
+		s.types[eventType] = true
+	}
+	d.subscriptions = append(d.subscriptions, &s)
+}
+
+// Observe notifies the event to the synchronous Notifiers and queues
+// it for the others, it's meant to be passed to storage.Store's
+// SetEventObserver
+func (d *Dispatcher) Observe(e *storage.Event) {
+	d.notify(e, true)
+	select {
+	case d.queue <- e:
+	default:
+		log.Warningf("notification queue full, dropping %s event", e.Type)
+	}
+}
+
+// Start starts notifying the queued events
+func (d *Dispatcher) Start() {
+	d.Add(1)
+	go d.worker()
+}
+
+// Halt stops notifying the events
+func (d *Dispatcher) Halt() {
+	close(d.haltCh)
+	d.Wait()
+}
+
+func (d *Dispatcher) worker() {
+	defer d.Done()
+	for {
+		select {
+		case <-d.haltCh:
+			return
+		case e := <-d.queue:
+			d.notify(e, false)
+		}
+	}
+}
+
+// notify passes the event to the subscribed
+// Notifiers, either the synchronous ones or the others
+func (d *Dispatcher) notify(e *storage.Event, synchronous bool) {
+	for _, s := range d.subscriptions {
+		if s.synchronous != synchronous || !s.types[e.Type] {
+			continue
+		}
+		err := s.notifier.Notify(e)
+		if err != nil {
+			log.Errorf("failed to notify %s event: %s", e.Type, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// notify_test.go - user facing notification tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a Notifier which records the events
+type recorder struct {
+	sync.Mutex
+	events []*storage.Event
+}
+
+func (r *recorder) Notify(e *storage.Event) error {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.events)
+}
+
+func TestDispatcher(t *testing.T) {
+	require := require.New(t)
+
+	d := New()
+	all := &recorder{}
+	arrivals := &recorder{}
+	d.Subscribe(all, nil)
+	d.Subscribe(arrivals, []storage.EventType{storage.EventMessageArrived})
+	d.Start()
+	for _, eventType := range []storage.EventType{storage.EventBlockSent, storage.EventMessageAcked, storage.EventMessageArrived} {
+		d.Observe(&storage.Event{Type: eventType, Account: "alice@acme.com"})
+	}
+	require.Eventually(func() bool { return all.count() == 2 }, 5*time.Second, 10*time.Millisecond)
+	d.Halt()
+	require.Equal(1, arrivals.count())
+	require.Equal(storage.EventMessageArrived, arrivals.events[0].Type)
+
+	_, err := FromConfig([]config.Notifier{{Type: "desktop", Events: []string{"message_arrived"}}}, "")
+	require.NoError(err, "FromConfig failed")
+	_, err = FromConfig([]config.Notifier{{Type: "desktop", Events: []string{"message_lost"}}}, "")
+	require.Error(err, "unknown event not detected")
+}
+
+func TestDispatcherSync(t *testing.T) {
+	require := require.New(t)
+
+	d := New()
+	audit := &recorder{}
+	d.SubscribeSync(audit, []storage.EventType{storage.EventBlockSent, storage.EventBlockAcked})
+	// the synchronous Notifiers don't miss the
+	// events dropped once the queue is full
+	for i := 0; i < 2*queueLength; i++ {
+		d.Observe(&storage.Event{Type: storage.EventBlockSent, Account: "alice@acme.com"})
+	}
+	d.Observe(&storage.Event{Type: storage.EventBlockAcked, Account: "alice@acme.com"})
+	require.Equal(2*queueLength+1, audit.count())
+	require.Equal(storage.EventBlockAcked, audit.events[2*queueLength].Type)
+}
+
+func TestCommandAndFIFO(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "notify_test")
+	require.NoError(err, "TempDir failed")
+	defer os.RemoveAll(dir)
+	e := &storage.Event{
+		Time:      time.Unix(1500000000, 0),
+		Type:      storage.EventMessageArrived,
+		Account:   "alice@acme.com",
+		MessageID: "00ff",
+		Detail:    "from bob@nsa.gov",
+	}
+
+	out := filepath.Join(dir, "out")
+	c := NewCommand("/bin/sh", []string{"-c", `echo "$MIXCLIENT_EVENT_TYPE $MIXCLIENT_EVENT_DETAIL" > ` + out})
+	require.NoError(c.Notify(e), "command Notify failed")
+	output, err := ioutil.ReadFile(out)
+	require.NoError(err, "ReadFile failed")
+	require.Equal("message_arrived from bob@nsa.gov\n", string(output))
+	require.Error(NewCommand("/bin/false", nil).Notify(e), "command failure not detected")
+
+	fifo := filepath.Join(dir, "fifo")
+	require.NoError(syscall.Mkfifo(fifo, 0600), "Mkfifo failed")
+	f := NewFIFO(fifo)
+	require.NoError(f.Notify(e), "events must be dropped without reader")
+	r, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	require.NoError(err, "OpenFile failed")
+	defer r.Close()
+	require.NoError(f.Notify(e), "FIFO Notify failed")
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	require.NoError(err, "ReadBytes failed")
+	decoded := storage.Event{}
+	require.NoError(json.Unmarshal(line, &decoded), "Unmarshal failed")
+	require.Equal(e.Detail, decoded.Detail)
+	require.True(e.Time.Equal(decoded.Time))
+}
+
+func TestDesktopArgs(t *testing.T) {
+	require := require.New(t)
+
+	args := desktopArgs(&storage.Event{
+		Type:    storage.EventMessageArrived,
+		Account: "alice@acme.com",
+		Detail:  `from o'brien\`,
+	})
+	require.Equal(`'New message'`, args[len(args)-5])
+	require.Equal(`'alice@acme.com: from o\'brien\\'`, args[len(args)-4])
+}
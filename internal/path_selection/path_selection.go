@@ -22,9 +22,14 @@ import (
 	cryptorand "crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	mathrand "math/rand"
+	"sync"
 	"time"
 
+	clientconstants "github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/epochtime"
@@ -46,13 +51,14 @@ func DurationFromFloat(delay float64) time.Duration {
 // of the "Panoramix Mix Network End-to-end Protocol Specification"
 // the delay for the egress provider, the last hop is always zero,
 // see https://github.com/Katzenpost/docs/blob/master/specs/end_to_end.txt
-func getDelays(lambda float64, count int) []float64 {
-	cryptRand := rand.NewMath()
+func getDelays(randReader io.Reader, lambda float64, count int) ([]float64, error) {
+	source := entropy.NewSource(randReader)
+	cryptRand := mathrand.New(source)
 	delays := make([]float64, count)
 	for i := 0; i < count-1; i++ {
 		delays[i] = rand.Exp(cryptRand, lambda)
 	}
-	return delays
+	return delays, source.Err()
 }
 
 // sum adds a slice of float64.
@@ -83,9 +89,14 @@ func getFutureEpoch(hopDuration time.Duration) uint64 {
 // hop in the route where the mean of this distribution is tuneable
 // using the lambda parameter.
 type RouteFactory struct {
-	pki     pki.Client
-	numHops int
-	lambda  float64
+	pki        pki.Client
+	numHops    int
+	lambda     float64
+	randReader io.Reader
+
+	pinLock sync.Mutex
+	debug   bool
+	pinned  map[clientconstants.MessageID][]string
 }
 
 // New creates a new RouteFactory for creating routes
@@ -97,21 +108,37 @@ type RouteFactory struct {
 //   that our per hop Poisson mix delays are sampled from.
 func New(pki pki.Client, numHops int, lambda float64) *RouteFactory {
 	r := RouteFactory{
-		pki:     pki,
-		numHops: numHops,
-		lambda:  lambda,
+		pki:        pki,
+		numHops:    numHops,
+		lambda:     lambda,
+		randReader: entropy.Reader,
+		pinned:     make(map[clientconstants.MessageID][]string),
 	}
 	return &r
 }
 
+// SetRandomReader sets the entropy source used to select
+// mixes, sample delays and generate SURB IDs. This defaults
+// to crypto/rand and should only be changed for deterministic
+// tests and simulations.
+func (r *RouteFactory) SetRandomReader(randReader io.Reader) {
+	r.randReader = randReader
+}
+
 // getRouteDescriptors returns a slice of mix descriptors,
 // one for each hop in the route where each mix descriptor
 // was selected from the set of descriptors for that layer
 func (r *RouteFactory) getRouteDescriptors(senderProviderName, recipientProviderName string) ([]*pki.MixDescriptor, error) {
+	epoch, _, _ := epochtime.Now()
+	return r.getEpochRouteDescriptors(epoch, senderProviderName, recipientProviderName)
+}
+
+// getEpochRouteDescriptors is like getRouteDescriptors but
+// selects the mixes from the PKI document of the given epoch
+func (r *RouteFactory) getEpochRouteDescriptors(epoch uint64, senderProviderName, recipientProviderName string) ([]*pki.MixDescriptor, error) {
 	var err error
 	// number of mix hops plus two provider hops in total
 	descriptors := make([]*pki.MixDescriptor, r.numHops)
-	epoch, _, _ := epochtime.Now()
 	ctx := context.TODO() // XXX fix me: use correct context for real pki source
 	consensus, err := r.pki.Get(ctx, epoch)
 	if err != nil {
@@ -133,7 +160,7 @@ func (r *RouteFactory) getRouteDescriptors(senderProviderName, recipientProvider
 		if len(layerMixes) == 0 {
 			return nil, fmt.Errorf("Mixnet PKI client retrieved 0 descriptors from layer %d", i)
 		}
-		c, err := cryptorand.Int(rand.Reader, big.NewInt(int64(len(layerMixes))))
+		c, err := cryptorand.Int(r.randReader, big.NewInt(int64(len(layerMixes))))
 		if err != nil {
 			return nil, err
 		}
@@ -157,6 +184,9 @@ func (r *RouteFactory) getHopEpochKeys(till time.Duration, delays []float64, des
 	for i := 0; i < len(descriptors); i++ {
 		hopDelay = hopDelay + delays[i]
 		hopDuration := DurationFromFloat(hopDelay)
+		if nearEpochBoundary(hopDuration, till) {
+			return nil, ErrNearEpochBoundary
+		}
 		currentEpoch, _, _ := epochtime.Now()
 		if hopDuration < till {
 			keys[i] = descriptors[i].MixKeys[currentEpoch]
@@ -171,6 +201,28 @@ func (r *RouteFactory) getHopEpochKeys(till time.Duration, delays []float64, des
 	return keys, nil
 }
 
+// ErrNearEpochBoundary is the error returned when the hops of the
+// route would arrive too close to an epoch boundary, the route can
+// be built once the boundary has passed
+var ErrNearEpochBoundary = errors.New("hop arrives too close to an epoch boundary")
+
+// nearEpochBoundary returns true if the given hop duration is
+// within clientconstants.EpochBoundarySlack of one of the next
+// epoch boundaries, the first of which is 'till' from now
+func nearEpochBoundary(hopDuration, till time.Duration) bool {
+	for i := 0; i < 3; i++ {
+		boundary := till + time.Duration(i)*epochtime.Period
+		delta := hopDuration - boundary
+		if delta < 0 {
+			delta = -delta
+		}
+		if delta < clientconstants.EpochBoundarySlack {
+			return true
+		}
+	}
+	return false
+}
+
 // newPathVector returns a slice of PathHops and optionally a new SURB ID
 // if the isSURB argument is set to true.
 // The PathHop struct has three attributes: ID, PublicKey and Commands.
@@ -205,7 +257,7 @@ func (r *RouteFactory) newPathVector(till time.Duration,
 			if isSURB {
 				surbReply := new(commands.SURBReply)
 				surbID = &[constants.SURBIDLength]byte{}
-				_, err := rand.Reader.Read(surbID[:])
+				_, err := io.ReadFull(r.randReader, surbID[:])
 				if err != nil {
 					return nil, nil, err
 				}
@@ -229,13 +281,20 @@ func (r *RouteFactory) newPathVector(till time.Duration,
 // The generated forward and reply paths are intended to be used
 // with the Poisson Stop and Wait ARQ, an end to end reliable transmission
 // protocol for mix networks using the Poisson mix strategy.
-func (r *RouteFactory) next(senderProviderName, recipientProviderName string, recipientID [constants.RecipientIDLength]byte) ([]*sphinx.PathHop, []*sphinx.PathHop, *[constants.SURBIDLength]byte, time.Duration, error) {
+func (r *RouteFactory) next(senderProviderName, recipientProviderName string, recipientID [constants.RecipientIDLength]byte, pinned []string) ([]*sphinx.PathHop, []*sphinx.PathHop, *[constants.SURBIDLength]byte, time.Duration, error) {
 	var rtt, till time.Duration
 	var forwardDelays, replyDelays []float64
 	for {
 		// 1. Sample all forward and SURB delays.
-		forwardDelays = getDelays(r.lambda, r.numHops)
-		replyDelays = getDelays(r.lambda, r.numHops)
+		var err error
+		forwardDelays, err = getDelays(r.randReader, r.lambda, r.numHops)
+		if err != nil {
+			return nil, nil, nil, rtt, err
+		}
+		replyDelays, err = getDelays(r.randReader, r.lambda, r.numHops)
+		if err != nil {
+			return nil, nil, nil, rtt, err
+		}
 		// 2. Ensure total delays doesn't exceed (time_till next_epoch) +
 		//    2 * epoch_duration, as keys are only published 3 epochs in
 		//    advance.
@@ -252,6 +311,12 @@ func (r *RouteFactory) next(senderProviderName, recipientProviderName string, re
 	if err != nil {
 		return nil, nil, nil, rtt, err
 	}
+	if pinned != nil {
+		err = r.pinDescriptors(forwardDescriptors, pinned)
+		if err != nil {
+			return nil, nil, nil, rtt, err
+		}
+	}
 	replyDescriptors, err := r.getRouteDescriptors(recipientProviderName, senderProviderName)
 	if err != nil {
 		return nil, nil, nil, rtt, err
@@ -276,6 +341,13 @@ func (r *RouteFactory) next(senderProviderName, recipientProviderName string, re
 // selected delays. We give up after four tries and return an error.
 func (r *RouteFactory) Build(senderProvider, recipientProvider string,
 	recipientID [constants.RecipientIDLength]byte) ([]*sphinx.PathHop, []*sphinx.PathHop, *[constants.SURBIDLength]byte, time.Duration, error) {
+	return r.build(senderProvider, recipientProvider, recipientID, nil)
+}
+
+// build builds forward and reply paths, the forward
+// path goes through the pinned mixes if not nil
+func (r *RouteFactory) build(senderProvider, recipientProvider string,
+	recipientID [constants.RecipientIDLength]byte, pinned []string) ([]*sphinx.PathHop, []*sphinx.PathHop, *[constants.SURBIDLength]byte, time.Duration, error) {
 
 	var err error = nil
 	var forwardPath []*sphinx.PathHop
@@ -284,11 +356,14 @@ func (r *RouteFactory) Build(senderProvider, recipientProvider string,
 	var rtt time.Duration
 
 	for i := 0; i < 4; i++ {
-		forwardPath, replyPath, surbID, rtt, err = r.next(senderProvider, recipientProvider, recipientID)
+		forwardPath, replyPath, surbID, rtt, err = r.next(senderProvider, recipientProvider, recipientID, pinned)
 		if err == nil {
 			break
 		}
 	}
+	if err == ErrNearEpochBoundary {
+		return nil, nil, nil, rtt, err
+	}
 	if err != nil {
 		return nil, nil, nil, rtt, fmt.Errorf("RouteFactory.Build failed: %s", err)
 	}
@@ -17,13 +17,18 @@
 package path_selection
 
 import (
+	"bytes"
+	"context"
+	mathrand "math/rand"
 	"testing"
 
+	clientconstants "github.com/katzenpost/client/internal/constants"
 	"github.com/katzenpost/client/mix_pki"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx"
 	"github.com/katzenpost/core/sphinx/constants"
 	"github.com/stretchr/testify/require"
 )
@@ -231,3 +236,84 @@ func TestGetRouteDescriptors(t *testing.T) {
 		t.Logf("name: %s", descriptor.Name)
 	}
 }
+
+func TestDeterministicPathSelection(t *testing.T) {
+	require := require.New(t)
+
+	mixPKI, _ := newMixPKI(require)
+	nrHops := 5
+	lambda := float64(.00123)
+	recipientID := [constants.RecipientIDLength]byte{}
+	copy(recipientID[:], []byte("alice"))
+
+	build := func() ([]*sphinx.PathHop, *[constants.SURBIDLength]byte) {
+		factory := New(mixPKI, nrHops, lambda)
+		factory.SetRandomReader(mathrand.New(mathrand.NewSource(1)))
+		forwardRoute, _, surbID, _, err := factory.Build("acme.com", "nsa.gov", recipientID)
+		require.NoError(err, "build route error")
+		return forwardRoute, surbID
+	}
+	forwardRoute1, surbID1 := build()
+	forwardRoute2, surbID2 := build()
+	require.Equal(*surbID1, *surbID2, "SURB IDs differ for the same entropy source")
+	for i := range forwardRoute1 {
+		require.Equal(forwardRoute1[i].ID, forwardRoute2[i].ID, "routes differ for the same entropy source")
+	}
+	delays1, err := getDelays(mathrand.New(mathrand.NewSource(2)), lambda, nrHops)
+	require.NoError(err, "getDelays error")
+	delays2, err := getDelays(mathrand.New(mathrand.NewSource(2)), lambda, nrHops)
+	require.NoError(err, "getDelays error")
+	require.Equal(delays1, delays2)
+
+	// a failing entropy source is an error rather than a panic
+	_, err = getDelays(bytes.NewReader(nil), lambda, nrHops)
+	require.Error(err, "getDelays succeeded without entropy")
+}
+
+func TestPinRoute(t *testing.T) {
+	require := require.New(t)
+
+	mixPKI, _ := newMixPKI(require)
+	factory := New(mixPKI, 5, float64(.00123))
+	recipientID := [constants.RecipientIDLength]byte{}
+	copy(recipientID[:], []byte("alice"))
+	messageID := [clientconstants.MessageIDLength]byte{1, 2, 3}
+	mixes := []string{"gchq123", "fsbspy1", "foxtrot2"}
+
+	err := factory.PinRoute(messageID, mixes)
+	require.Equal(ErrDebugDisabled, err)
+	factory.SetDebug(true)
+	err = factory.PinRoute(messageID, mixes[:2])
+	require.Error(err, "a route with a missing layer was pinned")
+	err = factory.PinRoute(messageID, []string{"nsamix102", "fsbspy1", "foxtrot2"})
+	require.NoError(err, "unexpected PinRoute() error")
+	_, _, _, _, err = factory.BuildMessage(messageID, "acme.com", "nsa.gov", recipientID)
+	require.Error(err, "a mix was pinned to the wrong layer")
+	err = factory.PinRoute(messageID, mixes)
+	require.NoError(err, "unexpected PinRoute() error")
+
+	epoch, _, _ := epochtime.Now()
+	doc, err := mixPKI.Get(context.Background(), epoch)
+	require.NoError(err, "unexpected Get() error")
+	isMix := func(hop *sphinx.PathHop, name string) bool {
+		mix, err := doc.GetMix(name)
+		require.NoError(err, "unexpected GetMix() error")
+		for _, key := range mix.MixKeys {
+			if bytes.Equal(hop.ID[:], key.Bytes()) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 10; i++ {
+		forwardRoute, _, _, _, err := factory.BuildMessage(messageID, "acme.com", "nsa.gov", recipientID)
+		require.NoError(err, "unexpected BuildMessage() error")
+		for j, name := range mixes {
+			require.True(isMix(forwardRoute[j+1], name), "hop %d is not the pinned mix %s", j+1, name)
+		}
+	}
+
+	factory.SetDebug(false)
+	err = factory.PinRoute(messageID, mixes)
+	require.Equal(ErrDebugDisabled, err)
+}
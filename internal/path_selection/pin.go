@@ -0,0 +1,113 @@
+// pin.go - route pinning for debugging
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package path_selection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	clientconstants "github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// ErrDebugDisabled is the error returned when
+// pinning a route outside of the debug mode
+var ErrDebugDisabled = errors.New("route pinning requires the debug mode")
+
+// SetDebug enables or disables the debug mode which allows
+// pinning the routes of messages, disabling it unpins them all
+func (r *RouteFactory) SetDebug(enabled bool) {
+	r.pinLock.Lock()
+	defer r.pinLock.Unlock()
+	r.debug = enabled
+	if !enabled {
+		r.pinned = make(map[clientconstants.MessageID][]string)
+	}
+}
+
+// PinRoute pins the forward route of the given message to the
+// named mixes, one for each mix layer, bypassing the random mix
+// selection. This is meant to reproduce path specific delivery
+// failures: the traffic of a pinned message is trivially linkable.
+func (r *RouteFactory) PinRoute(messageID clientconstants.MessageID, mixes []string) error {
+	r.pinLock.Lock()
+	defer r.pinLock.Unlock()
+	if !r.debug {
+		return ErrDebugDisabled
+	}
+	if len(mixes) != r.numHops-2 {
+		return fmt.Errorf("a pinned route must have %d mixes", r.numHops-2)
+	}
+	r.pinned[messageID] = append([]string{}, mixes...)
+	log.Warningf("DEBUG: the route of message %x is pinned to %v, it's traffic is NOT anonymous", messageID, mixes)
+	return nil
+}
+
+// UnpinRoute restores the random mix selection of the given message
+func (r *RouteFactory) UnpinRoute(messageID clientconstants.MessageID) {
+	r.pinLock.Lock()
+	defer r.pinLock.Unlock()
+	delete(r.pinned, messageID)
+}
+
+// pinDescriptors replaces the mixes of the given
+// route descriptors with the pinned mixes
+func (r *RouteFactory) pinDescriptors(descriptors []*pki.MixDescriptor, mixes []string) error {
+	epoch, _, _ := epochtime.Now()
+	consensus, err := r.pki.Get(context.TODO(), epoch)
+	if err != nil {
+		return err
+	}
+	for i, name := range mixes {
+		layerMixes, err := consensus.GetMixesInLayer(uint8(i + 1))
+		if err != nil {
+			return err
+		}
+		descriptors[i+1] = nil
+		for _, mix := range layerMixes {
+			if mix.Name == name {
+				descriptors[i+1] = mix
+			}
+		}
+		if descriptors[i+1] == nil {
+			return fmt.Errorf("pinned mix %s is not in layer %d", name, i+1)
+		}
+	}
+	return nil
+}
+
+// BuildMessage builds forward and reply paths for a Block of the
+// given message, the forward path follows it's pinned route if any
+func (r *RouteFactory) BuildMessage(messageID clientconstants.MessageID, senderProvider, recipientProvider string,
+	recipientID [constants.RecipientIDLength]byte) ([]*sphinx.PathHop, []*sphinx.PathHop, *[constants.SURBIDLength]byte, time.Duration, error) {
+
+	r.pinLock.Lock()
+	pinned, ok := r.pinned[messageID]
+	r.pinLock.Unlock()
+	if ok {
+		log.Warningf("DEBUG: sending a Block of message %x over it's pinned route %v", messageID, pinned)
+	}
+	return r.build(senderProvider, recipientProvider, recipientID, pinned)
+}
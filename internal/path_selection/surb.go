@@ -0,0 +1,82 @@
+// surb.go - paths of pre-generated SURBs
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package path_selection
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/sphinx/constants"
+)
+
+// BuildSURBPath builds the path of a SURB to be used during the given
+// epoch, from the sender's Provider to the recipient's Provider. All
+// it's hops use the mix keys of that epoch, so it may be built ahead
+// of time from a prefetched PKI document. It returns the path, the
+// SURB ID and the total delay of the path: the SURB must be used at
+// least that long before the end of the epoch.
+func (r *RouteFactory) BuildSURBPath(epoch uint64, senderProvider, recipientProvider string) ([]*sphinx.PathHop, *[constants.SURBIDLength]byte, time.Duration, error) {
+	descriptors, err := r.getEpochRouteDescriptors(epoch, senderProvider, recipientProvider)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	delays, err := getDelays(r.randReader, r.lambda, r.numHops)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	surbID := &[constants.SURBIDLength]byte{}
+	_, err = io.ReadFull(r.randReader, surbID[:])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	path := make([]*sphinx.PathHop, r.numHops)
+	for i := range path {
+		key, ok := descriptors[i].MixKeys[epoch]
+		if !ok || key == nil {
+			return nil, nil, 0, fmt.Errorf("%s has no mix key for epoch %d", descriptors[i].Name, epoch)
+		}
+		path[i] = new(sphinx.PathHop)
+		copy(path[i].ID[:], key.Bytes())
+		path[i].PublicKey = key
+		if i < r.numHops-1 {
+			delay := new(commands.NodeDelay)
+			delay.Delay = uint32(delays[i])
+			path[i].Commands = []commands.RoutingCommand{delay}
+		} else {
+			surbReply := new(commands.SURBReply)
+			surbReply.ID = *surbID
+			path[i].Commands = []commands.RoutingCommand{surbReply}
+		}
+	}
+	return path, surbID, DurationFromFloat(sum(delays)), nil
+}
+
+// PathDelay returns the total mixing delay of the given path
+func PathDelay(path []*sphinx.PathHop) time.Duration {
+	delay := float64(0)
+	for _, hop := range path {
+		for _, cmd := range hop.Commands {
+			if nodeDelay, ok := cmd.(*commands.NodeDelay); ok {
+				delay += float64(nodeDelay.Delay)
+			}
+		}
+	}
+	return DurationFromFloat(delay)
+}
@@ -22,6 +22,7 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -31,6 +32,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/katzenpost/client/internal/entropy"
 	"github.com/katzenpost/core/utils"
 )
 
@@ -38,7 +40,8 @@ const (
 	// Commands
 	cmdUser = "USER" // USER name
 	cmdPass = "PASS" // PASS string
-	// cmdApop = "APOP" // (Optional) APOP name digest
+	cmdApop = "APOP" // (Optional) APOP name digest
+	cmdAuth = "AUTH" // (Optional) AUTH mechanism [initial-response]
 	cmdQuit = "QUIT"
 	cmdCapa = "CAPA"
 
@@ -53,8 +56,8 @@ const (
 
 	// RFC 2449 capabilities.
 	// capTop  = "TOP"
-	capUser = "USER"
-	// capSASL = "SASL
+	capUser      = "USER"
+	capSASL      = "SASL PLAIN"
 	capRespCodes = "RESP-CODES"
 	// capLoginDelay     = "LOGIN-DELAY"
 	// capPipelining     = "PIPELINING"
@@ -62,9 +65,12 @@ const (
 	capUIDL           = "UIDL"
 	capImplementation = "IMPLEMENTATION Katzenpost"
 
-	// This is larger than it needs to be (88 bytes is sufficient for all
-	// supported commands), but it doesn't hurt.
-	maxCmdLength = 128
+	// SASL mechanisms, RFC 5034.
+	saslPlain = "PLAIN"
+
+	// The initial response of AUTH PLAIN carries both the user name and
+	// the password base64 encoded, the other commands fit in 128 bytes.
+	maxCmdLength = 512
 )
 
 const (
@@ -76,6 +82,7 @@ const (
 var (
 	capabilities = []string{
 		capUser,
+		capSASL,
 		capRespCodes,
 		capUIDL,
 		capImplementation,
@@ -97,6 +104,18 @@ type Backend interface {
 	NewSession(user, pass []byte) (BackendSession, error)
 }
 
+// APOPBackend is implemented by the Backends supporting the APOP
+// command, RFC 1939 section 7, which authenticates the user with the
+// MD5 digest of the greeting's timestamp and a secret shared with the
+// server instead of sending the password.
+type APOPBackend interface {
+	// NewSessionAPOP authenticates the user specified by the given
+	// username and hex encoded digest of the given timestamp, and
+	// iff the digest is valid, locks the user's maildrop and returns
+	// a BackendSession instance.
+	NewSessionAPOP(user []byte, timestamp string, digest []byte) (BackendSession, error)
+}
+
 // BackendSession is a view into a given user's (locked) maildrop.
 type BackendSession interface {
 	// Messages returns all of the messages in a user's maildrop.
@@ -110,6 +129,17 @@ type BackendSession interface {
 	Close()
 }
 
+// MarkingBackendSession is implemented by the BackendSessions which
+// persist the marks of the DELE command, e.g. as a flag shared with
+// other mail protocols, until the marked messages are deleted by
+// DeleteMessages when the session is QUIT. The BackendSession is
+// expected to drop the marks if it's closed without a QUIT.
+type MarkingBackendSession interface {
+	// MarkDeleted marks or unmarks the message, addressed by index
+	// into the slice returned by Messages(), as deleted.
+	MarkDeleted(item int, deleted bool) error
+}
+
 // Session is a POP3 server session.
 type Session struct {
 	conn net.Conn
@@ -118,6 +148,10 @@ type Session struct {
 
 	state sessionState
 
+	// timestamp is the APOP timestamp of the greeting,
+	// empty if the Backend doesn't support APOP
+	timestamp string
+
 	limRd *io.LimitedReader
 	rd    *textproto.Reader
 	wr    *textproto.Writer
@@ -155,8 +189,12 @@ func (s *Session) doAuthorization() error {
 		panic(fmt.Sprintf("pop3: BUG: doAuthorization in state: %d", s.state))
 	}
 
-	// Issue a one line greeting
-	if err := s.writeOk("POP3 server ready"); err != nil {
+	// Issue a one line greeting, with the APOP timestamp if supported.
+	greeting := "POP3 server ready"
+	if s.timestamp != "" {
+		greeting += " " + s.timestamp
+	}
+	if err := s.writeOk("%s", greeting); err != nil {
 		return err
 	}
 
@@ -211,25 +249,45 @@ authLoop:
 
 			// Call the backend to attempt to authenticate, and lock the mail
 			// drop.
-			var err error
-			if s.bs, err = s.b.NewSession(authUser, splitL[1]); err != nil {
-				if err == ErrInUse {
-					// RFC 2499: IN-USE response code.
-					if err = s.writeErr("%s", err.Error()); err != nil {
-						return err
-					}
-				} else if err = s.writeErr("invalid username or password"); err != nil {
+			bs, err := s.b.NewSession(authUser, splitL[1])
+			utils.ExplicitBzero(splitL[1])
+			ok, err := s.onAuthenticated(bs, err)
+			if err != nil {
+				return err
+			}
+			if ok {
+				break authLoop // Authenticated.
+			}
+		case cmdApop:
+			b, ok := s.b.(APOPBackend)
+			if !ok || s.timestamp == "" {
+				if err := s.writeErr("invalid command: '%s'", cmd); err != nil {
 					return err
 				}
 				break
 			}
-
-			utils.ExplicitBzero(splitL[1])
-			if err = s.writeOk("maildrop locked and ready"); err != nil {
-				s.bs.Close()
+			if len(splitL) != 3 {
+				if err := s.writeArgErr(cmd); err != nil {
+					return err
+				}
+				break
+			}
+			bs, err := b.NewSessionAPOP(splitL[1], s.timestamp, splitL[2])
+			ok, err = s.onAuthenticated(bs, err)
+			if err != nil {
 				return err
 			}
-			break authLoop // Authenticated.
+			if ok {
+				break authLoop // Authenticated.
+			}
+		case cmdAuth:
+			ok, err := s.onCmdAuth(splitL)
+			if err != nil {
+				return err
+			}
+			if ok {
+				break authLoop // Authenticated.
+			}
 		case cmdQuit:
 			return s.onCmdQuit()
 		case cmdCapa:
@@ -253,6 +311,69 @@ authLoop:
 	return nil
 }
 
+// onAuthenticated responds to an authentication attempt which
+// returned the given BackendSession and error, it returns true
+// if the user is authenticated and it's maildrop is locked
+func (s *Session) onAuthenticated(bs BackendSession, err error) (bool, error) {
+	if err != nil {
+		if err == ErrInUse {
+			// RFC 2499: IN-USE response code.
+			return false, s.writeErr("%s", err.Error())
+		}
+		return false, s.writeErr("invalid username or password")
+	}
+	s.bs = bs
+	if err = s.writeOk("maildrop locked and ready"); err != nil {
+		s.bs.Close()
+		return false, err
+	}
+	return true, nil
+}
+
+// onCmdAuth handles the AUTH command, RFC 5034, with the
+// PLAIN mechanism, RFC 4616, it returns true if the user
+// is authenticated and it's maildrop is locked
+func (s *Session) onCmdAuth(splitL [][]byte) (bool, error) {
+	if len(splitL) < 2 || len(splitL) > 3 {
+		return false, s.writeArgErr(cmdAuth)
+	}
+	if strings.ToUpper(string(splitL[1])) != saslPlain {
+		return false, s.writeErr("unsupported authentication mechanism")
+	}
+	var response []byte
+	if len(splitL) == 3 {
+		response = splitL[2]
+	} else {
+		// Prompt for the response with an empty challenge.
+		if err := s.writeLine("+ "); err != nil {
+			return false, err
+		}
+		l, err := s.readLineBytes()
+		if err != nil {
+			return false, err
+		}
+		response = l
+	}
+	if string(response) == "*" {
+		return false, s.writeErr("authentication cancelled")
+	}
+	plain, err := base64.StdEncoding.DecodeString(string(response))
+	utils.ExplicitBzero(response)
+	if err != nil {
+		return false, s.writeErr("invalid authentication response")
+	}
+	defer utils.ExplicitBzero(plain)
+	// message = [authzid] NUL authcid NUL passwd
+	fields := bytes.Split(plain, []byte{0})
+	if len(fields) != 3 || len(fields[1]) == 0 {
+		return false, s.writeErr("invalid authentication response")
+	}
+	if len(fields[0]) != 0 && !bytes.Equal(fields[0], fields[1]) {
+		return false, s.writeErr("invalid username or password")
+	}
+	return s.onAuthenticated(s.b.NewSession(fields[1], fields[2]))
+}
+
 func (s *Session) doTransaction() {
 	if s.state != stateTransaction {
 		panic(fmt.Sprintf("pop3: BUG: doTransaction in state: %d", s.state))
@@ -438,6 +559,11 @@ func (s *Session) onCmdDele(splitL []string) error {
 		return s.writeErr("message %d already deleted", idx)
 	}
 
+	if mbs, ok := s.bs.(MarkingBackendSession); ok {
+		if err := mbs.MarkDeleted(idx-1, true); err != nil {
+			return s.writeErr("failed to delete message %d", idx)
+		}
+	}
 	s.deletedMessages[idx-1] = true
 
 	return s.writeOk("message %d deleted", idx)
@@ -456,6 +582,14 @@ func (s *Session) onCmdRset(splitL []string) error {
 		return s.writeArgErr(splitL[0])
 	}
 
+	if mbs, ok := s.bs.(MarkingBackendSession); ok {
+		for i := range s.deletedMessages {
+			if err := mbs.MarkDeleted(i, false); err != nil {
+				return s.writeErr("failed to reset the deleted messages")
+			}
+			delete(s.deletedMessages, i)
+		}
+	}
 	s.deletedMessages = make(map[int]bool)
 	return s.writeOk("")
 }
@@ -549,5 +683,19 @@ func NewSession(conn net.Conn, backend Backend) *Session {
 	s.rd = textproto.NewReader(bufio.NewReader(s.limRd))
 	s.wr = textproto.NewWriter(bufio.NewWriter(s.conn))
 	s.deletedMessages = make(map[int]bool)
+	if _, ok := backend.(APOPBackend); ok {
+		s.timestamp = newTimestamp()
+	}
 	return s
 }
+
+// newTimestamp returns a unique APOP timestamp, RFC 1939
+// requires it to be in the syntax of a msg-id
+func newTimestamp() string {
+	nonce := make([]byte, 16)
+	_, err := io.ReadFull(entropy.Reader, nonce)
+	if err != nil {
+		panic(fmt.Sprintf("pop3: BUG: failed to read the APOP nonce: %s", err))
+	}
+	return fmt.Sprintf("<%s@mixclient>", hex.EncodeToString(nonce))
+}
@@ -20,10 +20,14 @@ package pop3
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/textproto"
+	"strings"
 	"sync"
 	"testing"
 
@@ -213,3 +217,150 @@ func TestPop3(t *testing.T) {
 
 	wg.Wait()
 }
+
+type TestAPOPBackend struct {
+	TestBackend
+}
+
+func (b TestAPOPBackend) NewSessionAPOP(user []byte, timestamp string, digest []byte) (BackendSession, error) {
+	sum := md5.Sum([]byte(timestamp + testPass))
+	if !bytes.Equal(user, []byte(testUser)) || string(digest) != hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("invalid user/digest: '%s'/'%s'", user, digest)
+	}
+	return TestBackendSession{}, nil
+}
+
+func TestPop3Authentication(t *testing.T) {
+	require := require.New(t)
+
+	// dial returns a client connection to a new
+	// Session of the given Backend and it's greeting
+	dial := func(backend Backend) (*textproto.Conn, string) {
+		clientConn, serverConn := net.Pipe()
+		go NewSession(serverConn, backend).Serve()
+		c := textproto.NewConn(clientConn)
+		l, err := c.ReadLine()
+		require.NoError(err, "failed reading banner")
+		return c, l
+	}
+	// command sends the given command and returns the response
+	command := func(c *textproto.Conn, format string, args ...interface{}) string {
+		err := c.PrintfLine(format, args...)
+		require.NoError(err, "failed sending command")
+		l, err := c.ReadLine()
+		require.NoError(err, "failed reading response")
+		return l
+	}
+	plain := func(authzid, authcid, passwd string) string {
+		return base64.StdEncoding.EncodeToString([]byte(authzid + "\x00" + authcid + "\x00" + passwd))
+	}
+	ok := func(response string) bool {
+		return strings.HasPrefix(response, "+OK ")
+	}
+
+	// AUTH PLAIN with an initial response
+	c, greeting := dial(TestBackend{})
+	require.Equal("+OK POP3 server ready", greeting)
+	require.False(ok(command(c, "APOP %s c4c9334bac560ecc979e58001b3e22fb", testUser)))
+	require.False(ok(command(c, "AUTH CRAM-MD5")))
+	require.False(ok(command(c, "AUTH PLAIN %s", plain("", testUser, "guess"))))
+	require.False(ok(command(c, "AUTH PLAIN %s", plain("bob", testUser, testPass))))
+	require.False(ok(command(c, "AUTH PLAIN %s", "not base64")))
+	require.True(ok(command(c, "AUTH PLAIN %s", plain(testUser, testUser, testPass))))
+	require.True(ok(command(c, "QUIT")))
+	c.Close()
+
+	// AUTH PLAIN with the response following an empty challenge
+	c, _ = dial(TestBackend{})
+	require.Equal("+ ", command(c, "AUTH PLAIN"))
+	require.False(ok(command(c, "*")))
+	require.Equal("+ ", command(c, "AUTH plain"))
+	require.True(ok(command(c, "%s", plain("", testUser, testPass))))
+	require.True(ok(command(c, "QUIT")))
+	c.Close()
+
+	// APOP with the timestamp of the greeting
+	c, greeting = dial(TestAPOPBackend{})
+	i := strings.Index(greeting, " <")
+	require.NotEqual(-1, i)
+	timestamp := greeting[i+1:]
+	require.True(strings.HasSuffix(timestamp, ">"))
+	require.False(ok(command(c, "APOP %s", testUser)))
+	sum := md5.Sum([]byte("<other@host>" + testPass))
+	require.False(ok(command(c, "APOP %s %x", testUser, sum[:])))
+	sum = md5.Sum([]byte(timestamp + testPass))
+	require.True(ok(command(c, "APOP %s %x", testUser, sum[:])))
+	require.True(ok(command(c, "QUIT")))
+	c.Close()
+
+	// the timestamps are unique
+	c, other := dial(TestAPOPBackend{})
+	require.NotEqual(greeting, other)
+	c.Close()
+}
+
+// markingSession is a MarkingBackendSession recording it's calls
+type markingSession struct {
+	TestBackendSession
+	sync.Mutex
+
+	marks   []string
+	deleted []int
+}
+
+func (s *markingSession) MarkDeleted(item int, deleted bool) error {
+	s.Lock()
+	defer s.Unlock()
+	s.marks = append(s.marks, fmt.Sprintf("%d %v", item, deleted))
+	return nil
+}
+
+func (s *markingSession) DeleteMessages(items []int) error {
+	s.Lock()
+	defer s.Unlock()
+	s.deleted = items
+	return nil
+}
+
+type markingBackend struct {
+	session *markingSession
+}
+
+func (b markingBackend) NewSession(user, pass []byte) (BackendSession, error) {
+	return b.session, nil
+}
+
+func TestPop3Marking(t *testing.T) {
+	require := require.New(t)
+
+	session := &markingSession{}
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		NewSession(serverConn, markingBackend{session}).Serve()
+		close(done)
+	}()
+	c := textproto.NewConn(clientConn)
+	command := func(format string, args ...interface{}) string {
+		err := c.PrintfLine(format, args...)
+		require.NoError(err, "failed sending command")
+		l, err := c.ReadLine()
+		require.NoError(err, "failed reading response")
+		return l
+	}
+	_, err := c.ReadLine()
+	require.NoError(err, "failed reading banner")
+	require.True(strings.HasPrefix(command("USER %s", testUser), "+OK"))
+	require.True(strings.HasPrefix(command("PASS %s", testPass), "+OK"))
+	require.True(strings.HasPrefix(command("DELE 1"), "+OK"))
+	require.True(strings.HasPrefix(command("RSET"), "+OK"))
+	require.True(strings.HasPrefix(command("DELE 2"), "+OK"))
+	require.True(strings.HasPrefix(command("QUIT"), "+OK"))
+	<-done
+	c.Close()
+
+	session.Lock()
+	defer session.Unlock()
+	require.Equal([]string{"0 true", "0 false", "1 true"}, session.marks)
+	require.Equal([]int{1}, session.deleted)
+}
@@ -0,0 +1,110 @@
+// power.go - low power mode
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package power toggles the low power mode of the client components,
+// for mobile devices on battery. In the low power mode the intervals
+// between the send slots are lengthened and the retransmission and
+// PKI refresh timers are coalesced so that the radio wakes up less
+// often, trading some traffic analysis resistance for battery life.
+package power
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// Component is a client component which has a low power mode,
+// e.g. proxy.SendScheduler, user_pki.KeyRefresher and
+// mix_pki.Prefetcher
+type Component interface {
+	SetLowPower(enabled bool)
+}
+
+// Manager toggles the low power mode of the registered components
+type Manager struct {
+	sync.Mutex
+
+	components []Component
+	lowPower   bool
+}
+
+// New creates a new Manager, the low power mode is initially disabled
+func New() *Manager {
+	return &Manager{}
+}
+
+// Register registers the given component,
+// which is put in the current mode
+func (m *Manager) Register(c Component) {
+	m.Lock()
+	defer m.Unlock()
+	m.components = append(m.components, c)
+	c.SetLowPower(m.lowPower)
+}
+
+// SetLowPower enables or disables the low power mode
+// of all the registered components
+func (m *Manager) SetLowPower(enabled bool) {
+	m.Lock()
+	defer m.Unlock()
+	if enabled == m.lowPower {
+		return
+	}
+	m.lowPower = enabled
+	for _, c := range m.components {
+		c.SetLowPower(enabled)
+	}
+	if enabled {
+		log.Notice("low power mode enabled")
+	} else {
+		log.Notice("low power mode disabled")
+	}
+}
+
+// LowPower returns true if the low power mode is enabled
+func (m *Manager) LowPower() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.lowPower
+}
+
+// ToggleOn toggles the low power mode each time one of the given
+// signals is received, e.g. syscall.SIGUSR1, until the returned
+// function is called
+func (m *Manager) ToggleOn(signals ...os.Signal) func() {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, signals...)
+	go func() {
+		for {
+			select {
+			case <-c:
+				m.SetLowPower(!m.LowPower())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
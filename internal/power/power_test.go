@@ -0,0 +1,73 @@
+// power_test.go - low power mode tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package power
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testComponent struct {
+	sync.Mutex
+	lowPower bool
+	calls    int
+}
+
+func (c *testComponent) SetLowPower(enabled bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.lowPower = enabled
+	c.calls++
+}
+
+func (c *testComponent) state() (bool, int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.lowPower, c.calls
+}
+
+func TestManager(t *testing.T) {
+	require := require.New(t)
+
+	m := New()
+	first := &testComponent{}
+	m.Register(first)
+	m.SetLowPower(true)
+	second := &testComponent{}
+	m.Register(second)
+	lowPower, _ := second.state()
+	require.True(lowPower, "a component registered in low power mode was not switched")
+
+	m.SetLowPower(true)
+	_, calls := first.state()
+	require.Equal(2, calls, "an unchanged mode was applied again")
+
+	stop := m.ToggleOn(syscall.SIGUSR1)
+	defer stop()
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	require.NoError(err, "unexpected Kill error")
+	for i := 0; i < 100 && m.LowPower(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(m.LowPower(), "the signal didn't toggle the low power mode")
+	lowPower, _ = first.state()
+	require.False(lowPower)
+}
@@ -0,0 +1,111 @@
+// compression.go - wire protocol payload compression negotiation
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package proxy provides mixnet client proxies
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	coreConstants "github.com/katzenpost/core/constants"
+)
+
+const (
+	// CompressionNone indicates that bulk wire protocol
+	// payloads are sent uncompressed.
+	CompressionNone = ""
+
+	// CompressionGzip indicates that bulk wire protocol
+	// payloads are gzip compressed.
+	CompressionGzip = "gzip"
+)
+
+// supportedCompression is the list of compression algorithms
+// we support, in order of preference.
+var supportedCompression = []string{CompressionGzip}
+
+// NegotiateCompression returns the compression algorithm to use for
+// bulk wire protocol payloads (retrieval batches) given the list of
+// algorithms advertised by the Provider. CompressionNone is returned
+// if compression is disabled or if the Provider doesn't advertise
+// any of the algorithms we support. Sphinx packets are never compressed
+// because doing so would break their size uniformity.
+func NegotiateCompression(disabled bool, advertised []string) string {
+	if disabled {
+		return CompressionNone
+	}
+	for _, algorithm := range supportedCompression {
+		if isStringInList(algorithm, advertised) {
+			return algorithm
+		}
+	}
+	return CompressionNone
+}
+
+// compressPayload compresses a wire protocol payload
+// with the given compression algorithm
+func compressPayload(algorithm string, payload []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(payload)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
+
+// decompressPayload decompresses a wire protocol payload with the
+// given compression algorithm. The decompressed payload may never be
+// larger than a Sphinx forward payload, this prevents a malicious
+// Provider from making us inflate arbitrarily large payloads.
+func decompressPayload(algorithm string, payload []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, coreConstants.ForwardPayloadLength+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > coreConstants.ForwardPayloadLength {
+			return nil, errors.New("decompressed payload exceeds Sphinx payload size")
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
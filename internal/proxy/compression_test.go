@@ -0,0 +1,125 @@
+// compression_test.go - wire protocol payload compression tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	coreConstants "github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(CompressionGzip, NegotiateCompression(false, []string{"zstd", "GZIP"}))
+	require.Equal(CompressionNone, NegotiateCompression(true, []string{CompressionGzip}))
+	require.Equal(CompressionNone, NegotiateCompression(false, []string{"zstd"}))
+	require.Equal(CompressionNone, NegotiateCompression(false, nil))
+}
+
+func TestCompressionPreservesPayloadSize(t *testing.T) {
+	require := require.New(t)
+
+	senderKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	recipientKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	handler := block.NewHandler(senderKey, rand.Reader)
+
+	messages := [][]byte{
+		[]byte("short"),
+		make([]byte, block.BlockLength),
+		make([]byte, block.BlockLength*3+7),
+	}
+	ciphertextLen := 0
+	for _, message := range messages {
+		blocks, err := fragmentMessage(rand.Reader, message)
+		require.NoError(err, "fragmentMessage failed")
+		for _, b := range blocks {
+			ciphertext, err := handler.Encrypt(recipientKey.PublicKey(), b)
+			require.NoError(err, "Encrypt failed")
+			if ciphertextLen == 0 {
+				ciphertextLen = len(ciphertext)
+			}
+			require.Equal(ciphertextLen, len(ciphertext), "ciphertext size is not uniform")
+
+			compressed, err := compressPayload(CompressionGzip, ciphertext)
+			require.NoError(err, "compressPayload failed")
+			decompressed, err := decompressPayload(CompressionGzip, compressed)
+			require.NoError(err, "decompressPayload failed")
+			require.Equal(ciphertext, decompressed, "round trip altered the payload")
+			require.Equal(ciphertextLen, len(decompressed), "decompressed size is not uniform")
+		}
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	require := require.New(t)
+
+	oversized := make([]byte, coreConstants.ForwardPayloadLength+1)
+	compressed, err := compressPayload(CompressionGzip, oversized)
+	require.NoError(err, "compressPayload failed")
+	_, err = decompressPayload(CompressionGzip, compressed)
+	require.Error(err, "decompressPayload should've failed")
+
+	_, err = decompressPayload("zstd", compressed)
+	require.Error(err, "decompressPayload should've failed")
+}
+
+func TestMessageCompression(t *testing.T) {
+	require := require.New(t)
+
+	message := bytes.Repeat([]byte("Off with her head! "), 1000)
+	compressed, err := compressMessage(message)
+	require.NoError(err, "compressMessage failed")
+	require.True(len(compressed) < len(message), "message not compressed")
+
+	// the last Block of a reassembled message is zero padded
+	padded := append(compressed, make([]byte, block.BlockLength)...)
+	decompressed, err := decompressMessage(padded, len(message))
+	require.NoError(err, "decompressMessage failed")
+	require.Equal(message, decompressed)
+
+	_, err = decompressMessage(padded, len(message)-1)
+	require.Error(err, "decompressMessage should've failed")
+
+	fetcher := NewFetcher("alice@acme.com", nil, nil, nil, nil)
+	flags, payload, err := parseFrame(append(frameHeader(frameCompressed), padded...))
+	require.NoError(err, "parseFrame failed")
+	r, err := fetcher.prepare(payload, flags&frameCompressed != 0, [32]byte{}, [constants.MessageIDLength]byte{}, 1, nil)
+	require.NoError(err, "prepare failed")
+	require.True(bytes.HasSuffix(r.message, message), "compressed message not decompressed")
+
+	// an uncompressed message is never sniffed for compression,
+	// whatever it's body starts with
+	for _, plaintext := range [][]byte{
+		[]byte("KPZ1 is not a gzip stream"),
+		append([]byte("KPZ1"), compressed...),
+	} {
+		flags, payload, err := parseFrame(append(frameHeader(0), plaintext...))
+		require.NoError(err, "parseFrame failed")
+		r, err := fetcher.prepare(payload, flags&frameCompressed != 0, [32]byte{}, [constants.MessageIDLength]byte{}, 1, nil)
+		require.NoError(err, "prepare failed")
+		require.True(bytes.HasSuffix(r.message, plaintext), "uncompressed message altered")
+	}
+}
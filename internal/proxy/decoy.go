@@ -0,0 +1,152 @@
+// decoy.go - loop and drop decoy traffic
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// sendDecoy sends a decoy Sphinx packet with an all zero payload
+// through the mixnet. A loop decoy is addressed to the Sender's own
+// account, whose Fetcher discards it, and a drop decoy to a random
+// recipient ID of the Sender's Provider, which discards it. Decoys
+// don't take room in the send window as they aren't ACKed.
+func (s *Sender) sendDecoy(loop bool) error {
+	err := s.checkCap()
+	if err != nil {
+		return err
+	}
+	user, provider, err := config.SplitEmail(s.identity)
+	if err != nil {
+		return err
+	}
+	recipientID := [constants.RecipientIDLength]byte{}
+	if loop {
+		copy(recipientID[:], user)
+	} else {
+		_, err = io.ReadFull(s.randReader, recipientID[:])
+		if err != nil {
+			return err
+		}
+	}
+	forwardPath, _, _, _, err := s.routeFactory.Build(provider, provider, recipientID)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, sphinx.SURBLength+block.CiphertextLength)
+	sphinxPacket, err := sphinx.NewPacket(s.randReader, forwardPath, payload)
+	if err != nil {
+		return err
+	}
+	err = s.channels[0].send(&commands.SendPacket{SphinxPacket: sphinxPacket})
+	if err != nil {
+		return err
+	}
+	recordUsage(s.store, s.identity, len(sphinxPacket), 0)
+	return nil
+}
+
+// SetCoverTraffic enables or disables the loop and drop decoys of
+// the senders with a traffic profile, see config.CoverTrafficEnabled.
+// While enabled the empty send slots carry a drop decoy.
+func (s *SendScheduler) SetCoverTraffic(enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.coverTraffic = enabled
+	for sender := range s.senders {
+		s.startDecoys(sender)
+	}
+}
+
+// startDecoys stops the decoys of the given sender and starts
+// those of it's current traffic profile, if cover traffic is
+// enabled. The caller must hold the lock.
+func (s *SendScheduler) startDecoys(sender string) {
+	if halt, ok := s.decoyHalts[sender]; ok {
+		close(halt)
+		delete(s.decoyHalts, sender)
+	}
+	profile := s.profiles[sender]
+	if !s.coverTraffic || profile == nil {
+		return
+	}
+	halt := make(chan struct{})
+	s.decoyHalts[sender] = halt
+	if interval := profile.LoopDecoyInterval(); interval > 0 {
+		s.goDecoys("loop decoys "+sender, sender, true, interval, halt)
+	}
+	if interval := profile.DropDecoyInterval(); interval > 0 {
+		s.goDecoys("drop decoys "+sender, sender, false, interval, halt)
+	}
+}
+
+// goDecoys runs the decoyLoop of the given sender,
+// by the Supervisor if one is set
+func (s *SendScheduler) goDecoys(name, sender string, loop bool, interval time.Duration, halt chan struct{}) {
+	if s.supervisor == nil {
+		go s.decoyLoop(sender, loop, interval, halt, nil)
+		return
+	}
+	s.supervisor.Go(name, func(stop <-chan struct{}) error {
+		s.decoyLoop(sender, loop, interval, halt, stop)
+		return nil
+	})
+}
+
+// decoyLoop sends the loop or drop decoys of the given sender at
+// exponentially distributed intervals of the given mean until halted
+func (s *SendScheduler) decoyLoop(sender string, loop bool, meanInterval time.Duration, halt chan struct{}, stop <-chan struct{}) {
+	rng := entropy.NewMath()
+	for {
+		s.Lock()
+		interval := meanInterval
+		if s.lowPower {
+			interval *= constants.LowPowerSlotFactor
+		}
+		delay := time.Duration(rand.Exp(rng, 1/float64(interval)))
+		timer := s.clock.NewTimer(delay)
+		s.Unlock()
+		select {
+		case <-halt:
+			timer.Stop()
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		s.sendDecoy(sender, loop)
+	}
+}
+
+// sendDecoy sends a decoy of the given sender, the
+// failures are only logged as no message is lost
+func (s *SendScheduler) sendDecoy(sender string, loop bool) {
+	err := s.senders[sender].sendDecoy(loop)
+	if err != nil {
+		log.Debugf("failed to send a decoy of %s: %s", sender, err)
+	}
+}
@@ -0,0 +1,209 @@
+// deferred.go - deferred sending of submitted messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/storage"
+)
+
+// SendAfterHeader is the header of a submitted message which holds
+// it until the given time, either an RFC 5322 date or an RFC 3339
+// timestamp. It's removed from the message.
+const SendAfterHeader = "X-Mix-Send-After"
+
+// deferredRetryInterval is the delay after which the
+// deferred messages which failed to be queued are retried
+const deferredRetryInterval = time.Minute
+
+// parseSendAfter parses the value of a SendAfterHeader
+func parseSendAfter(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	t, err := mail.ParseDate(value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// DeferredSender holds submitted messages in the Store until their
+// send time, and then hands them to the fragmentation and send
+// pipeline. The held messages survive restarts.
+type DeferredSender struct {
+	sync.Mutex
+
+	store        *storage.Store
+	scheduler    *SendScheduler
+	randomReader io.Reader
+	clock        clock.Clock
+	timer        clock.Timer
+	next         time.Time
+	stopped      bool
+}
+
+// NewDeferredSender creates a new DeferredSender
+// which queues the messages with the given scheduler
+func NewDeferredSender(store *storage.Store, scheduler *SendScheduler) *DeferredSender {
+	d := DeferredSender{
+		store:        store,
+		scheduler:    scheduler,
+		randomReader: entropy.Reader,
+		clock:        clock.Real,
+		stopped:      true,
+	}
+	return &d
+}
+
+// Defer holds the message until the given time and returns it's
+// ID, copy is filed into the sender's Sent folder once it's sent.
+// The message is sent in Blocks with the given flags. The given
+// submission, if any, is recorded with the message atomically.
+func (d *DeferredSender) Defer(sender, recipient string, message, copy []byte, flags uint8, sendAfter time.Time, priority storage.Priority, submission *storage.Submission) (uint64, error) {
+	id, err := d.store.PutSubmittedDeferredMessage(&storage.DeferredMessage{
+		Sender:    sender,
+		Recipient: recipient,
+		SendAfter: sendAfter,
+		Priority:  priority,
+		Message:   message,
+		Flags:     flags,
+		Copy:      copy,
+	}, submission)
+	if err != nil {
+		return 0, err
+	}
+	log.Debugf("deferred message %d from %s to %s until %s", id, sender, recipient, sendAfter)
+	d.Lock()
+	defer d.Unlock()
+	if !d.stopped {
+		d.schedule(sendAfter)
+	}
+	return id, nil
+}
+
+// Cancel cancels the deferred message with the given ID,
+// storage.ErrKeyNotFound is returned if it was already sent
+func (d *DeferredSender) Cancel(id uint64) error {
+	return d.store.RemoveDeferredMessage(id)
+}
+
+// SetClock sets the Clock telling the send times, e.g.
+// a clock.Fake in tests. It must be set before Start.
+func (d *DeferredSender) SetClock(c clock.Clock) {
+	d.Lock()
+	defer d.Unlock()
+	d.clock = c
+}
+
+// Start sends the deferred messages which are due
+// and schedules the sending of the others
+func (d *DeferredSender) Start() {
+	d.Lock()
+	d.stopped = false
+	d.Unlock()
+	d.release()
+}
+
+// Stop stops sending the deferred messages
+func (d *DeferredSender) Stop() {
+	d.Lock()
+	defer d.Unlock()
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+// schedule arms the timer to release the deferred messages at
+// the given time, unless it's armed to release them earlier. It
+// must be called with the lock held.
+func (d *DeferredSender) schedule(at time.Time) {
+	if d.timer != nil && d.timer.Stop() && d.next.Before(at) {
+		at = d.next
+	}
+	d.next = at
+	d.timer = d.clock.AfterFunc(at.Sub(d.clock.Now()), d.release)
+}
+
+// release queues the deferred messages which are
+// due and schedules the next release
+func (d *DeferredSender) release() {
+	messages, err := d.store.DeferredMessages()
+	if err != nil {
+		log.Errorf("failed to read the deferred messages: %s", err)
+		d.reschedule(d.clock.Now().Add(deferredRetryInterval))
+		return
+	}
+	now := d.clock.Now()
+	next := time.Time{}
+	for _, m := range messages {
+		if m.SendAfter.After(now) {
+			if next.IsZero() || m.SendAfter.Before(next) {
+				next = m.SendAfter
+			}
+			continue
+		}
+		err = d.send(m)
+		if err != nil {
+			log.Errorf("failed to send deferred message %d from %s: %s", m.ID, m.Sender, err)
+			retry := now.Add(deferredRetryInterval)
+			if next.IsZero() || retry.Before(next) {
+				next = retry
+			}
+		}
+	}
+	if !next.IsZero() {
+		d.reschedule(next)
+	}
+}
+
+// reschedule arms the timer unless the DeferredSender is stopped
+func (d *DeferredSender) reschedule(at time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.stopped {
+		d.schedule(at)
+	}
+}
+
+// send queues the given deferred message and removes it from the
+// Store, a crash in between sends the message twice rather than
+// losing it
+func (d *DeferredSender) send(m *storage.DeferredMessage) error {
+	_, err := enqueueMessage(d.randomReader, d.store, d.scheduler, m.Sender, m.Recipient, m.Message, m.Flags, m.Priority, nil)
+	if err != nil {
+		return err
+	}
+	err = d.store.RemoveDeferredMessage(m.ID)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return err
+	}
+	if m.Copy != nil {
+		_, err = d.store.PutFolderMessage(m.Sender, storage.FolderSent, m.Copy)
+		if err != nil {
+			log.Errorf("failed to file the message sent by %s: %s", m.Sender, err)
+		}
+	}
+	return nil
+}
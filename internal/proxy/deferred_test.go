@@ -0,0 +1,97 @@
+// deferred_test.go - deferred sending tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSendAfter(t *testing.T) {
+	require := require.New(t)
+
+	expected := time.Date(2017, 11, 3, 12, 0, 0, 0, time.UTC)
+	sendAfter, err := parseSendAfter("Fri, 03 Nov 2017 12:00:00 +0000")
+	require.NoError(err, "unexpected parseSendAfter() error")
+	require.True(expected.Equal(sendAfter))
+	sendAfter, err = parseSendAfter(" 2017-11-03T13:00:00+01:00")
+	require.NoError(err, "unexpected parseSendAfter() error")
+	require.True(expected.Equal(sendAfter))
+	_, err = parseSendAfter("tomorrow")
+	require.Error(err)
+}
+
+func TestDeferredSender(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "deferred_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	// the Blocks stay in the send slot queue
+	s := NewSendScheduler(map[string]*Sender{})
+	s.EnableSendSlots(time.Hour, true)
+	defer s.StopSendSlots()
+	d := NewDeferredSender(store, s)
+	now := time.Unix(1500000000, 0)
+	c := clock.NewFake(now)
+	d.SetClock(c)
+
+	_, err = d.Defer(account, "bob@nsa.gov", []byte("later"), []byte("later copy"), 0, now.Add(time.Hour), storage.PriorityBulk, nil)
+	require.NoError(err, "unexpected Defer() error")
+	cancelled, err := d.Defer(account, "bob@nsa.gov", []byte("never"), nil, 0, now.Add(time.Minute), storage.PriorityBulk, nil)
+	require.NoError(err, "unexpected Defer() error")
+	err = d.Cancel(cancelled)
+	require.NoError(err, "unexpected Cancel() error")
+	err = d.Cancel(cancelled)
+	require.Equal(storage.ErrKeyNotFound, err)
+
+	d.release()
+	deferred, err := store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Equal(1, len(deferred))
+	blocks, err := store.EgressBlocks()
+	require.NoError(err, "unexpected EgressBlocks() error")
+	require.Equal(0, len(blocks))
+
+	c.Advance(time.Hour)
+	d.release()
+	deferred, err = store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Equal(0, len(deferred))
+	blocks, err = store.EgressBlocks()
+	require.NoError(err, "unexpected EgressBlocks() error")
+	require.Equal(1, len(blocks))
+	require.Equal("bob@nsa.gov", blocks[0].Recipient)
+	require.NotNil(s.nextSlotBlock("alice@acme.com"))
+	sent, err := store.FolderMessages(account, storage.FolderSent)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Equal(1, len(sent))
+	require.Equal([]byte("later copy"), sent[0].Message)
+}
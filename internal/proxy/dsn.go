@@ -0,0 +1,79 @@
+// dsn.go - delivery status notifications
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/client/internal/l10n"
+	"github.com/katzenpost/client/storage"
+)
+
+const (
+	// dsnBoundary is the MIME boundary of the parts
+	// of our delivery status notifications
+	dsnBoundary = "mixclient-dsn-boundary"
+
+	// dsnActionDelivered is the DSN action reported when all
+	// the Blocks of a message were acknowledged
+	dsnActionDelivered = "delivered"
+
+	// dsnActionRelayed is the DSN action reported when all the
+	// Blocks of a message were sent but some of them were sent
+	// with a SURB of the recipient, their ACK can't be received
+	dsnActionRelayed = "relayed"
+
+	// dsnActionFailed is the DSN action reported when
+	// retransmission of a message was given up
+	dsnActionFailed = "failed"
+)
+
+// composeDSN returns an RFC 3464 delivery status notification
+// addressed to the sender of the given Block's message
+// in the given language
+func composeDSN(b *storage.EgressBlock, action, language string, now time.Time) []byte {
+	subject := l10n.Header(language, l10n.DSNSuccessSubject)
+	status := "2.0.0"
+	explanation := l10n.Sprintf(language, l10n.DSNSuccessBody, b.Recipient, b.Block.TotalBlocks)
+	switch action {
+	case dsnActionRelayed:
+		explanation = l10n.Sprintf(language, l10n.DSNRelayedBody, b.Recipient, b.Block.TotalBlocks)
+	case dsnActionFailed:
+		subject = l10n.Header(language, l10n.DSNFailureSubject)
+		status = "5.4.7"
+		explanation = l10n.Sprintf(language, l10n.DSNFailureBody, b.Recipient, b.SendAttempts)
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: MAILER-DAEMON@%s\n", b.SenderProvider)
+	fmt.Fprintf(buf, "To: %s\n", b.Sender)
+	fmt.Fprintf(buf, "Subject: %s\n", subject)
+	fmt.Fprintf(buf, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "%s: auto-replied\n", autoSubmittedHeader)
+	fmt.Fprintf(buf, "MIME-Version: 1.0\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\n\n", dsnBoundary)
+	fmt.Fprintf(buf, "--%s\nContent-Type: text/plain; charset=utf-8\n\n%s\n\n", dsnBoundary, explanation)
+	fmt.Fprintf(buf, "--%s\nContent-Type: message/delivery-status\n\n", dsnBoundary)
+	fmt.Fprintf(buf, "Reporting-MTA: dns; %s\n", b.SenderProvider)
+	fmt.Fprintf(buf, "X-Mix-Message-ID: %x\n\n", b.Block.MessageID)
+	fmt.Fprintf(buf, "Final-Recipient: rfc822; %s\n", b.Recipient)
+	fmt.Fprintf(buf, "Action: %s\n", action)
+	fmt.Fprintf(buf, "Status: %s\n\n", status)
+	fmt.Fprintf(buf, "--%s--\n", dsnBoundary)
+	return buf.Bytes()
+}
@@ -0,0 +1,177 @@
+// dsn_test.go - delivery status notification tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryStatusNotifications(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "dsn_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	sender := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{sender})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender, store: store},
+	})
+	surbCount := 0
+	putMessage := func(message []byte) []*storage.EgressBlock {
+		blocks, err := fragmentMessage(rand.Reader, message)
+		require.NoError(err, "fragmentMessage failed")
+		egressBlocks := []*storage.EgressBlock{}
+		for _, b := range blocks {
+			egressBlock := storage.EgressBlock{
+				Sender:            sender,
+				SenderProvider:    "acme.com",
+				Recipient:         "bob@nsa.gov",
+				RecipientProvider: "nsa.gov",
+				Block:             *b,
+			}
+			surbCount += 1
+			egressBlock.SURBID[0] = byte(surbCount)
+			_, err := store.PutEgressBlock(&egressBlock)
+			require.NoError(err, "PutEgressBlock failed")
+			s.pending[egressBlock.SURBID] = &egressBlock
+			egressBlocks = append(egressBlocks, &egressBlock)
+		}
+		return egressBlocks
+	}
+
+	delivered := putMessage(make([]byte, block.BlockLength+1))
+	require.Equal(2, len(delivered))
+	s.Cancel(delivered[0].SURBID)
+	messages, err := store.Messages(sender)
+	require.NoError(err, "Messages failed")
+	require.Equal(0, len(messages), "DSN sent before all blocks were ACKed")
+	s.Cancel(delivered[1].SURBID)
+	messages, err = store.Messages(sender)
+	require.NoError(err, "Messages failed")
+	require.Equal(1, len(messages), "no DSN sent")
+	m, err := mail.ReadMessage(bytes.NewReader(messages[0]))
+	require.NoError(err, "ReadMessage failed")
+	require.Equal(sender, m.Header.Get("To"))
+	require.Contains(m.Header.Get("Content-Type"), "report-type=delivery-status")
+	body, err := ioutil.ReadAll(m.Body)
+	require.NoError(err, "ReadAll failed")
+	require.Contains(string(body), "Action: delivered")
+	require.Contains(string(body), "Final-Recipient: rfc822; bob@nsa.gov")
+
+	failed := putMessage([]byte("hello"))
+	failed[0].SendAttempts = constants.MaxSendAttempts
+	s.handleSend(&retransmission{storageBlock: failed[0]})
+	messages, err = store.Messages(sender)
+	require.NoError(err, "Messages failed")
+	require.Equal(2, len(messages), "no DSN sent")
+	require.Contains(string(messages[1]), "Action: failed")
+	keys, err := store.GetKeys()
+	require.NoError(err, "GetKeys failed")
+	require.Equal(0, len(keys), "blocks of the failed message were not removed")
+
+	events, err := store.Events(time.Time{}, 0)
+	require.NoError(err, "Events failed")
+	require.Equal(2, len(events))
+	require.Equal(storage.EventMessageAcked, events[0].Type)
+	require.Equal(fmt.Sprintf("%x", delivered[0].Block.MessageID), events[0].MessageID)
+	require.Equal(storage.EventMessageBounced, events[1].Type)
+}
+
+func TestRelayedBlocks(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "dsn_test2")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	sender := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{sender})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender, store: store},
+	})
+	blocks, err := fragmentMessage(rand.Reader, make([]byte, block.BlockLength+1))
+	require.NoError(err, "fragmentMessage failed")
+	require.Equal(2, len(blocks))
+	egressBlocks := []*storage.EgressBlock{}
+	for i, b := range blocks {
+		egressBlock := storage.EgressBlock{
+			Sender:            sender,
+			SenderProvider:    "acme.com",
+			Recipient:         "bob@nsa.gov",
+			RecipientProvider: "nsa.gov",
+			Block:             *b,
+		}
+		egressBlock.SURBID[0] = byte(i + 1)
+		_, err := store.PutEgressBlock(&egressBlock)
+		require.NoError(err, "PutEgressBlock failed")
+		egressBlocks = append(egressBlocks, &egressBlock)
+	}
+
+	// the first Block was last sent with a received SURB on
+	// it's final attempt, it's forgotten rather than bounced
+	relayed := egressBlocks[0]
+	relayed.SendAttempts = constants.MaxSendAttempts
+	s.forget(relayed)
+	require.Equal(0, len(s.pending))
+	s.handleSend(&retransmission{storageBlock: relayed})
+	keys, err := store.GetKeys()
+	require.NoError(err, "GetKeys failed")
+	require.Equal(1, len(keys), "relayed block was not removed")
+	messages, err := store.Messages(sender)
+	require.NoError(err, "Messages failed")
+	require.Equal(0, len(messages), "DSN sent before all blocks were sent")
+
+	// the second Block is ACKed, the message can't be reported
+	// as delivered since the first Block wasn't ACKed
+	acked := egressBlocks[1]
+	acked.SURBKeys = []byte{1}
+	s.pending[acked.SURBID] = acked
+	s.Cancel(acked.SURBID)
+	messages, err = store.Messages(sender)
+	require.NoError(err, "Messages failed")
+	require.Equal(1, len(messages), "no DSN sent")
+	require.Contains(string(messages[0]), "Action: relayed")
+	require.Equal(0, len(s.relayed))
+
+	events, err := store.Events(time.Time{}, 0)
+	require.NoError(err, "Events failed")
+	for _, e := range events {
+		require.NotEqual(storage.EventMessageBounced, e.Type)
+	}
+}
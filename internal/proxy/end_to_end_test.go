@@ -18,6 +18,7 @@ package proxy
 
 import (
 	"context"
+	"encoding/base64"
 	"io/ioutil"
 	"net"
 	"net/textproto"
@@ -26,7 +27,8 @@ import (
 	//"time"
 
 	"github.com/katzenpost/client/config"
-	"github.com/katzenpost/client/path_selection"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/storage"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/epochtime"
@@ -67,7 +69,9 @@ func TestEndToEndProxy(t *testing.T) {
 	}
 	sendScheduler := NewSendScheduler(senders)
 
+	alicePassword := "any_password"
 	submitProxy := NewSmtpProxy(&accounts, rand.Reader, userPKI, aliceStore, alicePool, routeFactory, sendScheduler)
+	submitProxy.SetPasswords(map[string]string{aliceEmail: alicePassword})
 	aliceServerConn, aliceClientConn := net.Pipe()
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -94,13 +98,20 @@ func TestEndToEndProxy(t *testing.T) {
 		require.NoError(err, "failed reading banner")
 		t.Logf("S->C: '%s'", l)
 
-		err = c.PrintfLine("helo localhost")
+		err = c.PrintfLine("ehlo localhost")
 		require.NoError(err, "failed sending")
 
-		l, err = c.ReadLine()
+		_, l, err = c.ReadResponse(250)
 		require.NoError(err, "failed reading")
 		t.Logf("S->C: '%s'", l)
 
+		err = c.PrintfLine("auth plain %s", base64.StdEncoding.EncodeToString([]byte("\x00"+aliceEmail+"\x00"+alicePassword)))
+		require.NoError(err, "failed sending auth")
+
+		_, l, err = c.ReadResponse(235)
+		require.NoError(err, "failed authenticating")
+		t.Logf("S->C: '%s'", l)
+
 		err = c.PrintfLine("mail from:<%s>", aliceEmail)
 		require.NoError(err, "failed sending mail from:")
 
@@ -132,6 +143,12 @@ func TestEndToEndProxy(t *testing.T) {
 
 	wg.Wait()
 
+	// a copy of the message was filed into Alice's Sent folder
+	sent, err := aliceStore.FolderMessages(aliceEmail, storage.FolderSent)
+	require.NoError(err, "FolderMessages failure")
+	require.Equal(1, len(sent))
+	require.Contains(string(sent[0].Message), "super short message")
+
 	// decrypt Alice's captured sphinx packet
 	aliceSession := alicePool.Sessions["alice@acme.com"]
 	mockAliceSession, ok := aliceSession.(*MockSession)
@@ -189,7 +206,9 @@ func TestEndToEndProxy(t *testing.T) {
 	//periodicRetriever := NewFetchScheduler(fetchers, duration)
 	//periodicRetriever.Start()
 
+	bobsPassword := "any_password"
 	pop3Service := NewPop3Service(bobStore)
+	pop3Service.SetPasswords(map[string]string{bobEmail: bobsPassword})
 	bobPop3ServerConn, bobPop3ClientConn := net.Pipe()
 
 	wg.Add(2)
@@ -224,7 +243,6 @@ func TestEndToEndProxy(t *testing.T) {
 		t.Logf("S->C: '%s'", l)
 
 		// PASS
-		bobsPassword := "any_password"
 		err = c.PrintfLine("PASS %s", bobsPassword)
 		require.NoError(err, "failed sending PASS")
 		l, err = c.ReadLine()
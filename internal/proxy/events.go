@@ -0,0 +1,41 @@
+// events.go - structured event recording
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+)
+
+// recordEvent records an event in the Store's event log, failures
+// are only logged because the event log is purely informational
+func recordEvent(store *storage.Store, eventType storage.EventType, account string, messageID *[constants.MessageIDLength]byte, detail string) {
+	e := storage.Event{
+		Type:    eventType,
+		Account: account,
+		Detail:  detail,
+	}
+	if messageID != nil {
+		e.MessageID = fmt.Sprintf("%x", *messageID)
+	}
+	err := store.RecordEvent(&e)
+	if err != nil {
+		log.Errorf("failed to record %s event: %s", eventType, err)
+	}
+}
@@ -0,0 +1,839 @@
+// fetch.go - client message retrieval
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package proxy provides mixnet client proxies
+package proxy
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/crypto/envelope"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/log_limiter"
+	"github.com/katzenpost/client/internal/mail_filter"
+	"github.com/katzenpost/client/internal/scheduler"
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// Fetcher fetches messages for a given account identity
+type Fetcher struct {
+	Identity    string
+	sequence    uint32
+	pool        *session_pool.SessionPool
+	store       *storage.Store
+	scheduler   *SendScheduler
+	handler     *block.Handler
+	compression string
+	identityKey *ecdh.PrivateKey
+	kemKey      *mlkem.DecapsulationKey768
+	discard     bool
+	connected   bool
+	quota       uint64
+	full        bool
+	filter      mail_filter.Filter
+	reassembler *reassembler
+	supervisor  *supervisor.Supervisor
+	clock       clock.Clock
+
+	// lock guards deferred, hasDeferred and failed,
+	// updated by the reassembly workers
+	lock        sync.Mutex
+	hasDeferred bool
+	deferred    map[[constants.MessageIDLength]byte]bool
+	// failed holds the reassemblies which failed and are
+	// retried, see retryFailed
+	failed map[[constants.MessageIDLength]byte]failedReassembly
+	// quotaLock serializes the deliveries of an account
+	// with a mailbox quota, see deliver
+	quotaLock sync.Mutex
+}
+
+// failedReassembly is a reassembly which failed
+type failedReassembly struct {
+	totalBlocks uint16
+	err         error
+}
+
+// retrieveTimeout is the maximum duration a multiplexed
+// Fetch waits for the response of the Provider
+const retrieveTimeout = time.Minute
+
+func NewFetcher(identity string, pool *session_pool.SessionPool, store *storage.Store, scheduler *SendScheduler, handler *block.Handler) *Fetcher {
+	return &Fetcher{
+		Identity:  identity,
+		pool:      pool,
+		store:     store,
+		scheduler: scheduler,
+		handler:   handler,
+		deferred:  make(map[[constants.MessageIDLength]byte]bool),
+		failed:    make(map[[constants.MessageIDLength]byte]failedReassembly),
+		clock:     clock.Real,
+	}
+}
+
+// SetClock sets the Clock telling the epochs of the received SURBs
+// and the times of the synthesized headers and notices, e.g. a
+// clock.Fake in tests, see FetchScheduler.SetClock
+func (f *Fetcher) SetClock(c clock.Clock) {
+	f.clock = c
+}
+
+// SetFilter sets the Filter deciding whether the
+// received messages are delivered, see package mail_filter
+func (f *Fetcher) SetFilter(filter mail_filter.Filter) {
+	f.filter = filter
+}
+
+// SetCompression sets the compression algorithm negotiated
+// with the Provider for retrieved payloads.
+// See NegotiateCompression.
+func (f *Fetcher) SetCompression(algorithm string) {
+	f.compression = algorithm
+}
+
+// DiscardMessages causes received messages to be dropped
+// instead of being delivered to the mailbox, which is used by
+// send only deployments. ACKs are still processed.
+func (f *Fetcher) DiscardMessages() {
+	f.discard = true
+}
+
+// SetIdentityKey sets the private key used to open
+// end to end encrypted messages. See envelope.Open.
+func (f *Fetcher) SetIdentityKey(identityKey *ecdh.PrivateKey) {
+	f.identityKey = identityKey
+}
+
+// SetKEMKey sets the ML-KEM-768 private key used to open the
+// experimental hybrid envelopes. See envelope.OpenHybrid.
+func (f *Fetcher) SetKEMKey(kemKey *mlkem.DecapsulationKey768) {
+	f.kemKey = kemKey
+}
+
+// SetSupervisor sets the Supervisor recovering the panics of
+// the reassembly workers, it must be set before SetReassemblyWorkers
+func (f *Fetcher) SetSupervisor(sup *supervisor.Supervisor) {
+	f.supervisor = sup
+}
+
+// SetReassemblyWorkers starts the given number of workers reassembling
+// the received messages in parallel, the Blocks of a message are
+// processed in order. Without workers the messages are reassembled
+// by Fetch. It must be set before the first Fetch.
+func (f *Fetcher) SetReassemblyWorkers(workers int) {
+	if workers > 0 {
+		f.reassembler = newReassembler(f.Identity, workers, f.reassemble)
+		f.reassembler.supervisor = f.supervisor
+	}
+}
+
+// Halt stops the reassembly workers once
+// the received messages are reassembled
+func (f *Fetcher) Halt() {
+	if f.reassembler != nil {
+		f.reassembler.halt()
+	}
+}
+
+// openMessage decrypts the message if it's framing flags mark an
+// end to end encrypted envelope, see frameSealed, the envelope's
+// magic tells it's suite, plaintext messages are returned unaltered
+func (f *Fetcher) openMessage(message []byte, flags uint8) ([]byte, error) {
+	if flags&frameSealed == 0 {
+		return message, nil
+	}
+	if envelope.IsHybridSealed(message) {
+		if f.identityKey == nil || f.kemKey == nil {
+			return nil, errors.New("received hybrid encrypted message but no KEM key is set")
+		}
+		return envelope.OpenHybrid(f.identityKey, f.kemKey, message)
+	}
+	if f.identityKey == nil {
+		return nil, errors.New("received encrypted message but no identity key is set")
+	}
+	return envelope.Open(f.identityKey, message)
+}
+
+// Fetch fetches a message and returns
+// the queue size hint or an error.
+// The fetched message is then handled
+// by either storing it in the DB or
+// by cancelling a retransmit if it's an ACK message.
+// The retrieval is acknowledged by the sequence number
+// of the next fetch, also when the queue was empty.
+// While the mailbox is full the ACKs are still processed,
+// a message Block is left at the Provider unacknowledged
+// until space is freed, see SetMailboxQuota.
+func (f *Fetcher) Fetch() (uint8, error) {
+	var queueHintSize uint8
+	full, err := f.checkQuota()
+	if err != nil {
+		return uint8(0), err
+	}
+	cmd := commands.RetrieveMessage{
+		Sequence: f.sequence,
+	}
+	rSeq := uint32(0)
+	var recvCmd commands.Command
+	if mux := f.pool.Mux(f.Identity); mux != nil {
+		recvCmd, err = mux.Request(cmd, retrieveTimeout)
+	} else {
+		recvCmd, err = f.retrieve(cmd)
+	}
+	if err != nil {
+		f.setConnected(false, err)
+		return uint8(0), err
+	}
+	f.setConnected(true, nil)
+	if ack, ok := recvCmd.(commands.MessageACK); ok {
+		log.Debug("retrieved MessageACK")
+		queueHintSize = ack.QueueSizeHint
+		rSeq = ack.Sequence
+		recordUsage(f.store, f.Identity, 0, len(ack.Payload))
+		err := f.processAck(ack.ID, ack.Payload)
+		if err != nil {
+			return uint8(0), err
+		}
+	} else if message, ok := recvCmd.(commands.Message); ok {
+		log.Debug("retrieved Message")
+		recordUsage(f.store, f.Identity, 0, len(message.Payload))
+		if full {
+			// the same sequence number retrieves it again
+			log.Debugf("leaving a message for %s at the Provider, the mailbox is full", f.Identity)
+			return uint8(0), nil
+		}
+		queueHintSize = message.QueueSizeHint
+		rSeq = message.Sequence
+		err := f.processMessage(message.Payload)
+		if err != nil {
+			return uint8(0), err
+		}
+	} else if empty, ok := recvCmd.(commands.MessageEmpty); ok {
+		log.Debug("retrieved MessageEmpty")
+		rSeq = empty.Sequence
+	} else {
+		err := errors.New("retrieved non-Message/MessageACK/MessageEmpty wire protocol command")
+		log.Debug(err)
+		return uint8(0), err
+	}
+	if rSeq != f.sequence {
+		err := errors.New("received sequence mismatch")
+		log.Debug(err)
+		return uint8(0), err
+	}
+	f.sequence += 1
+	return queueHintSize, nil
+}
+
+// retrieve sends the given RetrieveMessage command
+// and returns the response of the Provider
+func (f *Fetcher) retrieve(cmd commands.RetrieveMessage) (commands.Command, error) {
+	session, mutex, err := f.pool.Get(f.Identity)
+	if err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	err = session.SendCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return session.RecvCommand()
+}
+
+// setConnected records a session event
+// when the state of the session changes
+func (f *Fetcher) setConnected(connected bool, err error) {
+	if connected == f.connected {
+		return
+	}
+	f.connected = connected
+	if connected {
+		recordEvent(f.store, storage.EventSessionConnected, f.Identity, nil, "")
+		return
+	}
+	recordEvent(f.store, storage.EventSessionLost, f.Identity, nil, err.Error())
+	_, provider, splitErr := config.SplitEmail(f.Identity)
+	if splitErr != nil {
+		return
+	}
+	err = f.store.RecordDisconnect(provider)
+	if err != nil {
+		log.Errorf("failed to record disconnect from %s: %s", provider, err)
+	}
+}
+
+// processAck is used by our Stop and Wait ARQ to cancel
+// the retransmit timer
+func (f *Fetcher) processAck(id [constants.SURBIDLength]byte, payload []byte) error {
+	// Ensure payload bytes are all zeros.
+	// see Panoramix Mix Network End-to-end Protocol Specification
+	// https://github.com/Katzenpost/docs/blob/master/specs/end_to_end.txt
+	// Section 4.2.2 Client Protocol Acknowledgment Processing (SURB-ACKs).
+	surb, err := f.store.RedeemSURB(f.Identity, id)
+	if err == nil {
+		return f.processReply(surb, payload)
+	}
+	if err != storage.ErrKeyNotFound {
+		return err
+	}
+	if !utils.CtIsZero(payload) {
+		// the Provider delivers the payload of the
+		// ACK encrypted with the keys of our SURB
+		plaintext, err := f.scheduler.decryptACK(id, payload)
+		if err != nil || !utils.CtIsZero(plaintext) {
+			return errors.New("ACK payload bytes are not all 0x00")
+		}
+	}
+	replayed, err := f.store.SeenSURBID(f.Identity, id)
+	if err != nil {
+		return err
+	}
+	if replayed {
+		log.Debugf("dropping replayed ACK with SURB ID %x", id)
+		return nil
+	}
+	f.scheduler.Cancel(id)
+	return nil
+}
+
+// processReply decrypts a message Block sent to us with
+// a SURB we issued and processes it like other messages
+func (f *Fetcher) processReply(surb *storage.PooledSURB, payload []byte) error {
+	plaintext, err := sphinx.DecryptSURBPayload(payload, surb.Keys)
+	if err != nil {
+		return err
+	}
+	if len(plaintext) < sphinx.SURBLength {
+		return errors.New("SURB reply payload is truncated")
+	}
+	log.Debugf("received a reply from %s with SURB ID %x", surb.Correspondent, surb.ID)
+	if f.discard {
+		log.Debug("discarding message received by send only account")
+		return nil
+	}
+	if utils.CtIsZero(payload) {
+		log.Debug("discarding loop decoy")
+		return nil
+	}
+	return f.processBlock(plaintext[sphinx.SURBLength:])
+}
+
+// processMessage receives a message Block, decrypts it and
+// writes it to our local bolt db for eventual processing.
+func (f *Fetcher) processMessage(payload []byte) error {
+	if f.discard {
+		log.Debug("discarding message received by send only account")
+		return nil
+	}
+	if utils.CtIsZero(payload) {
+		log.Debug("discarding loop decoy")
+		return nil
+	}
+	payload, err := decompressPayload(f.compression, payload)
+	if err != nil {
+		return err
+	}
+	return f.processBlock(payload)
+}
+
+// processBlock decrypts the given Block ciphertext and writes
+// it to our local bolt db for eventual processing. The message
+// is reassembled by the reassembly workers if they're started.
+func (f *Fetcher) processBlock(payload []byte) error {
+	b, peerKey, err := f.handler.Decrypt(payload)
+	if err != nil {
+		return err
+	}
+	s := [32]byte{}
+	copy(s[:], peerKey.Bytes())
+	ingressBlock := storage.IngressBlock{
+		S:     s,
+		Block: b,
+	}
+	err = f.store.PutIngressBlock(f.Identity, &ingressBlock)
+	if err == storage.ErrReplay {
+		log.Debugf("dropping replayed block %d of message %x", b.BlockID, b.MessageID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.reassembler != nil {
+		return f.reassembler.submit(b.MessageID, b.TotalBlocks)
+	}
+	return f.reassemble(b.MessageID, b.TotalBlocks)
+}
+
+// reassemble reassembles the message with the given ID, see
+// assemble. A failed reassembly is retried by retryFailed.
+func (f *Fetcher) reassemble(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error {
+	err := f.assemble(messageID, totalBlocks)
+	if err != nil {
+		f.lock.Lock()
+		f.failed[messageID] = failedReassembly{
+			totalBlocks: totalBlocks,
+			err:         err,
+		}
+		f.lock.Unlock()
+	}
+	return err
+}
+
+// retryFailed retries the reassemblies which failed since the last
+// call and returns an error reporting them. The Blocks of a message
+// which can't be opened are dropped by assemble, the reassemblies
+// failing on the store are retried until they succeed.
+func (f *Fetcher) retryFailed() error {
+	f.lock.Lock()
+	failed := f.failed
+	f.failed = make(map[[constants.MessageIDLength]byte]failedReassembly)
+	f.lock.Unlock()
+	var lastErr error
+	for messageID, r := range failed {
+		lastErr = r.err
+		if f.reassembler != nil {
+			err := f.reassembler.submit(messageID, r.totalBlocks)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		f.reassemble(messageID, r.totalBlocks)
+	}
+	if lastErr == nil {
+		return nil
+	}
+	return fmt.Errorf("%d reassemblies failed, retrying: %s", len(failed), lastErr)
+}
+
+// receivedMessage is a message received by the Fetcher
+// which is ready to be delivered to the mailbox
+type receivedMessage struct {
+	message []byte
+	surbs   []*storage.ReceivedSURB
+	sender  string
+}
+
+// prepare prepares the given opened message for the delivery, the
+// message was received in the given number of Blocks sent with
+// the given static key. It decompresses the message if it was
+// sent compressed, extracts it's SURBs and synthesizes it's headers.
+func (f *Fetcher) prepare(plaintext []byte, compressed bool, s [32]byte, messageID [constants.MessageIDLength]byte, blocks int, pinned map[string][32]byte) (*receivedMessage, error) {
+	message := plaintext
+	if compressed {
+		var err error
+		message, err = decompressMessage(plaintext, maxFragmentedMessageLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := receivedMessage{}
+	message, surbs := extractSURBs(message)
+	r.sender = authenticatedSender(message, s, pinned)
+	epoch, _, _ := epochNow(f.clock)
+	r.surbs = bindSURBs(surbs, r.sender, epoch)
+	r.message = synthesizeHeaders(f.Identity, message, messageID, blocks, r.sender, f.clock.Now())
+	return &r, nil
+}
+
+// filterMessage passes the prepared message to the Filter, the
+// message store isn't being updated so the Filter may take it's time
+func (f *Fetcher) filterMessage(r *receivedMessage) (mail_filter.Verdict, error) {
+	contacts, err := contactsByAddress(f.store)
+	if err != nil {
+		return mail_filter.Accept, err
+	}
+	m := mail_filter.Message{
+		Account:       f.Identity,
+		Sender:        senderAddress(r.message),
+		Authenticated: r.sender != "",
+		Raw:           r.message,
+	}
+	m.Contact = contacts[m.Sender]
+	return f.filter.Filter(&m)
+}
+
+// deliver delivers the prepared message with the given commit function,
+// which removes the message's Blocks or parts and files the message
+// into the given folder, the INBOX if empty, or drops it if it's nil.
+// The Filter runs before the commit, a message it fails on is
+// quarantined in the Junk folder. A message which doesn't fit the
+// mailbox quota is deferred, the usage is checked and the message
+// committed under the quota lock so that concurrent deliveries
+// don't exceed it. A message which was already committed by
+// another reassembly is ignored.
+func (f *Fetcher) deliver(messageID [constants.MessageIDLength]byte, r *receivedMessage, commit func(message []byte, folder string) error) error {
+	folder := ""
+	if f.filter != nil {
+		verdict, err := f.filterMessage(r)
+		if err != nil {
+			log.Errorf("%s: mail filter failed, quarantining message %x: %s", f.Identity, messageID, err)
+			folder = storage.FolderJunk
+		} else if verdict == mail_filter.Discard {
+			err = commit(nil, "")
+			if err == storage.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			f.discarded(messageID)
+			return nil
+		}
+	}
+	unlock := f.lockQuota()
+	used, err := f.mailboxUsage()
+	if err != nil {
+		unlock()
+		return err
+	}
+	if !f.fits(used, len(r.message)) {
+		unlock()
+		f.deferMessage(messageID, len(r.message), used)
+		return nil
+	}
+	err = commit(r.message, folder)
+	unlock()
+	if err == storage.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.delivered(messageID, r)
+	return nil
+}
+
+// drop drops the message with the given ID which can't be opened
+// with the given commit function, see deliver, so that it's Blocks
+// aren't kept forever, and returns the error
+func (f *Fetcher) drop(messageID [constants.MessageIDLength]byte, err error, commit func(message []byte, folder string) error) error {
+	commitErr := commit(nil, "")
+	if commitErr != nil && commitErr != storage.ErrKeyNotFound {
+		return commitErr
+	}
+	recordEvent(f.store, storage.EventMessageDropped, f.Identity, &messageID, err.Error())
+	return fmt.Errorf("dropped message %x: %s", messageID, err)
+}
+
+// discarded records that the given message was filtered out
+func (f *Fetcher) discarded(messageID [constants.MessageIDLength]byte) {
+	f.lock.Lock()
+	delete(f.deferred, messageID)
+	f.lock.Unlock()
+	log.Noticef("%s: discarded filtered message", f.Identity)
+	recordEvent(f.store, storage.EventMessageFiltered, f.Identity, &messageID, "")
+}
+
+// delivered records the arrival of the given
+// message which was delivered to the mailbox
+func (f *Fetcher) delivered(messageID [constants.MessageIDLength]byte, r *receivedMessage) {
+	f.lock.Lock()
+	delete(f.deferred, messageID)
+	f.lock.Unlock()
+	// the sender isn't recorded, the event log
+	// mustn't reveal the correspondents
+	recordEvent(f.store, storage.EventMessageArrived, f.Identity, &messageID, "")
+	for _, surb := range r.surbs {
+		err := f.store.PutReceivedSURB(f.Identity, surb)
+		if err != nil {
+			log.Errorf("failed to store a SURB received from %s: %s", surb.Correspondent, err)
+		}
+	}
+	err := f.sendVacationReply(r.message)
+	if err != nil {
+		log.Errorf("failed to send vacation auto-reply: %s", err)
+	}
+}
+
+// open reassembles and decrypts the message of the given
+// Blocks, it returns the message and it's framing flags
+func (f *Fetcher) open(ingressBlocks []*storage.IngressBlock) ([]byte, uint8, error) {
+	if !validBlocks(ingressBlocks) {
+		return nil, 0, errors.New("one or more blocks are invalid")
+	}
+	reassembled, err := reassembleMessage(ingressBlocks)
+	if err != nil {
+		return nil, 0, err
+	}
+	flags, payload, err := parseFrame(reassembled)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := f.openMessage(payload, flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plaintext, flags, nil
+}
+
+// assemble reassembles the message with the given ID into the
+// mailbox once all it's Blocks were received. The message is
+// reassembled, decrypted and filtered outside of a transaction,
+// then delivered atomically with the removal of it's Blocks, see
+// deliver. A message which can't be opened is dropped. A message
+// which is a part of a split message is stored until all the parts
+// are received.
+func (f *Fetcher) assemble(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error {
+	ingressBlocks, keys, err := f.store.GetIngressBlocks(f.Identity, messageID)
+	if err != nil {
+		return err
+	}
+	ingressBlocks = deduplicateBlocks(ingressBlocks)
+	if len(ingressBlocks) != int(totalBlocks) {
+		return nil
+	}
+	commit := func(message []byte, folder string) error {
+		return f.store.CommitReassembly(f.Identity, keys, message, folder)
+	}
+	plaintext, flags, err := f.open(ingressBlocks)
+	if err != nil {
+		return f.drop(messageID, err, commit)
+	}
+	if flags&frameSplitPart != 0 {
+		part, err := parseSplitPart(plaintext, ingressBlocks[0].S)
+		if err != nil {
+			return f.drop(messageID, err, commit)
+		}
+		part.Blocks = len(ingressBlocks)
+		part.Compressed = flags&frameCompressed != 0
+		err = f.store.PutSplitPart(f.Identity, messageID, part)
+		if err != nil {
+			return err
+		}
+		return f.join(part.ID)
+	}
+	pinned, err := pinnedKeys(f.store)
+	if err != nil {
+		return err
+	}
+	r, err := f.prepare(plaintext, flags&frameCompressed != 0, ingressBlocks[0].S, messageID, len(ingressBlocks), pinned)
+	if err != nil {
+		return f.drop(messageID, err, commit)
+	}
+	return f.deliver(messageID, r, commit)
+}
+
+// join delivers the split message with the given ID into the
+// mailbox once all it's parts were received, as assemble does
+func (f *Fetcher) join(id [constants.MessageIDLength]byte) error {
+	parts, keys, err := f.store.SplitMessageParts(f.Identity, id)
+	if err != nil || parts == nil {
+		return err
+	}
+	commit := func(message []byte, folder string) error {
+		return f.store.CommitSplitMessage(f.Identity, keys, message, folder)
+	}
+	pinned, err := pinnedKeys(f.store)
+	if err != nil {
+		return err
+	}
+	message, s, blocks := joinSplitParts(parts)
+	r, err := f.prepare(message, parts[0].Compressed, s, id, blocks, pinned)
+	if err != nil {
+		return f.drop(id, err, commit)
+	}
+	return f.deliver(id, r, commit)
+}
+
+// joinSplitMessages delivers the split messages of which
+// all the parts were received but which weren't delivered
+// yet, e.g. because they didn't fit the mailbox quota
+func (f *Fetcher) joinSplitMessages() error {
+	ids, err := f.store.CompleteSplitMessages(f.Identity)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = f.join(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchScheduler is scheduler which is used to periodically
+// fetch messages using a set of fetchers
+type FetchScheduler struct {
+	fetchers map[string]*Fetcher
+	sched    *scheduler.PriorityScheduler
+	duration time.Duration
+	errLog   *log_limiter.Limiter
+	// rngs holds a random source per account identity, the
+	// accounts fetch independently so that their fetches
+	// don't reveal that they belong to the same client
+	rngs map[string]*mathrand.Rand
+	// maxBatch is the maximum number of messages fetched
+	// back to back while the Provider has queued messages
+	maxBatch  int
+	batchLock sync.Mutex
+	batch     map[string]int
+}
+
+// NewFetchScheduler creates a new FetchScheduler
+// given a slice of identity strings and a duration
+func NewFetchScheduler(fetchers map[string]*Fetcher, duration time.Duration) *FetchScheduler {
+	s := FetchScheduler{
+		fetchers: fetchers,
+		duration: duration,
+		errLog:   log_limiter.New(log, constants.ErrorLogInterval),
+		rngs:     make(map[string]*mathrand.Rand),
+		maxBatch: constants.DefaultMaxFetchBatch,
+		batch:    make(map[string]int),
+	}
+	for identity := range fetchers {
+		s.rngs[identity] = entropy.NewMath()
+	}
+	s.sched = scheduler.New(s.handleFetch)
+	return &s
+}
+
+// SetClock sets the Clock of the fetch schedule and that of the
+// Fetchers, e.g. a clock.Fake in tests. It must be set before Start.
+func (s *FetchScheduler) SetClock(c clock.Clock) {
+	s.sched.SetClock(c)
+	for _, fetcher := range s.fetchers {
+		fetcher.SetClock(c)
+	}
+}
+
+// SetMaxBatch sets the maximum number of messages fetched back
+// to back while the Provider reports more queued messages, the
+// remaining messages are fetched at the next scheduled fetch.
+// It must be set before Start.
+func (s *FetchScheduler) SetMaxBatch(maxBatch int) {
+	s.maxBatch = maxBatch
+}
+
+// SetSupervisor sets the Supervisor recovering the panics
+// of the fetches, it must be set before Start
+func (s *FetchScheduler) SetSupervisor(sup *supervisor.Supervisor) {
+	s.sched.SetSupervisor(sup, "fetch scheduler")
+}
+
+// ErrorStats returns the statistics of the fetch errors
+// per account identity
+func (s *FetchScheduler) ErrorStats() map[string]log_limiter.ClassStats {
+	return s.errLog.Stats()
+}
+
+// Start starts our periodic message checking scheduler,
+// the first fetch of each account is at a random time
+// within the fetch interval
+func (s *FetchScheduler) Start() {
+	for identity := range s.fetchers {
+		s.sched.Add(s.jitter(identity, s.duration), identity)
+	}
+}
+
+// nextFetch returns the delay until the next fetch of the given
+// account, exponentially distributed with the mean duration so that
+// the fetches of the account are a Poisson process
+func (s *FetchScheduler) nextFetch(identity string) time.Duration {
+	rng, ok := s.rngs[identity]
+	if !ok || s.duration <= 0 {
+		return s.duration
+	}
+	return time.Duration(rand.Exp(rng, 1/float64(s.duration)))
+}
+
+// continueBatch returns true if the next message of the given
+// account is fetched immediately, at most maxBatch messages are
+// fetched back to back before the Poisson schedule applies again
+func (s *FetchScheduler) continueBatch(identity string, queueSizeHint uint8) bool {
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+	if queueSizeHint == 0 || s.batch[identity]+1 >= s.maxBatch {
+		delete(s.batch, identity)
+		return false
+	}
+	s.batch[identity]++
+	return true
+}
+
+// jitter returns a random duration in the range [0, max)
+// drawn from the random source of the given account
+func (s *FetchScheduler) jitter(identity string, max time.Duration) time.Duration {
+	rng, ok := s.rngs[identity]
+	if !ok || max <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(max)))
+}
+
+// handleFetch is called by the our scheduler when
+// a fetch must be performed. After the fetch, we
+// either schedule an immediate another fetch or a
+// delayed fetch depending if there are more messages left
+// and the batch size. A failed fetch is retried at the
+// next scheduled fetch.
+// See "Panoramix Mix Network End-to-end Protocol Specification"
+// https://github.com/Katzenpost/docs/blob/master/specs/end_to_end.txt
+func (s *FetchScheduler) handleFetch(task interface{}) {
+	identity, ok := task.(string)
+	if !ok {
+		log.Error("FetchScheduler got invalid task from priority scheduler.")
+		return
+	}
+	fetcher, ok := s.fetchers[identity]
+	if !ok {
+		err := errors.New("fetcher identity not found")
+		log.Error(err)
+		return
+	}
+	queueSizeHint, err := fetcher.Fetch()
+	if err != nil {
+		s.errLog.Error(identity, err)
+		s.continueBatch(identity, 0)
+		s.sched.Add(s.nextFetch(identity), identity)
+		return
+	}
+	err = fetcher.store.FlushHeldMessages(identity)
+	if err != nil {
+		s.errLog.Error(identity, err)
+	}
+	err = fetcher.joinSplitMessages()
+	if err != nil {
+		s.errLog.Error(identity, err)
+	}
+	err = fetcher.retryFailed()
+	if err != nil {
+		s.errLog.Error(identity, err)
+	}
+	if s.continueBatch(identity, queueSizeHint) {
+		s.sched.Add(time.Duration(0), identity)
+	} else {
+		s.sched.Add(s.nextFetch(identity), identity)
+	}
+}
@@ -0,0 +1,107 @@
+// fetch_test.go - fetch scheduler tests
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchSchedulerJitter(t *testing.T) {
+	require := require.New(t)
+
+	s := NewFetchScheduler(map[string]*Fetcher{
+		"alice@acme.com": &Fetcher{Identity: "alice@acme.com"},
+		"bob@acme.com":   &Fetcher{Identity: "bob@acme.com"},
+	}, time.Minute)
+	require.NotEqual(s.rngs["alice@acme.com"], s.rngs["bob@acme.com"])
+
+	// the accounts don't poll in lock-step
+	same := true
+	for i := 0; i < 10; i++ {
+		alice := s.nextFetch("alice@acme.com")
+		bob := s.nextFetch("bob@acme.com")
+		require.True(alice >= 0)
+		require.True(bob >= 0)
+		if alice != bob {
+			same = false
+		}
+	}
+	require.False(same)
+	require.Equal(time.Duration(0), s.jitter("carol@acme.com", time.Minute))
+}
+
+func TestFetchSchedulerPoisson(t *testing.T) {
+	require := require.New(t)
+
+	s := NewFetchScheduler(map[string]*Fetcher{
+		"alice@acme.com": &Fetcher{Identity: "alice@acme.com"},
+	}, time.Minute)
+
+	// the delays are exponentially distributed with the mean interval
+	total := time.Duration(0)
+	for i := 0; i < 10000; i++ {
+		total += s.nextFetch("alice@acme.com")
+	}
+	mean := total / 10000
+	require.True(mean > 50*time.Second && mean < 70*time.Second)
+	require.Equal(time.Minute, s.nextFetch("carol@acme.com"))
+}
+
+func TestFetchSchedulerBatch(t *testing.T) {
+	require := require.New(t)
+
+	s := NewFetchScheduler(map[string]*Fetcher{
+		"alice@acme.com": &Fetcher{Identity: "alice@acme.com"},
+	}, time.Minute)
+	s.SetMaxBatch(3)
+
+	// at most three messages are fetched back to back
+	require.True(s.continueBatch("alice@acme.com", 10))
+	require.True(s.continueBatch("alice@acme.com", 9))
+	require.False(s.continueBatch("alice@acme.com", 8))
+
+	// the batch starts over after the Poisson delay
+	require.True(s.continueBatch("alice@acme.com", 7))
+	require.False(s.continueBatch("alice@acme.com", 0))
+	require.True(s.continueBatch("alice@acme.com", 6))
+}
+
+func TestFetchEmpty(t *testing.T) {
+	require := require.New(t)
+
+	pool, store, _, handler := makeUser(require, "alice@acme.com")
+	defer store.Close()
+	fetcher := NewFetcher("alice@acme.com", pool, store, nil, handler)
+	session := pool.Sessions["alice@acme.com"].(*MockSession)
+
+	// an empty queue acknowledges the retrieval
+	session.recvCommands = []commands.Command{commands.MessageEmpty{Sequence: 0}}
+	hint, err := fetcher.Fetch()
+	require.NoError(err)
+	require.Equal(uint8(0), hint)
+	require.Equal(uint32(1), fetcher.sequence)
+	require.Equal(commands.RetrieveMessage{Sequence: 0}, session.sentCommands[0])
+
+	session.recvCommands = []commands.Command{commands.MessageEmpty{Sequence: 0}}
+	_, err = fetcher.Fetch()
+	require.Error(err)
+	require.Equal(uint32(1), fetcher.sequence)
+}
@@ -20,15 +20,57 @@ package proxy
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"sort"
 
-	"github.com/katzenpost/client/constants"
 	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
 	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
 )
 
+// All the Blocks leave the client at the same size, regardless of
+// the size of their message, so that short messages and the last
+// Block of a message aren't distinguishable on the wire. Each Block
+// payload is padded to block.BlockLength by fragmentStream and each
+// Block is encrypted to block.CiphertextLength by encryptBlock.
+
+// padPayload returns the given Block payload padded with
+// zeros to block.BlockLength
+func padPayload(payload []byte) ([]byte, error) {
+	if len(payload) > block.BlockLength {
+		return nil, errors.New("oversized Block payload")
+	}
+	padded := make([]byte, block.BlockLength)
+	copy(padded, payload)
+	return padded, nil
+}
+
+// encryptBlock encrypts the given Block for the given recipient key,
+// padding it's payload if need be, and ensures that the ciphertext
+// is of the uniform size
+func encryptBlock(handler *block.Handler, recipientKey *ecdh.PublicKey, b *block.Block) ([]byte, error) {
+	if len(b.Block) != block.BlockLength {
+		payload, err := padPayload(b.Block)
+		if err != nil {
+			return nil, err
+		}
+		padded := *b
+		padded.Block = payload
+		b = &padded
+	}
+	ciphertext, err := handler.Encrypt(recipientKey, b)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) != block.CiphertextLength {
+		return nil, fmt.Errorf("non-uniform Block ciphertext of %d bytes", len(ciphertext))
+	}
+	return ciphertext, nil
+}
+
 // deduplicateBlocks deduplicates the given blocks according to the BlockIDs
 func deduplicateBlocks(ingressBlocks []*storage.IngressBlock) []*storage.IngressBlock {
 	blockIDMap := make(map[uint16]bool)
@@ -79,7 +121,13 @@ func (a ByBlockID) Less(i, j int) bool { return a[i].Block.BlockID < a[j].Block.
 // if a block is missing
 func reassembleMessage(ingressBlocks []*storage.IngressBlock) ([]byte, error) {
 	sort.Sort(ByBlockID(ingressBlocks))
-	message := []byte{}
+	length := 0
+	for _, b := range ingressBlocks {
+		length += len(b.Block.Block)
+	}
+	// the payloads are copied, the storage
+	// reuses the blocks once reassembled
+	message := make([]byte, 0, length)
 	for i, b := range ingressBlocks {
 		if ingressBlocks[i].Block.BlockID != uint16(i) {
 			return nil, errors.New("message reassembler failed: missing message block")
@@ -92,45 +140,56 @@ func reassembleMessage(ingressBlocks []*storage.IngressBlock) ([]byte, error) {
 // fragmentMessage fragments a message into a slice of blocks
 func fragmentMessage(randomReader io.Reader, message []byte) ([]*block.Block, error) {
 	blocks := []*block.Block{}
-	if len(message) <= block.BlockLength {
-		id := [constants.MessageIDLength]byte{}
-		_, err := randomReader.Read(id[:])
+	err := fragmentStream(randomReader, bytes.NewReader(message), len(message), func(b *block.Block) error {
+		blocks = append(blocks, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// fragmentStream reads a message of the given length from r and
+// fragments it into blocks, one at a time, so that a large message
+// never needs to be held in memory. Each block is passed to emit.
+func fragmentStream(randomReader io.Reader, r io.Reader, length int, emit func(*block.Block) error) error {
+	if length > maxFragmentedMessageLength {
+		return errors.New("message too large to be fragmented into blocks")
+	}
+	totalBlocks := 1
+	if length > block.BlockLength {
+		totalBlocks = int(math.Ceil(float64(length) / float64(block.BlockLength)))
+	}
+	id := [constants.MessageIDLength]byte{}
+	_, err := randomReader.Read(id[:])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < totalBlocks; i++ {
+		payloadLength := block.BlockLength
+		if i == totalBlocks-1 {
+			payloadLength = length - i*block.BlockLength
+		}
+		payload := make([]byte, payloadLength)
+		_, err = io.ReadFull(r, payload)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		payload, err = padPayload(payload)
+		if err != nil {
+			return err
 		}
-		payload := [block.BlockLength]byte{}
-		copy(payload[:], message)
-		block := block.Block{
+		b := block.Block{
 			MessageID:   id,
-			TotalBlocks: 1,
-			BlockID:     0,
-			Block:       payload[:],
+			TotalBlocks: uint16(totalBlocks),
+			BlockID:     uint16(i),
+			Block:       payload,
 		}
-		blocks = append(blocks, &block)
-	} else {
-		totalBlocks := int(math.Ceil(float64(len(message)) / float64(block.BlockLength)))
-		id := [constants.MessageIDLength]byte{}
-		_, err := randomReader.Read(id[:])
+		err = emit(&b)
 		if err != nil {
-			return nil, err
-		}
-		for i := 0; i < totalBlocks; i++ {
-			var blockPayload []byte
-			if i == totalBlocks-1 {
-				payload := [block.BlockLength]byte{}
-				blockPayload = payload[:]
-				copy(blockPayload[:], message[i*block.BlockLength:])
-			} else {
-				blockPayload = message[i*block.BlockLength : (i+1)*block.BlockLength]
-			}
-			block := block.Block{
-				MessageID:   id,
-				TotalBlocks: uint16(totalBlocks),
-				BlockID:     uint16(i),
-				Block:       blockPayload,
-			}
-			blocks = append(blocks, &block)
+			return err
 		}
 	}
-	return blocks, nil
+	return nil
 }
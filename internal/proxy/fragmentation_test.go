@@ -18,11 +18,14 @@
 package proxy
 
 import (
+	"fmt"
 	"testing"
+	"testing/quick"
 
-	"github.com/katzenpost/client/constants"
 	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
 	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/stretchr/testify/require"
 )
@@ -295,3 +298,92 @@ func TestReassemblyMissingBlock(t *testing.T) {
 	_, err := reassembleMessage(blocks)
 	require.Error(err, "reassembleMessage should've failed")
 }
+
+func TestUniformBlockSize(t *testing.T) {
+	require := require.New(t)
+
+	senderKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	recipientKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	handler := block.NewHandler(senderKey, rand.Reader)
+
+	// whatever the message length, every Block leaves at the same size
+	property := func(length uint32) bool {
+		message := make([]byte, int(length%(3*block.BlockLength+1)))
+		blocks, err := fragmentMessage(rand.Reader, message)
+		if err != nil {
+			return false
+		}
+		for _, b := range blocks {
+			if len(b.Block) != block.BlockLength {
+				return false
+			}
+			ciphertext, err := encryptBlock(handler, recipientKey.PublicKey(), b)
+			if err != nil || len(ciphertext) != block.CiphertextLength {
+				return false
+			}
+		}
+		return true
+	}
+	err = quick.Check(property, &quick.Config{MaxCount: 20})
+	require.NoError(err, "non-uniform Block size")
+
+	short := &block.Block{Block: []byte("short")}
+	ciphertext, err := encryptBlock(handler, recipientKey.PublicKey(), short)
+	require.NoError(err, "encryptBlock failed")
+	require.Equal(block.CiphertextLength, len(ciphertext))
+	require.Equal([]byte("short"), short.Block)
+	_, err = padPayload(make([]byte, block.BlockLength+1))
+	require.Error(err, "oversized payload not detected")
+}
+
+// fragmentationSizes are the numbers of blocks
+// of the messages of the fragmentation benchmarks
+var fragmentationSizes = []int{1, 10, 100}
+
+func BenchmarkFragmentMessage(b *testing.B) {
+	for _, n := range fragmentationSizes {
+		b.Run(fmt.Sprintf("%dblocks", n), func(b *testing.B) {
+			message := make([]byte, n*block.BlockLength)
+			_, err := rand.Reader.Read(message)
+			require.NoError(b, err, "rand reader failed")
+			b.SetBytes(int64(len(message)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := fragmentMessage(rand.Reader, message)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReassembleMessage(b *testing.B) {
+	for _, n := range fragmentationSizes {
+		b.Run(fmt.Sprintf("%dblocks", n), func(b *testing.B) {
+			message := make([]byte, n*block.BlockLength)
+			_, err := rand.Reader.Read(message)
+			require.NoError(b, err, "rand reader failed")
+			blocks, err := fragmentMessage(rand.Reader, message)
+			require.NoError(b, err, "fragmentMessage failed")
+			ingressBlocks := make([]*storage.IngressBlock, len(blocks))
+			for i, blk := range blocks {
+				ingressBlocks[i] = &storage.IngressBlock{
+					Block: blk,
+				}
+			}
+			b.SetBytes(int64(len(message)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := reassembleMessage(ingressBlocks)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// framing.go - mixnet message framing
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// frameMarker starts the framing header of every mixnet message.
+	// The messages of clients predating the framing are RFC 5322
+	// messages, which never start with a NUL byte, so that they're
+	// still received, see parseFrame.
+	frameMarker = 0x00
+
+	// frameVersion is the version of the framing header
+	frameVersion = 1
+
+	// frameHeaderLength is the length of the framing header:
+	// the marker, the version and the flags of the message
+	frameHeaderLength = 3
+)
+
+const (
+	// frameSplitPart marks a message which is a part of a
+	// message split into several mixnet messages, see splitMessage
+	frameSplitPart uint8 = 1 << iota
+
+	// frameSealed marks a message sealed in an end to end
+	// encrypted envelope, see envelope.Seal, the envelope's
+	// magic tells whether it's an experimental hybrid
+	// envelope, see envelope.SealHybrid
+	frameSealed
+
+	// frameCompressed marks a gzip compressed message, see
+	// compressMessage. A message is compressed before it's split,
+	// so all the parts of a compressed split message carry it.
+	frameCompressed
+
+	// knownFrameFlags are the flags a message may carry
+	knownFrameFlags = frameSplitPart | frameSealed | frameCompressed
+)
+
+// frameHeader returns the framing header of a message
+// with the given flags, which is sent before the message
+// in it's Blocks, the Block header itself is left as spec'd
+func frameHeader(flags uint8) []byte {
+	return []byte{frameMarker, frameVersion, flags}
+}
+
+// parseFrame returns the flags and the payload of the given
+// reassembled mixnet message. A message without framing header
+// is returned unaltered without flags, messages of an unknown
+// framing version or with unknown flags are rejected.
+func parseFrame(message []byte) (uint8, []byte, error) {
+	if len(message) == 0 || message[0] != frameMarker {
+		return 0, message, nil
+	}
+	if len(message) < frameHeaderLength {
+		return 0, nil, errors.New("truncated message framing header")
+	}
+	if message[1] != frameVersion {
+		return 0, nil, fmt.Errorf("unsupported message framing version %d", message[1])
+	}
+	flags := message[2]
+	if flags&^knownFrameFlags != 0 {
+		return 0, nil, fmt.Errorf("unknown message framing flags %#x", flags)
+	}
+	return flags, message[frameHeaderLength:], nil
+}
@@ -0,0 +1,62 @@
+// framing_test.go - mixnet message framing tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFraming(t *testing.T) {
+	require := require.New(t)
+
+	message := []byte("Subject: hello\n\nframed")
+	blocks, err := fragmentMessage(rand.Reader, append(frameHeader(frameSplitPart), message...))
+	require.NoError(err, "fragmentMessage failed")
+	ingressBlocks := []*storage.IngressBlock{}
+	for _, b := range blocks {
+		raw, err := b.ToBytes()
+		require.NoError(err, "ToBytes failed")
+		// the Block header is left as spec'd
+		received, err := block.FromBytes(raw)
+		require.NoError(err, "FromBytes failed")
+		ingressBlocks = append(ingressBlocks, &storage.IngressBlock{Block: received})
+	}
+	reassembled, err := reassembleMessage(ingressBlocks)
+	require.NoError(err, "reassembleMessage failed")
+	flags, payload, err := parseFrame(reassembled)
+	require.NoError(err, "parseFrame failed")
+	require.Equal(frameSplitPart, flags)
+	require.Equal(message, payload[:len(message)])
+
+	// the messages of clients predating the framing are received as is
+	flags, payload, err = parseFrame(message)
+	require.NoError(err, "parseFrame failed")
+	require.Equal(uint8(0), flags)
+	require.Equal(message, payload)
+
+	_, _, err = parseFrame([]byte{frameMarker, frameVersion})
+	require.Error(err, "truncated framing header was accepted")
+	_, _, err = parseFrame(append([]byte{frameMarker, frameVersion + 1, 0}, message...))
+	require.Error(err, "unknown framing version was accepted")
+	_, _, err = parseFrame(append(frameHeader(0x80), message...))
+	require.Error(err, "unknown framing flags were accepted")
+}
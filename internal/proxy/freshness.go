@@ -0,0 +1,105 @@
+// freshness.go - pausing the sending without a PKI document or clock
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+)
+
+// PKIFreshness reports whether the PKI document of the
+// current epoch is available, e.g. a mix_pki.Prefetcher
+type PKIFreshness interface {
+	Fresh() bool
+}
+
+// ClockSkewCheck reports whether the sending must be refused because
+// of the skew of the local clock, e.g. a mix_pki.SkewMonitor
+type ClockSkewCheck interface {
+	RefuseSend() bool
+}
+
+// SetPKIFreshness causes the Blocks to be held back while the PKI
+// document of the current epoch is missing, since no route can be
+// built without it. They are sent once the document is available.
+func (s *SendScheduler) SetPKIFreshness(freshness PKIFreshness) {
+	s.Lock()
+	defer s.Unlock()
+	s.freshness = freshness
+}
+
+// SetClockSkewCheck causes the Blocks to be held back while the
+// skew of the local clock is excessive, since the mixes would drop
+// the packets built for the wrong epoch
+func (s *SendScheduler) SetClockSkewCheck(check ClockSkewCheck) {
+	s.Lock()
+	defer s.Unlock()
+	s.skewCheck = check
+}
+
+// stalled returns the reason the sending is paused, or
+// an empty string if it isn't. The caller must hold the lock.
+func (s *SendScheduler) stalled() string {
+	if s.freshness != nil && !s.freshness.Fresh() {
+		return "the PKI document of the current epoch is missing"
+	}
+	if s.skewCheck != nil && s.skewCheck.RefuseSend() {
+		return "the local clock is skewed"
+	}
+	return ""
+}
+
+// holdStale holds back the given Block and returns true if the
+// PKI document of the current epoch is missing or if the skew
+// of the local clock is excessive
+func (s *SendScheduler) holdStale(storageBlock *storage.EgressBlock) bool {
+	s.Lock()
+	defer s.Unlock()
+	reason := s.stalled()
+	if reason == "" {
+		return false
+	}
+	if len(s.stale) == 0 {
+		log.Warningf("%s, sending is paused", reason)
+	}
+	s.stale = append(s.stale, storageBlock)
+	if s.staleTimer == nil {
+		s.staleTimer = s.clock.AfterFunc(constants.PKIStaleRecheckInterval, s.recheckStale)
+	}
+	return true
+}
+
+// recheckStale sends the held back Blocks once the
+// sending is no longer stalled, or checks again later
+func (s *SendScheduler) recheckStale() {
+	s.Lock()
+	if s.stalled() != "" {
+		s.staleTimer = s.clock.AfterFunc(constants.PKIStaleRecheckInterval, s.recheckStale)
+		s.Unlock()
+		return
+	}
+	stale := s.stale
+	s.stale = nil
+	s.staleTimer = nil
+	s.Unlock()
+	log.Noticef("sending is resumed, sending %d held back Blocks", len(stale))
+	for _, storageBlock := range stale {
+		if !s.enqueueSlot(storageBlock) {
+			s.sendNow(storageBlock)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// freshness_test.go - PKI freshness tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+// mockFreshness is a PKIFreshness and a ClockSkewCheck
+// whose state is set by the test
+type mockFreshness struct {
+	sync.Mutex
+	fresh bool
+}
+
+func (m *mockFreshness) Fresh() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.fresh
+}
+
+func (m *mockFreshness) RefuseSend() bool {
+	return !m.Fresh()
+}
+
+func (m *mockFreshness) set(fresh bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.fresh = fresh
+}
+
+func TestPKIFreshness(t *testing.T) {
+	require := require.New(t)
+
+	mixPKI, _ := newMixPKI(require)
+	routeFactory := path_selection.New(mixPKI, 5, float64(.123))
+
+	aliceEmail := "alice@acme.com"
+	alicePool, aliceStore, alicePrivKey, aliceBlockHandler := makeUser(require, aliceEmail)
+	defer aliceStore.Close()
+	err := aliceStore.CreateAccountBuckets([]string{aliceEmail})
+	require.NoError(err, "CreateAccountBuckets failure")
+	bobPrivKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failure")
+	userPKI := MockUserPKI{
+		userMap: map[string]*ecdh.PublicKey{
+			aliceEmail:    alicePrivKey.PublicKey(),
+			"bob@nsa.gov": bobPrivKey.PublicKey(),
+		},
+	}
+	session := alicePool.Sessions[aliceEmail].(*MockSession)
+
+	aliceSender, err := NewSender(aliceEmail, alicePool, aliceStore, routeFactory, userPKI, aliceBlockHandler)
+	require.NoError(err, "NewSender failure")
+	s := NewSendScheduler(map[string]*Sender{
+		aliceEmail: aliceSender,
+	})
+	fake := clock.NewFake(time.Now())
+	s.SetClock(fake)
+	freshness := &mockFreshness{}
+	s.SetPKIFreshness(freshness)
+
+	bobID := [sphinxconstants.RecipientIDLength]byte{}
+	copy(bobID[:], "bob")
+	egressBlock := storage.EgressBlock{
+		Sender:            aliceEmail,
+		SenderProvider:    "acme.com",
+		Recipient:         "bob@nsa.gov",
+		RecipientProvider: "nsa.gov",
+		RecipientID:       bobID,
+		Block: block.Block{
+			TotalBlocks: 1,
+			Block:       []byte("held back"),
+		},
+	}
+	blockID, err := aliceStore.PutEgressBlock(&egressBlock)
+	require.NoError(err, "PutEgressBlock failure")
+
+	// the Block is held back without the current PKI document
+	err = s.Send(aliceEmail, blockID, &egressBlock)
+	require.NoError(err, "Send failure")
+	require.Equal(0, len(session.sentCommands))
+	require.Equal(1, len(s.stale))
+
+	fake.Advance(constants.PKIStaleRecheckInterval)
+	require.Equal(0, len(session.sentCommands))
+	require.Equal(1, len(s.stale))
+
+	// and sent once the document is available
+	freshness.set(true)
+	fake.Advance(constants.PKIStaleRecheckInterval)
+	require.Equal(1, len(session.sentCommands))
+	require.Equal(0, len(s.stale))
+}
+
+func TestClockSkewCheck(t *testing.T) {
+	require := require.New(t)
+
+	s := NewSendScheduler(map[string]*Sender{})
+	require.Equal("", s.stalled())
+	skewed := &mockFreshness{}
+	s.SetClockSkewCheck(skewed)
+	require.Equal("the local clock is skewed", s.stalled())
+	skewed.set(true)
+	require.Equal("", s.stalled())
+}
@@ -0,0 +1,104 @@
+// hybrid_test.go - hybrid envelope suite negotiation tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"crypto/mlkem"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/client/internal/crypto/envelope"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+// hybridUserPKI is a UserPKI advertising a single recipient
+type hybridUserPKI struct {
+	key    *ecdh.PublicKey
+	kemKey *mlkem.EncapsulationKey768
+}
+
+func (h *hybridUserPKI) GetKey(email string) (*ecdh.PublicKey, error) {
+	return h.key, nil
+}
+
+func (h *hybridUserPKI) GetKEMKey(email string) (*mlkem.EncapsulationKey768, error) {
+	return h.kemKey, nil
+}
+
+func TestHybridSuiteNegotiation(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "hybrid_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	identityKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	kemKey, err := mlkem.GenerateKey768()
+	require.NoError(err, "GenerateKey768 failed")
+	userPKI := &hybridUserPKI{
+		key:    identityKey.PublicKey(),
+		kemKey: kemKey.EncapsulationKey(),
+	}
+	p := NewSmtpProxy(nil, rand.Reader, userPKI, store, nil, nil, nil)
+	p.EnableHybridEncryption()
+	fetcher := NewFetcher("bob@nsa.gov", nil, store, nil, nil)
+	fetcher.SetIdentityKey(identityKey)
+	message := []byte("Subject: hi\n\nhello\n")
+
+	sealed, err := p.sealMessage("bob@nsa.gov", message)
+	require.NoError(err, "sealMessage failed")
+	require.True(envelope.IsHybridSealed(sealed))
+	suite, err := store.Suite("Bob@nsa.gov")
+	require.NoError(err, "Suite failed")
+	require.Equal(envelope.SuiteHybrid, suite)
+	_, err = fetcher.openMessage(sealed, frameSealed)
+	require.Error(err, "openMessage without a KEM key should've failed")
+	fetcher.SetKEMKey(kemKey)
+	opened, err := fetcher.openMessage(sealed, frameSealed)
+	require.NoError(err, "openMessage failed")
+	require.Equal(message, opened)
+
+	// the recipient stops advertising it's ML-KEM key
+	userPKI.kemKey = nil
+	sealed, err = p.sealMessage("bob@nsa.gov", message)
+	require.NoError(err, "sealMessage failed")
+	require.True(envelope.IsSealed(sealed))
+	suite, err = store.Suite("bob@nsa.gov")
+	require.NoError(err, "Suite failed")
+	require.Equal(envelope.SuiteClassical, suite)
+	opened, err = fetcher.openMessage(sealed, frameSealed)
+	require.NoError(err, "openMessage failed")
+	require.Equal(message, opened)
+
+	// a plaintext message is never taken for an envelope
+	plaintext := append([]byte{}, sealed...)
+	opened, err = fetcher.openMessage(plaintext, 0)
+	require.NoError(err, "openMessage failed")
+	require.Equal(plaintext, opened)
+
+	// a message framed as sealed must be an envelope
+	_, err = fetcher.openMessage(message, frameSealed)
+	require.Error(err, "openMessage of a plaintext framed as sealed should've failed")
+}
@@ -0,0 +1,119 @@
+// idempotency.go - idempotent message submission
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+)
+
+// IdempotencyKeyHeader is the header of a submitted message carrying
+// a key chosen by the client which identifies the submission. A
+// message resubmitted by the same sender with the same key within
+// the storage.SubmissionWindow, for instance by a MUA retrying after
+// a timeout, is accepted but isn't sent again.
+const IdempotencyKeyHeader = "X-Mix-Idempotency-Key"
+
+// maxIdempotencyKeyLength is the maximum length of an idempotency key
+const maxIdempotencyKeyLength = 256
+
+// ErrSubmissionInProgress is the error returned when a message is
+// submitted while the submission of a message with the same
+// idempotency key hasn't completed yet
+var ErrSubmissionInProgress = errors.New("submission with the same idempotency key in progress")
+
+// submissionKey returns the key of an in flight submission
+func submissionKey(sender, idempotencyKey string) string {
+	return sender + "\x00" + idempotencyKey
+}
+
+// beginSubmission returns the message ID of the sender's recent
+// submission with the given idempotency key if there is one, otherwise
+// the key is marked as in flight until endSubmission so that concurrent
+// resubmissions are detected as well
+func (p *SubmitProxy) beginSubmission(sender, idempotencyKey string) (*[constants.MessageIDLength]byte, error) {
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		return nil, fmt.Errorf("idempotency key longer than %d bytes", maxIdempotencyKeyLength)
+	}
+	p.submittingLock.Lock()
+	defer p.submittingLock.Unlock()
+	if p.submitting[submissionKey(sender, idempotencyKey)] {
+		return nil, ErrSubmissionInProgress
+	}
+	messageID, err := p.store.LookupSubmission(sender, idempotencyKey)
+	if err != nil || messageID != nil {
+		return messageID, err
+	}
+	p.submitting[submissionKey(sender, idempotencyKey)] = true
+	return nil, nil
+}
+
+// endSubmission ends the in flight submission started by beginSubmission
+func (p *SubmitProxy) endSubmission(sender, idempotencyKey string) {
+	p.submittingLock.Lock()
+	defer p.submittingLock.Unlock()
+	delete(p.submitting, submissionKey(sender, idempotencyKey))
+}
+
+// newSubmission returns the record of the submission with the given
+// idempotency key, nil if it's empty. It's persisted atomically with
+// the enqueued message, see enqueueStream.
+func newSubmission(idempotencyKey string) *storage.Submission {
+	if idempotencyKey == "" {
+		return nil
+	}
+	return &storage.Submission{Key: idempotencyKey}
+}
+
+// SubmitMessage enqueues the given message from sender to receiver
+// and returns it's message ID. If idempotencyKey isn't empty and the
+// sender submitted a message with the same key within the
+// storage.SubmissionWindow, the message isn't enqueued again and the
+// message ID of the previous submission is returned instead.
+func (p *SubmitProxy) SubmitMessage(sender, receiver, idempotencyKey string, message []byte) ([constants.MessageIDLength]byte, error) {
+	messageID := [constants.MessageIDLength]byte{}
+	if idempotencyKey != "" {
+		previous, err := p.beginSubmission(sender, idempotencyKey)
+		if err != nil {
+			return messageID, err
+		}
+		if previous != nil {
+			log.Noticef("ignoring duplicate submission of message %x by %s", *previous, sender)
+			return *previous, nil
+		}
+		defer p.endSubmission(sender, idempotencyKey)
+	}
+	size := len(message)
+	flags := uint8(0)
+	if p.encryption {
+		sealed, err := p.sealMessage(receiver, message)
+		if err != nil {
+			return messageID, err
+		}
+		message = sealed
+		flags = frameSealed
+	}
+	messageID, err := p.enqueueMessage(sender, receiver, message, flags, messagePriority("", len(message)), newSubmission(idempotencyKey))
+	if err != nil {
+		return messageID, err
+	}
+	p.recordSent(sender, receiver, "", size, messageID)
+	return messageID, nil
+}
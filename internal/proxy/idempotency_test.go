@@ -0,0 +1,81 @@
+// idempotency_test.go - idempotent message submission tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentSubmission(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "idempotency_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	sender := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{sender})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender, store: store},
+	})
+	s.EnableSendSlots(time.Hour, false)
+	p := NewSmtpProxy(nil, rand.Reader, nil, store, nil, nil, s)
+
+	first, err := p.SubmitMessage(sender, "bob@nsa.gov", "retry-1", []byte("hello"))
+	require.NoError(err, "SubmitMessage failed")
+	require.Equal(1, s.Queued())
+
+	// a retry with the same key isn't enqueued again
+	retry, err := p.SubmitMessage(sender, "bob@nsa.gov", "retry-1", []byte("hello"))
+	require.NoError(err, "SubmitMessage failed")
+	require.Equal(first, retry)
+	require.Equal(1, s.Queued())
+
+	// while a submission is in flight a retry is deferred
+	_, err = p.beginSubmission(sender, "retry-2")
+	require.NoError(err, "beginSubmission failed")
+	_, err = p.SubmitMessage(sender, "bob@nsa.gov", "retry-2", []byte("hello"))
+	require.Equal(ErrSubmissionInProgress, err)
+	p.endSubmission(sender, "retry-2")
+
+	second, err := p.SubmitMessage(sender, "bob@nsa.gov", "retry-2", []byte("hello"))
+	require.NoError(err, "SubmitMessage failed")
+	require.NotEqual(first, second)
+	_, err = p.SubmitMessage(sender, "bob@nsa.gov", "", []byte("hello"))
+	require.NoError(err, "SubmitMessage failed")
+	require.Equal(3, s.Queued())
+
+	_, err = p.SubmitMessage(sender, "bob@nsa.gov", strings.Repeat("k", maxIdempotencyKeyLength+1), []byte("hello"))
+	require.Error(err, "oversized idempotency key not detected")
+
+	for s.Queued() > 0 {
+		s.nextSlotBlock(sender)
+	}
+	s.StopSendSlots()
+}
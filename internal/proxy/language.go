@@ -0,0 +1,32 @@
+// language.go - language of the client generated messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"github.com/katzenpost/client/storage"
+)
+
+// accountLanguage returns the language of the messages generated
+// for the given account, the default language if it isn't set
+func accountLanguage(store *storage.Store, account string) string {
+	language, err := store.Language(account)
+	if err != nil {
+		log.Errorf("failed to get the language of %s: %s", account, err)
+		return ""
+	}
+	return language
+}
@@ -0,0 +1,79 @@
+// message_size.go - message size limits and compression
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/katzenpost/client/crypto/block"
+)
+
+// maxFragmentedMessageLength is the maximum size of a message
+// which can be fragmented into Blocks, limited by the 16 bit
+// TotalBlocks field of the Block header
+const maxFragmentedMessageLength = block.BlockLength * math.MaxUint16
+
+// messageTooLargeText returns the SMTP rejection text
+// explaining why an oversized message was refused
+func messageTooLargeText(size, maxSize int) string {
+	return fmt.Sprintf("552 5.3.4 Message size %d exceeds the limit of %d bytes. "+
+		"Messages are split into %d byte blocks which are each sent as a separate "+
+		"mix network packet, please send large attachments by other means.",
+		size, maxSize, block.BlockLength)
+}
+
+// compressMessage gzip compresses the message, which
+// is then sent with the frameCompressed flag
+func compressMessage(message []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(message)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressMessage decompresses a message received with the
+// frameCompressed flag. Trailing Block padding is ignored and the
+// decompressed message may never be larger than maxSize.
+func decompressMessage(message []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Multistream(false)
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, errors.New("decompressed message exceeds maximum message size")
+	}
+	return out, nil
+}
@@ -0,0 +1,290 @@
+// pop3.go - POP3 + mixnet proxy server.
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package proxy provides mixnet client proxies
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/katzenpost/client/internal/auth"
+	"github.com/katzenpost/client/internal/pop3"
+	"github.com/katzenpost/client/internal/rate_limit"
+	"github.com/katzenpost/client/storage"
+)
+
+// ErrInvalidPassword is the error returned when a POP3
+// client presents the wrong password of an account
+var ErrInvalidPassword = errors.New("invalid password")
+
+// Pop3BackendSession is our boltdb backed implementation of our
+// pop3 BackendSession and MarkingBackendSession interfaces. The
+// messages marked by DELE are flagged as deleted in the store
+// and expunged when the session is QUIT.
+type Pop3BackendSession struct {
+	store       *storage.Store
+	accountName string
+	// keys are the keys of the messages returned by Messages
+	keys []uint64
+	// marked are the keys of the messages marked by
+	// the session which weren't expunged yet
+	marked map[uint64]bool
+}
+
+// Messages returns a list of messages stored in our bolt
+// database, except the messages flagged as deleted
+func (s *Pop3BackendSession) Messages() ([][]byte, error) {
+	inbox, err := s.store.FolderMessages(s.accountName, storage.FolderInbox)
+	if err != nil {
+		return nil, err
+	}
+	messages := [][]byte{}
+	s.keys = []uint64{}
+	for _, m := range inbox {
+		if m.Flags&storage.FlagDeleted != 0 {
+			continue
+		}
+		messages = append(messages, m.Message)
+		s.keys = append(s.keys, m.Key)
+	}
+	return messages, nil
+}
+
+// MessageMetadata returns the metadata of the messages returned
+// by Messages, see storage.MessageMetadata. The messages flagged
+// as deleted are left out unless the session marked them.
+func (s *Pop3BackendSession) MessageMetadata() ([]*storage.MessageMetadata, error) {
+	metadata, err := s.store.MessageMetadata(s.accountName)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []*storage.MessageMetadata{}
+	for _, m := range metadata {
+		if m.Flags&storage.FlagDeleted != 0 && !s.marked[m.Key] {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered, nil
+}
+
+// MarkDeleted flags the message with the given
+// index as deleted, or removes the flag
+func (s *Pop3BackendSession) MarkDeleted(item int, deleted bool) error {
+	if item < 0 || item >= len(s.keys) {
+		return fmt.Errorf("no such message %d", item)
+	}
+	key := s.keys[item]
+	if deleted {
+		_, err := s.store.UpdateMessageFlags(s.accountName, key, storage.FlagDeleted, 0)
+		if err != nil {
+			return err
+		}
+		s.marked[key] = true
+		return nil
+	}
+	_, err := s.store.UpdateMessageFlags(s.accountName, key, 0, storage.FlagDeleted)
+	if err != nil {
+		return err
+	}
+	delete(s.marked, key)
+	return nil
+}
+
+// DeleteMessages deletes a list of messages, addressed by index,
+// along with the other messages marked by the session. The messages
+// flagged as deleted by other sessions are left to them.
+func (s *Pop3BackendSession) DeleteMessages(items []int) error {
+	for _, item := range items {
+		if item >= 0 && item < len(s.keys) && s.marked[s.keys[item]] {
+			continue
+		}
+		err := s.MarkDeleted(item, true)
+		if err != nil {
+			return err
+		}
+	}
+	keys := make([]uint64, 0, len(s.marked))
+	for key := range s.marked {
+		keys = append(keys, key)
+	}
+	_, err := s.store.ExpungeMessages(s.accountName, keys)
+	if err != nil {
+		return err
+	}
+	s.marked = make(map[uint64]bool)
+	return nil
+}
+
+// Close closes the session, the deletion flags of the messages
+// marked by a session which wasn't QUIT are removed
+func (s *Pop3BackendSession) Close() {
+	for key := range s.marked {
+		_, err := s.store.UpdateMessageFlags(s.accountName, key, 0, storage.FlagDeleted)
+		if err != nil && err != storage.ErrKeyNotFound {
+			log.Errorf("failed to unmark message %d of %s: %s", key, s.accountName, err)
+		}
+	}
+}
+
+// Pop3Backend implements our pop3 Backend and APOPBackend interfaces
+type Pop3Backend struct {
+	store          *storage.Store
+	passwords      map[string]string
+	passwordHashes map[string]string
+}
+
+// NewPop3Backend creates a new Pop3Backend given the db file path
+func NewPop3Backend(store *storage.Store) Pop3Backend {
+	p := Pop3Backend{
+		store: store,
+	}
+	return p
+}
+
+// NewSession returns a BackendSession implementation or an error given
+// the user name and password, see Pop3Service.SetPasswords and
+// Pop3Service.SetPasswordHashes. The accounts without a password
+// or a password hash are refused.
+func (b Pop3Backend) NewSession(user, pass []byte) (pop3.BackendSession, error) {
+	accountName := strings.ToLower(string(user))
+	if !checkProxyPassword(b.passwords, b.passwordHashes, accountName, pass) {
+		return nil, ErrInvalidPassword
+	}
+	return b.newSession(accountName), nil
+}
+
+// checkProxyPassword returns true if the given password is the proxy
+// password of the given account, given the passwords and the password
+// hashes of the accounts. It's false for the accounts with neither.
+func checkProxyPassword(passwords, hashes map[string]string, accountName string, pass []byte) bool {
+	if password := passwords[accountName]; password != "" {
+		return subtle.ConstantTimeCompare([]byte(password), pass) == 1
+	}
+	if hash := hashes[accountName]; hash != "" {
+		return auth.CheckPassword(hash, pass)
+	}
+	return false
+}
+
+// NewSessionAPOP returns a BackendSession implementation or an error
+// given the user name and the APOP digest of the given timestamp.
+// APOP requires the account's password, it fails for the accounts
+// which only have a password hash or neither.
+func (b Pop3Backend) NewSessionAPOP(user []byte, timestamp string, digest []byte) (pop3.BackendSession, error) {
+	accountName := strings.ToLower(string(user))
+	password := b.passwords[accountName]
+	if password == "" || !auth.CheckAPOP(password, timestamp, digest) {
+		return nil, ErrInvalidPassword
+	}
+	return b.newSession(accountName), nil
+}
+
+// newSession returns the BackendSession of the given account
+func (b Pop3Backend) newSession(accountName string) pop3.BackendSession {
+	return &Pop3BackendSession{
+		store:       b.store,
+		accountName: accountName,
+		marked:      make(map[uint64]bool),
+	}
+}
+
+// Pop3Service is a pop3 service which is backed by
+// a local boltdb
+type Pop3Service struct {
+	store          *storage.Store
+	limiter        *rate_limit.Limiter
+	passwords      map[string]string
+	passwordHashes map[string]string
+}
+
+// NewPop3Service creates a new Pop3Service with the given store.
+// The deletion marks left over by the sessions of a previous run
+// which weren't QUIT are removed.
+func NewPop3Service(store *storage.Store) *Pop3Service {
+	s := Pop3Service{
+		store: store,
+	}
+	s.clearStaleMarks()
+	return &s
+}
+
+// clearStaleMarks removes the deleted flags of the messages
+// of every account, no session is open yet
+func (s *Pop3Service) clearStaleMarks() {
+	accounts, err := s.store.Accounts()
+	if err != nil {
+		log.Errorf("failed to list the accounts: %s", err)
+		return
+	}
+	for _, accountName := range accounts {
+		cleared, err := s.store.ClearDeletedFlags(accountName)
+		if err != nil {
+			log.Errorf("failed to clear the deletion marks of %s: %s", accountName, err)
+			continue
+		}
+		if cleared > 0 {
+			log.Noticef("%s: restored %d messages marked by an interrupted POP3 session", accountName, cleared)
+		}
+	}
+}
+
+// SetRateLimiter sets the limiter of the concurrent connections
+// per source IP address, excess connections are rejected
+func (s *Pop3Service) SetRateLimiter(limiter *rate_limit.Limiter) {
+	s.limiter = limiter
+}
+
+// SetPasswords sets the passwords of the accounts keyed by their
+// lower case e-mail address, see config.Config.ProxyPasswords.
+// A session of an account is only opened with the account's
+// password, so that a mail client of one account can't read the
+// mailbox of another, the accounts without one are refused
+func (s *Pop3Service) SetPasswords(passwords map[string]string) {
+	s.passwords = passwords
+}
+
+// SetPasswordHashes sets the password hashes of the accounts keyed by
+// their lower case e-mail address, see config.Config.ProxyPasswordHashes.
+// They apply to the accounts without a password set by SetPasswords.
+func (s *Pop3Service) SetPasswordHashes(hashes map[string]string) {
+	s.passwordHashes = hashes
+}
+
+// HandleConnection is a blocking function that uses the given
+// connection to handle a pop3 session
+func (s *Pop3Service) HandleConnection(conn net.Conn) error {
+	defer conn.Close()
+	if s.limiter != nil {
+		source := rate_limit.SourceKey(conn)
+		if !s.limiter.Acquire(source) {
+			log.Debugf("too many POP3 connections from %s", source)
+			_, err := fmt.Fprintf(conn, "-ERR too many connections, try again later\r\n")
+			return err
+		}
+		defer s.limiter.Release(source)
+	}
+	backend := NewPop3Backend(s.store)
+	backend.passwords = s.passwords
+	backend.passwordHashes = s.passwordHashes
+	pop3Session := pop3.NewSession(conn, backend)
+	pop3Session.Serve()
+	return nil
+}
@@ -17,6 +17,9 @@
 package proxy
 
 import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -27,7 +30,9 @@ import (
 	"testing"
 
 	"github.com/coreos/bbolt"
-	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/client/internal/auth"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/rate_limit"
 	"github.com/katzenpost/client/storage"
 	"github.com/stretchr/testify/require"
 )
@@ -116,6 +121,7 @@ func TestPop3Basics(t *testing.T) {
 	store, err := storage.New(dbFile.Name())
 	require.NoError(err, "unexpected storage.New error")
 	pop3 := NewPop3Service(store)
+	pop3.SetPasswords(map[string]string{testUser: testPass})
 
 	serverConn, clientConn := net.Pipe()
 	var wg sync.WaitGroup
@@ -300,3 +306,122 @@ func TestPop3Basics(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestPop3ConnectionLimit(t *testing.T) {
+	require := require.New(t)
+
+	limiter := rate_limit.New(0, 1)
+	service := NewPop3Service(nil)
+	service.SetRateLimiter(limiter)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	require.True(limiter.Acquire(rate_limit.SourceKey(serverConn)))
+
+	go service.HandleConnection(serverConn)
+	line, err := textproto.NewReader(bufio.NewReader(clientConn)).ReadLine()
+	require.NoError(err, "ReadLine failed")
+	require.Equal("-ERR too many connections, try again later", line)
+}
+
+func TestPop3Passwords(t *testing.T) {
+	require := require.New(t)
+
+	backend := NewPop3Backend(nil)
+	backend.passwords = map[string]string{"alice@acme.com": testPass}
+
+	_, err := backend.NewSession([]byte("Alice@acme.com"), []byte(testPass))
+	require.NoError(err, "NewSession failed")
+	_, err = backend.NewSession([]byte("alice@acme.com"), []byte("guess"))
+	require.Equal(ErrInvalidPassword, err)
+	_, err = backend.NewSession([]byte("alice@acme.com"), nil)
+	require.Equal(ErrInvalidPassword, err)
+
+	// accounts without a password are refused
+	_, err = backend.NewSession([]byte("bob@acme.com"), []byte("guess"))
+	require.Equal(ErrInvalidPassword, err)
+	_, err = backend.NewSession([]byte("bob@acme.com"), nil)
+	require.Equal(ErrInvalidPassword, err)
+	backend.passwords["carol@acme.com"] = ""
+	_, err = backend.NewSession([]byte("carol@acme.com"), nil)
+	require.Equal(ErrInvalidPassword, err)
+
+	hash, err := auth.HashPassword(testPass)
+	require.NoError(err, "HashPassword failed")
+	backend.passwordHashes = map[string]string{"bob@acme.com": hash}
+	_, err = backend.NewSession([]byte("bob@acme.com"), []byte(testPass))
+	require.NoError(err, "NewSession failed")
+	_, err = backend.NewSession([]byte("bob@acme.com"), []byte("guess"))
+	require.Equal(ErrInvalidPassword, err)
+
+	// APOP requires the password itself
+	timestamp := "<1896.697170952@dbc.mtview.ca.us>"
+	digest := md5.Sum([]byte(timestamp + testPass))
+	_, err = backend.NewSessionAPOP([]byte("alice@acme.com"), timestamp, []byte(hex.EncodeToString(digest[:])))
+	require.NoError(err, "NewSessionAPOP failed")
+	_, err = backend.NewSessionAPOP([]byte("alice@acme.com"), "<other@host>", []byte(hex.EncodeToString(digest[:])))
+	require.Equal(ErrInvalidPassword, err)
+	_, err = backend.NewSessionAPOP([]byte("bob@acme.com"), timestamp, []byte(hex.EncodeToString(digest[:])))
+	require.Equal(ErrInvalidPassword, err)
+}
+
+func TestPop3DeletionFlags(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "pop3_db_test3")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected storage.New error")
+	defer store.Close()
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	for _, m := range []string{"one", "two", "three"} {
+		err = store.PutMessage(account, []byte(m))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	backend := NewPop3Backend(store)
+	backend.passwords = map[string]string{account: testPass}
+
+	// the marks of a session closed without QUIT are dropped
+	bs, err := backend.NewSession([]byte(account), []byte(testPass))
+	require.NoError(err, "NewSession failed")
+	session := bs.(*Pop3BackendSession)
+	messages, err := session.Messages()
+	require.NoError(err, "Messages failed")
+	require.Len(messages, 3)
+	err = session.MarkDeleted(0, true)
+	require.NoError(err, "MarkDeleted failed")
+	flags, err := store.MessageFlags(account, 1)
+	require.NoError(err, "MessageFlags failed")
+	require.Equal(storage.FlagDeleted, flags, "DELE not persisted")
+	session.Close()
+	flags, err = store.MessageFlags(account, 1)
+	require.NoError(err, "MessageFlags failed")
+	require.Equal(storage.Flags(0), flags, "mark not dropped")
+
+	// the messages flagged as deleted elsewhere are hidden, only
+	// the messages deleted by the session are expunged
+	_, err = store.UpdateMessageFlags(account, 3, storage.FlagDeleted, 0)
+	require.NoError(err, "UpdateMessageFlags failed")
+	bs, err = backend.NewSession([]byte(account), []byte(testPass))
+	require.NoError(err, "NewSession failed")
+	messages, err = bs.Messages()
+	require.NoError(err, "Messages failed")
+	require.Equal([][]byte{[]byte("one"), []byte("two")}, messages)
+	metadata, err := bs.(*Pop3BackendSession).MessageMetadata()
+	require.NoError(err, "MessageMetadata failed")
+	require.Len(metadata, 2)
+	err = bs.DeleteMessages([]int{1})
+	require.NoError(err, "DeleteMessages failed")
+	bs.Close()
+	messages, err = store.Messages(account)
+	require.NoError(err, "Messages failed")
+	require.Equal([][]byte{[]byte("one"), []byte("three")}, messages)
+
+	// the marks left over by a previous run are dropped at startup
+	NewPop3Service(store)
+	flags, err = store.MessageFlags(account, 3)
+	require.NoError(err, "MessageFlags failed")
+	require.Equal(storage.Flags(0), flags, "stale mark not dropped")
+}
@@ -0,0 +1,389 @@
+// queue_test.go - egress queue manipulation tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueManipulation(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "queue_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	sender := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{sender})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender, store: store},
+	})
+	surbCount := 0
+	putMessage := func(message []byte) []*storage.EgressBlock {
+		blocks, err := fragmentMessage(rand.Reader, message)
+		require.NoError(err, "fragmentMessage failed")
+		egressBlocks := []*storage.EgressBlock{}
+		for _, b := range blocks {
+			egressBlock := storage.EgressBlock{
+				Sender:    sender,
+				Recipient: "bob@nsa.gov",
+				Block:     *b,
+			}
+			surbCount += 1
+			egressBlock.SURBID[0] = byte(surbCount)
+			_, err := store.PutEgressBlock(&egressBlock)
+			require.NoError(err, "PutEgressBlock failed")
+			s.pending[egressBlock.SURBID] = &egressBlock
+			egressBlocks = append(egressBlocks, &egressBlock)
+		}
+		return egressBlocks
+	}
+
+	cancelled := putMessage(make([]byte, block.BlockLength+1))
+	putMessage([]byte("hello"))
+	queue, err := s.Queue()
+	require.NoError(err, "Queue failed")
+	require.Equal(3, len(queue))
+	require.Equal("bob@nsa.gov", queue[0].Recipient)
+
+	err = s.CancelMessage(cancelled[0].Block.MessageID)
+	require.NoError(err, "CancelMessage failed")
+	queue, err = s.Queue()
+	require.NoError(err, "Queue failed")
+	require.Equal(1, len(queue))
+	require.Equal(1, len(s.pending))
+	err = s.CancelMessage(cancelled[0].Block.MessageID)
+	require.Equal(ErrNotQueued, err)
+	err = s.RetransmitBlock(cancelled[0].BlockID)
+	require.Equal(ErrNotQueued, err)
+
+	purged, err := s.PurgeQueue()
+	require.NoError(err, "PurgeQueue failed")
+	require.Equal(1, purged)
+	require.Equal(0, len(s.pending))
+	queue, err = s.Queue()
+	require.NoError(err, "Queue failed")
+	require.Equal(0, len(queue))
+
+	// Block IDs aren't reused after a purge
+	fresh := putMessage([]byte("hello again"))
+	require.NotEqual(cancelled[0].BlockID, fresh[0].BlockID)
+}
+
+func TestRetransmitBlockTimer(t *testing.T) {
+	require := require.New(t)
+
+	sender := "alice@acme.com"
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender},
+	})
+	s.SetClock(clock.NewFake(time.Now()))
+	b := &storage.EgressBlock{Sender: sender}
+	b.SURBID[0] = 1
+	b.BlockID[0] = 1
+	s.add(time.Hour, b)
+	require.Equal(uint64(1), s.timers[b.SURBID])
+	err := s.RetransmitBlock(b.BlockID)
+	require.NoError(err, "RetransmitBlock failed")
+	require.Equal(uint64(2), s.timers[b.SURBID])
+
+	// the replaced timer doesn't retransmit the Block
+	s.failed[b.Block.MessageID] = true
+	s.handleSend(&retransmission{storageBlock: b, timer: 1})
+	require.Len(s.pending, 1, "the replaced timer retransmitted the Block")
+	s.handleSend(&retransmission{storageBlock: b, timer: 2})
+	require.Len(s.pending, 0)
+	require.Len(s.timers, 0)
+}
+
+func TestResolveRecipient(t *testing.T) {
+	require := require.New(t)
+
+	p := NewSmtpProxy(nil, nil, nil, nil, nil, nil, nil)
+	p.SetAliases(map[string]string{"boss": "bob+work@acme", "team@local": "carol@acme"})
+	for arg, expected := range map[string]string{
+		"<alice@acme>":       "alice@acme",
+		"<alice+lists@acme>": "alice+lists@acme",
+		"<boss>":             "bob+work@acme",
+		"<Boss>":             "bob+work@acme",
+		"<team@local>":       "carol@acme",
+	} {
+		address, err := p.resolveRecipient(arg)
+		require.NoError(err, arg)
+		require.Equal(expected, address)
+	}
+}
+
+func TestRewriteRecipient(t *testing.T) {
+	require := require.New(t)
+
+	for _, c := range []struct {
+		to, arg, address, expected string
+	}{
+		{"bob@nsa.gov, carol@acme", "<carol@acme>", "carol@acme", "bob@nsa.gov, carol@acme"},
+		{"dave@acme", "<boss>", "bob+work@acme", "dave@acme"},
+		{"boss, dave@acme", "<Boss>", "bob+work@acme", "bob+work@acme, dave@acme"},
+		{"Team <team@local>, dave@acme", "<team@local>", "carol@acme", "\"Team\" <carol@acme>, <dave@acme>"},
+	} {
+		require.Equal(c.expected, rewriteRecipient(c.to, c.arg, c.address), c.to)
+	}
+}
+
+func TestSplitRecipient(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "queue_test2")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	key, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair() error")
+	userPKI := MockUserPKI{
+		userMap: map[string]*ecdh.PublicKey{
+			"alice@acme":   key.PublicKey(),
+			"c++dev@acme":  key.PublicKey(),
+			"bob+work@nsa": key.PublicKey(),
+		},
+	}
+	p := NewSmtpProxy(nil, nil, userPKI, store, nil, nil, nil)
+	for address, expected := range map[string][2]string{
+		"alice@acme":       {"alice@acme", ""},
+		"alice+lists@acme": {"alice@acme", "lists"},
+		"c++dev@acme":      {"c++dev@acme", ""},
+		"c++dev+ci@acme":   {"c++dev@acme", "ci"},
+		"bob+work@nsa":     {"bob+work@nsa", ""},
+	} {
+		receiver, tag, err := p.splitRecipient(address)
+		require.NoError(err, address)
+		require.Equal(expected[0], receiver, address)
+		require.Equal(expected[1], tag, address)
+	}
+	_, _, err = p.splitRecipient("carol+lists@acme")
+	require.Error(err, "unknown recipient not detected")
+	_, _, err = p.splitRecipient("carol@acme")
+	require.Error(err, "unknown recipient not detected")
+}
+
+func TestSendSlotPriority(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(storage.PriorityInteractive, messagePriority("", 10))
+	require.Equal(storage.PriorityBulk, messagePriority("", block.BlockLength+1))
+	require.Equal(storage.PriorityBulk, messagePriority(" Bulk", 10))
+	require.Equal(storage.PriorityInteractive, messagePriority("interactive", block.BlockLength+1))
+
+	s := NewSendScheduler(map[string]*Sender{})
+	s.EnableSendSlots(time.Hour, true)
+	defer s.StopSendSlots()
+	newBlock := func(id byte, priority storage.Priority) *storage.EgressBlock {
+		b := storage.EgressBlock{
+			Sender:   "alice@acme.com",
+			Priority: priority,
+		}
+		b.Block.MessageID[0] = id
+		err := s.Send(b.Sender, &b.BlockID, &b)
+		require.NoError(err, "Send failed")
+		return &b
+	}
+	bulk1 := newBlock(1, storage.PriorityBulk)
+	bulk2 := newBlock(2, storage.PriorityBulk)
+	interactive := newBlock(3, storage.PriorityInteractive)
+	failed := newBlock(4, storage.PriorityInteractive)
+	s.failed[failed.Block.MessageID] = true
+
+	require.Equal(interactive, s.nextSlotBlock("alice@acme.com"))
+	require.Equal(bulk1, s.nextSlotBlock("alice@acme.com"))
+	require.Equal(bulk2, s.nextSlotBlock("alice@acme.com"))
+	require.Nil(s.nextSlotBlock("alice@acme.com"))
+}
+
+func TestSendQueueWatermarks(t *testing.T) {
+	require := require.New(t)
+
+	s := NewSendScheduler(map[string]*Sender{})
+	s.SetWatermarks(3, 1)
+	s.EnableSendSlots(time.Hour, false)
+	defer s.StopSendSlots()
+	send := func() {
+		b := storage.EgressBlock{Sender: "alice@acme.com"}
+		err := s.Send(b.Sender, &b.BlockID, &b)
+		require.NoError(err, "Send failed")
+	}
+
+	send()
+	send()
+	require.Equal(2, s.Queued())
+	require.False(s.Congested())
+	send()
+	require.True(s.Congested())
+
+	// the queue must drain to the low watermark
+	require.NotNil(s.nextSlotBlock("alice@acme.com"))
+	require.True(s.Congested())
+	require.NotNil(s.nextSlotBlock("alice@acme.com"))
+	require.False(s.Congested())
+	require.NotNil(s.nextSlotBlock("alice@acme.com"))
+	require.Equal(0, s.Queued())
+}
+
+func TestSendSlotIsolation(t *testing.T) {
+	require := require.New(t)
+
+	s := NewSendScheduler(map[string]*Sender{})
+	s.EnableSendSlots(time.Hour, false)
+	defer s.StopSendSlots()
+	send := func(sender string, id byte) *storage.EgressBlock {
+		b := storage.EgressBlock{Sender: sender}
+		b.Block.MessageID[0] = id
+		err := s.Send(b.Sender, &b.BlockID, &b)
+		require.NoError(err, "Send failed")
+		return &b
+	}
+	alice := send("alice@acme.com", 1)
+	bob := send("bob@nsa.gov", 2)
+	require.Equal(2, len(s.slots))
+	require.NotEqual(s.slots["alice@acme.com"].rng, s.slots["bob@nsa.gov"].rng)
+
+	// a slot of one account never carries the Blocks of another
+	require.Equal(bob, s.nextSlotBlock("bob@nsa.gov"))
+	require.Nil(s.nextSlotBlock("bob@nsa.gov"))
+	require.Equal(1, s.Queued())
+	require.Equal(alice, s.nextSlotBlock("alice@acme.com"))
+	require.Nil(s.nextSlotBlock("carol@acme.com"))
+}
+
+func TestSendSlotTrafficProfile(t *testing.T) {
+	require := require.New(t)
+
+	sender := "alice@acme.com"
+	s := NewSendScheduler(map[string]*Sender{sender: &Sender{identity: sender}})
+	err := s.SetTrafficProfile("bob@nsa.gov", &config.TrafficProfile{})
+	require.Equal(ErrUnknownSender, err)
+
+	c := clock.NewFake(time.Now())
+	s.SetClock(c)
+	profile := &config.TrafficProfile{
+		Name:            "burst",
+		PayloadInterval: 1000,
+		LoopInterval:    1000,
+		DropInterval:    1000,
+		MaxBurst:        3,
+	}
+	err = s.SetTrafficProfile(sender, profile)
+	require.NoError(err, "SetTrafficProfile failed")
+	require.Equal(profile, s.TrafficProfile(sender))
+
+	// the Blocks of a sender with a profile are sent in
+	// it's slots although send slots aren't enabled
+	b := &storage.EgressBlock{Sender: sender}
+	err = s.Send(sender, &b.BlockID, b)
+	require.NoError(err, "Send failed")
+	require.Equal(b, s.nextSlotBlock(sender))
+	pending := func(n int) func() bool {
+		return func() bool {
+			return c.Pending() == n
+		}
+	}
+	require.Eventually(pending(1), time.Second, time.Millisecond, "the send slots weren't started")
+
+	// the loop and drop decoys follow the
+	// profile while cover traffic is enabled
+	s.SetCoverTraffic(true)
+	require.Eventually(pending(3), time.Second, time.Millisecond, "the decoys weren't started")
+	err = s.SetTrafficProfile(sender, nil)
+	require.NoError(err, "SetTrafficProfile failed")
+	require.Nil(s.TrafficProfile(sender))
+	require.Eventually(pending(1), time.Second, time.Millisecond, "the decoys weren't stopped")
+	s.StopSendSlots()
+	require.Eventually(pending(0), time.Second, time.Millisecond, "the send slots weren't stopped")
+}
+
+func TestSendSchedulerRecover(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "queue_test3")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	sender := "alice@acme.com"
+
+	putBlock := func(surbID byte) *storage.EgressBlock {
+		b := storage.EgressBlock{
+			Sender:            sender,
+			SenderProvider:    "acme.com",
+			RecipientProvider: "nsa.gov",
+			Priority:          storage.PriorityBulk,
+			Block: block.Block{
+				TotalBlocks: uint16(1),
+				Block:       []byte("hello"),
+			},
+		}
+		b.SURBID[0] = surbID
+		blockID, err := store.PutEgressBlock(&b)
+		require.NoError(err, "PutEgressBlock failed")
+		b.BlockID = *blockID
+		return &b
+	}
+	unsent := putBlock(0)
+	sent := putBlock(1)
+	err = store.RecordSendIntent(&storage.SendIntent{
+		BlockID:  sent.BlockID,
+		SURBID:   sent.SURBID,
+		Time:     time.Now(),
+		Deadline: time.Now().Add(time.Hour),
+	})
+	require.NoError(err, "RecordSendIntent failed")
+	// the intent of a Block ACKed before the crash is left over
+	err = store.RecordSendIntent(&storage.SendIntent{BlockID: [storage.BlockIDLength]byte{0xff}})
+	require.NoError(err, "RecordSendIntent failed")
+
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender, store: store},
+	})
+	s.EnableSendSlots(time.Hour, false)
+	recovered, err := s.Recover()
+	require.NoError(err, "Recover failed")
+	require.Equal(2, recovered)
+
+	// the possibly sent Block awaits it's ACK, the other one is sent
+	require.Equal(sent.BlockID, s.pending[sent.SURBID].BlockID)
+	require.Equal(unsent.BlockID, s.nextSlotBlock(sender).BlockID)
+	intents, err := store.SendIntents()
+	require.NoError(err, "SendIntents failed")
+	require.Len(intents, 1)
+	require.NotNil(intents[sent.BlockID])
+	s.StopSendSlots()
+}
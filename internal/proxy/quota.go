@@ -0,0 +1,161 @@
+// quota.go - mailbox quota aware message retrieval
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/l10n"
+)
+
+// SetMailboxQuota sets the maximum number of bytes of the messages
+// in the Fetcher's mailbox, zero means unlimited. A received message
+// which doesn't fit is deferred: it's Blocks are kept and it's
+// delivered once messages are deleted, smallest first. Once the
+// mailbox is full no more messages are retrieved, they are left at
+// the Provider; note that this also delays the ACKs.
+func (f *Fetcher) SetMailboxQuota(quota uint64) {
+	f.quota = quota
+	// look for the messages deferred before a restart
+	f.hasDeferred = quota > 0
+}
+
+// mailboxUsage returns the number of bytes in the
+// mailbox if it has a quota
+func (f *Fetcher) mailboxUsage() (uint64, error) {
+	if f.quota == 0 {
+		return 0, nil
+	}
+	used, err := f.store.MailboxSize(f.Identity)
+	return uint64(used), err
+}
+
+// lockQuota serializes the deliveries of an account with a
+// mailbox quota, so that the usage doesn't change until the message
+// is delivered, and returns the function releasing the lock
+func (f *Fetcher) lockQuota() func() {
+	if f.quota == 0 {
+		return func() {}
+	}
+	f.quotaLock.Lock()
+	return f.quotaLock.Unlock
+}
+
+// fits returns true if a message of the given size
+// fits in the mailbox holding used bytes
+func (f *Fetcher) fits(used uint64, size int) bool {
+	return f.quota == 0 || used+uint64(size) <= f.quota
+}
+
+// checkQuota delivers the deferred messages which fit in the
+// mailbox and returns true if it's full
+func (f *Fetcher) checkQuota() (bool, error) {
+	if f.quota == 0 {
+		return false, nil
+	}
+	if f.reassembler != nil {
+		// the usage is checked once the
+		// received messages are delivered
+		f.reassembler.wait()
+	}
+	err := f.assembleDeferred()
+	if err != nil {
+		return false, err
+	}
+	used, err := f.mailboxUsage()
+	if err != nil {
+		return false, err
+	}
+	full := used >= f.quota
+	if full && !f.full {
+		log.Warningf("the mailbox of %s is full, messages are left at the Provider until space is freed", f.Identity)
+	} else if !full && f.full {
+		log.Noticef("the mailbox of %s has space again, retrieving messages", f.Identity)
+	}
+	f.full = full
+	return full, nil
+}
+
+// assembleDeferred delivers the deferred
+// messages which fit, smallest first
+func (f *Fetcher) assembleDeferred() error {
+	f.lock.Lock()
+	hasDeferred := f.hasDeferred
+	f.lock.Unlock()
+	if !hasDeferred {
+		return nil
+	}
+	pending, err := f.store.PendingMessages(f.Identity)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.hasDeferred = false
+	f.lock.Unlock()
+	for _, p := range pending {
+		if !p.Complete() {
+			continue
+		}
+		err = f.assemble(p.MessageID, p.TotalBlocks)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferMessage records that the message with the given ID and size
+// was deferred, the user is notified once per message
+func (f *Fetcher) deferMessage(messageID [constants.MessageIDLength]byte, size int, used uint64) {
+	f.lock.Lock()
+	f.hasDeferred = true
+	notified := f.deferred[messageID]
+	f.deferred[messageID] = true
+	f.lock.Unlock()
+	if notified {
+		return
+	}
+	log.Warningf("deferring message %x of %d bytes, the mailbox of %s is nearly full", messageID, size, f.Identity)
+	_, provider, err := config.SplitEmail(f.Identity)
+	if err != nil {
+		log.Errorf("failed to notify the deferral of message %x: %s", messageID, err)
+		return
+	}
+	notice := composeDeferNotice(f.Identity, provider, accountLanguage(f.store, f.Identity), messageID, size, f.quota-used, f.clock.Now())
+	err = f.store.PutMessage(f.Identity, notice)
+	if err != nil {
+		log.Errorf("failed to notify the deferral of message %x: %s", messageID, err)
+	}
+}
+
+// composeDeferNotice returns the notification delivered to
+// the mailbox when a message is deferred, in the given language
+func composeDeferNotice(identity, provider, language string, messageID [constants.MessageIDLength]byte, size int, left uint64, now time.Time) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: MAILER-DAEMON@%s\n", provider)
+	fmt.Fprintf(buf, "To: %s\n", identity)
+	fmt.Fprintf(buf, "Subject: %s\n", l10n.Header(language, l10n.DeferredSubject))
+	fmt.Fprintf(buf, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "%s: auto-generated\n", autoSubmittedHeader)
+	fmt.Fprintf(buf, "MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\n\n")
+	fmt.Fprint(buf, l10n.Sprintf(language, l10n.DeferredBody, size, messageID, left))
+	return buf.Bytes()
+}
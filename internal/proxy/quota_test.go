@@ -0,0 +1,242 @@
+// quota_test.go - mailbox quota tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/mail_filter"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailboxQuota(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "quota_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	account := "bob@nsa.gov"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	fetcher := NewFetcher(account, nil, store, nil, nil)
+	fetcher.SetMailboxQuota(1000)
+	receive := func(id byte, size int) {
+		header := []byte("From: alice@acme.com\nSubject: hi\n\n")
+		message := append(header, bytes.Repeat([]byte{'a'}, size-len(header))...)
+		b := &block.Block{
+			MessageID:   [16]byte{id},
+			TotalBlocks: 1,
+			Block:       message,
+		}
+		err := store.PutIngressBlock(account, &storage.IngressBlock{Block: b})
+		require.NoError(err, "unexpected PutIngressBlock() error")
+		err = fetcher.assemble(b.MessageID, b.TotalBlocks)
+		require.NoError(err, "unexpected assemble() error")
+	}
+	mailbox := func() []int {
+		messages, err := store.Messages(account)
+		require.NoError(err, "unexpected Messages() error")
+		sizes := []int{}
+		for _, m := range messages {
+			sizes = append(sizes, len(m))
+		}
+		return sizes
+	}
+
+	// the size of the headers prepended to the received messages
+	overhead := len(synthesizeHeaders(account, nil, [16]byte{}, 1, "", time.Now()))
+
+	receive(1, 200)
+	receive(2, 800)
+	sizes := mailbox()
+	require.Len(sizes, 2, "the large message was not deferred")
+	require.Equal(200+overhead, sizes[0])
+	notice := sizes[1]
+	receive(3, 50)
+	require.Equal([]int{200 + overhead, notice, 50 + overhead}, mailbox(), "the small message was not delivered")
+	err = fetcher.assemble([16]byte{2}, 1)
+	require.NoError(err, "unexpected assemble() error")
+	require.Len(mailbox(), 3, "the deferral was notified twice")
+
+	full, err := fetcher.checkQuota()
+	require.NoError(err, "unexpected checkQuota() error")
+	require.False(full)
+
+	// freeing space delivers the deferred message
+	err = store.DeleteMessages(account, []int{1, 2, 3})
+	require.NoError(err, "unexpected DeleteMessages() error")
+	full, err = fetcher.checkQuota()
+	require.NoError(err, "unexpected checkQuota() error")
+	require.False(full)
+	require.Equal([]int{800 + overhead}, mailbox())
+	pending, err := store.PendingMessages(account)
+	require.NoError(err, "unexpected PendingMessages() error")
+	require.Len(pending, 0)
+
+	err = store.PutMessage(account, make([]byte, 100))
+	require.NoError(err, "unexpected PutMessage() error")
+	full, err = fetcher.checkQuota()
+	require.NoError(err, "unexpected checkQuota() error")
+	require.True(full)
+}
+
+func TestMailboxQuotaFetch(t *testing.T) {
+	require := require.New(t)
+
+	account := "alice@acme.com"
+	pool, store, _, handler := makeUser(require, account)
+	defer store.Close()
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutMessage(account, make([]byte, 100))
+	require.NoError(err, "unexpected PutMessage() error")
+	fetcher := NewFetcher(account, pool, store, NewSendScheduler(map[string]*Sender{}), handler)
+	fetcher.SetMailboxQuota(100)
+	session := pool.Sessions[account].(*MockSession)
+
+	// the ACKs are processed while the mailbox is full
+	session.recvCommands = []commands.Command{commands.MessageACK{Sequence: 0, QueueSizeHint: 2, Payload: make([]byte, 100)}}
+	hint, err := fetcher.Fetch()
+	require.NoError(err, "unexpected Fetch() error")
+	require.Equal(uint8(2), hint)
+	require.Equal(uint32(1), fetcher.sequence)
+
+	// a message is left at the Provider
+	session.recvCommands = []commands.Command{commands.Message{Sequence: 1, QueueSizeHint: 1, Payload: make([]byte, 100)}}
+	hint, err = fetcher.Fetch()
+	require.NoError(err, "unexpected Fetch() error")
+	require.Equal(uint8(0), hint)
+	require.Equal(uint32(1), fetcher.sequence, "the message was acknowledged")
+	require.Equal(commands.RetrieveMessage{Sequence: 1}, session.sentCommands[1])
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Len(messages, 1)
+}
+
+func TestFetcherFilter(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "quota_test2")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	account := "bob@nsa.gov"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutContact(&storage.Contact{Alias: "mallory", Address: "Mallory@evil.com", Blocked: true})
+	require.NoError(err, "unexpected PutContact() error")
+
+	fetcher := NewFetcher(account, nil, store, nil, nil)
+	fetcher.SetFilter(mail_filter.NewContacts(false))
+	receive := func(id byte, from string) {
+		b := &block.Block{
+			MessageID:   [16]byte{id},
+			TotalBlocks: 1,
+			Block:       []byte("From: " + from + "\nSubject: hi\n\nhello\n"),
+		}
+		err := store.PutIngressBlock(account, &storage.IngressBlock{Block: b})
+		require.NoError(err, "unexpected PutIngressBlock() error")
+		err = fetcher.assemble(b.MessageID, b.TotalBlocks)
+		require.NoError(err, "unexpected assemble() error")
+		blocks, _, err := store.GetIngressBlocks(account, b.MessageID)
+		require.NoError(err, "unexpected GetIngressBlocks() error")
+		require.Len(blocks, 0, "the blocks were not removed")
+	}
+
+	receive(1, "alice@acme.com")
+	receive(2, "mallory@evil.com")
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Len(messages, 1, "the blocked sender was not discarded")
+	require.Contains(string(messages[0]), "alice@acme.com")
+
+	// the messages a filter fails on are quarantined
+	fetcher.SetFilter(mail_filter.Chain{failingFilter{}})
+	receive(3, "carol@fsb.ru")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Len(messages, 1, "the message was delivered to the INBOX")
+	junk, err := store.FolderMessages(account, storage.FolderJunk)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Len(junk, 1, "the message was not quarantined")
+	require.Contains(string(junk[0].Message), "carol@fsb.ru")
+}
+
+func TestFetcherDropsInvalidMessage(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "quota_test3")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	account := "bob@nsa.gov"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	fetcher := NewFetcher(account, nil, store, nil, nil)
+	messageID := [16]byte{1}
+	// Blocks sent with different static keys can't be reassembled
+	for i := 0; i < 2; i++ {
+		b := &storage.IngressBlock{
+			S: [32]byte{byte(i)},
+			Block: &block.Block{
+				MessageID:   messageID,
+				TotalBlocks: 2,
+				BlockID:     uint16(i),
+				Block:       []byte("hello"),
+			},
+		}
+		err = store.PutIngressBlock(account, b)
+		require.NoError(err, "unexpected PutIngressBlock() error")
+	}
+	err = fetcher.reassemble(messageID, 2)
+	require.Error(err, "invalid message not detected")
+	blocks, _, err := store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Len(blocks, 0, "the blocks of the invalid message were kept")
+	events, err := store.Events(time.Time{}, 0)
+	require.NoError(err, "unexpected Events() error")
+	require.Len(events, 1)
+	require.Equal(storage.EventMessageDropped, events[0].Type)
+
+	// the failure is reported once, retrying it is a no-op
+	require.Error(fetcher.retryFailed(), "the failure was not reported")
+	require.NoError(fetcher.retryFailed())
+}
+
+// failingFilter is a mail_filter.Filter which always fails
+type failingFilter struct{}
+
+func (failingFilter) Filter(m *mail_filter.Message) (mail_filter.Verdict, error) {
+	return mail_filter.Accept, errors.New("filter failure")
+}
@@ -0,0 +1,142 @@
+// reassembly.go - parallel reassembly of the received messages
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/supervisor"
+)
+
+// errReassemblerHalted is returned by submit once the reassembler
+// is halted, the Blocks of the message are kept in the store
+var errReassemblerHalted = errors.New("reassembly workers halted")
+
+// reassemblyQueueLength is the number of reassemblies queued
+// for a worker before the receive goroutine is blocked
+const reassemblyQueueLength = 64
+
+// reassembly is the reassembly of a message
+// of which a Block was stored
+type reassembly struct {
+	messageID   [constants.MessageIDLength]byte
+	totalBlocks uint16
+}
+
+// reassembler reassembles the received messages on a pool of
+// workers. Each message is assigned to a worker by it's ID so that
+// the Blocks of a message are processed in the order they were
+// received, while different messages are reassembled in parallel.
+type reassembler struct {
+	sync.WaitGroup
+
+	identity string
+	assemble func(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error
+	queues   []chan reassembly
+	// supervisor recovers the panics of the reassemblies,
+	// it must be set before the first submit
+	supervisor *supervisor.Supervisor
+	// pending counts the submitted reassemblies which aren't done
+	pending sync.WaitGroup
+	// lock guards halted, the queues are closed
+	// by halt while it's held for writing
+	lock   sync.RWMutex
+	halted bool
+}
+
+// newReassembler starts the given number of workers
+// reassembling the messages of the given account with assemble
+func newReassembler(identity string, workers int, assemble func([constants.MessageIDLength]byte, uint16) error) *reassembler {
+	r := reassembler{
+		identity: identity,
+		assemble: assemble,
+		queues:   make([]chan reassembly, workers),
+	}
+	for i := range r.queues {
+		r.queues[i] = make(chan reassembly, reassemblyQueueLength)
+		r.Add(1)
+		go r.worker(r.queues[i])
+	}
+	return &r
+}
+
+// queue returns the queue of the worker the
+// message with the given ID is assigned to
+func (r *reassembler) queue(messageID [constants.MessageIDLength]byte) chan reassembly {
+	h := fnv.New32a()
+	h.Write(messageID[:])
+	return r.queues[h.Sum32()%uint32(len(r.queues))]
+}
+
+// submit queues the reassembly of the message with the given ID,
+// it blocks while the queue of the message's worker is full.
+// submit and wait must be called by the same goroutine.
+func (r *reassembler) submit(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.halted {
+		return errReassemblerHalted
+	}
+	r.pending.Add(1)
+	r.queue(messageID) <- reassembly{
+		messageID:   messageID,
+		totalBlocks: totalBlocks,
+	}
+	return nil
+}
+
+// wait waits until the submitted reassemblies are done
+func (r *reassembler) wait() {
+	r.pending.Wait()
+}
+
+// halt stops the workers once the submitted reassemblies
+// are done, submit fails afterwards
+func (r *reassembler) halt() {
+	r.lock.Lock()
+	if !r.halted {
+		r.halted = true
+		for _, queue := range r.queues {
+			close(queue)
+		}
+	}
+	r.lock.Unlock()
+	r.Wait()
+}
+
+func (r *reassembler) worker(queue <-chan reassembly) {
+	defer r.Done()
+	for m := range queue {
+		r.handle(m)
+	}
+}
+
+// handle reassembles the given message, the failures
+// are retried by the Fetcher, see Fetcher.retryFailed
+func (r *reassembler) handle(m reassembly) {
+	defer r.pending.Done()
+	if r.supervisor != nil {
+		defer r.supervisor.Recover("reassembly of " + r.identity)
+	}
+	err := r.assemble(m.messageID, m.totalBlocks)
+	if err != nil {
+		log.Debugf("%s: failed to reassemble message %x: %s", r.identity, m.messageID, err)
+	}
+}
@@ -0,0 +1,118 @@
+// reassembly_test.go - tests for the parallel reassembly
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassembler(t *testing.T) {
+	require := require.New(t)
+
+	var lock sync.Mutex
+	processed := make(map[[constants.MessageIDLength]byte][]uint16)
+	r := newReassembler("alice@acme.com", 4, func(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error {
+		lock.Lock()
+		defer lock.Unlock()
+		processed[messageID] = append(processed[messageID], totalBlocks)
+		return nil
+	})
+	defer r.halt()
+
+	// the Blocks of a message are processed in order,
+	// the order is recorded in totalBlocks
+	for i := uint16(0); i < 50; i++ {
+		for id := byte(0); id < 10; id++ {
+			r.submit([constants.MessageIDLength]byte{id}, i)
+		}
+	}
+	r.wait()
+	require.Equal(10, len(processed))
+	for _, order := range processed {
+		require.Equal(50, len(order))
+		for i, totalBlocks := range order {
+			require.Equal(uint16(i), totalBlocks, "blocks of a message processed out of order")
+		}
+	}
+}
+
+func TestReassemblerParallel(t *testing.T) {
+	require := require.New(t)
+
+	// find two messages assigned to different workers
+	r := newReassembler("alice@acme.com", 2, nil)
+	first := [constants.MessageIDLength]byte{0}
+	second := [constants.MessageIDLength]byte{1}
+	for r.queue(first) == r.queue(second) {
+		second[0]++
+	}
+	r.halt()
+
+	blocked := make(chan struct{})
+	done := make(chan struct{})
+	r = newReassembler("alice@acme.com", 2, func(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error {
+		if messageID == first {
+			<-blocked
+			return nil
+		}
+		close(done)
+		return nil
+	})
+	r.submit(first, 1)
+	r.submit(second, 1)
+	// the second message isn't held up by the first
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		require.Fail("messages aren't reassembled in parallel")
+	}
+	close(blocked)
+	r.halt()
+}
+
+func TestReassemblerRecover(t *testing.T) {
+	require := require.New(t)
+
+	done := make(chan struct{})
+	r := newReassembler("alice@acme.com", 1, func(messageID [constants.MessageIDLength]byte, totalBlocks uint16) error {
+		if totalBlocks == 1 {
+			panic("reassembly failure")
+		}
+		close(done)
+		return nil
+	})
+	r.supervisor = supervisor.New()
+	defer r.supervisor.Halt()
+	// the worker continues after a panic
+	require.NoError(r.submit([constants.MessageIDLength]byte{1}, 1))
+	require.NoError(r.submit([constants.MessageIDLength]byte{2}, 2))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		require.Fail("the worker didn't recover from the panic")
+	}
+	r.wait()
+	r.halt()
+	require.Equal(errReassemblerHalted, r.submit([constants.MessageIDLength]byte{3}, 1))
+	r.halt()
+}
@@ -0,0 +1,148 @@
+// received.go - headers synthesized for the received messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+)
+
+// synthesizedHeaders are the headers the client prepends to the
+// received messages, their occurrences in the messages as sent
+// are removed so that they can be trusted
+var synthesizedHeaders = []string{
+	storage.MessageIDHeader,
+	storage.BlockCountHeader,
+	storage.AuthenticatedSenderHeader,
+}
+
+// pinnedKeys returns the keys pinned in the contact book
+// indexed by lower case e-mail address
+func pinnedKeys(store *storage.Store) (map[string][32]byte, error) {
+	contacts, err := store.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][32]byte)
+	for _, c := range contacts {
+		if c.PinnedKey != nil {
+			key := [32]byte{}
+			copy(key[:], c.PinnedKey.Bytes())
+			keys[strings.ToLower(c.Address)] = key
+		}
+	}
+	return keys, nil
+}
+
+// contactsByAddress returns the contact book
+// indexed by lower case e-mail address
+func contactsByAddress(store *storage.Store) (map[string]*storage.Contact, error) {
+	contacts, err := store.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	byAddress := make(map[string]*storage.Contact)
+	for _, c := range contacts {
+		byAddress[strings.ToLower(c.Address)] = c
+	}
+	return byAddress, nil
+}
+
+// senderAddress returns the lower case address of the
+// message's From header, an empty string if it has none
+func senderAddress(message []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return ""
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(from.Address)
+}
+
+// authenticatedSender returns the address of the message's From
+// header if the message's Blocks were encrypted with the key pinned
+// for it, an empty string otherwise
+func authenticatedSender(message []byte, s [32]byte, pinned map[string][32]byte) string {
+	address := senderAddress(message)
+	if address == "" {
+		return ""
+	}
+	key, ok := pinned[address]
+	if !ok || key != s {
+		return ""
+	}
+	return address
+}
+
+// stripHeaders removes the given headers from the message's header
+func stripHeaders(message []byte, names []string) []byte {
+	stripped := new(bytes.Buffer)
+	r := bufio.NewReader(bytes.NewReader(message))
+	skipping := false
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 || err != nil {
+			// end of the header
+			stripped.Write(line)
+			break
+		}
+		if skipping && (line[0] == ' ' || line[0] == '\t') {
+			// continuation of a removed header
+			continue
+		}
+		skipping = false
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			for _, name := range names {
+				if strings.EqualFold(string(line[:i]), name) {
+					skipping = true
+					break
+				}
+			}
+		}
+		if !skipping {
+			stripped.Write(line)
+		}
+	}
+	io.Copy(stripped, r)
+	return stripped.Bytes()
+}
+
+// synthesizeHeaders prepends the Received header and the metadata
+// headers to a message received by the given account, sender is
+// the authenticated sender or an empty string
+func synthesizeHeaders(accountName string, message []byte, messageID [constants.MessageIDLength]byte, blocks int, sender string, now time.Time) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Received: by mixclient for <%s>; %s\n", accountName, now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "%s: %x\n", storage.MessageIDHeader, messageID)
+	fmt.Fprintf(buf, "%s: %d\n", storage.BlockCountHeader, blocks)
+	if sender != "" {
+		fmt.Fprintf(buf, "%s: %s\n", storage.AuthenticatedSenderHeader, sender)
+	}
+	buf.Write(stripHeaders(message, synthesizedHeaders))
+	return buf.Bytes()
+}
@@ -0,0 +1,46 @@
+// received_test.go - received message header tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSynthesizeHeaders(t *testing.T) {
+	require := require.New(t)
+
+	// forged metadata headers are removed along with their continuations
+	message := []byte(fmt.Sprintf("From: bob@nsa.gov\n%s: 3\n%s:\n bob@nsa.gov\nSubject: hi\n\n%s: 1\n",
+		storage.BlockCountHeader, storage.AuthenticatedSenderHeader, storage.BlockCountHeader))
+	now := time.Date(2017, 11, 3, 12, 0, 0, 0, time.UTC)
+	synthesized := synthesizeHeaders("alice@acme.com", message, [16]byte{1}, 2, "", now)
+	require.Equal(fmt.Sprintf("Received: by mixclient for <alice@acme.com>; Fri, 03 Nov 2017 12:00:00 +0000\n"+
+		"%s: 01000000000000000000000000000000\n%s: 2\nFrom: bob@nsa.gov\nSubject: hi\n\n%s: 1\n",
+		storage.MessageIDHeader, storage.BlockCountHeader, storage.BlockCountHeader), string(synthesized))
+
+	pinned := map[string][32]byte{"bob@nsa.gov": [32]byte{7}}
+	require.Equal("bob@nsa.gov", authenticatedSender(message, [32]byte{7}, pinned))
+	require.Equal("", authenticatedSender(message, [32]byte{8}, pinned))
+	synthesized = synthesizeHeaders("alice@acme.com", message, [16]byte{1}, 2, "bob@nsa.gov", now)
+	require.True(strings.Contains(string(synthesized), storage.AuthenticatedSenderHeader+": bob@nsa.gov\nFrom:"))
+}
@@ -0,0 +1,215 @@
+// rotation.go - mixnet epoch key rotation
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/epochtime"
+)
+
+// KeyRotator tracks the mixnet epochs and, at each epoch boundary,
+// collects the garbage of the Store, retiring the expired SURB keys
+// among others, and retransmits the Blocks whose SURBs expired
+// before their ACK arrived
+type KeyRotator struct {
+	sync.Mutex
+
+	store     *storage.Store
+	scheduler *SendScheduler
+	accounts  []string
+	epoch     uint64
+	clock     clock.Clock
+	timer     clock.Timer
+	stopped   bool
+
+	// audit only logs the SURB keys which would be retired
+	audit bool
+}
+
+// NewKeyRotator creates a new KeyRotator
+func NewKeyRotator(store *storage.Store, scheduler *SendScheduler) *KeyRotator {
+	r := KeyRotator{
+		store:     store,
+		scheduler: scheduler,
+		clock:     clock.Real,
+	}
+	return &r
+}
+
+// SetClock sets the Clock telling the epochs, e.g.
+// a clock.Fake in tests. It must be set before Start.
+func (r *KeyRotator) SetClock(c clock.Clock) {
+	r.Lock()
+	defer r.Unlock()
+	r.clock = c
+}
+
+// now returns the current epoch and the time till the next one
+func (r *KeyRotator) now() (uint64, time.Duration) {
+	r.Lock()
+	c := r.clock
+	r.Unlock()
+	epoch, _, till := epochNow(c)
+	return epoch, till
+}
+
+// epochNow returns the current epoch of the given Clock, the
+// time elapsed since it began and the time till the next one
+func epochNow(c clock.Clock) (uint64, time.Duration, time.Duration) {
+	return epochtime.FromUnix(c.Now().Unix())
+}
+
+// SetAccounts sets the accounts whose expired
+// SURBs and idempotency keys are collected
+func (r *KeyRotator) SetAccounts(accounts []string) {
+	r.Lock()
+	defer r.Unlock()
+	r.accounts = accounts
+}
+
+// SetAudit enables or disables the audit mode, in which the
+// SURB keys which would be retired at each epoch boundary are
+// logged and kept instead, so that the retention policy may be
+// reviewed before it removes anything
+func (r *KeyRotator) SetAudit(audit bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.audit = audit
+}
+
+// Start rotates the keys of the current epoch
+// and schedules the rotation at each epoch boundary
+func (r *KeyRotator) Start() {
+	epoch, till := r.now()
+	r.rotate(epoch)
+	r.Lock()
+	defer r.Unlock()
+	r.stopped = false
+	r.timer = r.clock.AfterFunc(till, r.run)
+}
+
+// Stop stops the key rotation
+func (r *KeyRotator) Stop() {
+	r.Lock()
+	defer r.Unlock()
+	r.stopped = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// run is called at each epoch boundary
+func (r *KeyRotator) run() {
+	epoch, till := r.now()
+	r.rotate(epoch)
+	r.Lock()
+	defer r.Unlock()
+	if !r.stopped {
+		r.timer = r.clock.AfterFunc(till, r.run)
+	}
+}
+
+// rotate retires the SURB keys which expired by the given epoch
+// and retransmits the Blocks which can no longer be ACKed
+func (r *KeyRotator) rotate(epoch uint64) {
+	r.Lock()
+	if epoch == r.epoch {
+		r.Unlock()
+		return
+	}
+	r.epoch = epoch
+	audit := r.audit
+	accounts := r.accounts
+	r.Unlock()
+	log.Debugf("KeyRotator rotating keys for epoch %d", epoch)
+	recordEvent(r.store, storage.EventEpochRollover, "", nil, fmt.Sprintf("epoch %d", epoch))
+	if audit {
+		r.auditRetire(epoch)
+	} else {
+		r.collectGarbage(accounts, epoch)
+	}
+	if r.scheduler != nil {
+		r.scheduler.RetransmitExpired(epoch)
+	}
+}
+
+// collectGarbage reclaims the records which expired by the
+// given epoch and reports the number of reclaimed records
+func (r *KeyRotator) collectGarbage(accounts []string, epoch uint64) {
+	report, err := r.store.CollectGarbage(accounts, epoch)
+	if err != nil {
+		log.Errorf("KeyRotator failed to collect garbage: %s", err)
+		return
+	}
+	if report.Total() == 0 {
+		return
+	}
+	log.Noticef("KeyRotator reclaimed %s", report)
+	recordEvent(r.store, storage.EventGarbageCollected, "", nil, report.String())
+}
+
+// auditRetire logs the SURB keys and egress blocks
+// which would be removed by the given epoch
+func (r *KeyRotator) auditRetire(epoch uint64) {
+	candidates, err := r.store.PreviewRetireSURBKeys(epoch)
+	if err != nil {
+		log.Errorf("KeyRotator failed to preview SURB key retirement: %s", err)
+		return
+	}
+	stale, err := r.store.PreviewStaleEgressBlocks()
+	if err != nil {
+		log.Errorf("KeyRotator failed to preview stale egress blocks: %s", err)
+		return
+	}
+	candidates = append(candidates, stale...)
+	for _, c := range candidates {
+		log.Noticef("KeyRotator audit: would remove %s", c)
+	}
+}
+
+// holdBoundary holds back the given Block, of which no route
+// could be built because it's hops would arrive too close to the
+// next epoch boundary, until the boundary has passed
+func (s *SendScheduler) holdBoundary(storageBlock *storage.EgressBlock) {
+	s.Lock()
+	defer s.Unlock()
+	s.boundary = append(s.boundary, storageBlock)
+	if s.boundaryTimer == nil {
+		_, _, till := epochtime.FromUnix(s.clock.Now().Unix())
+		s.boundaryTimer = s.clock.AfterFunc(till+constants.EpochBoundarySlack, s.resumeBoundary)
+	}
+}
+
+// resumeBoundary sends the Blocks held back by holdBoundary
+func (s *SendScheduler) resumeBoundary() {
+	s.Lock()
+	held := s.boundary
+	s.boundary = nil
+	s.boundaryTimer = nil
+	s.Unlock()
+	for _, storageBlock := range held {
+		if !s.enqueueSlot(storageBlock) {
+			s.sendNow(storageBlock)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// rotation_test.go - key rotation tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRotatorFakeClock(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "rotation_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	// a minute before an epoch boundary
+	start := epochtime.Epoch.Add(1000*epochtime.Period - time.Minute)
+	c := clock.NewFake(start)
+	r := NewKeyRotator(store, nil)
+	r.SetClock(c)
+	r.Start()
+	defer r.Stop()
+
+	rollovers := func() int {
+		events, err := store.Events(time.Time{}, 0)
+		require.NoError(err, "unexpected Events() error")
+		n := 0
+		for _, e := range events {
+			if e.Type == storage.EventEpochRollover {
+				n++
+			}
+		}
+		return n
+	}
+	require.Equal(1, rollovers())
+	c.Advance(time.Minute)
+	require.Equal(2, rollovers())
+	// a day of epochs passes in no time
+	c.Advance(24 * time.Hour)
+	require.Equal(2+int(24*time.Hour/epochtime.Period), rollovers())
+	require.Equal(1, c.Pending())
+}
+
+func TestHoldBoundary(t *testing.T) {
+	require := require.New(t)
+
+	sender := "alice@acme.com"
+	s := NewSendScheduler(map[string]*Sender{
+		sender: &Sender{identity: sender},
+	})
+	// a minute before an epoch boundary
+	c := clock.NewFake(epochtime.Epoch.Add(1000*epochtime.Period - time.Minute))
+	s.SetClock(c)
+	// the resumed Blocks are queued for their send slots,
+	// which aren't started
+	s.slotsEnabled = true
+	s.haltSlots = make(chan struct{})
+	s.slots = map[string]*slotQueue{sender: &slotQueue{}}
+	b := &storage.EgressBlock{Sender: sender}
+	s.holdBoundary(b)
+	s.holdBoundary(b)
+	require.Equal(1, c.Pending())
+
+	c.Advance(time.Minute)
+	require.Len(s.boundary, 2, "Blocks resumed before the boundary passed")
+	c.Advance(constants.EpochBoundarySlack)
+	require.Len(s.boundary, 0, "Blocks held back after the boundary passed")
+	require.Equal(b, s.nextSlotBlock(sender))
+	require.Equal(b, s.nextSlotBlock(sender))
+	require.Equal(0, c.Pending())
+}
@@ -0,0 +1,1219 @@
+// send.go - mix network client send
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/log_limiter"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/internal/scheduler"
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/client/user_pki"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// ErrSendWindowFull is the error returned when the in-flight
+// windows of all the send channels of a Sender are full
+var ErrSendWindowFull = errors.New("send window full")
+
+// ErrUnknownSender is the error returned when
+// the given sender has no configured account
+var ErrUnknownSender = errors.New("unknown sender")
+
+// sendChannel is a wire protocol session
+// the Blocks of a Sender are striped across
+type sendChannel struct {
+	mutex    *sync.Mutex
+	session  wire.SessionInterface
+	inFlight int
+
+	// pool is set on the channel of the identity's session,
+	// which is replaced with it's Mux once it fails over
+	pool     *session_pool.SessionPool
+	identity string
+}
+
+// send writes the given command to the session of the channel,
+// through the current Mux of the session if it's multiplexed
+func (c *sendChannel) send(cmd commands.Command) error {
+	if c.pool != nil {
+		if mux := c.pool.Mux(c.identity); mux != nil {
+			return mux.Send(cmd)
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.session.SendCommand(cmd)
+}
+
+// Sender is used to send a message over the mixnet
+type Sender struct {
+	sync.Mutex
+
+	identity     string
+	channels     []*sendChannel
+	next         int
+	window       int
+	inFlight     map[[constants.SURBIDLength]byte]*sendChannel
+	store        *storage.Store
+	routeFactory *path_selection.RouteFactory
+	userPKI      user_pki.UserPKI
+	handler      *block.Handler
+	randReader   io.Reader
+	monthlyCap   uint64
+	surbs        *SURBManager
+	clock        clock.Clock
+}
+
+// NewSender creates a new Sender which stripes
+// the Blocks across all the send channels of the
+// given identity in the session pool
+func NewSender(identity string, pool *session_pool.SessionPool, store *storage.Store, routeFactory *path_selection.RouteFactory, userPKI user_pki.UserPKI, handler *block.Handler) (*Sender, error) {
+	sessions, mutexes, err := pool.SendChannels(identity)
+	if err != nil {
+		return nil, err
+	}
+	channels := []*sendChannel{}
+	for i, session := range sessions {
+		channels = append(channels, &sendChannel{
+			mutex:   mutexes[i],
+			session: session,
+		})
+	}
+	channels[0].pool = pool
+	channels[0].identity = identity
+	s := Sender{
+		channels:     channels,
+		inFlight:     make(map[[constants.SURBIDLength]byte]*sendChannel),
+		identity:     identity,
+		store:        store,
+		routeFactory: routeFactory,
+		userPKI:      pinnedUserPKI(store, userPKI),
+		handler:      handler,
+		randReader:   entropy.Reader,
+		clock:        clock.Real,
+	}
+	return &s, nil
+}
+
+// SetRandomReader sets the entropy source used to create
+// Sphinx packets and SURBs, this defaults to crypto/rand
+func (s *Sender) SetRandomReader(randReader io.Reader) {
+	s.randReader = randReader
+}
+
+// SetClock sets the Clock telling the epochs and the times of the
+// send intents and the usage, e.g. a clock.Fake in tests. It must
+// be set before any Block is sent, see SendScheduler.SetClock.
+func (s *Sender) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// SetSURBManager sets the SURBManager whose pooled SURBs carry the
+// ACKs, received SURBs are then used to send the Blocks when the
+// PKI document is unavailable
+func (s *Sender) SetSURBManager(surbs *SURBManager) {
+	s.surbs = surbs
+}
+
+// SetSendWindow sets the maximum number of un-ACKed Blocks in
+// flight on each send channel, zero means unlimited
+func (s *Sender) SetSendWindow(window int) {
+	s.Lock()
+	defer s.Unlock()
+	s.window = window
+}
+
+// reserveChannel returns the next send channel
+// with room in it's in-flight window
+func (s *Sender) reserveChannel() (*sendChannel, error) {
+	s.Lock()
+	defer s.Unlock()
+	for i := 0; i < len(s.channels); i++ {
+		c := s.channels[(s.next+i)%len(s.channels)]
+		if s.window == 0 || c.inFlight < s.window {
+			s.next = (s.next + i + 1) % len(s.channels)
+			c.inFlight++
+			return c, nil
+		}
+	}
+	return nil, ErrSendWindowFull
+}
+
+// unreserve returns the window slot of a Block
+// which failed to be sent on the given channel
+func (s *Sender) unreserve(c *sendChannel) {
+	s.Lock()
+	defer s.Unlock()
+	c.inFlight--
+}
+
+// release frees the window slot of the in-flight Block with the
+// given SURB ID, once it's ACKed or it's retransmission is due.
+// It returns true if a slot was freed.
+func (s *Sender) release(surbID [constants.SURBIDLength]byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.inFlight[surbID]
+	if !ok {
+		return false
+	}
+	delete(s.inFlight, surbID)
+	c.inFlight--
+	return true
+}
+
+// releaseAll frees the window slots of all the in-flight Blocks
+func (s *Sender) releaseAll() {
+	s.Lock()
+	defer s.Unlock()
+	for surbID, c := range s.inFlight {
+		delete(s.inFlight, surbID)
+		c.inFlight--
+	}
+}
+
+// composeSphinxPacket creates a SendPacket wire protocol command with
+// a Sphinx packet and SURB header
+func (s *Sender) composeSphinxPacket(blockID *[storage.BlockIDLength]byte, storageBlock *storage.EgressBlock, payload []byte) (*commands.SendPacket, time.Duration, error) {
+	forwardPath, replyPath, surbID, rtt, err := s.routeFactory.BuildMessage(storageBlock.Block.MessageID, storageBlock.SenderProvider, storageBlock.RecipientProvider, storageBlock.RecipientID)
+	if err != nil {
+		if s.surbs != nil {
+			return s.composeSURBPacket(blockID, storageBlock, payload, err)
+		}
+		return nil, rtt, err
+	}
+	var surb, surbKeys []byte
+	if s.surbs != nil {
+		forwardDelay := path_selection.PathDelay(forwardPath)
+		pooled, err := s.surbs.ackSURB(storageBlock.Recipient, forwardDelay)
+		if err == nil {
+			surb, surbKeys, surbID = pooled.SURB, pooled.Keys, &pooled.ID
+			rtt = forwardDelay + pooled.Delay
+		} else if err != storage.ErrNoPooledSURB {
+			log.Errorf("failed to take a pooled SURB: %s", err)
+		}
+	}
+	if surb == nil {
+		surb, surbKeys, err = sphinx.NewSURB(s.randReader, replyPath)
+		if err != nil {
+			return nil, rtt, err
+		}
+	}
+	storageBlock.SURBKeys = surbKeys
+	storageBlock.SendAttempts += 1
+	storageBlock.SURBID = *surbID
+	storageBlock.SURBEpoch, _, _ = epochNow(s.clock)
+	err = s.store.Update(blockID, storageBlock)
+	if err != nil {
+		return nil, rtt, err
+	}
+	sphinxPacket, err := sphinx.NewPacket(s.randReader, forwardPath, append(surb, payload...))
+	if err != nil {
+		return nil, rtt, err
+	}
+	cmd := commands.SendPacket{
+		SphinxPacket: sphinxPacket,
+	}
+	return &cmd, rtt, nil
+}
+
+// composeSURBPacket creates a SendPacket wire protocol command with
+// a Sphinx packet built from a SURB received from the recipient, which
+// is used when the forward path can't be built. Such packets carry no
+// SURB so their ACK can't be received, the Block is left without
+// SURBKeys and it's forgotten once sent, see SendScheduler.forget.
+func (s *Sender) composeSURBPacket(blockID *[storage.BlockIDLength]byte, storageBlock *storage.EgressBlock, payload []byte, pathErr error) (*commands.SendPacket, time.Duration, error) {
+	epoch, _, till := epochNow(s.clock)
+	received, err := s.store.TakeReceivedSURB(s.identity, strings.ToLower(storageBlock.Recipient), epoch, till-constants.EpochBoundarySlack)
+	if err != nil {
+		return nil, till, pathErr
+	}
+	surbID := [constants.SURBIDLength]byte{}
+	_, err = io.ReadFull(s.randReader, surbID[:])
+	if err != nil {
+		return nil, till, err
+	}
+	storageBlock.SURBKeys = nil
+	storageBlock.SendAttempts += 1
+	storageBlock.SURBID = surbID
+	storageBlock.SURBEpoch = epoch
+	err = s.store.Update(blockID, storageBlock)
+	if err != nil {
+		return nil, till, err
+	}
+	sphinxPacket, _, err := sphinx.NewPacketFromSURB(received.SURB, append(make([]byte, sphinx.SURBLength), payload...))
+	if err != nil {
+		return nil, till, err
+	}
+	log.Debugf("sending a Block to %s with a received SURB: %s", storageBlock.Recipient, pathErr)
+	cmd := commands.SendPacket{
+		SphinxPacket: sphinxPacket,
+	}
+	return &cmd, till, nil
+}
+
+// Send sends an encrypted block over the mixnet on the next send
+// channel, ErrSendWindowFull is returned if all of them are full
+func (s *Sender) Send(blockID *[storage.BlockIDLength]byte, storageBlock *storage.EgressBlock) (time.Duration, error) {
+	var rtt time.Duration
+	err := s.checkCap()
+	if err != nil {
+		return rtt, err
+	}
+	receiverKey, err := s.userPKI.GetKey(storageBlock.Recipient)
+	if err != nil {
+		return rtt, err
+	}
+	blockCiphertext, err := encryptBlock(s.handler, receiverKey, &storageBlock.Block)
+	if err != nil {
+		return rtt, err
+	}
+	c, err := s.reserveChannel()
+	if err != nil {
+		return rtt, err
+	}
+	cmd, rtt, err := s.composeSphinxPacket(blockID, storageBlock, blockCiphertext)
+	if err != nil {
+		s.unreserve(c)
+		return rtt, err
+	}
+	// the intent is journaled ahead of the transmission so
+	// that after a crash the Block is known to be possibly sent
+	now := s.clock.Now()
+	err = s.store.RecordSendIntent(&storage.SendIntent{
+		BlockID:  *blockID,
+		SURBID:   storageBlock.SURBID,
+		Time:     now,
+		Deadline: now.Add(rtt + constants.RoundTripTimeSlop),
+	})
+	if err != nil {
+		s.unreserve(c)
+		return rtt, err
+	}
+	err = c.send(cmd)
+	if err != nil {
+		s.unreserve(c)
+		clearErr := s.store.ClearSendIntent(blockID)
+		if clearErr != nil {
+			log.Errorf("failed to clear the send intent of a Block: %s", clearErr)
+		}
+		return rtt, err
+	}
+	recordUsage(s.store, s.identity, len(cmd.SphinxPacket), 0)
+	s.Lock()
+	s.inFlight[storageBlock.SURBID] = c
+	s.Unlock()
+	return rtt, nil
+}
+
+// SendScheduler is used to send messages and schedule the retransmission
+// if the ACK wasn't received in time. Once all the Blocks of a message
+// are ACKed, or once the retransmission of a Block is given up, a
+// delivery status notification is delivered to the sender's mailbox.
+type SendScheduler struct {
+	sync.Mutex
+
+	sched   *scheduler.PriorityScheduler
+	clock   clock.Clock
+	senders map[string]*Sender
+	pending map[[constants.SURBIDLength]byte]*storage.EgressBlock
+	failed  map[[constants.MessageIDLength]byte]bool
+
+	// relayed are the messages of which some Blocks were sent with
+	// a received SURB, they can't be reported as delivered
+	relayed map[[constants.MessageIDLength]byte]bool
+	errLog  *log_limiter.Limiter
+
+	// timers holds the current retransmission timer of each
+	// pending Block by SURB ID, the retransmissions scheduled
+	// before it are ignored, see schedule
+	timers    map[[constants.SURBIDLength]byte]uint64
+	lastTimer uint64
+
+	// slotInterval is the mean interval between two send slots.
+	// Each sender has it's own slots, see slotQueue, the Blocks of
+	// a sender are sent immediately unless send slots are enabled
+	// or the sender has a traffic profile.
+	slotInterval time.Duration
+	slotsEnabled bool
+	prioritize   bool
+	slots        map[string]*slotQueue
+	profiles     map[string]*config.TrafficProfile
+	haltSlots    chan struct{}
+	lowPower     bool
+
+	// coverTraffic enables the decoys of the traffic profiles,
+	// decoyHalts stops the decoys of each sender, see startDecoys
+	coverTraffic bool
+	decoyHalts   map[string]chan struct{}
+
+	// supervisor runs the send slots, see SetSupervisor
+	supervisor *supervisor.Supervisor
+
+	// blocked are the Blocks waiting for room
+	// in the send window of their Sender
+	blocked []*storage.EgressBlock
+
+	// paused are the Blocks held back until the next
+	// month by the monthly usage cap of their Sender
+	paused      []*storage.EgressBlock
+	resumeTimer clock.Timer
+
+	// stale are the Blocks held back while the PKI document of
+	// the current epoch is missing or the local clock is skewed
+	freshness  PKIFreshness
+	skewCheck  ClockSkewCheck
+	stale      []*storage.EgressBlock
+	staleTimer clock.Timer
+
+	// boundary are the Blocks held back until the next epoch
+	// boundary has passed, no route could be built before it
+	boundary      []*storage.EgressBlock
+	boundaryTimer clock.Timer
+
+	// the SMTP proxy refuses submissions once highWatermark
+	// Blocks are queued, until no more than lowWatermark are
+	highWatermark int
+	lowWatermark  int
+	congested     bool
+}
+
+// slotQueue holds the Blocks of one sender waiting for it's send
+// slots. The senders don't share their slots nor their random
+// source, so that the traffic of one account can't be correlated
+// with the traffic of another account of the same client.
+type slotQueue struct {
+	rng         *mathrand.Rand
+	interactive []*storage.EgressBlock
+	bulk        []*storage.EgressBlock
+}
+
+// len returns the number of queued Blocks
+func (q *slotQueue) len() int {
+	return len(q.interactive) + len(q.bulk)
+}
+
+// NewSendScheduler creates a new SendScheduler which is used
+// to implement our Stop and Wait ARQ for sending messages
+// on behalf of one or more user identities
+func NewSendScheduler(senders map[string]*Sender) *SendScheduler {
+	s := SendScheduler{
+		senders: senders,
+		pending: make(map[[constants.SURBIDLength]byte]*storage.EgressBlock),
+		failed:  make(map[[constants.MessageIDLength]byte]bool),
+		relayed: make(map[[constants.MessageIDLength]byte]bool),
+		errLog:  log_limiter.New(log, constants.ErrorLogInterval),
+		timers:  make(map[[constants.SURBIDLength]byte]uint64),
+
+		slotInterval:  constants.DefaultSendSlotInterval,
+		profiles:      make(map[string]*config.TrafficProfile),
+		decoyHalts:    make(map[string]chan struct{}),
+		highWatermark: constants.DefaultQueueHighWatermark,
+		lowWatermark:  constants.DefaultQueueLowWatermark,
+	}
+	s.sched = scheduler.New(s.handleSend)
+	s.clock = clock.Real
+	return &s
+}
+
+// SetClock sets the Clock of the retransmissions, the send slots
+// and the usage cap pauses, and that of the senders, e.g. a
+// clock.Fake in tests. It must be set before any Block is sent.
+func (s *SendScheduler) SetClock(c clock.Clock) {
+	s.Lock()
+	defer s.Unlock()
+	s.clock = c
+	s.sched.SetClock(c)
+	for _, sender := range s.senders {
+		sender.SetClock(c)
+	}
+}
+
+// SetSupervisor sets the Supervisor running the send slots
+// and recovering the panics of the retransmissions. It must be
+// set before EnableSendSlots and before any Block is sent.
+func (s *SendScheduler) SetSupervisor(sup *supervisor.Supervisor) {
+	s.Lock()
+	defer s.Unlock()
+	s.supervisor = sup
+	s.sched.SetSupervisor(sup, "retransmission scheduler")
+}
+
+// EnableSendSlots causes the Blocks to be sent in send slots whose
+// intervals are exponentially distributed with the given mean, one
+// Block per slot, instead of immediately. If prioritize is true the
+// Blocks of interactive messages are sent ahead of the queued bulk
+// transfers, this reorders our Blocks without changing the timing
+// of the slots and therefore the external traffic pattern.
+func (s *SendScheduler) EnableSendSlots(meanInterval time.Duration, prioritize bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.slotsEnabled {
+		return
+	}
+	s.slotsEnabled = true
+	s.slotInterval = meanInterval
+	s.prioritize = prioritize
+	for sender := range s.senders {
+		s.slotQueue(sender)
+	}
+}
+
+// slotQueue returns the slotQueue of the given sender, it's
+// created and it's slots started if it doesn't exist yet.
+// The caller must hold the lock.
+func (s *SendScheduler) slotQueue(sender string) *slotQueue {
+	if s.haltSlots == nil {
+		s.slots = make(map[string]*slotQueue)
+		s.haltSlots = make(chan struct{})
+	}
+	q, ok := s.slots[sender]
+	if !ok {
+		q = &slotQueue{
+			rng: entropy.NewMath(),
+		}
+		s.slots[sender] = q
+		halt := s.haltSlots
+		if s.supervisor == nil {
+			go s.slotLoop(sender, q, halt, nil)
+		} else {
+			s.supervisor.Go("send slots "+sender, func(stop <-chan struct{}) error {
+				s.slotLoop(sender, q, halt, stop)
+				return nil
+			})
+		}
+	}
+	return q
+}
+
+// queued returns the number of Blocks waiting to
+// be sent, the caller must hold the lock
+func (s *SendScheduler) queued() int {
+	queued := len(s.blocked)
+	for _, q := range s.slots {
+		queued += q.len()
+	}
+	return queued
+}
+
+// SetWatermarks sets the number of queued Blocks above which
+// Congested returns true, until no more than low are queued
+func (s *SendScheduler) SetWatermarks(high, low int) {
+	s.Lock()
+	defer s.Unlock()
+	s.highWatermark = high
+	s.lowWatermark = low
+}
+
+// Queued returns the number of Blocks waiting to be sent, those
+// held back by the monthly usage cap aren't counted
+func (s *SendScheduler) Queued() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queued()
+}
+
+// Congested returns true if the send queue reached the high
+// watermark and didn't drain to the low watermark since, in which
+// case new messages should be refused rather than queued
+func (s *SendScheduler) Congested() bool {
+	s.Lock()
+	defer s.Unlock()
+	queued := s.queued()
+	if s.congested && queued <= s.lowWatermark {
+		log.Noticef("send queue drained to %d Blocks, accepting submissions", queued)
+		s.congested = false
+	} else if !s.congested && queued >= s.highWatermark {
+		log.Warningf("send queue reached %d Blocks, refusing submissions", queued)
+		s.congested = true
+	}
+	return s.congested
+}
+
+// SetLowPower enables or disables the low power mode, which
+// lengthens the intervals between the send slots and coalesces
+// the retransmission timers so that the radio wakes up less
+// often, at the expense of some traffic analysis resistance
+func (s *SendScheduler) SetLowPower(enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.lowPower = enabled
+	if enabled {
+		s.sched.SetGranularity(constants.LowPowerTimerGranularity)
+	} else {
+		s.sched.SetGranularity(0)
+	}
+}
+
+// StopSendSlots stops the send slots, the Blocks which are still
+// queued are sent immediately. The senders with a traffic profile
+// start new slots once they send again.
+func (s *SendScheduler) StopSendSlots() {
+	s.Lock()
+	s.slotsEnabled = false
+	if s.haltSlots == nil {
+		s.Unlock()
+		return
+	}
+	close(s.haltSlots)
+	s.haltSlots = nil
+	queued := []*storage.EgressBlock{}
+	for _, q := range s.slots {
+		queued = append(queued, q.interactive...)
+		queued = append(queued, q.bulk...)
+	}
+	s.slots = nil
+	s.Unlock()
+	for _, storageBlock := range queued {
+		s.sendNow(storageBlock)
+	}
+}
+
+// SetTrafficProfile sets the traffic profile of the given sender,
+// it's Blocks are then sent in send slots following the profile's
+// interval and burst, whether or not EnableSendSlots was called,
+// and it's decoys are sent following the profile's loop and drop
+// intervals, see SetCoverTraffic. The profile may be switched at
+// runtime, it applies from the next send slot on. A nil profile
+// reverts the sender to the EnableSendSlots parameters, or to
+// sending immediately once it's queued Blocks are sent.
+func (s *SendScheduler) SetTrafficProfile(sender string, profile *config.TrafficProfile) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.senders[sender]; !ok {
+		return ErrUnknownSender
+	}
+	if profile == nil {
+		delete(s.profiles, sender)
+	} else {
+		s.profiles[sender] = profile
+	}
+	s.startDecoys(sender)
+	return nil
+}
+
+// TrafficProfile returns the traffic profile
+// of the given sender or nil if it has none
+func (s *SendScheduler) TrafficProfile(sender string) *config.TrafficProfile {
+	s.Lock()
+	defer s.Unlock()
+	return s.profiles[sender]
+}
+
+// slotLoop waits for each send slot of the given sender until halted
+func (s *SendScheduler) slotLoop(sender string, q *slotQueue, halt chan struct{}, stop <-chan struct{}) {
+	for {
+		s.Lock()
+		interval := s.slotInterval
+		if p := s.profiles[sender]; p != nil && p.PayloadInterval > 0 {
+			interval = p.SlotInterval()
+		}
+		if s.lowPower {
+			interval *= constants.LowPowerSlotFactor
+		}
+		delay := time.Duration(rand.Exp(q.rng, 1/float64(interval)))
+		timer := s.clock.NewTimer(delay)
+		s.Unlock()
+		select {
+		case <-halt:
+			timer.Stop()
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		s.sendSlot(sender)
+	}
+}
+
+// enqueueSlot queues the given Block for the next free send slot,
+// it returns false if it's sender has no send slots
+func (s *SendScheduler) enqueueSlot(storageBlock *storage.EgressBlock) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.slotsEnabled && s.profiles[storageBlock.Sender] == nil {
+		return false
+	}
+	q := s.slotQueue(storageBlock.Sender)
+	if s.prioritize && storageBlock.Priority == storage.PriorityInteractive {
+		q.interactive = append(q.interactive, storageBlock)
+	} else {
+		q.bulk = append(q.bulk, storageBlock)
+	}
+	return true
+}
+
+// nextSlotBlock dequeues the Block of the given sender to be sent
+// in it's current send slot, interactive Blocks first, or returns nil
+func (s *SendScheduler) nextSlotBlock(sender string) *storage.EgressBlock {
+	s.Lock()
+	defer s.Unlock()
+	q, ok := s.slots[sender]
+	if !ok {
+		return nil
+	}
+	for q.len() > 0 {
+		var storageBlock *storage.EgressBlock
+		if len(q.interactive) > 0 {
+			storageBlock, q.interactive = q.interactive[0], q.interactive[1:]
+		} else {
+			storageBlock, q.bulk = q.bulk[0], q.bulk[1:]
+		}
+		if !s.failed[storageBlock.Block.MessageID] {
+			return storageBlock
+		}
+	}
+	return nil
+}
+
+// sendSlot sends the next queued Blocks of the given sender, if any,
+// up to the maximum burst of the sender's traffic profile
+func (s *SendScheduler) sendSlot(sender string) {
+	burst := 1
+	if p := s.TrafficProfile(sender); p != nil {
+		burst = p.Burst()
+	}
+	for i := 0; i < burst; i++ {
+		storageBlock := s.nextSlotBlock(sender)
+		if storageBlock == nil {
+			s.Lock()
+			coverTraffic := s.coverTraffic
+			s.Unlock()
+			if i == 0 && coverTraffic {
+				s.sendDecoy(sender, false)
+			}
+			return
+		}
+		s.sendNow(storageBlock)
+	}
+}
+
+// dropQueued removes the queued Blocks matching the given filter
+func (s *SendScheduler) dropQueued(drop func(*storage.EgressBlock) bool) {
+	filter := func(queue []*storage.EgressBlock) []*storage.EgressBlock {
+		kept := []*storage.EgressBlock{}
+		for _, b := range queue {
+			if !drop(b) {
+				kept = append(kept, b)
+			}
+		}
+		return kept
+	}
+	for _, q := range s.slots {
+		q.interactive = filter(q.interactive)
+		q.bulk = filter(q.bulk)
+	}
+	s.blocked = filter(s.blocked)
+	s.paused = filter(s.paused)
+	s.stale = filter(s.stale)
+	s.boundary = filter(s.boundary)
+}
+
+// unblock dispatches the first Block waiting for
+// room in the send window of the given Sender
+func (s *SendScheduler) unblock(sender string) {
+	s.Lock()
+	var storageBlock *storage.EgressBlock
+	for i, b := range s.blocked {
+		if b.Sender == sender {
+			storageBlock = b
+			s.blocked = append(s.blocked[:i], s.blocked[i+1:]...)
+			break
+		}
+	}
+	s.Unlock()
+	if storageBlock == nil {
+		return
+	}
+	if !s.enqueueSlot(storageBlock) {
+		s.sendNow(storageBlock)
+	}
+}
+
+// releaseWindow frees the send window slot of the given
+// in-flight Block and dispatches a blocked Block in it's place
+func (s *SendScheduler) releaseWindow(storageBlock *storage.EgressBlock) {
+	if s.senders[storageBlock.Sender].release(storageBlock.SURBID) {
+		s.unblock(storageBlock.Sender)
+	}
+}
+
+// ErrorStats returns the statistics of the retransmission
+// errors per sender identity
+func (s *SendScheduler) ErrorStats() map[string]log_limiter.ClassStats {
+	return s.errLog.Stats()
+}
+
+// Send sends the given block and adds a retransmit job to the scheduler
+func (s *SendScheduler) Send(sender string, blockID *[storage.BlockIDLength]byte, storageBlock *storage.EgressBlock) error {
+	if s.enqueueSlot(storageBlock) || s.holdStale(storageBlock) {
+		return nil
+	}
+	rtt, err := s.senders[sender].Send(blockID, storageBlock)
+	if err == ErrSendWindowFull {
+		s.Lock()
+		s.blocked = append(s.blocked, storageBlock)
+		s.Unlock()
+		return nil
+	}
+	if err == ErrUsageCapReached {
+		s.pause(storageBlock)
+		return nil
+	}
+	if err == path_selection.ErrNearEpochBoundary {
+		s.holdBoundary(storageBlock)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.recordSent(storageBlock)
+	if storageBlock.SURBKeys == nil {
+		s.forget(storageBlock)
+		return nil
+	}
+	// schedule a resend in the future
+	// (but it can be cancelled if we receive an ACK)
+	s.add(rtt, storageBlock)
+	return nil
+}
+
+// add adds a retransmit job to the scheduler
+func (s *SendScheduler) add(rtt time.Duration, storageBlock *storage.EgressBlock) {
+	s.Lock()
+	s.pending[storageBlock.SURBID] = storageBlock
+	s.Unlock()
+	s.schedule(rtt+constants.RoundTripTimeSlop, storageBlock)
+}
+
+// retransmission is a scheduled retransmission of a pending Block
+type retransmission struct {
+	storageBlock *storage.EgressBlock
+	timer        uint64
+}
+
+// schedule schedules the retransmission of the given pending Block
+// after the given delay, replacing it's previous retransmission timer
+// so that it isn't retransmitted twice
+func (s *SendScheduler) schedule(delay time.Duration, storageBlock *storage.EgressBlock) {
+	s.Lock()
+	s.lastTimer++
+	r := retransmission{
+		storageBlock: storageBlock,
+		timer:        s.lastTimer,
+	}
+	s.timers[storageBlock.SURBID] = r.timer
+	s.Unlock()
+	s.sched.Add(delay, &r)
+}
+
+// Cancel ensures that a given retransmit will not be executed
+func (s *SendScheduler) Cancel(id [constants.SURBIDLength]byte) {
+	s.Lock()
+	storageBlock, ok := s.pending[id]
+	delete(s.pending, id)
+	delete(s.timers, id)
+	s.Unlock()
+	if !ok {
+		log.Error("SendScheduler Cancellation received an unknown SURB ID")
+		return
+	}
+	s.releaseWindow(storageBlock)
+	store := s.senders[storageBlock.Sender].store
+	remaining, err := store.RemoveEgressBlock(storageBlock)
+	if err != nil {
+		log.Errorf("SendScheduler failed to remove ACKed block: %s", err)
+		return
+	}
+	recordEvent(store, storage.EventBlockAcked, storageBlock.Sender, &storageBlock.Block.MessageID, fmt.Sprintf("block %d of %d", storageBlock.Block.BlockID, storageBlock.Block.TotalBlocks))
+	if remaining == 0 {
+		if s.takeRelayed(storageBlock) {
+			s.notify(storageBlock, dsnActionRelayed)
+			return
+		}
+		recordEvent(store, storage.EventMessageAcked, storageBlock.Sender, &storageBlock.Block.MessageID, "to "+storageBlock.Recipient)
+		s.notify(storageBlock, dsnActionDelivered)
+	}
+}
+
+// forget removes the given Block once it's sent with a SURB received
+// from the recipient. It's ACK can't be received, so it's neither
+// retransmitted nor counted towards constants.MaxSendAttempts.
+func (s *SendScheduler) forget(storageBlock *storage.EgressBlock) {
+	s.releaseWindow(storageBlock)
+	s.Lock()
+	s.relayed[storageBlock.Block.MessageID] = true
+	s.Unlock()
+	store := s.senders[storageBlock.Sender].store
+	remaining, err := store.RemoveEgressBlock(storageBlock)
+	if err != nil {
+		log.Errorf("SendScheduler failed to remove relayed block: %s", err)
+		return
+	}
+	if remaining == 0 {
+		s.takeRelayed(storageBlock)
+		s.notify(storageBlock, dsnActionRelayed)
+	}
+}
+
+// takeRelayed reports whether some Blocks of the given Block's
+// message were sent with a received SURB, and forgets the message
+func (s *SendScheduler) takeRelayed(storageBlock *storage.EgressBlock) bool {
+	s.Lock()
+	defer s.Unlock()
+	relayed := s.relayed[storageBlock.Block.MessageID]
+	delete(s.relayed, storageBlock.Block.MessageID)
+	return relayed
+}
+
+// decryptACK decrypts the given ACK payload with
+// the SURB keys of the pending Block it acknowledges
+func (s *SendScheduler) decryptACK(id [constants.SURBIDLength]byte, payload []byte) ([]byte, error) {
+	s.Lock()
+	storageBlock, ok := s.pending[id]
+	s.Unlock()
+	if !ok || storageBlock.SURBKeys == nil {
+		return nil, errors.New("no SURB keys to decrypt the ACK with")
+	}
+	// DecryptSURBPayload obliterates the keys
+	keys := append([]byte{}, storageBlock.SURBKeys...)
+	return sphinx.DecryptSURBPayload(payload, keys)
+}
+
+// notify delivers a delivery status notification
+// to the mailbox of the sender of the given Block
+func (s *SendScheduler) notify(storageBlock *storage.EgressBlock, action string) {
+	store := s.senders[storageBlock.Sender].store
+	language := accountLanguage(store, storageBlock.Sender)
+	err := store.PutMessage(storageBlock.Sender, composeDSN(storageBlock, action, language, s.clock.Now()))
+	if err != nil {
+		log.Errorf("SendScheduler failed to deliver DSN: %s", err)
+	}
+}
+
+// giveUp stops the retransmission of all the Blocks
+// of the given Block's message and notifies the sender
+func (s *SendScheduler) giveUp(storageBlock *storage.EgressBlock) {
+	messageID := storageBlock.Block.MessageID
+	s.Lock()
+	alreadyFailed := s.failed[messageID]
+	s.failed[messageID] = true
+	delete(s.relayed, messageID)
+	s.dropQueued(func(b *storage.EgressBlock) bool {
+		return b.Block.MessageID == messageID
+	})
+	s.Unlock()
+	if alreadyFailed {
+		return
+	}
+	log.Errorf("SendScheduler giving up on message %x after %d attempts", messageID, storageBlock.SendAttempts)
+	err := s.senders[storageBlock.Sender].store.RemoveMessageEgressBlocks(messageID)
+	if err != nil {
+		log.Errorf("SendScheduler failed to remove blocks: %s", err)
+	}
+	detail := fmt.Sprintf("to %s after %d attempts", storageBlock.Recipient, storageBlock.SendAttempts)
+	recordEvent(s.senders[storageBlock.Sender].store, storage.EventMessageBounced, storageBlock.Sender, &messageID, detail)
+	s.notify(storageBlock, dsnActionFailed)
+}
+
+// RetransmitExpired immediately retransmits the pending Blocks whose
+// SURB has expired by the given epoch, their ACK can no longer arrive
+func (s *SendScheduler) RetransmitExpired(epoch uint64) {
+	s.Lock()
+	expired := []*storage.EgressBlock{}
+	for _, storageBlock := range s.pending {
+		if storageBlock.SURBEpoch+constants.SURBKeyRetentionEpochs <= epoch {
+			expired = append(expired, storageBlock)
+		}
+	}
+	s.Unlock()
+	for _, storageBlock := range expired {
+		s.schedule(time.Duration(0), storageBlock)
+	}
+}
+
+// Recover reschedules the Blocks left in the egress queue by a
+// previous run, it must be called once before any Block is sent.
+// The Blocks with a send intent were possibly sent before a crash,
+// their ACK is awaited until the intent's deadline and they are
+// retransmitted afterwards. The Blocks without one were never sent
+// and are sent right away. It returns the number of rescheduled
+// Blocks.
+func (s *SendScheduler) Recover() (int, error) {
+	recovered, possiblySent := 0, 0
+	for _, store := range s.stores() {
+		blocks, err := store.EgressBlocks()
+		if err != nil {
+			return recovered, err
+		}
+		intents, err := store.SendIntents()
+		if err != nil {
+			return recovered, err
+		}
+		for _, storageBlock := range blocks {
+			if _, ok := s.senders[storageBlock.Sender]; !ok {
+				continue
+			}
+			intent, ok := intents[storageBlock.BlockID]
+			delete(intents, storageBlock.BlockID)
+			recovered++
+			if !ok || intent.SURBID != storageBlock.SURBID {
+				if !s.enqueueSlot(storageBlock) {
+					s.sendNow(storageBlock)
+				}
+				continue
+			}
+			possiblySent++
+			delay := intent.Deadline.Sub(s.clock.Now())
+			if delay < 0 {
+				delay = 0
+			}
+			s.Lock()
+			s.pending[storageBlock.SURBID] = storageBlock
+			s.Unlock()
+			s.schedule(delay, storageBlock)
+		}
+		// the intents of removed Blocks are left over
+		for blockID := range intents {
+			err = store.ClearSendIntent(&blockID)
+			if err != nil {
+				return recovered, err
+			}
+		}
+	}
+	if recovered > 0 {
+		log.Noticef("SendScheduler recovered %d Blocks, %d of them possibly sent", recovered, possiblySent)
+	}
+	return recovered, nil
+}
+
+// ErrNotQueued is the error returned when a queue
+// operation refers to an unknown message or Block
+var ErrNotQueued = errors.New("message or block is not queued")
+
+// stores returns the distinct Stores of the senders
+func (s *SendScheduler) stores() []*storage.Store {
+	stores := []*storage.Store{}
+	seen := make(map[*storage.Store]bool)
+	for _, sender := range s.senders {
+		if !seen[sender.store] {
+			seen[sender.store] = true
+			stores = append(stores, sender.store)
+		}
+	}
+	return stores
+}
+
+// Queue returns the queued Blocks of all the senders
+func (s *SendScheduler) Queue() ([]*storage.EgressBlock, error) {
+	queue := []*storage.EgressBlock{}
+	for _, store := range s.stores() {
+		blocks, err := store.EgressBlocks()
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, blocks...)
+	}
+	return queue, nil
+}
+
+// CancelMessage stops the transmission of all the Blocks
+// of the given message and removes them from the queue.
+// No delivery status notification is sent.
+func (s *SendScheduler) CancelMessage(messageID [constants.MessageIDLength]byte) error {
+	queue, err := s.Queue()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, b := range queue {
+		if b.Block.MessageID == messageID {
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotQueued
+	}
+	s.Lock()
+	released := []*storage.EgressBlock{}
+	for id, b := range s.pending {
+		if b.Block.MessageID == messageID {
+			delete(s.pending, id)
+			delete(s.timers, id)
+			released = append(released, b)
+		}
+	}
+	s.dropQueued(func(b *storage.EgressBlock) bool {
+		return b.Block.MessageID == messageID
+	})
+	delete(s.relayed, messageID)
+	s.Unlock()
+	for _, b := range released {
+		s.releaseWindow(b)
+	}
+	for _, store := range s.stores() {
+		err = store.RemoveMessageEgressBlocks(messageID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetransmitBlock immediately retransmits the given pending
+// Block instead of waiting for it's retransmission timer,
+// which is cancelled
+func (s *SendScheduler) RetransmitBlock(blockID [storage.BlockIDLength]byte) error {
+	s.Lock()
+	var storageBlock *storage.EgressBlock
+	for _, b := range s.pending {
+		if b.BlockID == blockID {
+			storageBlock = b
+		}
+	}
+	s.Unlock()
+	if storageBlock == nil {
+		return ErrNotQueued
+	}
+	s.schedule(time.Duration(0), storageBlock)
+	return nil
+}
+
+// PurgeQueue stops all the transmissions and removes all the
+// Blocks from the queue, it returns the number of removed Blocks
+func (s *SendScheduler) PurgeQueue() (int, error) {
+	s.Lock()
+	s.pending = make(map[[constants.SURBIDLength]byte]*storage.EgressBlock)
+	s.timers = make(map[[constants.SURBIDLength]byte]uint64)
+	for _, q := range s.slots {
+		q.interactive = nil
+		q.bulk = nil
+	}
+	s.blocked = nil
+	s.paused = nil
+	s.stale = nil
+	s.boundary = nil
+	s.Unlock()
+	for _, sender := range s.senders {
+		sender.releaseAll()
+	}
+	purged := 0
+	for _, store := range s.stores() {
+		n, err := store.PurgeEgress()
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// handleSend is called by the scheduler to perform
+// a retransmit, the retransmissions which were
+// rescheduled since are ignored
+func (s *SendScheduler) handleSend(task interface{}) {
+	r, ok := task.(*retransmission)
+	if !ok {
+		log.Error("SendScheduler got invalid task from priority scheduler.")
+		return
+	}
+	storageBlock := r.storageBlock
+	s.Lock()
+	if timer, ok := s.timers[storageBlock.SURBID]; ok && timer != r.timer {
+		s.Unlock()
+		return
+	}
+	delete(s.timers, storageBlock.SURBID)
+	_, ok = s.pending[storageBlock.SURBID]
+	delete(s.pending, storageBlock.SURBID)
+	failed := s.failed[storageBlock.Block.MessageID]
+	s.Unlock()
+	if !ok {
+		return
+	}
+	// the ACK is overdue, so the Block no longer counts
+	// against the in-flight window of it's send channel
+	s.releaseWindow(storageBlock)
+	if failed {
+		return
+	}
+	if storageBlock.SendAttempts >= constants.MaxSendAttempts {
+		s.giveUp(storageBlock)
+		return
+	}
+	if s.enqueueSlot(storageBlock) {
+		return
+	}
+	s.sendNow(storageBlock)
+}
+
+// sendNow sends the given Block and schedules it's retransmission
+func (s *SendScheduler) sendNow(storageBlock *storage.EgressBlock) {
+	if s.holdStale(storageBlock) {
+		return
+	}
+	rtt, err := s.senders[storageBlock.Sender].Send(&storageBlock.BlockID, storageBlock)
+	if err == ErrSendWindowFull {
+		s.Lock()
+		s.blocked = append(s.blocked, storageBlock)
+		s.Unlock()
+		return
+	}
+	if err == ErrUsageCapReached {
+		s.pause(storageBlock)
+		return
+	}
+	if err == path_selection.ErrNearEpochBoundary {
+		s.holdBoundary(storageBlock)
+		return
+	}
+	if err != nil {
+		s.errLog.Error(storageBlock.Sender, err)
+	} else {
+		s.recordSent(storageBlock)
+		if storageBlock.SURBKeys == nil {
+			s.forget(storageBlock)
+			return
+		}
+	}
+	s.add(rtt, storageBlock)
+}
+
+// recordSent records the transmission of the given Block
+func (s *SendScheduler) recordSent(storageBlock *storage.EgressBlock) {
+	detail := fmt.Sprintf("block %d of %d attempt %d", storageBlock.Block.BlockID, storageBlock.Block.TotalBlocks, storageBlock.SendAttempts)
+	recordEvent(s.senders[storageBlock.Sender].store, storage.EventBlockSent, storageBlock.Sender, &storageBlock.Block.MessageID, detail)
+}
@@ -28,9 +28,9 @@ import (
 	"time"
 
 	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/internal/session_pool"
 	"github.com/katzenpost/client/mix_pki"
-	"github.com/katzenpost/client/path_selection"
-	"github.com/katzenpost/client/session_pool"
 	"github.com/katzenpost/client/storage"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
@@ -412,3 +412,67 @@ func TestSender(t *testing.T) {
 	require.NoError(err, "Send failure")
 	t.Logf("Bob send rtt %s", rtt)
 }
+
+func TestSendChannels(t *testing.T) {
+	require := require.New(t)
+
+	mixPKI, _ := newMixPKI(require)
+	routeFactory := path_selection.New(mixPKI, 5, float64(.123))
+
+	aliceEmail := "alice@acme.com"
+	alicePool, aliceStore, alicePrivKey, aliceBlockHandler := makeUser(require, aliceEmail)
+	defer aliceStore.Close()
+	err := aliceStore.CreateAccountBuckets([]string{aliceEmail})
+	require.NoError(err, "CreateAccountBuckets failure")
+	bobPrivKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failure")
+	userPKI := MockUserPKI{
+		userMap: map[string]*ecdh.PublicKey{
+			aliceEmail:    alicePrivKey.PublicKey(),
+			"bob@nsa.gov": bobPrivKey.PublicKey(),
+		},
+	}
+	secondSession := &MockSession{}
+	alicePool.AddSendChannel(aliceEmail, secondSession)
+	firstSession := alicePool.Sessions[aliceEmail].(*MockSession)
+
+	aliceSender, err := NewSender(aliceEmail, alicePool, aliceStore, routeFactory, userPKI, aliceBlockHandler)
+	require.NoError(err, "NewSender failure")
+	aliceSender.SetSendWindow(1)
+	s := NewSendScheduler(map[string]*Sender{
+		aliceEmail: aliceSender,
+	})
+
+	bobID := [sphinxconstants.RecipientIDLength]byte{}
+	copy(bobID[:], "bob")
+	egressBlocks := []*storage.EgressBlock{}
+	for i := 0; i < 3; i++ {
+		egressBlock := storage.EgressBlock{
+			Sender:            aliceEmail,
+			SenderProvider:    "acme.com",
+			Recipient:         "bob@nsa.gov",
+			RecipientProvider: "nsa.gov",
+			RecipientID:       bobID,
+			Block: block.Block{
+				TotalBlocks: 3,
+				BlockID:     uint16(i),
+				Block:       []byte("striped across the send channels"),
+			},
+		}
+		blockID, err := aliceStore.PutEgressBlock(&egressBlock)
+		require.NoError(err, "PutEgressBlock failure")
+		err = s.Send(aliceEmail, blockID, &egressBlock)
+		require.NoError(err, "Send failure")
+		egressBlocks = append(egressBlocks, &egressBlock)
+	}
+
+	// one Block per channel, the third waits for a window slot
+	require.Equal(1, len(firstSession.sentCommands))
+	require.Equal(1, len(secondSession.sentCommands))
+	require.Equal(1, len(s.blocked))
+
+	s.Cancel(egressBlocks[0].SURBID)
+	require.Equal(0, len(s.blocked))
+	require.Equal(2, len(firstSession.sentCommands))
+	require.Equal(1, len(secondSession.sentCommands))
+}
@@ -0,0 +1,1036 @@
+// smtp_proxy.go - mix network client smtp submission proxy
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package proxy provides mixnet client proxies
+package proxy
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/crypto/envelope"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/internal/rate_limit"
+	"github.com/katzenpost/client/internal/send_ledger"
+	"github.com/katzenpost/client/internal/session_pool"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/client/user_pki"
+	"github.com/op/go-logging"
+	"github.com/siebenmann/smtpd"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// logWriter is used to present the io.Reader interface
+// to our SMTP library for logging. this is only required
+// because of our SMTP library choice and isn't otherwise needed.
+type logWriter struct {
+	log *logging.Logger
+}
+
+// newLogWriter creates a new logWriter
+func newLogWriter(log *logging.Logger) *logWriter {
+	writer := logWriter{
+		log: log,
+	}
+	return &writer
+}
+
+// Write writes a message to the log
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.log.Debug(string(p))
+	return len(p), nil
+}
+
+// isStringInList returns true if key is found in list
+func isStringInList(key string, list []string) bool {
+	k := strings.ToLower(key)
+	ret := false
+	for i := 0; i < len(list); i++ {
+		if k == strings.ToLower(list[i]) {
+			return true
+		}
+	}
+	return ret
+}
+
+// getWhiteListedFields returns a new header composed of only
+// the entries in the given header which our found in the whitelist
+func getWhiteListedFields(header *mail.Header, whitelist []string) *mail.Header {
+	rHeader := make(mail.Header)
+	for k, v := range *header {
+		if isStringInList(k, whitelist) {
+			rHeader[k] = v
+		}
+	}
+	return &rHeader
+}
+
+// getMessageIdentities returns the sender and receiver identity strings
+// or an error
+func getMessageIdentities(message *mail.Message) (string, string, error) {
+	sender, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil {
+		return "", "", err
+	}
+	receiver, err := mail.ParseAddress(message.Header.Get("To"))
+	if err != nil {
+		return "", "", err
+	}
+	return sender.Address, receiver.Address, nil
+}
+
+// parseMessage returns a parsed message structure given a string
+func parseMessage(message string) (*mail.Message, error) {
+	messageBuffer := bytes.NewBuffer([]byte(message))
+	m, err := mail.ReadMessage(messageBuffer)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// stringFromHeader serializes the header structure into a string
+func stringFromHeader(header mail.Header) (string, error) {
+	messageBuffer := new(bytes.Buffer)
+	for key, _ := range header {
+		value := header.Get(key)
+		_, err := messageBuffer.WriteString(fmt.Sprintf("%s: ", key))
+		if err != nil {
+			return "", err
+		}
+		_, err = messageBuffer.WriteString(fmt.Sprintf("%s\n", value))
+		if err != nil {
+			return "", err
+		}
+	}
+	return messageBuffer.String(), nil
+}
+
+// stringFromHeaderBody serializes the given header and body
+func stringFromHeaderBody(header mail.Header, body io.Reader) (string, error) {
+	buf := new(bytes.Buffer)
+	headerStr, err := stringFromHeader(header)
+	if err != nil {
+		return "", err
+	}
+	_, err = buf.WriteString(headerStr)
+	if err != nil {
+		return "", err
+	}
+	_, err = buf.ReadFrom(body)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// SubmitProxy handles SMTP mail submissions. This means we act as an SMTP
+// daemon, accepting e-mail messages and proxying them to the mix network
+// via the Providers.
+type SubmitProxy struct {
+
+	// accounts is a mapping of emails to private keys
+	accounts *config.AccountsMap
+
+	// randomReader is an implementation of the io.Reader interface
+	// which is used to generate ephemeral keys for our wire protocol's
+	// cryptographic handshake messages
+	randomReader io.Reader
+
+	// userPKI implements the UserPKI interface
+	userPKI user_pki.UserPKI
+
+	// store is used to persist messages to disk
+	store *storage.Store
+
+	// session pool of connections to each provider
+	sessionPool *session_pool.SessionPool
+
+	// routeFactory is used to create mixnet routes
+	routeFactory *path_selection.RouteFactory
+
+	whitelist []string
+
+	// scheduler send message blocks and implements the Stop and Wait ARQ
+	scheduler *SendScheduler
+
+	// ordering adds per conversation sequence numbers to messages
+	ordering bool
+
+	// encryption seals messages to the recipient's key
+	encryption bool
+
+	// hybrid seals messages with the experimental post-quantum
+	// hybrid envelopes to the recipients advertising an ML-KEM key
+	hybrid bool
+
+	// maxMessageSize is the maximum size of a submitted message
+	maxMessageSize int
+
+	// compressOversize compresses messages exceeding maxMessageSize
+	compressOversize bool
+
+	// messages exceeding splitMaxBlocks Blocks are split into
+	// at most splitMaxParts mixnet messages, see SetSplitting
+	splitMaxBlocks int
+	splitMaxParts  int
+
+	// sourceLimiter and accountLimiter rate limit the submissions
+	// per source IP address and per sending account
+	sourceLimiter  *rate_limit.Limiter
+	accountLimiter *rate_limit.Limiter
+
+	// messages larger than spoolThreshold are spooled to an
+	// encrypted temporary file in spoolDir and fragmented from
+	// disk instead of being copied, see SetSpool
+	spoolDir       string
+	spoolThreshold int
+
+	// ledger optionally records the sent messages
+	ledger *send_ledger.Ledger
+
+	// surbs holds the SURBManagers of the sending accounts
+	// which attach SURBs to their outgoing messages
+	surbs map[string]*SURBManager
+
+	// deferred holds the messages with a SendAfterHeader
+	deferred *DeferredSender
+
+	// diskSpace refuses the submissions while a
+	// data volume is low on space
+	diskSpace DiskSpaceCheck
+
+	// aliases maps the lower case local recipient
+	// names to their addresses, see SetAliases
+	aliases map[string]string
+
+	// submitting holds the idempotency keys of the
+	// submissions in flight, see beginSubmission
+	submitting     map[string]bool
+	submittingLock sync.Mutex
+
+	// passwords and passwordHashes are the proxy passwords of
+	// the accounts the mail clients authenticate with, see
+	// SetPasswords and SetPasswordHashes
+	passwords      map[string]string
+	passwordHashes map[string]string
+}
+
+// pinnedUserPKI returns the given UserPKI wrapped so that the keys
+// pinned in the contact book of the given store take precedence
+func pinnedUserPKI(store *storage.Store, userPKI user_pki.UserPKI) *user_pki.PinnedUserPKI {
+	if store == nil {
+		// a nil store in the interface isn't a nil interface
+		return user_pki.NewPinnedUserPKI(nil, userPKI)
+	}
+	return user_pki.NewPinnedUserPKI(store, userPKI)
+}
+
+// NewSmtpProxy creates a new SubmitProxy struct
+func NewSmtpProxy(accounts *config.AccountsMap, randomReader io.Reader, userPki user_pki.UserPKI, store *storage.Store, pool *session_pool.SessionPool, routeFactory *path_selection.RouteFactory, scheduler *SendScheduler) *SubmitProxy {
+	submissionProxy := SubmitProxy{
+		accounts:       accounts,
+		randomReader:   randomReader,
+		userPKI:        pinnedUserPKI(store, userPki),
+		store:          store,
+		sessionPool:    pool,
+		routeFactory:   routeFactory,
+		scheduler:      scheduler,
+		maxMessageSize: constants.DefaultMaxMessageSize,
+		splitMaxBlocks: math.MaxUint16,
+		splitMaxParts:  constants.DefaultMaxSplitParts,
+		submitting:     make(map[string]bool),
+		whitelist: []string{ // XXX yawning fix me
+			"To",
+			"From",
+			"Subject",
+			"MIME-Version",
+			"Content-Type",
+		},
+	}
+	return &submissionProxy
+}
+
+// SetPasswords sets the passwords of the accounts keyed by their
+// lower case e-mail address, see config.Config.ProxyPasswords. A
+// mail client must authenticate as the sending account with it's
+// password, the accounts without one can't submit messages.
+func (p *SubmitProxy) SetPasswords(passwords map[string]string) {
+	p.passwords = passwords
+}
+
+// SetPasswordHashes sets the password hashes of the accounts keyed by
+// their lower case e-mail address, see config.Config.ProxyPasswordHashes.
+// They apply to the accounts without a password set by SetPasswords.
+func (p *SubmitProxy) SetPasswordHashes(hashes map[string]string) {
+	p.passwordHashes = hashes
+}
+
+// authenticatePlain returns the account authenticated by the given
+// SASL PLAIN response, RFC 4616, or an empty string if the response
+// is invalid or the password isn't the proxy password of the account.
+// The authorization identity, if any, must be the account.
+func (p *SubmitProxy) authenticatePlain(response []byte) string {
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 {
+		return ""
+	}
+	account := strings.ToLower(string(fields[1]))
+	if len(fields[0]) != 0 && strings.ToLower(string(fields[0])) != account {
+		return ""
+	}
+	if !checkProxyPassword(p.passwords, p.passwordHashes, account, fields[2]) {
+		return ""
+	}
+	return account
+}
+
+// EnableOrdering causes sequence numbers to be added to outgoing
+// messages so that the recipient can deliver them in order.
+// See storage.SequenceHeader.
+func (p *SubmitProxy) EnableOrdering() {
+	p.ordering = true
+}
+
+// EnableMessageEncryption causes outgoing messages to be end to
+// end encrypted to the recipient's key published in the user PKI.
+// See envelope.Seal.
+func (p *SubmitProxy) EnableMessageEncryption() {
+	p.encryption = true
+}
+
+// EnableHybridEncryption causes outgoing messages to be sealed with
+// the experimental post-quantum hybrid envelopes when the recipient
+// advertises an ML-KEM key in the user PKI, falling back to the
+// classical envelopes otherwise. See envelope.SealHybrid.
+func (p *SubmitProxy) EnableHybridEncryption() {
+	p.encryption = true
+	p.hybrid = true
+}
+
+// SetMaxMessageSize sets the maximum size of a submitted message.
+// Oversized messages are rejected unless compress is true, in which
+// case they are compressed and only rejected if still oversized.
+func (p *SubmitProxy) SetMaxMessageSize(maxSize int, compress bool) {
+	p.maxMessageSize = maxSize
+	p.compressOversize = compress
+}
+
+// SetSplitting causes the messages which would take more than maxBlocks
+// Blocks to be split into several mixnet messages which the recipient
+// joins, messages which would take more than maxParts mixnet messages
+// are rejected. The defaults apply to zero values, see config.Splitting.
+func (p *SubmitProxy) SetSplitting(maxBlocks, maxParts int) {
+	if maxBlocks == 0 {
+		maxBlocks = math.MaxUint16
+	}
+	if maxParts == 0 {
+		maxParts = constants.DefaultMaxSplitParts
+	}
+	p.splitMaxBlocks = maxBlocks
+	p.splitMaxParts = maxParts
+}
+
+// splitLength returns the size above which a message is split
+// into several mixnet messages, the size of the split parts
+func (p *SubmitProxy) splitLength() int {
+	return splitPartLength(p.splitMaxBlocks, p.encryption)
+}
+
+// SetRateLimiters sets the limiters of the concurrent connections
+// and messages per source IP address and of the messages per sending
+// account. Connections and messages exceeding the limits are
+// temporarily rejected so that the clients retry later.
+func (p *SubmitProxy) SetRateLimiters(sourceLimiter, accountLimiter *rate_limit.Limiter) {
+	p.sourceLimiter = sourceLimiter
+	p.accountLimiter = accountLimiter
+}
+
+// SetSpool causes submitted messages larger than threshold bytes
+// to be spooled to an encrypted temporary file in the given directory,
+// or the default temporary directory if empty, and fragmented and
+// enqueued from disk a block at a time instead of in memory. Messages
+// which are end to end encrypted or compressed are never spooled.
+// Note that the SMTP server buffers the DATA of a message in memory
+// before it's spooled, the spool only spares the copies of the message
+// and it's Blocks made by the in memory fragmentation.
+func (p *SubmitProxy) SetSpool(dir string, threshold int) {
+	p.spoolDir = dir
+	p.spoolThreshold = threshold
+}
+
+// SetLedger causes the submitted messages to be
+// recorded in the given send ledger
+func (p *SubmitProxy) SetLedger(ledger *send_ledger.Ledger) {
+	p.ledger = ledger
+}
+
+// DiskSpaceCheck reports whether a volume holding the
+// data of the client is low on space, e.g. a disk_space.Monitor
+type DiskSpaceCheck interface {
+	Low() bool
+}
+
+// SetDiskSpaceCheck causes the submissions to be refused with a
+// 452 reply while a volume holding the data is low on space
+func (p *SubmitProxy) SetDiskSpaceCheck(check DiskSpaceCheck) {
+	p.diskSpace = check
+}
+
+// SetSURBManagers sets the SURBManagers of the accounts, indexed by
+// identity, outgoing messages of these accounts carry SURBs their
+// recipients may reply with. See SURBManager.
+func (p *SubmitProxy) SetSURBManagers(surbs map[string]*SURBManager) {
+	p.surbs = surbs
+}
+
+// recordSent records the submission of a message in the send
+// ledger, failures are only logged since the message was
+// already enqueued
+func (p *SubmitProxy) recordSent(sender, receiver, subject string, size int, messageID [constants.MessageIDLength]byte) {
+	if p.ledger == nil {
+		return
+	}
+	err := p.ledger.Record(&send_ledger.Entry{
+		Time:      time.Now(),
+		Account:   sender,
+		Recipient: receiver,
+		MessageID: fmt.Sprintf("%x", messageID),
+		Subject:   subject,
+		Size:      size,
+	})
+	if err != nil {
+		log.Errorf("failed to record message to %s in the send ledger: %s", receiver, err)
+	}
+}
+
+// enqueueSpooled spools the message composed of the given header and
+// body to disk and enqueues it from there
+func (p *SubmitProxy) enqueueSpooled(smtpConn *smtpd.Conn, sender, receiver string, header mail.Header, body io.Reader, priorityHeader, idempotencyKey string) error {
+	sp, err := newSpool(p.spoolDir, p.randomReader)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := sp.Remove(); err != nil {
+			log.Errorf("failed to remove spool: %s", err)
+		}
+	}()
+	headerStr, err := stringFromHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(sp, headerStr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(sp, body)
+	if err != nil {
+		return err
+	}
+	err = sp.Rewind()
+	if err != nil {
+		return err
+	}
+	if sp.Len() > p.maxMessageSize {
+		log.Debugf("rejecting oversized message of %d bytes", sp.Len())
+		smtpConn.RejectMsg(messageTooLargeText(sp.Len(), p.maxMessageSize))
+		return nil
+	}
+	messageID, err := enqueueStream(p.randomReader, p.store, p.scheduler, sender, receiver, sp, sp.Len(), 0, messagePriority(priorityHeader, sp.Len()), newSubmission(idempotencyKey))
+	if err != nil {
+		return err
+	}
+	p.recordSent(sender, receiver, header.Get("Subject"), sp.Len(), messageID)
+	err = sp.Rewind()
+	if err != nil {
+		return err
+	}
+	message, err := ioutil.ReadAll(sp)
+	if err != nil {
+		return err
+	}
+	p.fileSent(sender, message)
+	return nil
+}
+
+// SetDeferredSender sets the DeferredSender holding the submitted
+// messages with a SendAfterHeader, the header is ignored otherwise
+func (p *SubmitProxy) SetDeferredSender(deferred *DeferredSender) {
+	p.deferred = deferred
+}
+
+// sendAfter returns the time a message with the given SendAfterHeader
+// value is to be sent at, zero if it's to be sent right away
+func (p *SubmitProxy) sendAfter(value string) (time.Time, error) {
+	if value == "" || p.deferred == nil {
+		return time.Time{}, nil
+	}
+	sendAfter, err := parseSendAfter(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !sendAfter.After(p.deferred.clock.Now()) {
+		return time.Time{}, nil
+	}
+	return sendAfter, nil
+}
+
+// fileSent files a copy of a sent message into the sender's Sent
+// folder, without the SURBs which were issued to the recipient
+func (p *SubmitProxy) fileSent(sender string, message []byte) {
+	_, err := p.store.PutFolderMessage(sender, storage.FolderSent, stripHeaders(message, []string{surbHeader}))
+	if err != nil {
+		log.Errorf("failed to file the message sent by %s: %s", sender, err)
+	}
+}
+
+// sealMessage encrypts the message to the receiver's key, the
+// envelope is sent with the frameSealed flag, the envelope's magic
+// tells the classical and hybrid suites apart, see envelope.Seal
+// and envelope.SealHybrid
+func (p *SubmitProxy) sealMessage(receiver string, message []byte) ([]byte, error) {
+	receiverKey, err := p.userPKI.GetKey(receiver)
+	if err != nil {
+		return nil, err
+	}
+	kemKey, err := p.receiverKEMKey(receiver)
+	if err != nil {
+		return nil, err
+	}
+	suite := envelope.SuiteClassical
+	if kemKey != nil {
+		suite = envelope.SuiteHybrid
+	}
+	previousSuite, err := p.store.Suite(receiver)
+	if err != nil {
+		return nil, err
+	}
+	if previousSuite != suite {
+		if previousSuite == envelope.SuiteHybrid {
+			log.Warningf("%s no longer advertises an ML-KEM key, falling back to %s", receiver, suite)
+		}
+		err = p.store.SetSuite(receiver, suite)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if kemKey != nil {
+		return envelope.SealHybrid(p.randomReader, receiverKey, kemKey, message)
+	}
+	return envelope.Seal(p.randomReader, receiverKey, message)
+}
+
+// receiverKEMKey returns the ML-KEM key advertised by the receiver
+// or nil if hybrid encryption is disabled or the user PKI doesn't
+// support it
+func (p *SubmitProxy) receiverKEMKey(receiver string) (*mlkem.EncapsulationKey768, error) {
+	if !p.hybrid {
+		return nil, nil
+	}
+	source, ok := p.userPKI.(user_pki.KEMKeySource)
+	if !ok {
+		return nil, nil
+	}
+	return source.GetKEMKey(receiver)
+}
+
+// SetAliases sets the local recipient aliases keyed by their
+// lower case name, see config.Config.Aliases. They take
+// precedence over the aliases of the contact book.
+func (p *SubmitProxy) SetAliases(aliases map[string]string) {
+	p.aliases = aliases
+}
+
+// resolveRecipient returns the e-mail address of the given SMTP
+// recipient argument which is either an e-mail address, a local
+// alias or the alias of a contact in the contact book. The address
+// may carry a plus tag, see config.SplitPlusAddress.
+func (p *SubmitProxy) resolveRecipient(arg string) (string, error) {
+	alias := strings.Trim(strings.TrimSpace(arg), "<>")
+	if address, ok := p.aliases[strings.ToLower(alias)]; ok {
+		return address, nil
+	}
+	if alias != "" && !strings.Contains(alias, "@") {
+		contact, err := p.store.GetContact(alias)
+		if err != nil {
+			return "", err
+		}
+		return strings.ToLower(contact.Address), nil
+	}
+	receiverAddr, err := mail.ParseAddress(arg)
+	if err != nil {
+		return "", err
+	}
+	return receiverAddr.Address, nil
+}
+
+// rewriteRecipient returns the given To header with the entry naming
+// the given SMTP recipient argument, e.g. an alias, replaced by the
+// address it resolved to. The other recipients are kept, so that a
+// message to several recipients is rewritten for each of them. The
+// header is returned unchanged if it doesn't name the recipient.
+func rewriteRecipient(to, arg, address string) string {
+	arg = strings.Trim(strings.TrimSpace(arg), "<>")
+	if strings.EqualFold(arg, address) {
+		return to
+	}
+	rewritten := false
+	entries := []string{}
+	if list, err := mail.ParseAddressList(to); err == nil {
+		for _, a := range list {
+			if strings.EqualFold(a.Address, arg) {
+				a.Address = address
+				rewritten = true
+			}
+			entries = append(entries, a.String())
+		}
+	} else {
+		// a bare alias isn't an address, the entries are split on commas
+		for _, entry := range strings.Split(to, ",") {
+			entry = strings.TrimSpace(entry)
+			name := entry
+			if a, err := mail.ParseAddress(entry); err == nil {
+				name = a.Address
+			}
+			if strings.EqualFold(strings.Trim(name, "<>"), arg) {
+				entry = address
+				rewritten = true
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if !rewritten {
+		return to
+	}
+	return strings.Join(entries, ", ")
+}
+
+// splitRecipient returns the address of the given recipient and
+// it's plus tag, see config.SplitPlusAddress. The longest local
+// part known to the user PKI is kept, so that the address of an
+// identity such as c++dev@acme isn't split. An error is returned
+// if no address is known.
+func (p *SubmitProxy) splitRecipient(address string) (string, string, error) {
+	_, err := p.userPKI.GetKey(address)
+	if err == nil {
+		return address, "", nil
+	}
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return address, "", err
+	}
+	for plus := strings.LastIndex(address[:at], "+"); plus > 0; plus = strings.LastIndex(address[:plus], "+") {
+		receiver := address[:plus] + address[at:]
+		_, keyErr := p.userPKI.GetKey(receiver)
+		if keyErr == nil {
+			return receiver, address[plus+1 : at], nil
+		}
+	}
+	return address, "", err
+}
+
+// TagHeader is the header of an outgoing message holding the tag of
+// the plus address it was submitted to, e.g. lists for bob+lists@acme.
+// The message is sent to the canonical address, the tag only travels
+// in the end to end payload so that the recipient may filter by it.
+const TagHeader = "X-Mix-Tag"
+
+// PriorityHeader is the header of a submitted message which selects
+// it's priority class, either "interactive" or "bulk". Messages
+// without it which fit into a single Block are interactive.
+const PriorityHeader = "X-Mix-Priority"
+
+// messagePriority returns the priority class of a message given
+// the value of it's PriorityHeader and it's length
+func messagePriority(header string, messageLength int) storage.Priority {
+	switch strings.ToLower(strings.TrimSpace(header)) {
+	case "interactive":
+		return storage.PriorityInteractive
+	case "bulk":
+		return storage.PriorityBulk
+	}
+	if messageLength <= block.BlockLength {
+		return storage.PriorityInteractive
+	}
+	return storage.PriorityBulk
+}
+
+// enqueueMessage enqueues the message in our persistent message store
+// so that it can soon be sent on it's way to the recipient.
+func (p *SubmitProxy) enqueueMessage(sender, receiver string, message []byte, flags uint8, priority storage.Priority, submission *storage.Submission) ([constants.MessageIDLength]byte, error) {
+	return enqueueMessage(p.randomReader, p.store, p.scheduler, sender, receiver, message, flags, priority, submission)
+}
+
+// enqueueMessage fragments the message framed with the given
+// flags into blocks, persists them in the egress bucket and schedules them to be
+// sent, it returns the message ID
+func enqueueMessage(randomReader io.Reader, store *storage.Store, scheduler *SendScheduler, sender, receiver string, message []byte, flags uint8, priority storage.Priority, submission *storage.Submission) ([constants.MessageIDLength]byte, error) {
+	return enqueueStream(randomReader, store, scheduler, sender, receiver, bytes.NewReader(message), len(message), flags, priority, submission)
+}
+
+// enqueueStream reads a message of the given length from r, and
+// fragments, persists and sends it's blocks one at a time, preceded
+// by the framing header with the given flags, see frameHeader. It
+// returns the message ID. The given submission, if any, is recorded
+// with the last Block, under the message ID unless it's set, see
+// storage.Store.PutSubmittedEgressBlock.
+func enqueueStream(randomReader io.Reader, store *storage.Store, scheduler *SendScheduler, sender, receiver string, r io.Reader, length int, flags uint8, priority storage.Priority, submission *storage.Submission) ([constants.MessageIDLength]byte, error) {
+	messageID := [constants.MessageIDLength]byte{}
+	_, senderProvider, err := config.SplitEmail(sender)
+	if err != nil {
+		return messageID, err
+	}
+	recipientUser, recipientProvider, err := config.SplitEmail(receiver)
+	if err != nil {
+		return messageID, err
+	}
+	recipientID := [constants.RecipientIDLength]byte{}
+	copy(recipientID[:], recipientUser)
+	var first *block.Block
+	r = io.MultiReader(bytes.NewReader(frameHeader(flags)), r)
+	err = fragmentStream(randomReader, r, frameHeaderLength+length, func(b *block.Block) error {
+		if first == nil {
+			first = b
+		}
+		storageBlock := storage.EgressBlock{
+			Sender:            sender,
+			SenderProvider:    senderProvider,
+			Recipient:         receiver,
+			RecipientID:       recipientID,
+			RecipientProvider: recipientProvider,
+			SendAttempts:      uint8(0),
+			Priority:          priority,
+			Block:             *b,
+		}
+		var blockID *[storage.BlockIDLength]byte
+		var err error
+		if submission != nil && b.BlockID == b.TotalBlocks-1 {
+			if submission.MessageID == ([constants.MessageIDLength]byte{}) {
+				submission.MessageID = b.MessageID
+			}
+			blockID, err = store.PutSubmittedEgressBlock(&storageBlock, submission)
+		} else {
+			blockID, err = store.PutEgressBlock(&storageBlock)
+		}
+		if err != nil {
+			return err
+		}
+		scheduler.Send(sender, blockID, &storageBlock)
+		return nil
+	})
+	if err != nil {
+		if first != nil {
+			// don't leave an incomplete message in the queue
+			scheduler.CancelMessage(first.MessageID)
+		}
+		return messageID, err
+	}
+	recordEvent(store, storage.EventMessageQueued, sender, &first.MessageID, fmt.Sprintf("to %s in %d blocks", receiver, first.TotalBlocks))
+	return first.MessageID, nil
+}
+
+// insufficientStorage replies 452, which smtpd has no method for,
+// to the current command and closes the connection
+func insufficientStorage(conn net.Conn) error {
+	fmt.Fprintf(conn, "452 4.3.1 insufficient system storage, try again later\r\n")
+	return conn.Close()
+}
+
+// handleSMTPSubmission handles the SMTP submissions
+func (p *SubmitProxy) HandleSMTPSubmission(conn net.Conn) error {
+	source := rate_limit.SourceKey(conn)
+	if p.sourceLimiter != nil {
+		if !p.sourceLimiter.Acquire(source) {
+			log.Debugf("too many SMTP connections from %s", source)
+			fmt.Fprintf(conn, "421 4.7.0 too many connections, try again later\r\n")
+			return conn.Close()
+		}
+		defer p.sourceLimiter.Release(source)
+	}
+	cfg := smtpd.Config{ // XXX
+		Auth: &smtpd.AuthConfig{Mechanisms: []string{"PLAIN"}},
+	}
+	logWriter := newLogWriter(log)
+	smtpConn := smtpd.NewConn(conn, cfg, logWriter)
+	// authenticated is the account the mail client
+	// authenticated as, the only one it may send as
+	authenticated := ""
+	sender := ""
+	receiver := ""
+	recipient := ""
+	addressed := ""
+	tag := ""
+	for {
+		event := smtpConn.Next()
+		if event.What == smtpd.DONE || event.What == smtpd.ABORT {
+			return nil
+		}
+		if event.What == smtpd.COMMAND && event.Cmd == smtpd.AUTH {
+			account := ""
+			ok := smtpConn.Authenticate(func(c *smtpd.Conn, response []byte) ([]byte, bool) {
+				account = p.authenticatePlain(response)
+				return nil, account != ""
+			})
+			if !ok || account == "" {
+				log.Debugf("SMTP authentication failed from %s", source)
+				continue
+			}
+			authenticated = account
+		}
+		if event.What == smtpd.COMMAND && event.Cmd == smtpd.MAILFROM {
+			senderAddr, err := mail.ParseAddress(event.Arg)
+			if err != nil {
+				log.Debug("sender address parse fail")
+				smtpConn.Reject()
+				return err
+			}
+			sender = senderAddr.Address
+			if strings.ToLower(sender) != authenticated {
+				log.Debugf("submission as %s not authenticated", sender)
+				smtpConn.RejectMsg("Authenticate as %s to send as it", sender)
+				return nil
+			}
+			if _, err = p.accounts.GetIdentityKey(sender); err != nil {
+				log.Debug("client identity not found")
+				smtpConn.Reject()
+				return nil
+			}
+			deactivated, err := p.store.IsDeactivated(sender)
+			if err != nil {
+				smtpConn.Reject()
+				return err
+			}
+			if deactivated {
+				log.Debugf("account %s is deactivated", sender)
+				smtpConn.Reject()
+				return nil
+			}
+			if (p.sourceLimiter != nil && !p.sourceLimiter.Allow(source)) ||
+				(p.accountLimiter != nil && !p.accountLimiter.Allow(sender)) {
+				log.Debugf("submission rate limit exceeded by %s from %s", sender, source)
+				smtpConn.TempfailMsg("rate limit exceeded, try again later")
+				return nil
+			}
+			if p.diskSpace != nil && p.diskSpace.Low() {
+				log.Debugf("disk space low, deferring submission by %s", sender)
+				return insufficientStorage(conn)
+			}
+			if p.scheduler.Congested() {
+				log.Debugf("send queue congested, deferring submission by %s", sender)
+				smtpConn.TempfailMsg("send queue full, try again later")
+				return nil
+			}
+		}
+		if event.What == smtpd.COMMAND && event.Cmd == smtpd.RCPTTO {
+			address, err := p.resolveRecipient(strings.ToLower(event.Arg))
+			if err != nil {
+				log.Debug("recipient address parse fail")
+				smtpConn.Reject()
+				return err
+			}
+			recipient = event.Arg
+			addressed = address
+			receiver, tag, err = p.splitRecipient(address)
+			if err != nil {
+				log.Debugf("user PKI: email %s not found", receiver)
+				smtpConn.Reject()
+				return nil
+			}
+		}
+		if event.What == smtpd.GOTDATA {
+			message, err := parseMessage(event.Arg)
+			if err != nil {
+				return err
+			}
+			id := message.Header.Get("X-Panoramix-Sender-Identity-Key")
+			if len(id) != 0 {
+				log.Debug("Bad message received. Found X-Panoramix-Sender-Identity-Key in header.")
+				smtpConn.Reject()
+				return nil
+			}
+			idempotencyKey := strings.TrimSpace(message.Header.Get(IdempotencyKeyHeader))
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				log.Debugf("rejecting message with an oversized %s header", IdempotencyKeyHeader)
+				smtpConn.RejectMsg("Invalid %s header", IdempotencyKeyHeader)
+				return nil
+			}
+			if idempotencyKey != "" {
+				previous, err := p.beginSubmission(sender, idempotencyKey)
+				if err == ErrSubmissionInProgress {
+					log.Debugf("submission by %s already in progress", sender)
+					smtpConn.TempfailMsg("submission in progress, try again later")
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if previous != nil {
+					log.Noticef("ignoring duplicate submission of message %x by %s", *previous, sender)
+					return nil
+				}
+				defer p.endSubmission(sender, idempotencyKey)
+			}
+			priorityHeader := message.Header.Get(PriorityHeader)
+			sendAfter, err := p.sendAfter(message.Header.Get(SendAfterHeader))
+			if err != nil {
+				log.Debugf("rejecting message with invalid %s header: %s", SendAfterHeader, err)
+				smtpConn.RejectMsg("Invalid %s header", SendAfterHeader)
+				return nil
+			}
+			deferred := !sendAfter.IsZero()
+			if p.diskSpace != nil && p.diskSpace.Low() {
+				// the volume may have filled up since MAIL FROM
+				log.Debugf("disk space low, refusing message of %s", sender)
+				return insufficientStorage(conn)
+			}
+			if !deferred && p.scheduler.Congested() {
+				// the queue may have filled up since MAIL FROM
+				log.Debugf("send queue congested, refusing message of %s", sender)
+				smtpConn.TempfailMsg("send queue full, try again later")
+				return nil
+			}
+			header := getWhiteListedFields(&message.Header, p.whitelist)
+			if from, err := mail.ParseAddress(header.Get("From")); err != nil || !strings.EqualFold(from.Address, sender) {
+				// the From header can't name another account
+				(*header)["From"] = []string{sender}
+			}
+			if to := header.Get("To"); to != "" {
+				// the message may be addressed to an alias
+				(*header)["To"] = []string{rewriteRecipient(to, recipient, addressed)}
+			}
+			if tag != "" {
+				(*header)[TagHeader] = []string{tag}
+			}
+			// deferred messages are sent without sequence number nor
+			// SURBs, they would be out of order and expired by then
+			if p.ordering && !deferred {
+				seq, err := p.store.NextOutgoingSequence(sender, receiver)
+				if err != nil {
+					return err
+				}
+				(*header)[storage.SequenceHeader] = []string{strconv.FormatUint(seq, 10)}
+			}
+			if surbs, ok := p.surbs[sender]; ok && !deferred {
+				if value := surbs.attach(receiver); value != "" {
+					(*header)[surbHeader] = []string{value}
+				}
+			}
+			if p.spoolThreshold != 0 && len(event.Arg) > p.spoolThreshold && !p.encryption && !deferred &&
+				!(p.compressOversize && len(event.Arg) > p.maxMessageSize) && len(event.Arg) <= p.splitLength() {
+				return p.enqueueSpooled(smtpConn, sender, receiver, *header, message.Body, priorityHeader, idempotencyKey)
+			}
+			messageString, err := stringFromHeaderBody(*header, message.Body)
+			if err != nil {
+				return err
+			}
+			messageBytes := []byte(messageString)
+			flags := uint8(0)
+			if len(messageBytes) > p.maxMessageSize && p.compressOversize {
+				messageBytes, err = compressMessage(messageBytes)
+				if err != nil {
+					return err
+				}
+				flags |= frameCompressed
+			}
+			if len(messageBytes) > p.maxMessageSize {
+				log.Debugf("rejecting oversized message of %d bytes", len(messageString))
+				smtpConn.RejectMsg(messageTooLargeText(len(messageString), p.maxMessageSize))
+				return nil
+			}
+			parts := [][]byte{messageBytes}
+			if len(messageBytes) > p.splitLength() {
+				parts, err = splitMessage(p.randomReader, messageBytes, p.splitLength(), p.splitMaxParts)
+				if err == errTooManyParts {
+					log.Debugf("rejecting message of %d bytes exceeding %d split parts", len(messageBytes), p.splitMaxParts)
+					smtpConn.RejectMsg("Message exceeds the maximum of %d split parts", p.splitMaxParts)
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				log.Debugf("splitting message of %d bytes into %d mixnet messages", len(messageBytes), len(parts))
+				flags |= frameSplitPart
+			}
+			if p.encryption {
+				for i := range parts {
+					parts[i], err = p.sealMessage(receiver, parts[i])
+					if err != nil {
+						return err
+					}
+				}
+				flags |= frameSealed
+			}
+			if deferred {
+				for i, part := range parts {
+					// the message is filed once, with it's first part
+					var sentCopy []byte
+					if i == 0 {
+						sentCopy = []byte(messageString)
+					}
+					// the submission is recorded with the last part, the
+					// message ID is only known once the message is sent
+					var submission *storage.Submission
+					if i == len(parts)-1 {
+						submission = newSubmission(idempotencyKey)
+					}
+					_, err = p.deferred.Defer(sender, receiver, part, sentCopy, flags, sendAfter, messagePriority(priorityHeader, len(part)), submission)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			var messageID [constants.MessageIDLength]byte
+			for i, part := range parts {
+				// the submission is recorded with the
+				// last part under the ID of the first
+				var submission *storage.Submission
+				if i == len(parts)-1 {
+					submission = newSubmission(idempotencyKey)
+					if submission != nil {
+						submission.MessageID = messageID
+					}
+				}
+				partID, err := p.enqueueMessage(sender, receiver, part, flags, messagePriority(priorityHeader, len(part)), submission)
+				if err != nil {
+					return err
+				}
+				if i == 0 {
+					messageID = partID
+				}
+			}
+			p.recordSent(sender, receiver, header.Get("Subject"), len(messageString), messageID)
+			p.fileSent(sender, []byte(messageString))
+			return nil
+		}
+	}
+	return nil
+}
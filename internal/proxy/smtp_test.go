@@ -0,0 +1,47 @@
+// smtp_test.go - SMTP submission proxy tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/katzenpost/client/internal/auth"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticatePlain(t *testing.T) {
+	require := require.New(t)
+
+	p := NewSmtpProxy(nil, rand.Reader, nil, nil, nil, nil, nil)
+	p.SetPasswords(map[string]string{"alice@acme.com": testPass})
+	hash, err := auth.HashPassword(testPass)
+	require.NoError(err, "HashPassword failed")
+	p.SetPasswordHashes(map[string]string{"bob@acme.com": hash})
+
+	require.Equal("alice@acme.com", p.authenticatePlain([]byte("\x00Alice@acme.com\x00"+testPass)))
+	require.Equal("alice@acme.com", p.authenticatePlain([]byte("alice@acme.com\x00alice@acme.com\x00"+testPass)))
+	require.Equal("bob@acme.com", p.authenticatePlain([]byte("\x00bob@acme.com\x00"+testPass)))
+	require.Empty(p.authenticatePlain([]byte("\x00alice@acme.com\x00guess")))
+	require.Empty(p.authenticatePlain([]byte("\x00alice@acme.com")))
+
+	// the authorization identity can't be another account
+	require.Empty(p.authenticatePlain([]byte("bob@acme.com\x00alice@acme.com\x00" + testPass)))
+
+	// accounts without a password can't authenticate
+	require.Empty(p.authenticatePlain([]byte("\x00carol@acme.com\x00")))
+}
@@ -0,0 +1,144 @@
+// split.go - splitting of messages exceeding the Blocks per message ID
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/crypto/envelope"
+	"github.com/katzenpost/client/storage"
+)
+
+const (
+	// splitMessageMagic starts the parts of a message which was split
+	// into several mixnet messages, followed by the split message ID,
+	// the part's index, the number of parts and the length of the
+	// part's payload. The parts are identified by the frameSplitPart
+	// flag of their framing header, the magic only checks them.
+	splitMessageMagic = "KPS1"
+
+	// splitHeaderLength is the length of the header of a part
+	splitHeaderLength = len(splitMessageMagic) + constants.MessageIDLength + 2 + 2 + 4
+)
+
+// errTooManyParts is the error returned when a message would
+// be split into more parts than allowed
+var errTooManyParts = errors.New("message exceeds the maximum number of split parts")
+
+// splitPartLength returns the maximum payload length of a part
+// sent in the given number of Blocks, sealed if seal is true
+func splitPartLength(maxBlocks int, seal bool) int {
+	length := maxBlocks*block.BlockLength - frameHeaderLength - splitHeaderLength
+	if seal {
+		length -= envelope.HybridOverhead
+	}
+	return length
+}
+
+// splitMessage splits the given message into parts whose
+// payloads are at most partLength bytes long, it fails if
+// that takes more than maxParts parts
+func splitMessage(randomReader io.Reader, message []byte, partLength, maxParts int) ([][]byte, error) {
+	if partLength <= 0 {
+		return nil, errors.New("invalid split part length")
+	}
+	total := (len(message) + partLength - 1) / partLength
+	if total > maxParts || total > int(^uint16(0)) {
+		return nil, errTooManyParts
+	}
+	id := [constants.MessageIDLength]byte{}
+	_, err := io.ReadFull(randomReader, id[:])
+	if err != nil {
+		return nil, err
+	}
+	parts := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		payload := message[i*partLength:]
+		if len(payload) > partLength {
+			payload = payload[:partLength]
+		}
+		part := make([]byte, splitHeaderLength, splitHeaderLength+len(payload))
+		off := copy(part, splitMessageMagic)
+		off += copy(part[off:], id[:])
+		binary.BigEndian.PutUint16(part[off:], uint16(i))
+		binary.BigEndian.PutUint16(part[off+2:], uint16(total))
+		binary.BigEndian.PutUint32(part[off+4:], uint32(len(payload)))
+		parts = append(parts, append(part, payload...))
+	}
+	return parts, nil
+}
+
+// parseSplitPart returns the part of a split message the given
+// reassembled mixnet message, framed with the frameSplitPart flag,
+// is, trailing Block padding is ignored. The ID of the part is bound
+// to the given static key of the sender, so that only the parts of
+// the same sender are joined.
+func parseSplitPart(message []byte, s [32]byte) (*storage.SplitPart, error) {
+	if len(message) < splitHeaderLength {
+		return nil, errors.New("truncated split message part")
+	}
+	if string(message[:len(splitMessageMagic)]) != splitMessageMagic {
+		return nil, errors.New("invalid split message part")
+	}
+	part := storage.SplitPart{}
+	off := copy(part.ID[:], message[len(splitMessageMagic):])
+	off += len(splitMessageMagic)
+	part.Index = binary.BigEndian.Uint16(message[off:])
+	part.Total = binary.BigEndian.Uint16(message[off+2:])
+	length := int(binary.BigEndian.Uint32(message[off+4:]))
+	if part.Index >= part.Total || length > len(message)-splitHeaderLength {
+		return nil, errors.New("invalid split message part")
+	}
+	part.Payload = message[splitHeaderLength : splitHeaderLength+length]
+	part.ID = senderSplitID(s, part.ID)
+	part.S = s
+	return &part, nil
+}
+
+// senderSplitID returns the ID of the parts of the split message
+// with the given ID sent with the given static key
+func senderSplitID(s [32]byte, id [constants.MessageIDLength]byte) [constants.MessageIDLength]byte {
+	h := sha256.New()
+	h.Write(s[:])
+	h.Write(id[:])
+	senderID := [constants.MessageIDLength]byte{}
+	copy(senderID[:], h.Sum(nil))
+	return senderID
+}
+
+// joinSplitParts returns the message the given parts, ordered by
+// index, were split from, the sender's static key if all the parts
+// were sent with the same key, as their IDs ensure, or a zero key
+// otherwise, and the total number of Blocks of the parts
+func joinSplitParts(parts []*storage.SplitPart) ([]byte, [32]byte, int) {
+	message := []byte{}
+	s := parts[0].S
+	blocks := 0
+	for _, part := range parts {
+		message = append(message, part.Payload...)
+		if part.S != s {
+			s = [32]byte{}
+		}
+		blocks += part.Blocks
+	}
+	return message, s, blocks
+}
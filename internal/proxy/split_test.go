@@ -0,0 +1,130 @@
+// split_test.go - message splitting tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitMessage(t *testing.T) {
+	require := require.New(t)
+
+	message := bytes.Repeat([]byte("0123456789"), 25)
+	parts, err := splitMessage(rand.Reader, message, 100, 3)
+	require.NoError(err, "splitMessage failed")
+	require.Len(parts, 3)
+	parsed := []*storage.SplitPart{}
+	for i, p := range parts {
+		// trailing Block padding is ignored
+		part, err := parseSplitPart(append(p, make([]byte, 42)...), [32]byte{})
+		require.NoError(err, "parseSplitPart failed")
+		require.Equal(uint16(i), part.Index)
+		require.Equal(uint16(3), part.Total)
+		if i > 0 {
+			require.Equal(parsed[0].ID, part.ID)
+		}
+		part.Blocks = 1
+		parsed = append(parsed, part)
+	}
+	joined, s, blocks := joinSplitParts(parsed)
+	require.Equal(message, joined)
+	require.Equal([32]byte{}, s)
+	require.Equal(3, blocks)
+
+	_, err = splitMessage(rand.Reader, message, 100, 2)
+	require.Equal(errTooManyParts, err)
+
+	_, err = parseSplitPart(message, [32]byte{})
+	require.Error(err, "a message which isn't a part was parsed")
+	_, err = parseSplitPart(parts[0][:splitHeaderLength-1], [32]byte{})
+	require.Error(err, "truncated part not detected")
+	_, err = parseSplitPart(parts[0][:splitHeaderLength+1], [32]byte{})
+	require.Error(err, "truncated payload not detected")
+
+	// the parts of another sender get another ID
+	part, err := parseSplitPart(parts[0], [32]byte{1})
+	require.NoError(err, "parseSplitPart failed")
+	require.NotEqual(parsed[0].ID, part.ID)
+	require.Equal([32]byte{1}, part.S)
+}
+
+func TestJoinSplitMessage(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "split_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	account := "bob@nsa.gov"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	fetcher := NewFetcher(account, nil, store, nil, nil)
+
+	message := append([]byte("From: alice@acme.com\nSubject: hi\n\n"), bytes.Repeat([]byte{'a'}, 1000)...)
+	parts, err := splitMessage(rand.Reader, message, 400, 3)
+	require.NoError(err, "splitMessage failed")
+	require.Len(parts, 3)
+	receive := func(i int, s [32]byte) {
+		b := &block.Block{
+			MessageID:   [16]byte{byte(i), s[0]},
+			TotalBlocks: 1,
+			Block:       append(frameHeader(frameSplitPart), parts[i]...),
+		}
+		err := store.PutIngressBlock(account, &storage.IngressBlock{S: s, Block: b})
+		require.NoError(err, "unexpected PutIngressBlock() error")
+		err = fetcher.assemble(b.MessageID, b.TotalBlocks)
+		require.NoError(err, "unexpected assemble() error")
+		blocks, _, err := store.GetIngressBlocks(account, b.MessageID)
+		require.NoError(err, "unexpected GetIngressBlocks() error")
+		require.Empty(blocks, "the Blocks of the part were kept")
+	}
+
+	// the parts may arrive in any order
+	alice := [32]byte{1}
+	receive(2, alice)
+	receive(0, alice)
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Empty(messages)
+	require.NoError(fetcher.joinSplitMessages())
+
+	// the part of another sender isn't joined
+	receive(1, [32]byte{2})
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Empty(messages)
+
+	receive(1, alice)
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Len(messages, 1)
+	require.True(bytes.HasSuffix(messages[0], message), "the joined message differs")
+	require.Contains(string(messages[0]), storage.BlockCountHeader+": 3\n")
+	complete, err := store.CompleteSplitMessages(account)
+	require.NoError(err, "unexpected CompleteSplitMessages() error")
+	require.Empty(complete)
+}
@@ -0,0 +1,167 @@
+// spool.go - encrypted on disk message spool
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/katzenpost/client/crypto/block"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// SpoolFilePrefix is the prefix of the names of the spool
+// files, see config.Spool
+const SpoolFilePrefix = "mixclient-spool"
+
+// spoolChunkLength is the length of the plaintext chunks of
+// the spool, each chunk is the payload of exactly one Block
+const spoolChunkLength = block.BlockLength
+
+// spool is a temporary file which holds a single message while it's
+// fragmented. The message is encrypted in chunks with an ephemeral key
+// which never leaves our memory, so that the plaintext of a message
+// doesn't outlive the spool even if the file isn't removed.
+type spool struct {
+	file    *os.File
+	key     [32]byte
+	buf     []byte
+	written uint64
+	read    uint64
+	length  int
+}
+
+// newSpool creates a new empty spool in the given
+// directory, or in the default temporary directory
+func newSpool(dir string, randomReader io.Reader) (*spool, error) {
+	s := spool{
+		buf: make([]byte, 0, spoolChunkLength),
+	}
+	_, err := io.ReadFull(randomReader, s.key[:])
+	if err != nil {
+		return nil, err
+	}
+	s.file, err = ioutil.TempFile(dir, SpoolFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// spoolNonce returns the nonce of the given chunk
+func spoolNonce(chunk uint64) *[24]byte {
+	nonce := [24]byte{}
+	binary.BigEndian.PutUint64(nonce[:], chunk)
+	return &nonce
+}
+
+// Write appends the given data to the spooled message
+func (s *spool) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := spoolChunkLength - len(s.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		s.buf = append(s.buf, p[:free]...)
+		p = p[free:]
+		if len(s.buf) == spoolChunkLength {
+			err := s.writeChunk()
+			if err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeChunk encrypts the buffered chunk to the file
+func (s *spool) writeChunk() error {
+	sealed := secretbox.Seal(nil, s.buf, spoolNonce(s.written), &s.key)
+	_, err := s.file.Write(sealed)
+	if err != nil {
+		return err
+	}
+	s.written++
+	s.length += len(s.buf)
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Rewind writes the last partial chunk and prepares the spooled
+// message to be read from the beginning, it must be called once
+// the whole message has been written
+func (s *spool) Rewind() error {
+	if len(s.buf) > 0 {
+		err := s.writeChunk()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// Len returns the length of the spooled message once rewound
+func (s *spool) Len() int {
+	return s.length
+}
+
+// Read reads the spooled message, decrypting a chunk at a time
+func (s *spool) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		sealed := make([]byte, spoolChunkLength+secretbox.Overhead)
+		n, err := io.ReadFull(s.file, sealed)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if n <= secretbox.Overhead {
+			return 0, errors.New("spool: truncated chunk")
+		}
+		chunk, ok := secretbox.Open(s.buf[:0], sealed[:n], spoolNonce(s.read), &s.key)
+		if !ok {
+			return 0, errors.New("spool: authentication failed")
+		}
+		s.read++
+		s.buf = chunk
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Remove closes and removes the spool file and forgets the key
+func (s *spool) Remove() error {
+	for i := range s.key {
+		s.key[i] = 0
+	}
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(s.file.Name())
+}
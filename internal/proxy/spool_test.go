@@ -0,0 +1,76 @@
+// spool_test.go - encrypted on disk message spool tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolFragmentation(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "spool_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+
+	message := make([]byte, 3*block.BlockLength+123)
+	_, err = rand.Reader.Read(message)
+	require.NoError(err, "unexpected Read error")
+
+	sp, err := newSpool(dir, rand.Reader)
+	require.NoError(err, "newSpool failed")
+	for i := 0; i < len(message); i += 1000 {
+		end := i + 1000
+		if end > len(message) {
+			end = len(message)
+		}
+		_, err = sp.Write(message[i:end])
+		require.NoError(err, "Write failed")
+	}
+	err = sp.Rewind()
+	require.NoError(err, "Rewind failed")
+	require.Equal(len(message), sp.Len())
+
+	raw, err := ioutil.ReadFile(sp.file.Name())
+	require.NoError(err, "unexpected ReadFile error")
+	require.False(bytes.Contains(raw, message[:64]), "spool is not encrypted")
+
+	blocks := []*storage.IngressBlock{}
+	err = fragmentStream(rand.Reader, sp, sp.Len(), func(b *block.Block) error {
+		blocks = append(blocks, &storage.IngressBlock{Block: b})
+		return nil
+	})
+	require.NoError(err, "fragmentStream failed")
+	require.Equal(4, len(blocks))
+	reassembled, err := reassembleMessage(blocks)
+	require.NoError(err, "reassembleMessage failed")
+	require.Equal(message, reassembled[:len(message)])
+
+	err = sp.Remove()
+	require.NoError(err, "Remove failed")
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(0, len(files))
+}
@@ -0,0 +1,376 @@
+// surb_pool.go - pool of pre-generated SURBs
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/sphinx"
+)
+
+// surbHeader is the message header carrying the SURBs issued to
+// the recipient, separated by commas. Each is given by the epoch
+// during which it may be used, the delay of it's path in
+// milliseconds and the base64 encoded SURB.
+const surbHeader = "X-Mix-Surb"
+
+// SURBManager keeps a pool of pre-generated SURBs per correspondent
+// of an account, persisted in the Store. The SURBs of a correspondent
+// carry the ACKs of the Blocks sent to it and, attached to our
+// messages, it's replies: they're built ahead of time for the
+// epochs of the prefetched PKI documents so that replies remain
+// possible during PKI outages. The pools are replenished at each
+// epoch boundary and whenever SURBs are attached to a message.
+type SURBManager struct {
+	sync.Mutex
+
+	identity       string
+	provider       string
+	store          *storage.Store
+	routeFactory   *path_selection.RouteFactory
+	randReader     io.Reader
+	poolSize       int
+	correspondents map[string]bool
+	clock          clock.Clock
+	timer          clock.Timer
+	stopped        bool
+}
+
+// NewSURBManager creates a new SURBManager for the given account,
+// initially only the account's own pool is maintained
+func NewSURBManager(identity string, store *storage.Store, routeFactory *path_selection.RouteFactory) (*SURBManager, error) {
+	_, provider, err := config.SplitEmail(identity)
+	if err != nil {
+		return nil, err
+	}
+	m := SURBManager{
+		identity:     identity,
+		provider:     provider,
+		store:        store,
+		routeFactory: routeFactory,
+		randReader:   entropy.Reader,
+		poolSize:     constants.SURBPoolSize,
+		correspondents: map[string]bool{
+			identity: true,
+		},
+		clock: clock.Real,
+	}
+	return &m, nil
+}
+
+// SetRandomReader sets the entropy source used to
+// create the SURBs, this defaults to crypto/rand
+func (m *SURBManager) SetRandomReader(randReader io.Reader) {
+	m.Lock()
+	defer m.Unlock()
+	m.randReader = randReader
+}
+
+// SetClock sets the Clock telling the epochs, e.g. a clock.Fake
+// in tests. It must be set before Start and any SURB is used.
+func (m *SURBManager) SetClock(c clock.Clock) {
+	m.Lock()
+	defer m.Unlock()
+	m.clock = c
+}
+
+// SetPoolSize sets the number of unissued SURBs
+// kept per correspondent and epoch
+func (m *SURBManager) SetPoolSize(size int) {
+	m.Lock()
+	defer m.Unlock()
+	m.poolSize = size
+}
+
+// Track adds the given correspondent to the replenished pools
+func (m *SURBManager) Track(correspondent string) error {
+	_, _, err := config.SplitEmail(correspondent)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.correspondents[strings.ToLower(correspondent)] = true
+	return nil
+}
+
+// Start replenishes the pools and schedules
+// their replenishment at each epoch boundary
+func (m *SURBManager) Start() {
+	m.Lock()
+	m.stopped = false
+	m.Unlock()
+	m.run()
+}
+
+// Stop stops the replenishment of the pools
+func (m *SURBManager) Stop() {
+	m.Lock()
+	defer m.Unlock()
+	m.stopped = true
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
+
+// run is called at each epoch boundary
+func (m *SURBManager) run() {
+	err := m.Replenish()
+	if err != nil {
+		log.Errorf("SURBManager failed to replenish the SURB pools of %s: %s", m.identity, err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	_, _, till := epochNow(m.clock)
+	if !m.stopped {
+		m.timer = m.clock.AfterFunc(till, m.run)
+	}
+}
+
+// Replenish removes the expired SURBs and tops up the pool of each
+// correspondent for the current epoch and the following ones,
+// as far as their PKI documents are available
+func (m *SURBManager) Replenish() error {
+	epoch, _, _ := epochNow(m.clock)
+	expired, err := m.store.ExpirePooledSURBs(m.identity, epoch)
+	if err != nil {
+		return err
+	}
+	if expired != 0 {
+		log.Debugf("SURBManager expired %d SURBs of %s", expired, m.identity)
+	}
+	m.Lock()
+	correspondents := make([]string, 0, len(m.correspondents))
+	for correspondent := range m.correspondents {
+		correspondents = append(correspondents, correspondent)
+	}
+	poolSize := m.poolSize
+	m.Unlock()
+	for _, correspondent := range correspondents {
+		for e := epoch; e < epoch+constants.SURBKeyRetentionEpochs; e++ {
+			count, err := m.store.PooledSURBCount(m.identity, correspondent, e)
+			if err != nil {
+				return err
+			}
+			for ; count < poolSize; count++ {
+				err = m.generate(correspondent, e)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				// the PKI document of the epoch isn't available yet
+				log.Debugf("SURBManager can't pool SURBs of epoch %d for %s: %s", e, correspondent, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// generate adds a new SURB of the given correspondent
+// and epoch to the pool
+func (m *SURBManager) generate(correspondent string, epoch uint64) error {
+	_, provider, err := config.SplitEmail(correspondent)
+	if err != nil {
+		return err
+	}
+	path, surbID, delay, err := m.routeFactory.BuildSURBPath(epoch, provider, m.provider)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	randReader := m.randReader
+	m.Unlock()
+	surb, keys, err := sphinx.NewSURB(randReader, path)
+	if err != nil {
+		return err
+	}
+	return m.store.PutPooledSURB(m.identity, &storage.PooledSURB{
+		ID:            *surbID,
+		Correspondent: correspondent,
+		Epoch:         epoch,
+		Delay:         delay,
+		SURB:          surb,
+		Keys:          keys,
+	})
+}
+
+// maxSURBDelay returns the maximum path delay of a SURB used now,
+// as told by the given Clock, during the given epoch, zero if it's
+// not usable anymore
+func maxSURBDelay(c clock.Clock, epoch uint64) time.Duration {
+	current, _, till := epochNow(c)
+	if epoch > current {
+		till += time.Duration(epoch-current-1) * epochtime.Period
+	} else if epoch < current {
+		return 0
+	}
+	return till - constants.EpochBoundarySlack
+}
+
+// ackSURB returns a pooled SURB carrying the ACK of a Block sent to
+// the given recipient now over a forward path of the given delay,
+// ErrNoPooledSURB is returned if there is none
+func (m *SURBManager) ackSURB(recipient string, forwardDelay time.Duration) (*storage.PooledSURB, error) {
+	epoch, _, _ := epochNow(m.clock)
+	return m.store.TakePooledSURB(m.identity, strings.ToLower(recipient), epoch, maxSURBDelay(m.clock, epoch)-forwardDelay)
+}
+
+// issue returns a pooled SURB of the given epoch issued to
+// the correspondent, one is generated if the pool is empty
+func (m *SURBManager) issue(correspondent string, epoch uint64) (*storage.PooledSURB, error) {
+	// the correspondent may use the SURB any time during the epoch
+	maxDelay := epochtime.Period - constants.EpochBoundarySlack
+	surb, err := m.store.IssuePooledSURB(m.identity, correspondent, epoch, maxDelay)
+	if err != storage.ErrNoPooledSURB {
+		return surb, err
+	}
+	err = m.generate(correspondent, epoch)
+	if err != nil {
+		return nil, err
+	}
+	return m.store.IssuePooledSURB(m.identity, correspondent, epoch, maxDelay)
+}
+
+// attach returns the value of the SURB header of an outgoing message
+// to the given recipient, the SURBs are issued for the next epochs.
+// The recipient's pool is replenished from then on.
+func (m *SURBManager) attach(recipient string) string {
+	recipient = strings.ToLower(recipient)
+	err := m.Track(recipient)
+	if err != nil {
+		log.Errorf("SURBManager failed to attach SURBs: %s", err)
+		return ""
+	}
+	epoch, _, _ := epochNow(m.clock)
+	values := []string{}
+	for i := uint64(0); i < constants.SURBsPerMessage; i++ {
+		surb, err := m.issue(recipient, epoch+1+i)
+		if err != nil {
+			log.Debugf("SURBManager failed to issue a SURB of epoch %d to %s: %s", epoch+1+i, recipient, err)
+			break
+		}
+		values = append(values, fmt.Sprintf("%d %d %s", surb.Epoch, surb.Delay/time.Millisecond,
+			base64.StdEncoding.EncodeToString(surb.SURB)))
+	}
+	return strings.Join(values, ", ")
+}
+
+// parseSURBHeader parses the value of a SURB header
+func parseSURBHeader(value string) ([]*storage.ReceivedSURB, error) {
+	surbs := []*storage.ReceivedSURB{}
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed %s header", surbHeader)
+		}
+		epoch, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		delay, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		surb, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if len(surb) != sphinx.SURBLength {
+			return nil, fmt.Errorf("%s header has a SURB of %d bytes", surbHeader, len(surb))
+		}
+		surbs = append(surbs, &storage.ReceivedSURB{
+			Epoch: epoch,
+			Delay: time.Duration(delay) * time.Millisecond,
+			SURB:  surb,
+		})
+	}
+	return surbs, nil
+}
+
+// extractSURBs removes the SURB headers from the given message and
+// returns the SURBs, they aren't attributed to a correspondent yet
+func extractSURBs(message []byte) ([]byte, []*storage.ReceivedSURB) {
+	surbs := []*storage.ReceivedSURB{}
+	found := false
+	stripped := new(bytes.Buffer)
+	r := bufio.NewReader(bytes.NewReader(message))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 || err != nil {
+			// end of the header
+			stripped.Write(line)
+			break
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(string(line[:i]), surbHeader) {
+			stripped.Write(line)
+			continue
+		}
+		found = true
+		parsed, err := parseSURBHeader(string(line[i+1:]))
+		if err != nil {
+			log.Debugf("dropping the received SURBs: %s", err)
+			continue
+		}
+		surbs = append(surbs, parsed...)
+	}
+	if !found {
+		return message, nil
+	}
+	io.Copy(stripped, r)
+	return stripped.Bytes(), surbs
+}
+
+// bindSURBs attributes the given SURBs to the authenticated sender
+// of the message they were received with, as of the given epoch. The
+// From header alone doesn't tell who issued them: the SURBs of
+// messages whose sender isn't authenticated are dropped, as are
+// those which can't be used in the next epochs.
+func bindSURBs(surbs []*storage.ReceivedSURB, sender string, epoch uint64) []*storage.ReceivedSURB {
+	if sender == "" {
+		if len(surbs) > 0 {
+			log.Debugf("dropping %d SURBs of an unauthenticated sender", len(surbs))
+		}
+		return nil
+	}
+	bound := []*storage.ReceivedSURB{}
+	for _, surb := range surbs {
+		if surb.Epoch < epoch || surb.Epoch > epoch+constants.SURBKeyRetentionEpochs {
+			continue
+		}
+		surb.Correspondent = strings.ToLower(sender)
+		bound = append(bound, surb)
+	}
+	return bound
+}
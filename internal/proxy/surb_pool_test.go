@@ -0,0 +1,78 @@
+// surb_pool_test.go - SURB header tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractSURBs(t *testing.T) {
+	require := require.New(t)
+
+	surb := bytes.Repeat([]byte{7}, sphinx.SURBLength)
+	value := fmt.Sprintf("12 3000 %s, 13 4500 %s", base64.StdEncoding.EncodeToString(surb), base64.StdEncoding.EncodeToString(surb))
+	message := []byte(fmt.Sprintf("From: Bob <Bob@nsa.gov>\nTo: alice@acme.com\n%s: %s\n\nhello\n", surbHeader, value))
+
+	stripped, surbs := extractSURBs(message)
+	require.Equal("From: Bob <Bob@nsa.gov>\nTo: alice@acme.com\n\nhello\n", string(stripped))
+	require.Equal(2, len(surbs))
+	require.Equal("", surbs[0].Correspondent)
+	require.Equal(uint64(12), surbs[0].Epoch)
+	require.Equal(3*time.Second, surbs[0].Delay)
+	require.Equal(surb, surbs[0].SURB)
+	require.Equal(uint64(13), surbs[1].Epoch)
+	require.Equal(4500*time.Millisecond, surbs[1].Delay)
+
+	// malformed SURBs are dropped along with their header
+	message = []byte(fmt.Sprintf("From: bob@nsa.gov\n%s: 12 3000 AAAA\n\nhello\n", surbHeader))
+	stripped, surbs = extractSURBs(message)
+	require.Equal("From: bob@nsa.gov\n\nhello\n", string(stripped))
+	require.Equal(0, len(surbs))
+
+	message = []byte("From: bob@nsa.gov\n\nhello\n")
+	stripped, surbs = extractSURBs(message)
+	require.Equal(message, stripped)
+	require.Nil(surbs)
+}
+
+func TestBindSURBs(t *testing.T) {
+	require := require.New(t)
+
+	surbs := func() []*storage.ReceivedSURB {
+		return []*storage.ReceivedSURB{
+			{Epoch: 9}, {Epoch: 10}, {Epoch: 13}, {Epoch: 1 << 40},
+		}
+	}
+	// the From header of an unauthenticated message isn't trusted
+	require.Nil(bindSURBs(surbs(), "", 10))
+
+	bound := bindSURBs(surbs(), "Bob@nsa.gov", 10)
+	require.Equal(2, len(bound))
+	require.Equal(uint64(10), bound[0].Epoch)
+	require.Equal(uint64(13), bound[1].Epoch)
+	for _, surb := range bound {
+		require.Equal("bob@nsa.gov", surb.Correspondent)
+	}
+}
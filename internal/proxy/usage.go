@@ -0,0 +1,131 @@
+// usage.go - bandwidth accounting and monthly usage caps
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/client/internal/l10n"
+	"github.com/katzenpost/client/storage"
+)
+
+// ErrUsageCapReached is the error returned when a Sender
+// reached it's monthly usage cap
+var ErrUsageCapReached = errors.New("monthly usage cap reached")
+
+// recordUsage adds the given numbers of bytes to the account's
+// monthly usage, failures are only logged so that the traffic
+// isn't interrupted by the accounting
+func recordUsage(store *storage.Store, account string, sent, received int) {
+	err := store.RecordUsage(account, sent, received)
+	if err != nil {
+		log.Errorf("failed to record the bandwidth usage of %s: %s", account, err)
+	}
+}
+
+// nextMonth returns the start of the month following the given time
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// SetMonthlyCap sets the maximum number of bytes the Sender's
+// account may send and receive per month, once reached sending
+// is paused until the next month. Zero means unlimited.
+func (s *Sender) SetMonthlyCap(limit uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.monthlyCap = limit
+}
+
+// checkCap returns ErrUsageCapReached if the Sender's
+// account reached it's monthly usage cap
+func (s *Sender) checkCap() error {
+	s.Lock()
+	limit := s.monthlyCap
+	s.Unlock()
+	if limit == 0 {
+		return nil
+	}
+	usage, err := s.store.Usage(s.identity, s.clock.Now())
+	if err != nil {
+		return err
+	}
+	if usage.Total() >= limit {
+		return ErrUsageCapReached
+	}
+	return nil
+}
+
+// composeCapNotice returns the notification delivered to the
+// mailbox of the sender of the given Block once it's account
+// reached it's monthly usage cap, in the given language
+func composeCapNotice(b *storage.EgressBlock, language string, now time.Time) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: MAILER-DAEMON@%s\n", b.SenderProvider)
+	fmt.Fprintf(buf, "To: %s\n", b.Sender)
+	fmt.Fprintf(buf, "Subject: %s\n", l10n.Header(language, l10n.UsageCapSubject))
+	fmt.Fprintf(buf, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "%s: auto-generated\n", autoSubmittedHeader)
+	fmt.Fprintf(buf, "MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\n\n")
+	fmt.Fprint(buf, l10n.Sprintf(language, l10n.UsageCapBody, nextMonth(now).Format(time.RFC1123Z)))
+	return buf.Bytes()
+}
+
+// pause holds the given Block back until the next month because
+// it's sender reached the monthly usage cap, the sender is notified
+// the first time this happens in a month
+func (s *SendScheduler) pause(storageBlock *storage.EgressBlock) {
+	s.Lock()
+	now := s.clock.Now()
+	s.paused = append(s.paused, storageBlock)
+	if s.resumeTimer == nil {
+		s.resumeTimer = s.clock.AfterFunc(nextMonth(now).Sub(now), s.resume)
+	}
+	s.Unlock()
+	store := s.senders[storageBlock.Sender].store
+	first, err := store.MarkCapNotified(storageBlock.Sender)
+	if err != nil {
+		log.Errorf("SendScheduler failed to record usage cap notification: %s", err)
+		return
+	}
+	if !first {
+		return
+	}
+	log.Warningf("%s reached it's monthly usage cap, sending is paused", storageBlock.Sender)
+	err = store.PutMessage(storageBlock.Sender, composeCapNotice(storageBlock, accountLanguage(store, storageBlock.Sender), now))
+	if err != nil {
+		log.Errorf("SendScheduler failed to deliver usage cap notification: %s", err)
+	}
+}
+
+// resume sends the Blocks held back by the monthly usage caps
+func (s *SendScheduler) resume() {
+	s.Lock()
+	paused := s.paused
+	s.paused = nil
+	s.resumeTimer = nil
+	s.Unlock()
+	for _, storageBlock := range paused {
+		if !s.enqueueSlot(storageBlock) {
+			s.sendNow(storageBlock)
+		}
+	}
+}
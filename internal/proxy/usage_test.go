@@ -0,0 +1,116 @@
+// usage_test.go - monthly usage cap tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/path_selection"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextMonth(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Date(2017, time.December, 31, 23, 0, 0, 0, time.UTC)
+	require.Equal(time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC), nextMonth(now))
+}
+
+func TestMonthlyUsageCap(t *testing.T) {
+	require := require.New(t)
+
+	mixPKI, _ := newMixPKI(require)
+	routeFactory := path_selection.New(mixPKI, 5, float64(.123))
+
+	aliceEmail := "alice@acme.com"
+	alicePool, aliceStore, alicePrivKey, aliceBlockHandler := makeUser(require, aliceEmail)
+	defer aliceStore.Close()
+	err := aliceStore.CreateAccountBuckets([]string{aliceEmail})
+	require.NoError(err, "CreateAccountBuckets failure")
+	bobPrivKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failure")
+	userPKI := MockUserPKI{
+		userMap: map[string]*ecdh.PublicKey{
+			aliceEmail:    alicePrivKey.PublicKey(),
+			"bob@nsa.gov": bobPrivKey.PublicKey(),
+		},
+	}
+	session := alicePool.Sessions[aliceEmail].(*MockSession)
+
+	aliceSender, err := NewSender(aliceEmail, alicePool, aliceStore, routeFactory, userPKI, aliceBlockHandler)
+	require.NoError(err, "NewSender failure")
+	s := NewSendScheduler(map[string]*Sender{
+		aliceEmail: aliceSender,
+	})
+
+	bobID := [sphinxconstants.RecipientIDLength]byte{}
+	copy(bobID[:], "bob")
+	send := func(i int) {
+		egressBlock := storage.EgressBlock{
+			Sender:            aliceEmail,
+			SenderProvider:    "acme.com",
+			Recipient:         "bob@nsa.gov",
+			RecipientProvider: "nsa.gov",
+			RecipientID:       bobID,
+			Block: block.Block{
+				TotalBlocks: 2,
+				BlockID:     uint16(i),
+				Block:       []byte("metered"),
+			},
+		}
+		blockID, err := aliceStore.PutEgressBlock(&egressBlock)
+		require.NoError(err, "PutEgressBlock failure")
+		err = s.Send(aliceEmail, blockID, &egressBlock)
+		require.NoError(err, "Send failure")
+	}
+
+	send(0)
+	require.Equal(1, len(session.sentCommands))
+	usage, err := aliceStore.Usage(aliceEmail, time.Now())
+	require.NoError(err, "Usage failure")
+	require.NotEqual(uint64(0), usage.Sent)
+	require.Equal(uint64(0), usage.Received)
+
+	// the cap is reached, the second Block is held back
+	aliceSender.SetMonthlyCap(usage.Total())
+	send(1)
+	require.Equal(1, len(session.sentCommands))
+	require.Equal(1, len(s.paused))
+	messages, err := aliceStore.Messages(aliceEmail)
+	require.NoError(err, "Messages failure")
+	require.Equal(1, len(messages))
+	require.True(strings.Contains(string(messages[0]), "Subject: Monthly usage cap reached"))
+
+	// the user is notified only once per month
+	send(2)
+	require.Equal(2, len(s.paused))
+	messages, err = aliceStore.Messages(aliceEmail)
+	require.NoError(err, "Messages failure")
+	require.Equal(1, len(messages))
+
+	aliceSender.SetMonthlyCap(0)
+	s.resume()
+	require.Equal(3, len(session.sentCommands))
+	require.Equal(0, len(s.paused))
+}
@@ -0,0 +1,92 @@
+// vacation.go - vacation auto-replies
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/l10n"
+	"github.com/katzenpost/client/storage"
+)
+
+// autoSubmittedHeader marks automatically generated messages,
+// see RFC 3834. We never auto-reply to such messages so that
+// two accounts on vacation don't reply to each other forever.
+const autoSubmittedHeader = "Auto-Submitted"
+
+// vacationRecipient returns the address the vacation auto-reply
+// to the given message must be sent to, ok is false if the
+// message must not be replied to
+func vacationRecipient(accountName string, m *mail.Message) (recipient string, ok bool, err error) {
+	if autoSubmitted := m.Header.Get(autoSubmittedHeader); autoSubmitted != "" && strings.ToLower(autoSubmitted) != "no" {
+		return "", false, nil
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return "", false, err
+	}
+	recipient = strings.ToLower(from.Address)
+	if recipient == strings.ToLower(accountName) {
+		return "", false, nil
+	}
+	return recipient, true, nil
+}
+
+// composeVacationReply returns the vacation auto-reply
+// to the given message using the given template, the subject
+// is in the given language
+func composeVacationReply(accountName, recipient, language string, m *mail.Message, template string) []byte {
+	subject := m.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	if subject == "" {
+		subject = l10n.Header(language, l10n.VacationSubjectNone)
+	} else {
+		subject = l10n.Header(language, l10n.VacationSubject, subject)
+	}
+	reply := fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\n%s: auto-replied\n"+
+		"MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\n\n%s\n",
+		accountName, recipient, subject, autoSubmittedHeader, template)
+	return []byte(reply)
+}
+
+// sendVacationReply sends a vacation auto-reply to the sender
+// of the given message if the account is on vacation and the
+// sender wasn't recently replied to
+func (f *Fetcher) sendVacationReply(message []byte) error {
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	recipient, ok, err := vacationRecipient(f.Identity, m)
+	if err != nil || !ok {
+		return err
+	}
+	template, err := f.store.VacationReply(f.Identity, recipient)
+	if err != nil || template == "" {
+		return err
+	}
+	reply := composeVacationReply(f.Identity, recipient, accountLanguage(f.store, f.Identity), m, template)
+	_, err = enqueueMessage(entropy.Reader, f.store, f.scheduler, f.Identity, recipient, reply, 0, storage.PriorityBulk, nil)
+	return err
+}
@@ -0,0 +1,137 @@
+// rate_limit.go - local proxy flood protection
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package rate_limit provides the rate limits of our local proxy
+// listeners so that a misbehaving local application can't flood the
+// egress queue and distort the client's traffic profile.
+package rate_limit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of buckets above which
+// the full buckets are forgotten
+const maxIdleBuckets = 1024
+
+// bucket is the token bucket of a single key
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter limits the rate of messages and the number of concurrent
+// connections per key, where a key is either a source IP address
+// or an account. A limit of zero disables the respective check.
+type Limiter struct {
+	sync.Mutex
+
+	messagesPerMinute int
+	maxConnections    int
+	buckets           map[string]*bucket
+	connections       map[string]int
+	now               func() time.Time
+}
+
+// New creates a new Limiter allowing bursts of up to
+// messagesPerMinute messages and maxConnections
+// concurrent connections per key
+func New(messagesPerMinute, maxConnections int) *Limiter {
+	l := Limiter{
+		messagesPerMinute: messagesPerMinute,
+		maxConnections:    maxConnections,
+		buckets:           make(map[string]*bucket),
+		connections:       make(map[string]int),
+		now:               time.Now,
+	}
+	return &l
+}
+
+// refill adds the tokens accumulated since the last update
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.updated).Minutes() * float64(l.messagesPerMinute)
+	if b.tokens > float64(l.messagesPerMinute) {
+		b.tokens = float64(l.messagesPerMinute)
+	}
+	b.updated = now
+}
+
+// Allow returns true if a message of the given key may be
+// accepted, false if the key exceeded it's message rate
+func (l *Limiter) Allow(key string) bool {
+	if l.messagesPerMinute == 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	if len(l.buckets) > maxIdleBuckets {
+		for k, b := range l.buckets {
+			l.refill(b, now)
+			if b.tokens == float64(l.messagesPerMinute) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens:  float64(l.messagesPerMinute),
+			updated: now,
+		}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Acquire returns true if a new connection of the given key may
+// be accepted, in which case Release must be called once it's closed
+func (l *Limiter) Acquire(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.maxConnections != 0 && l.connections[key] >= l.maxConnections {
+		return false
+	}
+	l.connections[key]++
+	return true
+}
+
+// Release releases a connection acquired with Acquire
+func (l *Limiter) Release(key string) {
+	l.Lock()
+	defer l.Unlock()
+	l.connections[key]--
+	if l.connections[key] <= 0 {
+		delete(l.connections, key)
+	}
+}
+
+// SourceKey returns the key of the source IP
+// address of the given connection
+func SourceKey(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,70 @@
+// rate_limit_test.go - local proxy flood protection tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rate_limit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRate(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1500000000, 0)
+	l := New(2, 0)
+	l.now = func() time.Time { return now }
+	require.True(l.Allow("127.0.0.1"))
+	require.True(l.Allow("127.0.0.1"))
+	require.False(l.Allow("127.0.0.1"), "burst exceeded")
+	require.True(l.Allow("alice@acme.com"), "keys must be limited independently")
+
+	now = now.Add(30 * time.Second)
+	require.True(l.Allow("127.0.0.1"), "token not refilled")
+	require.False(l.Allow("127.0.0.1"))
+
+	unlimited := New(0, 0)
+	for i := 0; i < 100; i++ {
+		require.True(unlimited.Allow("127.0.0.1"))
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	require := require.New(t)
+
+	l := New(0, 2)
+	require.True(l.Acquire("127.0.0.1"))
+	require.True(l.Acquire("127.0.0.1"))
+	require.False(l.Acquire("127.0.0.1"))
+	require.True(l.Acquire("::1"))
+	l.Release("127.0.0.1")
+	require.True(l.Acquire("127.0.0.1"))
+}
+
+func TestSourceKey(t *testing.T) {
+	require := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "unexpected Listen error")
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(err, "unexpected Dial error")
+	defer conn.Close()
+	require.Equal("127.0.0.1", SourceKey(conn))
+}
@@ -0,0 +1,167 @@
+// mnemonic.go - mnemonic phrase key backup
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package recovery_kit
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/magical/argon2"
+)
+
+// A mnemonic is a phrase of words from the recovery kit word list
+// which can be written down by hand, it encodes the link layer and
+// end to end private keys of an account followed by a checksum of
+// the keys and the account address catching typos, see Mnemonic and
+// MnemonicAccount. Anyone knowing it has the keys of the account.
+const (
+	// mnemonicKeysSize is the size in bytes of the keys of a mnemonic
+	mnemonicKeysSize = 2 * keySize
+
+	// mnemonicChecksumSize is the size in bytes of the checksum
+	mnemonicChecksumSize = 2
+
+	// mnemonicWordsPerLine is the number of words per line of a mnemonic
+	mnemonicWordsPerLine = 6
+
+	// mnemonicDomain separates the checksum
+	// of mnemonics from other uses of the keys
+	mnemonicDomain = "mixclient mnemonic v2 "
+
+	// legacySeedSize is the size in bytes of the seed of the
+	// mnemonics of the first version, from which the keys were
+	// derived instead, they are still restored
+	legacySeedSize = 16
+
+	// legacyDomain separated the key derivation of
+	// the legacy mnemonics from other uses of the seed
+	legacyDomain = "mixclient mnemonic v1 "
+)
+
+// mnemonicChecksum returns the checksum of the given
+// keys of the account with the given address
+func mnemonicChecksum(keys []byte, address string) []byte {
+	h := sha256.New()
+	h.Write([]byte(mnemonicDomain + address + "\x00"))
+	h.Write(keys)
+	return h.Sum(nil)[:mnemonicChecksumSize]
+}
+
+// Mnemonic returns the mnemonic of the keys of the given account,
+// in lines of mnemonicWordsPerLine words
+func Mnemonic(a *Account) string {
+	keys := append(a.LinkKey.Bytes(), a.EndToEndKey.Bytes()...)
+	lines := []string{}
+	line := []string{}
+	for _, b := range append(keys, mnemonicChecksum(keys, strings.ToLower(a.Address))...) {
+		line = append(line, words[b])
+		if len(line) == mnemonicWordsPerLine {
+			lines = append(lines, strings.Join(line, " "))
+			line = []string{}
+		}
+	}
+	if len(line) != 0 {
+		lines = append(lines, strings.Join(line, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseMnemonic returns the keys encoded by the given mnemonic of the
+// account with the given address, the case of the words and the
+// whitespace, e.g. the line breaks, are ignored
+func parseMnemonic(mnemonic, address string) ([]byte, error) {
+	fields := strings.Fields(strings.ToLower(mnemonic))
+	if len(fields) == legacySeedSize+mnemonicChecksumSize {
+		return legacyKeys(fields, address)
+	}
+	if len(fields) != mnemonicKeysSize+mnemonicChecksumSize {
+		return nil, fmt.Errorf("mnemonic has %d words instead of %d", len(fields), mnemonicKeysSize+mnemonicChecksumSize)
+	}
+	data, err := decodeWords(fields)
+	if err != nil {
+		return nil, err
+	}
+	keys := data[:mnemonicKeysSize]
+	if string(mnemonicChecksum(keys, address)) != string(data[mnemonicKeysSize:]) {
+		return nil, errors.New("mnemonic checksum mismatch, check the words and the address")
+	}
+	return keys, nil
+}
+
+// decodeWords returns the bytes encoded by the given words
+func decodeWords(fields []string) ([]byte, error) {
+	index := make(map[string]byte)
+	for i, word := range words {
+		index[word] = byte(i)
+	}
+	data := []byte{}
+	for _, word := range fields {
+		b, ok := index[word]
+		if !ok {
+			return nil, fmt.Errorf("mnemonic: unknown word %q", word)
+		}
+		data = append(data, b)
+	}
+	return data, nil
+}
+
+// legacyKeys returns the keys of the account with the given address
+// derived from the seed of the given words of a legacy mnemonic. The
+// keys restored from it may be exported to a mnemonic of the current
+// version, see Mnemonic.
+func legacyKeys(fields []string, address string) ([]byte, error) {
+	data, err := decodeWords(fields)
+	if err != nil {
+		return nil, err
+	}
+	seed := data[:legacySeedSize]
+	sum := sha256.Sum256(seed)
+	if string(sum[:mnemonicChecksumSize]) != string(data[legacySeedSize:]) {
+		return nil, errors.New("mnemonic checksum mismatch, check the words")
+	}
+	return argon2.Key(seed, []byte(legacyDomain+address), 32, 2, int64(1<<16), mnemonicKeysSize)
+}
+
+// MnemonicAccount returns the account with the given address whose
+// keys are encoded by the given mnemonic, see Mnemonic. The returned
+// Account is restored like those of a Kit, e.g. with Kit.Restore.
+func MnemonicAccount(mnemonic, address string) (*Account, error) {
+	address = strings.ToLower(address)
+	keys, err := parseMnemonic(mnemonic, address)
+	if err != nil {
+		return nil, err
+	}
+	a := Account{
+		Address: address,
+		Created: time.Now(),
+	}
+	a.LinkKey = new(ecdh.PrivateKey)
+	err = a.LinkKey.FromBytes(keys[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	a.EndToEndKey = new(ecdh.PrivateKey)
+	err = a.EndToEndKey.FromBytes(keys[keySize:])
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
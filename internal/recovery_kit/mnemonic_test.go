@@ -0,0 +1,105 @@
+// mnemonic_test.go - mnemonic phrase key backup tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package recovery_kit
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/magical/argon2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMnemonic(t *testing.T) {
+	require := require.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	endToEndKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	account := &Account{
+		Address:     "Alice@acme.com",
+		LinkKey:     linkKey,
+		EndToEndKey: endToEndKey,
+	}
+	mnemonic := Mnemonic(account)
+	phrase := strings.Fields(mnemonic)
+	require.Equal(mnemonicKeysSize+mnemonicChecksumSize, len(phrase))
+	require.Len(strings.Split(mnemonic, "\n"), (len(phrase)+mnemonicWordsPerLine-1)/mnemonicWordsPerLine)
+
+	// the mnemonic encodes the keys of the account
+	a, err := MnemonicAccount(mnemonic, "alice@acme.com")
+	require.NoError(err, "MnemonicAccount failed")
+	require.Equal("alice@acme.com", a.Address)
+	require.Equal(linkKey.Bytes(), a.LinkKey.Bytes())
+	require.Equal(endToEndKey.Bytes(), a.EndToEndKey.Bytes())
+	b, err := MnemonicAccount(strings.ToUpper(strings.Join(phrase, " ")), "Alice@acme.com")
+	require.NoError(err, "MnemonicAccount failed")
+	require.Equal(a.EndToEndKey.Bytes(), b.EndToEndKey.Bytes())
+
+	// the checksum covers the address
+	_, err = MnemonicAccount(mnemonic, "bob@acme.com")
+	require.Error(err, "wrong address not detected")
+
+	// a typo is caught by the checksum
+	replacement := words[0]
+	if phrase[3] == replacement {
+		replacement = words[1]
+	}
+	phrase[3] = replacement
+	_, err = MnemonicAccount(strings.Join(phrase, " "), "alice@acme.com")
+	require.Error(err, "typo not detected")
+	_, err = MnemonicAccount(strings.Join(phrase[1:], " "), "alice@acme.com")
+	require.Error(err, "missing word not detected")
+
+	keysDir, err := ioutil.TempDir("", "mnemonic_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(keysDir)
+	kit := Kit{Accounts: []*Account{a}}
+	restored, err := kit.Restore(keysDir, "correct horse battery staple")
+	require.NoError(err, "Restore failed")
+	key, err := restored.GetAccountKey(constants.EndToEndKeyType, restored.Account[0], keysDir, "correct horse battery staple")
+	require.NoError(err, "GetAccountKey failed")
+	require.Equal(endToEndKey.Bytes(), key.Bytes())
+}
+
+func TestLegacyMnemonic(t *testing.T) {
+	require := require.New(t)
+
+	seed := make([]byte, legacySeedSize)
+	sum := sha256.Sum256(seed)
+	phrase := []string{}
+	for _, b := range append(seed, sum[:mnemonicChecksumSize]...) {
+		phrase = append(phrase, words[b])
+	}
+	a, err := MnemonicAccount(strings.Join(phrase, " "), "alice@acme.com")
+	require.NoError(err, "MnemonicAccount failed")
+	keys, err := argon2.Key(seed, []byte(legacyDomain+"alice@acme.com"), 32, 2, int64(1<<16), mnemonicKeysSize)
+	require.NoError(err, "argon2.Key failed")
+	require.Equal(keys[keySize:], a.EndToEndKey.Bytes())
+
+	// the restored keys are exported to a current mnemonic
+	b, err := MnemonicAccount(Mnemonic(a), "alice@acme.com")
+	require.NoError(err, "MnemonicAccount failed")
+	require.Equal(a.LinkKey.Bytes(), b.LinkKey.Bytes())
+}
@@ -0,0 +1,474 @@
+// recovery_kit.go - printable disaster recovery kit
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package recovery_kit produces printable, passphrase encrypted recovery
+// documents from which a user can reconstruct their client identities
+// after the total loss of their device, and restores them.
+package recovery_kit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/crypto/vault"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/key_store"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/magical/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// kitVersion is the version of the encoding of the secret section
+	kitVersion = 1
+
+	// kitHeader is the first line of a printed recovery kit
+	kitHeader = "MIXCLIENT RECOVERY KIT"
+
+	// kitFooter is the last line of a printed recovery kit
+	kitFooter = "END OF RECOVERY KIT"
+
+	// wordsPerLine is the number of data words per printed line,
+	// each line is followed by a check word
+	wordsPerLine = 8
+
+	// passphraseMinSize is the minimum kit passphrase size in bytes
+	passphraseMinSize = 12
+
+	saltSize  = 16
+	nonceSize = 24
+	keySize   = 32
+)
+
+// Account is a client identity saved in a recovery kit
+type Account struct {
+	// Address is the e-mail address of the account
+	Address string
+
+	// Created is the creation time of the account's keys
+	Created time.Time
+
+	// LinkKey is the wire protocol link layer private key
+	LinkKey *ecdh.PrivateKey
+
+	// EndToEndKey is the end to end messaging private key
+	EndToEndKey *ecdh.PrivateKey
+}
+
+// Pin is a pinned Provider key, a PKI trust anchor
+type Pin struct {
+	// Name is the name of the Provider
+	Name string
+
+	// PublicKey is the Provider's pinned public key
+	PublicKey *ecdh.PublicKey
+}
+
+// Kit is a recovery kit
+type Kit struct {
+	// Created is the creation time of the kit
+	Created time.Time
+
+	// Accounts are the identities saved in the kit
+	Accounts []*Account
+
+	// Pins are the pinned Provider keys
+	Pins []*Pin
+}
+
+// Collect creates a recovery kit of all the accounts and pinned
+// Provider keys of the given configuration, the account keys are
+// decrypted from keysDir with the given passphrase
+func Collect(cfg *config.Config, keysDir, passphrase string) (*Kit, error) {
+	kit := Kit{
+		Created: time.Now(),
+	}
+	for _, account := range cfg.Account {
+		linkKey, err := cfg.GetAccountKey(constants.LinkLayerKeyType, account, keysDir, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		endToEndKey, err := cfg.GetAccountKey(constants.EndToEndKeyType, account, keysDir, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keyFile := config.CreateKeyFileName(keysDir, constants.LinkLayerKeyType, account.Name, account.Provider, constants.KeyStatusPrivate)
+		info, err := os.Stat(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		kit.Accounts = append(kit.Accounts, &Account{
+			Address:     strings.ToLower(fmt.Sprintf("%s@%s", account.Name, account.Provider)),
+			Created:     info.ModTime(),
+			LinkKey:     linkKey,
+			EndToEndKey: endToEndKey,
+		})
+	}
+	for _, pinning := range cfg.ProviderPinning {
+		pemPayload, err := ioutil.ReadFile(pinning.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(pemPayload)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode pinned key of %s", pinning.Name)
+		}
+		publicKey := new(ecdh.PublicKey)
+		err = publicKey.FromBytes(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		kit.Pins = append(kit.Pins, &Pin{
+			Name:      pinning.Name,
+			PublicKey: publicKey,
+		})
+	}
+	return &kit, nil
+}
+
+// stretch derives the kit encryption key from the passphrase
+func stretch(passphrase string, salt []byte) (*[keySize]byte, error) {
+	if len(passphrase) < passphraseMinSize {
+		return nil, errors.New("passphrase too short")
+	}
+	out, err := argon2.Key([]byte(passphrase), salt, 32, 2, int64(1<<16), keySize)
+	if err != nil {
+		return nil, err
+	}
+	key := [keySize]byte{}
+	copy(key[:], out)
+	return &key, nil
+}
+
+// writeString writes a length prefixed string
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// readString reads a length prefixed string
+func readString(r *bytes.Reader) (string, error) {
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	_, err = io.ReadFull(r, s)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// marshal serializes the secret section of the kit,
+// compactly so that it prints as few words as possible
+func (k *Kit) marshal() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(kitVersion)
+	binary.Write(buf, binary.BigEndian, k.Created.Unix())
+	binary.Write(buf, binary.BigEndian, uint16(len(k.Accounts)))
+	for _, a := range k.Accounts {
+		writeString(buf, a.Address)
+		binary.Write(buf, binary.BigEndian, a.Created.Unix())
+		buf.Write(a.LinkKey.Bytes())
+		buf.Write(a.EndToEndKey.Bytes())
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(k.Pins)))
+	for _, p := range k.Pins {
+		writeString(buf, p.Name)
+		buf.Write(p.PublicKey.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// unmarshal deserializes the secret section of a kit
+func unmarshal(raw []byte) (*Kit, error) {
+	r := bytes.NewReader(raw)
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != kitVersion {
+		return nil, fmt.Errorf("unsupported recovery kit version %d", version)
+	}
+	var created int64
+	err = binary.Read(r, binary.BigEndian, &created)
+	if err != nil {
+		return nil, err
+	}
+	kit := Kit{
+		Created: time.Unix(created, 0),
+	}
+	var count uint16
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(count); i++ {
+		a := Account{}
+		a.Address, err = readString(r)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(r, binary.BigEndian, &created)
+		if err != nil {
+			return nil, err
+		}
+		a.Created = time.Unix(created, 0)
+		keys := make([]byte, 2*keySize)
+		_, err = io.ReadFull(r, keys)
+		if err != nil {
+			return nil, err
+		}
+		a.LinkKey = new(ecdh.PrivateKey)
+		err = a.LinkKey.FromBytes(keys[:keySize])
+		if err != nil {
+			return nil, err
+		}
+		a.EndToEndKey = new(ecdh.PrivateKey)
+		err = a.EndToEndKey.FromBytes(keys[keySize:])
+		if err != nil {
+			return nil, err
+		}
+		kit.Accounts = append(kit.Accounts, &a)
+	}
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(count); i++ {
+		p := Pin{}
+		p.Name, err = readString(r)
+		if err != nil {
+			return nil, err
+		}
+		key := make([]byte, keySize)
+		_, err = io.ReadFull(r, key)
+		if err != nil {
+			return nil, err
+		}
+		p.PublicKey = new(ecdh.PublicKey)
+		err = p.PublicKey.FromBytes(key)
+		if err != nil {
+			return nil, err
+		}
+		kit.Pins = append(kit.Pins, &p)
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("trailing data in recovery kit")
+	}
+	return &kit, nil
+}
+
+// checkWord returns the check word of the given printed line
+func checkWord(lineNumber int, data []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:", lineNumber)
+	h.Write(data)
+	return words[h.Sum(nil)[0]]
+}
+
+// Write writes the printable recovery kit to w. The account addresses,
+// key creation dates and pinned Provider keys are printed in the clear
+// for reference, all of them are also part of the secret section which
+// is encrypted with the given kit passphrase and printed as words.
+func (k *Kit) Write(w io.Writer, randReader io.Reader, kitPassphrase string) error {
+	salt := make([]byte, saltSize)
+	_, err := io.ReadFull(randReader, salt)
+	if err != nil {
+		return err
+	}
+	nonce := [nonceSize]byte{}
+	_, err = io.ReadFull(randReader, nonce[:])
+	if err != nil {
+		return err
+	}
+	key, err := stretch(kitPassphrase, salt)
+	if err != nil {
+		return err
+	}
+	secret := append(salt, nonce[:]...)
+	secret = secretbox.Seal(secret, k.marshal(), &nonce, key)
+
+	out := new(bytes.Buffer)
+	fmt.Fprintln(out, kitHeader)
+	fmt.Fprintf(out, "Created: %s\n\n", k.Created.UTC().Format(time.RFC3339))
+	for _, a := range k.Accounts {
+		fmt.Fprintf(out, "Account %s\n", a.Address)
+		fmt.Fprintf(out, "    keys created %s\n", a.Created.UTC().Format(time.RFC3339))
+	}
+	for _, p := range k.Pins {
+		fmt.Fprintf(out, "Pinned Provider %s %s\n", p.Name, hex.EncodeToString(p.PublicKey.Bytes()))
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Keep this document in a safe place away from your device.")
+	fmt.Fprintln(out, "The secret keys below are encrypted with the kit passphrase,")
+	fmt.Fprintln(out, "each numbered line ends with a check word to catch typos.")
+	fmt.Fprintln(out)
+	for i, line := 0, 1; i < len(secret); i, line = i+wordsPerLine, line+1 {
+		end := i + wordsPerLine
+		if end > len(secret) {
+			end = len(secret)
+		}
+		fmt.Fprintf(out, "%03d", line)
+		for _, b := range secret[i:end] {
+			fmt.Fprintf(out, " %s", words[b])
+		}
+		fmt.Fprintf(out, "  %s\n", checkWord(line, secret[i:end]))
+	}
+	fmt.Fprintln(out, kitFooter)
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// Read parses a printed recovery kit read from r, and decrypts it's
+// secret section with the given kit passphrase. Lines which aren't
+// numbered word lines are ignored.
+func Read(r io.Reader, kitPassphrase string) (*Kit, error) {
+	index := make(map[string]byte)
+	for i, word := range words {
+		index[word] = byte(i)
+	}
+	secret := []byte{}
+	line := 1
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.ToLower(scanner.Text()))
+		if len(fields) < 3 {
+			continue
+		}
+		lineNumber, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		if lineNumber != line {
+			return nil, fmt.Errorf("recovery kit line %d is missing", line)
+		}
+		data := []byte{}
+		for _, word := range fields[1 : len(fields)-1] {
+			b, ok := index[word]
+			if !ok {
+				return nil, fmt.Errorf("recovery kit line %d: unknown word %q", line, word)
+			}
+			data = append(data, b)
+		}
+		if checkWord(line, data) != fields[len(fields)-1] {
+			return nil, fmt.Errorf("recovery kit line %d: check word mismatch", line)
+		}
+		secret = append(secret, data...)
+		line++
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < saltSize+nonceSize+secretbox.Overhead {
+		return nil, errors.New("recovery kit is truncated")
+	}
+	key, err := stretch(kitPassphrase, secret[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := [nonceSize]byte{}
+	copy(nonce[:], secret[saltSize:saltSize+nonceSize])
+	raw, ok := secretbox.Open(nil, secret[saltSize+nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("wrong passphrase or corrupted recovery kit")
+	}
+	return unmarshal(raw)
+}
+
+// pinnedKeyFileName returns the file name of a restored pinned Provider key
+func pinnedKeyFileName(keysDir, provider string) string {
+	return fmt.Sprintf("%s/provider_%s.%s.pem", keysDir, provider, constants.KeyStatusPublic)
+}
+
+// Restore writes the keys of the kit to keysDir, encrypted with the
+// given passphrase, and returns a configuration of the restored
+// accounts and pinned Provider keys. Existing key files are never
+// overwritten.
+func (k *Kit) Restore(keysDir, passphrase string) (*config.Config, error) {
+	store, err := key_store.Open(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.Config{}
+	for _, a := range k.Accounts {
+		name, provider, err := config.SplitEmail(a.Address)
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]*ecdh.PrivateKey{
+			constants.LinkLayerKeyType: a.LinkKey,
+			constants.EndToEndKeyType:  a.EndToEndKey,
+		}
+		for keyType, key := range keys {
+			keyFile := store.KeyFile(keyType, name, provider, constants.KeyStatusPrivate)
+			if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+				return nil, fmt.Errorf("key file %s already exists", keyFile)
+			}
+			v, err := vault.New(constants.KeyStatusPrivate, passphrase, keyFile, a.Address, nil)
+			if err != nil {
+				return nil, err
+			}
+			pemPayload, err := v.Encrypt(key.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			err = store.WriteFile(keyFile, pemPayload)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cfg.Account = append(cfg.Account, config.Account{
+			Name:     name,
+			Provider: provider,
+		})
+	}
+	for _, p := range k.Pins {
+		keyFile := pinnedKeyFileName(keysDir, p.Name)
+		if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+			return nil, fmt.Errorf("key file %s already exists", keyFile)
+		}
+		block := pem.Block{
+			Type:  constants.KeyStatusPublic,
+			Bytes: p.PublicKey.Bytes(),
+		}
+		err := store.WriteFile(keyFile, pem.EncodeToMemory(&block))
+		if err != nil {
+			return nil, err
+		}
+		cfg.ProviderPinning = append(cfg.ProviderPinning, config.ProviderPinning{
+			Name:          p.Name,
+			PublicKeyFile: keyFile,
+		})
+	}
+	return &cfg, nil
+}
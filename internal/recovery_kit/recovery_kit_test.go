@@ -0,0 +1,116 @@
+// recovery_kit_test.go - recovery kit tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package recovery_kit
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryKit(t *testing.T) {
+	require := require.New(t)
+
+	keysDir, err := ioutil.TempDir("", "recovery_kit_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(keysDir)
+	restoreDir, err := ioutil.TempDir("", "recovery_kit_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(restoreDir)
+
+	providerKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair error")
+	pinFile := keysDir + "/acme.pem"
+	block := pem.Block{
+		Type:  constants.KeyStatusPublic,
+		Bytes: providerKey.PublicKey().Bytes(),
+	}
+	err = ioutil.WriteFile(pinFile, pem.EncodeToMemory(&block), 0600)
+	require.NoError(err, "unexpected WriteFile error")
+
+	passphrase := "correct horse battery staple"
+	cfg := config.Config{
+		Account: []config.Account{
+			{Name: "alice", Provider: "acme.com"},
+		},
+		ProviderPinning: []config.ProviderPinning{
+			{Name: "acme.com", PublicKeyFile: pinFile},
+		},
+	}
+	err = cfg.GenerateKeys(keysDir, passphrase)
+	require.NoError(err, "GenerateKeys failed")
+
+	kit, err := Collect(&cfg, keysDir, passphrase)
+	require.NoError(err, "Collect failed")
+	require.Equal(1, len(kit.Accounts))
+	require.Equal("alice@acme.com", kit.Accounts[0].Address)
+
+	kitPassphrase := "a different kit passphrase"
+	printed := new(bytes.Buffer)
+	err = kit.Write(printed, rand.Reader, kitPassphrase)
+	require.NoError(err, "Write failed")
+	require.Contains(printed.String(), "Account alice@acme.com")
+
+	_, err = Read(bytes.NewReader(printed.Bytes()), "the wrong passphrase")
+	require.Error(err, "Read succeeded with the wrong passphrase")
+
+	// a typo is caught by the line's check word
+	lines := strings.Split(printed.String(), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "002 ") {
+			fields := strings.Fields(line)
+			replacement := words[0]
+			if fields[1] == replacement {
+				replacement = words[1]
+			}
+			lines[i] = strings.Replace(line, " "+fields[1]+" ", " "+replacement+" ", 1)
+		}
+	}
+	_, err = Read(strings.NewReader(strings.Join(lines, "\n")), kitPassphrase)
+	require.Error(err, "typo not detected")
+
+	recovered, err := Read(bytes.NewReader(printed.Bytes()), kitPassphrase)
+	require.NoError(err, "Read failed")
+	require.Equal(kit.Created.Unix(), recovered.Created.Unix())
+	require.Equal(kit.Accounts[0].LinkKey.Bytes(), recovered.Accounts[0].LinkKey.Bytes())
+	require.Equal(kit.Accounts[0].EndToEndKey.Bytes(), recovered.Accounts[0].EndToEndKey.Bytes())
+	require.Equal(providerKey.PublicKey().Bytes(), recovered.Pins[0].PublicKey.Bytes())
+
+	newPassphrase := "a new device passphrase"
+	restored, err := recovered.Restore(restoreDir, newPassphrase)
+	require.NoError(err, "Restore failed")
+	accounts, err := restored.AccountsMap(constants.EndToEndKeyType, restoreDir, newPassphrase)
+	require.NoError(err, "AccountsMap failed")
+	key, err := accounts.GetIdentityKey("alice@acme.com")
+	require.NoError(err, "GetIdentityKey failed")
+	require.Equal(kit.Accounts[0].EndToEndKey.Bytes(), key.Bytes())
+	pins, err := restored.GetProviderPinnedKeys()
+	require.NoError(err, "GetProviderPinnedKeys failed")
+	require.Equal(1, len(pins))
+
+	_, err = recovered.Restore(restoreDir, newPassphrase)
+	require.Error(err, "Restore overwrote the existing keys")
+}
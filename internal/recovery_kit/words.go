@@ -0,0 +1,54 @@
+// words.go - recovery kit word list
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package recovery_kit
+
+// words encodes one byte per word, the words are
+// distinct and easy to read back from a printout
+var words = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "anchor", "angle", "ankle", "apple", "april", "apron", "arena",
+	"armor", "arrow", "atlas", "attic", "audio", "autumn", "avenue", "badge",
+	"bagel", "baker", "bamboo", "banana", "banjo", "barley", "basket", "beacon",
+	"beaver", "berry", "bicycle", "bishop", "blanket", "blossom", "bonnet", "border",
+	"bottle", "bracket", "breeze", "bridge", "bronze", "bubble", "bucket", "butter",
+	"cabin", "cactus", "camel", "canal", "candle", "canoe", "canyon", "carbon",
+	"carpet", "castle", "cattle", "celery", "cement", "cherry", "circus", "citrus",
+	"clover", "cobalt", "coffee", "collar", "comet", "copper", "coral", "cotton",
+	"cradle", "crayon", "cricket", "crystal", "dagger", "daisy", "dancer", "denim",
+	"desert", "diesel", "dinner", "dolphin", "domino", "donkey", "dragon", "drawer",
+	"dune", "eagle", "easel", "echo", "elbow", "ember", "engine", "falcon",
+	"fabric", "feather", "fennel", "ferry", "fiddle", "finch", "flute", "forest",
+	"fossil", "fox", "galaxy", "garage", "garlic", "geyser", "ginger", "glacier",
+	"goblet", "gopher", "granite", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "helmet", "hermit", "hollow", "honey", "hornet", "hotel", "iceberg",
+	"igloo", "indigo", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly",
+	"jigsaw", "juniper", "kayak", "kennel", "kettle", "kitten", "koala", "ladder",
+	"lagoon", "lantern", "laser", "lemon", "lentil", "lily", "linen", "lizard",
+	"locket", "lumber", "magnet", "mango", "maple", "marble", "meadow", "melon",
+	"meteor", "mirror", "mitten", "monkey", "muffin", "mustard", "napkin", "nectar",
+	"needle", "nickel", "noodle", "oasis", "ocean", "olive", "onion", "orbit",
+	"orchid", "otter", "oyster", "paddle", "palace", "panda", "parrot", "pebble",
+	"pepper", "piano", "pickle", "pigeon", "pillow", "pilot", "pine", "planet",
+	"plum", "pocket", "pony", "poppy", "potato", "prism", "pumpkin", "puzzle",
+	"quartz", "quill", "rabbit", "radar", "radish", "raven", "ribbon", "river",
+	"robin", "rocket", "saddle", "salmon", "sandal", "satin", "scarf", "sierra",
+	"silver", "sketch", "sleigh", "spider", "squid", "statue", "stone", "sugar",
+	"summit", "sunset", "swan", "tablet", "tango", "teapot", "temple", "thunder",
+	"tiger", "timber", "tomato", "topaz", "torch", "tulip", "tundra", "turnip",
+	"turtle", "valley", "velvet", "violin", "volcano", "waffle", "walnut", "walrus",
+	"wagon", "willow", "window", "wizard", "yogurt", "zebra", "zephyr", "zigzag",
+}
@@ -0,0 +1,280 @@
+// registration.go - account registration with the Provider
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package registration registers new accounts with their Provider.
+// Given the account's fresh link layer key and an invitation token
+// from the configuration, the client asks the Provider to create
+// the account before connecting to it, instead of the Provider's
+// operator adding it by hand.
+//
+// The wire protocol authenticates the client with it's link layer
+// key during the handshake, so a session can't be established
+// before the account exists. Registration therefore uses the
+// Provider's user registration service: a form with the version,
+// command, user and link key fields is POSTed to the /registration
+// path of the account's RegistrationURL, over the transport of the
+// Provider, which responds 200 OK once the account exists and 409
+// Conflict if it already exists. A registration whose outcome is
+// unknown, e.g. because the response was lost, is recorded as
+// pending so that a 409 Conflict in response to it's retry is taken
+// for the account registered by the lost attempt.
+package registration
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/transport"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+const (
+	// Path is the path of the Provider's registration endpoint
+	Path = "/registration"
+
+	// Version is the version of the registration protocol
+	Version = "0"
+
+	// RegisterLinkCommand is the command registering
+	// an account with it's link layer key
+	RegisterLinkCommand = "register_link"
+
+	// maxResponseSize is the maximum size in bytes
+	// of an error response we will read
+	maxResponseSize = 1 << 12
+)
+
+// the fields of the registration form
+const (
+	versionField = "version"
+	commandField = "command"
+	userField    = "user"
+	linkKeyField = "linkkey"
+	tokenField   = "token"
+)
+
+// ErrAccountExists is the error returned when the account is
+// already registered, by another client unless a registration
+// of the account is pending
+var ErrAccountExists = errors.New("account already registered with another key")
+
+// Request is a registration request
+type Request struct {
+	// Account is the e-mail address of the account
+	Account string
+	// LinkKey is the public link layer key the
+	// account authenticates it's wire sessions with
+	LinkKey *ecdh.PublicKey
+	// Token is the invitation token
+	Token string
+}
+
+// form returns the registration form of the Request
+func (r *Request) form() (url.Values, error) {
+	user, _, err := config.SplitEmail(r.Account)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set(versionField, Version)
+	form.Set(commandField, RegisterLinkCommand)
+	form.Set(userField, user)
+	form.Set(linkKeyField, linkKeyString(r.LinkKey))
+	form.Set(tokenField, r.Token)
+	return form, nil
+}
+
+// Registrar registers accounts with a Provider
+type Registrar interface {
+	Register(ctx context.Context, request *Request) error
+}
+
+// HTTPRegistrar is a Registrar which POSTs the Requests
+// to the Provider's registration endpoint
+type HTTPRegistrar struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPRegistrar creates a new HTTPRegistrar of the registration
+// service at the given URL, which is connected to over the given
+// Transport, e.g. the obfs4 transport of the Provider
+func NewHTTPRegistrar(registrationURL string, t transport.Transport) (*HTTPRegistrar, error) {
+	u, err := url.Parse(registrationURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported registration URL scheme %q", u.Scheme)
+	}
+	u.Path = Path
+	h := HTTPRegistrar{
+		url: u.String(),
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				// the environment's HTTP proxy would bypass the transport
+				Proxy: nil,
+				Dial: func(network, address string) (net.Conn, error) {
+					return t.Dial(address)
+				},
+			},
+		},
+	}
+	return &h, nil
+}
+
+// Register sends the registration request
+func (h *HTTPRegistrar) Register(ctx context.Context, request *Request) error {
+	form, err := request.form()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", h.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return ErrAccountExists
+	}
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	return &RefusedError{
+		Account: request.Account,
+		Status:  resp.Status,
+		Reason:  strings.TrimSpace(string(reason)),
+	}
+}
+
+// RefusedError is the error returned when the
+// Provider responds to a registration with an error
+type RefusedError struct {
+	Account string
+	Status  string
+	Reason  string
+}
+
+// Error returns the description of the error
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("registration of %s failed: %s: %s", e.Account, e.Status, e.Reason)
+}
+
+// Store persists the registration state
+// of the accounts, see storage.Store
+type Store interface {
+	RegisteredAt(accountName string) (time.Time, error)
+	SetRegistered(accountName string) error
+	RegistrationPending(accountName string) (bool, error)
+	SetRegistrationPending(accountName string, pending bool) error
+}
+
+// RegisterAccounts registers the configured accounts which have an
+// InvitationToken and weren't registered yet, linkKeys are their
+// link layer keys. The proxies must only be started once it succeeds.
+func RegisterAccounts(ctx context.Context, cfg *config.Config, linkKeys *config.AccountsMap, store Store) error {
+	for _, acct := range cfg.Account {
+		if acct.InvitationToken == "" {
+			continue
+		}
+		email := fmt.Sprintf("%s@%s", acct.Name, acct.Provider)
+		registered, err := store.RegisteredAt(email)
+		if err != nil {
+			return err
+		}
+		if !registered.IsZero() {
+			continue
+		}
+		privateKey, err := linkKeys.GetIdentityKey(email)
+		if err != nil {
+			return err
+		}
+		t, err := transport.New(cfg.ProviderTransport(acct.Provider))
+		if err != nil {
+			return err
+		}
+		registrar, err := NewHTTPRegistrar(acct.RegistrationURL, t)
+		if err != nil {
+			return fmt.Errorf("%s: %s", email, err)
+		}
+		err = register(ctx, registrar, store, &Request{
+			Account: email,
+			LinkKey: privateKey.PublicKey(),
+			Token:   acct.InvitationToken,
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", email, err)
+		}
+		log.Noticef("registered %s with it's Provider", email)
+	}
+	return nil
+}
+
+// register sends the given Request with the Registrar and records
+// the outcome, a registration is pending until it's response is
+// received
+func register(ctx context.Context, registrar Registrar, store Store, request *Request) error {
+	retry, err := store.RegistrationPending(request.Account)
+	if err != nil {
+		return err
+	}
+	err = store.SetRegistrationPending(request.Account, true)
+	if err != nil {
+		return err
+	}
+	err = registrar.Register(ctx, request)
+	if err == ErrAccountExists && retry {
+		// the account was created by the
+		// attempt whose response was lost
+		log.Noticef("%s was registered by a previous attempt", request.Account)
+		err = nil
+	}
+	if err == nil {
+		return store.SetRegistered(request.Account)
+	}
+	if _, ok := err.(*RefusedError); ok || err == ErrAccountExists {
+		pendingErr := store.SetRegistrationPending(request.Account, false)
+		if pendingErr != nil {
+			log.Errorf("failed to record the registration of %s: %s", request.Account, pendingErr)
+		}
+	}
+	return err
+}
+
+// linkKeyString returns the base64 encoding of the given link layer key
+func linkKeyString(key *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
@@ -0,0 +1,127 @@
+// registration_test.go - account registration tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package registration
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/transport"
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterAccounts(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "registration_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := storage.New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	err = store.CreateAccountBuckets([]string{"alice@acme.com", "bob@acme.com"})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	aliceKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair() error")
+	bobKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair() error")
+	linkKeys := config.AccountsMap{
+		"alice@acme.com": aliceKey,
+		"bob@acme.com":   bobKey,
+	}
+
+	forms := []url.Values{}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(Path, r.URL.Path)
+		err := r.ParseForm()
+		require.NoError(err, "unexpected ParseForm error")
+		forms = append(forms, r.PostForm)
+		if status == 0 {
+			// the response is lost
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(err, "unexpected Hijack error")
+			conn.Close()
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	cfg := &config.Config{
+		Account: []config.Account{
+			{Name: "alice", Provider: "acme.com", InvitationToken: "s3cret", RegistrationURL: server.URL},
+			// bob was registered out of band
+			{Name: "bob", Provider: "acme.com"},
+		},
+	}
+	register := func() error {
+		return RegisterAccounts(context.Background(), cfg, &linkKeys, store)
+	}
+	isRegistered := func() bool {
+		registered, err := store.RegisteredAt("alice@acme.com")
+		require.NoError(err, "unexpected RegisteredAt() error")
+		return !registered.IsZero()
+	}
+
+	status = http.StatusForbidden
+	require.Error(register(), "refused registration not detected")
+	require.False(isRegistered())
+	require.Len(forms, 1)
+	require.Equal(Version, forms[0].Get(versionField))
+	require.Equal(RegisterLinkCommand, forms[0].Get(commandField))
+	require.Equal("alice", forms[0].Get(userField))
+	require.Equal("s3cret", forms[0].Get(tokenField))
+	require.Equal(linkKeyString(aliceKey.PublicKey()), forms[0].Get(linkKeyField))
+
+	// the account of someone else can't be taken over
+	status = http.StatusConflict
+	require.Error(register(), "existing account not detected")
+	require.False(isRegistered())
+
+	// a conflict in response to the retry of a registration
+	// whose response was lost means it was registered
+	status = 0
+	require.Error(register(), "lost response not detected")
+	require.False(isRegistered())
+	status = http.StatusConflict
+	require.NoError(register(), "unexpected RegisterAccounts() error")
+	require.True(isRegistered())
+	require.Len(forms, 4)
+
+	// registered accounts aren't registered again
+	require.NoError(register(), "unexpected RegisterAccounts() error")
+	require.Len(forms, 4)
+
+	status = http.StatusOK
+	registrar, err := NewHTTPRegistrar(server.URL, &transport.TCP{})
+	require.NoError(err, "unexpected NewHTTPRegistrar() error")
+	err = registrar.Register(context.Background(), &Request{Account: "carol@acme.com", LinkKey: bobKey.PublicKey()})
+	require.NoError(err, "unexpected Register() error")
+	status = http.StatusConflict
+	err = registrar.Register(context.Background(), &Request{Account: "carol@acme.com", LinkKey: bobKey.PublicKey()})
+	require.Equal(ErrAccountExists, err)
+}
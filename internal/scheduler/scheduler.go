@@ -0,0 +1,153 @@
+// scheduler.go - mixnet client priority queue backed scheduler
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/core/queue"
+)
+
+// PriorityScheduler is a priority queue backed scheduler
+type PriorityScheduler struct {
+	queue       *queue.PriorityQueue
+	taskHandler func(interface{})
+	timer       clock.Timer
+
+	// clock is the source of time of the scheduler, the
+	// priorities are the durations since it's origin
+	clock  clock.Clock
+	origin time.Time
+
+	// granularity coalesces the tasks, see SetGranularity
+	granularity int64
+
+	// supervisor records the panics of the task handler
+	// as failures of the task named name, see SetSupervisor
+	supervisor *supervisor.Supervisor
+	name       string
+}
+
+// New creates a new PriorityScheduler given a taskHandler function
+// which is eventually responsible for dealing with the scheduled items
+func New(taskHandler func(interface{})) *PriorityScheduler {
+	s := PriorityScheduler{
+		queue:       queue.New(),
+		taskHandler: taskHandler,
+	}
+	s.SetClock(clock.Real)
+	return &s
+}
+
+// SetClock sets the Clock of the scheduler, e.g. a clock.Fake
+// in tests. It must be set before any task is added.
+func (s *PriorityScheduler) SetClock(c clock.Clock) {
+	s.clock = c
+	s.origin = c.Now()
+}
+
+// SetSupervisor sets the Supervisor the panics of the task handler
+// are recovered by and recorded as failures of the given name, the
+// following tasks are then still handled. It must be set before any
+// task is added.
+func (s *PriorityScheduler) SetSupervisor(sup *supervisor.Supervisor, name string) {
+	s.supervisor = sup
+	s.name = name
+}
+
+// now returns the current time of the scheduler's clock as the
+// duration since it's origin, which is monotonic for clock.Real
+func (s *PriorityScheduler) now() time.Duration {
+	return s.clock.Now().Sub(s.origin)
+}
+
+// run causes the lowest priority task
+// to be processed before scheduling
+// the handling of the next scheduled task
+func (s *PriorityScheduler) run() {
+	entry := s.queue.Pop()
+	s.handle(entry.Value)
+	s.schedule()
+}
+
+// handle calls the task handler with the given task
+func (s *PriorityScheduler) handle(task interface{}) {
+	if s.supervisor != nil {
+		defer s.supervisor.Recover(s.name)
+	}
+	s.taskHandler(task)
+}
+
+// schedule schedules the handling of the lowest
+// priority item. Queue priority is compared to
+// current monotime.
+func (s *PriorityScheduler) schedule() {
+	entry := s.queue.Peek()
+	if entry == nil {
+		return
+	}
+	now := s.now()
+	if time.Duration(entry.Priority) <= now {
+		s.timer = s.clock.AfterFunc(time.Duration(0), s.run)
+	} else {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.timer = s.clock.AfterFunc(time.Duration(entry.Priority)-now, s.run)
+	}
+}
+
+// SetGranularity causes the tasks added afterwards to be delayed
+// until the next multiple of the given granularity, so that the
+// tasks due within the same interval are handled together and the
+// host wakes up less often. Zero disables the coalescing.
+func (s *PriorityScheduler) SetGranularity(granularity time.Duration) {
+	atomic.StoreInt64(&s.granularity, int64(granularity))
+}
+
+// Add adds a task to the scheduler
+func (s *PriorityScheduler) Add(duration time.Duration, task interface{}) {
+	granularity := time.Duration(atomic.LoadInt64(&s.granularity))
+	now := s.now()
+	priority := now + coalesce(s.clock.Now().UnixNano(), duration, granularity)
+	s.queue.Enqueue(uint64(priority), task)
+	s.schedule()
+}
+
+// Coalesce returns the given delay extended so that it expires on
+// a multiple of the given granularity of the given Clock, the one
+// of the timer it delays, so that the delays of independent timers
+// expire together
+func Coalesce(c clock.Clock, delay, granularity time.Duration) time.Duration {
+	return coalesce(c.Now().UnixNano(), delay, granularity)
+}
+
+// coalesce returns the given delay extended so that it expires on
+// a multiple of the given granularity of a clock at the given time
+func coalesce(now int64, delay, granularity time.Duration) time.Duration {
+	if granularity <= 0 {
+		return delay
+	}
+	deadline := time.Duration(now) + delay
+	if remainder := deadline % granularity; remainder != 0 {
+		deadline += granularity - remainder
+	}
+	return deadline - time.Duration(now)
+}
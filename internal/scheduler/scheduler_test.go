@@ -0,0 +1,157 @@
+// scheduler_test.go - mixnet client scheduler tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/stretchr/testify/require"
+)
+
+type TestTask struct {
+	Value string
+	Delay time.Duration
+}
+
+func TestPrioritySchedulerBasics(t *testing.T) {
+	require := require.New(t)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	counter := 0
+	handler := func(payload interface{}) {
+		s, ok := payload.(string)
+		require.Equal(true, ok, "handler type assertion failure")
+		t.Logf("handler payload is %s\n", s)
+		counter += 1
+	}
+	s := New(handler)
+
+	testPlatter := []TestTask{
+		{
+			Value: "A reliable method of fighting with tanks are Molotov cocktails.",
+			Delay: time.Millisecond * 100,
+		},
+		{
+			Value: "Use the same means to destroy enemy armored vehicles that you would tanks.",
+			Delay: time.Millisecond * 100,
+		},
+		{
+			Value: `When you are even with an opponent, it is essential to keep thinking of
+stabbing him in the face with the tip of your sword in the intervals between the opponent's
+sword blows and your own sword blows.`,
+			Delay: time.Millisecond * 90,
+		},
+		{
+			Value: `Stabbing in the heart is used when fighting in a place where there is no
+room for slashing, either overhead or to the sides, so you stab the opponent.`,
+			Delay: time.Millisecond * 120,
+		},
+	}
+
+	for _, v := range testPlatter {
+		s.Add(v.Delay, v.Value)
+	}
+
+	time.AfterFunc(150*time.Millisecond, func() {
+		defer wg.Done()
+	})
+
+	wg.Wait()
+	require.Equal(0, s.queue.Len(), "queue size mismatch")
+	require.Equal(len(testPlatter), counter, "counter mismatch")
+}
+
+func TestCoalesce(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(time.Second, Coalesce(clock.Real, time.Second, 0))
+	granularity := 50 * time.Millisecond
+	for _, delay := range []time.Duration{0, time.Millisecond, 49 * time.Millisecond, time.Second} {
+		coalesced := Coalesce(clock.Real, delay, granularity)
+		require.True(coalesced >= delay, "delay %s was shortened to %s", delay, coalesced)
+		require.True(coalesced < delay+granularity, "delay %s was extended to %s", delay, coalesced)
+	}
+
+	// the delays expire on the multiples of the granularity of the given clock
+	c := clock.NewFake(time.Unix(1500000000, int64(10*time.Millisecond)))
+	require.Equal(40*time.Millisecond, Coalesce(c, 0, granularity))
+	require.Equal(90*time.Millisecond, Coalesce(c, 60*time.Millisecond, granularity))
+}
+
+func TestPrioritySchedulerFakeClock(t *testing.T) {
+	require := require.New(t)
+
+	// on the hour
+	c := clock.NewFake(time.Unix(1500001200, 0))
+	handled := []string{}
+	var s *PriorityScheduler
+	s = New(func(task interface{}) {
+		handled = append(handled, task.(string))
+		// a task may reschedule itself
+		if task.(string) == "hourly" && len(handled) < 4 {
+			s.Add(time.Hour, "hourly")
+		}
+	})
+	s.SetClock(c)
+	s.Add(90*time.Minute, "once")
+	s.Add(time.Hour, "hourly")
+
+	c.Advance(59 * time.Minute)
+	require.Empty(handled)
+	// hours pass in no time
+	c.Advance(10 * time.Hour)
+	require.Equal([]string{"hourly", "once", "hourly", "hourly"}, handled)
+	require.Equal(0, s.queue.Len())
+
+	// at 10:59 a task due in 30 seconds is delayed until 11:00
+	s.SetGranularity(time.Hour)
+	s.Add(30*time.Second, "coalesced")
+	c.Advance(30 * time.Second)
+	require.Equal(4, len(handled))
+	c.Advance(30 * time.Second)
+	require.Equal("coalesced", handled[4])
+}
+
+func TestPrioritySchedulerSupervisor(t *testing.T) {
+	require := require.New(t)
+
+	c := clock.NewFake(time.Unix(1500001200, 0))
+	sup := supervisor.New()
+	handled := []string{}
+	s := New(func(task interface{}) {
+		if task.(string) == "panic" {
+			panic("boom")
+		}
+		handled = append(handled, task.(string))
+	})
+	s.SetClock(c)
+	s.SetSupervisor(sup, "test")
+	s.Add(time.Minute, "panic")
+	s.Add(2*time.Minute, "next")
+
+	// the tasks following a panic are still handled
+	c.Advance(2 * time.Minute)
+	require.Equal([]string{"next"}, handled)
+	require.NoError(sup.Err())
+	sup.Halt()
+}
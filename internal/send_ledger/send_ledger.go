@@ -0,0 +1,391 @@
+// send_ledger.go - encrypted ledger of the sent messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package send_ledger keeps an opt-in, local only record of what was
+// sent, when and to whom, for users who must be able to account for
+// their correspondence. The ledger is entirely separate from the
+// transient egress queue: entries are appended to their own file, each
+// encrypted with a random ledger key which is itself sealed in a vault
+// with the user's passphrase. Wiping removes the ledger key first so
+// that the entries are unreadable even if the ledger file survives.
+package send_ledger
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/crypto/vault"
+	"github.com/katzenpost/client/internal/entropy"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// LedgerFileName is the name of the file holding the entries
+	LedgerFileName = "send_ledger"
+
+	// KeyFileName is the name of the vault file holding the ledger key
+	KeyFileName = "send_ledger.key.pem"
+
+	// keyVaultType is the PEM type of the ledger key vault
+	keyVaultType = "SEND LEDGER KEY"
+
+	// maxEntryLength is the maximum length of an encrypted entry
+	maxEntryLength = 1 << 16
+)
+
+// Entry records a sent message
+type Entry struct {
+	// Time is the time the message was submitted
+	Time time.Time
+	// Account is the e-mail address of the sending account
+	Account string
+	// Recipient is the e-mail address of the recipient
+	Recipient string
+	// MessageID is the hex encoded mixnet message ID, the
+	// same as the X-Mix-Message-ID of the delivery status
+	// notifications
+	MessageID string
+	// Subject is the subject of the message
+	Subject string
+	// Size is the size of the message in bytes
+	Size int
+}
+
+// Filter selects ledger entries, the zero Filter selects all of them
+type Filter struct {
+	// Account selects the entries of the given account
+	Account string
+	// Since selects the entries at or after the given time
+	Since time.Time
+	// Until selects the entries before the given time
+	Until time.Time
+}
+
+// match returns true if the entry is selected by the filter
+func (f *Filter) match(e *Entry) bool {
+	if f == nil {
+		return true
+	}
+	if f.Account != "" && f.Account != e.Account {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Ledger is an encrypted append only ledger of the sent messages
+type Ledger struct {
+	sync.Mutex
+
+	path string
+	key  [32]byte
+	// end is the length of the ledger file spanned by it's
+	// records, a torn last record lies beyond it, see records
+	end int64
+}
+
+// Open opens the ledger in the given directory, decrypting it's key
+// with the given passphrase. The ledger and it's key are created if
+// they don't exist yet.
+func Open(dir, passphrase string) (*Ledger, error) {
+	v, err := vault.New(keyVaultType, passphrase, filepath.Join(dir, KeyFileName), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	l := Ledger{
+		path: filepath.Join(dir, LedgerFileName),
+	}
+	key, err := v.Open()
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(l.path); statErr == nil {
+			return nil, errors.New("send ledger key is missing")
+		}
+		_, err = io.ReadFull(entropy.Reader, l.key[:])
+		if err != nil {
+			return nil, err
+		}
+		return &l, v.Seal(l.key[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != len(l.key) {
+		return nil, errors.New("invalid send ledger key")
+	}
+	copy(l.key[:], key)
+	_, l.end, err = l.records()
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Close forgets the ledger key
+func (l *Ledger) Close() {
+	l.Lock()
+	defer l.Unlock()
+	for i := range l.key {
+		l.key[i] = 0
+	}
+}
+
+// Record appends the given entry to the ledger
+func (l *Ledger) Record(e *Entry) error {
+	plaintext, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	nonce := [24]byte{}
+	_, err = io.ReadFull(entropy.Reader, nonce[:])
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	sealed := secretbox.Seal(nonce[:], plaintext, &nonce, &l.key)
+	if len(sealed) > maxEntryLength {
+		return errors.New("send ledger entry too long")
+	}
+	record := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(record, uint32(len(sealed)))
+	record = append(record, sealed...)
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// a torn last record is dropped, the new
+	// record would be unreadable behind it
+	err = f.Truncate(l.end)
+	if err == nil {
+		_, err = f.WriteAt(record, l.end)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		l.end += int64(len(record))
+	}
+	return err
+}
+
+// record is an entry as it's stored in the ledger file
+type record struct {
+	raw   []byte
+	entry *Entry
+}
+
+// records returns the records of the ledger file in the order they
+// were recorded and the length of the file they span, the lock must
+// be held. A torn last record, left behind by an interrupted Record,
+// is ignored: a truncated one, or one which fails to decrypt and ends
+// the file, or a garbled length shorter than the longest record.
+func (l *Ledger) records() ([]*record, int64, error) {
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return []*record{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	records := []*record{}
+	end := 0
+	for end < len(data) {
+		tail := data[end:]
+		if len(tail) < 4 {
+			break
+		}
+		length := int(binary.BigEndian.Uint32(tail))
+		if length > maxEntryLength || length < 24+secretbox.Overhead {
+			if len(tail) <= 4+maxEntryLength {
+				break
+			}
+			return nil, 0, errors.New("send ledger is corrupted")
+		}
+		if len(tail) < 4+length {
+			break
+		}
+		r := record{
+			raw:   tail[:4+length],
+			entry: new(Entry),
+		}
+		err = l.decrypt(tail[4:4+length], r.entry)
+		if err != nil {
+			if len(tail) == 4+length {
+				break
+			}
+			return nil, 0, err
+		}
+		records = append(records, &r)
+		end += 4 + length
+	}
+	return records, int64(end), nil
+}
+
+// decrypt decrypts the given sealed entry into e
+func (l *Ledger) decrypt(sealed []byte, e *Entry) error {
+	nonce := [24]byte{}
+	copy(nonce[:], sealed)
+	plaintext, ok := secretbox.Open(nil, sealed[24:], &nonce, &l.key)
+	if !ok {
+		return errors.New("send ledger entry authentication failed")
+	}
+	return json.Unmarshal(plaintext, e)
+}
+
+// Entries returns the entries selected by the given
+// filter in the order they were recorded
+func (l *Ledger) Entries(filter *Filter) ([]*Entry, error) {
+	l.Lock()
+	defer l.Unlock()
+	records, _, err := l.records()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	for _, r := range records {
+		if filter.match(r.entry) {
+			entries = append(entries, r.entry)
+		}
+	}
+	return entries, nil
+}
+
+// RemoveAccount removes the entries of the given account, e.g. once
+// it's removed from the client, the ledger file is atomically
+// replaced by one without them
+func (l *Ledger) RemoveAccount(account string) error {
+	l.Lock()
+	defer l.Unlock()
+	records, _, err := l.records()
+	if err != nil {
+		return err
+	}
+	kept := []byte{}
+	removed := 0
+	for _, r := range records {
+		if strings.EqualFold(r.entry.Account, account) {
+			removed++
+			continue
+		}
+		kept = append(kept, r.raw...)
+	}
+	if removed == 0 {
+		return nil
+	}
+	tmpPath := l.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(kept)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	l.end = int64(len(kept))
+	return nil
+}
+
+// ExportJSON writes the entries selected by the
+// given filter to w as a JSON array
+func (l *Ledger) ExportJSON(w io.Writer, filter *Filter) error {
+	entries, err := l.Entries(filter)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// ExportCSV writes the entries selected by the
+// given filter to w as CSV with a header row
+func (l *Ledger) ExportCSV(w io.Writer, filter *Filter) error {
+	entries, err := l.Entries(filter)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	err = writer.Write([]string{"time", "account", "recipient", "message_id", "subject", "size"})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = writer.Write([]string{
+			e.Time.UTC().Format(time.RFC3339),
+			csvField(e.Account),
+			csvField(e.Recipient),
+			csvField(e.MessageID),
+			csvField(e.Subject),
+			strconv.Itoa(e.Size),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvField neutralizes a field which a spreadsheet would evaluate as
+// a formula, one starting with =, +, -, @, a tab or a carriage return,
+// by prefixing it with a single quote
+func csvField(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+// Wipe destroys the ledger in the given directory, the passphrase
+// isn't needed. The key is removed first, so that the entries can't
+// be decrypted even if the ledger file can't be removed.
+func Wipe(dir string) error {
+	for _, name := range []string{KeyFileName, LedgerFileName} {
+		err := os.Remove(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
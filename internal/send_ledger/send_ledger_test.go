@@ -0,0 +1,179 @@
+// send_ledger_test.go - send ledger tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package send_ledger
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendLedger(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "send_ledger_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	passphrase := "correct horse battery staple"
+
+	l, err := Open(dir, passphrase)
+	require.NoError(err, "unexpected Open() error")
+	start := time.Date(2017, time.October, 1, 12, 0, 0, 0, time.UTC)
+	for i, account := range []string{"alice@acme.com", "bob@acme.com", "alice@acme.com"} {
+		err = l.Record(&Entry{
+			Time:      start.Add(time.Duration(i) * 24 * time.Hour),
+			Account:   account,
+			Recipient: "carol@nsa.gov",
+			MessageID: "00112233",
+			Subject:   "report, part 1",
+			Size:      1000 + i,
+		})
+		require.NoError(err, "unexpected Record() error")
+	}
+	l.Close()
+
+	_, err = Open(dir, "not the right passphrase")
+	require.Error(err, "the ledger was opened with the wrong passphrase")
+	l, err = Open(dir, passphrase)
+	require.NoError(err, "unexpected Open() error")
+	defer l.Close()
+
+	entries, err := l.Entries(nil)
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 3)
+	entries, err = l.Entries(&Filter{Account: "alice@acme.com", Since: start.Add(time.Hour)})
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 1)
+	require.Equal(1002, entries[0].Size)
+	entries, err = l.Entries(&Filter{Until: start.Add(24 * time.Hour)})
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 1)
+	require.Equal("alice@acme.com", entries[0].Account)
+
+	buf := new(bytes.Buffer)
+	err = l.ExportCSV(buf, &Filter{Account: "bob@acme.com"})
+	require.NoError(err, "unexpected ExportCSV() error")
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(err, "unexpected ReadAll error")
+	require.Equal([][]string{
+		{"time", "account", "recipient", "message_id", "subject", "size"},
+		{"2017-10-02T12:00:00Z", "bob@acme.com", "carol@nsa.gov", "00112233", "report, part 1", "1001"},
+	}, records)
+
+	buf.Reset()
+	err = l.ExportJSON(buf, nil)
+	require.NoError(err, "unexpected ExportJSON() error")
+	exported := []*Entry{}
+	err = json.Unmarshal(buf.Bytes(), &exported)
+	require.NoError(err, "unexpected Unmarshal error")
+	require.Len(exported, 3)
+
+	// an interrupted Record leaves a truncated entry behind
+	f, err := os.OpenFile(filepath.Join(dir, LedgerFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(err, "unexpected OpenFile error")
+	_, err = f.Write([]byte{0, 0, 1, 0, 42})
+	require.NoError(err, "unexpected Write error")
+	entries, err = l.Entries(nil)
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 3)
+	l.Close()
+
+	// as is a complete one which fails to decrypt
+	info, err := f.Stat()
+	require.NoError(err, "unexpected Stat error")
+	err = f.Truncate(info.Size() - 5)
+	require.NoError(err, "unexpected Truncate error")
+	_, err = f.Write(append([]byte{0, 0, 0, 64}, make([]byte, 64)...))
+	require.NoError(err, "unexpected Write error")
+	f.Close()
+	l, err = Open(dir, passphrase)
+	require.NoError(err, "unexpected Open() error")
+	defer l.Close()
+	entries, err = l.Entries(nil)
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 3)
+
+	// the torn record is dropped by the next Record
+	err = l.Record(&Entry{
+		Time:      start.Add(72 * time.Hour),
+		Account:   "bob@acme.com",
+		Recipient: "=HYPERLINK(\"http://evil.com\")",
+		MessageID: "44556677",
+		Subject:   "@SUM(A1)",
+		Size:      2000,
+	})
+	require.NoError(err, "unexpected Record() error")
+	entries, err = l.Entries(nil)
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 4)
+
+	// the fields evaluated by a spreadsheet are neutralized
+	buf.Reset()
+	err = l.ExportCSV(buf, &Filter{Since: start.Add(72 * time.Hour)})
+	require.NoError(err, "unexpected ExportCSV() error")
+	records, err = csv.NewReader(buf).ReadAll()
+	require.NoError(err, "unexpected ReadAll error")
+	require.Len(records, 2)
+	require.Equal("'=HYPERLINK(\"http://evil.com\")", records[1][2])
+	require.Equal("'@SUM(A1)", records[1][4])
+
+	// removing an account drops it's entries
+	err = l.RemoveAccount("Alice@acme.com")
+	require.NoError(err, "unexpected RemoveAccount() error")
+	entries, err = l.Entries(nil)
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 2)
+	require.Equal("bob@acme.com", entries[0].Account)
+	err = l.Record(&Entry{Account: "bob@acme.com"})
+	require.NoError(err, "unexpected Record() error")
+	entries, err = l.Entries(nil)
+	require.NoError(err, "unexpected Entries() error")
+	require.Len(entries, 3)
+
+	err = Wipe(dir)
+	require.NoError(err, "unexpected Wipe() error")
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err, "unexpected ReadDir error")
+	require.Len(files, 0)
+}
+
+func TestMissingKey(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "send_ledger_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	passphrase := "correct horse battery staple"
+
+	l, err := Open(dir, passphrase)
+	require.NoError(err, "unexpected Open() error")
+	err = l.Record(&Entry{Account: "alice@acme.com"})
+	require.NoError(err, "unexpected Record() error")
+	l.Close()
+
+	err = os.Remove(filepath.Join(dir, KeyFileName))
+	require.NoError(err, "unexpected Remove error")
+	_, err = Open(dir, passphrase)
+	require.Error(err, "a new key was created for an existing ledger")
+}
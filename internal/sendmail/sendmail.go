@@ -0,0 +1,305 @@
+// sendmail.go - sendmail compatible message injection
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sendmail implements the command line interface of
+// /usr/sbin/sendmail on top of our SMTP submission proxy so that
+// cron jobs, git send-email and mail clients configured to use
+// sendmail can submit messages into the mix network.
+package sendmail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"github.com/katzenpost/client/internal/autoconfig"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/pelletier/go-toml"
+)
+
+// Options are the parsed sendmail command line arguments
+type Options struct {
+	// Sender is the envelope sender set with -f, if empty
+	// the address of the From header is used
+	Sender string
+	// ReadRecipients is set with -t, the recipients are read
+	// from the To, Cc and Bcc headers of the message
+	ReadRecipients bool
+	// IgnoreDots is set with -i or -oi, a line with a single dot
+	// doesn't terminate the message read from the input
+	IgnoreDots bool
+	// Recipients are the recipients given as arguments
+	Recipients []string
+	// Address is the SMTP proxy address set with -S
+	Address string
+	// AutoConfigFile is the auto-configuration file set with
+	// -C which is used to find the SMTP proxy address
+	AutoConfigFile string
+	// Password is the proxy password of the sending account, it's
+	// read from the PasswordEnv environment variable by mixclient-sendmail
+	Password string
+}
+
+// PasswordEnv is the environment variable holding the proxy
+// password the sender authenticates to the SMTP proxy with,
+// it's not a command line option so that it isn't visible
+// to the other users of the system
+const PasswordEnv = "MIXCLIENT_PROXY_PASSWORD"
+
+// ParseArgs parses the sendmail command line arguments, excluding
+// the program name. Unsupported sendmail options which don't affect
+// the submission such as -F, -o and -B are accepted and ignored.
+func ParseArgs(args []string) (*Options, error) {
+	o := Options{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			o.Recipients = append(o.Recipients, args[i:]...)
+			break
+		}
+		if arg == "--" {
+			o.Recipients = append(o.Recipients, args[i+1:]...)
+			break
+		}
+		// options taking a value accept it both
+		// attached and as the next argument
+		value := func() (string, error) {
+			if len(arg) > 2 {
+				return arg[2:], nil
+			}
+			i++
+			if i == len(args) {
+				return "", fmt.Errorf("option %s requires an argument", arg)
+			}
+			return args[i], nil
+		}
+		var err error
+		switch arg[1] {
+		case 'f', 'r':
+			o.Sender, err = value()
+		case 'S':
+			o.Address, err = value()
+		case 'C':
+			o.AutoConfigFile, err = value()
+		case 'F', 'B', 'N', 'R', 'V', 'X', 'h', 'p', 'q':
+			_, err = value()
+		case 't':
+			o.ReadRecipients = true
+		case 'i':
+			o.IgnoreDots = true
+		case 'o':
+			if arg == "-oi" {
+				o.IgnoreDots = true
+			}
+		case 'b':
+			if arg != "-bm" {
+				return nil, fmt.Errorf("unsupported mode %s", arg)
+			}
+		case 'v', 'U', 'm', 'n', 'G':
+		default:
+			return nil, fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &o, nil
+}
+
+// readMessage reads the message from the input which is
+// terminated by a line with a single dot unless ignoreDots is set
+func readMessage(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return ioutil.ReadAll(r)
+	}
+	message := new(bytes.Buffer)
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			return message.Bytes(), nil
+		}
+		message.WriteString(line)
+		if err == io.EOF {
+			return message.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// removeHeader removes the given header field
+// including it's continuation lines
+func removeHeader(message []byte, field string) []byte {
+	out := new(bytes.Buffer)
+	prefix := strings.ToLower(field) + ":"
+	lines := bytes.SplitAfter(message, []byte("\n"))
+	removing := false
+	for i, line := range lines {
+		trimmed := strings.TrimRight(string(line), "\r\n")
+		if trimmed == "" {
+			// end of the header
+			for _, l := range lines[i:] {
+				out.Write(l)
+			}
+			break
+		}
+		if removing && (line[0] == ' ' || line[0] == '\t') {
+			continue
+		}
+		removing = strings.HasPrefix(strings.ToLower(trimmed), prefix)
+		if !removing {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
+
+// headerAddresses returns the addresses of the given header fields
+func headerAddresses(header mail.Header, fields ...string) ([]string, error) {
+	addresses := []string{}
+	for _, field := range fields {
+		if header.Get(field) == "" {
+			continue
+		}
+		list, err := header.AddressList(field)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range list {
+			addresses = append(addresses, a.Address)
+		}
+	}
+	return addresses, nil
+}
+
+// smtpAddress returns the address of the SMTP proxy
+func (o *Options) smtpAddress() (string, error) {
+	if o.Address != "" {
+		return o.Address, nil
+	}
+	if o.AutoConfigFile == "" {
+		return constants.DefaultSMTPAddress, nil
+	}
+	data, err := ioutil.ReadFile(o.AutoConfigFile)
+	if err != nil {
+		return "", err
+	}
+	a := autoconfig.AutoConfig{}
+	err = toml.Unmarshal(data, &a)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(a.SMTP.Host, strconv.Itoa(a.SMTP.Port)), nil
+}
+
+// submit submits the message to a single recipient, our
+// SMTP proxy only accepts one recipient per transaction.
+// The sender authenticates with the given password if any.
+func submit(address, sender, password, recipient string, message []byte) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.Dial(address)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if password != "" {
+		err = c.Auth(smtp.PlainAuth("", sender, password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(sender)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(recipient)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(message)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Submit reads a message from the given input and
+// submits it to each of it's recipients
+func Submit(o *Options, r io.Reader) error {
+	message, err := readMessage(r, o.IgnoreDots)
+	if err != nil {
+		return err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	recipients := o.Recipients
+	if o.ReadRecipients {
+		headerRecipients, err := headerAddresses(m.Header, "To", "Cc", "Bcc")
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, headerRecipients...)
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipients given")
+	}
+	sender := o.Sender
+	if sender == "" {
+		from, err := headerAddresses(m.Header, "From")
+		if err != nil {
+			return err
+		}
+		if len(from) == 0 {
+			return errors.New("no sender given")
+		}
+		sender = from[0]
+	}
+	message = removeHeader(message, "Bcc")
+	address, err := o.smtpAddress()
+	if err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		err = submit(address, sender, o.Password, recipient, message)
+		if err != nil {
+			return fmt.Errorf("failed to submit message to %s: %s", recipient, err)
+		}
+	}
+	return nil
+}
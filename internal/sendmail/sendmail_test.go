@@ -0,0 +1,130 @@
+// sendmail_test.go - sendmail compatible message injection tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sendmail
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type transaction struct {
+	auth      string
+	sender    string
+	recipient string
+	data      string
+}
+
+// serveSMTP is a minimal SMTP server which
+// records the transactions of each connection
+func serveSMTP(listener net.Listener, transactions chan<- transaction) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 localhost ESMTP")
+		t := transaction{}
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				break
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO "):
+				c.PrintfLine("250-localhost")
+				c.PrintfLine("250 AUTH PLAIN")
+				continue
+			case strings.HasPrefix(line, "AUTH PLAIN "):
+				response, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+				t.auth = string(response)
+				c.PrintfLine("235 ok")
+				continue
+			case strings.HasPrefix(line, "MAIL FROM:"):
+				t.sender = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				t.recipient = strings.Trim(line[len("RCPT TO:"):], "<>")
+			case line == "DATA":
+				c.PrintfLine("354 go ahead")
+				data, _ := c.ReadDotBytes()
+				t.data = string(data)
+				transactions <- t
+			case line == "QUIT":
+				c.PrintfLine("221 bye")
+				c.Close()
+				continue
+			}
+			c.PrintfLine("250 ok")
+		}
+		c.Close()
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	require := require.New(t)
+
+	o, err := ParseArgs([]string{"-oi", "-f", "alice@acme.com", "-FAlice", "-t", "bob@nsa.gov"})
+	require.NoError(err, "unexpected ParseArgs() error")
+	require.Equal("alice@acme.com", o.Sender)
+	require.True(o.IgnoreDots)
+	require.True(o.ReadRecipients)
+	require.Equal([]string{"bob@nsa.gov"}, o.Recipients)
+
+	_, err = ParseArgs([]string{"-bp"})
+	require.Error(err, "expected ParseArgs() error for unsupported mode")
+	_, err = ParseArgs([]string{"-f"})
+	require.Error(err, "expected ParseArgs() error for missing argument")
+}
+
+func TestSubmit(t *testing.T) {
+	require := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "unexpected Listen error")
+	defer listener.Close()
+	transactions := make(chan transaction, 3)
+	go serveSMTP(listener, transactions)
+
+	o, err := ParseArgs([]string{"-t", "-S", listener.Addr().String()})
+	require.NoError(err, "unexpected ParseArgs() error")
+	message := "From: alice@acme.com\nTo: bob@nsa.gov\nBcc: carol@fsb.ru,\n  dave@acme.com\nSubject: hi\n\nhello\n.\nignored\n"
+	err = Submit(o, strings.NewReader(message))
+	require.NoError(err, "unexpected Submit() error")
+
+	recipients := []string{"bob@nsa.gov", "carol@fsb.ru", "dave@acme.com"}
+	for _, recipient := range recipients {
+		tr := <-transactions
+		require.Equal("alice@acme.com", tr.sender)
+		require.Equal(recipient, tr.recipient)
+		require.Equal("From: alice@acme.com\nTo: bob@nsa.gov\nSubject: hi\n\nhello\n", tr.data)
+		require.Empty(tr.auth)
+	}
+
+	// the sender authenticates with the proxy password
+	o.Password = "teatime475"
+	err = Submit(o, strings.NewReader(message))
+	require.NoError(err, "unexpected Submit() error")
+	for range recipients {
+		tr := <-transactions
+		require.Equal("\x00alice@acme.com\x00teatime475", tr.auth)
+	}
+}
@@ -0,0 +1,65 @@
+// launchd.go - launchd agent property list
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"path/filepath"
+)
+
+// launchAgentPath returns the path of the property list
+// of the launchd agent of the given name
+func launchAgentPath(home, name string) string {
+	return filepath.Join(home, "Library", "LaunchAgents", name+".plist")
+}
+
+// launchdPlist returns the property list of the launchd agent
+// which starts the daemon at login and restarts it if it exits
+func launchdPlist(c *Config) ([]byte, error) {
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	writeString := func(indent, s string) error {
+		b.WriteString(indent + "<string>")
+		err := xml.EscapeText(b, []byte(s))
+		b.WriteString("</string>\n")
+		return err
+	}
+	b.WriteString("\t<key>Label</key>\n")
+	err = writeString("\t", c.name())
+	if err != nil {
+		return nil, err
+	}
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{c.Executable}, c.Args...) {
+		err = writeString("\t\t", arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.WriteString("\t</array>\n")
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+// launchd_test.go - launchd agent property list tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaunchdPlist(t *testing.T) {
+	require := require.New(t)
+
+	_, err := launchdPlist(&Config{})
+	require.Error(err, "missing executable not detected")
+
+	plist, err := launchdPlist(&Config{
+		Executable: "/usr/local/bin/mixclient",
+		Args:       []string{"-c", "/Users/alice/Library/Application Support/mixclient/a&b.toml"},
+	})
+	require.NoError(err, "launchdPlist failed")
+	require.Contains(string(plist), "<string>mixclient</string>")
+	require.Contains(string(plist), "a&amp;b.toml")
+
+	// the property list must be well formed
+	d := xml.NewDecoder(strings.NewReader(string(plist)))
+	d.Strict = true
+	for {
+		_, err := d.Token()
+		if err != nil {
+			require.Equal(io.EOF, err)
+			break
+		}
+	}
+	require.Equal("/Users/alice/Library/LaunchAgents/mixclient.plist", launchAgentPath("/Users/alice", DefaultName))
+}
@@ -0,0 +1,88 @@
+// service.go - service lifecycle integration
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package service runs the client daemon under the service manager
+// of the operating system instead of a foreground terminal: as a
+// Windows service, as a launchd agent on macOS and, with package
+// systemd, as a systemd service on Linux. Install and Uninstall
+// register the daemon with the service manager, see
+// cmd/mixclient-service.
+package service
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// DefaultName is the default name of the installed service
+const DefaultName = "mixclient"
+
+// ErrUnsupported is the error returned by Install and Uninstall on
+// the operating systems whose service manager isn't supported
+var ErrUnsupported = errors.New("service installation isn't supported on this platform, see package systemd")
+
+// Config describes the installed service
+type Config struct {
+	// Name is the name of the service, DefaultName if empty.
+	// On macOS it's the label of the launchd agent.
+	Name string
+	// DisplayName is the human readable name of the service
+	DisplayName string
+	// Description describes the service
+	Description string
+	// Executable is the absolute path of the daemon binary
+	Executable string
+	// Args are the command line arguments of the daemon
+	Args []string
+}
+
+// name returns the name of the service
+func (c *Config) name() string {
+	if c.Name == "" {
+		return DefaultName
+	}
+	return c.Name
+}
+
+// validate returns an error if the configuration is incomplete
+func (c *Config) validate() error {
+	if c.Executable == "" {
+		return errors.New("service executable not set")
+	}
+	return nil
+}
+
+// runForeground calls start, waits for an interrupt or termination
+// signal and calls stop
+func runForeground(start func() error, stop func()) error {
+	err := start()
+	if err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	s := <-signals
+	log.Noticef("received %s, stopping", s)
+	stop()
+	return nil
+}
@@ -0,0 +1,86 @@
+// service_darwin.go - macOS launchd agent integration
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build darwin
+// +build darwin
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Run calls start, runs until launchd or the user stops
+// the daemon with a termination signal and calls stop
+func Run(name string, start func() error, stop func()) error {
+	return runForeground(start, stop)
+}
+
+// Install writes the launchd agent property list of the daemon
+// and loads it, the daemon is then started at every login
+func Install(c *Config) error {
+	plist, err := launchdPlist(c)
+	if err != nil {
+		return err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	path := launchAgentPath(home, c.name())
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("launchd agent %s already exists", path)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, plist, 0644)
+	if err != nil {
+		return err
+	}
+	return launchctl("load", "-w", path)
+}
+
+// Uninstall unloads the launchd agent and removes it's property list
+func Uninstall(c *Config) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	path := launchAgentPath(home, c.name())
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("launchd agent %s isn't installed", path)
+	}
+	err = launchctl("unload", "-w", path)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// launchctl runs launchctl with the given arguments
+func launchctl(args ...string) error {
+	output, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %s: %s", args[0], err, output)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+// service_other.go - service lifecycle on other platforms
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package service
+
+// Run calls start, runs until the daemon is
+// interrupted or terminated and calls stop
+func Run(name string, start func() error, stop func()) error {
+	return runForeground(start, stop)
+}
+
+// Install returns ErrUnsupported, systemd units are installed
+// by the distribution packages, see package systemd
+func Install(c *Config) error {
+	return ErrUnsupported
+}
+
+// Uninstall returns ErrUnsupported
+func Uninstall(c *Config) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,137 @@
+// service_windows.go - Windows service integration
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build windows
+// +build windows
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// stopTimeout is how long Uninstall waits for the service to stop
+const stopTimeout = 30 * time.Second
+
+// handler is the service control handler of the daemon
+type handler struct {
+	start    func() error
+	stop     func()
+	startErr error
+}
+
+// Execute runs the daemon until the service control
+// manager asks it to stop or the system shuts down
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	h.startErr = h.start()
+	if h.startErr != nil {
+		log.Errorf("failed to start the service: %s", h.startErr)
+		return true, 1
+	}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Notice("service stop requested")
+			status <- svc.Status{State: svc.StopPending}
+			h.stop()
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// Run calls start and runs until the service control manager stops
+// the service, then it calls stop. When the daemon isn't started by
+// the service control manager it runs in the foreground until it's
+// interrupted instead.
+func Run(name string, start func() error, stop func()) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return runForeground(start, stop)
+	}
+	h := handler{start: start, stop: stop}
+	err = svc.Run(name, &h)
+	if err != nil {
+		return err
+	}
+	return h.startErr
+}
+
+// Install registers the daemon as an automatically
+// started Windows service
+func Install(c *Config) error {
+	err := c.validate()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(c.name())
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", c.name())
+	}
+	s, err = m.CreateService(c.name(), c.Executable, mgr.Config{
+		DisplayName: c.DisplayName,
+		Description: c.Description,
+		StartType:   mgr.StartAutomatic,
+	}, c.Args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// Uninstall stops and removes the Windows service
+func Uninstall(c *Config) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(c.name())
+	if err != nil {
+		return fmt.Errorf("service %s isn't installed", c.name())
+	}
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	if err == nil {
+		deadline := time.Now().Add(stopTimeout)
+		for status.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+			status, err = s.Query()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.Delete()
+}
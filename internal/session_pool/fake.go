@@ -0,0 +1,211 @@
+// fake.go - in-memory Provider session
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package session_pool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// ErrNothingToReceive is returned by FakeSession's RecvCommand when
+// no command was requested, a real session would block, see SetBlocking
+var ErrNothingToReceive = errors.New("fake session: nothing to receive")
+
+// FakeSession is an in-memory wire.SessionInterface which plays the
+// Provider side of the client protocol without sockets or handshakes,
+// so that the send, receive and ACK logic can be unit tested quickly.
+// The Sphinx packets sent are recorded, and each RetrieveMessage is
+// answered with the next delivered message or ACK, or MessageEmpty.
+// GetConsensus isn't answered, the consensus can be Pushed instead.
+type FakeSession struct {
+	sync.Mutex
+
+	sent      [][]byte
+	queue     []commands.Command
+	responses []commands.Command
+	err       error
+	closed    bool
+	blocking  bool
+	cond      *sync.Cond
+}
+
+// NewFakeSession creates a new FakeSession
+func NewFakeSession() *FakeSession {
+	f := &FakeSession{}
+	f.cond = sync.NewCond(&f.Mutex)
+	return f
+}
+
+// Initialize does nothing, there is no handshake
+func (f *FakeSession) Initialize(conn net.Conn) error {
+	return nil
+}
+
+// SendCommand records the sent Sphinx packets
+// and answers the message retrievals
+func (f *FakeSession) SendCommand(cmd commands.Command) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if f.closed {
+		return errors.New("fake session: closed")
+	}
+	switch c := cmd.(type) {
+	case *commands.SendPacket:
+		f.sent = append(f.sent, c.SphinxPacket)
+	case commands.SendPacket:
+		f.sent = append(f.sent, c.SphinxPacket)
+	case *commands.RetrieveMessage:
+		f.retrieve(c.Sequence)
+	case commands.RetrieveMessage:
+		f.retrieve(c.Sequence)
+	case commands.NoOp, *commands.NoOp:
+	case commands.GetConsensus, *commands.GetConsensus:
+	default:
+		return fmt.Errorf("fake session: unexpected command %T", cmd)
+	}
+	return nil
+}
+
+// retrieve queues the response to a RetrieveMessage command
+func (f *FakeSession) retrieve(sequence uint32) {
+	if len(f.queue) == 0 {
+		f.responses = append(f.responses, commands.MessageEmpty{Sequence: sequence})
+		f.cond.Broadcast()
+		return
+	}
+	hint := len(f.queue) - 1
+	if hint > 255 {
+		hint = 255
+	}
+	switch c := f.queue[0].(type) {
+	case commands.Message:
+		c.Sequence, c.QueueSizeHint = sequence, uint8(hint)
+		f.responses = append(f.responses, c)
+	case commands.MessageACK:
+		c.Sequence, c.QueueSizeHint = sequence, uint8(hint)
+		f.responses = append(f.responses, c)
+	}
+	f.queue = f.queue[1:]
+	f.cond.Broadcast()
+}
+
+// RecvCommand returns the responses to the commands sent,
+// in order, or ErrNothingToReceive
+func (f *FakeSession) RecvCommand() (commands.Command, error) {
+	f.Lock()
+	defer f.Unlock()
+	for f.blocking && f.err == nil && !f.closed && len(f.responses) == 0 {
+		f.cond.Wait()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.responses) == 0 {
+		if f.closed {
+			return nil, errors.New("fake session: closed")
+		}
+		return nil, ErrNothingToReceive
+	}
+	cmd := f.responses[0]
+	f.responses = f.responses[1:]
+	return cmd, nil
+}
+
+// Close closes the session, subsequent commands fail
+func (f *FakeSession) Close() {
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+}
+
+// PeerCredentials returns nil, the Provider isn't authenticated
+func (f *FakeSession) PeerCredentials() *wire.PeerCredentials {
+	return nil
+}
+
+// ClockSkew returns zero
+func (f *FakeSession) ClockSkew() time.Duration {
+	return 0
+}
+
+// Deliver queues a message payload for retrieval
+func (f *FakeSession) Deliver(payload []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.queue = append(f.queue, commands.Message{Payload: payload})
+}
+
+// DeliverACK queues an ACK of the given SURB ID for retrieval
+func (f *FakeSession) DeliverACK(id [constants.SURBIDLength]byte, payload []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.queue = append(f.queue, commands.MessageACK{ID: id, Payload: payload})
+}
+
+// Queued returns the number of messages and
+// ACKs waiting to be retrieved
+func (f *FakeSession) Queued() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.queue)
+}
+
+// Sent returns the Sphinx packets sent so far
+func (f *FakeSession) Sent() [][]byte {
+	f.Lock()
+	defer f.Unlock()
+	return append([][]byte{}, f.sent...)
+}
+
+// SetError makes all subsequent commands fail with the given
+// error to simulate a lost link, nil restores the session
+func (f *FakeSession) SetError(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.err = err
+	f.cond.Broadcast()
+}
+
+// SetBlocking makes RecvCommand wait for a command to be received,
+// like a real session, rather than return ErrNothingToReceive,
+// so that the session can be read continuously by a Mux
+func (f *FakeSession) SetBlocking(blocking bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.blocking = blocking
+	f.cond.Broadcast()
+}
+
+// Push queues a command which is received
+// without being requested, e.g. a Disconnect
+func (f *FakeSession) Push(cmd commands.Command) {
+	f.Lock()
+	defer f.Unlock()
+	f.responses = append(f.responses, cmd)
+	f.cond.Broadcast()
+}
@@ -0,0 +1,72 @@
+// fake_test.go - in-memory Provider session tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package session_pool
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeSession(t *testing.T) {
+	require := require.New(t)
+
+	var session wire.SessionInterface = NewFakeSession()
+	fake := session.(*FakeSession)
+
+	err := session.SendCommand(&commands.SendPacket{SphinxPacket: []byte("packet")})
+	require.NoError(err, "unexpected SendCommand() error")
+	require.Equal([][]byte{[]byte("packet")}, fake.Sent())
+
+	_, err = session.RecvCommand()
+	require.Equal(ErrNothingToReceive, err)
+
+	id := [constants.SURBIDLength]byte{1}
+	fake.Deliver([]byte("hello"))
+	fake.DeliverACK(id, []byte{0})
+	err = session.SendCommand(commands.RetrieveMessage{Sequence: 0})
+	require.NoError(err, "unexpected SendCommand() error")
+	cmd, err := session.RecvCommand()
+	require.NoError(err, "unexpected RecvCommand() error")
+	require.Equal(commands.Message{QueueSizeHint: 1, Sequence: 0, Payload: []byte("hello")}, cmd)
+	err = session.SendCommand(commands.RetrieveMessage{Sequence: 1})
+	require.NoError(err, "unexpected SendCommand() error")
+	cmd, err = session.RecvCommand()
+	require.NoError(err, "unexpected RecvCommand() error")
+	ack, ok := cmd.(commands.MessageACK)
+	require.True(ok, "expected a MessageACK")
+	require.Equal(id, ack.ID)
+	require.Equal(uint32(1), ack.Sequence)
+	err = session.SendCommand(commands.RetrieveMessage{Sequence: 2})
+	require.NoError(err, "unexpected SendCommand() error")
+	cmd, err = session.RecvCommand()
+	require.NoError(err, "unexpected RecvCommand() error")
+	require.Equal(commands.MessageEmpty{Sequence: 2}, cmd)
+
+	lost := errors.New("link lost")
+	fake.SetError(lost)
+	err = session.SendCommand(commands.RetrieveMessage{Sequence: 3})
+	require.Equal(lost, err)
+	fake.SetError(nil)
+	session.Close()
+	err = session.SendCommand(commands.NoOp{})
+	require.Error(err, "closed session accepted a command")
+}
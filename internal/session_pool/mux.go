@@ -0,0 +1,448 @@
+// mux.go - wire protocol session multiplexer
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package session_pool
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+var (
+	// ErrMuxHalted is returned when sending with a halted Mux
+	ErrMuxHalted = errors.New("session multiplexer halted")
+
+	// ErrMuxTimeout is returned by Request when the
+	// Provider doesn't respond within the timeout
+	ErrMuxTimeout = errors.New("session multiplexer: timed out waiting for the response")
+)
+
+// Inbound is a command received by a Mux,
+// or the error which ended it's reception
+type Inbound struct {
+	Command commands.Command
+	Err     error
+}
+
+// outbound is a command queued for sending
+type outbound struct {
+	cmd   commands.Command
+	errCh chan error
+}
+
+// callKey correlates the commands answered by the Provider
+// with their responses: retrievals by their sequence number,
+// consensus requests by the order they were sent in
+type callKey struct {
+	kind     string
+	sequence uint32
+}
+
+// call is a command awaiting it's response
+type call struct {
+	respCh chan commands.Command
+
+	// abandoned is set once the request timed out, it's
+	// response is then discarded when it's received
+	abandoned bool
+}
+
+// Mux owns a Provider session: the commands of concurrent senders
+// are written in turn by a single writer, and a single reader receives
+// the commands of the Provider. The responses are returned to the
+// Requests they answer, and the commands the Provider pushes are
+// dispatched to the channels registered for their type. Sending
+// therefore never waits for a response to be received, so the SMTP
+// submission and the message retrieval don't block each other.
+type Mux struct {
+	sync.Mutex
+
+	session  wire.SessionInterface
+	handlers map[reflect.Type][]chan<- Inbound
+	calls    map[callKey][]*call
+	outCh    chan *outbound
+	haltCh   chan struct{}
+	haltOnce sync.Once
+	wg       sync.WaitGroup
+
+	// err is the reception error which halted the Mux
+	err error
+
+	// supervisor runs the writer and the reader, see SetSupervisor
+	supervisor *supervisor.Supervisor
+}
+
+// NewMux creates a new Mux of the given session,
+// which must not be used directly afterwards
+func NewMux(session wire.SessionInterface) *Mux {
+	return &Mux{
+		session:  session,
+		handlers: make(map[reflect.Type][]chan<- Inbound),
+		calls:    make(map[callKey][]*call),
+		outCh:    make(chan *outbound),
+		haltCh:   make(chan struct{}),
+	}
+}
+
+// commandType returns the type handlers of
+// the given command are registered for
+func commandType(cmd commands.Command) reflect.Type {
+	t := reflect.TypeOf(cmd)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// requestKey returns the key correlating the given command with
+// it's response, false if the Provider doesn't answer it
+func requestKey(cmd commands.Command) (callKey, bool) {
+	switch c := cmd.(type) {
+	case commands.RetrieveMessage:
+		return callKey{"retrieve", c.Sequence}, true
+	case *commands.RetrieveMessage:
+		return callKey{"retrieve", c.Sequence}, true
+	case commands.GetConsensus, *commands.GetConsensus:
+		return callKey{kind: "consensus"}, true
+	}
+	return callKey{}, false
+}
+
+// responseKey returns the key correlating the given received
+// command with it's request, false if it isn't a response
+func responseKey(cmd commands.Command) (callKey, bool) {
+	switch c := cmd.(type) {
+	case commands.Message:
+		return callKey{"retrieve", c.Sequence}, true
+	case *commands.Message:
+		return callKey{"retrieve", c.Sequence}, true
+	case commands.MessageACK:
+		return callKey{"retrieve", c.Sequence}, true
+	case *commands.MessageACK:
+		return callKey{"retrieve", c.Sequence}, true
+	case commands.MessageEmpty:
+		return callKey{"retrieve", c.Sequence}, true
+	case *commands.MessageEmpty:
+		return callKey{"retrieve", c.Sequence}, true
+	case commands.Consensus, *commands.Consensus:
+		return callKey{kind: "consensus"}, true
+	}
+	return callKey{}, false
+}
+
+// Handle registers the channel the commands pushed by the Provider
+// of the same type as cmd are dispatched to, e.g.
+// Handle(commands.Disconnect{}, ch). The error which ends the
+// reception is dispatched to every registered channel.
+func (m *Mux) Handle(cmd commands.Command, ch chan<- Inbound) {
+	m.Lock()
+	defer m.Unlock()
+	t := commandType(cmd)
+	m.handlers[t] = append(m.handlers[t], ch)
+}
+
+// SetSupervisor sets the Supervisor which runs the writer and
+// the reader and records their panics, it must be set before Start.
+// A panic halts the Mux, the command being written or received is
+// lost, so that the pending Sends and Requests fail instead of
+// waiting for it. Halt doesn't wait for the supervised writer and
+// reader, they return once the session is closed.
+func (m *Mux) SetSupervisor(sup *supervisor.Supervisor) {
+	m.supervisor = sup
+}
+
+// Start starts the writer and the reader
+func (m *Mux) Start() {
+	m.start("writer", m.writer)
+	m.start("reader", m.reader)
+}
+
+// start runs the given loop until the Mux, or
+// the Supervisor if one is set, is halted
+func (m *Mux) start(name string, loop func(stop <-chan struct{})) {
+	if m.supervisor == nil {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			loop(nil)
+		}()
+		return
+	}
+	m.supervisor.Go("session "+name, func(stop <-chan struct{}) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				m.fail(fmt.Errorf("session %s panicked: %v", name, v))
+				err = &supervisor.PanicError{
+					Value: v,
+					Stack: debug.Stack(),
+				}
+			}
+		}()
+		loop(stop)
+		return nil
+	})
+}
+
+// fail halts the Mux because of the given error, which the pending
+// and later commands fail with and which is dispatched to every
+// handler, unless the Mux was already halted
+func (m *Mux) fail(err error) {
+	select {
+	case <-m.haltCh:
+		return
+	default:
+	}
+	log.Errorf("session multiplexer halted: %s", err)
+	m.Lock()
+	m.err = err
+	m.Unlock()
+	m.halt()
+	m.dispatchError(err)
+}
+
+// Halt stops the Mux and closes it's session
+func (m *Mux) Halt() {
+	m.halt()
+	m.wg.Wait()
+}
+
+// halt stops the Mux without waiting for the writer and the reader
+func (m *Mux) halt() {
+	m.haltOnce.Do(func() {
+		close(m.haltCh)
+		m.session.Close()
+	})
+}
+
+// Halted returns a channel which is closed once the Mux is halted,
+// either by Halt or because the session failed, see Err
+func (m *Mux) Halted() <-chan struct{} {
+	return m.haltCh
+}
+
+// Err returns the reception error which halted the Mux, if any
+func (m *Mux) Err() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.err
+}
+
+// haltErr returns the error the commands of a halted Mux fail with
+func (m *Mux) haltErr() error {
+	err := m.Err()
+	if err == nil {
+		return ErrMuxHalted
+	}
+	return err
+}
+
+// Send queues the given command and returns once it's written, the
+// commands answered by the Provider must be sent with Request
+func (m *Mux) Send(cmd commands.Command) error {
+	if _, ok := requestKey(cmd); ok {
+		return fmt.Errorf("session multiplexer: %T must be sent with Request", cmd)
+	}
+	return m.send(cmd)
+}
+
+// send queues the given command and returns once it's written
+func (m *Mux) send(cmd commands.Command) error {
+	out := &outbound{
+		cmd:   cmd,
+		errCh: make(chan error, 1),
+	}
+	select {
+	case m.outCh <- out:
+	case <-m.haltCh:
+		return m.haltErr()
+	}
+	select {
+	case err := <-out.errCh:
+		return err
+	case <-m.haltCh:
+		return m.haltErr()
+	}
+}
+
+// Request sends the given command and returns the response of the
+// Provider. The response to a request which timed out is discarded
+// once it's received, rather than taken for the response to a
+// later request.
+func (m *Mux) Request(cmd commands.Command, timeout time.Duration) (commands.Command, error) {
+	key, ok := requestKey(cmd)
+	if !ok {
+		return nil, fmt.Errorf("session multiplexer: %T has no response", cmd)
+	}
+	// the call is registered before sending as
+	// the response may be received before send returns
+	c := &call{
+		respCh: make(chan commands.Command, 1),
+	}
+	m.Lock()
+	m.calls[key] = append(m.calls[key], c)
+	m.Unlock()
+	err := m.send(cmd)
+	if err != nil {
+		m.removeCall(key, c)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-c.respCh:
+		return resp, nil
+	case <-m.haltCh:
+		return nil, m.haltErr()
+	case <-timer.C:
+		m.Lock()
+		c.abandoned = true
+		m.Unlock()
+		return nil, ErrMuxTimeout
+	}
+}
+
+// removeCall forgets the given call of a command which wasn't sent
+func (m *Mux) removeCall(key callKey, c *call) {
+	m.Lock()
+	defer m.Unlock()
+	calls := m.calls[key]
+	for i := range calls {
+		if calls[i] == c {
+			calls = append(calls[:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(calls) == 0 {
+		delete(m.calls, key)
+		return
+	}
+	m.calls[key] = calls
+}
+
+// writer writes the queued commands until the Mux,
+// or the Supervisor if one is set, is halted
+func (m *Mux) writer(stop <-chan struct{}) {
+	for {
+		select {
+		case <-m.haltCh:
+			return
+		case <-stop:
+			// closing the session stops the reader
+			m.halt()
+			return
+		case out := <-m.outCh:
+			out.errCh <- m.session.SendCommand(out.cmd)
+		}
+	}
+}
+
+// reader receives the commands of the Provider until the
+// session fails or is closed: the responses are returned to their
+// Requests and the other commands dispatched to their handlers
+func (m *Mux) reader(stop <-chan struct{}) {
+	for {
+		cmd, err := m.session.RecvCommand()
+		if err != nil {
+			// unless the session was closed by halt
+			m.fail(err)
+			return
+		}
+		if m.respond(cmd) {
+			continue
+		}
+		m.dispatch(commandType(cmd), Inbound{Command: cmd})
+	}
+}
+
+// respond returns the given response to the oldest call of the
+// request it answers, it returns false if cmd isn't a response
+func (m *Mux) respond(cmd commands.Command) bool {
+	key, ok := responseKey(cmd)
+	if !ok {
+		return false
+	}
+	m.Lock()
+	calls := m.calls[key]
+	if len(calls) == 0 {
+		m.Unlock()
+		log.Debugf("dropping uncorrelated %T response", cmd)
+		return true
+	}
+	c := calls[0]
+	if len(calls) == 1 {
+		delete(m.calls, key)
+	} else {
+		m.calls[key] = calls[1:]
+	}
+	abandoned := c.abandoned
+	m.Unlock()
+	if abandoned {
+		log.Debugf("discarding the late %T response", cmd)
+		return true
+	}
+	c.respCh <- cmd
+	return true
+}
+
+// dispatch sends the given Inbound to
+// the handlers of the given command type
+func (m *Mux) dispatch(t reflect.Type, in Inbound) {
+	m.Lock()
+	handlers := append([]chan<- Inbound{}, m.handlers[t]...)
+	m.Unlock()
+	if len(handlers) == 0 {
+		log.Debugf("dropping unhandled %s command", t)
+		return
+	}
+	for _, ch := range handlers {
+		select {
+		case ch <- in:
+		case <-m.haltCh:
+			return
+		}
+	}
+}
+
+// dispatchError sends the given reception error to every
+// distinct handler which is ready to receive it
+func (m *Mux) dispatchError(err error) {
+	m.Lock()
+	seen := make(map[chan<- Inbound]bool)
+	handlers := []chan<- Inbound{}
+	for _, chs := range m.handlers {
+		for _, ch := range chs {
+			if !seen[ch] {
+				seen[ch] = true
+				handlers = append(handlers, ch)
+			}
+		}
+	}
+	m.Unlock()
+	for _, ch := range handlers {
+		select {
+		case ch <- Inbound{Err: err}:
+		default:
+		}
+	}
+}
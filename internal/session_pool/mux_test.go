@@ -0,0 +1,209 @@
+// mux_test.go - session multiplexer tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package session_pool
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMux(t *testing.T) {
+	require := require.New(t)
+
+	session := NewFakeSession()
+	session.SetBlocking(true)
+	mux := NewMux(session)
+	pushed := make(chan Inbound, 1)
+	mux.Handle(commands.Disconnect{}, pushed)
+	mux.Start()
+	defer mux.Halt()
+
+	// concurrent senders don't wait for the retrievals
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mux.Send(commands.SendPacket{SphinxPacket: []byte("packet")})
+			require.NoError(err, "unexpected Send() error")
+		}()
+	}
+	resp, err := mux.Request(commands.RetrieveMessage{Sequence: 0}, time.Second)
+	require.NoError(err, "unexpected Request() error")
+	require.Equal(commands.MessageEmpty{Sequence: 0}, resp)
+	wg.Wait()
+	require.Len(session.Sent(), 10)
+
+	session.Deliver([]byte("hello"))
+	resp, err = mux.Request(commands.RetrieveMessage{Sequence: 1}, time.Second)
+	require.NoError(err, "unexpected Request() error")
+	require.Equal([]byte("hello"), resp.(commands.Message).Payload)
+
+	// commands with a response must be requested
+	err = mux.Send(commands.RetrieveMessage{Sequence: 2})
+	require.Error(err, "Send() of a RetrieveMessage didn't fail")
+
+	// the commands pushed by the Provider are dispatched
+	session.Push(commands.Disconnect{})
+	select {
+	case in := <-pushed:
+		require.NoError(in.Err)
+		require.Equal(commands.Disconnect{}, in.Command)
+	case <-time.After(time.Second):
+		require.FailNow("Disconnect wasn't dispatched")
+	}
+
+	// a lost link fails the sends and halts the Mux
+	lost := errors.New("link lost")
+	session.SetError(lost)
+	err = mux.Send(commands.SendPacket{SphinxPacket: []byte("packet")})
+	require.Equal(lost, err)
+	_, err = mux.Request(commands.RetrieveMessage{Sequence: 2}, time.Second)
+	require.Equal(lost, err)
+
+	mux.Halt()
+	require.Equal(lost, mux.Err())
+}
+
+func TestMuxHalt(t *testing.T) {
+	require := require.New(t)
+
+	session := NewFakeSession()
+	session.SetBlocking(true)
+	mux := NewMux(session)
+	mux.Start()
+	mux.Halt()
+	_, err := mux.Request(commands.RetrieveMessage{Sequence: 0}, time.Second)
+	require.Equal(ErrMuxHalted, err)
+	require.NoError(mux.Err())
+}
+
+func TestMuxLateResponse(t *testing.T) {
+	require := require.New(t)
+
+	session := NewFakeSession()
+	session.SetBlocking(true)
+	mux := NewMux(session)
+	mux.Start()
+	defer mux.Halt()
+
+	// the fake session doesn't answer GetConsensus
+	_, err := mux.Request(commands.GetConsensus{}, 10*time.Millisecond)
+	require.Equal(ErrMuxTimeout, err)
+
+	type result struct {
+		resp commands.Command
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, err := mux.Request(commands.GetConsensus{}, time.Second)
+		resultCh <- result{resp, err}
+	}()
+	require.Eventually(func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(mux.calls[callKey{kind: "consensus"}]) == 2
+	}, time.Second, time.Millisecond)
+
+	// the late response to the first request isn't
+	// taken for the response to the second one
+	session.Push(commands.Consensus{Payload: []byte("late")})
+	session.Push(commands.Consensus{Payload: []byte("fresh")})
+	r := <-resultCh
+	require.NoError(r.err, "unexpected Request() error")
+	require.Equal([]byte("fresh"), r.resp.(commands.Consensus).Payload)
+}
+
+func TestMuxReceiveError(t *testing.T) {
+	require := require.New(t)
+
+	session := NewFakeSession()
+	mux := NewMux(session)
+	messages := make(chan Inbound, 1)
+	acks := make(chan Inbound, 1)
+	mux.Handle(commands.Message{}, messages)
+	mux.Handle(commands.MessageACK{}, acks)
+	mux.Start()
+	defer mux.Halt()
+
+	// the fake session fails the reception as it doesn't
+	// block, which halts the Mux and is dispatched to every handler
+	for _, ch := range []chan Inbound{messages, acks} {
+		select {
+		case in := <-ch:
+			require.Equal(ErrNothingToReceive, in.Err)
+		case <-time.After(time.Second):
+			require.FailNow("receive error wasn't dispatched")
+		}
+	}
+	select {
+	case <-mux.Halted():
+	case <-time.After(time.Second):
+		require.FailNow("the Mux wasn't halted")
+	}
+	require.Equal(ErrNothingToReceive, mux.Err())
+	_, err := mux.Request(commands.RetrieveMessage{Sequence: 0}, time.Second)
+	require.Equal(ErrNothingToReceive, err)
+}
+
+// panickingSession is a FakeSession whose SendCommand panics
+type panickingSession struct {
+	*FakeSession
+}
+
+func (p *panickingSession) SendCommand(cmd commands.Command) error {
+	panic("send failure")
+}
+
+func TestMuxPanic(t *testing.T) {
+	require := require.New(t)
+
+	session := NewFakeSession()
+	session.SetBlocking(true)
+	mux := NewMux(&panickingSession{session})
+	sup := supervisor.New()
+	defer sup.Halt()
+	mux.SetSupervisor(sup)
+	mux.Start()
+	defer mux.Halt()
+
+	// the panic of the writer fails the Send instead of blocking it
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mux.Send(commands.SendPacket{SphinxPacket: []byte("packet")})
+	}()
+	select {
+	case err := <-errCh:
+		require.Error(err, "the Send succeeded")
+	case <-time.After(time.Second):
+		require.FailNow("the Send blocked")
+	}
+	select {
+	case <-mux.Halted():
+	default:
+		require.FailNow("the Mux wasn't halted")
+	}
+	err := mux.Send(commands.SendPacket{SphinxPacket: []byte("packet")})
+	require.Equal(mux.Err(), err)
+}
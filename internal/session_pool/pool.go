@@ -0,0 +1,498 @@
+// pool.go - session pool for mixnet clients
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package provides wire protocol session pool API
+package session_pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/supervisor"
+	"github.com/katzenpost/client/internal/transport"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// SessionPool maps sender email string to sender identity
+// wire protocol session with the Provider
+type SessionPool struct {
+	Sessions map[string]wire.SessionInterface
+	Locks    map[string]*sync.Mutex
+
+	// SendSessions are the additional send channels of each
+	// identity which are used alongside it's session in Sessions
+	SendSessions map[string][]wire.SessionInterface
+	SendLocks    map[string][]*sync.Mutex
+
+	// endpoints maps each identity to the Provider
+	// endpoint it's session is established with
+	endpoints map[string]string
+
+	// dialers maps each identity to the dialer which
+	// reestablishes it's session once it's lost
+	dialers map[string]*dialer
+
+	// muxes maps each multiplexed identity to
+	// the Mux which owns it's session
+	muxes map[string]*Mux
+
+	// supervisor runs the goroutines of the muxes
+	supervisor *supervisor.Supervisor
+
+	// lock guards the maps against identities
+	// being added or removed concurrently
+	lock sync.RWMutex
+
+	// haltCh is closed by Close to stop the reconnections
+	haltCh chan struct{}
+	closed bool
+}
+
+// HealthTracker is an interface that represents the persistent
+// connection health of the Provider endpoints, see storage.Store
+type HealthTracker interface {
+	RecordHandshake(provider, endpoint string, rtt time.Duration, handshakeErr error) error
+	RankEndpoints(provider string, endpoints []string) ([]string, error)
+}
+
+// New creates a new SessionPool
+func New(accounts *config.AccountsMap, config *config.Config, providerAuthenticator wire.PeerAuthenticator, mixPKI pki.Client) (*SessionPool, error) {
+	return NewWithHealth(accounts, config, providerAuthenticator, mixPKI, nil)
+}
+
+// NewWithHealth creates a new SessionPool which tries the endpoints
+// of each Provider in decreasing order of health and records the
+// outcome of each connection attempt with the given HealthTracker
+func NewWithHealth(accounts *config.AccountsMap, config *config.Config, providerAuthenticator wire.PeerAuthenticator, mixPKI pki.Client, health HealthTracker) (*SessionPool, error) {
+	s := SessionPool{
+		Sessions:  make(map[string]wire.SessionInterface),
+		Locks:     make(map[string]*sync.Mutex),
+		endpoints: make(map[string]string),
+		dialers:   make(map[string]*dialer),
+	}
+	for _, acct := range config.Account {
+		email := fmt.Sprintf("%s@%s", acct.Name, acct.Provider)
+		privateKey, err := accounts.GetIdentityKey(email)
+		if err != nil {
+			return nil, err
+		}
+		sessionConfig := wire.SessionConfig{
+			Authenticator:     providerAuthenticator,
+			AdditionalData:    []byte(acct.Name),
+			AuthenticationKey: privateKey,
+			RandomReader:      entropy.Reader,
+		}
+		epoch, _, _ := epochtime.Now()
+		ctx := context.TODO() // XXX
+		doc, err := mixPKI.Get(ctx, epoch)
+		if err != nil {
+			return nil, err
+		}
+		providerDesc, err := doc.GetProvider(acct.Provider)
+		if err != nil {
+			return nil, err
+		}
+		transportConfig := config.ProviderTransport(acct.Provider)
+		t, err := transport.New(transportConfig)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := providerDesc.Addresses
+		if transportConfig != nil && transportConfig.Address != "" {
+			endpoints = []string{transportConfig.Address}
+		}
+		d := &dialer{
+			sessionConfig: &sessionConfig,
+			transport:     t,
+			provider:      acct.Provider,
+			endpoints:     endpoints,
+			fallbacks:     acct.FallbackAddresses,
+			attempts:      acct.ProviderFailoverAttempts(),
+			health:        health,
+		}
+		session, endpoint, err := d.connect("")
+		if err != nil {
+			return nil, err
+		}
+		s.Add(email, session)
+		s.endpoints[email] = endpoint
+		s.dialers[email] = d
+		for i := 1; i < acct.SendChannels; i++ {
+			// the Provider may refuse concurrent sessions
+			// of the same identity, in which case we make
+			// do with the channels established so far
+			session, _, err := d.connect("")
+			if err != nil {
+				log.Warningf("%s: failed to open send channel %d: %s", email, i, err)
+				break
+			}
+			s.AddSendChannel(email, session)
+		}
+	}
+	return &s, nil
+}
+
+// dialer establishes the sessions of an account with the
+// endpoints of it's Provider, see connect
+type dialer struct {
+	sessionConfig *wire.SessionConfig
+	transport     transport.Transport
+	provider      string
+	endpoints     []string
+	fallbacks     []string
+	attempts      int
+	health        HealthTracker
+}
+
+// connect returns a session with the first Provider endpoint which
+// completes the handshake over the Transport, and that endpoint. Each
+// endpoint is attempted the configured number of times before failing
+// over to the next one, the fallback addresses are tried last. The
+// given endpoint, that of a lost session, if any, is tried after all
+// the others.
+func (d *dialer) connect(lost string) (wire.SessionInterface, string, error) {
+	endpoints := d.endpoints
+	if len(endpoints) == 0 && len(d.fallbacks) == 0 {
+		return nil, "", fmt.Errorf("provider %s has no endpoints", d.provider)
+	}
+	if d.health != nil && len(endpoints) != 0 {
+		ranked, err := d.health.RankEndpoints(d.provider, endpoints)
+		if err != nil {
+			return nil, "", err
+		}
+		endpoints = ranked
+	}
+	candidates := []string{}
+	for _, endpoint := range append(append([]string{}, endpoints...), d.fallbacks...) {
+		if endpoint != lost {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) < len(endpoints)+len(d.fallbacks) {
+		candidates = append(candidates, lost)
+	}
+	var err error
+	for i, endpoint := range candidates {
+		if i == len(endpoints) && i != 0 && lost == "" {
+			log.Warningf("failing over to the fallback addresses of %s", d.provider)
+		}
+		for attempt := 0; attempt < d.attempts; attempt++ {
+			var session wire.SessionInterface
+			session, err = handshake(d.sessionConfig, d.transport, d.provider, endpoint, d.health)
+			if err == nil {
+				return session, endpoint, nil
+			}
+			log.Debugf("handshake %d with %s endpoint %s failed: %s", attempt+1, d.provider, endpoint, err)
+		}
+	}
+	return nil, "", err
+}
+
+// handshake returns a session with the given Provider endpoint
+// and records the outcome with the HealthTracker if not nil
+func handshake(sessionConfig *wire.SessionConfig, t transport.Transport, provider, endpoint string, health HealthTracker) (wire.SessionInterface, error) {
+	start := time.Now()
+	session, err := wire.NewSession(sessionConfig, true)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Dial(endpoint)
+	if err == nil {
+		err = session.Initialize(conn)
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if health != nil {
+		healthErr := health.RecordHandshake(provider, endpoint, time.Since(start), err)
+		if healthErr != nil {
+			log.Errorf("failed to record handshake with %s: %s", endpoint, healthErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *SessionPool) Add(identity string, session wire.SessionInterface) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Sessions[identity] = session
+	s.Locks[identity] = &sync.Mutex{}
+}
+
+// AddSendChannel adds an additional send channel for the
+// given identity, see SendChannels
+func (s *SessionPool) AddSendChannel(identity string, session wire.SessionInterface) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.SendSessions == nil {
+		s.SendSessions = make(map[string][]wire.SessionInterface)
+		s.SendLocks = make(map[string][]*sync.Mutex)
+	}
+	s.SendSessions[identity] = append(s.SendSessions[identity], session)
+	s.SendLocks[identity] = append(s.SendLocks[identity], &sync.Mutex{})
+}
+
+// SendChannels returns the session of the given identity followed
+// by it's additional send channels, and their respective locks
+func (s *SessionPool) SendChannels(identity string) ([]wire.SessionInterface, []*sync.Mutex, error) {
+	session, lock, err := s.Get(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	sessions := append([]wire.SessionInterface{session}, s.SendSessions[identity]...)
+	locks := append([]*sync.Mutex{lock}, s.SendLocks[identity]...)
+	return sessions, locks, nil
+}
+
+// Endpoint returns the Provider endpoint the current session of the
+// given identity is established with, which changes when a lost
+// session fails over, empty if the session wasn't established by
+// the SessionPool
+func (s *SessionPool) Endpoint(identity string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.endpoints[identity]
+}
+
+// SetSupervisor sets the Supervisor which runs the
+// goroutines of the Muxes created by Multiplex
+func (s *SessionPool) SetSupervisor(sup *supervisor.Supervisor) {
+	s.supervisor = sup
+}
+
+// Multiplex hands the session of the given identity over to a
+// started Mux, which is then used by the Fetcher and the Sender
+// instead of the session and it's lock
+func (s *SessionPool) Multiplex(identity string) (*Mux, error) {
+	session, _, err := s.Get(identity)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if mux, ok := s.muxes[identity]; ok {
+		return mux, nil
+	}
+	return s.startMux(identity, session), nil
+}
+
+// startMux starts the Mux of the given session of the given identity
+// and reestablishes the session once it's lost. The caller must hold
+// the lock.
+func (s *SessionPool) startMux(identity string, session wire.SessionInterface) *Mux {
+	if s.muxes == nil {
+		s.muxes = make(map[string]*Mux)
+	}
+	mux := NewMux(session)
+	mux.SetSupervisor(s.supervisor)
+	mux.Start()
+	s.muxes[identity] = mux
+	if _, ok := s.dialers[identity]; ok {
+		go s.watch(identity, mux)
+	}
+	return mux
+}
+
+// halted returns the channel closed by Close
+func (s *SessionPool) halted() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.haltCh == nil {
+		s.haltCh = make(chan struct{})
+		if s.closed {
+			close(s.haltCh)
+		}
+	}
+	return s.haltCh
+}
+
+// watch waits for the given Mux of the given identity to halt and,
+// if it's session failed rather than being closed, fails over to
+// the next endpoint of the Provider, see Reconnect
+func (s *SessionPool) watch(identity string, mux *Mux) {
+	select {
+	case <-mux.Halted():
+	case <-s.halted():
+		return
+	}
+	if mux.Err() == nil {
+		// halted by Close or Remove
+		return
+	}
+	log.Warningf("%s: lost the session with %s: %s", identity, s.Endpoint(identity), mux.Err())
+	s.reconnect(identity, mux)
+}
+
+// reconnect reestablishes the lost session of the given identity,
+// whose failed Mux is given, retrying with an exponential backoff
+// until it succeeds, the pool is closed or the identity removed
+func (s *SessionPool) reconnect(identity string, failed *Mux) {
+	backoff := constants.ProviderReconnectMinBackoff
+	halted := s.halted()
+	for {
+		s.lock.RLock()
+		d := s.dialers[identity]
+		current := s.muxes[identity]
+		lost := s.endpoints[identity]
+		closed := s.closed
+		s.lock.RUnlock()
+		if closed || d == nil || current != failed {
+			return
+		}
+		session, endpoint, err := d.connect(lost)
+		if err == nil {
+			s.lock.Lock()
+			if s.closed || s.muxes[identity] != failed {
+				s.lock.Unlock()
+				session.Close()
+				return
+			}
+			s.Sessions[identity] = session
+			s.endpoints[identity] = endpoint
+			s.startMux(identity, session)
+			s.lock.Unlock()
+			log.Noticef("%s: reestablished the session with %s", identity, endpoint)
+			return
+		}
+		log.Warningf("%s: failed to reestablish the session, retrying in %s: %s", identity, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-halted:
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+		if backoff > constants.ProviderReconnectMaxBackoff {
+			backoff = constants.ProviderReconnectMaxBackoff
+		}
+	}
+}
+
+// Mux returns the Mux of the given identity,
+// nil if it's session isn't multiplexed
+func (s *SessionPool) Mux(identity string) *Mux {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.muxes[identity]
+}
+
+// Close halts the Muxes and closes the sessions
+// and send channels of every identity
+func (s *SessionPool) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		if s.haltCh != nil {
+			close(s.haltCh)
+		}
+	}
+	for _, mux := range s.muxes {
+		mux.Halt()
+	}
+	for identity, session := range s.Sessions {
+		if _, ok := s.muxes[identity]; !ok {
+			session.Close()
+		}
+	}
+	for _, sessions := range s.SendSessions {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}
+}
+
+// Remove halts the Mux and closes the session and send channels of
+// the given identity, which is then forgotten, so that it's logged
+// out of it's Provider
+func (s *SessionPool) Remove(identity string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.Sessions[identity]
+	if !ok {
+		return errors.New("wire protocol session pool key not found")
+	}
+	if mux, ok := s.muxes[identity]; ok {
+		mux.Halt()
+		delete(s.muxes, identity)
+	} else {
+		session.Close()
+	}
+	for _, sendSession := range s.SendSessions[identity] {
+		sendSession.Close()
+	}
+	delete(s.Sessions, identity)
+	delete(s.Locks, identity)
+	delete(s.SendSessions, identity)
+	delete(s.SendLocks, identity)
+	delete(s.endpoints, identity)
+	delete(s.dialers, identity)
+	return nil
+}
+
+func (s *SessionPool) Get(identity string) (wire.SessionInterface, *sync.Mutex, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, ok := s.Sessions[identity]
+	if !ok {
+		return nil, nil, errors.New("wire protocol session pool key not found")
+	}
+	return v, s.Locks[identity], nil
+}
+
+// Check returns an error if the session of the given identity isn't
+// usable: it was never established, it's Mux was halted by the
+// failure of the session, or a NoOp command can't be sent over it
+func (s *SessionPool) Check(identity string) error {
+	session, lock, err := s.Get(identity)
+	if err != nil {
+		return err
+	}
+	if mux := s.Mux(identity); mux != nil {
+		return mux.Send(commands.NoOp{})
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return session.SendCommand(commands.NoOp{})
+}
+
+func (s *SessionPool) Identities() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ids := []string{}
+	for id, _ := range s.Sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
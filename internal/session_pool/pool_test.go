@@ -0,0 +1,181 @@
+// pool_test.go - Provider failover tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package session_pool
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/require"
+)
+
+type refusingTransport struct {
+	dialed []string
+}
+
+func (t *refusingTransport) Dial(address string) (net.Conn, error) {
+	t.dialed = append(t.dialed, address)
+	return nil, errors.New("connection refused")
+}
+
+type recordingHealth struct {
+	recorded []string
+}
+
+func (h *recordingHealth) RecordHandshake(provider, endpoint string, rtt time.Duration, handshakeErr error) error {
+	h.recorded = append(h.recorded, endpoint)
+	return nil
+}
+
+func (h *recordingHealth) RankEndpoints(provider string, endpoints []string) ([]string, error) {
+	ranked := []string{}
+	for i := len(endpoints) - 1; i >= 0; i-- {
+		ranked = append(ranked, endpoints[i])
+	}
+	return ranked, nil
+}
+
+type acceptAll struct{}
+
+func (acceptAll) IsPeerValid(*wire.PeerCredentials) bool {
+	return true
+}
+
+func TestConnectFailover(t *testing.T) {
+	require := require.New(t)
+
+	privateKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair() error")
+	sessionConfig := wire.SessionConfig{
+		Authenticator:     acceptAll{},
+		AdditionalData:    []byte("alice"),
+		AuthenticationKey: privateKey,
+		RandomReader:      rand.Reader,
+	}
+	transport := &refusingTransport{}
+	health := &recordingHealth{}
+	d := &dialer{
+		sessionConfig: &sessionConfig,
+		transport:     transport,
+		provider:      "acme.com",
+		endpoints:     []string{"127.0.0.1:1", "127.0.0.1:2"},
+		fallbacks:     []string{"127.0.0.1:3"},
+		attempts:      2,
+		health:        health,
+	}
+	_, _, err = d.connect("")
+	require.Error(err, "expected connect() to fail")
+	expected := []string{
+		"127.0.0.1:2", "127.0.0.1:2",
+		"127.0.0.1:1", "127.0.0.1:1",
+		"127.0.0.1:3", "127.0.0.1:3",
+	}
+	require.Equal(expected, transport.dialed)
+	require.Equal(expected, health.recorded)
+
+	// the endpoint of a lost session is tried last
+	transport.dialed = nil
+	_, _, err = d.connect("127.0.0.1:2")
+	require.Error(err, "expected connect() to fail")
+	require.Equal([]string{
+		"127.0.0.1:1", "127.0.0.1:1",
+		"127.0.0.1:3", "127.0.0.1:3",
+		"127.0.0.1:2", "127.0.0.1:2",
+	}, transport.dialed)
+
+	d = &dialer{sessionConfig: &sessionConfig, transport: transport, provider: "acme.com", attempts: 1}
+	_, _, err = d.connect("")
+	require.Error(err, "expected connect() without endpoints to fail")
+}
+
+func TestReconnectStops(t *testing.T) {
+	require := require.New(t)
+
+	pool := SessionPool{
+		Sessions: make(map[string]wire.SessionInterface),
+		Locks:    make(map[string]*sync.Mutex),
+		dialers: map[string]*dialer{
+			"alice@acme.com": {transport: &refusingTransport{}, provider: "acme.com"},
+		},
+	}
+	pool.Add("alice@acme.com", NewFakeSession())
+	mux, err := pool.Multiplex("alice@acme.com")
+	require.NoError(err, "Multiplex failed")
+
+	// the session can't be reestablished until the pool is closed
+	done := make(chan struct{})
+	go func() {
+		pool.reconnect("alice@acme.com", mux)
+		close(done)
+	}()
+	pool.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		require.Fail("the reconnection outlived the pool")
+	}
+}
+
+func TestClose(t *testing.T) {
+	require := require.New(t)
+
+	pool := SessionPool{
+		Sessions: make(map[string]wire.SessionInterface),
+		Locks:    make(map[string]*sync.Mutex),
+	}
+	session := NewFakeSession()
+	sendChannel := NewFakeSession()
+	pool.Add("alice@acme.com", session)
+	pool.AddSendChannel("alice@acme.com", sendChannel)
+
+	pool.Close()
+	require.Error(session.SendCommand(commands.NoOp{}), "session not closed")
+	require.Error(sendChannel.SendCommand(commands.NoOp{}), "send channel not closed")
+}
+
+func TestRemove(t *testing.T) {
+	require := require.New(t)
+
+	pool := SessionPool{
+		Sessions: make(map[string]wire.SessionInterface),
+		Locks:    make(map[string]*sync.Mutex),
+	}
+	alice := NewFakeSession()
+	aliceSendChannel := NewFakeSession()
+	bob := NewFakeSession()
+	pool.Add("alice@acme.com", alice)
+	pool.AddSendChannel("alice@acme.com", aliceSendChannel)
+	pool.Add("bob@nsa.gov", bob)
+
+	err := pool.Remove("alice@acme.com")
+	require.NoError(err, "Remove failed")
+	require.Error(alice.SendCommand(commands.NoOp{}), "session not closed")
+	require.Error(aliceSendChannel.SendCommand(commands.NoOp{}), "send channel not closed")
+	require.NoError(bob.SendCommand(commands.NoOp{}), "session of another identity closed")
+	_, _, err = pool.Get("alice@acme.com")
+	require.Error(err, "removed identity not forgotten")
+	require.Equal([]string{"bob@nsa.gov"}, pool.Identities())
+	err = pool.Remove("alice@acme.com")
+	require.Error(err, "removed identity removed twice")
+}
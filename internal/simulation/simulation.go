@@ -0,0 +1,361 @@
+// simulation.go - simulated traffic over a modeled mixnet
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package simulation drives many in-process clients over a modeled
+// mix network, see package mock_mixnet, with synthetic traffic which
+// goes through the real fragmentation, scheduling and retransmission
+// code. The time of the simulation is a clock.Fake advanced step by
+// step, so that hours of traffic are simulated in seconds, and it's
+// Report gives the latency, loss and queue statistics used to tune
+// the λ parameters shipped as defaults.
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/mock_mixnet"
+	"github.com/katzenpost/client/storage"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// Config is the configuration of a simulation
+type Config struct {
+	// Clients is the number of clients, each
+	// has one account at one of the Providers
+	Clients int
+
+	// Providers is the number of Providers
+	Providers int
+
+	// Duration is the duration of the synthetic traffic
+	Duration time.Duration
+
+	// Drain is the additional duration the simulation runs for
+	// without new messages, for the retransmissions to complete
+	Drain time.Duration
+
+	// Step is the duration the simulated time is advanced by
+	// between two rounds of message retrievals
+	Step time.Duration
+
+	// MessageInterval is the mean of the exponentially distributed
+	// intervals between two messages sent by a client
+	MessageInterval time.Duration
+
+	// MessageSize is the size in bytes of the message bodies
+	MessageSize int
+
+	// Loss is the probability of a packet to be dropped
+	Loss float64
+
+	// Delay is the distribution of the network delays,
+	// the packets aren't delayed if nil
+	Delay mock_mixnet.Delay
+
+	// Lambda is the inverse of the mean per hop delay in
+	// milliseconds, mock_mixnet.Lambda is used if zero
+	Lambda float64
+
+	// SendInterval is the mean interval between two send
+	// slots, the Blocks are sent immediately if zero
+	SendInterval time.Duration
+}
+
+// validate returns an error if the Config is invalid
+func (c *Config) validate() error {
+	switch {
+	case c.Clients < 2:
+		return errors.New("a simulation needs at least two clients")
+	case c.Providers < 1:
+		return errors.New("a simulation needs at least one Provider")
+	case c.Step <= 0:
+		return errors.New("the simulation step must be positive")
+	case c.MessageInterval <= 0:
+		return errors.New("the message interval must be positive")
+	case c.Loss < 0 || c.Loss > 1:
+		return errors.New("the loss must be between 0 and 1")
+	}
+	return nil
+}
+
+// Report holds the statistics of a simulation
+type Report struct {
+	sync.Mutex
+
+	// Messages is the number of messages submitted
+	Messages int
+
+	// Refused is the number of submissions refused by the SMTP proxy
+	Refused int
+
+	// Delivered is the number of messages which
+	// arrived in the mailbox of their recipient
+	Delivered int
+
+	// Acked is the number of messages whose
+	// Blocks were all acknowledged
+	Acked int
+
+	// Bounced is the number of messages
+	// whose delivery was given up
+	Bounced int
+
+	// Transmissions is the number of Blocks sent,
+	// including the retransmissions
+	Transmissions int
+
+	// Blocks is the number of distinct Blocks sent
+	Blocks int
+
+	// Latencies are the delays between the submission
+	// and the arrival of the delivered messages
+	Latencies []time.Duration
+
+	// MaxQueue is the largest number of Blocks
+	// waiting for their ACK over all the clients
+	MaxQueue int
+
+	// MeanQueue is the mean number of Blocks waiting for their
+	// ACK over all the clients, sampled at each step
+	MeanQueue float64
+
+	queued  map[string]time.Time
+	sent    map[string]bool
+	samples int
+}
+
+// Percentile returns the given percentile, between 0 and 100,
+// of the latencies of the delivered messages
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, r.Latencies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// Write writes the Report in a human readable form to w
+func (r *Report) Write(w io.Writer) error {
+	loss := 0.0
+	if r.Messages-r.Refused > 0 {
+		loss = 1 - float64(r.Delivered)/float64(r.Messages-r.Refused)
+	}
+	retransmissions := 0.0
+	if r.Blocks > 0 {
+		retransmissions = float64(r.Transmissions-r.Blocks) / float64(r.Blocks)
+	}
+	_, err := fmt.Fprintf(w, `messages        %d submitted, %d refused
+delivered       %d (%.2f%% lost)
+acknowledged    %d
+bounced         %d
+blocks          %d sent, %d transmissions (%.2f retransmissions per block)
+latency         p50 %s, p90 %s, p99 %s, max %s
+queue           mean %.1f, max %d blocks
+`, r.Messages, r.Refused, r.Delivered, 100*loss, r.Acked, r.Bounced, r.Blocks, r.Transmissions, retransmissions,
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100), r.MeanQueue, r.MaxQueue)
+	return err
+}
+
+// observe returns the event observer of a client, the
+// events are timed with the given simulation clock
+func (r *Report) observe(c clock.Clock) func(e *storage.Event) {
+	return func(e *storage.Event) {
+		r.Lock()
+		defer r.Unlock()
+		switch e.Type {
+		case storage.EventMessageQueued:
+			r.queued[e.MessageID] = c.Now()
+		case storage.EventBlockSent:
+			r.Transmissions++
+			var block, total, attempt int
+			fmt.Sscanf(e.Detail, "block %d of %d attempt %d", &block, &total, &attempt)
+			key := fmt.Sprintf("%s/%d", e.MessageID, block)
+			if !r.sent[key] {
+				r.sent[key] = true
+				r.Blocks++
+			}
+		case storage.EventMessageArrived:
+			if queued, ok := r.queued[e.MessageID]; ok {
+				r.Delivered++
+				r.Latencies = append(r.Latencies, c.Now().Sub(queued))
+			}
+		case storage.EventMessageAcked:
+			r.Acked++
+		case storage.EventMessageBounced:
+			r.Bounced++
+		}
+	}
+}
+
+// sampleQueue records the given number of queued Blocks
+func (r *Report) sampleQueue(queued int) {
+	r.Lock()
+	defer r.Unlock()
+	if queued > r.MaxQueue {
+		r.MaxQueue = queued
+	}
+	r.MeanQueue += (float64(queued) - r.MeanQueue) / float64(r.samples+1)
+	r.samples++
+}
+
+// client is a simulated client and the time of it's next message
+type client struct {
+	*mock_mixnet.Client
+
+	next time.Time
+}
+
+// message returns a synthetic message of the given body size
+func message(rng *mathrand.Rand, recipient string, size int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz "
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return fmt.Sprintf("To: %s\r\nSubject: simulation\r\n\r\n%s\r\n", recipient, body)
+}
+
+// step advances the given clock by d, one timer at a time, each
+// of the given number of send slot loops woken up sends it's Block
+// and waits for it's next slot before the time moves on
+func step(c *clock.Fake, d time.Duration, slots int) {
+	end := c.Now().Add(d)
+	for c.Next(end) {
+		c.BlockUntil(slots)
+	}
+	c.Advance(end.Sub(c.Now()))
+}
+
+// Run runs the simulation of the given Config and returns it's Report
+func Run(cfg *Config) (*Report, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "mixclient-simulation")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	providers := []string{}
+	for i := 0; i < cfg.Providers; i++ {
+		providers = append(providers, fmt.Sprintf("provider%d.example", i))
+	}
+	m, err := mock_mixnet.New(providers...)
+	if err != nil {
+		return nil, err
+	}
+	c := clock.NewFake(time.Now())
+	m.SetClock(c)
+	m.SetLoss(cfg.Loss)
+	if cfg.Delay != nil {
+		m.SetDelay(cfg.Delay)
+	}
+	if cfg.Lambda != 0 {
+		m.SetLambda(cfg.Lambda)
+	}
+
+	report := Report{
+		queued: make(map[string]time.Time),
+		sent:   make(map[string]bool),
+	}
+	rng := entropy.NewMath()
+	clients := []*client{}
+	defer func() {
+		for _, cl := range clients {
+			cl.Scheduler.StopSendSlots()
+			cl.Close()
+		}
+	}()
+	for i := 0; i < cfg.Clients; i++ {
+		identity := fmt.Sprintf("user%d@%s", i, providers[i%len(providers)])
+		cl, err := m.NewClient(identity, filepath.Join(dir, fmt.Sprintf("user%d.db", i)))
+		if err != nil {
+			return nil, err
+		}
+		cl.Scheduler.SetClock(c)
+		if cfg.SendInterval > 0 {
+			cl.Scheduler.EnableSendSlots(cfg.SendInterval, true)
+		}
+		cl.Store.SetEventObserver(report.observe(c))
+		clients = append(clients, &client{
+			Client: cl,
+			next:   c.Now().Add(time.Duration(rng.ExpFloat64() * float64(cfg.MessageInterval))),
+		})
+	}
+
+	slots := 0
+	if cfg.SendInterval > 0 {
+		slots = len(clients)
+	}
+	c.BlockUntil(slots)
+	start := c.Now()
+	for c.Now().Sub(start) < cfg.Duration+cfg.Drain {
+		sending := c.Now().Sub(start) < cfg.Duration
+		for _, cl := range clients {
+			for sending && !cl.next.After(c.Now()) {
+				recipient := clients[rng.Intn(len(clients))]
+				for recipient == cl {
+					recipient = clients[rng.Intn(len(clients))]
+				}
+				report.Lock()
+				report.Messages++
+				report.Unlock()
+				err := cl.Send(recipient.Identity, message(rng, recipient.Identity, cfg.MessageSize))
+				if err != nil {
+					log.Debugf("simulation: %s: %s", cl.Identity, err)
+					report.Lock()
+					report.Refused++
+					report.Unlock()
+				}
+				cl.next = cl.next.Add(time.Duration(rng.ExpFloat64() * float64(cfg.MessageInterval)))
+			}
+		}
+		step(c, cfg.Step, slots)
+		queued := 0
+		for _, cl := range clients {
+			err := cl.Fetch()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", cl.Identity, err)
+			}
+			queue, err := cl.Scheduler.Queue()
+			if err != nil {
+				return nil, err
+			}
+			queued += len(queue)
+		}
+		report.sampleQueue(queued)
+	}
+	return &report, nil
+}
@@ -0,0 +1,81 @@
+// simulation_test.go - simulation tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package simulation
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/internal/mock_mixnet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	require := require.New(t)
+
+	_, err := Run(&Config{Clients: 1, Providers: 1, Step: time.Second, MessageInterval: time.Minute})
+	require.Error(err, "simulation of a single client not refused")
+
+	report, err := Run(&Config{
+		Clients:         3,
+		Providers:       2,
+		Duration:        10 * time.Minute,
+		Drain:           10 * time.Minute,
+		Step:            time.Second,
+		MessageInterval: 2 * time.Minute,
+		MessageSize:     100,
+		Delay:           mock_mixnet.ExponentialDelay(time.Second),
+	})
+	require.NoError(err, "Run failed")
+	require.True(report.Messages > 0, "no message sent")
+	require.Equal(report.Messages-report.Refused, report.Delivered)
+	require.Equal(report.Delivered, report.Acked)
+	require.Equal(0, report.Bounced)
+	require.Equal(report.Blocks, report.Transmissions)
+	require.True(report.Percentile(50) > 0, "zero latency")
+	require.True(report.Percentile(50) <= report.Percentile(99))
+
+	out := new(bytes.Buffer)
+	require.NoError(report.Write(out), "Write failed")
+	require.Contains(out.String(), "(0.00% lost)")
+}
+
+func TestRunLambda(t *testing.T) {
+	require := require.New(t)
+
+	run := func(lambda float64) *Report {
+		report, err := Run(&Config{
+			Clients:         2,
+			Providers:       1,
+			Duration:        10 * time.Minute,
+			Drain:           10 * time.Minute,
+			Step:            time.Second,
+			MessageInterval: 2 * time.Minute,
+			MessageSize:     100,
+			Lambda:          lambda,
+			SendInterval:    time.Second,
+		})
+		require.NoError(err, "Run failed")
+		require.True(report.Delivered > 0, "no message delivered")
+		return report
+	}
+	// the mean per hop delay is 8ms and 10s
+	fast := run(0.123)
+	slow := run(0.0001)
+	require.True(slow.Percentile(50) > fast.Percentile(50), "λ doesn't change the latency")
+}
@@ -0,0 +1,154 @@
+// status_file.go - unread message counts for status bars
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package status_file writes the number of messages waiting in each
+// account's mailbox to a small JSON file, so that desktop status bars
+// and window manager widgets can show new mail indicators without
+// access to the proxies. The file is replaced atomically whenever a
+// mailbox changes, a widget may simply watch or re-read it.
+package status_file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// MailboxCounter counts the messages of an account's
+// mailbox, it's implemented by storage.Store
+type MailboxCounter interface {
+	MailboxCount(accountName string) (int, error)
+}
+
+// Status is the content of the status file
+type Status struct {
+	// Accounts maps the account names
+	// to their number of unread messages
+	Accounts map[string]int
+	// Total is the number of unread messages of all accounts
+	Total int
+}
+
+// Writer keeps the status file up to date
+type Writer struct {
+	sync.Mutex
+
+	fileName string
+	store    MailboxCounter
+	status   Status
+}
+
+// New returns a new *Writer of the given file
+// which counts the messages of the given accounts
+func New(fileName string, store MailboxCounter, accounts []string) *Writer {
+	w := Writer{
+		fileName: fileName,
+		store:    store,
+		status: Status{
+			Accounts: make(map[string]int),
+		},
+	}
+	for _, accountName := range accounts {
+		w.status.Accounts[accountName] = 0
+	}
+	return &w
+}
+
+// Update counts the messages of all the accounts
+// and writes the status file
+func (w *Writer) Update() error {
+	w.Lock()
+	defer w.Unlock()
+	for accountName := range w.status.Accounts {
+		err := w.count(accountName)
+		if err != nil {
+			return err
+		}
+	}
+	return w.write()
+}
+
+// MailboxChanged counts the messages of the given account and
+// writes the status file if the count changed. It's meant to be
+// passed to storage.Store's SetMailboxObserver.
+func (w *Writer) MailboxChanged(accountName string) {
+	w.Lock()
+	defer w.Unlock()
+	previous, ok := w.status.Accounts[accountName]
+	if !ok {
+		return
+	}
+	err := w.count(accountName)
+	if err != nil {
+		log.Errorf("status file: failed to count messages of %s: %s", accountName, err)
+		return
+	}
+	if w.status.Accounts[accountName] == previous {
+		return
+	}
+	err = w.write()
+	if err != nil {
+		log.Errorf("status file: failed to write %s: %s", w.fileName, err)
+	}
+}
+
+// count updates the message count of the given account
+func (w *Writer) count(accountName string) error {
+	count, err := w.store.MailboxCount(accountName)
+	if err != nil {
+		return err
+	}
+	w.status.Total += count - w.status.Accounts[accountName]
+	w.status.Accounts[accountName] = count
+	return nil
+}
+
+// write atomically replaces the status file
+func (w *Writer) write() error {
+	data, err := json.Marshal(&w.status)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(w.fileName), filepath.Base(w.fileName))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), w.fileName)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Remove removes the status file so that widgets
+// don't show stale counts once the client stops
+func (w *Writer) Remove() error {
+	w.Lock()
+	defer w.Unlock()
+	return os.Remove(w.fileName)
+}
@@ -0,0 +1,86 @@
+// status_file_test.go - unread message count tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package status_file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/client/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func readStatus(require *require.Assertions, fileName string) Status {
+	data, err := ioutil.ReadFile(fileName)
+	require.NoError(err, "unexpected ReadFile error")
+	status := Status{}
+	err = json.Unmarshal(data, &status)
+	require.NoError(err, "unexpected Unmarshal error")
+	return status
+}
+
+func TestStatusFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "status_file_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+
+	store, err := storage.New(filepath.Join(dir, "db"))
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	accounts := []string{"alice@acme.com", "bob@nsa.gov"}
+	err = store.CreateAccountBuckets(accounts)
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutMessage("alice@acme.com", []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	fileName := filepath.Join(dir, "status.json")
+	w := New(fileName, store, accounts)
+	err = w.Update()
+	require.NoError(err, "unexpected Update() error")
+	status := readStatus(require, fileName)
+	require.Equal(map[string]int{"alice@acme.com": 1, "bob@nsa.gov": 0}, status.Accounts)
+	require.Equal(1, status.Total)
+
+	store.SetMailboxObserver(w.MailboxChanged)
+	err = store.PutMessage("bob@nsa.gov", []byte("hi"))
+	require.NoError(err, "unexpected PutMessage() error")
+	err = store.PutMessage("bob@nsa.gov", []byte("hi again"))
+	require.NoError(err, "unexpected PutMessage() error")
+	status = readStatus(require, fileName)
+	require.Equal(2, status.Accounts["bob@nsa.gov"])
+	require.Equal(3, status.Total)
+
+	err = store.DeleteMessages("alice@acme.com", []int{1})
+	require.NoError(err, "unexpected DeleteMessages() error")
+	status = readStatus(require, fileName)
+	require.Equal(0, status.Accounts["alice@acme.com"])
+	require.Equal(2, status.Total)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err, "unexpected ReadDir error")
+	require.Len(files, 2, "temporary status files were left behind")
+
+	err = w.Remove()
+	require.NoError(err, "unexpected Remove() error")
+	_, err = os.Stat(fileName)
+	require.True(os.IsNotExist(err))
+}
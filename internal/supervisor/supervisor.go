@@ -0,0 +1,290 @@
+// supervisor.go - goroutine supervision
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package supervisor owns the long-running goroutines of the daemon:
+// a worker which panics or fails is logged with it's stack trace and
+// restarted with an exponential backoff, and once it fails too often
+// the Supervisor escalates by halting every worker and shutting
+// down the daemon, instead of a single crashed goroutine silently
+// taking down one service.
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// ErrHalted is returned by Err once the Supervisor
+// was halted without escalation
+var ErrHalted = errors.New("supervisor halted")
+
+// Worker is the function of a supervised goroutine, it must return
+// once halt is closed. A Worker returning nil before that is done
+// and isn't restarted, one returning an error or panicking is.
+type Worker func(halt <-chan struct{}) error
+
+// PanicError is the failure of a Worker which panicked
+type PanicError struct {
+	// Value is the value the Worker panicked with
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+// Error returns the panic value
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// EscalationError is the error of a Supervisor which
+// escalated after repeated failures of a Worker
+type EscalationError struct {
+	// Name is the name of the failing Worker
+	Name string
+	// Failures is the number of failures within the failure window
+	Failures int
+	// Err is the last failure of the Worker
+	Err error
+}
+
+// Error describes the escalation
+func (e *EscalationError) Error() string {
+	return fmt.Sprintf("worker %s failed %d times, last failure: %s", e.Name, e.Failures, e.Err)
+}
+
+// Supervisor runs and restarts Workers
+type Supervisor struct {
+	sync.Mutex
+
+	clock         clock.Clock
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxFailures   int
+	failureWindow time.Duration
+	shutdown      func(error)
+
+	// failures holds the recent failure times of each Worker
+	failures map[string][]time.Time
+
+	err      error
+	haltCh   chan struct{}
+	haltOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a new Supervisor with the default backoff and
+// escalation thresholds, see the Supervisor constants
+func New() *Supervisor {
+	return &Supervisor{
+		clock:         clock.Real,
+		minBackoff:    constants.SupervisorMinBackoff,
+		maxBackoff:    constants.SupervisorMaxBackoff,
+		maxFailures:   constants.SupervisorMaxFailures,
+		failureWindow: constants.SupervisorFailureWindow,
+		failures:      make(map[string][]time.Time),
+		haltCh:        make(chan struct{}),
+	}
+}
+
+// SetClock sets the Clock of the restart backoff and failure window
+func (s *Supervisor) SetClock(c clock.Clock) {
+	s.Lock()
+	defer s.Unlock()
+	s.clock = c
+}
+
+// SetBackoff sets the delay before the first restart of a failed
+// Worker, which doubles with each failure up to max
+func (s *Supervisor) SetBackoff(min, max time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.minBackoff = min
+	s.maxBackoff = max
+}
+
+// SetEscalation sets the number of failures of a Worker
+// within the given window after which the Supervisor escalates
+func (s *Supervisor) SetEscalation(maxFailures int, window time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.maxFailures = maxFailures
+	s.failureWindow = window
+}
+
+// SetShutdown sets the function called in it's own goroutine
+// when the Supervisor escalates, it should shut the daemon down
+func (s *Supervisor) SetShutdown(f func(error)) {
+	s.Lock()
+	defer s.Unlock()
+	s.shutdown = f
+}
+
+// Go runs the given Worker under supervision until the Supervisor is
+// halted. The Worker isn't started if the Supervisor is already halted.
+func (s *Supervisor) Go(name string, w Worker) {
+	select {
+	case <-s.haltCh:
+		return
+	default:
+	}
+	s.wg.Add(1)
+	go s.supervise(name, w)
+}
+
+// supervise runs the given Worker and restarts it after each failure
+func (s *Supervisor) supervise(name string, w Worker) {
+	defer s.wg.Done()
+	for {
+		err := run(w, s.haltCh)
+		select {
+		case <-s.haltCh:
+			return
+		default:
+		}
+		if err == nil {
+			return
+		}
+		backoff, ok := s.fail(name, err)
+		if !ok {
+			return
+		}
+		log.Noticef("restarting worker %s in %s", name, backoff)
+		s.Lock()
+		timer := s.clock.NewTimer(backoff)
+		s.Unlock()
+		select {
+		case <-s.haltCh:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Recover recovers a panic of the named task and records it as a
+// failure, it must be deferred by the task, e.g. the task handler
+// of a scheduler, which continues to run afterwards
+func (s *Supervisor) Recover(name string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	s.fail(name, &PanicError{
+		Value: v,
+		Stack: debug.Stack(),
+	})
+}
+
+// fail logs and records the given failure of the named Worker or task,
+// it returns the backoff before it's restart, or false if the
+// Supervisor escalated instead
+func (s *Supervisor) fail(name string, err error) (time.Duration, bool) {
+	if p, ok := err.(*PanicError); ok {
+		log.Errorf("worker %s panicked: %v\n%s", name, p.Value, p.Stack)
+	} else {
+		log.Errorf("worker %s failed: %s", name, err)
+	}
+	s.Lock()
+	now := s.clock.Now()
+	recent := []time.Time{}
+	for _, t := range s.failures[name] {
+		if now.Sub(t) < s.failureWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	s.failures[name] = recent
+	if len(recent) >= s.maxFailures {
+		s.Unlock()
+		s.escalate(&EscalationError{
+			Name:     name,
+			Failures: len(recent),
+			Err:      err,
+		})
+		return 0, false
+	}
+	backoff := s.minBackoff << uint(len(recent)-1)
+	if backoff > s.maxBackoff || backoff <= 0 {
+		backoff = s.maxBackoff
+	}
+	s.Unlock()
+	return backoff, true
+}
+
+// run calls the given Worker and returns it's
+// error, or a PanicError if it panicked
+func run(w Worker, halt <-chan struct{}) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{
+				Value: v,
+				Stack: debug.Stack(),
+			}
+		}
+	}()
+	return w(halt)
+}
+
+// escalate halts every Worker and calls the shutdown function
+func (s *Supervisor) escalate(err *EscalationError) {
+	log.Criticalf("%s, shutting down", err)
+	s.Lock()
+	shutdown := s.shutdown
+	s.Unlock()
+	s.stop(err)
+	if shutdown != nil {
+		go shutdown(err)
+	}
+}
+
+// stop closes the halt channel, recording the given error
+func (s *Supervisor) stop(err error) {
+	s.haltOnce.Do(func() {
+		s.Lock()
+		s.err = err
+		s.Unlock()
+		close(s.haltCh)
+	})
+}
+
+// Done returns a channel closed once the Supervisor is halted,
+// either by Halt or because it escalated
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.haltCh
+}
+
+// Err returns nil while the Supervisor runs, then ErrHalted
+// or the EscalationError of the Worker which failed too often
+func (s *Supervisor) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// Halt halts every Worker and waits for them to return
+func (s *Supervisor) Halt() {
+	s.stop(ErrHalted)
+	s.wg.Wait()
+}
@@ -0,0 +1,133 @@
+// supervisor_test.go - goroutine supervision tests
+// Copyright (C) 2017  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisorRestart(t *testing.T) {
+	require := require.New(t)
+
+	c := clock.NewFake(time.Unix(1500000000, 0))
+	s := New()
+	s.SetClock(c)
+	s.SetBackoff(time.Second, 4*time.Second)
+	s.SetEscalation(3, time.Minute)
+	runs := make(chan int, 10)
+	n := 0
+	s.Go("test", func(halt <-chan struct{}) error {
+		n++
+		runs <- n
+		if n < 3 {
+			panic("boom")
+		}
+		<-halt
+		return nil
+	})
+	timerPending := func() bool { return c.Pending() == 1 }
+
+	require.Equal(1, <-runs)
+	require.Eventually(timerPending, time.Second, time.Millisecond)
+	c.Advance(time.Second)
+	require.Equal(2, <-runs)
+
+	// the backoff doubles
+	require.Eventually(timerPending, time.Second, time.Millisecond)
+	c.Advance(time.Second)
+	require.Empty(runs)
+	c.Advance(time.Second)
+	require.Equal(3, <-runs)
+	require.NoError(s.Err())
+
+	s.Halt()
+	require.Equal(ErrHalted, s.Err())
+	// no worker is started once halted
+	s.Go("late", func(halt <-chan struct{}) error {
+		panic("started after halt")
+	})
+}
+
+func TestSupervisorEscalation(t *testing.T) {
+	require := require.New(t)
+
+	c := clock.NewFake(time.Unix(1500000000, 0))
+	s := New()
+	s.SetClock(c)
+	s.SetBackoff(time.Second, time.Second)
+	s.SetEscalation(3, time.Minute)
+	shutdown := make(chan error, 1)
+	s.SetShutdown(func(err error) {
+		shutdown <- err
+	})
+	failure := errors.New("failure")
+	s.Go("failing", func(halt <-chan struct{}) error {
+		return failure
+	})
+	// a worker returning nil is done
+	s.Go("done", func(halt <-chan struct{}) error {
+		return nil
+	})
+	blocked := make(chan struct{})
+	s.Go("blocked", func(halt <-chan struct{}) error {
+		<-halt
+		close(blocked)
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		require.Eventually(func() bool { return c.Pending() == 1 }, time.Second, time.Millisecond)
+		c.Advance(time.Second)
+	}
+	err := <-shutdown
+	<-s.Done()
+	<-blocked
+	e, ok := err.(*EscalationError)
+	require.True(ok)
+	require.Equal("failing", e.Name)
+	require.Equal(3, e.Failures)
+	require.Equal(failure, e.Err)
+	require.Equal(err, s.Err())
+	s.Halt()
+	require.Equal(err, s.Err())
+}
+
+func TestSupervisorRecover(t *testing.T) {
+	require := require.New(t)
+
+	s := New()
+	s.SetEscalation(2, time.Minute)
+	task := func() {
+		defer s.Recover("task")
+		panic("boom")
+	}
+	task()
+	require.NoError(s.Err())
+	task()
+	e, ok := s.Err().(*EscalationError)
+	require.True(ok)
+	p, ok := e.Err.(*PanicError)
+	require.True(ok)
+	require.Equal("boom", p.Value)
+	require.Contains(string(p.Stack), "TestSupervisorRecover")
+	s.Halt()
+}
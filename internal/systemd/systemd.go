@@ -0,0 +1,254 @@
+// systemd.go - systemd socket activation and service notification
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+// Package systemd integrates the client daemon with systemd: it
+// accepts the SMTP, POP3, management and health check listeners
+// passed by socket activation, notifies the service manager of the daemon's state and
+// pings the service watchdog. Every function is a no-op when the
+// daemon isn't run by systemd.
+//
+// The listeners are named by the FileDescriptorName= of their socket
+// units, SMTPListener, POP3Listener, ManagementListener and
+// HealthCheckListener.
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+const (
+	// SMTPListener is the name of the SMTP submission proxy listener
+	SMTPListener = "smtp"
+
+	// POP3Listener is the name of the POP3 receive proxy listener
+	POP3Listener = "pop3"
+
+	// ManagementListener is the name of the listener of the
+	// management commands, see package management
+	ManagementListener = "management"
+
+	// HealthCheckListener is the name of the listener
+	// of the health check endpoints, see package health_check
+	HealthCheckListener = "health"
+
+	// Ready is the state sent once the daemon is started
+	Ready = "READY=1"
+
+	// Stopping is the state sent when the daemon starts to stop
+	Stopping = "STOPPING=1"
+
+	// WatchdogPing is the state sent to keep the watchdog from
+	// restarting the daemon
+	WatchdogPing = "WATCHDOG=1"
+
+	// listenFDsStart is the first file descriptor passed by
+	// socket activation, after stdin, stdout and stderr
+	listenFDsStart = 3
+)
+
+// Listeners returns the named listeners passed by socket activation,
+// or an empty map if the daemon wasn't socket activated. The socket
+// activation environment variables are unset so that they aren't
+// inherited by child processes. On error every passed file
+// descriptor is closed.
+func Listeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	names, err := listenNames(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	fds := make([]int, len(names))
+	for i := range fds {
+		fds[i] = listenFDsStart + i
+	}
+	return listenersFromFDs(names, fds)
+}
+
+// listenersFromFDs returns the named listeners of the given file
+// descriptors, which are all closed on error
+func listenersFromFDs(names []string, fds []int) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	for i, name := range names {
+		syscall.CloseOnExec(fds[i])
+		f := os.NewFile(uintptr(fds[i]), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			if _, ok := listeners[name]; ok {
+				l.Close()
+				err = fmt.Errorf("duplicate socket activated listener %s", name)
+			}
+		} else {
+			err = fmt.Errorf("socket activated listener %s: %s", name, err)
+		}
+		if err != nil {
+			// the listeners opened so far and the
+			// remaining descriptors would leak
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, fd := range fds[i+1:] {
+				syscall.Close(fd)
+			}
+			return nil, err
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// listenNames returns the names of the file descriptors passed by
+// socket activation given the values of the LISTEN_PID, LISTEN_FDS
+// and LISTEN_FDNAMES environment variables, none if they were meant
+// for another process
+func listenNames(pidEnv, fdsEnv, namesEnv string, pid int) ([]string, error) {
+	if pidEnv == "" || fdsEnv == "" {
+		return nil, nil
+	}
+	listenPid, err := strconv.Atoi(pidEnv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID: %s", err)
+	}
+	if listenPid != pid {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fdsEnv)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if namesEnv == "" {
+		return nil, errors.New("socket activated listeners without FileDescriptorName")
+	}
+	names := strings.Split(namesEnv, ":")
+	if len(names) != n {
+		return nil, fmt.Errorf("LISTEN_FDNAMES names %d listeners, expected %d", len(names), n)
+	}
+	return names, nil
+}
+
+// Notify sends the given state, e.g. Ready, to the service
+// manager, it does nothing if NOTIFY_SOCKET isn't set
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the watchdog timeout of the service, or
+// zero if the watchdog isn't enabled for this process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Watchdog pings the service watchdog at half it's timeout
+// as long as the daemon passes it's health check
+type Watchdog struct {
+	sync.WaitGroup
+
+	interval time.Duration
+	healthy  func() bool
+	haltCh   chan struct{}
+}
+
+// NewWatchdog creates a new Watchdog of the given timeout, see
+// WatchdogInterval. If healthy isn't nil the watchdog is only
+// pinged while it returns true, e.g. health_check.Checker.Healthy,
+// so that systemd restarts a daemon which is stuck.
+func NewWatchdog(timeout time.Duration, healthy func() bool) *Watchdog {
+	return &Watchdog{
+		interval: timeout / 2,
+		healthy:  healthy,
+		haltCh:   make(chan struct{}),
+	}
+}
+
+// Start starts pinging the watchdog
+func (w *Watchdog) Start() {
+	w.Add(1)
+	go w.worker()
+}
+
+// Stop stops pinging the watchdog
+func (w *Watchdog) Stop() {
+	close(w.haltCh)
+	w.Wait()
+}
+
+func (w *Watchdog) worker() {
+	defer w.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.haltCh:
+			return
+		case <-ticker.C:
+		}
+		if w.healthy != nil && !w.healthy() {
+			log.Warning("health check failed, not pinging the systemd watchdog")
+			continue
+		}
+		err := Notify(WatchdogPing)
+		if err != nil {
+			log.Errorf("failed to ping the systemd watchdog: %s", err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// systemd_test.go - systemd integration tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenNames(t *testing.T) {
+	require := require.New(t)
+
+	names, err := listenNames("", "", "", 42)
+	require.NoError(err, "listenNames failed")
+	require.Nil(names)
+	names, err = listenNames("41", "2", "smtp:pop3", 42)
+	require.NoError(err, "listenNames failed")
+	require.Nil(names, "listeners of another process accepted")
+	names, err = listenNames("42", "2", "smtp:pop3", 42)
+	require.NoError(err, "listenNames failed")
+	require.Equal([]string{SMTPListener, POP3Listener}, names)
+
+	_, err = listenNames("42", "2", "smtp", 42)
+	require.Error(err, "LISTEN_FDNAMES mismatch not detected")
+	_, err = listenNames("42", "1", "", 42)
+	require.Error(err, "missing LISTEN_FDNAMES not detected")
+	_, err = listenNames("42", "x", "smtp", 42)
+	require.Error(err, "invalid LISTEN_FDS not detected")
+
+	listeners, err := Listeners()
+	require.NoError(err, "Listeners failed")
+	require.Equal(0, len(listeners))
+}
+
+func TestListenersFromFDs(t *testing.T) {
+	require := require.New(t)
+
+	dup := func(l net.Listener) int {
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(err, "File failed")
+		defer f.Close()
+		fd, err := syscall.Dup(int(f.Fd()))
+		require.NoError(err, "Dup failed")
+		return fd
+	}
+	smtp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen failed")
+	defer smtp.Close()
+	pop3, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen failed")
+	defer pop3.Close()
+	r, w, err := os.Pipe()
+	require.NoError(err, "Pipe failed")
+	defer w.Close()
+	pipe, err := syscall.Dup(int(r.Fd()))
+	require.NoError(err, "Dup failed")
+	r.Close()
+
+	listeners, err := listenersFromFDs([]string{SMTPListener, ManagementListener}, []int{dup(smtp), dup(pop3)})
+	require.NoError(err, "listenersFromFDs failed")
+	require.Equal(2, len(listeners))
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	// a descriptor which isn't a socket fails them all
+	last := dup(pop3)
+	_, err = listenersFromFDs([]string{SMTPListener, "pipe", POP3Listener}, []int{dup(smtp), pipe, last})
+	require.Error(err, "a pipe was accepted as listener")
+	_, err = syscall.Dup(last)
+	require.Equal(syscall.EBADF, err, "the remaining descriptor wasn't closed")
+}
+
+func TestNotify(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(Notify(Ready), "Notify without NOTIFY_SOCKET failed")
+
+	dir, err := ioutil.TempDir("", "systemd_test")
+	require.NoError(err, "TempDir failed")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(err, "ListenUnixgram failed")
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	receive := func() string {
+		b := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(b)
+		require.NoError(err, "Read failed")
+		return string(b[:n])
+	}
+
+	require.NoError(Notify(Ready), "Notify failed")
+	require.Equal("READY=1", receive())
+
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	timeout, err := WatchdogInterval()
+	require.NoError(err, "WatchdogInterval failed")
+	require.Equal(20*time.Millisecond, timeout)
+	w := NewWatchdog(timeout, func() bool { return true })
+	w.Start()
+	require.Equal("WATCHDOG=1", receive())
+	w.Stop()
+
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	timeout, err = WatchdogInterval()
+	require.NoError(err, "WatchdogInterval failed")
+	require.Equal(time.Duration(0), timeout, "watchdog of another process enabled")
+}
@@ -0,0 +1,39 @@
+// obfs4.go - obfs4 transport
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"errors"
+)
+
+// NewObfs4 returns a Transport which obfuscates the link with a
+// locally running obfs4 client such as obfs4proxy, by connecting
+// through it's SOCKS5 listener at the given address. As specified
+// for pluggable transport clients, the bridge arguments are passed
+// as the SOCKS5 credentials, split across the username and password
+// if they don't fit the username. The obfs4 client must already be
+// running, it isn't launched by the Transport.
+func NewObfs4(proxyAddress, args string) (*SOCKS5, error) {
+	if len(args) > 2*255 {
+		return nil, errors.New("obfs4: bridge arguments too long")
+	}
+	user, password := args, "\x00"
+	if len(args) > 255 {
+		user, password = args[:255], args[255:]
+	}
+	return NewSOCKS5(proxyAddress, user, password), nil
+}
@@ -0,0 +1,200 @@
+// socks.go - SOCKS5 transport
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion           = 5
+	socksAuthNone          = 0x00
+	socksAuthPassword      = 0x02
+	socksPasswordVersion   = 1
+	socksConnect           = 0x01
+	socksAddressIPv4       = 0x01
+	socksAddressDomainName = 0x03
+	socksAddressIPv6       = 0x04
+	socksSucceeded         = 0x00
+
+	// socksHandshakeTimeout is the maximum duration
+	// of the handshake with the SOCKS5 proxy
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// SOCKS5 tunnels the link through a SOCKS5 proxy, see RFC 1928
+type SOCKS5 struct {
+	proxyAddress string
+	user         string
+	password     string
+}
+
+// NewSOCKS5 returns a new *SOCKS5 transport which connects through
+// the proxy at the given address, with username/password
+// authentication (RFC 1929) unless user is empty
+func NewSOCKS5(proxyAddress, user, password string) *SOCKS5 {
+	s := SOCKS5{
+		proxyAddress: proxyAddress,
+		user:         user,
+		password:     password,
+	}
+	return &s
+}
+
+// Dial connects to the given address through the proxy
+func (s *SOCKS5) Dial(address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", s.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err == nil {
+		err = s.connect(conn, address)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect performs the SOCKS5 handshake requesting
+// a connection to the given address
+func (s *SOCKS5) connect(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks5: invalid port %q", portString)
+	}
+
+	method := byte(socksAuthNone)
+	if s.user != "" {
+		method = socksAuthPassword
+	}
+	_, err = conn.Write([]byte{socksVersion, 1, method})
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("socks5: unexpected protocol version")
+	}
+	if reply[1] != method {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if method == socksAuthPassword {
+		err = s.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, socksAddressIPv4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, socksAddressIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		request = append(request, socksAddressDomainName, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errors.New("socks5: unexpected protocol version")
+	}
+	if header[1] != socksSucceeded {
+		return fmt.Errorf("socks5: connect to %s failed with reply %d", address, header[1])
+	}
+	// discard the bound address and port
+	length := 0
+	switch header[3] {
+	case socksAddressIPv4:
+		length = net.IPv4len
+	case socksAddressIPv6:
+		length = net.IPv6len
+	case socksAddressDomainName:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(conn, l)
+		if err != nil {
+			return err
+		}
+		length = int(l[0])
+	default:
+		return errors.New("socks5: unknown address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, length+2))
+	return err
+}
+
+// authenticate performs the username/password
+// authentication, see RFC 1929
+func (s *SOCKS5) authenticate(conn net.Conn) error {
+	if len(s.user) > 255 || len(s.password) > 255 {
+		return errors.New("socks5: credentials too long")
+	}
+	request := []byte{socksPasswordVersion, byte(len(s.user))}
+	request = append(request, s.user...)
+	request = append(request, byte(len(s.password)))
+	request = append(request, s.password...)
+	_, err := conn.Write(request)
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[1] != socksSucceeded {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
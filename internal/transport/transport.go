@@ -0,0 +1,75 @@
+// transport.go - Provider link transports
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package transport provides the transports which connect the client
+// to it's Providers, so that the wire protocol link may be tunneled
+// through a proxy or obfuscated on networks which block or fingerprint
+// the raw wire protocol.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/katzenpost/client/config"
+)
+
+const (
+	// TypeTCP is the plain TCP transport, the default
+	TypeTCP = "tcp"
+	// TypeSOCKS5 tunnels the link through a SOCKS5 proxy
+	TypeSOCKS5 = "socks5"
+	// TypeObfs4 obfuscates the link with a local obfs4 client
+	TypeObfs4 = "obfs4"
+)
+
+// Transport connects to a Provider endpoint
+type Transport interface {
+	// Dial connects to the given endpoint address
+	Dial(address string) (net.Conn, error)
+}
+
+// TCP is the plain TCP transport
+type TCP struct{}
+
+// Dial connects to the given address over TCP
+func (t *TCP) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+// New returns the Transport of the given configuration,
+// the TCP transport is returned if cfg is nil
+func New(cfg *config.Transport) (Transport, error) {
+	if cfg == nil {
+		return &TCP{}, nil
+	}
+	switch cfg.Type {
+	case "", TypeTCP:
+		return &TCP{}, nil
+	case TypeSOCKS5:
+		if cfg.ProxyAddress == "" {
+			return nil, errors.New("socks5 transport requires a ProxyAddress")
+		}
+		return NewSOCKS5(cfg.ProxyAddress, cfg.ProxyUser, cfg.ProxyPassword), nil
+	case TypeObfs4:
+		if cfg.ProxyAddress == "" || cfg.Args == "" {
+			return nil, errors.New("obfs4 transport requires a ProxyAddress and Args")
+		}
+		return NewObfs4(cfg.ProxyAddress, cfg.Args)
+	}
+	return nil, fmt.Errorf("unknown transport type %q", cfg.Type)
+}
@@ -0,0 +1,139 @@
+// transport_test.go - Provider link transport tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/config"
+	"github.com/stretchr/testify/require"
+)
+
+// socksRequest is what the fake SOCKS5 proxy received
+type socksRequest struct {
+	user     string
+	password string
+	host     string
+	port     uint16
+	err      error
+}
+
+// fakeSOCKS5 accepts a single connection, performs the proxy side
+// of the SOCKS5 handshake and then echoes what it receives
+func fakeSOCKS5(listener net.Listener, requests chan<- *socksRequest) {
+	r := socksRequest{}
+	conn, err := listener.Accept()
+	if err != nil {
+		r.err = err
+		requests <- &r
+		return
+	}
+	defer conn.Close()
+	readString := func() string {
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		s := make([]byte, l[0])
+		io.ReadFull(conn, s)
+		return string(s)
+	}
+	greeting := make([]byte, 3)
+	_, r.err = io.ReadFull(conn, greeting)
+	conn.Write([]byte{socksVersion, greeting[2]})
+	if greeting[2] == socksAuthPassword {
+		io.ReadFull(conn, make([]byte, 1))
+		r.user = readString()
+		r.password = readString()
+		conn.Write([]byte{socksPasswordVersion, socksSucceeded})
+	}
+	header := make([]byte, 4)
+	io.ReadFull(conn, header)
+	switch header[3] {
+	case socksAddressIPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		r.host = net.IP(ip).String()
+	case socksAddressDomainName:
+		r.host = readString()
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	r.port = binary.BigEndian.Uint16(port)
+	conn.Write([]byte{socksVersion, socksSucceeded, 0, socksAddressIPv4, 127, 0, 0, 1, 0, 0})
+	requests <- &r
+	io.Copy(conn, conn)
+}
+
+func TestSOCKS5(t *testing.T) {
+	require := require.New(t)
+
+	for _, cfg := range []*config.Transport{
+		{Type: TypeSOCKS5},
+		{Type: TypeSOCKS5, ProxyUser: "alice", ProxyPassword: "secret"},
+		{Type: TypeObfs4, Args: "cert=AAAA;iat-mode=0"},
+		{Type: TypeObfs4, Args: "cert=" + strings.Repeat("A", 300)},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err, "unexpected Listen error")
+		requests := make(chan *socksRequest, 1)
+		go fakeSOCKS5(listener, requests)
+
+		cfg.ProxyAddress = listener.Addr().String()
+		transport, err := New(cfg)
+		require.NoError(err, "unexpected New() error")
+		conn, err := transport.Dial("provider.example.org:29483")
+		require.NoError(err, "unexpected Dial() error")
+		r := <-requests
+		require.NoError(r.err)
+		require.Equal("provider.example.org", r.host)
+		require.Equal(uint16(29483), r.port)
+		switch {
+		case cfg.Type == TypeObfs4 && len(cfg.Args) > 255:
+			require.Equal(cfg.Args, r.user+r.password)
+		case cfg.Type == TypeObfs4:
+			require.Equal(cfg.Args, r.user)
+			require.Equal("\x00", r.password)
+		default:
+			require.Equal(cfg.ProxyUser, r.user)
+			require.Equal(cfg.ProxyPassword, r.password)
+		}
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(err, "unexpected Write error")
+		pong := make([]byte, 4)
+		_, err = io.ReadFull(conn, pong)
+		require.NoError(err, "unexpected Read error")
+		require.Equal("ping", string(pong))
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestNew(t *testing.T) {
+	require := require.New(t)
+
+	transport, err := New(nil)
+	require.NoError(err, "unexpected New() error")
+	require.IsType(&TCP{}, transport)
+	_, err = New(&config.Transport{Type: "carrier-pigeon"})
+	require.Error(err)
+	_, err = New(&config.Transport{Type: TypeObfs4, ProxyAddress: "127.0.0.1:9050"})
+	require.Error(err, "obfs4 without bridge arguments was accepted")
+}
@@ -0,0 +1,241 @@
+// wipe.go - emergency destruction of the local data
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package wipe destroys the local data of the client for users in
+// high-risk situations who need a fast way to get rid of it: the
+// sessions are terminated, the key files, vaults and database are
+// overwritten and unlinked, and the process exits. Overwriting
+// doesn't reach the copies left behind by journaling or copy-on-write
+// filesystems or by the wear leveling of flash storage, full disk
+// encryption is still advised.
+package wipe
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// ExitCode is the exit code of the process once wiped, it's zero
+// so that a service manager doesn't restart the client
+const ExitCode = 0
+
+// Wiper destroys the registered files and directories
+type Wiper struct {
+	sync.Mutex
+
+	paths    []string
+	patterns []string
+	halts    []func() error
+	exit     func(code int)
+	wiping   bool
+}
+
+// New creates a new Wiper which exits the process once it wiped
+func New() *Wiper {
+	return &Wiper{
+		exit: os.Exit,
+	}
+}
+
+// SetExit sets the function called with ExitCode once
+// wiped instead of os.Exit, e.g. in tests
+func (w *Wiper) SetExit(exit func(code int)) {
+	w.Lock()
+	defer w.Unlock()
+	w.exit = exit
+}
+
+// AddPath registers a file or a directory, e.g. the keys
+// directory, the database file or a vault, to be destroyed
+func (w *Wiper) AddPath(path string) {
+	w.Lock()
+	defer w.Unlock()
+	w.paths = append(w.paths, path)
+}
+
+// AddPattern registers the files and directories matching the
+// given pattern, see filepath.Match, to be destroyed, e.g. the
+// temporary files which don't exist yet. The pattern is only
+// matched when wiping.
+func (w *Wiper) AddPattern(pattern string) {
+	w.Lock()
+	defer w.Unlock()
+	w.patterns = append(w.patterns, pattern)
+}
+
+// OnWipe registers a function called before the files are
+// destroyed, e.g. session_pool.SessionPool.Close to terminate
+// the sessions or storage.Store.Close to release the database
+func (w *Wiper) OnWipe(halt func() error) {
+	w.Lock()
+	defer w.Unlock()
+	w.halts = append(w.halts, halt)
+}
+
+// Wipe calls the functions registered with OnWipe, destroys the
+// registered paths and those matching the patterns and exits. The failure to destroy one path
+// doesn't stop the destruction of the others, the first error is
+// returned if the exit function returns. Wipe is only run once.
+func (w *Wiper) Wipe() error {
+	w.Lock()
+	if w.wiping {
+		w.Unlock()
+		return nil
+	}
+	w.wiping = true
+	paths := w.paths
+	patterns := w.patterns
+	halts := w.halts
+	exit := w.exit
+	w.Unlock()
+
+	log.Warning("wiping the local data")
+	var first error
+	for _, halt := range halts {
+		err := halt()
+		if err != nil {
+			log.Errorf("wipe: %s", err)
+		}
+	}
+	for _, path := range paths {
+		err := Shred(path)
+		if err != nil {
+			log.Errorf("wipe: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		err := ShredPattern(pattern)
+		if err != nil {
+			log.Errorf("wipe: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	exit(ExitCode)
+	return first
+}
+
+// WipeOn wipes once one of the given signals is received,
+// e.g. syscall.SIGUSR2, until the returned function is called
+func (w *Wiper) WipeOn(signals ...os.Signal) func() {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, signals...)
+	go func() {
+		select {
+		case <-c:
+			w.Wipe()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// ShredFile overwrites the given file with random data, flushes
+// it to the disk and then unlinks it. The file is unlinked even
+// if it can't be overwritten, the first error is returned.
+func ShredFile(path string) error {
+	err := overwrite(path)
+	if removeErr := os.Remove(path); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// overwrite overwrites the given file with random
+// data and flushes it to the disk
+func overwrite(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, entropy.Reader, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Shred shreds the given file, or every file below the given
+// directory which is then removed, a missing path is ignored
+func Shred(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return os.Remove(path)
+		}
+		return ShredFile(path)
+	}
+	var first error
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			err = ShredFile(p)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		return nil
+	})
+	err = os.RemoveAll(path)
+	if first == nil {
+		first = err
+	}
+	return first
+}
+
+// ShredPattern shreds the files and directories matching the given
+// pattern, see filepath.Match, the first failure is returned
+func ShredPattern(pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, path := range matches {
+		err = Shred(path)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,95 @@
+// wipe_test.go - emergency wipe tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package wipe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWipe(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "wipe_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+
+	keysDir := filepath.Join(dir, "keys")
+	err = os.MkdirAll(filepath.Join(keysDir, "alice@acme.com"), 0700)
+	require.NoError(err, "unexpected MkdirAll error")
+	keyFile := filepath.Join(keysDir, "alice@acme.com", "e2e.private.pem")
+	err = ioutil.WriteFile(keyFile, []byte("private key"), 0600)
+	require.NoError(err, "unexpected WriteFile error")
+	dbFile := filepath.Join(dir, "client.db")
+	err = ioutil.WriteFile(dbFile, []byte("database"), 0600)
+	require.NoError(err, "unexpected WriteFile error")
+
+	w := New()
+	exitCode := -1
+	w.SetExit(func(code int) {
+		exitCode = code
+	})
+	halted := false
+	w.OnWipe(func() error {
+		halted = true
+		return nil
+	})
+	w.AddPath(keysDir)
+	w.AddPath(dbFile)
+	w.AddPath(filepath.Join(dir, "missing.vault"))
+	w.AddPattern(dbFile + ".snapshot*")
+	snapshotFile := dbFile + ".snapshot42"
+	err = ioutil.WriteFile(snapshotFile, []byte("database"), 0600)
+	require.NoError(err, "unexpected WriteFile error")
+
+	err = w.Wipe()
+	require.NoError(err, "Wipe failed")
+	require.True(halted, "OnWipe function not called")
+	require.Equal(ExitCode, exitCode)
+	_, err = os.Stat(keysDir)
+	require.True(os.IsNotExist(err), "keys directory not removed")
+	_, err = os.Stat(dbFile)
+	require.True(os.IsNotExist(err), "database not removed")
+	_, err = os.Stat(snapshotFile)
+	require.True(os.IsNotExist(err), "snapshot not removed")
+
+	// the wipe is only run once
+	exitCode = -1
+	require.NoError(w.Wipe(), "Wipe failed")
+	require.Equal(-1, exitCode)
+}
+
+func TestShredFileUnlinks(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "wipe_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+
+	// a directory can't be overwritten but it's still unlinked
+	path := filepath.Join(dir, "unwritable")
+	err = os.Mkdir(path, 0700)
+	require.NoError(err, "unexpected Mkdir error")
+	err = ShredFile(path)
+	require.Error(err, "the failure to overwrite was not reported")
+	_, err = os.Stat(path)
+	require.True(os.IsNotExist(err), "the path was not unlinked")
+}
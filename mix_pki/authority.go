@@ -0,0 +1,79 @@
+// authority.go - HTTP PKI authority client
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSignedDocumentSize is the maximum size in
+// bytes of an authority response we will read
+const maxSignedDocumentSize = 1 << 20
+
+// HTTPAuthority is a SignedClient which retrieves the signed PKI
+// documents of an authority from <base URL>/<epoch> as JSON
+// encoded SignedDocuments
+type HTTPAuthority struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPAuthority creates a new HTTPAuthority
+// for the authority at the given base URL
+func NewHTTPAuthority(baseURL string) *HTTPAuthority {
+	h := HTTPAuthority{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	return &h
+}
+
+// GetSigned retrieves the signed PKI document of the given epoch
+func (h *HTTPAuthority) GetSigned(ctx context.Context, epoch uint64) (*SignedDocument, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%d", h.baseURL, epoch), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("PKI document retrieval of epoch %d failed: %s", epoch, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignedDocumentSize))
+	if err != nil {
+		return nil, err
+	}
+	signed := SignedDocument{}
+	err = json.Unmarshal(body, &signed)
+	if err != nil {
+		return nil, err
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		signed.Date = date
+	}
+	return &signed, nil
+}
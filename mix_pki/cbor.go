@@ -18,12 +18,17 @@
 package mix_pki
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"sort"
 
-	"github.com/2tvenom/cbor"
+	cbor "github.com/katzenpost/client/internal/canonical_cbor"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/pki"
@@ -64,48 +69,203 @@ func NewStaticPKI() *StaticPKI {
 	return &staticPKI
 }
 
+// StaticPKIFromFile reads a StaticPKI from the
+// given file, see StaticPKIFromReader
 func StaticPKIFromFile(pkiFile string) (*StaticPKI, error) {
-	epochMap := make(map[uint64]*pki.Document)
-	var buffTest bytes.Buffer
-	encoder := cbor.NewEncoder(&buffTest)
-	b, err := ioutil.ReadFile(pkiFile)
+	f, err := os.Open(pkiFile)
 	if err != nil {
 		return nil, err
 	}
-	_, err = encoder.Unmarshal(b, &epochMap)
+	defer f.Close()
+	return StaticPKIFromReader(f)
+}
+
+// StaticPKIFromReader decodes a StaticPKI written by
+// Encode, files of the previous format are still read
+func StaticPKIFromReader(r io.Reader) (*StaticPKI, error) {
+	br := bufio.NewReader(r)
+	if !isCanonical(br) {
+		b, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return legacyStaticPKIFromCBOR(b)
+	}
+	w := wireStaticPKI{}
+	err := cbor.NewDecoder(br).Decode(&w)
 	if err != nil {
 		return nil, err
 	}
-	p := StaticPKI{
-		epochMap: epochMap,
+	if w.Version != wireVersion {
+		return nil, fmt.Errorf("unsupported static PKI version %d", w.Version)
+	}
+	documents := make([]*pki.Document, len(w.Documents))
+	for i := range w.Documents {
+		documents[i], err = fromWireDocument(w.Documents[i])
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &p, nil
+	return StaticPKIFromDocuments(documents)
+}
+
+// isCanonical returns true if the given reader starts
+// with the self-describe tag written by our encoder
+func isCanonical(br *bufio.Reader) bool {
+	b, err := br.Peek(len(cbor.SelfDescribe))
+	return err == nil && bytes.Equal(b, cbor.SelfDescribe)
+}
+
+// encode writes the self-described canonical encoding of v to w
+func encode(w io.Writer, v interface{}) error {
+	_, err := w.Write(cbor.SelfDescribe)
+	if err != nil {
+		return err
+	}
+	return cbor.NewEncoder(w).Encode(v)
+}
+
+// marshal returns the self-described canonical encoding of v
+func marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := encode(buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // DocsToCBOR takes a slice of Document structs and
 // returns the CBOR serialized output bytes
 func DocsToCBOR(documents []pki.Document) ([]byte, error) {
-	var buffTest bytes.Buffer
-	encoder := cbor.NewEncoder(&buffTest)
-	ok, err := encoder.Marshal(documents)
+	w := make([]*wireDocument, len(documents))
+	for i := range documents {
+		w[i] = toWireDocument(&documents[i])
+	}
+	return marshal(w)
+}
+
+// CBORKeysFromMap returns the CBOR serialized private
+// keys indexed by their public keys
+func CBORKeysFromMap(keysMap map[[32]byte]*ecdh.PrivateKey) ([]byte, error) {
+	w := wireKeys{
+		Version: wireVersion,
+		Keys:    make(map[[32]byte][]byte),
+	}
+	for publicKey, privateKey := range keysMap {
+		w.Keys[publicKey] = privateKey.Bytes()
+	}
+	return marshal(&w)
+}
+
+// CBORKeysToMap returns the private keys serialized by
+// CBORKeysFromMap. The previous format isn't supported,
+// it lacked the private key material.
+func CBORKeysToMap(b []byte) (map[[32]byte]*ecdh.PrivateKey, error) {
+	w := wireKeys{}
+	err := cbor.Unmarshal(b, &w)
 	if err != nil {
 		return nil, err
 	}
-	if !ok {
-		return nil, errors.New("wtf")
+	if w.Version != wireVersion {
+		return nil, fmt.Errorf("unsupported keys version %d", w.Version)
+	}
+	keysMap := make(map[[32]byte]*ecdh.PrivateKey)
+	for publicKey, b := range w.Keys {
+		privateKey := new(ecdh.PrivateKey)
+		err = privateKey.FromBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(privateKey.PublicKey().Bytes(), publicKey[:]) {
+			return nil, fmt.Errorf("private key doesn't match public key %x", publicKey)
+		}
+		keysMap[publicKey] = privateKey
 	}
-	return buffTest.Bytes(), nil
+	return keysMap, nil
 }
 
-func CBORKeysFromMap(keysMap map[[32]byte]*ecdh.PrivateKey) ([]byte, error) {
-	var buffTest bytes.Buffer
-	encoder := cbor.NewEncoder(&buffTest)
-	ok, err := encoder.Marshal(keysMap)
+// DocumentToCBOR returns the CBOR serialized document, the
+// encoding is canonical: equal documents have equal encodings
+func DocumentToCBOR(document *pki.Document) ([]byte, error) {
+	return marshal(toWireDocument(document))
+}
+
+// DocumentFromCBOR returns the document deserialized from
+// the given CBOR bytes, which may be of the previous format
+func DocumentFromCBOR(b []byte) (*pki.Document, error) {
+	if !bytes.HasPrefix(b, cbor.SelfDescribe) {
+		return legacyDocumentFromCBOR(b)
+	}
+	w := wireDocument{}
+	err := cbor.Unmarshal(b, &w)
 	if err != nil {
 		return nil, err
 	}
-	if !ok {
-		return nil, errors.New("wtf")
+	return fromWireDocument(&w)
+}
+
+// StaticPKIFromDocuments creates a new StaticPKI
+// holding the given documents indexed by epoch
+func StaticPKIFromDocuments(documents []*pki.Document) (*StaticPKI, error) {
+	staticPKI := NewStaticPKI()
+	for _, doc := range documents {
+		err := staticPKI.Set(doc.Epoch, doc)
+		if err != nil {
+			return nil, fmt.Errorf("duplicate document of epoch %d", doc.Epoch)
+		}
+	}
+	return staticPKI, nil
+}
+
+// Documents returns the documents of the StaticPKI sorted by epoch
+func (t *StaticPKI) Documents() []*pki.Document {
+	documents := []*pki.Document{}
+	for _, doc := range t.epochMap {
+		documents = append(documents, doc)
+	}
+	sort.Slice(documents, func(i, j int) bool {
+		return documents[i].Epoch < documents[j].Epoch
+	})
+	return documents
+}
+
+// Encode writes the documents of the StaticPKI
+// to w in the format read by StaticPKIFromReader
+func (t *StaticPKI) Encode(w io.Writer) error {
+	documents := t.Documents()
+	wire := wireStaticPKI{
+		Version:   wireVersion,
+		Documents: make([]*wireDocument, len(documents)),
+	}
+	for i, doc := range documents {
+		wire.Documents[i] = toWireDocument(doc)
+	}
+	return encode(w, &wire)
+}
+
+// ToCBOR returns the CBOR serialized documents of the
+// StaticPKI in the format read by StaticPKIFromFile
+func (t *StaticPKI) ToCBOR() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := t.Encode(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteFile writes the documents of the StaticPKI
+// to a file which can be read by StaticPKIFromFile
+func (t *StaticPKI) WriteFile(pkiFile string) error {
+	f, err := os.OpenFile(pkiFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = t.Encode(f)
+	if err != nil {
+		f.Close()
+		return err
 	}
-	return buffTest.Bytes(), nil
+	return f.Close()
 }
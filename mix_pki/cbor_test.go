@@ -0,0 +1,139 @@
+// cbor_test.go - PKI serialization tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/2tvenom/cbor"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+func generateDocument(require *require.Assertions) (*pki.Document, []byte) {
+	staticPKI, mixKeys, err := GenerateStaticPKI(rand.Reader, &Topology{
+		Layers:        3,
+		MixesPerLayer: 2,
+		Providers:     []string{"acme.com"},
+		StartEpoch:    7,
+		Epochs:        1,
+		BasePort:      30000,
+	})
+	require.NoError(err, "unexpected GenerateStaticPKI() error")
+	keys, err := CBORKeysFromMap(mixKeys)
+	require.NoError(err, "unexpected CBORKeysFromMap() error")
+	doc := staticPKI.Documents()[0]
+	doc.Providers[0].Kaetzchen = map[string]map[string]interface{}{
+		"loop": {"endpoint": "+loop"},
+	}
+	return doc, keys
+}
+
+func TestDocumentCBOR(t *testing.T) {
+	require := require.New(t)
+
+	doc, keys := generateDocument(require)
+	b, err := DocumentToCBOR(doc)
+	require.NoError(err, "unexpected DocumentToCBOR() error")
+	decoded, err := DocumentFromCBOR(b)
+	require.NoError(err, "unexpected DocumentFromCBOR() error")
+	// the empty layer 0 decodes as nil
+	require.Len(decoded.Topology[0], 0)
+	doc.Topology[0] = nil
+	require.Equal(doc, decoded)
+	// equal documents have equal encodings
+	again, err := DocumentToCBOR(decoded)
+	require.NoError(err, "unexpected DocumentToCBOR() error")
+	require.Equal(b, again)
+
+	mixKeys, err := CBORKeysToMap(keys)
+	require.NoError(err, "unexpected CBORKeysToMap() error")
+	require.Len(mixKeys, 3*2+1)
+	mixes, err := doc.GetMixesInLayer(1)
+	require.NoError(err, "unexpected GetMixesInLayer() error")
+	key := [32]byte{}
+	copy(key[:], mixes[0].MixKeys[7].Bytes())
+	require.Equal(mixes[0].MixKeys[7].Bytes(), mixKeys[key].PublicKey().Bytes())
+
+	// documents of the previous format are still read
+	var buffTest bytes.Buffer
+	_, err = cbor.NewEncoder(&buffTest).Marshal(&pki.Document{Epoch: 3, SendLambda: 0.5})
+	require.NoError(err, "unexpected Marshal() error")
+	decoded, err = DocumentFromCBOR(buffTest.Bytes())
+	require.NoError(err, "unexpected DocumentFromCBOR() error")
+	require.Equal(uint64(3), decoded.Epoch)
+	staticPKI, err := StaticPKIFromReader(bytes.NewReader(buffTest.Bytes()))
+	require.Error(err, "a document was read as a static PKI")
+	require.Nil(staticPKI)
+	buffTest.Reset()
+	_, err = cbor.NewEncoder(&buffTest).Marshal(map[uint64]*pki.Document{3: {Epoch: 3}})
+	require.NoError(err, "unexpected Marshal() error")
+	staticPKI, err = StaticPKIFromReader(bytes.NewReader(buffTest.Bytes()))
+	require.NoError(err, "unexpected StaticPKIFromReader() error")
+	require.Len(staticPKI.Documents(), 1)
+}
+
+func FuzzDocumentFromCBOR(f *testing.F) {
+	doc, _ := generateDocument(require.New(f))
+	b, err := DocumentToCBOR(doc)
+	require.NoError(f, err, "unexpected DocumentToCBOR() error")
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if !bytes.HasPrefix(data, b[:3]) {
+			return
+		}
+		doc, err := DocumentFromCBOR(data)
+		if err != nil {
+			return
+		}
+		// a decoded document must encode and decode to itself
+		encoded, err := DocumentToCBOR(doc)
+		require.NoError(t, err, "unexpected DocumentToCBOR() error")
+		decoded, err := DocumentFromCBOR(encoded)
+		require.NoError(t, err, "unexpected DocumentFromCBOR() error")
+		again, err := DocumentToCBOR(decoded)
+		require.NoError(t, err, "unexpected DocumentToCBOR() error")
+		require.Equal(t, encoded, again)
+	})
+}
+
+func FuzzStaticPKIFromReader(f *testing.F) {
+	doc, _ := generateDocument(require.New(f))
+	staticPKI, err := StaticPKIFromDocuments([]*pki.Document{doc})
+	require.NoError(f, err, "unexpected StaticPKIFromDocuments() error")
+	b, err := staticPKI.ToCBOR()
+	require.NoError(f, err, "unexpected ToCBOR() error")
+	f.Add(b)
+	var buffTest bytes.Buffer
+	_, err = cbor.NewEncoder(&buffTest).Marshal(map[uint64]*pki.Document{3: {Epoch: 3}})
+	require.NoError(f, err, "unexpected Marshal() error")
+	f.Add(buffTest.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		staticPKI, err := StaticPKIFromReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// the documents read must be written back
+		encoded, err := staticPKI.ToCBOR()
+		require.NoError(t, err, "unexpected ToCBOR() error")
+		decoded, err := StaticPKIFromReader(bytes.NewReader(encoded))
+		require.NoError(t, err, "unexpected StaticPKIFromReader() error")
+		require.Len(t, decoded.Documents(), len(staticPKI.Documents()))
+	})
+}
@@ -0,0 +1,356 @@
+// consensus.go - PKI document consensus of several authorities
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+// ErrNoConsensus is the error returned when no PKI document
+// is signed by the threshold number of authorities
+var ErrNoConsensus = errors.New("no PKI document reached the signature threshold")
+
+// SignedDocument is a PKI document as published by an authority
+type SignedDocument struct {
+	// Payload is the CBOR serialized pki.Document
+	Payload []byte
+	// Signature is the authority's signature of the Payload
+	Signature []byte
+	// Date is the authority's time as of the response,
+	// zero if unknown, see SkewMonitor
+	Date time.Time `json:"-"`
+}
+
+// SignedClient retrieves the signed PKI documents of an authority
+type SignedClient interface {
+	GetSigned(ctx context.Context, epoch uint64) (*SignedDocument, error)
+}
+
+// DocumentStore persists the accepted PKI documents and refuses the
+// documents of epochs preceding the latest one, see storage.Store
+type DocumentStore interface {
+	PutPKIDocument(epoch uint64, document []byte) error
+	PKIDocument(epoch uint64) ([]byte, error)
+}
+
+// SourceDocumentStore is a DocumentStore which persists the accepted
+// PKI documents of each source apart, and only refuses the documents
+// of epochs preceding the latest one of the same source. It's used
+// instead of the DocumentStore methods by a ConsensusPKI whose store
+// implements it, see storage.Store.
+type SourceDocumentStore interface {
+	DocumentStore
+	PutSourcePKIDocument(source string, epoch uint64, document []byte) error
+	SourcePKIDocument(source string, epoch uint64) ([]byte, error)
+}
+
+// storedDocument returns the document of the given epoch
+// accepted from the given source which is persisted in the
+// store, or nil if there is none
+func storedDocument(store DocumentStore, source string, epoch uint64) ([]byte, error) {
+	if s, ok := store.(SourceDocumentStore); ok {
+		return s.SourcePKIDocument(source, epoch)
+	}
+	return store.PKIDocument(epoch)
+}
+
+// storeDocument persists the document of the
+// given epoch accepted from the given source
+func storeDocument(store DocumentStore, source string, epoch uint64, document []byte) error {
+	if s, ok := store.(SourceDocumentStore); ok {
+		return s.PutSourcePKIDocument(source, epoch, document)
+	}
+	return store.PutPKIDocument(epoch, document)
+}
+
+// consensusAuthority is a PKI authority of a ConsensusPKI
+type consensusAuthority struct {
+	name   string
+	key    *eddsa.PublicKey
+	client SignedClient
+}
+
+// view is the verified PKI document of an authority
+type view struct {
+	authority string
+	key       string
+	digest    [sha256.Size]byte
+	payload   []byte
+	doc       *pki.Document
+	err       error
+}
+
+// ConsensusPKI is a pki.Client which fetches the PKI document of an
+// epoch from all the authorities and only accepts a document signed
+// by at least the threshold number of them, so that a single
+// malicious authority can't feed the client a poisoned topology.
+// The authorities whose view diverges are logged.
+type ConsensusPKI struct {
+	sync.Mutex
+
+	authorities []*consensusAuthority
+	threshold   int
+	docs        map[uint64]*pki.Document
+	store       DocumentStore
+	skew        *SkewMonitor
+	clock       clock.Clock
+}
+
+// NewConsensusPKI creates a new ConsensusPKI which requires the
+// signatures of threshold authorities
+func NewConsensusPKI(threshold int) *ConsensusPKI {
+	c := ConsensusPKI{
+		threshold: threshold,
+		docs:      make(map[uint64]*pki.Document),
+		clock:     clock.Real,
+	}
+	return &c
+}
+
+// ConsensusFromConfig creates a new ConsensusPKI
+// from the given PKI consensus configuration
+func ConsensusFromConfig(cfg *config.PKIConsensus) (*ConsensusPKI, error) {
+	c := NewConsensusPKI(cfg.Threshold)
+	for _, a := range cfg.Authority {
+		key := new(eddsa.PublicKey)
+		err := key.FromString(a.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key of PKI authority %s: %s", a.Name, err)
+		}
+		c.AddAuthority(a.Name, key, NewHTTPAuthority(a.URL))
+	}
+	return c, nil
+}
+
+// SetStore sets the store which persists the accepted documents,
+// protecting the client against the replay of an old consensus
+// across restarts
+func (c *ConsensusPKI) SetStore(store DocumentStore) {
+	c.Lock()
+	defer c.Unlock()
+	c.store = store
+}
+
+// SetSkewMonitor sets the SkewMonitor which estimates the skew of
+// the local clock from the time of the authorities' responses
+func (c *ConsensusPKI) SetSkewMonitor(skew *SkewMonitor) {
+	c.Lock()
+	defer c.Unlock()
+	c.skew = skew
+}
+
+// SetClock sets the Clock timing the authorities'
+// responses for the SkewMonitor, e.g. a clock.Fake
+func (c *ConsensusPKI) SetClock(clk clock.Clock) {
+	c.Lock()
+	defer c.Unlock()
+	c.clock = clk
+}
+
+// AddAuthority adds a PKI authority whose
+// documents are signed by the given key
+func (c *ConsensusPKI) AddAuthority(name string, key *eddsa.PublicKey, client SignedClient) {
+	c.Lock()
+	defer c.Unlock()
+	c.authorities = append(c.authorities, &consensusAuthority{
+		name:   name,
+		key:    key,
+		client: client,
+	})
+}
+
+// source returns the source of the documents accepted from the given
+// authorities in a SourceDocumentStore, the digest of their distinct keys,
+// so that another set of authorities has it's own epoch watermark
+func source(authorities []*consensusAuthority) string {
+	keys := make(map[string]bool)
+	for _, a := range authorities {
+		keys[string(a.key.Bytes())] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, key := range sorted {
+		h.Write([]byte(key))
+	}
+	return "consensus-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// fetch retrieves and verifies the PKI document of the
+// given epoch from the given authority
+func (c *ConsensusPKI) fetch(ctx context.Context, a *consensusAuthority, epoch uint64) *view {
+	v := view{
+		authority: a.name,
+		key:       string(a.key.Bytes()),
+	}
+	c.Lock()
+	clk := c.clock
+	c.Unlock()
+	sent := clk.Now()
+	signed, err := a.client.GetSigned(ctx, epoch)
+	received := clk.Now()
+	if err != nil {
+		v.err = err
+		return &v
+	}
+	if !a.key.Verify(signed.Signature, signed.Payload) {
+		v.err = errors.New("PKI document signature verification failed")
+		return &v
+	}
+	v.doc, err = DocumentFromCBOR(signed.Payload)
+	if err != nil {
+		v.err = err
+		return &v
+	}
+	if v.doc.Epoch != epoch {
+		v.err = fmt.Errorf("PKI document of epoch %d instead of %d", v.doc.Epoch, epoch)
+		return &v
+	}
+	v.digest = sha256.Sum256(signed.Payload)
+	v.payload = signed.Payload
+	c.Lock()
+	skew := c.skew
+	c.Unlock()
+	if skew != nil && !signed.Date.IsZero() {
+		skew.Observe(a.name, sent, received, signed.Date)
+	}
+	return &v
+}
+
+// Get returns the PKI document of the given epoch which
+// is signed by at least the threshold number of authorities
+func (c *ConsensusPKI) Get(ctx context.Context, epoch uint64) (*pki.Document, error) {
+	c.Lock()
+	doc, ok := c.docs[epoch]
+	authorities := append([]*consensusAuthority{}, c.authorities...)
+	store := c.store
+	c.Unlock()
+	if ok {
+		return doc, nil
+	}
+	if store != nil {
+		payload, err := storedDocument(store, source(authorities), epoch)
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil {
+			doc, err = DocumentFromCBOR(payload)
+			if err != nil {
+				return nil, err
+			}
+			c.cache(epoch, doc)
+			return doc, nil
+		}
+	}
+	keys := make(map[string]bool)
+	for _, a := range authorities {
+		keys[string(a.key.Bytes())] = true
+	}
+	if c.threshold < 1 || len(keys) < c.threshold {
+		return nil, fmt.Errorf("%d PKI authorities can't reach the threshold of %d", len(keys), c.threshold)
+	}
+
+	views := make([]*view, len(authorities))
+	wg := sync.WaitGroup{}
+	for i, a := range authorities {
+		wg.Add(1)
+		go func(i int, a *consensusAuthority) {
+			defer wg.Done()
+			views[i] = c.fetch(ctx, a, epoch)
+		}(i, a)
+	}
+	wg.Wait()
+
+	// the signatures are counted once per authority key, so that an
+	// authority configured more than once can't reach the threshold
+	// on it's own
+	votes := make(map[[sha256.Size]byte]map[string]bool)
+	for _, v := range views {
+		if v.err != nil {
+			log.Warningf("PKI authority %s failed to provide the document of epoch %d: %s", v.authority, epoch, v.err)
+			continue
+		}
+		if votes[v.digest] == nil {
+			votes[v.digest] = make(map[string]bool)
+		}
+		votes[v.digest][v.key] = true
+	}
+	var accepted *view
+	for _, v := range views {
+		if v.err != nil || len(votes[v.digest]) < c.threshold {
+			continue
+		}
+		if accepted != nil && accepted.digest != v.digest {
+			log.Errorf("conflicting PKI documents of epoch %d reached the threshold of %d", epoch, c.threshold)
+			return nil, ErrNoConsensus
+		}
+		accepted = v
+	}
+	if accepted == nil {
+		log.Errorf("no PKI document of epoch %d reached the threshold of %d", epoch, c.threshold)
+		return nil, ErrNoConsensus
+	}
+	for _, v := range views {
+		if v.err == nil && v.digest != accepted.digest {
+			log.Warningf("PKI authority %s diverges from the consensus of epoch %d", v.authority, epoch)
+		}
+	}
+
+	if store != nil {
+		err := storeDocument(store, source(authorities), epoch, accepted.payload)
+		if err != nil {
+			log.Errorf("refusing the PKI document of epoch %d: %s", epoch, err)
+			return nil, err
+		}
+	}
+	c.cache(epoch, accepted.doc)
+	return accepted.doc, nil
+}
+
+// cache caches the accepted document of the given epoch
+// and evicts the documents of the older epochs
+func (c *ConsensusPKI) cache(epoch uint64, doc *pki.Document) {
+	c.Lock()
+	defer c.Unlock()
+	for e := range c.docs {
+		if e+1 < epoch {
+			delete(c.docs, e)
+		}
+	}
+	c.docs[epoch] = doc
+}
+
+// Post is not supported, the descriptors
+// are posted to the authorities directly
+func (c *ConsensusPKI) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor) error {
+	return errors.New("posting to a PKI consensus is not supported")
+}
@@ -0,0 +1,212 @@
+// consensus_test.go - PKI document consensus tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/storage"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+// staticAuthority is a SignedClient which
+// always returns the same signed document
+type staticAuthority struct {
+	signed *SignedDocument
+}
+
+func (s *staticAuthority) GetSigned(ctx context.Context, epoch uint64) (*SignedDocument, error) {
+	return s.signed, nil
+}
+
+// documentStore is a DocumentStore which
+// doesn't keep the sources of the documents apart
+type documentStore struct {
+	docs map[uint64][]byte
+}
+
+func (s *documentStore) PutPKIDocument(epoch uint64, document []byte) error {
+	s.docs[epoch] = document
+	return nil
+}
+
+func (s *documentStore) PKIDocument(epoch uint64) ([]byte, error) {
+	return s.docs[epoch], nil
+}
+
+func signDocument(require *require.Assertions, key *eddsa.PrivateKey, doc *pki.Document) *SignedDocument {
+	payload, err := DocumentToCBOR(doc)
+	require.NoError(err, "unexpected DocumentToCBOR() error")
+	return &SignedDocument{
+		Payload:   payload,
+		Signature: key.Sign(payload),
+	}
+}
+
+func TestConsensusPKI(t *testing.T) {
+	require := require.New(t)
+
+	epoch := uint64(1234)
+	honest := &pki.Document{Epoch: epoch, SendLambda: 0.5}
+	poisoned := &pki.Document{Epoch: epoch, SendLambda: 0.9}
+	keys := make([]*eddsa.PrivateKey, 3)
+	for i := range keys {
+		var err error
+		keys[i], err = eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "unexpected NewKeypair error")
+	}
+	authorities := []*staticAuthority{
+		{signDocument(require, keys[0], honest)},
+		{signDocument(require, keys[1], honest)},
+		{signDocument(require, keys[2], poisoned)},
+	}
+	newConsensus := func(threshold int) *ConsensusPKI {
+		c := NewConsensusPKI(threshold)
+		for i, a := range authorities {
+			c.AddAuthority(string('a'+rune(i)), keys[i].PublicKey(), a)
+		}
+		return c
+	}
+
+	// the malicious authority is outvoted
+	doc, err := newConsensus(2).Get(context.Background(), epoch)
+	require.NoError(err, "unexpected Get() error")
+	require.Equal(0.5, doc.SendLambda)
+
+	_, err = newConsensus(3).Get(context.Background(), epoch)
+	require.Equal(ErrNoConsensus, err)
+	_, err = newConsensus(1).Get(context.Background(), epoch)
+	require.Equal(ErrNoConsensus, err, "conflicting documents were accepted")
+	_, err = newConsensus(4).Get(context.Background(), epoch)
+	require.Error(err, "the threshold exceeds the number of authorities")
+
+	// an authority configured twice is counted once
+	c := NewConsensusPKI(2)
+	c.AddAuthority("c", keys[2].PublicKey(), authorities[2])
+	c.AddAuthority("c2", keys[2].PublicKey(), authorities[2])
+	_, err = c.Get(context.Background(), epoch)
+	require.Error(err, "a single authority reached the threshold")
+
+	// a document signed with the wrong key doesn't count
+	authorities[1].signed = signDocument(require, keys[2], honest)
+	_, err = newConsensus(2).Get(context.Background(), epoch)
+	require.Equal(ErrNoConsensus, err)
+
+	// a document of another epoch doesn't count
+	authorities[1].signed = signDocument(require, keys[1], &pki.Document{Epoch: epoch - 1, SendLambda: 0.5})
+	_, err = newConsensus(2).Get(context.Background(), epoch)
+	require.Equal(ErrNoConsensus, err)
+}
+
+func TestConsensusRollback(t *testing.T) {
+	require := require.New(t)
+
+	store, err := storage.NewEphemeral()
+	require.NoError(err, "unexpected NewEphemeral() error")
+	defer store.Close()
+	key, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair error")
+	authority := &staticAuthority{signDocument(require, key, &pki.Document{Epoch: 20})}
+	newConsensus := func() *ConsensusPKI {
+		c := NewConsensusPKI(1)
+		c.SetStore(store)
+		c.AddAuthority("a", key.PublicKey(), authority)
+		return c
+	}
+
+	_, err = newConsensus().Get(context.Background(), 20)
+	require.NoError(err, "unexpected Get() error")
+
+	// after a restart an old consensus is refused
+	authority.signed = signDocument(require, key, &pki.Document{Epoch: 19})
+	_, err = newConsensus().Get(context.Background(), 19)
+	require.Equal(storage.ErrPKIRollback, err)
+
+	// the accepted document is loaded from the store
+	doc, err := newConsensus().Get(context.Background(), 20)
+	require.NoError(err, "unexpected Get() error")
+	require.Equal(uint64(20), doc.Epoch)
+
+	// the documents of other authorities are kept apart
+	_, ok, err := store.PKIEpochWatermark()
+	require.NoError(err, "unexpected PKIEpochWatermark() error")
+	require.False(ok, "the document was persisted as the default source's")
+}
+
+func TestConsensusDocumentStore(t *testing.T) {
+	require := require.New(t)
+
+	store := &documentStore{docs: make(map[uint64][]byte)}
+	key, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair error")
+	authority := &staticAuthority{signDocument(require, key, &pki.Document{Epoch: 20})}
+	newConsensus := func() *ConsensusPKI {
+		c := NewConsensusPKI(1)
+		c.SetStore(store)
+		c.AddAuthority("a", key.PublicKey(), authority)
+		return c
+	}
+
+	_, err = newConsensus().Get(context.Background(), 20)
+	require.NoError(err, "unexpected Get() error")
+	require.NotNil(store.docs[20], "the document wasn't persisted")
+
+	// the accepted document is loaded from the store
+	authority.signed = nil
+	doc, err := newConsensus().Get(context.Background(), 20)
+	require.NoError(err, "unexpected Get() error")
+	require.Equal(uint64(20), doc.Epoch)
+}
+
+func TestHTTPAuthority(t *testing.T) {
+	require := require.New(t)
+
+	key, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair error")
+	signed := signDocument(require, key, &pki.Document{Epoch: 42})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/42" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(signed)
+	}))
+	defer server.Close()
+
+	c := NewConsensusPKI(1)
+	skew := NewSkewMonitor(time.Minute, true)
+	c.SetSkewMonitor(skew)
+	c.AddAuthority("a", key.PublicKey(), NewHTTPAuthority(server.URL+"/"))
+	doc, err := c.Get(context.Background(), 42)
+	require.NoError(err, "unexpected Get() error")
+	require.Equal(uint64(42), doc.Epoch)
+
+	// the skew is estimated from the Date of the response
+	_, observed := skew.Skew()
+	require.True(observed)
+	require.False(skew.RefuseSend())
+	_, err = c.Get(context.Background(), 43)
+	require.Error(err, "a missing document was accepted")
+}
@@ -0,0 +1,133 @@
+// generate.go - synthetic static PKI generator
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+// Topology describes a synthetic mix network
+type Topology struct {
+	// Layers is the number of mix layers
+	Layers int
+	// MixesPerLayer is the number of mixes in each layer
+	MixesPerLayer int
+	// Providers are the names of the Providers
+	Providers []string
+	// StartEpoch is the epoch of the first document
+	StartEpoch uint64
+	// Epochs is the number of documents, one per epoch
+	Epochs int
+	// BasePort is the port of the first node, the nodes listen on
+	// consecutive ports of 127.0.0.1. The nodes have no address
+	// if zero.
+	BasePort int
+}
+
+// newDescriptor returns the descriptor of a node with fresh keys for
+// the given epochs, the private mix keys are added to mixKeys
+func newDescriptor(randReader io.Reader, name string, layer uint8, address string, t *Topology, mixKeys map[[32]byte]*ecdh.PrivateKey) (*pki.MixDescriptor, error) {
+	identityKey, err := eddsa.NewKeypair(randReader)
+	if err != nil {
+		return nil, err
+	}
+	linkKey, err := ecdh.NewKeypair(randReader)
+	if err != nil {
+		return nil, err
+	}
+	d := pki.MixDescriptor{
+		Name:        name,
+		IdentityKey: identityKey.PublicKey(),
+		LinkKey:     linkKey.PublicKey(),
+		MixKeys:     make(map[uint64]*ecdh.PublicKey),
+		Addresses:   []string{},
+		Layer:       layer,
+	}
+	if address != "" {
+		d.Addresses = append(d.Addresses, address)
+	}
+	for i := 0; i < t.Epochs; i++ {
+		mixKey, err := ecdh.NewKeypair(randReader)
+		if err != nil {
+			return nil, err
+		}
+		d.MixKeys[t.StartEpoch+uint64(i)] = mixKey.PublicKey()
+		publicKey := [32]byte{}
+		copy(publicKey[:], mixKey.PublicKey().Bytes())
+		mixKeys[publicKey] = mixKey
+	}
+	return &d, nil
+}
+
+// GenerateStaticPKI generates a StaticPKI of the given synthetic
+// topology with fresh keys, for integration tests and air-gapped
+// deployments. It also returns the private mix keys indexed by
+// public key, see CBORKeysFromMap.
+func GenerateStaticPKI(randReader io.Reader, t *Topology) (*StaticPKI, map[[32]byte]*ecdh.PrivateKey, error) {
+	if t.Layers < 1 || t.MixesPerLayer < 1 || t.Epochs < 1 {
+		return nil, nil, errors.New("a topology needs at least one layer, mix and epoch")
+	}
+	if len(t.Providers) == 0 {
+		return nil, nil, errors.New("a topology needs at least one Provider")
+	}
+	mixKeys := make(map[[32]byte]*ecdh.PrivateKey)
+	port := t.BasePort
+	address := func() string {
+		if t.BasePort == 0 {
+			return ""
+		}
+		port++
+		return fmt.Sprintf("127.0.0.1:%d", port-1)
+	}
+	providers := []*pki.MixDescriptor{}
+	for _, name := range t.Providers {
+		d, err := newDescriptor(randReader, name, 0, address(), t, mixKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		providers = append(providers, d)
+	}
+	// layer 0 is the Providers' layer
+	topology := make([][]*pki.MixDescriptor, t.Layers+1)
+	topology[0] = []*pki.MixDescriptor{}
+	for layer := 1; layer <= t.Layers; layer++ {
+		for i := 0; i < t.MixesPerLayer; i++ {
+			name := fmt.Sprintf("mix%d_%d", layer, i)
+			d, err := newDescriptor(randReader, name, uint8(layer), address(), t, mixKeys)
+			if err != nil {
+				return nil, nil, err
+			}
+			topology[layer] = append(topology[layer], d)
+		}
+	}
+	staticPKI := NewStaticPKI()
+	for i := 0; i < t.Epochs; i++ {
+		epoch := t.StartEpoch + uint64(i)
+		staticPKI.Set(epoch, &pki.Document{
+			Epoch:     epoch,
+			Topology:  topology,
+			Providers: providers,
+		})
+	}
+	return staticPKI, mixKeys, nil
+}
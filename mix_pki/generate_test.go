@@ -0,0 +1,73 @@
+// generate_test.go - synthetic static PKI generator tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateStaticPKI(t *testing.T) {
+	require := require.New(t)
+
+	_, _, err := GenerateStaticPKI(rand.Reader, &Topology{Layers: 3, MixesPerLayer: 2, Epochs: 2})
+	require.Error(err, "a topology without Providers was generated")
+	topology := &Topology{
+		Layers:        3,
+		MixesPerLayer: 2,
+		Providers:     []string{"acme.com", "nsa.gov"},
+		StartEpoch:    100,
+		Epochs:        2,
+		BasePort:      30000,
+	}
+	staticPKI, mixKeys, err := GenerateStaticPKI(rand.Reader, topology)
+	require.NoError(err, "unexpected GenerateStaticPKI() error")
+	// one key per node and epoch
+	require.Len(mixKeys, (3*2+2)*2)
+
+	pkiFile, err := ioutil.TempFile("", "generate_test")
+	require.NoError(err, "unexpected TempFile error")
+	pkiFile.Close()
+	defer os.Remove(pkiFile.Name())
+	err = staticPKI.WriteFile(pkiFile.Name())
+	require.NoError(err, "unexpected WriteFile() error")
+	loaded, err := StaticPKIFromFile(pkiFile.Name())
+	require.NoError(err, "unexpected StaticPKIFromFile() error")
+
+	documents := loaded.Documents()
+	require.Len(documents, 2)
+	require.Equal(uint64(100), documents[0].Epoch)
+	doc, err := loaded.Get(context.Background(), 101)
+	require.NoError(err, "unexpected Get() error")
+	provider, err := doc.GetProvider("nsa.gov")
+	require.NoError(err, "unexpected GetProvider() error")
+	require.Equal([]string{"127.0.0.1:30001"}, provider.Addresses)
+	mixes, err := doc.GetMixesInLayer(3)
+	require.NoError(err, "unexpected GetMixesInLayer() error")
+	require.Len(mixes, 2)
+	key := [32]byte{}
+	copy(key[:], mixes[1].MixKeys[101].Bytes())
+	require.Contains(mixKeys, key)
+
+	_, err = StaticPKIFromDocuments(append(documents, documents[0]))
+	require.Error(err, "duplicate documents were accepted")
+}
@@ -0,0 +1,70 @@
+// legacy.go - decoder of the previous CBOR format
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/2tvenom/cbor"
+	"github.com/katzenpost/core/pki"
+)
+
+// legacyUnmarshal decodes b into v with the decoder of the
+// previous format, which panics on some malformed inputs
+func legacyUnmarshal(b []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed CBOR: %v", r)
+		}
+	}()
+	var buffTest bytes.Buffer
+	encoder := cbor.NewEncoder(&buffTest)
+	_, err = encoder.Unmarshal(b, v)
+	return err
+}
+
+// legacyStaticPKIFromCBOR decodes a static PKI file written
+// before the canonical encoding was introduced
+func legacyStaticPKIFromCBOR(b []byte) (*StaticPKI, error) {
+	epochMap := make(map[uint64]*pki.Document)
+	err := legacyUnmarshal(b, &epochMap)
+	if err != nil {
+		return nil, err
+	}
+	for epoch, doc := range epochMap {
+		if doc == nil {
+			return nil, fmt.Errorf("missing document of epoch %d", epoch)
+		}
+	}
+	log.Warning("read a static PKI file of the previous format, rewrite it with mixclient-staticpki merge")
+	p := StaticPKI{
+		epochMap: epochMap,
+	}
+	return &p, nil
+}
+
+// legacyDocumentFromCBOR decodes a document serialized
+// before the canonical encoding was introduced
+func legacyDocumentFromCBOR(b []byte) (*pki.Document, error) {
+	document := pki.Document{}
+	err := legacyUnmarshal(b, &document)
+	if err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
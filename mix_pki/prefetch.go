@@ -0,0 +1,374 @@
+// prefetch.go - adaptive PKI document prefetching
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"context"
+	"errors"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/clock"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/scheduler"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+)
+
+// AuthorityStatus is the observed performance of a PKI authority
+type AuthorityStatus struct {
+	// Name is the name of the authority
+	Name string
+	// Latency is the moving average of the document fetch durations
+	Latency time.Duration
+	// Fetches is the number of document fetches
+	Fetches int
+	// Failures is the number of failed document fetches
+	Failures int
+}
+
+// PrefetchStatus describes the state of a Prefetcher
+type PrefetchStatus struct {
+	// LeadTime is the current prefetch lead time
+	LeadTime time.Duration
+	// NextEpochReady is true once the PKI
+	// document of the next epoch is cached
+	NextEpochReady bool
+	// Authorities is the status of each authority
+	Authorities []AuthorityStatus
+}
+
+// authority is a PKI authority of a Prefetcher
+type authority struct {
+	AuthorityStatus
+
+	client  pki.Client
+	failing bool
+}
+
+// Prefetcher is a pki.Client which caches the PKI documents of one or
+// more authorities and fetches the document of the next epoch ahead of
+// each epoch boundary. The lead time is widened beyond the configured
+// minimum when the authorities are observed to be slow, so that there
+// is time to retry before the epoch rolls over, and a random jitter is
+// added to it. Failed fetches are retried with an exponential backoff.
+type Prefetcher struct {
+	sync.Mutex
+
+	authorities []*authority
+	docs        map[uint64]*pki.Document
+	minLead     time.Duration
+	jitter      time.Duration
+	rng         *mathrand.Rand
+	failures    int
+	clock       clock.Clock
+	timer       clock.Timer
+	stopped     bool
+	lowPower    bool
+}
+
+// NewPrefetcher creates a new Prefetcher with the given minimum
+// lead time, see constants.DefaultPKIPrefetchLead
+func NewPrefetcher(minLead time.Duration) *Prefetcher {
+	p := Prefetcher{
+		docs:    make(map[uint64]*pki.Document),
+		minLead: minLead,
+		jitter:  constants.DefaultPKIPrefetchJitter,
+		rng:     entropy.NewMath(),
+		clock:   clock.Real,
+	}
+	return &p
+}
+
+// SetClock sets the Clock telling the epochs and timing the
+// prefetches, e.g. a clock.Fake in tests. It must be set before Start.
+func (p *Prefetcher) SetClock(c clock.Clock) {
+	p.Lock()
+	defer p.Unlock()
+	p.clock = c
+}
+
+// SetJitter sets the maximum random duration added to the
+// lead time of each prefetch, zero disables the jitter
+func (p *Prefetcher) SetJitter(jitter time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.jitter = jitter
+}
+
+// AddAuthority adds a PKI authority, the authorities are
+// tried in increasing order of latency
+func (p *Prefetcher) AddAuthority(name string, client pki.Client) {
+	p.Lock()
+	defer p.Unlock()
+	p.authorities = append(p.authorities, &authority{
+		AuthorityStatus: AuthorityStatus{
+			Name: name,
+		},
+		client: client,
+	})
+}
+
+// ranked returns the authorities, those whose last fetch succeeded
+// first and in increasing order of latency, the lock must be held
+func (p *Prefetcher) ranked() []*authority {
+	ranked := append([]*authority{}, p.authorities...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].failing != ranked[j].failing {
+			return !ranked[i].failing
+		}
+		return ranked[i].Latency < ranked[j].Latency
+	})
+	return ranked
+}
+
+// observe records the duration and outcome of a document fetch
+func (p *Prefetcher) observe(a *authority, elapsed time.Duration, err error) {
+	p.Lock()
+	defer p.Unlock()
+	a.Fetches++
+	if a.Fetches == 1 {
+		a.Latency = elapsed
+	} else {
+		a.Latency += (elapsed - a.Latency) / 4
+	}
+	a.failing = err != nil
+	if err != nil {
+		a.Failures++
+	}
+}
+
+// Get returns the PKI document of the given epoch from the cache,
+// or fetches it from the authorities
+func (p *Prefetcher) Get(ctx context.Context, epoch uint64) (*pki.Document, error) {
+	p.Lock()
+	doc, ok := p.docs[epoch]
+	authorities := p.ranked()
+	p.Unlock()
+	if ok {
+		return doc, nil
+	}
+	if len(authorities) == 0 {
+		return nil, errors.New("no PKI authorities")
+	}
+	var err error
+	for _, a := range authorities {
+		start := p.clock.Now()
+		doc, err = a.client.Get(ctx, epoch)
+		p.observe(a, p.clock.Now().Sub(start), err)
+		if err == nil {
+			p.Lock()
+			p.docs[epoch] = doc
+			p.Unlock()
+			return doc, nil
+		}
+		log.Debugf("PKI authority %s failed to provide the document of epoch %d: %s", a.Name, epoch, err)
+	}
+	return nil, err
+}
+
+// Post posts the descriptor to the fastest authority
+func (p *Prefetcher) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor) error {
+	p.Lock()
+	authorities := p.ranked()
+	p.Unlock()
+	if len(authorities) == 0 {
+		return errors.New("no PKI authorities")
+	}
+	return authorities[0].client.Post(ctx, epoch, signingKey, d)
+}
+
+// LeadTime returns the duration before an epoch boundary at which
+// the next document is fetched. It's the minimum lead time or, if
+// longer, a multiple of the time it takes to try every authority.
+func (p *Prefetcher) LeadTime() time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	total := time.Duration(0)
+	for _, a := range p.authorities {
+		total += a.Latency
+	}
+	lead := p.minLead
+	if adaptive := constants.PKIPrefetchLatencyFactor * total; adaptive > lead {
+		lead = adaptive
+	}
+	if lead > epochtime.Period/2 {
+		lead = epochtime.Period / 2
+	}
+	return lead
+}
+
+// Status returns the status of the Prefetcher
+func (p *Prefetcher) Status() *PrefetchStatus {
+	status := PrefetchStatus{
+		LeadTime: p.LeadTime(),
+	}
+	epoch, _, _ := epochtime.FromUnix(p.clock.Now().Unix())
+	p.Lock()
+	defer p.Unlock()
+	_, status.NextEpochReady = p.docs[epoch+1]
+	for _, a := range p.authorities {
+		status.Authorities = append(status.Authorities, a.AuthorityStatus)
+	}
+	return &status
+}
+
+// Fresh returns true if the PKI document of the current epoch is
+// cached, while it's missing no route can be built and the sending
+// is paused, see proxy.SendScheduler.SetPKIFreshness
+func (p *Prefetcher) Fresh() bool {
+	epoch, _, _ := epochtime.FromUnix(p.clock.Now().Unix())
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.docs[epoch]
+	return ok
+}
+
+// SetLowPower enables or disables the low power mode, in which
+// the prefetches are coalesced with the other timers of the client
+// so that the radio wakes up less often
+func (p *Prefetcher) SetLowPower(enabled bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.lowPower = enabled
+}
+
+// Start schedules the prefetching of the next epoch's document,
+// the current epoch's document is fetched first if it's missing
+func (p *Prefetcher) Start() {
+	epoch, _, _ := epochtime.FromUnix(p.clock.Now().Unix())
+	p.Lock()
+	p.stopped = false
+	p.Unlock()
+	if !p.Fresh() {
+		p.schedule(epoch, 0)
+		return
+	}
+	p.scheduleNext(epoch + 1)
+}
+
+// Stop stops the prefetching
+func (p *Prefetcher) Stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// boundary returns the start of the given epoch
+func (p *Prefetcher) boundary(epoch uint64) time.Time {
+	return epochtime.Epoch.Add(time.Duration(epoch) * epochtime.Period)
+}
+
+// scheduleNext schedules the prefetch of the document of the given
+// epoch the lead time and a random jitter before it begins
+func (p *Prefetcher) scheduleNext(epoch uint64) {
+	delay := p.boundary(epoch).Sub(p.clock.Now()) - p.LeadTime()
+	p.Lock()
+	if p.jitter > 0 {
+		delay -= time.Duration(p.rng.Int63n(int64(p.jitter)))
+	}
+	p.Unlock()
+	p.schedule(epoch, delay)
+}
+
+// backoff returns the delay before the next retry of a failed
+// fetch, the lock must be held
+func (p *Prefetcher) backoff() time.Duration {
+	backoff := constants.PKIRefreshMinBackoff << uint(p.failures-1)
+	if backoff > constants.PKIRefreshMaxBackoff || backoff <= 0 {
+		backoff = constants.PKIRefreshMaxBackoff
+	}
+	return backoff
+}
+
+// schedule prefetches the document of the given epoch after delay
+func (p *Prefetcher) schedule(epoch uint64, delay time.Duration) {
+	if delay < 0 {
+		delay = 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return
+	}
+	if p.lowPower {
+		// coalescing may extend the delay by up to the
+		// granularity, which the lead time easily absorbs
+		delay = scheduler.Coalesce(p.clock, delay, constants.LowPowerTimerGranularity)
+	}
+	p.timer = p.clock.AfterFunc(delay, func() {
+		p.prefetch(epoch)
+	})
+}
+
+// prefetch fetches the document of the given epoch, retrying with
+// an exponential backoff until it's fetched or the epoch is over,
+// and schedules the prefetch of the following one
+func (p *Prefetcher) prefetch(epoch uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.LeadTime())
+	_, err := p.Get(ctx, epoch)
+	cancel()
+	current, _, _ := epochtime.FromUnix(p.clock.Now().Unix())
+	if err != nil && current <= epoch {
+		p.Lock()
+		p.failures++
+		retry := p.backoff()
+		p.Unlock()
+		p.warnMissing(epoch, retry, err)
+		p.schedule(epoch, retry)
+		return
+	}
+	if err != nil {
+		log.Errorf("epoch %d ended without it's PKI document: %s", epoch, err)
+	}
+	p.Lock()
+	p.failures = 0
+	for e := range p.docs {
+		if e+1 < epoch {
+			delete(p.docs, e)
+		}
+	}
+	p.Unlock()
+	if current > epoch {
+		// the epoch rolled over while retrying, the
+		// current epoch's document is needed right away
+		p.schedule(current, 0)
+		return
+	}
+	p.scheduleNext(epoch + 1)
+}
+
+// warnMissing logs the failure to fetch the document of the given
+// epoch, increasingly loudly as the epoch boundary approaches
+func (p *Prefetcher) warnMissing(epoch uint64, retry time.Duration, err error) {
+	remaining := p.boundary(epoch).Sub(p.clock.Now())
+	switch {
+	case remaining <= 0:
+		log.Errorf("the PKI document of the current epoch %d is missing, sending is paused, retrying in %s: %s", epoch, retry, err)
+	case remaining < constants.PKIExpiryWarning:
+		log.Errorf("the PKI document of epoch %d is still missing %s before it begins, retrying in %s: %s", epoch, remaining.Round(time.Second), retry, err)
+	default:
+		log.Warningf("failed to prefetch the PKI document of epoch %d, retrying in %s: %s", epoch, retry, err)
+	}
+}
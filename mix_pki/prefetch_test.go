@@ -0,0 +1,123 @@
+// prefetch_test.go - adaptive PKI document prefetching tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+// slowPKI is a pki.Client which takes delay to answer
+type slowPKI struct {
+	sync.Mutex
+	delay time.Duration
+	fail  bool
+	gets  int
+}
+
+func (s *slowPKI) Get(ctx context.Context, epoch uint64) (*pki.Document, error) {
+	s.Lock()
+	s.gets++
+	delay, fail := s.delay, s.fail
+	s.Unlock()
+	time.Sleep(delay)
+	if fail {
+		return nil, errors.New("authority unavailable")
+	}
+	return &pki.Document{Epoch: epoch}, nil
+}
+
+func (s *slowPKI) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor) error {
+	return nil
+}
+
+func TestPrefetcher(t *testing.T) {
+	require := require.New(t)
+
+	broken := &slowPKI{delay: 20 * time.Millisecond, fail: true}
+	slow := &slowPKI{delay: 10 * time.Millisecond}
+	fast := &slowPKI{}
+	p := NewPrefetcher(time.Millisecond)
+	p.AddAuthority("broken", broken)
+	p.AddAuthority("slow", slow)
+	p.AddAuthority("fast", fast)
+	epoch, _, _ := epochtime.Now()
+
+	// the broken authority is tried first and then avoided
+	doc, err := p.Get(context.Background(), epoch)
+	require.NoError(err, "unexpected Get() error")
+	require.Equal(epoch, doc.Epoch)
+	require.Equal(1, broken.gets)
+	require.Equal(1, slow.gets)
+	require.Equal(0, fast.gets)
+	_, err = p.Get(context.Background(), epoch)
+	require.NoError(err, "unexpected Get() error")
+	require.Equal(1, slow.gets, "the document was not cached")
+
+	// the lead time is widened by the observed latency
+	lead := p.LeadTime()
+	require.True(lead >= 4*30*time.Millisecond, "lead time %s was not widened", lead)
+
+	status := p.Status()
+	require.Equal(lead, status.LeadTime)
+	require.False(status.NextEpochReady)
+	require.Equal(1, status.Authorities[0].Failures)
+	p.prefetch(epoch + 1)
+	p.Stop()
+	status = p.Status()
+	require.True(status.NextEpochReady)
+	// the untried authority ranks ahead of the slow one
+	require.Equal(1, fast.gets)
+	require.Equal(1, slow.gets)
+}
+
+func TestPrefetcherBackoff(t *testing.T) {
+	require := require.New(t)
+
+	broken := &slowPKI{fail: true}
+	p := NewPrefetcher(time.Millisecond)
+	p.AddAuthority("broken", broken)
+	epoch, _, _ := epochtime.Now()
+	require.False(p.Fresh())
+
+	// the retries back off exponentially
+	p.prefetch(epoch + 1)
+	p.Stop()
+	require.Equal(1, p.failures)
+	require.Equal(constants.PKIRefreshMinBackoff, p.backoff())
+	p.failures = 3
+	require.Equal(4*constants.PKIRefreshMinBackoff, p.backoff())
+	p.failures = 64
+	require.Equal(constants.PKIRefreshMaxBackoff, p.backoff())
+
+	// the current epoch's document makes the Prefetcher fresh
+	broken.Lock()
+	broken.fail = false
+	broken.Unlock()
+	_, err := p.Get(context.Background(), epoch)
+	require.NoError(err, "unexpected Get() error")
+	require.True(p.Fresh())
+}
@@ -0,0 +1,142 @@
+// skew.go - clock skew detection
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/config"
+	"github.com/katzenpost/core/epochtime"
+)
+
+// SkewMonitor estimates the skew of the local clock from the time
+// of the PKI authorities' responses. A large skew silently produces
+// packets built for the wrong epoch which the mixes drop, so it's
+// logged and, if configured, the sending is refused. The time of a
+// response isn't signed, so the skew is the median of the last
+// observation of each authority: a single authority, or whoever
+// tampers with it's responses, can't turn the refusal on or off.
+type SkewMonitor struct {
+	sync.Mutex
+
+	maxSkew      time.Duration
+	refuse       bool
+	observations map[string]time.Duration
+	skew         time.Duration
+	excessive    bool
+}
+
+// NewSkewMonitor creates a new SkewMonitor reporting skews above
+// maxSkew, RefuseSend is true while they do if refuse is true
+func NewSkewMonitor(maxSkew time.Duration, refuse bool) *SkewMonitor {
+	m := SkewMonitor{
+		maxSkew:      maxSkew,
+		refuse:       refuse,
+		observations: make(map[string]time.Duration),
+	}
+	return &m
+}
+
+// SkewMonitorFromConfig creates a new SkewMonitor
+// from the given configuration
+func SkewMonitorFromConfig(cfg *config.Config) *SkewMonitor {
+	return NewSkewMonitor(cfg.MaxClockSkew(), cfg.ClockSkew.RefuseSend)
+}
+
+// Observe records the time of the given authority as of it's response
+// to a request sent and received at the given local times. The
+// authority is assumed to have answered halfway through the round trip.
+func (m *SkewMonitor) Observe(authority string, sent, received, remote time.Time) {
+	local := sent.Add(received.Sub(sent) / 2)
+	m.Lock()
+	defer m.Unlock()
+	m.observations[authority] = local.Sub(remote)
+	m.skew = m.median()
+	excessive := abs(m.skew) > m.maxSkew
+	if excessive == m.excessive {
+		return
+	}
+	m.excessive = excessive
+	if !excessive {
+		log.Noticef("the local clock is back within %s of the PKI authorities", m.maxSkew)
+		return
+	}
+	direction := "ahead of"
+	if m.skew < 0 {
+		direction = "behind"
+	}
+	log.Warningf("the local clock is %s %s the PKI authorities, more than the maximum skew of %s", abs(m.skew).Round(time.Second), direction, m.maxSkew)
+	localEpoch, _, _ := epochtime.FromUnix(local.Unix())
+	networkEpoch, _, _ := epochtime.FromUnix(local.Add(-m.skew).Unix())
+	if localEpoch != networkEpoch {
+		log.Errorf("packets are built for epoch %d while the network is in epoch %d, the mixes will drop them", localEpoch, networkEpoch)
+	}
+	if m.refuse {
+		log.Warning("sending is refused until the local clock is corrected")
+	}
+}
+
+// median returns the median of the observed skews, of the two middle
+// ones the smallest if their number is even, the lock must be held
+func (m *SkewMonitor) median() time.Duration {
+	skews := make([]time.Duration, 0, len(m.observations))
+	for _, skew := range m.observations {
+		skews = append(skews, skew)
+	}
+	sort.Slice(skews, func(i, j int) bool {
+		return skews[i] < skews[j]
+	})
+	low, high := skews[(len(skews)-1)/2], skews[len(skews)/2]
+	if abs(low) < abs(high) {
+		return low
+	}
+	return high
+}
+
+// Skew returns the estimated skew of the local clock, positive
+// if it's ahead, and false if the skew wasn't observed yet
+func (m *SkewMonitor) Skew() (time.Duration, bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.skew, len(m.observations) != 0
+}
+
+// Excessive returns true if the estimated
+// skew of the local clock exceeds the maximum skew
+func (m *SkewMonitor) Excessive() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.excessive
+}
+
+// RefuseSend returns true if the sending must be refused because the
+// skew is excessive, see proxy.SendScheduler.SetClockSkewCheck
+func (m *SkewMonitor) RefuseSend() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.refuse && m.excessive
+}
+
+// abs returns the absolute value of the given duration
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
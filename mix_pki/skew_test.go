@@ -0,0 +1,66 @@
+// skew_test.go - clock skew detection tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkewMonitor(t *testing.T) {
+	require := require.New(t)
+
+	m := NewSkewMonitor(time.Minute, false)
+	_, observed := m.Skew()
+	require.False(observed)
+
+	// the authority answers halfway through the round trip
+	sent := epochtime.Epoch.Add(10 * epochtime.Period)
+	received := sent.Add(2 * time.Second)
+	m.Observe("a", sent, received, sent.Add(time.Second))
+	skew, observed := m.Skew()
+	require.True(observed)
+	require.Equal(time.Duration(0), skew)
+	require.False(m.Excessive())
+
+	// a skewed clock is only reported unless sending is refused
+	m.Observe("a", sent, received, sent.Add(-2*time.Minute))
+	skew, _ = m.Skew()
+	require.Equal(2*time.Minute+time.Second, skew)
+	require.True(m.Excessive())
+	require.False(m.RefuseSend())
+
+	m = NewSkewMonitor(time.Minute, true)
+	m.Observe("a", sent, received, sent.Add(time.Hour))
+	require.True(m.RefuseSend())
+	m.Observe("a", sent, received, sent)
+	require.False(m.RefuseSend())
+
+	// a single authority can't turn the refusal on or off
+	m.Observe("b", sent, received, sent)
+	m.Observe("c", sent, received, sent.Add(time.Hour))
+	require.False(m.RefuseSend())
+	skew, _ = m.Skew()
+	require.Equal(time.Second, skew)
+	m.Observe("a", sent, received, sent.Add(time.Hour))
+	require.True(m.RefuseSend())
+	m.Observe("b", sent, received, sent)
+	require.True(m.RefuseSend())
+}
@@ -0,0 +1,204 @@
+// wire.go - CBOR wire format of the PKI documents and keys
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mix_pki
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+// wireVersion is the version of the wire format
+const wireVersion = 1
+
+// wireDescriptor is the encoding of a pki.MixDescriptor
+type wireDescriptor struct {
+	Name        string                            `cbor:"name"`
+	IdentityKey []byte                            `cbor:"identity_key"`
+	LinkKey     []byte                            `cbor:"link_key"`
+	MixKeys     map[uint64][]byte                 `cbor:"mix_keys"`
+	Addresses   []string                          `cbor:"addresses"`
+	Kaetzchen   map[string]map[string]interface{} `cbor:"kaetzchen,omitempty"`
+	Layer       uint8                             `cbor:"layer"`
+	LoadWeight  uint8                             `cbor:"load_weight"`
+}
+
+// wireDocument is the encoding of a pki.Document
+type wireDocument struct {
+	Epoch           uint64              `cbor:"epoch"`
+	MixLambda       float64             `cbor:"mix_lambda"`
+	MixMaxDelay     uint64              `cbor:"mix_max_delay"`
+	SendLambda      float64             `cbor:"send_lambda"`
+	SendShift       uint64              `cbor:"send_shift"`
+	SendMaxInterval uint64              `cbor:"send_max_interval"`
+	Topology        [][]*wireDescriptor `cbor:"topology"`
+	Providers       []*wireDescriptor   `cbor:"providers"`
+}
+
+// wireStaticPKI is the encoding of a static PKI file,
+// the documents are sorted by epoch
+type wireStaticPKI struct {
+	Version   uint8           `cbor:"version"`
+	Documents []*wireDocument `cbor:"documents"`
+}
+
+// wireKeys is the encoding of a keys file, it maps the
+// public keys to their private keys
+type wireKeys struct {
+	Version uint8               `cbor:"version"`
+	Keys    map[[32]byte][]byte `cbor:"keys"`
+}
+
+func toWireDescriptor(desc *pki.MixDescriptor) *wireDescriptor {
+	if desc == nil {
+		return nil
+	}
+	w := &wireDescriptor{
+		Name:       desc.Name,
+		MixKeys:    make(map[uint64][]byte),
+		Addresses:  desc.Addresses,
+		Kaetzchen:  desc.Kaetzchen,
+		Layer:      desc.Layer,
+		LoadWeight: desc.LoadWeight,
+	}
+	if desc.IdentityKey != nil {
+		w.IdentityKey = desc.IdentityKey.Bytes()
+	}
+	if desc.LinkKey != nil {
+		w.LinkKey = desc.LinkKey.Bytes()
+	}
+	for epoch, key := range desc.MixKeys {
+		if key != nil {
+			w.MixKeys[epoch] = key.Bytes()
+		}
+	}
+	return w
+}
+
+func fromWireDescriptor(w *wireDescriptor) (*pki.MixDescriptor, error) {
+	if w == nil {
+		return nil, nil
+	}
+	desc := &pki.MixDescriptor{
+		Name:       w.Name,
+		MixKeys:    make(map[uint64]*ecdh.PublicKey),
+		Addresses:  w.Addresses,
+		Kaetzchen:  w.Kaetzchen,
+		Layer:      w.Layer,
+		LoadWeight: w.LoadWeight,
+	}
+	if w.IdentityKey != nil {
+		desc.IdentityKey = new(eddsa.PublicKey)
+		err := desc.IdentityKey.FromBytes(w.IdentityKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key of %s: %s", w.Name, err)
+		}
+	}
+	if w.LinkKey != nil {
+		desc.LinkKey = new(ecdh.PublicKey)
+		err := desc.LinkKey.FromBytes(w.LinkKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid link key of %s: %s", w.Name, err)
+		}
+	}
+	for epoch, b := range w.MixKeys {
+		key := new(ecdh.PublicKey)
+		err := key.FromBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mix key of %s: %s", w.Name, err)
+		}
+		desc.MixKeys[epoch] = key
+	}
+	return desc, nil
+}
+
+func toWireDescriptors(descs []*pki.MixDescriptor) []*wireDescriptor {
+	if descs == nil {
+		return nil
+	}
+	w := make([]*wireDescriptor, len(descs))
+	for i, desc := range descs {
+		w[i] = toWireDescriptor(desc)
+	}
+	return w
+}
+
+func fromWireDescriptors(w []*wireDescriptor) ([]*pki.MixDescriptor, error) {
+	if w == nil {
+		return nil, nil
+	}
+	descs := make([]*pki.MixDescriptor, len(w))
+	for i := range w {
+		desc, err := fromWireDescriptor(w[i])
+		if err != nil {
+			return nil, err
+		}
+		descs[i] = desc
+	}
+	return descs, nil
+}
+
+func toWireDocument(doc *pki.Document) *wireDocument {
+	w := &wireDocument{
+		Epoch:           doc.Epoch,
+		MixLambda:       doc.MixLambda,
+		MixMaxDelay:     doc.MixMaxDelay,
+		SendLambda:      doc.SendLambda,
+		SendShift:       doc.SendShift,
+		SendMaxInterval: doc.SendMaxInterval,
+		Providers:       toWireDescriptors(doc.Providers),
+	}
+	if doc.Topology != nil {
+		w.Topology = make([][]*wireDescriptor, len(doc.Topology))
+		for i, layer := range doc.Topology {
+			w.Topology[i] = toWireDescriptors(layer)
+		}
+	}
+	return w
+}
+
+func fromWireDocument(w *wireDocument) (*pki.Document, error) {
+	if w == nil {
+		return nil, errors.New("missing document")
+	}
+	doc := &pki.Document{
+		Epoch:           w.Epoch,
+		MixLambda:       w.MixLambda,
+		MixMaxDelay:     w.MixMaxDelay,
+		SendLambda:      w.SendLambda,
+		SendShift:       w.SendShift,
+		SendMaxInterval: w.SendMaxInterval,
+	}
+	var err error
+	doc.Providers, err = fromWireDescriptors(w.Providers)
+	if err != nil {
+		return nil, err
+	}
+	if w.Topology != nil {
+		doc.Topology = make([][]*pki.MixDescriptor, len(w.Topology))
+		for i, layer := range w.Topology {
+			doc.Topology[i], err = fromWireDescriptors(layer)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,256 @@
+// account_mode.go - account deactivation and vacation modes
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+var (
+	// deactivatedKey is the settings bucket key which is
+	// present if the account is deactivated
+	deactivatedKey = []byte("deactivated")
+
+	// vacationTemplateKey is the settings bucket key of the
+	// vacation auto-reply template, absent if not on vacation
+	vacationTemplateKey = []byte("vacation_template")
+
+	// languageKey is the settings bucket key of the language
+	// of the client generated messages, absent if the default
+	languageKey = []byte("language")
+
+	// registeredKey is the settings bucket key of the time the
+	// account was registered with it's Provider by the client,
+	// absent if it was registered out of band
+	registeredKey = []byte("registered")
+
+	// registrationPendingKey is the settings bucket key which is
+	// present while the outcome of a registration is unknown
+	registrationPendingKey = []byte("registration_pending")
+)
+
+// settingsBucketName is the name of
+// the bucket which persists the account's settings
+var settingsBucketName = []byte("settings")
+
+// vacationBucketName is the name of the bucket which
+// persists the time of the last vacation auto-reply to each sender
+var vacationBucketName = []byte("vacation")
+
+// SetDeactivated deactivates or reactivates the given account.
+// A deactivated account may not submit messages but it still
+// receives messages.
+func (s *Store) SetDeactivated(accountName string, deactivated bool) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		if deactivated {
+			return b.Put(deactivatedKey, []byte{1})
+		}
+		return b.Delete(deactivatedKey)
+	}
+	return s.db.Update(transaction)
+}
+
+// IsDeactivated returns true if the given account is deactivated
+func (s *Store) IsDeactivated(accountName string) (bool, error) {
+	deactivated := false
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		deactivated = b.Get(deactivatedKey) != nil
+		return nil
+	}
+	err := s.db.View(transaction)
+	return deactivated, err
+}
+
+// SetVacation puts the given account on vacation, replying to
+// senders with the given template. An empty template ends the
+// vacation and forgets the senders which were replied to.
+func (s *Store) SetVacation(accountName, template string) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		if template != "" {
+			return b.Put(vacationTemplateKey, []byte(template))
+		}
+		err := b.Delete(vacationTemplateKey)
+		if err != nil {
+			return err
+		}
+		root := accountRoot(tx, accountName)
+		err = root.DeleteBucket(vacationBucketName)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = root.CreateBucket(vacationBucketName)
+		return err
+	}
+	return s.db.Update(transaction)
+}
+
+// VacationReply returns the vacation auto-reply template if the
+// given account is on vacation and the sender wasn't replied to
+// within constants.VacationReplyInterval, otherwise an empty string
+// is returned. The reply is recorded so that each sender receives
+// at most one auto-reply per interval.
+func (s *Store) VacationReply(accountName, sender string) (string, error) {
+	template := ""
+	transaction := func(tx *bolt.Tx) error {
+		settings := accountBucket(tx, accountName, settingsBucketName)
+		replies := accountBucket(tx, accountName, vacationBucketName)
+		if settings == nil || replies == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		t := settings.Get(vacationTemplateKey)
+		if t == nil {
+			return nil
+		}
+		key := []byte(strings.ToLower(sender))
+		now := s.now()
+		if v := replies.Get(key); v != nil {
+			lastReply := time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			if now.Sub(lastReply) < constants.VacationReplyInterval {
+				return nil
+			}
+		}
+		v := [8]byte{}
+		binary.BigEndian.PutUint64(v[:], uint64(now.Unix()))
+		template = string(t)
+		return replies.Put(key, v[:])
+	}
+	err := s.db.Update(transaction)
+	return template, err
+}
+
+// SetLanguage sets the language of the messages the client generates
+// for the given account, e.g. "de", see package l10n. An empty
+// language restores the default.
+func (s *Store) SetLanguage(accountName, language string) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		if language == "" {
+			return b.Delete(languageKey)
+		}
+		return b.Put(languageKey, []byte(language))
+	}
+	return s.db.Update(transaction)
+}
+
+// Language returns the language of the messages the client generates
+// for the given account or an empty string if it's the default
+func (s *Store) Language(accountName string) (string, error) {
+	language := ""
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		language = string(b.Get(languageKey))
+		return nil
+	}
+	err := s.db.View(transaction)
+	return language, err
+}
+
+// SetRegistered records that the given account
+// was registered with it's Provider
+func (s *Store) SetRegistered(accountName string) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(s.now().Unix()))
+		err := b.Put(registeredKey, v)
+		if err != nil {
+			return err
+		}
+		return b.Delete(registrationPendingKey)
+	}
+	return s.db.Update(transaction)
+}
+
+// SetRegistrationPending records whether a registration of the
+// given account was sent to it's Provider without it's outcome
+// being known, e.g. because the response was lost
+func (s *Store) SetRegistrationPending(accountName string, pending bool) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		if pending {
+			return b.Put(registrationPendingKey, []byte{1})
+		}
+		return b.Delete(registrationPendingKey)
+	}
+	return s.db.Update(transaction)
+}
+
+// RegistrationPending returns true if the outcome of the
+// last registration of the given account is unknown
+func (s *Store) RegistrationPending(accountName string) (bool, error) {
+	pending := false
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		pending = b.Get(registrationPendingKey) != nil
+		return nil
+	}
+	err := s.db.View(transaction)
+	return pending, err
+}
+
+// RegisteredAt returns the time the given account was registered
+// with it's Provider, or the zero time if it wasn't registered
+// by the client
+func (s *Store) RegisteredAt(accountName string) (time.Time, error) {
+	registered := time.Time{}
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, settingsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		v := b.Get(registeredKey)
+		if len(v) == 8 {
+			registered = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		}
+		return nil
+	}
+	err := s.db.View(transaction)
+	return registered, err
+}
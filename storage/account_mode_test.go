@@ -0,0 +1,116 @@
+// account_mode_test.go - account deactivation and vacation mode tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountModes(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "account_mode_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	deactivated, err := store.IsDeactivated(account)
+	require.NoError(err, "unexpected IsDeactivated() error")
+	require.False(deactivated)
+	err = store.SetDeactivated(account, true)
+	require.NoError(err, "unexpected SetDeactivated() error")
+	deactivated, err = store.IsDeactivated(account)
+	require.NoError(err, "unexpected IsDeactivated() error")
+	require.True(deactivated)
+	err = store.SetDeactivated(account, false)
+	require.NoError(err, "unexpected SetDeactivated() error")
+	deactivated, err = store.IsDeactivated(account)
+	require.NoError(err, "unexpected IsDeactivated() error")
+	require.False(deactivated)
+
+	template, err := store.VacationReply(account, "bob@nsa.gov")
+	require.NoError(err, "unexpected VacationReply() error")
+	require.Equal("", template, "replied while not on vacation")
+
+	err = store.SetVacation(account, "I'm late!")
+	require.NoError(err, "unexpected SetVacation() error")
+	template, err = store.VacationReply(account, "bob@nsa.gov")
+	require.NoError(err, "unexpected VacationReply() error")
+	require.Equal("I'm late!", template)
+	template, err = store.VacationReply(account, "Bob@nsa.gov")
+	require.NoError(err, "unexpected VacationReply() error")
+	require.Equal("", template, "replied twice within the interval")
+
+	now = now.Add(constants.VacationReplyInterval)
+	template, err = store.VacationReply(account, "bob@nsa.gov")
+	require.NoError(err, "unexpected VacationReply() error")
+	require.Equal("I'm late!", template, "no reply after the interval")
+
+	err = store.SetVacation(account, "")
+	require.NoError(err, "unexpected SetVacation() error")
+	template, err = store.VacationReply(account, "carol@fsb.ru")
+	require.NoError(err, "unexpected VacationReply() error")
+	require.Equal("", template, "replied after the vacation ended")
+
+	language, err := store.Language(account)
+	require.NoError(err, "unexpected Language() error")
+	require.Equal("", language)
+	err = store.SetLanguage(account, "pt-BR")
+	require.NoError(err, "unexpected SetLanguage() error")
+	language, err = store.Language(account)
+	require.NoError(err, "unexpected Language() error")
+	require.Equal("pt-BR", language)
+	err = store.SetLanguage(account, "")
+	require.NoError(err, "unexpected SetLanguage() error")
+	language, err = store.Language(account)
+	require.NoError(err, "unexpected Language() error")
+	require.Equal("", language)
+
+	registered, err := store.RegisteredAt(account)
+	require.NoError(err, "unexpected RegisteredAt() error")
+	require.True(registered.IsZero())
+	err = store.SetRegistrationPending(account, true)
+	require.NoError(err, "unexpected SetRegistrationPending() error")
+	pending, err := store.RegistrationPending(account)
+	require.NoError(err, "unexpected RegistrationPending() error")
+	require.True(pending)
+	err = store.SetRegistered(account)
+	require.NoError(err, "unexpected SetRegistered() error")
+	registered, err = store.RegisteredAt(account)
+	require.NoError(err, "unexpected RegisteredAt() error")
+	require.True(now.Equal(registered))
+	pending, err = store.RegistrationPending(account)
+	require.NoError(err, "unexpected RegistrationPending() error")
+	require.False(pending, "the registration is still pending once registered")
+}
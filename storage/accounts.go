@@ -0,0 +1,348 @@
+// accounts.go - nested buckets of the accounts
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/bbolt"
+)
+
+// AccountsBucketName is the name of the boltdb bucket holding a
+// nested bucket for each account, named after the account, which
+// in turn holds the buckets of the account:
+//
+//	accounts/alice@acme.com/ingress
+//	accounts/alice@acme.com/pop3
+//	accounts/alice@acme.com/meta
+//	...
+const AccountsBucketName = "accounts"
+
+// ErrNoSuchAccount is the error returned when
+// the buckets of an account don't exist
+var ErrNoSuchAccount = errors.New("no such account")
+
+// legacyBucketSuffixes maps the names of the nested buckets of an
+// account which were renamed to the suffixes of the names of the
+// top level buckets they replace, e.g. alice@acme.com_incoming
+var legacyBucketSuffixes = map[string]string{
+	string(ingressBucketName):  "incoming",
+	string(metadataBucketName): "metadata",
+}
+
+// legacyBucketName returns the name of the top level bucket which
+// held the given bucket of the account before the buckets were nested
+func legacyBucketName(accountName string, name []byte) []byte {
+	suffix, ok := legacyBucketSuffixes[string(name)]
+	if !ok {
+		suffix = string(name)
+	}
+	return []byte(fmt.Sprintf("%s_%s", accountName, suffix))
+}
+
+// accountRoot returns the bucket holding the
+// buckets of the account, nil if it doesn't exist
+func accountRoot(tx *bolt.Tx, accountName string) *bolt.Bucket {
+	accounts := tx.Bucket([]byte(AccountsBucketName))
+	if accounts == nil {
+		return nil
+	}
+	return accounts.Bucket([]byte(accountName))
+}
+
+// accountBucket returns the given bucket of the
+// account, nil if it doesn't exist
+func accountBucket(tx *bolt.Tx, accountName string, name []byte) *bolt.Bucket {
+	root := accountRoot(tx, accountName)
+	if root == nil {
+		return nil
+	}
+	return root.Bucket(name)
+}
+
+// createAccountBucket returns the given bucket of
+// the account, it's created if it doesn't exist
+func createAccountBucket(tx *bolt.Tx, accountName string, name []byte) (*bolt.Bucket, error) {
+	accounts, err := tx.CreateBucketIfNotExists([]byte(AccountsBucketName))
+	if err != nil {
+		return nil, err
+	}
+	root, err := accounts.CreateBucketIfNotExists([]byte(accountName))
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists(name)
+}
+
+// createAccountBuckets creates all the buckets of the account
+func createAccountBuckets(tx *bolt.Tx, accountName string) error {
+	for _, name := range accountBucketNames {
+		_, err := createAccountBucket(tx, accountName, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountNames returns the names of all the accounts
+func accountNames(tx *bolt.Tx) []string {
+	accounts := []string{}
+	b := tx.Bucket([]byte(AccountsBucketName))
+	if b == nil {
+		return accounts
+	}
+	b.ForEach(func(name, v []byte) error {
+		if v == nil {
+			accounts = append(accounts, string(name))
+		}
+		return nil
+	})
+	return accounts
+}
+
+// Accounts returns the names of the accounts whose
+// buckets exist, sorted in byte order
+func (s *Store) Accounts() ([]string, error) {
+	var accounts []string
+	transaction := func(tx *bolt.Tx) error {
+		accounts = accountNames(tx)
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// DeleteAccount atomically removes all the buckets of the account,
+// the Blocks and the deferred messages sent by the account which are
+// still queued, it's events and it's entries in the contact book,
+// ErrNoSuchAccount is returned if the buckets don't exist. The records
+// which can't be decoded are left in place. The database is marked for
+// compaction, so that the freed pages holding the removed records are
+// dropped when it's next opened, see Compact.
+func (s *Store) DeleteAccount(accountName string) error {
+	transaction := func(tx *bolt.Tx) error {
+		accounts := tx.Bucket([]byte(AccountsBucketName))
+		if accounts == nil {
+			return ErrNoSuchAccount
+		}
+		err := accounts.DeleteBucket([]byte(accountName))
+		if err == bolt.ErrBucketNotFound {
+			return ErrNoSuchAccount
+		}
+		if err != nil {
+			return err
+		}
+		err = removeSenderEgressBlocks(tx, accountName)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{DeferredBucketName, EventsBucketName, ContactsBucketName} {
+			err = removeAccountRecords(tx, name, accountName)
+			if err != nil {
+				return err
+			}
+		}
+		if suites := tx.Bucket([]byte(SuitesBucketName)); suites != nil {
+			err = suites.Delete([]byte(strings.ToLower(accountName)))
+			if err != nil {
+				return err
+			}
+		}
+		return markCompaction(tx)
+	}
+	return s.db.Update(transaction)
+}
+
+// removeSenderEgressBlocks removes the queued
+// Blocks sent by the given account
+func removeSenderEgressBlocks(tx *bolt.Tx, accountName string) error {
+	bucket := tx.Bucket([]byte(EgressBucketName))
+	if bucket == nil {
+		return nil
+	}
+	keys := [][]byte{}
+	bucket.ForEach(func(k, v []byte) error {
+		b, err := EgressBlockFromBytes(v)
+		if err != nil {
+			log.Warningf("%s: skipping an undecodable egress Block: %s", accountName, err)
+			return nil
+		}
+		if strings.EqualFold(b.Sender, accountName) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	for _, k := range keys {
+		err := bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+		err = clearSendIntent(tx, k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountRecord is the part of the records of the
+// top level buckets which tells their account
+type accountRecord struct {
+	// Sender is the account of the deferred messages
+	Sender string
+	// Account is the account of the events
+	Account string
+	// Address is the e-mail address of the contacts
+	Address string
+}
+
+// removeAccountRecords removes the records of the given
+// account from the given top level bucket of JSON records
+func removeAccountRecords(tx *bolt.Tx, name, accountName string) error {
+	bucket := tx.Bucket([]byte(name))
+	if bucket == nil {
+		return nil
+	}
+	keys := [][]byte{}
+	bucket.ForEach(func(k, v []byte) error {
+		r := accountRecord{}
+		err := json.Unmarshal(v, &r)
+		if err != nil {
+			log.Warningf("%s: skipping an undecodable record of %s: %s", accountName, name, err)
+			return nil
+		}
+		for _, account := range []string{r.Sender, r.Account, r.Address} {
+			if strings.EqualFold(account, accountName) {
+				keys = append(keys, k)
+				break
+			}
+		}
+		return nil
+	})
+	for _, k := range keys {
+		err := bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketPath is the path of a bucket from the root
+// of the database, e.g. of the bucket of an account
+type bucketPath [][]byte
+
+// accountBucketPath returns the path of the given bucket of the account
+func accountBucketPath(accountName string, name []byte) bucketPath {
+	return bucketPath{[]byte(AccountsBucketName), []byte(accountName), name}
+}
+
+// String returns the names of the buckets of the path joined by slashes
+func (p bucketPath) String() string {
+	names := make([]string, len(p))
+	for i, name := range p {
+		names[i] = string(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// bucket returns the bucket at the path, nil if it doesn't exist
+func (p bucketPath) bucket(tx *bolt.Tx) *bolt.Bucket {
+	if len(p) == 0 {
+		return nil
+	}
+	b := tx.Bucket(p[0])
+	for _, name := range p[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// copyBucket copies the records, nested buckets and
+// sequence of the bucket src into the empty bucket dst
+func copyBucket(dst, src *bolt.Bucket) error {
+	err := src.ForEach(func(k, v []byte) error {
+		k = append([]byte{}, k...)
+		if v != nil {
+			return dst.Put(k, append([]byte{}, v...))
+		}
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+	if err != nil {
+		return err
+	}
+	return dst.SetSequence(src.Sequence())
+}
+
+// migrateAccounts moves the top level buckets of the accounts,
+// named after the account, e.g. alice@acme.com_pop3, into the
+// nested buckets of the account. The sequences of the buckets are
+// preserved so that the keys of new records aren't reused.
+func migrateAccounts(tx *bolt.Tx) error {
+	pop3Suffix := []byte("_" + string(pop3BucketName))
+	legacyAccounts := []string{}
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if bytes.HasSuffix(name, pop3Suffix) {
+			legacyAccounts = append(legacyAccounts, string(bytes.TrimSuffix(name, pop3Suffix)))
+		}
+		return nil
+	})
+	for _, accountName := range legacyAccounts {
+		for _, name := range accountBucketNames {
+			legacyName := legacyBucketName(accountName, name)
+			legacy := tx.Bucket(legacyName)
+			if legacy == nil {
+				continue
+			}
+			b, err := createAccountBucket(tx, accountName, name)
+			if err != nil {
+				return err
+			}
+			if k, _ := b.Cursor().First(); k != nil {
+				return fmt.Errorf("cannot migrate %s, %s isn't empty", legacyName, accountBucketPath(accountName, name))
+			}
+			err = copyBucket(b, legacy)
+			if err != nil {
+				return err
+			}
+			err = tx.DeleteBucket(legacyName)
+			if err != nil {
+				return err
+			}
+		}
+		err := createAccountBuckets(tx, accountName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
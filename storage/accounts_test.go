@@ -0,0 +1,186 @@
+// accounts_test.go - tests for the nested buckets of the accounts
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccounts(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "accounts_test1")
+	defer cleanup()
+	accounts, err := store.Accounts()
+	require.NoError(err, "unexpected Accounts() error")
+	require.Equal(0, len(accounts))
+
+	err = store.CreateAccountBuckets([]string{"bob@nsa.gov", "alice@acme.com"})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	accounts, err = store.Accounts()
+	require.NoError(err, "unexpected Accounts() error")
+	require.Equal([]string{"alice@acme.com", "bob@nsa.gov"}, accounts)
+	err = store.PutMessage("alice@acme.com", []byte("Subject: hello\n\nhi"))
+	require.NoError(err, "unexpected PutMessage() error")
+	for _, sender := range []string{"alice@acme.com", "bob@nsa.gov"} {
+		_, err = store.PutEgressBlock(&EgressBlock{
+			Sender:    sender,
+			Recipient: "carol@fsb.ru",
+			Block: block.Block{
+				TotalBlocks: uint16(1),
+				Block:       []byte("queued"),
+			},
+		})
+		require.NoError(err, "unexpected PutEgressBlock() error")
+	}
+
+	err = store.DeleteAccount("alice@acme.com")
+	require.NoError(err, "unexpected DeleteAccount() error")
+	accounts, err = store.Accounts()
+	require.NoError(err, "unexpected Accounts() error")
+	require.Equal([]string{"bob@nsa.gov"}, accounts)
+	_, err = store.Messages("alice@acme.com")
+	require.Error(err, "deleted account not detected")
+	egress, err := store.EgressBlocks()
+	require.NoError(err, "unexpected EgressBlocks() error")
+	require.Equal(1, len(egress))
+	require.Equal("bob@nsa.gov", egress[0].Sender)
+	err = store.DeleteAccount("alice@acme.com")
+	require.Equal(ErrNoSuchAccount, err)
+}
+
+func TestDeleteAccountData(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "accounts_test3")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	err = store.CreateAccountBuckets([]string{"bob@nsa.gov", "alice@acme.com"})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	for _, account := range []string{"alice@acme.com", "bob@nsa.gov"} {
+		_, err = store.PutDeferredMessage(&DeferredMessage{Sender: account, Recipient: "carol@fsb.ru"})
+		require.NoError(err, "unexpected PutDeferredMessage() error")
+		err = store.RecordEvent(&Event{Type: EventMessageQueued, Account: account})
+		require.NoError(err, "unexpected RecordEvent() error")
+		err = store.PutContact(&Contact{Alias: strings.Split(account, "@")[0], Address: account})
+		require.NoError(err, "unexpected PutContact() error")
+	}
+	// an undecodable record doesn't abort the deletion
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(EgressBucketName))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("corrupt"), []byte("not a Block"))
+	})
+	require.NoError(err, "unexpected Update() error")
+
+	err = store.DeleteAccount("alice@acme.com")
+	require.NoError(err, "unexpected DeleteAccount() error")
+	deferred, err := store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Len(deferred, 1)
+	require.Equal("bob@nsa.gov", deferred[0].Sender)
+	events, err := store.Events(time.Time{}, 0)
+	require.NoError(err, "unexpected Events() error")
+	require.Len(events, 1)
+	require.Equal("bob@nsa.gov", events[0].Account)
+	contacts, err := store.Contacts()
+	require.NoError(err, "unexpected Contacts() error")
+	require.Len(contacts, 1)
+	require.Equal("bob@nsa.gov", contacts[0].Address)
+
+	// the database is compacted when it's next opened
+	err = store.Close()
+	require.NoError(err, "unexpected Close() error")
+	store, err = New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	err = store.db.View(func(tx *bolt.Tx) error {
+		require.Nil(tx.Bucket(compactionBucketName), "the database is still marked for compaction")
+		return nil
+	})
+	require.NoError(err, "unexpected View() error")
+	_, err = os.Stat(dbFile.Name() + ".old")
+	require.True(os.IsNotExist(err), "the old database file was left behind")
+	accounts, err := store.Accounts()
+	require.NoError(err, "unexpected Accounts() error")
+	require.Equal([]string{"bob@nsa.gov"}, accounts)
+	deferred, err = store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Len(deferred, 1)
+}
+
+func TestMigrateAccounts(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "accounts_test2")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(dbFile.Name())
+	account := "alice@acme.com"
+
+	// the layout of the top level buckets named after the account
+	db, err := bolt.Open(dbFile.Name(), 0600, nil)
+	require.NoError(err, "unexpected bolt.Open error")
+	err = db.Update(func(tx *bolt.Tx) error {
+		pop3, err := tx.CreateBucket([]byte(account + "_pop3"))
+		require.NoError(err)
+		require.NoError(pop3.SetSequence(7))
+		require.NoError(pop3.Put([]byte("7"), []byte("Subject: hello\n\nhi")))
+		ingress, err := tx.CreateBucket([]byte(account + "_incoming"))
+		require.NoError(err)
+		require.NoError(ingress.Put([]byte("1"), []byte("block")))
+		_, err = tx.CreateBucket([]byte(account + "_metadata"))
+		return err
+	})
+	require.NoError(err, "unexpected Update() error")
+	db.Close()
+
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	accounts, err := store.Accounts()
+	require.NoError(err, "unexpected Accounts() error")
+	require.Equal([]string{account}, accounts)
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal([][]byte{[]byte("Subject: hello\n\nhi")}, messages)
+
+	err = store.db.View(func(tx *bolt.Tx) error {
+		require.Nil(tx.Bucket([]byte(account + "_pop3")))
+		require.Nil(tx.Bucket([]byte(account + "_incoming")))
+		require.Nil(tx.Bucket([]byte(account + "_metadata")))
+		require.Equal(uint64(7), accountBucket(tx, account, pop3BucketName).Sequence())
+		require.Equal([]byte("block"), accountBucket(tx, account, ingressBucketName).Get([]byte("1")))
+		// the buckets missing from the old layout are created
+		for _, name := range accountBucketNames {
+			require.NotNil(accountBucket(tx, account, name), "missing bucket %s", name)
+		}
+		return nil
+	})
+	require.NoError(err, "unexpected View() error")
+}
@@ -0,0 +1,304 @@
+// archive.go - export and import of the client state
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/crypto/vault"
+)
+
+// ArchiveVersion is the version of the archive format
+const ArchiveVersion = 1
+
+// Archive is a serializable snapshot of the client state used for
+// device migration and disaster recovery. The ingress buckets and
+// replay caches are not archived, they only hold transient state.
+type Archive struct {
+	// Version is the archive format version
+	Version int
+
+	// Contacts is the contact book
+	Contacts [][]byte
+
+	// Egress is the queue of Blocks waiting to be ACKed
+	Egress [][]byte
+
+	// Mailboxes maps each account to it's pop3 messages
+	Mailboxes map[string][][]byte
+
+	// Folders maps each account to the messages of it's
+	// folders other than the INBOX, indexed by folder
+	Folders map[string]map[string][][]byte `json:",omitempty"`
+
+	// Settings maps each account to it's settings
+	Settings map[string]map[string][]byte
+}
+
+// bucketValues returns copies of all the values of the given bucket
+func bucketValues(b *bolt.Bucket) [][]byte {
+	values := [][]byte{}
+	if b == nil {
+		return values
+	}
+	b.ForEach(func(k, v []byte) error {
+		values = append(values, append([]byte{}, v...))
+		return nil
+	})
+	return values
+}
+
+// Export returns a snapshot of the client state
+func (s *Store) Export() (*Archive, error) {
+	a := Archive{
+		Version:   ArchiveVersion,
+		Mailboxes: make(map[string][][]byte),
+		Folders:   make(map[string]map[string][][]byte),
+		Settings:  make(map[string]map[string][]byte),
+	}
+	transaction := func(tx *bolt.Tx) error {
+		a.Contacts = bucketValues(tx.Bucket([]byte(ContactsBucketName)))
+		a.Egress = bucketValues(tx.Bucket([]byte(EgressBucketName)))
+		for _, account := range accountNames(tx) {
+			a.Mailboxes[account] = bucketValues(accountBucket(tx, account, pop3BucketName))
+			folders := make(map[string][][]byte)
+			for _, folder := range Folders {
+				if folder == FolderInbox {
+					continue
+				}
+				folders[folder] = bucketValues(accountBucket(tx, account, folderBucketName(folder)))
+			}
+			a.Folders[account] = folders
+			settings := make(map[string][]byte)
+			if b := accountBucket(tx, account, settingsBucketName); b != nil {
+				b.ForEach(func(k, v []byte) error {
+					settings[string(k)] = append([]byte{}, v...)
+					return nil
+				})
+			}
+			a.Settings[account] = settings
+		}
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// egressKey returns the message ID and Block ID of a
+// serialized EgressBlock which identify it across databases
+func egressKey(raw []byte) (string, error) {
+	b, err := EgressBlockFromBytes(raw)
+	if err != nil {
+		return "", err
+	}
+	return blockKey(b), nil
+}
+
+// blockKey returns the message ID and Block ID of the given Block
+func blockKey(b *EgressBlock) string {
+	return fmt.Sprintf("%x:%d", b.Block.MessageID, b.Block.BlockID)
+}
+
+// Import merges the given snapshot into the Store without
+// clobbering existing data: existing contacts and settings take
+// precedence, Blocks already queued and messages already in a
+// mailbox are skipped
+func (s *Store) Import(a *Archive) error {
+	if a.Version != ArchiveVersion {
+		return fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+	transaction := func(tx *bolt.Tx) error {
+		contacts, err := tx.CreateBucketIfNotExists([]byte(ContactsBucketName))
+		if err != nil {
+			return err
+		}
+		for _, raw := range a.Contacts {
+			c, err := contactFromBytes(raw)
+			if err != nil {
+				return err
+			}
+			key := []byte(strings.ToLower(c.Alias))
+			if contacts.Get(key) == nil {
+				err = contacts.Put(key, raw)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = s.importEgress(tx, a.Egress)
+		if err != nil {
+			return err
+		}
+
+		for account, messages := range a.Mailboxes {
+			err := createAccountBuckets(tx, account)
+			if err != nil {
+				return err
+			}
+			seen := make(map[[sha256.Size]byte]bool)
+			for _, v := range bucketValues(accountBucket(tx, account, pop3BucketName)) {
+				seen[sha256.Sum256(v)] = true
+			}
+			for _, message := range messages {
+				if seen[sha256.Sum256(message)] {
+					continue
+				}
+				err = s.putMessage(tx, account, message)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for account, folders := range a.Folders {
+			for name, messages := range folders {
+				folder, err := folderName(name)
+				if err != nil || folder == FolderInbox {
+					return fmt.Errorf("invalid folder %s in archive", name)
+				}
+				b, err := createAccountBucket(tx, account, folderBucketName(folder))
+				if err != nil {
+					return err
+				}
+				seen := make(map[[sha256.Size]byte]bool)
+				for _, v := range bucketValues(b) {
+					seen[sha256.Sum256(v)] = true
+				}
+				for _, message := range messages {
+					if seen[sha256.Sum256(message)] {
+						continue
+					}
+					_, err = s.putFolderMessage(tx, account, folder, message)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		for account, settings := range a.Settings {
+			b, err := createAccountBucket(tx, account, settingsBucketName)
+			if err != nil {
+				return err
+			}
+			for k, v := range settings {
+				if b.Get([]byte(k)) == nil {
+					err = b.Put([]byte(k), v)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
+
+// importEgress adds the given serialized EgressBlocks
+// to the egress bucket unless they're already queued
+func (s *Store) importEgress(tx *bolt.Tx, egress [][]byte) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(EgressBucketName))
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]bool)
+	for _, v := range bucketValues(bucket) {
+		key, err := egressKey(v)
+		if err != nil {
+			return err
+		}
+		queued[key] = true
+	}
+	for _, raw := range egress {
+		key, err := egressKey(raw)
+		if err != nil {
+			return err
+		}
+		if queued[key] {
+			continue
+		}
+		b, err := EgressBlockFromBytes(raw)
+		if err != nil {
+			return err
+		}
+		id, _ := bucket.NextSequence()
+		binary.BigEndian.PutUint64(b.BlockID[:], id)
+		value, err := b.ToBytes()
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(b.BlockID[:], value)
+		if err != nil {
+			return err
+		}
+		queued[key] = true
+	}
+	return nil
+}
+
+// ExportToVault writes a snapshot of the client
+// state into the given encrypted vault
+func (s *Store) ExportToVault(v *vault.Vault) error {
+	a, err := s.Export()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return v.Seal(raw)
+}
+
+// OpenArchive reads a snapshot of the client
+// state from the given encrypted vault
+func OpenArchive(v *vault.Vault) (*Archive, error) {
+	raw, err := v.Open()
+	if err != nil {
+		return nil, err
+	}
+	a := Archive{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&a)
+	if err != nil {
+		return nil, errors.New("failed to decode client state archive")
+	}
+	return &a, nil
+}
+
+// ImportFromVault merges the snapshot of the client
+// state read from the given encrypted vault
+func (s *Store) ImportFromVault(v *vault.Vault) error {
+	a, err := OpenArchive(v)
+	if err != nil {
+		return err
+	}
+	return s.Import(a)
+}
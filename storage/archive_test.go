@@ -0,0 +1,106 @@
+// archive_test.go - export and import of the client state tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/crypto/vault"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(require *require.Assertions, name string) (*Store, func()) {
+	dbFile, err := ioutil.TempFile("", name)
+	require.NoError(err, "unexpected TempFile error")
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	return store, func() {
+		store.Close()
+		os.Remove(dbFile.Name())
+	}
+}
+
+func TestArchiveExportImport(t *testing.T) {
+	require := require.New(t)
+
+	src, cleanup := newTestStore(require, "archive_test1")
+	defer cleanup()
+	dst, cleanup := newTestStore(require, "archive_test2")
+	defer cleanup()
+
+	account := "alice@acme.com"
+	for _, store := range []*Store{src, dst} {
+		err := store.CreateAccountBuckets([]string{account})
+		require.NoError(err, "unexpected CreateAccountBuckets() error")
+		err = store.PutMessage(account, []byte("Subject: shared\n\nin both mailboxes\n"))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	err := src.PutMessage(account, []byte("Subject: old\n\nonly in the archive\n"))
+	require.NoError(err, "unexpected PutMessage() error")
+	err = src.PutContact(&Contact{Alias: "bob", Address: "bob@nsa.gov"})
+	require.NoError(err, "unexpected PutContact() error")
+	err = src.PutContact(&Contact{Alias: "carol", Address: "carol@fsb.ru"})
+	require.NoError(err, "unexpected PutContact() error")
+	err = dst.PutContact(&Contact{Alias: "bob", Address: "bob@newprovider.net"})
+	require.NoError(err, "unexpected PutContact() error")
+	err = src.SetVacation(account, "gone fishing")
+	require.NoError(err, "unexpected SetVacation() error")
+	egressBlock := EgressBlock{
+		Sender:            account,
+		SenderProvider:    "acme.com",
+		Recipient:         "bob@nsa.gov",
+		RecipientProvider: "nsa.gov",
+		Block: block.Block{
+			TotalBlocks: uint16(1),
+			Block:       []byte("queued"),
+		},
+	}
+	_, err = src.PutEgressBlock(&egressBlock)
+	require.NoError(err, "unexpected PutEgressBlock() error")
+
+	vaultFile, err := ioutil.TempFile("", "archive_test_vault")
+	require.NoError(err, "unexpected TempFile error")
+	defer os.Remove(vaultFile.Name())
+	options := vault.Options{Parallelism: 1, Memory: 1 << 10, NumIter: 1}
+	v, err := vault.New("client state", "correct horse battery staple", vaultFile.Name(), account, &options)
+	require.NoError(err, "unexpected vault.New() error")
+	err = src.ExportToVault(v)
+	require.NoError(err, "unexpected ExportToVault() error")
+
+	// importing twice must not duplicate anything
+	for i := 0; i < 2; i++ {
+		err = dst.ImportFromVault(v)
+		require.NoError(err, "unexpected ImportFromVault() error")
+	}
+
+	messages, err := dst.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(2, len(messages))
+	contacts, err := dst.Contacts()
+	require.NoError(err, "unexpected Contacts() error")
+	require.Equal(2, len(contacts))
+	require.Equal("bob@newprovider.net", contacts[0].Address, "existing contact was clobbered")
+	keys, err := dst.GetKeys()
+	require.NoError(err, "unexpected GetKeys() error")
+	require.Equal(1, len(keys))
+	template, err := dst.VacationReply(account, "bob@nsa.gov")
+	require.NoError(err, "unexpected VacationReply() error")
+	require.Equal("gone fishing", template)
+}
@@ -0,0 +1,124 @@
+// bandwidth.go - bandwidth accounting
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+// Usage is the bandwidth used by an account during a month
+type Usage struct {
+	// Sent is the number of bytes sent to the Provider
+	Sent uint64
+	// Received is the number of bytes received from the Provider
+	Received uint64
+	// CapNotified is true once the account was notified
+	// that it reached it's monthly usage cap
+	CapNotified bool
+}
+
+// Total returns the number of bytes sent and received
+func (u *Usage) Total() uint64 {
+	return u.Sent + u.Received
+}
+
+// bandwidthBucketName is the name of
+// the bucket which persists the account's monthly usage
+var bandwidthBucketName = []byte("bandwidth")
+
+// usageMonth returns the key of the month of the given time,
+// months are delimited in UTC
+func usageMonth(t time.Time) []byte {
+	return []byte(t.UTC().Format("2006-01"))
+}
+
+// updateUsage applies the given update to the
+// account's usage of the current month
+func (s *Store) updateUsage(accountName string, update func(*Usage)) (*Usage, error) {
+	usage := Usage{}
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, bandwidthBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		month := usageMonth(s.now())
+		if value := b.Get(month); value != nil {
+			err := json.Unmarshal(value, &usage)
+			if err != nil {
+				return err
+			}
+		}
+		update(&usage)
+		value, err := json.Marshal(&usage)
+		if err != nil {
+			return err
+		}
+		return b.Put(month, value)
+	}
+	err := s.db.Update(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// RecordUsage adds the given numbers of bytes sent and received
+// to the account's usage of the current month
+func (s *Store) RecordUsage(accountName string, sent, received int) error {
+	_, err := s.updateUsage(accountName, func(u *Usage) {
+		u.Sent += uint64(sent)
+		u.Received += uint64(received)
+	})
+	return err
+}
+
+// MarkCapNotified records that the account was notified that it
+// reached it's usage cap of the current month. It returns false
+// if the account was already notified.
+func (s *Store) MarkCapNotified(accountName string) (bool, error) {
+	notified := false
+	_, err := s.updateUsage(accountName, func(u *Usage) {
+		notified = u.CapNotified
+		u.CapNotified = true
+	})
+	return !notified, err
+}
+
+// Usage returns the account's usage of the month of the given time
+func (s *Store) Usage(accountName string, t time.Time) (*Usage, error) {
+	usage := Usage{}
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, bandwidthBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		value := b.Get(usageMonth(t))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &usage)
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
@@ -0,0 +1,60 @@
+// bandwidth_test.go - bandwidth accounting tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "bandwidth_test")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	january := time.Date(2017, time.January, 31, 23, 59, 0, 0, time.UTC)
+	store.now = func() time.Time { return january }
+	err = store.RecordUsage(account, 100, 0)
+	require.NoError(err, "unexpected RecordUsage() error")
+	err = store.RecordUsage(account, 20, 3)
+	require.NoError(err, "unexpected RecordUsage() error")
+	first, err := store.MarkCapNotified(account)
+	require.NoError(err, "unexpected MarkCapNotified() error")
+	require.True(first)
+	first, err = store.MarkCapNotified(account)
+	require.NoError(err, "unexpected MarkCapNotified() error")
+	require.False(first)
+
+	usage, err := store.Usage(account, january)
+	require.NoError(err, "unexpected Usage() error")
+	require.Equal(Usage{Sent: 120, Received: 3, CapNotified: true}, *usage)
+	require.Equal(uint64(123), usage.Total())
+
+	february := january.Add(time.Hour)
+	store.now = func() time.Time { return february }
+	err = store.RecordUsage(account, 0, 7)
+	require.NoError(err, "unexpected RecordUsage() error")
+	usage, err = store.Usage(account, february)
+	require.NoError(err, "unexpected Usage() error")
+	require.Equal(Usage{Received: 7}, *usage)
+}
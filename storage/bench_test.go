@@ -0,0 +1,311 @@
+// bench_test.go - benchmarks of the storage on large databases
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkRecords are the numbers of records of the synthetic
+// databases of the benchmarks. The Blocks have full payloads, as
+// received and sent by clients, a database of 10k Blocks takes
+// several hundred megabytes.
+var benchmarkRecords = []int{1000, 10000}
+
+// syntheticBatch is the number of records written
+// per transaction by newSyntheticStore
+const syntheticBatch = 1000
+
+// syntheticDB describes the records of a synthetic database
+type syntheticDB struct {
+	// accounts are the names of the accounts
+	accounts []string
+	// ingressMessages is the number of messages of each account
+	// of which the Blocks are held in the ingress bucket
+	ingressMessages int
+	// blocksPerMessage is the number of Blocks of each message
+	blocksPerMessage int
+	// egressBlocks is the number of queued Blocks sent by
+	// each account
+	egressBlocks int
+}
+
+// syntheticMessageID returns the ID of the i-th
+// ingress message of a synthetic database
+func syntheticMessageID(i int) [constants.MessageIDLength]byte {
+	id := [constants.MessageIDLength]byte{}
+	binary.BigEndian.PutUint64(id[:], uint64(i+1))
+	return id
+}
+
+// syntheticBlock returns a Block with a full payload
+func syntheticBlock(messageID [constants.MessageIDLength]byte, blockID, totalBlocks int) *block.Block {
+	payload := make([]byte, block.BlockLength)
+	binary.BigEndian.PutUint64(payload, uint64(blockID))
+	return &block.Block{
+		MessageID:   messageID,
+		TotalBlocks: uint16(totalBlocks),
+		BlockID:     uint16(blockID),
+		Block:       payload,
+	}
+}
+
+// syntheticEgressBlock returns a queued Block of the given account
+func syntheticEgressBlock(accountName string, i int) *EgressBlock {
+	return &EgressBlock{
+		Sender:            accountName,
+		SenderProvider:    "acme.com",
+		Recipient:         "bob",
+		RecipientProvider: "nsa.gov",
+		SURBKeys:          make([]byte, surbKeyMaterialLength),
+		Block:             *syntheticBlock(syntheticMessageID(i), 0, 1),
+	}
+}
+
+// writeBatched calls put count times, in transactions
+// of up to syntheticBatch calls
+func writeBatched(store *Store, count int, put func(tx *bolt.Tx, i int) error) error {
+	for start := 0; start < count; start += syntheticBatch {
+		err := store.db.Update(func(tx *bolt.Tx) error {
+			for i := start; i < count && i < start+syntheticBatch; i++ {
+				err := put(tx, i)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSyntheticStore returns a Store in a temporary file populated
+// with the records of the given synthetic database, and the function
+// removing it. The records are written as by PutIngressBlock and
+// PutEgressBlock, in large transactions so that databases of many
+// thousand records are quickly populated.
+func newSyntheticStore(tb testing.TB, db syntheticDB) (*Store, func()) {
+	require := require.New(tb)
+	store, cleanup := newTestStore(require, "synthetic")
+	err := store.CreateAccountBuckets(db.accounts)
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	for _, accountName := range db.accounts {
+		blocks := db.ingressMessages * db.blocksPerMessage
+		err = writeBatched(store, blocks, func(tx *bolt.Tx, i int) error {
+			bucket := accountBucket(tx, accountName, ingressBucketName)
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			// the Blocks of the messages are interleaved
+			// as if they arrived at the same time
+			ingressBlock := IngressBlock{
+				Block: syntheticBlock(syntheticMessageID(i%db.ingressMessages), i/db.ingressMessages, db.blocksPerMessage),
+			}
+			value, err := ingressBlock.ToBytes()
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(strconv.FormatUint(seq, 10)), value)
+		})
+		require.NoError(err, "failed to populate the ingress Blocks")
+		err = writeBatched(store, db.egressBlocks, func(tx *bolt.Tx, i int) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(EgressBucketName))
+			if err != nil {
+				return err
+			}
+			b := syntheticEgressBlock(accountName, i)
+			id, _ := bucket.NextSequence()
+			binary.BigEndian.PutUint64(b.BlockID[:], id)
+			value, err := b.ToBytes()
+			if err != nil {
+				return err
+			}
+			return bucket.Put(b.BlockID[:], value)
+		})
+		require.NoError(err, "failed to populate the egress Blocks")
+	}
+	return store, cleanup
+}
+
+func TestSyntheticStore(t *testing.T) {
+	require := require.New(t)
+
+	account := "alice@acme.com"
+	store, cleanup := newSyntheticStore(t, syntheticDB{
+		accounts:         []string{account},
+		ingressMessages:  3,
+		blocksPerMessage: 2,
+		egressBlocks:     syntheticBatch + 1,
+	})
+	defer cleanup()
+	blocks, _, err := store.GetIngressBlocks(account, syntheticMessageID(1))
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Equal(2, len(blocks))
+	for i, b := range blocks {
+		require.Equal(uint16(i), b.Block.BlockID)
+	}
+	egress, err := store.EgressBlocks()
+	require.NoError(err, "unexpected EgressBlocks() error")
+	require.Equal(syntheticBatch+1, len(egress))
+}
+
+func BenchmarkPutEgressBlock(b *testing.B) {
+	account := "alice@acme.com"
+	for _, n := range benchmarkRecords {
+		b.Run(fmt.Sprintf("%drecords", n), func(b *testing.B) {
+			store, cleanup := newSyntheticStore(b, syntheticDB{
+				accounts:     []string{account},
+				egressBlocks: n,
+			})
+			defer cleanup()
+			egressBlock := syntheticEgressBlock(account, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := store.PutEgressBlock(egressBlock)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetIngressBlocks(b *testing.B) {
+	account := "alice@acme.com"
+	blocksPerMessage := 4
+	for _, n := range benchmarkRecords {
+		b.Run(fmt.Sprintf("%drecords", n), func(b *testing.B) {
+			messages := n / blocksPerMessage
+			store, cleanup := newSyntheticStore(b, syntheticDB{
+				accounts:         []string{account},
+				ingressMessages:  messages,
+				blocksPerMessage: blocksPerMessage,
+			})
+			defer cleanup()
+			b.Run("alloc", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, _, err := store.GetIngressBlocks(account, syntheticMessageID(i%messages))
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("reuse", func(b *testing.B) {
+				var blocks []*IngressBlock
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					var err error
+					blocks, _, err = store.GetIngressBlocksInto(account, syntheticMessageID(i%messages), blocks)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkEgressBlockSerialization(b *testing.B) {
+	egressBlock := syntheticEgressBlock("alice@acme.com", 0)
+	raw, err := egressBlock.ToBytes()
+	require.NoError(b, err, "unexpected ToBytes() error")
+	b.Run("ToBytes", func(b *testing.B) {
+		b.SetBytes(int64(len(raw)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := egressBlock.ToBytes()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("FromBytes", func(b *testing.B) {
+		b.SetBytes(int64(len(raw)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := EgressBlockFromBytes(raw)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkIngressBlockSerialization(b *testing.B) {
+	ingressBlock := IngressBlock{
+		Block: syntheticBlock(syntheticMessageID(0), 0, 1),
+	}
+	raw, err := ingressBlock.ToBytes()
+	require.NoError(b, err, "unexpected ToBytes() error")
+	b.Run("ToBytes", func(b *testing.B) {
+		b.SetBytes(int64(len(raw)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := ingressBlock.ToBytes()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("AppendBinary", func(b *testing.B) {
+		buf := make([]byte, 0, len(raw))
+		b.SetBytes(int64(len(raw)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var err error
+			buf, err = ingressBlock.AppendBinary(buf[:0])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("FromBytes", func(b *testing.B) {
+		b.SetBytes(int64(len(raw)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := IngressBlockFromBytes(raw)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("UnmarshalBinary", func(b *testing.B) {
+		decoded := IngressBlock{}
+		b.SetBytes(int64(len(raw)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := decoded.UnmarshalBinary(raw)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
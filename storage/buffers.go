@@ -0,0 +1,66 @@
+// buffers.go - pooled buffers of the ingress path
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/katzenpost/client/crypto/block"
+)
+
+// ingressBlockSize is the size of a serialized IngressBlock
+const ingressBlockSize = 32 + block.SerializedLength
+
+// bufferPool holds the buffers IngressBlocks are serialized into
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, ingressBlockSize)
+		return &b
+	},
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putBuffer returns the buffer to the pool
+func putBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
+
+// ingressBlocksPool holds the slices of IngressBlocks the
+// Blocks of a message are decoded into while it's reassembled
+var ingressBlocksPool = sync.Pool{
+	New: func() interface{} {
+		return new([]*IngressBlock)
+	},
+}
+
+// getIngressBlocks returns a slice of IngressBlocks from the pool,
+// those up to it's capacity are reused by ingressBlocks
+func getIngressBlocks() *[]*IngressBlock {
+	return ingressBlocksPool.Get().(*[]*IngressBlock)
+}
+
+// putIngressBlocks returns the slice of IngressBlocks to the pool
+func putIngressBlocks(blocks *[]*IngressBlock) {
+	*blocks = (*blocks)[:0]
+	ingressBlocksPool.Put(blocks)
+}
@@ -0,0 +1,162 @@
+// compact.go - compaction of the database file
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/wipe"
+)
+
+// compactionBucketName is the name of the boltdb bucket which
+// marks the database for compaction once data which mustn't
+// survive on disk was deleted, see DeleteAccount
+var compactionBucketName = []byte("compaction")
+
+// markCompaction marks the database for compaction
+func markCompaction(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(compactionBucketName)
+	return err
+}
+
+// Compact rewrites the closed database file with only it's live
+// records. boltdb keeps the pages freed by a deletion, which still
+// hold the deleted records, in the file and reuses them later, the
+// compacted file has no free pages. The old file is shredded once
+// the compacted one has replaced it.
+func Compact(dbFile string) error {
+	oldFile := dbFile + ".old"
+	tmpFile := dbFile + ".compact"
+	err := removeOldFile(dbFile, oldFile)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(tmpFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	src, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: constants.DatabaseConnectTimeout})
+	if err != nil {
+		return err
+	}
+	err = copyDB(tmpFile, src)
+	if closeErr := src.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	// the old file is kept under another name, so that the
+	// database file is replaced atomically, until it's shredded
+	err = os.Link(dbFile, oldFile)
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	err = os.Rename(tmpFile, dbFile)
+	if err != nil {
+		os.Remove(tmpFile)
+		os.Remove(oldFile)
+		return err
+	}
+	return wipe.ShredFile(oldFile)
+}
+
+// removeOldFile removes the old database file left behind by an
+// interrupted compaction, it's only shredded if it was replaced
+func removeOldFile(dbFile, oldFile string) error {
+	oldInfo, err := os.Stat(oldFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(info, oldInfo) {
+		return os.Remove(oldFile)
+	}
+	return wipe.ShredFile(oldFile)
+}
+
+// copyDB copies the buckets of the given database, except the
+// compaction mark, into a new database created at the given path
+func copyDB(path string, src *bolt.DB) error {
+	dst, err := bolt.Open(path, 0600, &bolt.Options{Timeout: constants.DatabaseConnectTimeout})
+	if err != nil {
+		return err
+	}
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				if bytes.Equal(name, compactionBucketName) {
+					return nil
+				}
+				nested, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nested, b)
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compactIfMarked compacts the database file if it's marked for
+// compaction or finishes an interrupted compaction, a missing
+// file is ignored
+func compactIfMarked(dbFile string) error {
+	_, err := os.Stat(dbFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = removeOldFile(dbFile, dbFile+".old")
+	if err != nil {
+		return err
+	}
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: constants.DatabaseConnectTimeout})
+	if err != nil {
+		return err
+	}
+	marked := false
+	err = db.View(func(tx *bolt.Tx) error {
+		marked = tx.Bucket(compactionBucketName) != nil
+		return nil
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !marked {
+		return err
+	}
+	log.Notice("compacting the database to drop the deleted records")
+	return Compact(dbFile)
+}
@@ -0,0 +1,234 @@
+// contacts.go - persistent contact book
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+const (
+	// ContactsBucketName is the name of the boltdb bucket which
+	// persists the contact book, shared by all the accounts
+	ContactsBucketName = "contacts"
+
+	// SuitesBucketName is the name of the boltdb bucket which
+	// persists the envelope suite last used with each correspondent
+	SuitesBucketName = "suites"
+)
+
+// ErrContactNotFound is the error returned when
+// a contact book lookup fails
+var ErrContactNotFound = errors.New("contact not found")
+
+// Contact is a contact book entry, mapping a friendly
+// alias to a full mixnet e-mail address and optionally
+// pinning the contact's end to end public key
+type Contact struct {
+	// Alias is the friendly name of the contact, e.g. alice
+	Alias string
+
+	// Address is the e-mail address of the contact, e.g. alice@acme.com
+	Address string
+
+	// PinnedKey, if not nil, takes precedence over the
+	// key published in the user PKI
+	PinnedKey *ecdh.PublicKey
+
+	// Blocked discards the messages received from the
+	// contact, see package mail_filter
+	Blocked bool
+}
+
+// jsonContact is a json serializable representation of Contact
+type jsonContact struct {
+	Alias     string
+	Address   string
+	PinnedKey string
+	Blocked   bool
+}
+
+// toBytes serializes the contact
+func (c *Contact) toBytes() ([]byte, error) {
+	j := jsonContact{
+		Alias:   c.Alias,
+		Address: c.Address,
+		Blocked: c.Blocked,
+	}
+	if c.PinnedKey != nil {
+		j.PinnedKey = base64.StdEncoding.EncodeToString(c.PinnedKey.Bytes())
+	}
+	return json.Marshal(j)
+}
+
+// contactFromBytes deserializes a contact
+func contactFromBytes(raw []byte) (*Contact, error) {
+	j := jsonContact{}
+	err := json.Unmarshal(raw, &j)
+	if err != nil {
+		return nil, err
+	}
+	c := Contact{
+		Alias:   j.Alias,
+		Address: j.Address,
+		Blocked: j.Blocked,
+	}
+	if j.PinnedKey != "" {
+		rawKey, err := base64.StdEncoding.DecodeString(j.PinnedKey)
+		if err != nil {
+			return nil, err
+		}
+		c.PinnedKey = new(ecdh.PublicKey)
+		err = c.PinnedKey.FromBytes(rawKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// PutContact adds the contact to the contact book,
+// replacing any contact with the same alias
+func (s *Store) PutContact(c *Contact) error {
+	if c.Alias == "" || strings.Contains(c.Alias, "@") {
+		return errors.New("contact alias must be non-empty and not an e-mail address")
+	}
+	if !strings.Contains(c.Address, "@") {
+		return errors.New("contact address must be an e-mail address")
+	}
+	value, err := c.toBytes()
+	if err != nil {
+		return err
+	}
+	transaction := func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ContactsBucketName))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(strings.ToLower(c.Alias)), value)
+	}
+	return s.db.Update(transaction)
+}
+
+// RemoveContact removes the contact with the given alias
+func (s *Store) RemoveContact(alias string) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ContactsBucketName))
+		key := []byte(strings.ToLower(alias))
+		if b == nil || b.Get(key) == nil {
+			return ErrContactNotFound
+		}
+		return b.Delete(key)
+	}
+	return s.db.Update(transaction)
+}
+
+// Contacts returns all the contacts sorted by alias
+func (s *Store) Contacts() ([]*Contact, error) {
+	contacts := []*Contact{}
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ContactsBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			c, err := contactFromBytes(v)
+			if err != nil {
+				return err
+			}
+			contacts = append(contacts, c)
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// GetContact returns the contact with the given alias
+func (s *Store) GetContact(alias string) (*Contact, error) {
+	var c *Contact
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ContactsBucketName))
+		if b == nil {
+			return ErrContactNotFound
+		}
+		v := b.Get([]byte(strings.ToLower(alias)))
+		if v == nil {
+			return ErrContactNotFound
+		}
+		var err error
+		c, err = contactFromBytes(v)
+		return err
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// PinnedKey returns the pinned key of the contact with the given
+// e-mail address or nil if no key is pinned for that address
+func (s *Store) PinnedKey(address string) (*ecdh.PublicKey, error) {
+	contacts, err := s.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range contacts {
+		if c.PinnedKey != nil && strings.ToLower(c.Address) == strings.ToLower(address) {
+			return c.PinnedKey, nil
+		}
+	}
+	return nil, nil
+}
+
+// SetSuite records the envelope suite negotiated
+// with the correspondent with the given e-mail address
+func (s *Store) SetSuite(address, suite string) error {
+	transaction := func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(SuitesBucketName))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(strings.ToLower(address)), []byte(suite))
+	}
+	return s.db.Update(transaction)
+}
+
+// Suite returns the envelope suite last negotiated with the given
+// e-mail address or an empty string if none was recorded
+func (s *Store) Suite(address string) (string, error) {
+	suite := ""
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SuitesBucketName))
+		if b == nil {
+			return nil
+		}
+		suite = string(b.Get([]byte(strings.ToLower(address))))
+		return nil
+	}
+	err := s.db.View(transaction)
+	return suite, err
+}
@@ -0,0 +1,83 @@
+// contacts_test.go - persistent contact book tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContacts(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "contacts_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	contacts, err := store.Contacts()
+	require.NoError(err, "unexpected Contacts() error")
+	require.Equal(0, len(contacts))
+
+	bobKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "unexpected NewKeypair() error")
+	err = store.PutContact(&Contact{Alias: "Bob", Address: "bob@nsa.gov", PinnedKey: bobKey.PublicKey()})
+	require.NoError(err, "unexpected PutContact() error")
+	err = store.PutContact(&Contact{Alias: "alice", Address: "alice@acme.com", Blocked: true})
+	require.NoError(err, "unexpected PutContact() error")
+	err = store.PutContact(&Contact{Alias: "carol@fsb.ru", Address: "carol@fsb.ru"})
+	require.Error(err, "PutContact() should've failed")
+
+	contacts, err = store.Contacts()
+	require.NoError(err, "unexpected Contacts() error")
+	require.Equal(2, len(contacts))
+	require.Equal("alice", contacts[0].Alias)
+	require.Equal("Bob", contacts[1].Alias)
+
+	contact, err := store.GetContact("bob")
+	require.NoError(err, "unexpected GetContact() error")
+	require.Equal("bob@nsa.gov", contact.Address)
+	require.True(bobKey.PublicKey().Equal(contact.PinnedKey))
+	require.False(contact.Blocked)
+	contact, err = store.GetContact("alice")
+	require.NoError(err, "unexpected GetContact() error")
+	require.True(contact.Blocked, "Blocked not persisted")
+
+	key, err := store.PinnedKey("Bob@nsa.gov")
+	require.NoError(err, "unexpected PinnedKey() error")
+	require.True(bobKey.PublicKey().Equal(key))
+	key, err = store.PinnedKey("alice@acme.com")
+	require.NoError(err, "unexpected PinnedKey() error")
+	require.Nil(key)
+
+	err = store.RemoveContact("bob")
+	require.NoError(err, "unexpected RemoveContact() error")
+	_, err = store.GetContact("bob")
+	require.Equal(ErrContactNotFound, err)
+	err = store.RemoveContact("bob")
+	require.Equal(ErrContactNotFound, err)
+}
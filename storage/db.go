@@ -17,47 +17,89 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/coreos/bbolt"
-	"github.com/katzenpost/client/constants"
 	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
 	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/op/go-logging"
 )
 
+var log = logging.MustGetLogger("mixclient")
+
 const (
 	// BlockIDLength is the length of our storage block IDs
 	// which are used to uniquely identify storage blocks
 	// in the boltdb ingress buckets
-	BlockIDLength = 8
+	BlockIDLength = constants.BlockIDLength
 
 	// EgressBucketName is the name of the boltdb bucket
 	// used for storing messages received from our SMTP listener.
 	// We intentionally have a single boltdb bucket that handles
 	// all the outgoing messages for the client.
 	EgressBucketName = "outgoing"
+
+	// ReplayCacheSize is the maximum number of entries remembered
+	// by each account's replay cache, see PutIngressBlock and SeenSURBID.
+	ReplayCacheSize = 1 << 16
 )
 
-// ingressBucketNameFromAccount is a helper function that
-// returns the bucket name of the bucket that persists
-// encrypted message blocks given the name of an account.
+// ErrReplay is the error returned when a block or SURB ID
+// has been seen before
+var ErrReplay = errors.New("replayed block or SURB ID")
+
+// ErrBucketMissing is the error returned when
+// the boltdb bucket of a record doesn't exist
+var ErrBucketMissing = errors.New("boltdb bucket doesn't exist")
+
+// ErrKeyNotFound is the error returned when a record doesn't exist,
+// which is distinct from a record with an empty value
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrDiscardMessage is returned by the assembleFn of ReassembleMessage
+// and the joinFn of JoinSplitMessage to remove the Blocks or parts of
+// a message without delivering it, e.g. because it was filtered out
+var ErrDiscardMessage = errors.New("message discarded")
+
+// ingressBucketName is the name of the bucket of an account
+// that persists encrypted message blocks.
 // (in this case the account is an e-mail address)
-func ingressBucketNameFromAccount(accountName string) []byte {
-	return []byte(fmt.Sprintf("%s_incoming", accountName))
-}
+var ingressBucketName = []byte("ingress")
 
-// pop3BucketNameFromAccount is a helper function that
-// returns the bucket name of the bucket that persists
+// pop3BucketName is the name of the bucket that persists
 // plaintext message constructed from one or more
-// encrypted blocks from the account's "_incoming" bucket.
-func pop3BucketNameFromAccount(accountName string) []byte {
-	return []byte(fmt.Sprintf("%s_pop3", accountName))
-}
+// encrypted blocks from the account's ingress bucket.
+var pop3BucketName = []byte("pop3")
+
+// replayBucketName is the name of the bucket
+// which persists the account's recently seen block and SURB IDs
+var replayBucketName = []byte("replay")
+
+// replayOrderBucketName is the name of the bucket
+// which persists the insertion order of the account's replay cache
+// so that the oldest entries can be evicted first
+var replayOrderBucketName = []byte("replay_order")
+
+// Priority is the priority class of an outgoing message
+type Priority uint8
+
+const (
+	// PriorityBulk is the priority class of bulk transfers
+	PriorityBulk Priority = iota
+
+	// PriorityInteractive is the priority class of small user typed
+	// messages which are sent ahead of the bulk transfers
+	PriorityInteractive
+)
 
 // EgressBlock contains an encrypted message fragment
 // and other fields needed to send it to the destination
@@ -95,6 +137,13 @@ type EgressBlock struct {
 	// for a message composed using a SURB.
 	SURBID [sphinxconstants.SURBIDLength]byte
 
+	// SURBEpoch is the mixnet epoch during which the SURB was created,
+	// it's used to retire the SURBKeys once the SURB has expired.
+	SURBEpoch uint64
+
+	// Priority is the priority class of the Block's message
+	Priority Priority
+
 	// Block is a message fragment
 	Block block.Block
 }
@@ -110,44 +159,79 @@ type jsonEgressBlock struct {
 	SendAttempts      int
 	SURBKeys          string
 	SURBID            string
+	SURBEpoch         uint64
+	Priority          int
 	JsonBlock         *block.JsonBlock
 }
 
-// EgressBlock method returns a *EgressBlock or error
-// given the jsonEgressBlock receiver struct
+// surbKeyMaterialLength is the length of the SPRP key and IV
+// of each hop in the SURB keys, see sphinx.DecryptSURBPayload
+const surbKeyMaterialLength = 48 + 16
+
+// decodeID decodes the given base64 field of a
+// jsonEgressBlock into the fixed length dst
+func decodeID(field string, dst []byte, encoded string) error {
+	src, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", field, err)
+	}
+	err = constants.CopyID(dst, src)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", field, err)
+	}
+	return nil
+}
+
+// EgressBlock method returns a *EgressBlock or error given the
+// jsonEgressBlock receiver struct, every field is validated so
+// that a corrupted record fails instead of being sent garbled
 func (j *jsonEgressBlock) ToEgressBlock() (*EgressBlock, error) {
-	recipientID, err := base64.StdEncoding.DecodeString(j.RecipientID)
+	s := EgressBlock{
+		Sender:            j.Sender,
+		SenderProvider:    j.SenderProvider,
+		Recipient:         j.Recipient,
+		RecipientProvider: j.RecipientProvider,
+		SURBEpoch:         j.SURBEpoch,
+	}
+	err := decodeID("BlockID", s.BlockID[:], j.BlockID)
 	if err != nil {
 		return nil, err
 	}
-	blockID, err := base64.StdEncoding.DecodeString(j.BlockID)
+	err = decodeID("RecipientID", s.RecipientID[:], j.RecipientID)
 	if err != nil {
 		return nil, err
 	}
-	surbID, err := base64.StdEncoding.DecodeString(j.SURBID)
+	err = decodeID("SURBID", s.SURBID[:], j.SURBID)
 	if err != nil {
 		return nil, err
 	}
 	surbKeys, err := base64.StdEncoding.DecodeString(j.SURBKeys)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid SURBKeys: %s", err)
 	}
-	b, err := j.JsonBlock.ToBlock()
+	if len(surbKeys)%surbKeyMaterialLength != 0 {
+		return nil, fmt.Errorf("invalid SURBKeys length %d, expected a multiple of %d", len(surbKeys), surbKeyMaterialLength)
+	}
+	// retired or unused SURB keys are nil
+	if len(surbKeys) != 0 {
+		s.SURBKeys = surbKeys
+	}
+	s.SendAttempts, err = constants.Uint8(j.SendAttempts)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid SendAttempts: %s", err)
 	}
-	s := EgressBlock{
-		Sender:            j.Sender,
-		SenderProvider:    j.SenderProvider,
-		Recipient:         j.Recipient,
-		RecipientProvider: j.RecipientProvider,
-		SendAttempts:      uint8(j.SendAttempts),
-		Block:             *b,
+	if j.Priority != int(PriorityBulk) && j.Priority != int(PriorityInteractive) {
+		return nil, fmt.Errorf("invalid Priority %d", j.Priority)
+	}
+	s.Priority = Priority(j.Priority)
+	if j.JsonBlock == nil {
+		return nil, errors.New("egress block without Block")
 	}
-	copy(s.BlockID[:], blockID)
-	copy(s.RecipientID[:], recipientID)
-	copy(s.SURBKeys[:], surbKeys)
-	copy(s.SURBID[:], surbID)
+	b, err := j.JsonBlock.ToBlock()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Block: %s", err)
+	}
+	s.Block = *b
 	return &s, nil
 }
 
@@ -164,6 +248,8 @@ func (s *EgressBlock) ToJsonEgressBlock() *jsonEgressBlock {
 		SendAttempts:      int(s.SendAttempts),
 		SURBKeys:          base64.StdEncoding.EncodeToString(s.SURBKeys[:]),
 		SURBID:            base64.StdEncoding.EncodeToString(s.SURBID[:]),
+		SURBEpoch:         s.SURBEpoch,
+		Priority:          int(s.Priority),
 		JsonBlock:         s.Block.ToJsonBlock(),
 	}
 	return &j
@@ -191,7 +277,8 @@ func EgressBlockFromBytes(raw []byte) (*EgressBlock, error) {
 // IngressBlock is used to store incoming message blocks retrieved
 // from the client's Provider
 type IngressBlock struct {
-	// S is the `s` value from the noise_x encryption operation
+	// S is the sender's static key authenticated by
+	// the noise_x decryption operation
 	S [32]byte
 	// Block is a serialized block.Block
 	Block *block.Block
@@ -199,50 +286,148 @@ type IngressBlock struct {
 
 // ToBytes serializes an IngressBlock into a byte slice
 func (i *IngressBlock) ToBytes() ([]byte, error) {
-	b, err := i.Block.ToBytes()
-	if err != nil {
-		return nil, err
-	}
-	b = append(i.S[:], b...)
-	return b, nil
+	return i.AppendBinary(nil)
+}
+
+// AppendBinary appends the serialized IngressBlock to the
+// given buffer and returns the extended buffer
+func (i *IngressBlock) AppendBinary(out []byte) ([]byte, error) {
+	out = append(out, i.S[:]...)
+	return i.Block.AppendBinary(out)
 }
 
 // IngressBlockFromBytes deserializes a slice of bytes to an IngressBlock
 func IngressBlockFromBytes(b []byte) (*IngressBlock, error) {
-	aBlock, err := block.FromBytes(b[32:])
+	ingressBlock := IngressBlock{}
+	err := ingressBlock.UnmarshalBinary(b)
 	if err != nil {
 		return nil, err
 	}
-	s := [32]byte{}
-	copy(s[:], b[0:31])
-	ingressBlock := IngressBlock{
-		S:     s,
-		Block: aBlock,
-	}
 	return &ingressBlock, nil
 }
 
+// UnmarshalBinary deserializes the given bytes into the IngressBlock,
+// it's Block and the payload are reused and the bytes aren't retained
+func (i *IngressBlock) UnmarshalBinary(b []byte) error {
+	if len(b) < 32 {
+		return errors.New("truncated ingress block")
+	}
+	if i.Block == nil {
+		i.Block = new(block.Block)
+	}
+	err := i.Block.UnmarshalBinary(b[32:])
+	if err != nil {
+		return err
+	}
+	copy(i.S[:], b[0:32])
+	return nil
+}
+
+// hasMessageID returns false if the given serialized IngressBlock
+// doesn't contain the given message ID, without decoding it
+func hasMessageID(b []byte, messageID [constants.MessageIDLength]byte) bool {
+	if len(b) < 32+constants.MessageIDLength {
+		// left to UnmarshalBinary to report
+		return true
+	}
+	return bytes.Equal(b[32:32+constants.MessageIDLength], messageID[:])
+}
+
 // Store is our persistent storage for incoming
 // messages which have been reassembled.
 type Store struct {
-	db *bolt.DB
+	db              *bolt.DB
+	replayCacheSize uint64
+	eventLogSize    uint64
+	journalSize     uint64
+
+	// ordering enables in order delivery of conversations,
+	// see SetOrdering
+	ordering     bool
+	holdDuration time.Duration
+	now          func() time.Time
+
+	// maildirRoot enables Maildir delivery, see SetMaildir
+	maildirRoot string
+	keepPOP3    bool
+
+	// sorter files the received messages into
+	// the folders, see SetSorter
+	sorter Sorter
+
+	// mailboxObserver is notified of committed
+	// mailbox changes, see SetMailboxObserver
+	mailboxObserver func(accountName string)
+
+	// eventObserver is notified of the recorded
+	// events, see SetEventObserver
+	eventObserver func(e *Event)
+
+	// subscriptions are the channels of the subscribers
+	// to the committed changes by account, see Subscribe
+	subscriptionsLock sync.Mutex
+	subscriptions     map[chan *Notification]string
+
+	// snapshot is true if the database is a snapshot of the
+	// database held open by a writer, see OpenReadOnly
+	snapshot bool
 }
 
 // NewStore returns a new *Store or an error
 func New(dbFile string) (*Store, error) {
 	var err error
-	s := Store{}
+	s := Store{
+		replayCacheSize: ReplayCacheSize,
+		eventLogSize:    EventLogSize,
+		journalSize:     JournalSize,
+		now:             time.Now,
+	}
+	err = compactIfMarked(dbFile)
+	if err != nil {
+		return nil, err
+	}
 	s.db, err = bolt.Open(dbFile, 0600, &bolt.Options{Timeout: constants.DatabaseConnectTimeout})
 	if err != nil {
 		return nil, err
 	}
+	err = s.db.Update(migrateAccounts)
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	registerStore(&s)
 	return &s, nil
 }
 
+// Path returns the path of the database file
+func (s *Store) Path() string {
+	return s.db.Path()
+}
+
+// TemporaryFiles returns the patterns of the temporary copies of the
+// given database file: the snapshots taken by OpenReadOnly and the
+// files left behind by an interrupted Compact
+func TemporaryFiles(dbFile string) []string {
+	return []string{dbFile + ".snapshot*", dbFile + ".compact", dbFile + ".old"}
+}
+
 // Close closes our Store database
 func (s *Store) Close() error {
-	err := s.db.Close()
-	return err
+	unregisterStore(s)
+	return s.db.Close()
+}
+
+// CheckWritable returns an error if the database can't be written
+// because it's closed or opened read only. It doesn't write, so that
+// frequent health checks have no side effects, a full disk is
+// detected by package disk_space instead.
+func (s *Store) CheckWritable() error {
+	if s.db.IsReadOnly() {
+		return bolt.ErrDatabaseReadOnly
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
 }
 
 // egress storage
@@ -250,8 +435,24 @@ func (s *Store) Close() error {
 // Put puts a given EgressBlock into our db
 // and returns a block ID which is it's key
 func (s *Store) PutEgressBlock(b *EgressBlock) (*[BlockIDLength]byte, error) {
+	return s.PutSubmittedEgressBlock(b, nil)
+}
+
+// PutSubmittedEgressBlock puts the given EgressBlock into our db as
+// PutEgressBlock does and records the given submission of it's
+// sender, if any, in the same transaction. So the last Block of a
+// submitted message is never persisted without the record, which
+// would send the message again if it's resubmitted, nor the other
+// way around, which would lose the message.
+func (s *Store) PutSubmittedEgressBlock(b *EgressBlock, submission *Submission) (*[BlockIDLength]byte, error) {
 	blockID := [BlockIDLength]byte{}
 	transaction := func(tx *bolt.Tx) error {
+		if submission != nil {
+			err := s.putSubmission(tx, b.Sender, submission)
+			if err != nil {
+				return err
+			}
+		}
 		bucket, err := tx.CreateBucketIfNotExists([]byte(EgressBucketName))
 		if err != nil {
 			return err
@@ -282,7 +483,7 @@ func (s *Store) Update(blockID *[BlockIDLength]byte, b *EgressBlock) error {
 	transaction := func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(EgressBucketName))
 		if bucket == nil {
-			return errors.New("Update failed to get the bucket")
+			return ErrBucketMissing
 		}
 		value, err := b.ToBytes()
 		if err != nil {
@@ -301,7 +502,7 @@ func (s *Store) GetKeys() ([][BlockIDLength]byte, error) {
 	transaction := func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(EgressBucketName))
 		if b == nil {
-			return errors.New("GetKeys failed to get the bucket")
+			return ErrBucketMissing
 		}
 		c := b.Cursor()
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
@@ -318,32 +519,59 @@ func (s *Store) GetKeys() ([][BlockIDLength]byte, error) {
 	return keys, nil
 }
 
-// Get returns a serialized storage block given a block ID
+// Get returns a serialized storage block given a block ID,
+// ErrKeyNotFound is returned if there is no such block
 func (s *Store) Get(blockID *[BlockIDLength]byte) ([]byte, error) {
-	var err error
-	ret := []byte{}
+	var ret []byte
 	transaction := func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(EgressBucketName))
+		if b == nil {
+			return ErrBucketMissing
+		}
 		v := b.Get(blockID[:])
+		if v == nil {
+			return ErrKeyNotFound
+		}
 		ret = make([]byte, len(v))
 		copy(ret, v)
-		return err
+		return nil
 	}
-	err = s.db.View(transaction)
+	err := s.db.View(transaction)
 	if err != nil {
 		return nil, err
 	}
 	return ret, nil
 }
 
+// Has returns true if the storage block with the given block ID exists
+func (s *Store) Has(blockID *[BlockIDLength]byte) (bool, error) {
+	found := false
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(EgressBucketName))
+		if b == nil {
+			return nil
+		}
+		found = b.Get(blockID[:]) != nil
+		return nil
+	}
+	err := s.db.View(transaction)
+	return found, err
+}
+
 // Remove removes a specific *EgressBlock from our db
 // specified by the SURB ID
 func (s *Store) Remove(blockID *[BlockIDLength]byte) error {
 	var err error
 	transaction := func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(EgressBucketName))
+		if b == nil {
+			return ErrBucketMissing
+		}
 		err := b.Delete(blockID[:])
-		return err
+		if err != nil {
+			return err
+		}
+		return clearSendIntent(tx, blockID[:])
 	}
 
 	err = s.db.Update(transaction)
@@ -353,97 +581,497 @@ func (s *Store) Remove(blockID *[BlockIDLength]byte) error {
 	return nil
 }
 
+// RemoveEgressBlock removes the given *EgressBlock from our db and
+// returns the number of Blocks of the same message which remain
+func (s *Store) RemoveEgressBlock(b *EgressBlock) (int, error) {
+	remaining := 0
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return ErrBucketMissing
+		}
+		err := bucket.Delete(b.BlockID[:])
+		if err != nil {
+			return err
+		}
+		err = clearSendIntent(tx, b.BlockID[:])
+		if err != nil {
+			return err
+		}
+		tx.OnCommit(func() {
+			s.publish(&Notification{
+				Type:      EgressBlockAcked,
+				Account:   b.Sender,
+				MessageID: b.Block.MessageID,
+			})
+		})
+		return bucket.ForEach(func(k, v []byte) error {
+			other, err := EgressBlockFromBytes(v)
+			if err != nil {
+				return err
+			}
+			if other.Block.MessageID == b.Block.MessageID {
+				remaining += 1
+			}
+			return nil
+		})
+	}
+	err := s.db.Update(transaction)
+	return remaining, err
+}
+
+// RetireSURBKeys erases the SURBKeys of the *EgressBlock whose SURB
+// has expired by the given epoch, see constants.SURBKeyRetentionEpochs.
+// It returns the number of retired SURBKeys.
+func (s *Store) RetireSURBKeys(epoch uint64) (int, error) {
+	retired := 0
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return nil
+		}
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			b, err := EgressBlockFromBytes(v)
+			if err != nil {
+				log.Warningf("skipping undecodable egress block %x: %s", k, err)
+				return nil
+			}
+			if b.SURBKeys == nil || b.SURBEpoch+constants.SURBKeyRetentionEpochs > epoch {
+				return nil
+			}
+			for i := range b.SURBKeys {
+				b.SURBKeys[i] = 0
+			}
+			b.SURBKeys = nil
+			value, err := b.ToBytes()
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = value
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updates {
+			err = bucket.Put([]byte(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		retired = len(updates)
+		return nil
+	}
+	err := s.db.Update(transaction)
+	return retired, err
+}
+
+// RemoveMessageEgressBlocks removes all the *EgressBlock
+// of the given message from our db
+func (s *Store) RemoveMessageEgressBlocks(messageID [constants.MessageIDLength]byte) error {
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return ErrBucketMissing
+		}
+		keys := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			b, err := EgressBlockFromBytes(v)
+			if err != nil {
+				return err
+			}
+			if b.Block.MessageID == messageID {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+			err = clearSendIntent(tx, k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
+
+// EgressBlocks returns all the queued *EgressBlock
+func (s *Store) EgressBlocks() ([]*EgressBlock, error) {
+	blocks := []*EgressBlock{}
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			b, err := EgressBlockFromBytes(v)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, b)
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// PurgeEgress removes all the queued *EgressBlock from our
+// db and returns the number of removed Blocks
+func (s *Store) PurgeEgress() (int, error) {
+	purged := 0
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return nil
+		}
+		// the keys are deleted one by one so that the
+		// bucket sequence and thus the Block IDs aren't reused
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			err := clearSendIntent(tx, k)
+			if err != nil {
+				return err
+			}
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+			purged += 1
+		}
+		return nil
+	}
+	err := s.db.Update(transaction)
+	return purged, err
+}
+
 // ingress storage
 
+// accountBucketNames are the names of all the nested
+// buckets which store the data of an account
+var accountBucketNames = [][]byte{
+	// bucket for blocks, message fragment ciphertext
+	ingressBucketName,
+	// bucket for pop3, assembled messages
+	pop3BucketName,
+	// bucket for the metadata of the assembled messages
+	metadataBucketName,
+	// buckets for the folders other than the INBOX
+	folderBucketName(FolderSent),
+	folderBucketName(FolderDrafts),
+	folderBucketName(FolderTrash),
+	folderBucketName(FolderJunk),
+	// buckets for the replay cache
+	replayBucketName,
+	replayOrderBucketName,
+	// buckets for in order delivery of conversations
+	sequenceBucketName,
+	heldBucketName,
+	// buckets for the account deactivation and vacation modes
+	settingsBucketName,
+	vacationBucketName,
+	// bucket for the mailbox change journal
+	journalBucketName,
+	// bucket for the monthly bandwidth usage
+	bandwidthBucketName,
+	// buckets for the pre-generated and received SURBs
+	surbPoolBucketName,
+	receivedSURBsBucketName,
+	// bucket for the recent idempotent submissions
+	submissionsBucketName,
+	// bucket for the received parts of split messages
+	splitPartsBucketName,
+}
+
 // CreateAccountBuckets is used to create a set of storage account buckets
 // that will store received messages
 func (s *Store) CreateAccountBuckets(accounts []string) error {
 	for _, accountName := range accounts {
-		// bucket for blocks, message fragment ciphertext
 		transaction := func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists(ingressBucketNameFromAccount(accountName))
-			return err
+			return createAccountBuckets(tx, accountName)
 		}
 		err := s.db.Update(transaction)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// bucket for pop3, assembled messages
-		transaction = func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists(pop3BucketNameFromAccount(accountName))
-			return err
+// recordReplayEntry records the given entry in the account's replay
+// cache and returns true if the entry was already present. The cache
+// is bounded, once full the oldest entries are evicted first.
+func (s *Store) recordReplayEntry(tx *bolt.Tx, accountName string, entry []byte) (bool, error) {
+	entries := accountBucket(tx, accountName, replayBucketName)
+	order := accountBucket(tx, accountName, replayOrderBucketName)
+	if entries == nil || order == nil {
+		return false, fmt.Errorf("replay cache failure: bucket not found: %s", accountName)
+	}
+	if entries.Get(entry) != nil {
+		return true, nil
+	}
+	seq, err := order.NextSequence()
+	if err != nil {
+		return false, err
+	}
+	seqKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqKey, seq)
+	err = entries.Put(entry, seqKey)
+	if err != nil {
+		return false, err
+	}
+	err = order.Put(seqKey, entry)
+	if err != nil {
+		return false, err
+	}
+	// sequence numbers are only ever removed from the front of the
+	// order bucket, so the cache size is the distance to the oldest entry
+	c := order.Cursor()
+	for k, v := c.First(); k != nil && seq-binary.BigEndian.Uint64(k) >= s.replayCacheSize; k, v = c.First() {
+		err = entries.Delete(v)
+		if err != nil {
+			return false, err
 		}
-		err = s.db.Update(transaction)
+		err = c.Delete()
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
-	return nil
+	return false, nil
 }
 
-// Put puts an IngressBlock, into the corresponding bucket for that account
+// ingressBlockReplayEntry returns the replay cache entry
+// of the given block, composed of the message ID and block ID
+func ingressBlockReplayEntry(b *block.Block) []byte {
+	entry := make([]byte, 1+constants.MessageIDLength+2)
+	entry[0] = 'b'
+	copy(entry[1:], b.MessageID[:])
+	binary.BigEndian.PutUint16(entry[1+constants.MessageIDLength:], b.BlockID)
+	return entry
+}
+
+// SeenSURBID records the given SURB ID in the account's replay cache
+// and returns true if it was seen before
+func (s *Store) SeenSURBID(accountName string, surbID [sphinxconstants.SURBIDLength]byte) (bool, error) {
+	replayed := false
+	transaction := func(tx *bolt.Tx) error {
+		var err error
+		replayed, err = s.recordReplayEntry(tx, accountName, append([]byte{'s'}, surbID[:]...))
+		return err
+	}
+	err := s.db.Update(transaction)
+	return replayed, err
+}
+
+// Put puts an IngressBlock, into the corresponding bucket for that account.
+// ErrReplay is returned if a block with the same message ID and block ID
+// was seen before, in which case the block is dropped.
 func (s *Store) PutIngressBlock(accountName string, b *IngressBlock) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
 	transaction := func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(ingressBucketNameFromAccount(accountName))
+		bucket := accountBucket(tx, accountName, ingressBucketName)
 		if bucket == nil {
 			return fmt.Errorf("ingress store put failure: bucket not found: %s", accountName)
 		}
+		replayed, err := s.recordReplayEntry(tx, accountName, ingressBlockReplayEntry(b.Block))
+		if err != nil {
+			return err
+		}
+		if replayed {
+			return ErrReplay
+		}
 		seq, err := bucket.NextSequence()
 		if err != nil {
 			return err
 		}
-		ingressBlockBytes, err := b.ToBytes()
+		// bolt holds on to the value until the
+		// commit, the buffer is released after it
+		*buf, err = b.AppendBinary((*buf)[:0])
 		if err != nil {
 			return err
 		}
-		err = bucket.Put([]byte(strconv.Itoa(int(seq))), ingressBlockBytes)
+		err = bucket.Put([]byte(strconv.FormatUint(seq, 10)), *buf)
 		return err
 	}
 	err := s.db.Update(transaction)
 	return err
 }
 
+// ingressBlocks returns the IngressBlocks and their keys from the
+// given ingress bucket which contain the given message ID. Blocks
+// of other messages are skipped without being decoded, the matching
+// ones are decoded into the IngressBlocks of the given slice, up to
+// it's capacity.
+func ingressBlocks(b *bolt.Bucket, messageID [constants.MessageIDLength]byte, blocks []*IngressBlock) ([]*IngressBlock, [][]byte, error) {
+	blocks = blocks[:0]
+	keys := [][]byte{}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if !hasMessageID(v, messageID) {
+			continue
+		}
+		var ingressBlock *IngressBlock
+		if len(blocks) < cap(blocks) {
+			ingressBlock = blocks[:len(blocks)+1][len(blocks)]
+		}
+		if ingressBlock == nil {
+			ingressBlock = new(IngressBlock)
+		}
+		err := ingressBlock.UnmarshalBinary(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, ingressBlock)
+		newKey := make([]byte, len(k))
+		copy(newKey, k)
+		keys = append(keys, newKey)
+	}
+	return blocks, keys, nil
+}
+
 // GetIngressBlocks returns a slice of IngressBlocks which contain
 // the given message ID for the given account name
 // The block "keys" are also returned so that message a message is reassembled
 // the blocks can be removed from the db.
 func (s *Store) GetIngressBlocks(accountName string, messageID [constants.MessageIDLength]byte) ([]*IngressBlock, [][]byte, error) {
-	blocks := []*IngressBlock{}
-	keys := [][]byte{}
+	return s.GetIngressBlocksInto(accountName, messageID, nil)
+}
+
+// GetIngressBlocksInto is GetIngressBlocks decoding into the
+// IngressBlocks of the given slice, up to it's capacity, which
+// are reused along with the payloads of their Blocks
+func (s *Store) GetIngressBlocksInto(accountName string, messageID [constants.MessageIDLength]byte, blocks []*IngressBlock) ([]*IngressBlock, [][]byte, error) {
+	var keys [][]byte
 	transaction := func(tx *bolt.Tx) error {
-		b := tx.Bucket(ingressBucketNameFromAccount(accountName))
+		b := accountBucket(tx, accountName, ingressBucketName)
 		if b == nil {
 			return errors.New("boltdb bucket for that account doesn't exist")
 		}
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			newVal := make([]byte, len(v))
-			copy(newVal, v)
-			ingressBlock, err := IngressBlockFromBytes(newVal)
+		var err error
+		blocks, keys, err = ingressBlocks(b, messageID, blocks)
+		return err
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blocks, keys, nil
+}
+
+// ReassembleMessage reads the ingress blocks with the given message ID
+// and passes them to assembleFn. If assembleFn returns a message, the
+// message is put into the pop3 bucket and the blocks are removed.
+// If assembleFn returns a nil message, for instance because some blocks
+// have not yet arrived, nothing is modified. If it returns
+// ErrDiscardMessage, the blocks are removed without delivering
+// the message. All of this is performed
+// within a single bolt transaction so that a crash can neither
+// duplicate nor lose a message. The IngressBlocks are reused once
+// assembleFn returns, it must not retain them.
+func (s *Store) ReassembleMessage(accountName string, messageID [constants.MessageIDLength]byte, assembleFn func([]*IngressBlock) ([]byte, error)) error {
+	pooled := getIngressBlocks()
+	defer putIngressBlocks(pooled)
+	transaction := func(tx *bolt.Tx) error {
+		ingressBucket := accountBucket(tx, accountName, ingressBucketName)
+		if ingressBucket == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		blocks, keys, err := ingressBlocks(ingressBucket, messageID, *pooled)
+		if err != nil {
+			return err
+		}
+		*pooled = blocks
+		message, err := assembleFn(blocks)
+		switch {
+		case err == ErrDiscardMessage:
+		case err != nil:
+			return err
+		case message == nil:
+			return nil
+		default:
+			err = s.deliverMessage(tx, accountName, message)
 			if err != nil {
 				return err
 			}
-			if ingressBlock.Block.MessageID == messageID {
-				blocks = append(blocks, ingressBlock)
-				newKey := make([]byte, len(k))
-				copy(newKey, k)
-				keys = append(keys, newKey)
+		}
+		for _, key := range keys {
+			err = ingressBucket.Delete(key)
+			if err != nil {
+				return err
 			}
 		}
 		return nil
 	}
-	err := s.db.View(transaction)
+	return s.db.Update(transaction)
+}
+
+// CommitReassembly removes the ingress blocks with the given keys, as
+// returned by GetIngressBlocks, and delivers the message reassembled
+// from them within a single bolt transaction, so that the message can
+// be reassembled and filtered outside of a transaction. The message is
+// filed into the given folder unless it's empty, and it's dropped if
+// it's nil. Nothing is modified and ErrKeyNotFound is returned if one
+// of the blocks was removed in the meantime.
+func (s *Store) CommitReassembly(accountName string, keys [][]byte, message []byte, folder string) error {
+	transaction := func(tx *bolt.Tx) error {
+		ingressBucket := accountBucket(tx, accountName, ingressBucketName)
+		if ingressBucket == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		return s.commitMessage(tx, accountName, ingressBucket, keys, message, folder)
+	}
+	return s.db.Update(transaction)
+}
+
+// commitMessage removes the records with the given keys from the given
+// bucket and delivers the message built from them, see CommitReassembly
+func (s *Store) commitMessage(tx *bolt.Tx, accountName string, b *bolt.Bucket, keys [][]byte, message []byte, folder string) error {
+	for _, key := range keys {
+		if b.Get(key) == nil {
+			return ErrKeyNotFound
+		}
+	}
+	var err error
+	switch {
+	case message == nil:
+	case folder != "":
+		folder, err = folderName(folder)
+		if err != nil {
+			return err
+		}
+		_, err = s.putFolderMessage(tx, accountName, folder, message)
+	default:
+		err = s.deliverMessage(tx, accountName, message)
+	}
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	return blocks, keys, nil
+	for _, key := range keys {
+		err = b.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // RemoveBlocks removes the blocks using the specified keys
 func (s *Store) RemoveBlocks(accountName string, keys [][]byte) error {
 	transaction := func(tx *bolt.Tx) error {
-		b := tx.Bucket(ingressBucketNameFromAccount(accountName))
+		b := accountBucket(tx, accountName, ingressBucketName)
 		if b == nil {
 			return errors.New("boltdb bucket for that account doesn't exist")
 		}
@@ -464,7 +1092,7 @@ func (s *Store) RemoveBlocks(accountName string, keys [][]byte) error {
 func (s *Store) Messages(accountName string) ([][]byte, error) {
 	messages := [][]byte{}
 	transaction := func(tx *bolt.Tx) error {
-		b := tx.Bucket(pop3BucketNameFromAccount(accountName))
+		b := accountBucket(tx, accountName, pop3BucketName)
 		if b == nil {
 			return errors.New("boltdb bucket for that account doesn't exist")
 		}
@@ -483,44 +1111,46 @@ func (s *Store) Messages(accountName string) ([][]byte, error) {
 	return messages, nil
 }
 
-// PutMessage puts a fully assembled plaintext message into
-// the db where it can be retrieved using our pop3 service
-func (s *Store) PutMessage(accountName string, message []byte) error {
-	var err error
-	transaction := func(tx *bolt.Tx) error {
-		b := tx.Bucket(pop3BucketNameFromAccount(accountName))
-		seq, err := b.NextSequence()
-		if err != nil {
-			return err
-		}
-		err = b.Put([]byte(strconv.Itoa(int(seq))), message)
-		if err != nil {
-			return err
-		}
-		return nil
+// putMessage puts a message into the account's pop3 bucket
+// and records the change in the account's mailbox journal
+func (s *Store) putMessage(tx *bolt.Tx, accountName string, message []byte) error {
+	b := accountBucket(tx, accountName, pop3BucketName)
+	if b == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
 	}
-	err = s.db.Update(transaction)
+	seq, err := b.NextSequence()
 	if err != nil {
 		return err
 	}
-	return nil
+	key := []byte(strconv.FormatUint(seq, 10))
+	err = b.Put(key, message)
+	if err != nil {
+		return err
+	}
+	err = s.putMetadata(tx, accountName, key, message)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(tx, accountName, MailboxAdd, key)
+}
 
+// PutMessage puts a fully assembled plaintext message into
+// the db where it can be retrieved using our pop3 service
+func (s *Store) PutMessage(accountName string, message []byte) error {
+	transaction := func(tx *bolt.Tx) error {
+		return s.deliverMessage(tx, accountName, message)
+	}
+	return s.db.Update(transaction)
 }
 
 // deleteMessage deletes a single message from
 // our backing database storage
 func (s *Store) deleteMessage(accountName string, item int) error {
-	var err error
 	transaction := func(tx *bolt.Tx) error {
-		b := tx.Bucket(pop3BucketNameFromAccount(accountName))
-		err := b.Delete([]byte(strconv.Itoa(item)))
+		_, err := s.removeFolderMessage(tx, accountName, FolderInbox, uint64(item))
 		return err
 	}
-	err = s.db.Update(transaction)
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.db.Update(transaction)
 }
 
 // DeleteMessages deletes a list of messages
@@ -17,12 +17,16 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/katzenpost/client/crypto/block"
-	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/client/internal/constants"
+	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,7 +43,7 @@ func TestDBBasics(t *testing.T) {
 	require.NoError(err, "unexpected New() error")
 
 	rid := []byte{1, 2, 3, 4}
-	recipientID := [constants.RecipientIDLength]byte{}
+	recipientID := [sphinxconstants.RecipientIDLength]byte{}
 	copy(recipientID[:], rid)
 	b := block.Block{
 		TotalBlocks: uint16(1),
@@ -65,10 +69,18 @@ func TestDBBasics(t *testing.T) {
 		message, err := store.Get(&surb)
 		require.NoError(err, "unexpected Get error")
 		t.Log(string(message))
+		found, err := store.Has(&surb)
+		require.NoError(err, "unexpected Has() error")
+		require.True(found)
 	}
 
 	err = store.Remove(&surbs[0])
 	require.NoError(err, "unexpected Remove() error")
+	_, err = store.Get(&surbs[0])
+	require.Equal(ErrKeyNotFound, err)
+	found, err := store.Has(&surbs[0])
+	require.NoError(err, "unexpected Has() error")
+	require.False(found)
 
 	surbs, err = store.GetKeys()
 	require.NoError(err, "unexpected GetKeys() error")
@@ -78,3 +90,436 @@ func TestDBBasics(t *testing.T) {
 	err = store.Close()
 	require.NoError(err, "unexpected Close() error")
 }
+
+func TestReassembleMessage(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "db_test2")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	messageID := [constants.MessageIDLength]byte{1, 2, 3}
+	for i, payload := range []string{"The time has come, ", "the Walrus said"} {
+		ingressBlock := IngressBlock{
+			Block: &block.Block{
+				MessageID:   messageID,
+				TotalBlocks: 2,
+				BlockID:     uint16(i),
+				Block:       []byte(payload),
+			},
+		}
+		err = store.PutIngressBlock(account, &ingressBlock)
+		require.NoError(err, "unexpected PutIngressBlock() error")
+	}
+
+	// an incomplete message leaves the store untouched
+	err = store.ReassembleMessage(account, messageID, func(blocks []*IngressBlock) ([]byte, error) {
+		require.Equal(2, len(blocks), "wrong number of blocks")
+		return nil, nil
+	})
+	require.NoError(err, "unexpected ReassembleMessage() error")
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(0, len(messages), "expected zero messages")
+
+	// a failed assembly leaves the store untouched
+	err = store.ReassembleMessage(account, messageID, func(blocks []*IngressBlock) ([]byte, error) {
+		return nil, errors.New("assembly failure")
+	})
+	require.Error(err, "expected ReassembleMessage() error")
+	blocks, _, err := store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Equal(2, len(blocks), "wrong number of blocks")
+
+	err = store.ReassembleMessage(account, messageID, func(blocks []*IngressBlock) ([]byte, error) {
+		message := []byte{}
+		for _, b := range blocks {
+			message = append(message, b.Block.Block...)
+		}
+		return message, nil
+	})
+	require.NoError(err, "unexpected ReassembleMessage() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(1, len(messages), "expected one message")
+	require.Equal("The time has come, the Walrus said", string(messages[0]))
+	blocks, _, err = store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Equal(0, len(blocks), "expected blocks to be removed")
+
+	// a discarded message removes the blocks without a delivery
+	discardedID := [constants.MessageIDLength]byte{4, 5, 6}
+	ingressBlock := IngressBlock{
+		Block: &block.Block{
+			MessageID:   discardedID,
+			TotalBlocks: 1,
+			Block:       []byte("spam"),
+		},
+	}
+	err = store.PutIngressBlock(account, &ingressBlock)
+	require.NoError(err, "unexpected PutIngressBlock() error")
+	err = store.ReassembleMessage(account, discardedID, func(blocks []*IngressBlock) ([]byte, error) {
+		return nil, ErrDiscardMessage
+	})
+	require.NoError(err, "unexpected ReassembleMessage() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(1, len(messages), "discarded message delivered")
+	blocks, _, err = store.GetIngressBlocks(account, discardedID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Equal(0, len(blocks), "expected blocks to be removed")
+}
+
+func TestGetIngressBlocksInto(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "db_test_into")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	messageID := [constants.MessageIDLength]byte{1, 2, 3}
+	otherID := [constants.MessageIDLength]byte{4, 5, 6}
+	for i, id := range [][constants.MessageIDLength]byte{messageID, otherID, messageID} {
+		ingressBlock := IngressBlock{
+			S: [32]byte{byte(i)},
+			Block: &block.Block{
+				MessageID:   id,
+				TotalBlocks: 3,
+				BlockID:     uint16(i),
+				Block:       []byte{byte(i), byte(i)},
+			},
+		}
+		err = store.PutIngressBlock(account, &ingressBlock)
+		require.NoError(err, "unexpected PutIngressBlock() error")
+	}
+
+	blocks, keys, err := store.GetIngressBlocksInto(account, messageID, nil)
+	require.NoError(err, "unexpected GetIngressBlocksInto() error")
+	require.Equal(2, len(blocks), "blocks of the other message returned")
+	require.Equal(2, len(keys))
+	require.Equal([32]byte{2}, blocks[1].S)
+	require.Equal([]byte{2, 2}, blocks[1].Block.Block)
+
+	// the IngressBlocks and their payloads are reused
+	first, payload := blocks[0], blocks[0].Block.Block
+	blocks, _, err = store.GetIngressBlocksInto(account, otherID, blocks)
+	require.NoError(err, "unexpected GetIngressBlocksInto() error")
+	require.Equal(1, len(blocks))
+	require.True(first == blocks[0], "IngressBlock not reused")
+	require.True(&payload[0] == &blocks[0].Block.Block[0], "payload not reused")
+	require.Equal(otherID, blocks[0].Block.MessageID)
+	require.Equal([]byte{1, 1}, blocks[0].Block.Block)
+}
+
+func TestReplayCache(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "db_test3")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	store.replayCacheSize = 4
+
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	newIngressBlock := func(id byte) *IngressBlock {
+		return &IngressBlock{
+			Block: &block.Block{
+				MessageID:   [constants.MessageIDLength]byte{id},
+				TotalBlocks: 2,
+				BlockID:     1,
+				Block:       []byte("Beware the Jabberwock, my son!"),
+			},
+		}
+	}
+	err = store.PutIngressBlock(account, newIngressBlock(0))
+	require.NoError(err, "unexpected PutIngressBlock() error")
+	err = store.PutIngressBlock(account, newIngressBlock(0))
+	require.Equal(ErrReplay, err, "expected replay to be detected")
+	blocks, _, err := store.GetIngressBlocks(account, [constants.MessageIDLength]byte{0})
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Equal(1, len(blocks), "replayed block was stored")
+
+	surbID := [sphinxconstants.SURBIDLength]byte{1, 2, 3}
+	replayed, err := store.SeenSURBID(account, surbID)
+	require.NoError(err, "unexpected SeenSURBID() error")
+	require.False(replayed, "SURB ID wrongly reported as replayed")
+	replayed, err = store.SeenSURBID(account, surbID)
+	require.NoError(err, "unexpected SeenSURBID() error")
+	require.True(replayed, "expected replay to be detected")
+
+	// the cache is bounded, the oldest entries are evicted first
+	for i := byte(1); i < 4; i++ {
+		err = store.PutIngressBlock(account, newIngressBlock(i))
+		require.NoError(err, "unexpected PutIngressBlock() error")
+	}
+	err = store.PutIngressBlock(account, newIngressBlock(0))
+	require.NoError(err, "expected evicted entry to be forgotten")
+	err = store.PutIngressBlock(account, newIngressBlock(3))
+	require.Equal(ErrReplay, err, "expected replay to be detected")
+}
+
+func TestRetireSURBKeys(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "db_test4")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	surbKeys := bytes.Repeat([]byte{1}, surbKeyMaterialLength)
+	blockIDs := [][BlockIDLength]byte{}
+	for _, epoch := range []uint64{10, 12} {
+		s := EgressBlock{
+			SenderProvider:    "acme.com",
+			RecipientProvider: "nsa.gov",
+			SURBKeys:          surbKeys,
+			SURBEpoch:         epoch,
+			Priority:          PriorityInteractive,
+			Block: block.Block{
+				TotalBlocks: uint16(1),
+				Block:       []byte("Begin at the beginning"),
+			},
+		}
+		blockID, err := store.PutEgressBlock(&s)
+		require.NoError(err, "unexpected PutEgressBlock() error")
+		blockIDs = append(blockIDs, *blockID)
+	}
+
+	retired, err := store.RetireSURBKeys(12)
+	require.NoError(err, "unexpected RetireSURBKeys() error")
+	require.Equal(0, retired)
+	candidates, err := store.PreviewRetireSURBKeys(13)
+	require.NoError(err, "unexpected PreviewRetireSURBKeys() error")
+	require.Len(candidates, 1)
+	require.Equal(GCPolicySURBKeys, candidates[0].Policy)
+	retired, err = store.RetireSURBKeys(13)
+	require.NoError(err, "unexpected RetireSURBKeys() error")
+	require.Equal(1, retired)
+
+	raw, err := store.Get(&blockIDs[0])
+	require.NoError(err, "unexpected Get() error")
+	b, err := EgressBlockFromBytes(raw)
+	require.NoError(err, "unexpected EgressBlockFromBytes() error")
+	require.Nil(b.SURBKeys, "SURB keys were not retired")
+	raw, err = store.Get(&blockIDs[1])
+	require.NoError(err, "unexpected Get() error")
+	b, err = EgressBlockFromBytes(raw)
+	require.NoError(err, "unexpected EgressBlockFromBytes() error")
+	require.Equal(surbKeys, b.SURBKeys, "SURB keys retired too early")
+	require.Equal(uint64(12), b.SURBEpoch)
+	require.Equal(PriorityInteractive, b.Priority)
+}
+
+func TestEgressBlockOverflow(t *testing.T) {
+	require := require.New(t)
+
+	s := EgressBlock{
+		SendAttempts: 3,
+		Block: block.Block{
+			TotalBlocks: uint16(1),
+			Block:       []byte("Begin at the beginning"),
+		},
+	}
+	j := s.ToJsonEgressBlock()
+	b, err := j.ToEgressBlock()
+	require.NoError(err, "unexpected ToEgressBlock() error")
+	require.Equal(uint8(3), b.SendAttempts)
+
+	j.SendAttempts = 256
+	_, err = j.ToEgressBlock()
+	require.Error(err, "SendAttempts overflow not detected")
+	j.SendAttempts = 3
+	j.JsonBlock.TotalBlocks = 1 << 16
+	_, err = j.ToEgressBlock()
+	require.Error(err, "TotalBlocks overflow not detected")
+	j.JsonBlock.TotalBlocks = 1
+	j.SURBID = "AAAA"
+	_, err = j.ToEgressBlock()
+	require.Error(err, "short SURB ID not detected")
+}
+
+func TestEgressBlockValidation(t *testing.T) {
+	require := require.New(t)
+
+	s := EgressBlock{
+		Sender:       "alice@acme.com",
+		Recipient:    "bob@nsa.gov",
+		SURBKeys:     bytes.Repeat([]byte{7}, 3*surbKeyMaterialLength),
+		SendAttempts: 1,
+		Priority:     PriorityInteractive,
+		Block: block.Block{
+			TotalBlocks: uint16(1),
+			Block:       []byte("Begin at the beginning"),
+		},
+	}
+	s.SURBID[0] = 1
+	s.RecipientID[0] = 2
+	b, err := s.ToJsonEgressBlock().ToEgressBlock()
+	require.NoError(err, "unexpected ToEgressBlock() error")
+	require.Equal(s.SURBKeys, b.SURBKeys, "SURB keys were dropped")
+	require.Equal(s.SURBID, b.SURBID)
+	require.Equal(s.RecipientID, b.RecipientID)
+
+	short := base64.StdEncoding.EncodeToString([]byte{1, 2, 3})
+	long := base64.StdEncoding.EncodeToString(make([]byte, 2*constants.MessageIDLength))
+	cases := []struct {
+		field   string
+		corrupt func(j *jsonEgressBlock)
+	}{
+		{"BlockID", func(j *jsonEgressBlock) { j.BlockID = short }},
+		{"BlockID", func(j *jsonEgressBlock) { j.BlockID = long }},
+		{"RecipientID", func(j *jsonEgressBlock) { j.RecipientID = short }},
+		{"RecipientID", func(j *jsonEgressBlock) { j.RecipientID = "!" }},
+		{"SURBID", func(j *jsonEgressBlock) { j.SURBID = long }},
+		{"SURBKeys", func(j *jsonEgressBlock) { j.SURBKeys = short }},
+		{"SURBKeys", func(j *jsonEgressBlock) { j.SURBKeys = "!" }},
+		{"Priority", func(j *jsonEgressBlock) { j.Priority = 7 }},
+		{"Block", func(j *jsonEgressBlock) { j.JsonBlock = nil }},
+		{"MessageID", func(j *jsonEgressBlock) { j.JsonBlock.MessageID = short }},
+	}
+	for _, c := range cases {
+		j := s.ToJsonEgressBlock()
+		c.corrupt(j)
+		_, err := j.ToEgressBlock()
+		require.Error(err, "corrupted %s not detected", c.field)
+		require.Contains(err.Error(), c.field)
+	}
+}
+
+func FuzzEgressBlockFromBytes(f *testing.F) {
+	s := EgressBlock{
+		Sender:       "alice@acme.com",
+		Recipient:    "bob@nsa.gov",
+		SendAttempts: 1,
+		SURBKeys:     bytes.Repeat([]byte{1}, surbKeyMaterialLength),
+		Block: block.Block{
+			TotalBlocks: 1,
+			Block:       []byte("Begin at the beginning"),
+		},
+	}
+	raw, err := s.ToBytes()
+	require.NoError(f, err, "unexpected ToBytes() error")
+	f.Add(raw)
+	// an egress block without Block used to panic
+	f.Add([]byte(`{"BlockID":"","JsonBlock":null}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := EgressBlockFromBytes(data)
+		if err != nil {
+			return
+		}
+		encoded, err := s.ToBytes()
+		require.NoError(t, err, "unexpected ToBytes() error")
+		decoded, err := EgressBlockFromBytes(encoded)
+		require.NoError(t, err, "unexpected EgressBlockFromBytes() error")
+		require.Equal(t, s, decoded)
+	})
+}
+
+func FuzzIngressBlockFromBytes(f *testing.F) {
+	i := IngressBlock{
+		S: [32]byte{1},
+		Block: &block.Block{
+			TotalBlocks: 1,
+			Block:       []byte("Begin at the beginning"),
+		},
+	}
+	raw, err := i.ToBytes()
+	require.NoError(f, err, "unexpected ToBytes() error")
+	f.Add(raw)
+	// inputs shorter than the sender key used to panic
+	f.Add(raw[:16])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		i, err := IngressBlockFromBytes(data)
+		if err != nil {
+			return
+		}
+		encoded, err := i.ToBytes()
+		require.NoError(t, err, "unexpected ToBytes() error")
+		require.Equal(t, data, encoded)
+	})
+}
+
+func TestCommitReassembly(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "db_test_commit")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	put := func(id byte) [constants.MessageIDLength]byte {
+		messageID := [constants.MessageIDLength]byte{id}
+		err := store.PutIngressBlock(account, &IngressBlock{
+			Block: &block.Block{
+				MessageID:   messageID,
+				TotalBlocks: 1,
+				Block:       []byte{id},
+			},
+		})
+		require.NoError(err, "unexpected PutIngressBlock() error")
+		return messageID
+	}
+
+	messageID := put(1)
+	_, keys, err := store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	err = store.CommitReassembly(account, keys, []byte("hello"), "")
+	require.NoError(err, "unexpected CommitReassembly() error")
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal([][]byte{[]byte("hello")}, messages)
+
+	// the blocks were already removed
+	err = store.CommitReassembly(account, keys, []byte("hello"), "")
+	require.Equal(ErrKeyNotFound, err)
+
+	// quarantined messages are filed into the given folder
+	messageID = put(2)
+	_, keys, err = store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	err = store.CommitReassembly(account, keys, []byte("spam?"), FolderJunk)
+	require.NoError(err, "unexpected CommitReassembly() error")
+	junk, err := store.FolderMessages(account, FolderJunk)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Len(junk, 1)
+	require.Equal([]byte("spam?"), junk[0].Message)
+
+	// nil messages are dropped
+	messageID = put(3)
+	_, keys, err = store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	err = store.CommitReassembly(account, keys, nil, "")
+	require.NoError(err, "unexpected CommitReassembly() error")
+	blocks, _, err := store.GetIngressBlocks(account, messageID)
+	require.NoError(err, "unexpected GetIngressBlocks() error")
+	require.Empty(blocks)
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Len(messages, 1)
+}
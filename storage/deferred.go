@@ -0,0 +1,144 @@
+// deferred.go - messages held until their send time
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+// DeferredBucketName is the name of the boltdb bucket which persists
+// the submitted messages held until their send time
+const DeferredBucketName = "deferred"
+
+// DeferredMessage is a submitted message held until it's send time,
+// it's then fragmented and queued like other messages
+type DeferredMessage struct {
+	// ID is the key of the message in the deferred bucket
+	ID uint64
+
+	// Sender is the sending account
+	Sender string
+
+	// Recipient is the recipient's e-mail address
+	Recipient string
+
+	// SendAfter is the time the message is to be sent at
+	SendAfter time.Time
+
+	// Priority is the priority class of the message
+	Priority Priority
+
+	// Message is the message as it's to be fragmented
+	Message []byte
+
+	// Flags are the framing flags the message is sent with
+	Flags uint8 `json:",omitempty"`
+
+	// Copy is the copy of the message filed into the
+	// sender's Sent folder once it's sent, nil if none
+	Copy []byte `json:",omitempty"`
+}
+
+// deferredKey returns the deferred bucket key of the given ID
+func deferredKey(id uint64) []byte {
+	key := [8]byte{}
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:]
+}
+
+// PutDeferredMessage persists the given message and returns it's ID
+func (s *Store) PutDeferredMessage(m *DeferredMessage) (uint64, error) {
+	return s.PutSubmittedDeferredMessage(m, nil)
+}
+
+// PutSubmittedDeferredMessage persists the given deferred message as
+// PutDeferredMessage does and records the given submission of it's
+// sender, if any, in the same transaction, see PutSubmittedEgressBlock
+func (s *Store) PutSubmittedDeferredMessage(m *DeferredMessage, submission *Submission) (uint64, error) {
+	transaction := func(tx *bolt.Tx) error {
+		if submission != nil {
+			err := s.putSubmission(tx, m.Sender, submission)
+			if err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(DeferredBucketName))
+		if err != nil {
+			return err
+		}
+		m.ID, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return b.Put(deferredKey(m.ID), value)
+	}
+	err := s.db.Update(transaction)
+	if err != nil {
+		return 0, err
+	}
+	return m.ID, nil
+}
+
+// DeferredMessages returns the deferred messages sorted by send time
+func (s *Store) DeferredMessages() ([]*DeferredMessage, error) {
+	messages := []*DeferredMessage{}
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(DeferredBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			m := DeferredMessage{}
+			err := json.Unmarshal(v, &m)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, &m)
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].SendAfter.Before(messages[j].SendAfter)
+	})
+	return messages, nil
+}
+
+// RemoveDeferredMessage removes the deferred message with the
+// given ID, ErrKeyNotFound is returned if there is no such message
+func (s *Store) RemoveDeferredMessage(id uint64) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(DeferredBucketName))
+		if b == nil || b.Get(deferredKey(id)) == nil {
+			return ErrKeyNotFound
+		}
+		return b.Delete(deferredKey(id))
+	}
+	return s.db.Update(transaction)
+}
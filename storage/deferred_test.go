@@ -0,0 +1,81 @@
+// deferred_test.go - deferred message tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeferredMessages(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "deferred_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	messages, err := store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Equal(0, len(messages))
+
+	now := time.Unix(1500000000, 0)
+	later, err := store.PutDeferredMessage(&DeferredMessage{
+		Sender:    "alice@acme.com",
+		Recipient: "bob@nsa.gov",
+		SendAfter: now.Add(time.Hour),
+		Priority:  PriorityBulk,
+		Message:   []byte("later"),
+	})
+	require.NoError(err, "unexpected PutDeferredMessage() error")
+	sooner, err := store.PutDeferredMessage(&DeferredMessage{
+		Sender:    "alice@acme.com",
+		Recipient: "bob@nsa.gov",
+		SendAfter: now.Add(time.Minute),
+		Message:   []byte("sooner"),
+		Copy:      []byte("copy"),
+	})
+	require.NoError(err, "unexpected PutDeferredMessage() error")
+	require.NotEqual(later, sooner)
+
+	// the messages are sorted by send time
+	messages, err = store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Equal(2, len(messages))
+	require.Equal(sooner, messages[0].ID)
+	require.Equal([]byte("copy"), messages[0].Copy)
+	require.Equal(later, messages[1].ID)
+	require.Equal(PriorityBulk, messages[1].Priority)
+	require.Nil(messages[1].Copy)
+
+	err = store.RemoveDeferredMessage(sooner)
+	require.NoError(err, "unexpected RemoveDeferredMessage() error")
+	err = store.RemoveDeferredMessage(sooner)
+	require.Equal(ErrKeyNotFound, err)
+	messages, err = store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Equal(1, len(messages))
+}
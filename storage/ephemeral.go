@@ -0,0 +1,91 @@
+// ephemeral.go - Store without persistence
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+// ErrNoMemoryFileSystem is returned by NewEphemeral when no memory
+// backed file system is available, the ephemeral database is never
+// written to disk
+var ErrNoMemoryFileSystem = errors.New("no memory backed file system for the ephemeral store")
+
+// memoryDirs are the candidate directories of memory backed
+// file systems, in order of preference
+var memoryDirs = []string{
+	os.Getenv("XDG_RUNTIME_DIR"),
+	"/dev/shm",
+}
+
+// ephemeralDir returns a directory of a memory backed file system
+func ephemeralDir() (string, error) {
+	for _, dir := range memoryDirs {
+		if dir == "" {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", ErrNoMemoryFileSystem
+}
+
+// NewEphemeral returns a new empty Store which doesn't persist
+// anything, it has the same methods as a Store created with New
+// and it's content is lost once it's closed. This is used for the
+// ephemeral mode and for fast hermetic tests.
+//
+// The database lives in an anonymous file of a memory backed file
+// system, which is unlinked as soon as it's opened so that no other
+// process can find it. ErrNoMemoryFileSystem is returned on systems
+// without such a file system, an error is also returned if the file
+// can't be unlinked.
+func NewEphemeral() (*Store, error) {
+	dir, err := ephemeralDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "mixclient-ephemeral")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	s := Store{
+		replayCacheSize: ReplayCacheSize,
+		eventLogSize:    EventLogSize,
+		journalSize:     JournalSize,
+		now:             time.Now,
+	}
+	s.db, err = bolt.Open(f.Name(), 0600, &bolt.Options{NoSync: true})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	err = os.Remove(f.Name())
+	if err != nil {
+		s.db.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &s, nil
+}
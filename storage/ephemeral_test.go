@@ -0,0 +1,58 @@
+// ephemeral_test.go - Store without persistence tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEphemeralStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ephemeral_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	defer func(dirs []string) {
+		memoryDirs = dirs
+	}(memoryDirs)
+	memoryDirs = []string{dir}
+
+	store, err := NewEphemeral()
+	require.NoError(err, "unexpected NewEphemeral() error")
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(0, len(files), "ephemeral database is linked")
+
+	err = store.CreateAccountBuckets([]string{"alice@acme.com"})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutMessage("alice@acme.com", []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+	messages, err := store.Messages("alice@acme.com")
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal([][]byte{[]byte("hello")}, messages)
+	err = store.Close()
+	require.NoError(err, "unexpected Close() error")
+
+	// the database isn't written to disk
+	memoryDirs = []string{"", dir + "/missing"}
+	_, err = NewEphemeral()
+	require.Equal(ErrNoMemoryFileSystem, err)
+}
@@ -0,0 +1,198 @@
+// events.go - structured event log
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// EventsBucketName is the name of the boltdb bucket
+	// which persists the structured event log
+	EventsBucketName = "events"
+
+	// EventLogSize is the maximum number of events remembered
+	// by the event log, once full the oldest events are evicted
+	EventLogSize = 1 << 14
+)
+
+// EventType is the type of a lifecycle event
+type EventType string
+
+const (
+	// EventMessageQueued is recorded when a message
+	// is fragmented and put into the egress queue
+	EventMessageQueued EventType = "message_queued"
+
+	// EventBlockSent is recorded each time
+	// a Block is transmitted to the Provider
+	EventBlockSent EventType = "block_sent"
+
+	// EventBlockAcked is recorded each time
+	// the ACK of a Block is received
+	EventBlockAcked EventType = "block_acked"
+
+	// EventMessageAcked is recorded when all
+	// the Blocks of a message have been ACKed
+	EventMessageAcked EventType = "message_acked"
+
+	// EventMessageBounced is recorded when the
+	// delivery of a message is given up
+	EventMessageBounced EventType = "message_bounced"
+
+	// EventMessageArrived is recorded when a received
+	// message is delivered into an account's mailbox
+	EventMessageArrived EventType = "message_arrived"
+
+	// EventMessageFiltered is recorded when a received message
+	// is discarded by the mail filters, see package mail_filter
+	EventMessageFiltered EventType = "message_filtered"
+
+	// EventMessageDropped is recorded when a received message
+	// which can't be opened is dropped with it's Blocks
+	EventMessageDropped EventType = "message_dropped"
+
+	// EventSessionConnected is recorded when a wire protocol
+	// session with the Provider becomes usable
+	EventSessionConnected EventType = "session_connected"
+
+	// EventSessionLost is recorded when a wire protocol
+	// session with the Provider fails
+	EventSessionLost EventType = "session_lost"
+
+	// EventEpochRollover is recorded when a new mixnet epoch begins
+	EventEpochRollover EventType = "epoch_rollover"
+
+	// EventGarbageCollected is recorded when the garbage
+	// collection reclaimed expired or stale records
+	EventGarbageCollected EventType = "garbage_collected"
+
+	// EventDiskSpaceLow is recorded when the volume holding the
+	// database runs low on space, see package disk_space
+	EventDiskSpaceLow EventType = "disk_space_low"
+
+	// EventDiskSpaceRecovered is recorded when the volume
+	// holding the database is no longer low on space
+	EventDiskSpaceRecovered EventType = "disk_space_recovered"
+)
+
+// Event is a structured event of the event log
+type Event struct {
+	// Time is the time the event was recorded at
+	Time time.Time
+
+	// Type is the type of the event
+	Type EventType
+
+	// Account is the account the event relates to, if any
+	Account string
+
+	// MessageID is the hex encoded message ID
+	// the event relates to, if any
+	MessageID string
+
+	// Detail is an optional human readable description
+	Detail string
+}
+
+// RecordEvent appends the given event to the event log,
+// the event's Time is set to the current time if zero
+func (s *Store) RecordEvent(e *Event) error {
+	if e.Time.IsZero() {
+		e.Time = s.now()
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	transaction := func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(EventsBucketName))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if s.eventObserver != nil {
+			observer := s.eventObserver
+			tx.OnCommit(func() {
+				observer(e)
+			})
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		err = b.Put(key, raw)
+		if err != nil {
+			return err
+		}
+		// keys are only ever removed from the front of the
+		// bucket, so the log size is the distance to the oldest event
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && seq-binary.BigEndian.Uint64(k) >= s.eventLogSize; k, _ = c.First() {
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
+
+// SetEventObserver sets a function which is called with each event
+// once it's recorded in the event log. It's called once the
+// transaction is closed, so it may read the Store but it should
+// return quickly.
+func (s *Store) SetEventObserver(observer func(e *Event)) {
+	s.eventObserver = observer
+}
+
+// Events returns at most limit events recorded at or after the
+// given time, oldest first. A limit of zero returns all the events.
+func (s *Store) Events(since time.Time, limit int) ([]*Event, error) {
+	events := []*Event{}
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(EventsBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if limit != 0 && len(events) == limit {
+				return nil
+			}
+			e := Event{}
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			if !e.Time.Before(since) {
+				events = append(events, &e)
+			}
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,87 @@
+// events_test.go - structured event log tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "events_test1")
+	defer cleanup()
+
+	events, err := store.Events(time.Time{}, 0)
+	require.NoError(err, "unexpected Events() error")
+	require.Equal(0, len(events))
+
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+	store.eventLogSize = 3
+	for i := 0; i < 5; i++ {
+		err = store.RecordEvent(&Event{
+			Type:    EventBlockSent,
+			Account: "alice@acme.com",
+			Detail:  fmt.Sprintf("event %d", i),
+		})
+		require.NoError(err, "unexpected RecordEvent() error")
+		now = now.Add(time.Minute)
+	}
+
+	// the oldest events are evicted
+	events, err = store.Events(time.Time{}, 0)
+	require.NoError(err, "unexpected Events() error")
+	require.Equal(3, len(events))
+	require.Equal("event 2", events[0].Detail)
+	require.Equal(EventBlockSent, events[0].Type)
+
+	events, err = store.Events(time.Unix(1500000000, 0).Add(3*time.Minute), 0)
+	require.NoError(err, "unexpected Events() error")
+	require.Equal(2, len(events))
+	require.Equal("event 3", events[0].Detail)
+
+	events, err = store.Events(time.Time{}, 1)
+	require.NoError(err, "unexpected Events() error")
+	require.Equal(1, len(events))
+	require.Equal("event 2", events[0].Detail)
+}
+
+func TestEventObserver(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "events_test2")
+	defer cleanup()
+
+	observed := []*Event{}
+	store.SetEventObserver(func(e *Event) {
+		observed = append(observed, e)
+	})
+	err := store.RecordEvent(&Event{
+		Type:    EventMessageArrived,
+		Account: "alice@acme.com",
+		Detail:  "from bob@nsa.gov",
+	})
+	require.NoError(err, "unexpected RecordEvent() error")
+	require.Equal(1, len(observed))
+	require.Equal(EventMessageArrived, observed[0].Type)
+	require.False(observed[0].Time.IsZero())
+}
@@ -0,0 +1,214 @@
+// flags.go - message flags shared by the mail protocols
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/coreos/bbolt"
+)
+
+// Flags are the flags of a message in the pop3 bucket, they're
+// persisted with it's metadata so that they survive restarts and
+// are shared by the POP3 proxy and any other mail protocol
+type Flags uint8
+
+const (
+	// FlagSeen marks a message as read
+	FlagSeen Flags = 1 << iota
+
+	// FlagAnswered marks a message as answered
+	FlagAnswered
+
+	// FlagFlagged marks a message for urgent or special attention
+	FlagFlagged
+
+	// FlagDeleted marks a message for removal by Expunge
+	FlagDeleted
+)
+
+// flagNames are the IMAP names of the flags
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagSeen, `\Seen`},
+	{FlagAnswered, `\Answered`},
+	{FlagFlagged, `\Flagged`},
+	{FlagDeleted, `\Deleted`},
+}
+
+// String returns the space separated IMAP names of the flags
+func (f Flags) String() string {
+	names := []string{}
+	for _, n := range flagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// MessageFlags returns the flags of the message with the given key
+// in the account's pop3 bucket, ErrKeyNotFound if there is no such
+// message
+func (s *Store) MessageFlags(accountName string, key uint64) (Flags, error) {
+	flags := Flags(0)
+	transaction := func(tx *bolt.Tx) error {
+		m, err := s.metadata(tx, accountName, []byte(strconv.FormatUint(key, 10)))
+		if err != nil {
+			return err
+		}
+		flags = m.Flags
+		return nil
+	}
+	err := s.db.View(transaction)
+	return flags, err
+}
+
+// SetMessageFlags replaces the flags of the message with the given
+// key in the account's pop3 bucket
+func (s *Store) SetMessageFlags(accountName string, key uint64, flags Flags) error {
+	_, err := s.UpdateMessageFlags(accountName, key, flags, ^flags)
+	return err
+}
+
+// UpdateMessageFlags adds and removes the given flags of the message
+// with the given key in the account's pop3 bucket and returns the
+// resulting flags. A change is recorded in the mailbox journal.
+func (s *Store) UpdateMessageFlags(accountName string, key uint64, add, remove Flags) (Flags, error) {
+	flags := Flags(0)
+	transaction := func(tx *bolt.Tx) error {
+		k := []byte(strconv.FormatUint(key, 10))
+		m, err := s.metadata(tx, accountName, k)
+		if err != nil {
+			return err
+		}
+		flags = m.Flags&^remove | add
+		if flags == m.Flags {
+			return nil
+		}
+		m.Flags = flags
+		err = s.putMessageMetadata(tx, accountName, k, m)
+		if err != nil {
+			return err
+		}
+		return s.recordChange(tx, accountName, MailboxFlags, k)
+	}
+	err := s.db.Update(transaction)
+	return flags, err
+}
+
+// Expunge removes the messages flagged as deleted from the
+// account's pop3 bucket and returns their number
+func (s *Store) Expunge(accountName string) (int, error) {
+	return s.expunge(accountName, nil)
+}
+
+// ExpungeMessages removes the messages with the given keys which
+// are flagged as deleted from the account's pop3 bucket and returns
+// their number, the other messages flagged as deleted are kept
+func (s *Store) ExpungeMessages(accountName string, keys []uint64) (int, error) {
+	selected := make(map[uint64]bool)
+	for _, key := range keys {
+		selected[key] = true
+	}
+	return s.expunge(accountName, selected)
+}
+
+// expunge removes the messages flagged as deleted, only
+// those whose keys are selected unless selected is nil
+func (s *Store) expunge(accountName string, selected map[uint64]bool) (int, error) {
+	expunged := 0
+	transaction := func(tx *bolt.Tx) error {
+		expunged = 0
+		pop3 := accountBucket(tx, accountName, pop3BucketName)
+		if pop3 == nil {
+			return ErrBucketMissing
+		}
+		keys := []uint64{}
+		err := pop3.ForEach(func(k, v []byte) error {
+			m, err := s.metadata(tx, accountName, k)
+			if err != nil {
+				return err
+			}
+			if m.Flags&FlagDeleted != 0 && (selected == nil || selected[m.Key]) {
+				keys = append(keys, m.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			_, err = s.removeFolderMessage(tx, accountName, FolderInbox, key)
+			if err != nil {
+				return err
+			}
+			expunged++
+		}
+		return nil
+	}
+	err := s.db.Update(transaction)
+	return expunged, err
+}
+
+// ClearDeletedFlags removes the deleted flag of the messages of the
+// account's pop3 bucket and returns their number. The flags are left
+// over by the sessions which were interrupted, e.g. by a crash,
+// before their deletions were committed.
+func (s *Store) ClearDeletedFlags(accountName string) (int, error) {
+	cleared := 0
+	transaction := func(tx *bolt.Tx) error {
+		cleared = 0
+		pop3 := accountBucket(tx, accountName, pop3BucketName)
+		if pop3 == nil {
+			return ErrBucketMissing
+		}
+		marked := []*MessageMetadata{}
+		err := pop3.ForEach(func(k, v []byte) error {
+			m, err := s.metadata(tx, accountName, k)
+			if err != nil {
+				return err
+			}
+			if m.Flags&FlagDeleted != 0 {
+				marked = append(marked, m)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range marked {
+			k := []byte(strconv.FormatUint(m.Key, 10))
+			m.Flags &^= FlagDeleted
+			err = s.putMessageMetadata(tx, accountName, k, m)
+			if err != nil {
+				return err
+			}
+			err = s.recordChange(tx, accountName, MailboxFlags, k)
+			if err != nil {
+				return err
+			}
+			cleared++
+		}
+		return nil
+	}
+	err := s.db.Update(transaction)
+	return cleared, err
+}
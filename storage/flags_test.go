@@ -0,0 +1,121 @@
+// flags_test.go - message flag tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/coreos/bbolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageFlags(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "flags_test1")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	for _, m := range []string{"one", "two", "three"} {
+		err = store.PutMessage(account, []byte(m))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	_, modSeq, err := store.Changes(account, 0)
+	require.NoError(err, "unexpected Changes() error")
+
+	flags, err := store.MessageFlags(account, 1)
+	require.NoError(err, "unexpected MessageFlags() error")
+	require.Equal(Flags(0), flags)
+	_, err = store.MessageFlags(account, 4)
+	require.Equal(ErrKeyNotFound, err)
+
+	err = store.SetMessageFlags(account, 1, FlagSeen|FlagFlagged)
+	require.NoError(err, "unexpected SetMessageFlags() error")
+	flags, err = store.UpdateMessageFlags(account, 1, FlagAnswered, FlagFlagged)
+	require.NoError(err, "unexpected UpdateMessageFlags() error")
+	require.Equal(FlagSeen|FlagAnswered, flags)
+	require.Equal(`\Seen \Answered`, flags.String())
+	_, err = store.UpdateMessageFlags(account, 2, FlagDeleted, 0)
+	require.NoError(err, "unexpected UpdateMessageFlags() error")
+	_, err = store.UpdateMessageFlags(account, 4, FlagDeleted, 0)
+	require.Equal(ErrKeyNotFound, err)
+
+	changes, _, err := store.Changes(account, modSeq)
+	require.NoError(err, "unexpected Changes() error")
+	require.Len(changes, 3)
+	require.Equal(MailboxFlags, changes[0].Op)
+
+	inbox, err := store.FolderMessages(account, FolderInbox)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Equal([]Flags{FlagSeen | FlagAnswered, FlagDeleted, 0}, []Flags{inbox[0].Flags, inbox[1].Flags, inbox[2].Flags})
+
+	expunged, err := store.Expunge(account)
+	require.NoError(err, "unexpected Expunge() error")
+	require.Equal(1, expunged)
+	metadata, err := store.MessageMetadata(account)
+	require.NoError(err, "unexpected MessageMetadata() error")
+	require.Len(metadata, 2)
+	require.Equal([]uint64{1, 3}, []uint64{metadata[0].Key, metadata[1].Key})
+	require.Equal(FlagSeen|FlagAnswered, metadata[0].Flags, "flags not persisted")
+	require.Equal([]bool{true, false}, []bool{metadata[0].Seen, metadata[1].Seen}, "Seen out of sync with the flags")
+
+	// only the selected messages are expunged
+	for _, key := range []uint64{1, 3} {
+		_, err = store.UpdateMessageFlags(account, key, FlagDeleted, 0)
+		require.NoError(err, "unexpected UpdateMessageFlags() error")
+	}
+	expunged, err = store.ExpungeMessages(account, []uint64{3})
+	require.NoError(err, "unexpected ExpungeMessages() error")
+	require.Equal(1, expunged)
+	cleared, err := store.ClearDeletedFlags(account)
+	require.NoError(err, "unexpected ClearDeletedFlags() error")
+	require.Equal(1, cleared)
+	flags, err = store.MessageFlags(account, 1)
+	require.NoError(err, "unexpected MessageFlags() error")
+	require.Equal(FlagSeen|FlagAnswered, flags)
+	_, err = store.MessageFlags(account, 3)
+	require.Equal(ErrKeyNotFound, err)
+}
+
+func TestDeprecatedSeen(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "flags_test2")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutMessage(account, []byte("one"))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	// metadata recorded before the flags
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return accountBucket(tx, account, metadataBucketName).Put([]byte("1"), []byte(`{"Size":3,"Seen":true}`))
+	})
+	require.NoError(err, "unexpected Update() error")
+	flags, err := store.MessageFlags(account, 1)
+	require.NoError(err, "unexpected MessageFlags() error")
+	require.Equal(FlagSeen, flags)
+
+	_, err = store.UpdateMessageFlags(account, 1, FlagAnswered, FlagSeen)
+	require.NoError(err, "unexpected UpdateMessageFlags() error")
+	metadata, err := store.MessageMetadata(account)
+	require.NoError(err, "unexpected MessageMetadata() error")
+	require.Equal(FlagAnswered, metadata[0].Flags)
+	require.False(metadata[0].Seen, "Seen out of sync with the flags")
+}
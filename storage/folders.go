@@ -0,0 +1,263 @@
+// folders.go - mailbox folders
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// FolderInbox is the folder of the received messages, it's
+	// the pop3 bucket served by the POP3 proxy
+	FolderInbox = "INBOX"
+
+	// FolderSent is the folder keeping a copy of the sent messages
+	FolderSent = "Sent"
+
+	// FolderDrafts is the folder of the unsent drafts
+	FolderDrafts = "Drafts"
+
+	// FolderTrash is the folder of the deleted messages
+	FolderTrash = "Trash"
+
+	// FolderJunk is the folder of the unwanted received
+	// messages, see SetSorter
+	FolderJunk = "Junk"
+)
+
+// Folders are the mailbox folders of each account
+var Folders = []string{FolderInbox, FolderSent, FolderDrafts, FolderTrash, FolderJunk}
+
+// ErrNoSuchFolder is the error returned when a
+// folder name isn't one of Folders
+var ErrNoSuchFolder = errors.New("no such folder")
+
+// FolderMessage is a message in a mailbox folder
+type FolderMessage struct {
+	// Key is the key of the message within it's folder
+	Key uint64
+
+	// Message is the message
+	Message []byte
+
+	// Flags are the flags of a message in the INBOX
+	Flags Flags
+}
+
+// folderName returns the canonical name of the given folder,
+// folder names are case insensitive
+func folderName(folder string) (string, error) {
+	for _, name := range Folders {
+		if strings.EqualFold(folder, name) {
+			return name, nil
+		}
+	}
+	return "", ErrNoSuchFolder
+}
+
+// folderBucketName returns the name of the bucket of an account
+// which persists the messages of the given folder, the INBOX is
+// the pop3 bucket
+func folderBucketName(folder string) []byte {
+	if folder == FolderInbox {
+		return pop3BucketName
+	}
+	return []byte(fmt.Sprintf("folder_%s", strings.ToLower(folder)))
+}
+
+// putFolderMessage puts a message into the given folder and returns
+// it's key, messages put into the INBOX are recorded in the journal
+func (s *Store) putFolderMessage(tx *bolt.Tx, accountName, folder string, message []byte) (uint64, error) {
+	if folder == FolderInbox {
+		err := s.putMessage(tx, accountName, message)
+		if err != nil {
+			return 0, err
+		}
+		return accountBucket(tx, accountName, pop3BucketName).Sequence(), nil
+	}
+	b := accountBucket(tx, accountName, folderBucketName(folder))
+	if b == nil {
+		return 0, errors.New("boltdb bucket for that account doesn't exist")
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return seq, b.Put([]byte(strconv.FormatUint(seq, 10)), message)
+}
+
+// removeFolderMessage removes the message with the given key from
+// the given folder and returns it, nil if there is no such message
+func (s *Store) removeFolderMessage(tx *bolt.Tx, accountName, folder string, key uint64) ([]byte, error) {
+	b := accountBucket(tx, accountName, folderBucketName(folder))
+	if b == nil {
+		return nil, errors.New("boltdb bucket for that account doesn't exist")
+	}
+	k := []byte(strconv.FormatUint(key, 10))
+	v := b.Get(k)
+	if v == nil {
+		return nil, nil
+	}
+	message := append([]byte{}, v...)
+	err := b.Delete(k)
+	if err != nil {
+		return nil, err
+	}
+	if folder == FolderInbox {
+		metadata := accountBucket(tx, accountName, metadataBucketName)
+		if metadata != nil {
+			err = metadata.Delete(k)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = s.recordChange(tx, accountName, MailboxDelete, k)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// PutFolderMessage puts a message into the given folder of the
+// account and returns it's key within the folder
+func (s *Store) PutFolderMessage(accountName, folder string, message []byte) (uint64, error) {
+	folder, err := folderName(folder)
+	if err != nil {
+		return 0, err
+	}
+	key := uint64(0)
+	transaction := func(tx *bolt.Tx) error {
+		key, err = s.putFolderMessage(tx, accountName, folder, message)
+		return err
+	}
+	err = s.db.Update(transaction)
+	return key, err
+}
+
+// FolderMessages returns the messages of the given folder
+// of the account sorted by key, that is by arrival
+func (s *Store) FolderMessages(accountName, folder string) ([]*FolderMessage, error) {
+	folder, err := folderName(folder)
+	if err != nil {
+		return nil, err
+	}
+	messages := []*FolderMessage{}
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, folderBucketName(folder))
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			key, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				return err
+			}
+			m := FolderMessage{
+				Key:     key,
+				Message: append([]byte{}, v...),
+			}
+			if folder == FolderInbox {
+				metadata, err := s.metadata(tx, accountName, k)
+				if err != nil {
+					return err
+				}
+				m.Flags = metadata.Flags
+			}
+			messages = append(messages, &m)
+			return nil
+		})
+	}
+	err = s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Key < messages[j].Key
+	})
+	return messages, nil
+}
+
+// transferMessage copies the message with the given key from one
+// folder to another and returns it's new key, the original is removed
+// if move is set. ErrKeyNotFound is returned if there is no such
+// message.
+func (s *Store) transferMessage(accountName, from, to string, key uint64, move bool) (uint64, error) {
+	from, err := folderName(from)
+	if err != nil {
+		return 0, err
+	}
+	to, err = folderName(to)
+	if err != nil {
+		return 0, err
+	}
+	newKey := uint64(0)
+	transaction := func(tx *bolt.Tx) error {
+		var message []byte
+		if move {
+			message, err = s.removeFolderMessage(tx, accountName, from, key)
+			if err != nil {
+				return err
+			}
+		} else {
+			b := accountBucket(tx, accountName, folderBucketName(from))
+			if b == nil {
+				return errors.New("boltdb bucket for that account doesn't exist")
+			}
+			message = b.Get([]byte(strconv.FormatUint(key, 10)))
+		}
+		if message == nil {
+			return ErrKeyNotFound
+		}
+		newKey, err = s.putFolderMessage(tx, accountName, to, append([]byte{}, message...))
+		return err
+	}
+	err = s.db.Update(transaction)
+	return newKey, err
+}
+
+// CopyMessage copies the message with the given key from one folder
+// of the account to another and returns the key of the copy
+func (s *Store) CopyMessage(accountName, from, to string, key uint64) (uint64, error) {
+	return s.transferMessage(accountName, from, to, key, false)
+}
+
+// MoveMessage moves the message with the given key from one folder
+// of the account to another and returns it's new key
+func (s *Store) MoveMessage(accountName, from, to string, key uint64) (uint64, error) {
+	return s.transferMessage(accountName, from, to, key, true)
+}
+
+// DeleteFolderMessage deletes the message with the
+// given key from the given folder of the account
+func (s *Store) DeleteFolderMessage(accountName, folder string, key uint64) error {
+	folder, err := folderName(folder)
+	if err != nil {
+		return err
+	}
+	transaction := func(tx *bolt.Tx) error {
+		_, err := s.removeFolderMessage(tx, accountName, folder, key)
+		return err
+	}
+	return s.db.Update(transaction)
+}
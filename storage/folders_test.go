@@ -0,0 +1,101 @@
+// folders_test.go - mailbox folder tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolders(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "folders_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	_, err = store.PutFolderMessage(account, "Spam", []byte("hello"))
+	require.Equal(ErrNoSuchFolder, err)
+
+	for i := 0; i < 11; i++ {
+		key, err := store.PutFolderMessage(account, "sent", []byte{byte(i)})
+		require.NoError(err, "unexpected PutFolderMessage() error")
+		require.Equal(uint64(i+1), key)
+	}
+	// messages are sorted by key, not by their string encoding
+	sent, err := store.FolderMessages(account, FolderSent)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Equal(11, len(sent))
+	for i, m := range sent {
+		require.Equal(uint64(i+1), m.Key)
+		require.Equal([]byte{byte(i)}, m.Message)
+	}
+
+	// moving a message to the INBOX delivers it to the pop3 bucket
+	_, modSeq, err := store.Changes(account, 0)
+	require.NoError(err, "unexpected Changes() error")
+	key, err := store.MoveMessage(account, FolderSent, FolderInbox, 10)
+	require.NoError(err, "unexpected MoveMessage() error")
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal([][]byte{{9}}, messages)
+	changes, _, err := store.Changes(account, modSeq)
+	require.NoError(err, "unexpected Changes() error")
+	require.Equal(1, len(changes))
+	require.Equal(MailboxAdd, changes[0].Op)
+	_, err = store.MoveMessage(account, FolderSent, FolderInbox, 10)
+	require.Equal(ErrKeyNotFound, err)
+
+	copyKey, err := store.CopyMessage(account, FolderInbox, FolderTrash, key)
+	require.NoError(err, "unexpected CopyMessage() error")
+	trash, err := store.FolderMessages(account, FolderTrash)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Equal([]*FolderMessage{{Key: copyKey, Message: []byte{9}}}, trash)
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(1, len(messages))
+
+	err = store.DeleteFolderMessage(account, FolderInbox, key)
+	require.NoError(err, "unexpected DeleteFolderMessage() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(0, len(messages))
+	err = store.DeleteFolderMessage(account, FolderSent, 1)
+	require.NoError(err, "unexpected DeleteFolderMessage() error")
+	sent, err = store.FolderMessages(account, FolderSent)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Equal(9, len(sent))
+
+	// folders are archived
+	archive, err := store.Export()
+	require.NoError(err, "unexpected Export() error")
+	require.Equal(9, len(archive.Folders[account][FolderSent]))
+	require.Equal(1, len(archive.Folders[account][FolderTrash]))
+}
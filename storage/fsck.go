@@ -0,0 +1,353 @@
+// fsck.go - database integrity checking and repair
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+// CorruptBucketName is the name of the bucket into which Fsck moves
+// the records which can't be decoded, in a nested bucket named after
+// the bucket they were found in, so that they may still be examined
+const CorruptBucketName = "corrupt"
+
+// FsckProblem is an inconsistency of the database found by Fsck
+type FsckProblem struct {
+	// Bucket is the name of the bucket of the record
+	Bucket string
+	// Key is the key of the record, nil if the
+	// problem isn't specific to a record
+	Key []byte
+	// Problem describes the inconsistency
+	Problem string
+	// Orphan is true if the record is an index or
+	// journal entry whose data record doesn't exist
+	Orphan bool
+
+	// repair fixes the problem, nil if it can't be fixed
+	repair func(tx *bolt.Tx) error
+}
+
+// String returns a human readable description of the problem
+func (p *FsckProblem) String() string {
+	if p.Key == nil {
+		return fmt.Sprintf("%s: %s", p.Bucket, p.Problem)
+	}
+	return fmt.Sprintf("%s %q: %s", p.Bucket, p.Key, p.Problem)
+}
+
+// FsckReport is the outcome of Fsck
+type FsckReport struct {
+	// Records is the number of checked records
+	Records int
+	// Problems are the inconsistencies found
+	Problems []*FsckProblem
+	// Repaired is the number of repaired problems
+	Repaired int
+}
+
+// Orphans returns the number of problems of orphaned records
+func (r *FsckReport) Orphans() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Orphan {
+			n++
+		}
+	}
+	return n
+}
+
+// fsck accumulates the problems found within a transaction
+type fsck struct {
+	store  *Store
+	report FsckReport
+}
+
+// problem records a problem of the given record
+func (f *fsck) problem(bucket string, key []byte, orphan bool, repair func(tx *bolt.Tx) error, format string, args ...interface{}) {
+	f.report.Problems = append(f.report.Problems, &FsckProblem{
+		Bucket:  bucket,
+		Key:     append([]byte{}, key...),
+		Problem: fmt.Sprintf(format, args...),
+		Orphan:  orphan,
+		repair:  repair,
+	})
+}
+
+// corrupt records an undecodable record which is
+// repaired by moving it into the corrupt bucket
+func (f *fsck) corrupt(bucket bucketPath, key, value []byte, err error) {
+	key = append([]byte{}, key...)
+	value = append([]byte{}, value...)
+	quarantine := func(tx *bolt.Tx) error {
+		corrupt, err := tx.CreateBucketIfNotExists([]byte(CorruptBucketName))
+		if err != nil {
+			return err
+		}
+		b, err := corrupt.CreateBucketIfNotExists([]byte(bucket.String()))
+		if err != nil {
+			return err
+		}
+		err = b.Put(key, value)
+		if err != nil {
+			return err
+		}
+		return bucket.bucket(tx).Delete(key)
+	}
+	f.problem(bucket.String(), key, false, quarantine, "undecodable record: %s", err)
+}
+
+// orphan records an orphaned record which is repaired by removing it
+func (f *fsck) orphan(bucket bucketPath, key []byte, format string, args ...interface{}) {
+	key = append([]byte{}, key...)
+	remove := func(tx *bolt.Tx) error {
+		return bucket.bucket(tx).Delete(key)
+	}
+	f.problem(bucket.String(), key, true, remove, format, args...)
+}
+
+// Fsck checks the integrity of the database: the structure of the
+// bolt database, that every egress and ingress block, metadata record
+// and send intent can be decoded and that the replay cache, metadata
+// and send intent indexes match the records they refer to. If repair
+// is true the undecodable records are moved into the corrupt bucket,
+// the orphaned records are removed, the missing metadata is recorded
+// and the replay cache index is rebuilt. The client must not be
+// running during a repair. A page corrupted beyond the checks, on
+// which bolt panics, is returned as an error with the partial report.
+func (s *Store) Fsck(repair bool) (*FsckReport, error) {
+	f := fsck{
+		store: s,
+	}
+	check := func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			f.problem("database", nil, false, nil, "%s", err)
+		}
+		f.checkEgress(tx)
+		f.checkSendIntents(tx)
+		for _, account := range accountNames(tx) {
+			f.checkIngress(tx, account)
+			f.checkMetadata(tx, account)
+			f.checkReplay(tx, account)
+		}
+		return nil
+	}
+	err := s.db.View(recovered(check))
+	if err != nil {
+		return &f.report, err
+	}
+	if !repair {
+		return &f.report, nil
+	}
+	transaction := func(tx *bolt.Tx) error {
+		for _, p := range f.report.Problems {
+			if p.repair == nil {
+				continue
+			}
+			err := p.repair(tx)
+			if err != nil {
+				return fmt.Errorf("failed to repair %s: %s", p, err)
+			}
+			f.report.Repaired++
+		}
+		return nil
+	}
+	err = s.db.Update(recovered(transaction))
+	if err != nil {
+		f.report.Repaired = 0
+		return &f.report, err
+	}
+	return &f.report, nil
+}
+
+// recovered returns the given transaction with the panic of
+// bolt on a corrupted page turned into it's error
+func recovered(transaction func(tx *bolt.Tx) error) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("database corrupted: %v", r)
+			}
+		}()
+		return transaction(tx)
+	}
+}
+
+// checkEgress checks that the egress blocks decode
+// and are stored under their own Block ID
+func (f *fsck) checkEgress(tx *bolt.Tx) {
+	b := tx.Bucket([]byte(EgressBucketName))
+	if b == nil {
+		return
+	}
+	b.ForEach(func(k, v []byte) error {
+		f.report.Records++
+		egressBlock, err := EgressBlockFromBytes(v)
+		if err != nil {
+			f.corrupt(bucketPath{[]byte(EgressBucketName)}, k, v, err)
+			return nil
+		}
+		if !bytes.Equal(k, egressBlock.BlockID[:]) {
+			f.corrupt(bucketPath{[]byte(EgressBucketName)}, k, v, fmt.Errorf("stored under the key of another Block ID %x", egressBlock.BlockID))
+		}
+		return nil
+	})
+}
+
+// checkSendIntents checks that the send intents
+// decode and refer to an existing egress block
+func (f *fsck) checkSendIntents(tx *bolt.Tx) {
+	b := tx.Bucket([]byte(SendIntentsBucketName))
+	if b == nil {
+		return
+	}
+	egress := tx.Bucket([]byte(EgressBucketName))
+	b.ForEach(func(k, v []byte) error {
+		f.report.Records++
+		intent := SendIntent{}
+		err := json.Unmarshal(v, &intent)
+		if err != nil {
+			f.corrupt(bucketPath{[]byte(SendIntentsBucketName)}, k, v, err)
+			return nil
+		}
+		if egress == nil || egress.Get(k) == nil {
+			f.orphan(bucketPath{[]byte(SendIntentsBucketName)}, k, "send intent of a missing egress block")
+		}
+		return nil
+	})
+}
+
+// checkIngress checks that the account's ingress blocks decode
+func (f *fsck) checkIngress(tx *bolt.Tx, account string) {
+	path := accountBucketPath(account, ingressBucketName)
+	b := path.bucket(tx)
+	if b == nil {
+		return
+	}
+	b.ForEach(func(k, v []byte) error {
+		f.report.Records++
+		_, err := IngressBlockFromBytes(append([]byte{}, v...))
+		if err != nil {
+			f.corrupt(path, k, v, err)
+		}
+		return nil
+	})
+}
+
+// checkMetadata checks that the account's message metadata decodes
+// and refers to a message in the pop3 bucket, and that every message
+// in the pop3 bucket has it's metadata
+func (f *fsck) checkMetadata(tx *bolt.Tx, account string) {
+	path := accountBucketPath(account, metadataBucketName)
+	b := path.bucket(tx)
+	pop3 := accountBucket(tx, account, pop3BucketName)
+	if pop3 != nil {
+		pop3.ForEach(func(k, v []byte) error {
+			f.report.Records++
+			if b == nil || b.Get(k) == nil {
+				f.missingMetadata(account, k, v)
+			}
+			return nil
+		})
+	}
+	if b == nil {
+		return
+	}
+	b.ForEach(func(k, v []byte) error {
+		f.report.Records++
+		m := MessageMetadata{}
+		err := json.Unmarshal(v, &m)
+		if err != nil {
+			f.corrupt(path, k, v, err)
+			return nil
+		}
+		if pop3 == nil || pop3.Get(k) == nil {
+			f.orphan(path, k, "metadata of a missing message")
+		}
+		return nil
+	})
+}
+
+// missingMetadata records a message without metadata which is
+// repaired by recording the metadata read from it's headers, it's
+// arrival time is lost
+func (f *fsck) missingMetadata(account string, key, message []byte) {
+	key = append([]byte{}, key...)
+	m := f.store.messageMetadata(message)
+	m.Arrival = time.Time{}
+	record := func(tx *bolt.Tx) error {
+		b, err := createAccountBucket(tx, account, metadataBucketName)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	}
+	f.problem(accountBucketPath(account, pop3BucketName).String(), key, false, record, "message without metadata")
+}
+
+// checkReplay checks that the account's replay cache entries and
+// their insertion order index refer to each other. The cache is
+// repaired by rebuilding the entries from the order index.
+func (f *fsck) checkReplay(tx *bolt.Tx, account string) {
+	entries := accountBucket(tx, account, replayBucketName)
+	order := accountBucket(tx, account, replayOrderBucketName)
+	if entries == nil || order == nil {
+		return
+	}
+	unindexed, dangling := 0, 0
+	entries.ForEach(func(k, v []byte) error {
+		f.report.Records++
+		if !bytes.Equal(order.Get(v), k) {
+			unindexed++
+		}
+		return nil
+	})
+	order.ForEach(func(k, v []byte) error {
+		f.report.Records++
+		if !bytes.Equal(entries.Get(v), k) {
+			dangling++
+		}
+		return nil
+	})
+	if unindexed == 0 && dangling == 0 {
+		return
+	}
+	rebuild := func(tx *bolt.Tx) error {
+		root := accountRoot(tx, account)
+		err := root.DeleteBucket(replayBucketName)
+		if err != nil {
+			return err
+		}
+		entries, err := root.CreateBucket(replayBucketName)
+		if err != nil {
+			return err
+		}
+		return root.Bucket(replayOrderBucketName).ForEach(func(k, v []byte) error {
+			return entries.Put(v, k)
+		})
+	}
+	f.problem(accountBucketPath(account, replayBucketName).String(), nil, unindexed > 0, rebuild, "%d entries missing from and %d entries dangling in the order index", unindexed, dangling)
+}
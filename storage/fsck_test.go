@@ -0,0 +1,99 @@
+// fsck_test.go - database integrity checking tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "fsck_test")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutIngressBlock(account, &IngressBlock{
+		Block: &block.Block{
+			MessageID:   [constants.MessageIDLength]byte{1},
+			TotalBlocks: 2,
+			Block:       []byte("partial"),
+		},
+	})
+	require.NoError(err, "unexpected PutIngressBlock() error")
+	err = store.PutMessage(account, []byte("Subject: hello\n\nhi"))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	report, err := store.Fsck(false)
+	require.NoError(err, "unexpected Fsck() error")
+	require.Equal(0, len(report.Problems))
+	require.NotEqual(0, report.Records)
+
+	// corrupt the database
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		err := accountBucket(tx, account, ingressBucketName).Put([]byte("99"), []byte("garbage"))
+		require.NoError(err)
+		err = accountBucket(tx, account, metadataBucketName).Put([]byte("42"), []byte("{}"))
+		require.NoError(err)
+		err = accountBucket(tx, account, pop3BucketName).Put([]byte("7"), []byte("Subject: lost\n\nmetadata"))
+		require.NoError(err)
+		order := accountBucket(tx, account, replayOrderBucketName)
+		k, _ := order.Cursor().First()
+		return order.Delete(k)
+	})
+	require.NoError(err, "unexpected Update() error")
+
+	report, err = store.Fsck(false)
+	require.NoError(err, "unexpected Fsck() error")
+	require.Equal(4, len(report.Problems))
+	require.Equal(2, report.Orphans())
+	require.Equal(0, report.Repaired)
+
+	report, err = store.Fsck(true)
+	require.NoError(err, "unexpected Fsck() error")
+	require.Equal(4, report.Repaired)
+	report, err = store.Fsck(false)
+	require.NoError(err, "unexpected Fsck() error")
+	require.Equal(0, len(report.Problems))
+
+	// the undecodable block was quarantined
+	err = store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(CorruptBucketName)).Bucket([]byte(accountBucketPath(account, ingressBucketName).String()))
+		require.Equal([]byte("garbage"), b.Get([]byte("99")))
+		return nil
+	})
+	require.NoError(err, "unexpected View() error")
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(2, len(messages))
+	metadata, err := store.MessageMetadata(account)
+	require.NoError(err, "unexpected MessageMetadata() error")
+	require.Equal(2, len(metadata))
+
+	// a panic of bolt on a corrupted page is an error
+	err = recovered(func(tx *bolt.Tx) error {
+		panic("page 42 already freed")
+	})(nil)
+	require.Error(err, "the panic wasn't recovered")
+	require.Equal("database corrupted: page 42 already freed", err.Error())
+}
@@ -0,0 +1,179 @@
+// gc.go - garbage collection of expired and stale records
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// GCReport holds the number of records reclaimed
+// by each policy of CollectGarbage
+type GCReport struct {
+	// SURBKeys is the number of retired SURBKeys
+	// of expired SURBs, see RetireSURBKeys
+	SURBKeys int
+	// EgressBlocks is the number of removed stale
+	// *EgressBlock, see PreviewStaleEgressBlocks
+	EgressBlocks int
+	// PooledSURBs is the number of removed expired
+	// pooled and received SURBs, see ExpirePooledSURBs
+	PooledSURBs int
+	// Submissions is the number of removed idempotency keys
+	// older than the SubmissionWindow, see RecordSubmission
+	Submissions int
+	// SplitParts is the number of removed parts of split messages
+	// older than the SplitPartRetention, see PutSplitPart
+	SplitParts int
+}
+
+// Total returns the total number of reclaimed records
+func (r *GCReport) Total() int {
+	return r.SURBKeys + r.EgressBlocks + r.PooledSURBs + r.Submissions + r.SplitParts
+}
+
+// String returns a human readable summary of the report
+func (r *GCReport) String() string {
+	return fmt.Sprintf("%d SURB keys, %d egress blocks, %d pooled SURBs, %d submissions, %d split message parts",
+		r.SURBKeys, r.EgressBlocks, r.PooledSURBs, r.Submissions, r.SplitParts)
+}
+
+// CollectGarbage reclaims the records of the given accounts which
+// expired by the given epoch or which can no longer be used, so that
+// the key material and the egress state don't accumulate forever.
+// It's meant to be run at each epoch boundary.
+func (s *Store) CollectGarbage(accounts []string, epoch uint64) (*GCReport, error) {
+	report := GCReport{}
+	var err error
+	report.SURBKeys, err = s.RetireSURBKeys(epoch)
+	if err != nil {
+		return nil, err
+	}
+	report.EgressBlocks, err = s.removeStaleEgressBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, accountName := range accounts {
+		expired, err := s.ExpirePooledSURBs(accountName, epoch)
+		if err != nil {
+			return nil, err
+		}
+		report.PooledSURBs += expired
+		transaction := func(tx *bolt.Tx) error {
+			b := accountBucket(tx, accountName, submissionsBucketName)
+			if b == nil {
+				return ErrBucketMissing
+			}
+			pruned, err := s.pruneSubmissions(b)
+			report.Submissions += pruned
+			if err != nil {
+				return err
+			}
+			b = accountBucket(tx, accountName, splitPartsBucketName)
+			if b == nil {
+				return ErrBucketMissing
+			}
+			pruned, err = s.pruneSplitParts(b)
+			report.SplitParts += pruned
+			return err
+		}
+		err = s.db.Update(transaction)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
+
+// pendingACK returns true if the ACK of the *EgressBlock with
+// the given key is still awaited at the given time, see SendIntent
+func pendingACK(tx *bolt.Tx, key []byte, now time.Time) bool {
+	bucket := tx.Bucket([]byte(SendIntentsBucketName))
+	if bucket == nil {
+		return false
+	}
+	v := bucket.Get(key)
+	if v == nil {
+		return false
+	}
+	intent := SendIntent{}
+	err := json.Unmarshal(v, &intent)
+	if err != nil {
+		return false
+	}
+	return now.Before(intent.Deadline)
+}
+
+// staleEgressReason returns why the given *EgressBlock with the given
+// key is stale at the given time, or an empty string if it isn't. A Block is stale if
+// it's delivery was given up without it being removed, unless the ACK
+// of it's last transmission may still arrive, or if it's sender's
+// account no longer exists so that it can never be sent.
+func staleEgressReason(tx *bolt.Tx, key []byte, b *EgressBlock, now time.Time) string {
+	if b.SendAttempts >= constants.MaxSendAttempts && !pendingACK(tx, key, now) {
+		return fmt.Sprintf("given up after %d attempts", b.SendAttempts)
+	}
+	if accountBucket(tx, b.Sender, ingressBucketName) == nil {
+		return fmt.Sprintf("sender %s has no account", b.Sender)
+	}
+	return ""
+}
+
+// removeStaleEgressBlocks removes the stale *EgressBlock
+// and returns their number, see staleEgressReason
+func (s *Store) removeStaleEgressBlocks() (int, error) {
+	removed := 0
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return nil
+		}
+		stale := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			b, err := EgressBlockFromBytes(v)
+			if err != nil {
+				log.Warningf("skipping undecodable egress block %x: %s", k, err)
+				return nil
+			}
+			if staleEgressReason(tx, k, b, s.now()) != "" {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+			err = clearSendIntent(tx, k)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(stale)
+		return nil
+	}
+	err := s.db.Update(transaction)
+	return removed, err
+}
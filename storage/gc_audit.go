@@ -0,0 +1,117 @@
+// gc_audit.go - retention policy previews
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+const (
+	// GCPolicySURBKeys is the policy erasing the SURB
+	// keys of expired SURBs, see RetireSURBKeys
+	GCPolicySURBKeys = "surb_keys"
+
+	// GCPolicyStaleEgress is the policy removing the
+	// stale egress blocks, see CollectGarbage
+	GCPolicyStaleEgress = "stale_egress"
+)
+
+// GCCandidate is a record which a retention or
+// garbage collection policy would remove
+type GCCandidate struct {
+	// Policy is the name of the policy removing the record
+	Policy string
+	// Key identifies the record within the policy
+	Key string
+	// Reason describes why the record would be removed
+	Reason string
+}
+
+// String returns a human readable description of the record
+func (c *GCCandidate) String() string {
+	return fmt.Sprintf("%s %s: %s", c.Policy, c.Key, c.Reason)
+}
+
+// PreviewRetireSURBKeys returns the SURB keys RetireSURBKeys
+// would erase by the given epoch without erasing them
+func (s *Store) PreviewRetireSURBKeys(epoch uint64) ([]*GCCandidate, error) {
+	candidates := []*GCCandidate{}
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			b, err := EgressBlockFromBytes(v)
+			if err != nil {
+				log.Warningf("skipping undecodable egress block %x: %s", k, err)
+				return nil
+			}
+			if b.SURBKeys == nil || b.SURBEpoch+constants.SURBKeyRetentionEpochs > epoch {
+				return nil
+			}
+			candidates = append(candidates, &GCCandidate{
+				Policy: GCPolicySURBKeys,
+				Key:    blockKey(b),
+				Reason: fmt.Sprintf("SURB of epoch %d expired by epoch %d", b.SURBEpoch, epoch),
+			})
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// PreviewStaleEgressBlocks returns the stale egress blocks
+// CollectGarbage would remove without removing them
+func (s *Store) PreviewStaleEgressBlocks() ([]*GCCandidate, error) {
+	candidates := []*GCCandidate{}
+	transaction := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(EgressBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			b, err := EgressBlockFromBytes(v)
+			if err != nil {
+				log.Warningf("skipping undecodable egress block %x: %s", k, err)
+				return nil
+			}
+			reason := staleEgressReason(tx, k, b, s.now())
+			if reason == "" {
+				return nil
+			}
+			candidates = append(candidates, &GCCandidate{
+				Policy: GCPolicyStaleEgress,
+				Key:    blockKey(b),
+				Reason: reason,
+			})
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
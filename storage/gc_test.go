@@ -0,0 +1,142 @@
+// gc_test.go - garbage collection tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "gc_test")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+
+	putBlock := func(sender string, attempts uint8) {
+		b := EgressBlock{
+			Sender:            sender,
+			SenderProvider:    "acme.com",
+			RecipientProvider: "nsa.gov",
+			SendAttempts:      attempts,
+			SURBKeys:          bytes.Repeat([]byte{1}, surbKeyMaterialLength),
+			SURBEpoch:         10,
+			Priority:          PriorityBulk,
+			Block: block.Block{
+				TotalBlocks: uint16(1),
+				Block:       []byte("Begin at the beginning"),
+			},
+		}
+		_, err := store.PutEgressBlock(&b)
+		require.NoError(err, "unexpected PutEgressBlock() error")
+	}
+	putBlock(account, 1)
+	putBlock(account, constants.MaxSendAttempts)
+	putBlock("mallory@gone.org", 1)
+	err = store.RecordSubmission(account, "retry-1", [constants.MessageIDLength]byte{1})
+	require.NoError(err, "unexpected RecordSubmission() error")
+
+	candidates, err := store.PreviewStaleEgressBlocks()
+	require.NoError(err, "unexpected PreviewStaleEgressBlocks() error")
+	require.Len(candidates, 2)
+	require.Equal(GCPolicyStaleEgress, candidates[0].Policy)
+
+	// nothing expired yet, only the stale blocks are removed
+	report, err := store.CollectGarbage([]string{account}, 12)
+	require.NoError(err, "unexpected CollectGarbage() error")
+	require.Equal(GCReport{EgressBlocks: 2}, *report)
+	blocks, err := store.EgressBlocks()
+	require.NoError(err, "unexpected EgressBlocks() error")
+	require.Len(blocks, 1)
+	require.Equal(account, blocks[0].Sender)
+
+	now = now.Add(SubmissionWindow)
+	report, err = store.CollectGarbage([]string{account}, 13)
+	require.NoError(err, "unexpected CollectGarbage() error")
+	require.Equal(GCReport{SURBKeys: 1, Submissions: 1}, *report)
+	require.Equal(2, report.Total())
+	id, err := store.LookupSubmission(account, "retry-1")
+	require.NoError(err, "unexpected LookupSubmission() error")
+	require.Nil(id)
+
+	report, err = store.CollectGarbage([]string{account}, 14)
+	require.NoError(err, "unexpected CollectGarbage() error")
+	require.Equal(0, report.Total())
+	_, err = store.CollectGarbage([]string{"bob@acme.com"}, 14)
+	require.Error(err, "missing account buckets not detected")
+}
+
+func TestCollectGarbagePendingACK(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "gc_pending_test")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+
+	// the ACK of the last transmission is still awaited
+	b := EgressBlock{
+		Sender:            account,
+		SenderProvider:    "acme.com",
+		RecipientProvider: "nsa.gov",
+		SendAttempts:      constants.MaxSendAttempts,
+		Block: block.Block{
+			TotalBlocks: uint16(1),
+			Block:       []byte("Begin at the beginning"),
+		},
+	}
+	blockID, err := store.PutEgressBlock(&b)
+	require.NoError(err, "unexpected PutEgressBlock() error")
+	err = store.RecordSendIntent(&SendIntent{
+		BlockID:  *blockID,
+		Time:     now,
+		Deadline: now.Add(time.Minute),
+	})
+	require.NoError(err, "unexpected RecordSendIntent() error")
+
+	// undecodable records are skipped
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(EgressBucketName)).Put([]byte("garbage"), []byte{1, 2, 3})
+	})
+	require.NoError(err, "failed to write an undecodable egress block")
+
+	candidates, err := store.PreviewStaleEgressBlocks()
+	require.NoError(err, "unexpected PreviewStaleEgressBlocks() error")
+	require.Len(candidates, 0)
+	report, err := store.CollectGarbage([]string{account}, 12)
+	require.NoError(err, "unexpected CollectGarbage() error")
+	require.Equal(0, report.EgressBlocks)
+
+	now = now.Add(2 * time.Minute)
+	report, err = store.CollectGarbage([]string{account}, 12)
+	require.NoError(err, "unexpected CollectGarbage() error")
+	require.Equal(1, report.EgressBlocks)
+}
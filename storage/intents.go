@@ -0,0 +1,105 @@
+// intents.go - write-ahead journal of the send pipeline
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/coreos/bbolt"
+	sphinxconstants "github.com/katzenpost/core/sphinx/constants"
+)
+
+// SendIntentsBucketName is the name of the boltdb bucket
+// which journals the Blocks handed to a wire session
+const SendIntentsBucketName = "send_intents"
+
+// SendIntent is the write-ahead journal entry of an *EgressBlock
+// which is recorded before the Block is handed to the wire session
+// and cleared once the Block is ACKed or removed. After a crash
+// the Blocks with an intent are possibly sent and those without
+// one were never sent, see proxy.SendScheduler.Recover.
+type SendIntent struct {
+	// BlockID is the ID of the *EgressBlock
+	BlockID [BlockIDLength]byte
+	// SURBID is the ID of the SURB of the ACK
+	SURBID [sphinxconstants.SURBIDLength]byte
+	// Time is the time the Block was handed to the wire session
+	Time time.Time
+	// Deadline is the time by which the ACK is expected
+	Deadline time.Time
+}
+
+// RecordSendIntent records the given intent,
+// replacing the previous intent of the Block
+func (s *Store) RecordSendIntent(intent *SendIntent) error {
+	value, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	transaction := func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(SendIntentsBucketName))
+		if err != nil {
+			return err
+		}
+		return b.Put(intent.BlockID[:], value)
+	}
+	return s.db.Update(transaction)
+}
+
+// ClearSendIntent removes the intent of the given Block, the
+// Block wasn't handed to the wire session after all
+func (s *Store) ClearSendIntent(blockID *[BlockIDLength]byte) error {
+	transaction := func(tx *bolt.Tx) error {
+		return clearSendIntent(tx, blockID[:])
+	}
+	return s.db.Update(transaction)
+}
+
+// clearSendIntent removes the intent of the Block with the given key
+func clearSendIntent(tx *bolt.Tx, key []byte) error {
+	b := tx.Bucket([]byte(SendIntentsBucketName))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+// SendIntents returns the recorded intents keyed by their Block ID
+func (s *Store) SendIntents() (map[[BlockIDLength]byte]*SendIntent, error) {
+	intents := make(map[[BlockIDLength]byte]*SendIntent)
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SendIntentsBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			intent := SendIntent{}
+			err := json.Unmarshal(v, &intent)
+			if err != nil {
+				return err
+			}
+			intents[intent.BlockID] = &intent
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return intents, nil
+}
@@ -0,0 +1,83 @@
+// intents_test.go - send intent journal tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendIntents(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "intents_test")
+	defer cleanup()
+
+	putBlock := func(messageID byte) *EgressBlock {
+		b := EgressBlock{
+			SenderProvider:    "acme.com",
+			RecipientProvider: "nsa.gov",
+			Priority:          PriorityBulk,
+			Block: block.Block{
+				TotalBlocks: uint16(1),
+				Block:       []byte("Begin at the beginning"),
+			},
+		}
+		b.Block.MessageID[0] = messageID
+		blockID, err := store.PutEgressBlock(&b)
+		require.NoError(err, "unexpected PutEgressBlock() error")
+		b.BlockID = *blockID
+		err = store.RecordSendIntent(&SendIntent{
+			BlockID:  b.BlockID,
+			SURBID:   b.SURBID,
+			Time:     time.Unix(1500000000, 0),
+			Deadline: time.Unix(1500000060, 0),
+		})
+		require.NoError(err, "unexpected RecordSendIntent() error")
+		return &b
+	}
+	acked := putBlock(1)
+	failed := putBlock(2)
+	unsent := putBlock(3)
+	purged := putBlock(4)
+
+	intents, err := store.SendIntents()
+	require.NoError(err, "unexpected SendIntents() error")
+	require.Len(intents, 4)
+	require.Equal(time.Unix(1500000060, 0).Unix(), intents[acked.BlockID].Deadline.Unix())
+
+	// the intents are cleared along with their Blocks
+	_, err = store.RemoveEgressBlock(acked)
+	require.NoError(err, "unexpected RemoveEgressBlock() error")
+	err = store.RemoveMessageEgressBlocks(failed.Block.MessageID)
+	require.NoError(err, "unexpected RemoveMessageEgressBlocks() error")
+	err = store.ClearSendIntent(&unsent.BlockID)
+	require.NoError(err, "unexpected ClearSendIntent() error")
+	intents, err = store.SendIntents()
+	require.NoError(err, "unexpected SendIntents() error")
+	require.Len(intents, 1)
+	require.NotNil(intents[purged.BlockID])
+
+	_, err = store.PurgeEgress()
+	require.NoError(err, "unexpected PurgeEgress() error")
+	intents, err = store.SendIntents()
+	require.NoError(err, "unexpected SendIntents() error")
+	require.Len(intents, 0)
+}
@@ -0,0 +1,183 @@
+// journal.go - mailbox change journal
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/coreos/bbolt"
+)
+
+// JournalSize is the maximum number of changes remembered by
+// each account's mailbox journal, once full the oldest changes
+// are evicted first
+const JournalSize = 1 << 14
+
+// ErrJournalTruncated is the error returned when the changes
+// following the requested modification sequence have been
+// evicted from the journal, the mailbox must be fully resynced
+var ErrJournalTruncated = errors.New("mailbox journal truncated, full resync required")
+
+// MailboxOp is the type of a mailbox mutation
+type MailboxOp string
+
+const (
+	// MailboxAdd is the delivery of a message to the mailbox
+	MailboxAdd MailboxOp = "add"
+
+	// MailboxDelete is the deletion of a message from the mailbox
+	MailboxDelete MailboxOp = "delete"
+
+	// MailboxFlags is the change of the flags of a message
+	MailboxFlags MailboxOp = "flags"
+)
+
+// MailboxChange is an entry of the mailbox change journal
+type MailboxChange struct {
+	// ModSeq is the modification sequence of the change,
+	// which increases monotonically per account
+	ModSeq uint64
+
+	// Op is the type of the mutation
+	Op MailboxOp
+
+	// Key is the key of the message in the pop3 bucket
+	Key string
+}
+
+// journalBucketName is the name of the
+// bucket which persists the account's mailbox changes
+var journalBucketName = []byte("journal")
+
+// recordChange appends a change to the account's mailbox journal
+func (s *Store) recordChange(tx *bolt.Tx, accountName string, op MailboxOp, key []byte) error {
+	b := accountBucket(tx, accountName, journalBucketName)
+	if b == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(&MailboxChange{
+		ModSeq: seq,
+		Op:     op,
+		Key:    string(key),
+	})
+	if err != nil {
+		return err
+	}
+	seqKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqKey, seq)
+	err = b.Put(seqKey, value)
+	if err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && seq-binary.BigEndian.Uint64(k) >= s.journalSize; k, _ = c.First() {
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	if s.mailboxObserver != nil {
+		observer := s.mailboxObserver
+		tx.OnCommit(func() {
+			observer(accountName)
+		})
+	}
+	n := Notification{
+		Type:    mailboxNotifications[op],
+		Account: accountName,
+		ModSeq:  seq,
+	}
+	n.Key, _ = strconv.ParseUint(string(key), 10, 64)
+	tx.OnCommit(func() {
+		s.publish(&n)
+	})
+	return nil
+}
+
+// SetMailboxObserver sets a function which is called with the
+// account name after each committed change of an account's pop3
+// mailbox. It's called once the transaction is closed, so it may
+// read the Store but it should return quickly.
+func (s *Store) SetMailboxObserver(observer func(accountName string)) {
+	s.mailboxObserver = observer
+}
+
+// MailboxCount returns the number of messages
+// in the account's pop3 mailbox
+func (s *Store) MailboxCount(accountName string) (int, error) {
+	count := 0
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, pop3BucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		count = b.Stats().KeyN
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Changes returns the account's mailbox changes with a modification
+// sequence greater than since, and the highest modification sequence
+// of the mailbox which is to be passed as since in the next call.
+// ErrJournalTruncated is returned if some of the changes were evicted.
+func (s *Store) Changes(accountName string, since uint64) ([]*MailboxChange, uint64, error) {
+	changes := []*MailboxChange{}
+	highest := uint64(0)
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, journalBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		highest = b.Sequence()
+		if since >= highest {
+			return nil
+		}
+		c := b.Cursor()
+		first, _ := c.First()
+		if first == nil || binary.BigEndian.Uint64(first) > since+1 {
+			return ErrJournalTruncated
+		}
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, since+1)
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			change := MailboxChange{}
+			err := json.Unmarshal(v, &change)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, &change)
+		}
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, 0, err
+	}
+	return changes, highest, nil
+}
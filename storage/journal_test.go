@@ -0,0 +1,72 @@
+// journal_test.go - mailbox change journal tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailboxJournal(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "journal_test1")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	changes, modSeq, err := store.Changes(account, 0)
+	require.NoError(err, "unexpected Changes() error")
+	require.Equal(0, len(changes))
+	require.Equal(uint64(0), modSeq)
+
+	for i := 0; i < 2; i++ {
+		err = store.PutMessage(account, []byte("Subject: hi\n\nhello\n"))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	changes, modSeq, err = store.Changes(account, 0)
+	require.NoError(err, "unexpected Changes() error")
+	require.Equal(2, len(changes))
+	require.Equal(uint64(2), modSeq)
+	require.Equal(MailboxAdd, changes[0].Op)
+	require.Equal("1", changes[0].Key)
+
+	// deleting a missing message isn't a change
+	err = store.DeleteMessages(account, []int{1, 7})
+	require.NoError(err, "unexpected DeleteMessages() error")
+	changes, modSeq, err = store.Changes(account, modSeq)
+	require.NoError(err, "unexpected Changes() error")
+	require.Equal(1, len(changes))
+	require.Equal(uint64(3), modSeq)
+	require.Equal(&MailboxChange{ModSeq: 3, Op: MailboxDelete, Key: "1"}, changes[0])
+
+	changes, _, err = store.Changes(account, modSeq)
+	require.NoError(err, "unexpected Changes() error")
+	require.Equal(0, len(changes))
+
+	store.journalSize = 2
+	err = store.PutMessage(account, []byte("Subject: hi\n\nhello again\n"))
+	require.NoError(err, "unexpected PutMessage() error")
+	_, _, err = store.Changes(account, 1)
+	require.Equal(ErrJournalTruncated, err)
+	changes, modSeq, err = store.Changes(account, 2)
+	require.NoError(err, "unexpected Changes() error")
+	require.Equal(2, len(changes))
+	require.Equal(uint64(4), modSeq)
+}
@@ -0,0 +1,162 @@
+// maildir.go - Maildir message delivery
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+// maildirSubdirs are the directories of a Maildir
+var maildirSubdirs = []string{"tmp", "new", "cur"}
+
+// maildirCounter makes the delivery file names unique
+// within this process
+var maildirCounter uint64
+
+// Maildir delivers messages into a standard Maildir,
+// see https://cr.yp.to/proto/maildir.html
+type Maildir struct {
+	path string
+}
+
+// NewMaildir returns a new *Maildir rooted at the given
+// path, creating the tmp, new and cur directories if needed
+func NewMaildir(path string) (*Maildir, error) {
+	for _, subdir := range maildirSubdirs {
+		err := os.MkdirAll(filepath.Join(path, subdir), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Maildir{path: path}, nil
+}
+
+// uniqueName returns a file name which is unique
+// across deliveries, processes and hosts
+func (m *Maildir) uniqueName(now time.Time) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// '/' and ':' have a special meaning in Maildir file names
+	hostname = strings.Replace(hostname, "/", "\\057", -1)
+	hostname = strings.Replace(hostname, ":", "\\072", -1)
+	counter := atomic.AddUint64(&maildirCounter, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), counter, hostname)
+}
+
+// Deliver writes the message into the tmp directory and then
+// moves it into the new directory once it's safely on disk,
+// so that mail readers never see a partially written message
+func (m *Maildir) Deliver(message []byte) error {
+	return m.DeliverFlagged(message, "")
+}
+
+// DeliverFlagged delivers the message as Deliver but with the
+// given Maildir flags, e.g. "S" for a message which was read.
+// A flagged message is moved into the cur directory instead
+// of the new directory.
+func (m *Maildir) DeliverFlagged(message []byte, flags string) error {
+	name := m.uniqueName(time.Now())
+	tmpPath := filepath.Join(m.path, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(message)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	destination := filepath.Join(m.path, "new", name)
+	if flags != "" {
+		destination = filepath.Join(m.path, "cur", name+":2,"+flags)
+	}
+	err = os.Rename(tmpPath, destination)
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// SetMaildir enables delivery of the received messages into a
+// Maildir per account below the given root directory. The messages
+// are also put into the pop3 bucket if keepPOP3 is true.
+func (s *Store) SetMaildir(root string, keepPOP3 bool) {
+	s.maildirRoot = root
+	s.keepPOP3 = keepPOP3
+}
+
+// deliverToMailbox delivers the message to the account's Maildir
+// and/or pop3 bucket depending on the configuration, or to the
+// folder chosen by the Sorter
+func (s *Store) deliverToMailbox(tx *bolt.Tx, accountName string, message []byte) error {
+	d := s.sort(accountName, message)
+	if d.Discard {
+		return nil
+	}
+	if d.Folder != FolderInbox {
+		_, err := s.putFolderMessage(tx, accountName, d.Folder, message)
+		return err
+	}
+	if s.maildirRoot == "" {
+		return s.putInbox(tx, accountName, message, d.Seen)
+	}
+	if accountBucket(tx, accountName, pop3BucketName) == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	maildir, err := NewMaildir(filepath.Join(s.maildirRoot, accountName))
+	if err != nil {
+		return err
+	}
+	flags := ""
+	if d.Seen {
+		flags = "S"
+	}
+	err = maildir.DeliverFlagged(message, flags)
+	if err != nil {
+		return err
+	}
+	if s.keepPOP3 {
+		return s.putInbox(tx, accountName, message, d.Seen)
+	}
+	return nil
+}
+
+// putInbox puts the message into the account's pop3
+// bucket, marking it as read if seen is true
+func (s *Store) putInbox(tx *bolt.Tx, accountName string, message []byte, seen bool) error {
+	err := s.putMessage(tx, accountName, message)
+	if err != nil || !seen {
+		return err
+	}
+	return s.markSeen(tx, accountName)
+}
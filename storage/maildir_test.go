@@ -0,0 +1,69 @@
+// maildir_test.go - Maildir message delivery tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaildirDelivery(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "maildir_test1")
+	defer cleanup()
+	root, err := ioutil.TempDir("", "maildir_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(root)
+
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	store.SetMaildir(root, false)
+	message := []byte("From: bob@nsa.gov\n\nhello\n")
+	for i := 0; i < 2; i++ {
+		err = store.PutMessage(account, message)
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+
+	tmp, err := ioutil.ReadDir(filepath.Join(root, account, "tmp"))
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(0, len(tmp))
+	delivered, err := ioutil.ReadDir(filepath.Join(root, account, "new"))
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(2, len(delivered))
+	contents, err := ioutil.ReadFile(filepath.Join(root, account, "new", delivered[0].Name()))
+	require.NoError(err, "unexpected ReadFile error")
+	require.Equal(message, contents)
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(0, len(messages))
+
+	store.SetMaildir(root, true)
+	err = store.PutMessage(account, message)
+	require.NoError(err, "unexpected PutMessage() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(1, len(messages))
+
+	err = store.PutMessage("mallory@acme.com", message)
+	require.Error(err, "expected PutMessage() error for unknown account")
+}
@@ -0,0 +1,225 @@
+// metadata.go - metadata of the received messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// MessageIDHeader is the header the client prepends to the
+	// received messages, it's value is the hex encoded mixnet
+	// message ID
+	MessageIDHeader = "X-Mix-Message-Id"
+
+	// BlockCountHeader is the header the client prepends to the
+	// received messages, it's value is the number of Blocks the
+	// message was received in
+	BlockCountHeader = "X-Mix-Block-Count"
+
+	// AuthenticatedSenderHeader is the header the client prepends
+	// to the received messages whose Blocks were encrypted with the
+	// key pinned for the address of their From header, it's value
+	// is that address
+	AuthenticatedSenderHeader = "X-Mix-Authenticated-Sender"
+)
+
+// MessageMetadata is the metadata of a message in the pop3 bucket,
+// it's recorded when the message is delivered so that the mailbox
+// may be listed without reading the messages
+type MessageMetadata struct {
+	// Arrival is the time the message was delivered to the
+	// mailbox, it's zero for messages delivered before the
+	// metadata was recorded
+	Arrival time.Time
+
+	// Size is the size of the message in bytes
+	Size int
+
+	// MessageID is the hex encoded mixnet message ID,
+	// empty for messages generated by the client
+	MessageID string `json:",omitempty"`
+
+	// Blocks is the number of Blocks the message was received in
+	Blocks int `json:",omitempty"`
+
+	// Sender is the authenticated sender's e-mail address,
+	// empty if the sender wasn't authenticated
+	Sender string `json:",omitempty"`
+
+	// Seen is true if the message was marked as read.
+	//
+	// Deprecated: use Flags&FlagSeen, Seen is derived from
+	// the FlagSeen flag and kept in sync with it.
+	Seen bool `json:",omitempty"`
+
+	// Flags are the flags of the message, see SetMessageFlags
+	Flags Flags `json:",omitempty"`
+
+	// Key is the key of the message in the pop3 bucket
+	Key uint64 `json:"-"`
+}
+
+// metadataBucketName is the name of the bucket
+// which persists the metadata of the messages in the pop3 bucket,
+// it uses the same keys
+var metadataBucketName = []byte("meta")
+
+// messageMetadata returns the metadata of a message delivered now,
+// read from the headers the client prepended to it
+func (s *Store) messageMetadata(message []byte) *MessageMetadata {
+	metadata := MessageMetadata{
+		Arrival: s.now(),
+		Size:    len(message),
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return &metadata
+	}
+	metadata.MessageID = m.Header.Get(MessageIDHeader)
+	metadata.Blocks, _ = strconv.Atoi(m.Header.Get(BlockCountHeader))
+	metadata.Sender = strings.ToLower(m.Header.Get(AuthenticatedSenderHeader))
+	return &metadata
+}
+
+// putMetadata records the metadata of the message
+// put into the pop3 bucket with the given key
+func (s *Store) putMetadata(tx *bolt.Tx, accountName string, key, message []byte) error {
+	b := accountBucket(tx, accountName, metadataBucketName)
+	if b == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	value, err := json.Marshal(s.messageMetadata(message))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// markSeen marks the message last put into
+// the account's pop3 bucket as read
+func (s *Store) markSeen(tx *bolt.Tx, accountName string) error {
+	pop3 := accountBucket(tx, accountName, pop3BucketName)
+	if pop3 == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	key := []byte(strconv.FormatUint(pop3.Sequence(), 10))
+	m, err := s.metadata(tx, accountName, key)
+	if err != nil {
+		return err
+	}
+	m.Flags |= FlagSeen
+	return s.putMessageMetadata(tx, accountName, key, m)
+}
+
+// metadata returns the metadata of the message with the given
+// key in the account's pop3 bucket, ErrKeyNotFound if there is
+// no such message
+func (s *Store) metadata(tx *bolt.Tx, accountName string, key []byte) (*MessageMetadata, error) {
+	pop3 := accountBucket(tx, accountName, pop3BucketName)
+	if pop3 == nil {
+		return nil, errors.New("boltdb bucket for that account doesn't exist")
+	}
+	message := pop3.Get(key)
+	if message == nil {
+		return nil, ErrKeyNotFound
+	}
+	m := MessageMetadata{}
+	var value []byte
+	if b := accountBucket(tx, accountName, metadataBucketName); b != nil {
+		value = b.Get(key)
+	}
+	if value == nil {
+		// delivered before the metadata was recorded
+		m.Size = len(message)
+	} else {
+		err := json.Unmarshal(value, &m)
+		if err != nil {
+			return nil, err
+		}
+		if m.Seen {
+			// recorded before the flags
+			m.Flags |= FlagSeen
+		}
+	}
+	m.Seen = m.Flags&FlagSeen != 0
+	m.Key, _ = strconv.ParseUint(string(key), 10, 64)
+	return &m, nil
+}
+
+// putMessageMetadata records the given metadata of the
+// message with the given key in the account's pop3 bucket
+func (s *Store) putMessageMetadata(tx *bolt.Tx, accountName string, key []byte, m *MessageMetadata) error {
+	b := accountBucket(tx, accountName, metadataBucketName)
+	if b == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	m.Seen = m.Flags&FlagSeen != 0
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// MessageMetadata returns the metadata of the messages in the
+// account's pop3 bucket, in the order they're returned by Messages
+func (s *Store) MessageMetadata(accountName string) ([]*MessageMetadata, error) {
+	metadata := []*MessageMetadata{}
+	transaction := func(tx *bolt.Tx) error {
+		pop3 := accountBucket(tx, accountName, pop3BucketName)
+		if pop3 == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		c := pop3.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			m, err := s.metadata(tx, accountName, k)
+			if err != nil {
+				return err
+			}
+			metadata = append(metadata, m)
+		}
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// MailboxStat returns the number and the total size of
+// the messages in the account's pop3 bucket
+func (s *Store) MailboxStat(accountName string) (int, int, error) {
+	metadata, err := s.MessageMetadata(accountName)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := 0
+	for _, m := range metadata {
+		size += m.Size
+	}
+	return len(metadata), size, nil
+}
@@ -0,0 +1,79 @@
+// metadata_test.go - received message metadata tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageMetadata(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "metadata_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	received := []byte(fmt.Sprintf("%s: 0102\n%s: 3\n%s: Bob@nsa.gov\nFrom: bob@nsa.gov\n\nhello\n",
+		MessageIDHeader, BlockCountHeader, AuthenticatedSenderHeader))
+	err = store.PutMessage(account, received)
+	require.NoError(err, "unexpected PutMessage() error")
+	now = now.Add(time.Minute)
+	err = store.PutMessage(account, []byte("From: mixclient\n\nnotice\n"))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	metadata, err := store.MessageMetadata(account)
+	require.NoError(err, "unexpected MessageMetadata() error")
+	require.Equal(2, len(metadata))
+	require.True(metadata[0].Arrival.Equal(time.Unix(1500000000, 0)))
+	require.Equal(len(received), metadata[0].Size)
+	require.Equal("0102", metadata[0].MessageID)
+	require.Equal(3, metadata[0].Blocks)
+	require.Equal("bob@nsa.gov", metadata[0].Sender)
+	require.True(metadata[1].Arrival.Equal(time.Unix(1500000060, 0)))
+	require.Equal("", metadata[1].MessageID)
+	require.Equal("", metadata[1].Sender)
+
+	count, size, err := store.MailboxStat(account)
+	require.NoError(err, "unexpected MailboxStat() error")
+	require.Equal(2, count)
+	require.Equal(len(received)+len("From: mixclient\n\nnotice\n"), size)
+
+	err = store.DeleteMessages(account, []int{1})
+	require.NoError(err, "unexpected DeleteMessages() error")
+	metadata, err = store.MessageMetadata(account)
+	require.NoError(err, "unexpected MessageMetadata() error")
+	require.Equal(1, len(metadata))
+	require.Equal("", metadata[0].MessageID)
+}
@@ -0,0 +1,221 @@
+// pki.go - persisted PKI documents with rollback protection
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// PKIDocumentsBucketName is the name of the boltdb bucket which
+	// persists the accepted PKI documents of the default source
+	// indexed by epoch
+	PKIDocumentsBucketName = "pki_documents"
+
+	// PKISourceDocumentsBucketName is the name of the boltdb bucket
+	// which persists the accepted PKI documents of the other sources
+	// in a nested bucket per source indexed by epoch
+	PKISourceDocumentsBucketName = "pki_source_documents"
+
+	// PKIWatermarkBucketName is the name of the boltdb bucket which
+	// persists the latest epoch of an accepted PKI document of each
+	// source
+	PKIWatermarkBucketName = "pki_watermark"
+
+	// PKIDocumentRetention is the number of epochs preceding
+	// the watermark whose PKI documents are kept
+	PKIDocumentRetention = 2
+
+	// DefaultPKISource is the source of the PKI documents persisted
+	// by PutPKIDocument, see PutSourcePKIDocument
+	DefaultPKISource = ""
+)
+
+// ErrPKIRollback is the error returned when a PKI document is older
+// than the latest one accepted from the same source, e.g. an old
+// consensus is replayed
+var ErrPKIRollback = errors.New("PKI document is older than the latest accepted epoch")
+
+// epochKey returns the bucket key of the given epoch,
+// big endian so that the keys sort by epoch
+func epochKey(epoch uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, epoch)
+	return key
+}
+
+// pkiWatermarkKey returns the key of the epoch high-watermark
+// of the given source in the watermark bucket
+func pkiWatermarkKey(source string) []byte {
+	if source == DefaultPKISource {
+		return []byte("epoch")
+	}
+	return []byte("source/" + source)
+}
+
+// pkiWatermark returns the epoch high-watermark of the
+// given source and false if no PKI document was accepted
+func pkiWatermark(tx *bolt.Tx, source string) (uint64, bool) {
+	b := tx.Bucket([]byte(PKIWatermarkBucketName))
+	if b == nil {
+		return 0, false
+	}
+	value := b.Get(pkiWatermarkKey(source))
+	if len(value) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(value), true
+}
+
+// pkiDocuments returns the bucket of the PKI documents of the given
+// source, or nil if it doesn't exist
+func pkiDocuments(tx *bolt.Tx, source string) *bolt.Bucket {
+	if source == DefaultPKISource {
+		return tx.Bucket([]byte(PKIDocumentsBucketName))
+	}
+	root := tx.Bucket([]byte(PKISourceDocumentsBucketName))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(source))
+}
+
+// createPKIDocuments returns the bucket of the PKI documents
+// of the given source, it's created if it doesn't exist
+func createPKIDocuments(tx *bolt.Tx, source string) (*bolt.Bucket, error) {
+	if source == DefaultPKISource {
+		return tx.CreateBucketIfNotExists([]byte(PKIDocumentsBucketName))
+	}
+	root, err := tx.CreateBucketIfNotExists([]byte(PKISourceDocumentsBucketName))
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists([]byte(source))
+}
+
+// PutPKIDocument persists the accepted serialized PKI document of the
+// given epoch of the default source and raises it's epoch
+// high-watermark. ErrPKIRollback is returned if the epoch precedes
+// the watermark.
+func (s *Store) PutPKIDocument(epoch uint64, document []byte) error {
+	return s.PutSourcePKIDocument(DefaultPKISource, epoch, document)
+}
+
+// PutSourcePKIDocument persists the accepted serialized PKI document
+// of the given epoch and source and raises the epoch high-watermark
+// of the source. ErrPKIRollback is returned if the epoch is strictly
+// older than the watermark of the source, the watermarks of the other
+// sources don't matter.
+func (s *Store) PutSourcePKIDocument(source string, epoch uint64, document []byte) error {
+	transaction := func(tx *bolt.Tx) error {
+		watermark, ok := pkiWatermark(tx, source)
+		if ok && epoch < watermark {
+			return ErrPKIRollback
+		}
+		docs, err := createPKIDocuments(tx, source)
+		if err != nil {
+			return err
+		}
+		err = docs.Put(epochKey(epoch), document)
+		if err != nil {
+			return err
+		}
+		if ok && epoch == watermark {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(PKIWatermarkBucketName))
+		if err != nil {
+			return err
+		}
+		err = b.Put(pkiWatermarkKey(source), epochKey(epoch))
+		if err != nil {
+			return err
+		}
+		c := docs.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k)+PKIDocumentRetention < epoch; k, _ = c.First() {
+			err = docs.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
+
+// PKIDocument returns the persisted serialized PKI document of
+// the given epoch of the default source or nil if there is none
+func (s *Store) PKIDocument(epoch uint64) ([]byte, error) {
+	return s.SourcePKIDocument(DefaultPKISource, epoch)
+}
+
+// SourcePKIDocument returns the persisted serialized PKI document
+// of the given epoch and source or nil if there is none
+func (s *Store) SourcePKIDocument(source string, epoch uint64) ([]byte, error) {
+	var document []byte
+	transaction := func(tx *bolt.Tx) error {
+		b := pkiDocuments(tx, source)
+		if b == nil {
+			return nil
+		}
+		if value := b.Get(epochKey(epoch)); value != nil {
+			document = append([]byte{}, value...)
+		}
+		return nil
+	}
+	err := s.db.View(transaction)
+	return document, err
+}
+
+// PKIEpochWatermark returns the latest epoch of an accepted PKI
+// document of the default source and false if none was accepted
+func (s *Store) PKIEpochWatermark() (uint64, bool, error) {
+	return s.SourcePKIEpochWatermark(DefaultPKISource)
+}
+
+// SourcePKIEpochWatermark returns the latest epoch of an accepted
+// PKI document of the given source and false if none was accepted
+func (s *Store) SourcePKIEpochWatermark(source string) (uint64, bool, error) {
+	var watermark uint64
+	var ok bool
+	transaction := func(tx *bolt.Tx) error {
+		watermark, ok = pkiWatermark(tx, source)
+		return nil
+	}
+	err := s.db.View(transaction)
+	return watermark, ok, err
+}
+
+// ResetPKIEpochWatermark forgets the epoch high-watermarks and the
+// persisted PKI documents of all the sources, e.g. after the clock
+// was found to be far ahead, so that the documents of earlier epochs
+// are accepted again
+func (s *Store) ResetPKIEpochWatermark() error {
+	transaction := func(tx *bolt.Tx) error {
+		for _, name := range []string{PKIWatermarkBucketName, PKIDocumentsBucketName, PKISourceDocumentsBucketName} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
@@ -0,0 +1,117 @@
+// pki_test.go - persisted PKI document tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPKIDocuments(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "pki_test")
+	defer cleanup()
+
+	_, ok, err := store.PKIEpochWatermark()
+	require.NoError(err, "unexpected PKIEpochWatermark() error")
+	require.False(ok)
+	for epoch := uint64(10); epoch <= 14; epoch++ {
+		err = store.PutPKIDocument(epoch, []byte{byte(epoch)})
+		require.NoError(err, "unexpected PutPKIDocument() error")
+	}
+	watermark, ok, err := store.PKIEpochWatermark()
+	require.NoError(err, "unexpected PKIEpochWatermark() error")
+	require.True(ok)
+	require.Equal(uint64(14), watermark)
+
+	// an old consensus is refused
+	err = store.PutPKIDocument(13, []byte{42})
+	require.Equal(ErrPKIRollback, err)
+	document, err := store.PKIDocument(13)
+	require.NoError(err, "unexpected PKIDocument() error")
+	require.Equal([]byte{13}, document)
+	err = store.PutPKIDocument(14, []byte{14})
+	require.NoError(err, "the document of the latest epoch was refused")
+
+	// the documents preceding the retention are pruned
+	document, err = store.PKIDocument(12)
+	require.NoError(err, "unexpected PKIDocument() error")
+	require.Equal([]byte{12}, document)
+	document, err = store.PKIDocument(11)
+	require.NoError(err, "unexpected PKIDocument() error")
+	require.Nil(document)
+
+	err = store.ResetPKIEpochWatermark()
+	require.NoError(err, "unexpected ResetPKIEpochWatermark() error")
+	_, ok, err = store.PKIEpochWatermark()
+	require.NoError(err, "unexpected PKIEpochWatermark() error")
+	require.False(ok)
+	err = store.PutPKIDocument(3, []byte{3})
+	require.NoError(err, "the watermark was not reset")
+}
+
+func TestSourcePKIDocuments(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "pki_test2")
+	defer cleanup()
+
+	for epoch := uint64(10); epoch <= 14; epoch++ {
+		err := store.PutSourcePKIDocument("a", epoch, []byte{byte(epoch)})
+		require.NoError(err, "unexpected PutSourcePKIDocument() error")
+	}
+	watermark, ok, err := store.SourcePKIEpochWatermark("a")
+	require.NoError(err, "unexpected SourcePKIEpochWatermark() error")
+	require.True(ok)
+	require.Equal(uint64(14), watermark)
+	err = store.PutSourcePKIDocument("a", 13, []byte{42})
+	require.Equal(ErrPKIRollback, err)
+
+	// the watermark is kept per source
+	_, ok, err = store.PKIEpochWatermark()
+	require.NoError(err, "unexpected PKIEpochWatermark() error")
+	require.False(ok, "the watermark of another source was applied to the default one")
+	err = store.PutPKIDocument(13, []byte{13})
+	require.NoError(err, "the watermark of another source was applied")
+	err = store.PutSourcePKIDocument("b", 12, []byte{12})
+	require.NoError(err, "the watermark of another source was applied")
+	document, err := store.SourcePKIDocument("b", 12)
+	require.NoError(err, "unexpected SourcePKIDocument() error")
+	require.Equal([]byte{12}, document)
+	document, err = store.SourcePKIDocument("b", 14)
+	require.NoError(err, "unexpected SourcePKIDocument() error")
+	require.Nil(document)
+	document, err = store.SourcePKIDocument(DefaultPKISource, 13)
+	require.NoError(err, "unexpected SourcePKIDocument() error")
+	require.Equal([]byte{13}, document)
+
+	// the documents preceding the retention are pruned
+	document, err = store.SourcePKIDocument("a", 11)
+	require.NoError(err, "unexpected SourcePKIDocument() error")
+	require.Nil(document)
+
+	err = store.ResetPKIEpochWatermark()
+	require.NoError(err, "unexpected ResetPKIEpochWatermark() error")
+	_, ok, err = store.SourcePKIEpochWatermark("a")
+	require.NoError(err, "unexpected SourcePKIEpochWatermark() error")
+	require.False(ok)
+	document, err = store.SourcePKIDocument("a", 14)
+	require.NoError(err, "unexpected SourcePKIDocument() error")
+	require.Nil(document)
+}
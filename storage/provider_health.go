@@ -0,0 +1,260 @@
+// provider_health.go - Provider connection health scoring
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// ProviderHealthBucketName is the name of the boltdb bucket which
+	// persists the connection health of each Provider endpoint
+	ProviderHealthBucketName = "provider_health"
+
+	// rttWeight is the weight of the latest sample
+	// in the moving average of the handshake RTT
+	rttWeight = 0.2
+)
+
+// ProviderHealth is the connection health of a Provider endpoint
+type ProviderHealth struct {
+	// Provider is the name of the Provider
+	Provider string
+
+	// Endpoint is the address of the endpoint
+	Endpoint string
+
+	// Handshakes is the number of successful handshakes
+	Handshakes uint64
+
+	// HandshakeFailures is the number of failed connection attempts
+	HandshakeFailures uint64
+
+	// Disconnects is the number of established sessions which failed
+	Disconnects uint64
+
+	// RTT is the moving average of the handshake round trip time
+	RTT time.Duration
+
+	// LastSeen is the time of the last successful handshake
+	LastSeen time.Time
+
+	// Current is true if the last session
+	// with the Provider used this endpoint
+	Current bool
+}
+
+// Score returns the health score of the endpoint between 0 and 1,
+// higher is healthier. Endpoints without history score 0.5 so that
+// they are tried before endpoints which keep failing.
+func (h *ProviderHealth) Score() float64 {
+	attempts := float64(h.Handshakes + h.HandshakeFailures)
+	successRate := (float64(h.Handshakes) + 1) / (attempts + 2)
+	stability := 1 / (1 + float64(h.Disconnects)/(float64(h.Handshakes)+1))
+	latency := 1 / (1 + h.RTT.Seconds())
+	return successRate * stability * latency
+}
+
+// String returns a one line status summary of the endpoint
+func (h *ProviderHealth) String() string {
+	current := ""
+	if h.Current {
+		current = " (current)"
+	}
+	return fmt.Sprintf("%s %s%s score %.2f handshakes %d failures %d disconnects %d rtt %s",
+		h.Provider, h.Endpoint, current, h.Score(), h.Handshakes, h.HandshakeFailures, h.Disconnects, h.RTT)
+}
+
+// providerHealthKey returns the bucket key of the given endpoint
+func providerHealthKey(provider, endpoint string) []byte {
+	return []byte(strings.ToLower(provider) + "\x00" + endpoint)
+}
+
+// updateProviderHealth applies the given update
+// function to the persisted health of the endpoint
+func (s *Store) updateProviderHealth(provider, endpoint string, update func(*ProviderHealth)) error {
+	transaction := func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ProviderHealthBucketName))
+		if err != nil {
+			return err
+		}
+		key := providerHealthKey(provider, endpoint)
+		h := ProviderHealth{
+			Provider: strings.ToLower(provider),
+			Endpoint: endpoint,
+		}
+		if raw := b.Get(key); raw != nil {
+			err = json.Unmarshal(raw, &h)
+			if err != nil {
+				return err
+			}
+		}
+		update(&h)
+		if h.Current {
+			// only one endpoint per Provider is current
+			prefix := providerHealthKey(provider, "")
+			c := b.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if bytes.Equal(k, key) {
+					continue
+				}
+				other := ProviderHealth{}
+				err = json.Unmarshal(v, &other)
+				if err != nil {
+					return err
+				}
+				if !other.Current {
+					continue
+				}
+				other.Current = false
+				raw, err := json.Marshal(&other)
+				if err != nil {
+					return err
+				}
+				err = b.Put(k, raw)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		raw, err := json.Marshal(&h)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, raw)
+	}
+	return s.db.Update(transaction)
+}
+
+// RecordHandshake records the outcome of a connection attempt to
+// the given Provider endpoint, a successful handshake makes it the
+// Provider's current endpoint
+func (s *Store) RecordHandshake(provider, endpoint string, rtt time.Duration, handshakeErr error) error {
+	return s.updateProviderHealth(provider, endpoint, func(h *ProviderHealth) {
+		if handshakeErr != nil {
+			h.HandshakeFailures++
+			return
+		}
+		if h.Handshakes == 0 {
+			h.RTT = rtt
+		} else {
+			h.RTT = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(h.RTT))
+		}
+		h.Handshakes++
+		h.LastSeen = s.now()
+		h.Current = true
+	})
+}
+
+// RecordDisconnect records the failure of the
+// session with the Provider's current endpoint
+func (s *Store) RecordDisconnect(provider string) error {
+	health, err := s.ProviderHealth(provider)
+	if err != nil {
+		return err
+	}
+	for _, h := range health {
+		if h.Current {
+			return s.updateProviderHealth(provider, h.Endpoint, func(h *ProviderHealth) {
+				h.Disconnects++
+			})
+		}
+	}
+	return nil
+}
+
+// ProviderHealth returns the health of the endpoints of the given
+// Provider, or of all the Providers if provider is empty, sorted by
+// Provider and decreasing score
+func (s *Store) ProviderHealth(provider string) ([]*ProviderHealth, error) {
+	health := []*ProviderHealth{}
+	transaction := func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ProviderHealthBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if provider != "" && !bytes.HasPrefix(k, providerHealthKey(provider, "")) {
+				return nil
+			}
+			h := ProviderHealth{}
+			err := json.Unmarshal(v, &h)
+			if err != nil {
+				return err
+			}
+			health = append(health, &h)
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(health, func(i, j int) bool {
+		if health[i].Provider != health[j].Provider {
+			return health[i].Provider < health[j].Provider
+		}
+		return health[i].Score() > health[j].Score()
+	})
+	return health, nil
+}
+
+// RankEndpoints returns the given endpoints of the Provider
+// sorted by decreasing health score, endpoints without history
+// keep their relative order
+func (s *Store) RankEndpoints(provider string, endpoints []string) ([]string, error) {
+	health, err := s.ProviderHealth(provider)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]float64)
+	for _, h := range health {
+		scores[h.Endpoint] = h.Score()
+	}
+	score := func(endpoint string) float64 {
+		if s, ok := scores[endpoint]; ok {
+			return s
+		}
+		return (&ProviderHealth{}).Score()
+	}
+	ranked := append([]string{}, endpoints...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return score(ranked[i]) > score(ranked[j])
+	})
+	return ranked, nil
+}
+
+// ProviderStatus returns a human readable status
+// summary of all the known Provider endpoints
+func (s *Store) ProviderStatus() (string, error) {
+	health, err := s.ProviderHealth("")
+	if err != nil {
+		return "", err
+	}
+	status := new(bytes.Buffer)
+	for _, h := range health {
+		fmt.Fprintln(status, h.String())
+	}
+	return status.String(), nil
+}
@@ -0,0 +1,71 @@
+// provider_health_test.go - Provider connection health scoring tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderHealth(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "provider_health_test1")
+	defer cleanup()
+
+	endpoints := []string{"10.0.0.1:29483", "10.0.0.2:29483", "10.0.0.3:29483"}
+	ranked, err := store.RankEndpoints("acme.com", endpoints)
+	require.NoError(err, "unexpected RankEndpoints() error")
+	require.Equal(endpoints, ranked, "endpoints without history must keep their order")
+
+	for i := 0; i < 3; i++ {
+		err = store.RecordHandshake("acme.com", endpoints[0], 0, errors.New("connection refused"))
+		require.NoError(err, "unexpected RecordHandshake() error")
+	}
+	err = store.RecordHandshake("acme.com", endpoints[1], 100*time.Millisecond, nil)
+	require.NoError(err, "unexpected RecordHandshake() error")
+	err = store.RecordHandshake("acme.com", endpoints[2], 100*time.Millisecond, nil)
+	require.NoError(err, "unexpected RecordHandshake() error")
+	err = store.RecordDisconnect("acme.com")
+	require.NoError(err, "unexpected RecordDisconnect() error")
+	err = store.RecordHandshake("nsa.gov", "10.1.0.1:29483", time.Second, nil)
+	require.NoError(err, "unexpected RecordHandshake() error")
+
+	ranked, err = store.RankEndpoints("acme.com", endpoints)
+	require.NoError(err, "unexpected RankEndpoints() error")
+	require.Equal([]string{endpoints[1], endpoints[2], endpoints[0]}, ranked)
+
+	health, err := store.ProviderHealth("acme.com")
+	require.NoError(err, "unexpected ProviderHealth() error")
+	require.Equal(3, len(health))
+	require.Equal(endpoints[1], health[0].Endpoint)
+	require.False(health[0].Current)
+	require.Equal(endpoints[2], health[1].Endpoint)
+	require.True(health[1].Current)
+	require.Equal(uint64(1), health[1].Disconnects)
+	require.Equal(uint64(3), health[2].HandshakeFailures)
+
+	status, err := store.ProviderStatus()
+	require.NoError(err, "unexpected ProviderStatus() error")
+	lines := strings.Split(strings.TrimSpace(status), "\n")
+	require.Equal(4, len(lines))
+	require.True(strings.HasPrefix(lines[3], "nsa.gov 10.1.0.1:29483 (current)"))
+}
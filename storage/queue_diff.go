@@ -0,0 +1,158 @@
+// queue_diff.go - egress queue snapshot comparison
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// QueueDiffEntry describes the change of
+// a single Block between two queue snapshots
+type QueueDiffEntry struct {
+	// Key identifies the Block as message ID:block ID
+	Key string
+
+	// Sender is the sender identity of the Block
+	Sender string
+
+	// Recipient is the recipient identity of the Block
+	Recipient string
+
+	// OldAttempts is the number of send attempts in the
+	// first snapshot, zero if the Block was added
+	OldAttempts uint8
+
+	// NewAttempts is the number of send attempts in the
+	// second snapshot, zero if the Block was removed
+	NewAttempts uint8
+}
+
+// QueueDiff is the difference between the egress
+// queues of two client state snapshots
+type QueueDiff struct {
+	// Added are the Blocks queued after the first snapshot
+	Added []QueueDiffEntry
+
+	// Acked are the Blocks removed from the queue
+	// before reaching the maximum send attempts
+	Acked []QueueDiffEntry
+
+	// GivenUp are the Blocks removed from the queue
+	// after reaching the maximum send attempts
+	GivenUp []QueueDiffEntry
+
+	// Retried are the Blocks which were retransmitted
+	// between the two snapshots
+	Retried []QueueDiffEntry
+}
+
+// queueEntries returns the egress Blocks of the
+// given snapshot as entries keyed by blockKey
+func queueEntries(a *Archive) (map[string]QueueDiffEntry, error) {
+	entries := make(map[string]QueueDiffEntry)
+	for _, raw := range a.Egress {
+		b, err := EgressBlockFromBytes(raw)
+		if err != nil {
+			return nil, err
+		}
+		key := blockKey(b)
+		entries[key] = QueueDiffEntry{
+			Key:         key,
+			Sender:      b.Sender,
+			Recipient:   b.Recipient,
+			NewAttempts: b.SendAttempts,
+		}
+	}
+	return entries, nil
+}
+
+// sortEntries sorts the entries by key so that
+// reports are stable across invocations
+func sortEntries(entries []QueueDiffEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+}
+
+// DiffQueues compares the egress queues of two snapshots,
+// the first one being the oldest. Blocks which are gone from the
+// second snapshot are reported as given up if they have reached
+// the maximum send attempts and as ACKed otherwise.
+func DiffQueues(first, second *Archive) (*QueueDiff, error) {
+	oldEntries, err := queueEntries(first)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := queueEntries(second)
+	if err != nil {
+		return nil, err
+	}
+	diff := QueueDiff{}
+	for key, entry := range newEntries {
+		oldEntry, ok := oldEntries[key]
+		if !ok {
+			diff.Added = append(diff.Added, entry)
+			continue
+		}
+		if entry.NewAttempts > oldEntry.NewAttempts {
+			entry.OldAttempts = oldEntry.NewAttempts
+			diff.Retried = append(diff.Retried, entry)
+		}
+	}
+	for key, entry := range oldEntries {
+		if _, ok := newEntries[key]; ok {
+			continue
+		}
+		entry.OldAttempts = entry.NewAttempts
+		entry.NewAttempts = 0
+		if entry.OldAttempts >= constants.MaxSendAttempts {
+			diff.GivenUp = append(diff.GivenUp, entry)
+		} else {
+			diff.Acked = append(diff.Acked, entry)
+		}
+	}
+	sortEntries(diff.Added)
+	sortEntries(diff.Acked)
+	sortEntries(diff.GivenUp)
+	sortEntries(diff.Retried)
+	return &diff, nil
+}
+
+// String returns a human readable report of the queue changes
+func (d *QueueDiff) String() string {
+	report := new(bytes.Buffer)
+	sections := []struct {
+		title   string
+		entries []QueueDiffEntry
+	}{
+		{"added", d.Added},
+		{"acked", d.Acked},
+		{"given up", d.GivenUp},
+		{"retried", d.Retried},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(report, "%s: %d\n", section.title, len(section.entries))
+		for _, e := range section.entries {
+			fmt.Fprintf(report, "  %s %s -> %s attempts %d -> %d\n", e.Key, e.Sender, e.Recipient, e.OldAttempts, e.NewAttempts)
+		}
+	}
+	return report.String()
+}
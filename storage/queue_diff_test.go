@@ -0,0 +1,80 @@
+// queue_diff_test.go - egress queue snapshot comparison tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffQueues(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "queue_diff_test1")
+	defer cleanup()
+
+	newBlock := func(messageID byte) *EgressBlock {
+		b := EgressBlock{
+			Sender:    "alice@acme.com",
+			Recipient: "bob@nsa.gov",
+			Block: block.Block{
+				TotalBlocks: uint16(1),
+				Block:       []byte("queued"),
+			},
+		}
+		b.Block.MessageID[0] = messageID
+		blockID, err := store.PutEgressBlock(&b)
+		require.NoError(err, "unexpected PutEgressBlock() error")
+		b.BlockID = *blockID
+		return &b
+	}
+	acked := newBlock(1)
+	givenUp := newBlock(2)
+	retried := newBlock(3)
+	givenUp.SendAttempts = constants.MaxSendAttempts
+	err := store.Update(&givenUp.BlockID, givenUp)
+	require.NoError(err, "unexpected Update() error")
+	first, err := store.Export()
+	require.NoError(err, "unexpected Export() error")
+
+	_, err = store.RemoveEgressBlock(acked)
+	require.NoError(err, "unexpected RemoveEgressBlock() error")
+	_, err = store.RemoveEgressBlock(givenUp)
+	require.NoError(err, "unexpected RemoveEgressBlock() error")
+	retried.SendAttempts = 2
+	err = store.Update(&retried.BlockID, retried)
+	require.NoError(err, "unexpected Update() error")
+	newBlock(4)
+	second, err := store.Export()
+	require.NoError(err, "unexpected Export() error")
+
+	diff, err := DiffQueues(first, second)
+	require.NoError(err, "unexpected DiffQueues() error")
+	require.Equal(1, len(diff.Added))
+	require.Equal(1, len(diff.Acked))
+	require.Equal(blockKey(acked), diff.Acked[0].Key)
+	require.Equal(1, len(diff.GivenUp))
+	require.Equal(blockKey(givenUp), diff.GivenUp[0].Key)
+	require.Equal(1, len(diff.Retried))
+	require.Equal(uint8(0), diff.Retried[0].OldAttempts)
+	require.Equal(uint8(2), diff.Retried[0].NewAttempts)
+	require.True(strings.Contains(diff.String(), "given up: 1\n"))
+}
@@ -0,0 +1,115 @@
+// quota.go - mailbox size and pending messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// PendingMessage describes a message whose
+// Blocks are held in the account's ingress bucket
+type PendingMessage struct {
+	// MessageID is the ID of the message
+	MessageID [constants.MessageIDLength]byte
+	// TotalBlocks is the number of Blocks of the message
+	TotalBlocks uint16
+	// Blocks is the number of distinct Blocks received
+	Blocks int
+	// Size is the number of bytes of the received Blocks
+	Size int
+}
+
+// Complete returns true if all the Blocks of the message were received
+func (p *PendingMessage) Complete() bool {
+	return p.Blocks == int(p.TotalBlocks)
+}
+
+// MailboxSize returns the number of bytes of the
+// messages in the account's mailbox
+func (s *Store) MailboxSize(accountName string) (int, error) {
+	size := 0
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, pop3BucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			size += len(v)
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	return size, err
+}
+
+// PendingMessages returns the messages whose Blocks are held in the
+// account's ingress bucket, sorted by increasing size
+func (s *Store) PendingMessages(accountName string) ([]*PendingMessage, error) {
+	messages := make(map[[constants.MessageIDLength]byte]*PendingMessage)
+	seen := make(map[[constants.MessageIDLength]byte]map[uint16]bool)
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, ingressBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		// the payloads aren't kept, the Blocks
+		// are decoded into the same IngressBlock
+		ingressBlock := new(IngressBlock)
+		return b.ForEach(func(k, v []byte) error {
+			err := ingressBlock.UnmarshalBinary(v)
+			if err != nil {
+				return err
+			}
+			id := ingressBlock.Block.MessageID
+			m, ok := messages[id]
+			if !ok {
+				m = &PendingMessage{
+					MessageID:   id,
+					TotalBlocks: ingressBlock.Block.TotalBlocks,
+				}
+				messages[id] = m
+				seen[id] = make(map[uint16]bool)
+			}
+			if seen[id][ingressBlock.Block.BlockID] {
+				return nil
+			}
+			seen[id][ingressBlock.Block.BlockID] = true
+			m.Blocks++
+			m.Size += len(ingressBlock.Block.Block)
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	pending := []*PendingMessage{}
+	for _, m := range messages {
+		pending = append(pending, m)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Size != pending[j].Size {
+			return pending[i].Size < pending[j].Size
+		}
+		return string(pending[i].MessageID[:]) < string(pending[j].MessageID[:])
+	})
+	return pending, nil
+}
@@ -0,0 +1,198 @@
+// read_only.go - read only Store for external tooling
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// readOnlyLockTimeout is how long OpenReadOnly waits for
+	// the shared lock of the database before falling back
+	// to a snapshot
+	readOnlyLockTimeout = 500 * time.Millisecond
+
+	// snapshotAttempts is the number of snapshots OpenReadOnly
+	// takes before giving up if each of them is inconsistent
+	snapshotAttempts = 3
+)
+
+// OpenReadOnly opens the Store database in read only mode for
+// diagnostic tools, backup scripts and mailbox browsers, all the
+// modifications fail with bolt.ErrDatabaseReadOnly.
+//
+// While the database is held open for writing, by the client for
+// example, bolt doesn't grant the lock required to read it. Instead
+// a snapshot of the database is written next to it and opened, see
+// snapshotFile. It reflects the database at the time OpenReadOnly was
+// called. The snapshot file is unlinked as soon as it's open, so that
+// no copy of the database is left on disk, even if the process dies.
+func OpenReadOnly(dbFile string) (*Store, error) {
+	s := Store{
+		replayCacheSize: ReplayCacheSize,
+		eventLogSize:    EventLogSize,
+		journalSize:     JournalSize,
+		now:             time.Now,
+	}
+	var err error
+	s.db, err = bolt.Open(dbFile, 0600, &bolt.Options{ReadOnly: true, Timeout: readOnlyLockTimeout})
+	if err == nil {
+		return &s, nil
+	}
+	if err != bolt.ErrTimeout {
+		return nil, err
+	}
+	s.snapshot = true
+	for i := 0; i < snapshotAttempts; i++ {
+		var snapshot string
+		snapshot, err = snapshotFile(dbFile)
+		if err != nil {
+			return nil, err
+		}
+		s.db, err = bolt.Open(snapshot, 0600, &bolt.Options{ReadOnly: true, Timeout: readOnlyLockTimeout})
+		removeErr := os.Remove(snapshot)
+		if err == nil && removeErr != nil {
+			s.db.Close()
+			return nil, removeErr
+		}
+		if err == nil {
+			err = s.db.View(checkTx)
+			if err == nil {
+				return &s, nil
+			}
+			s.db.Close()
+		}
+		// the database was modified while it was
+		// being copied, try again
+	}
+	return nil, fmt.Errorf("failed to take a consistent snapshot of %s: %s", dbFile, err)
+}
+
+// openStores are the Stores of this process which hold their
+// database open for writing, by path, see snapshotFile
+var openStores = struct {
+	sync.Mutex
+	byPath map[string]*Store
+}{byPath: make(map[string]*Store)}
+
+// registerStore records the given Store as the writer of it's
+// database file, so that the snapshots are taken through it
+func registerStore(s *Store) {
+	path, err := filepath.Abs(s.db.Path())
+	if err != nil {
+		return
+	}
+	openStores.Lock()
+	defer openStores.Unlock()
+	openStores.byPath[path] = s
+}
+
+// unregisterStore forgets the given Store, see registerStore
+func unregisterStore(s *Store) {
+	openStores.Lock()
+	defer openStores.Unlock()
+	for path, store := range openStores.byPath {
+		if store == s {
+			delete(openStores.byPath, path)
+		}
+	}
+}
+
+// snapshotFile writes a snapshot of the given database file to a
+// temporary file in the same directory and returns it's name.
+//
+// If the database is held open by a Store of this process the
+// snapshot is written with tx.WriteTo in a read transaction, so it's
+// consistent. Otherwise the file is copied and the copy is refused
+// if the database was modified meanwhile, the copy can be torn by a
+// concurrent write.
+func snapshotFile(dbFile string) (string, error) {
+	path, err := filepath.Abs(dbFile)
+	if err != nil {
+		return "", err
+	}
+	openStores.Lock()
+	writer := openStores.byPath[path]
+	openStores.Unlock()
+	out, err := ioutil.TempFile(filepath.Dir(dbFile), filepath.Base(dbFile)+".snapshot")
+	if err != nil {
+		return "", err
+	}
+	if writer != nil {
+		err = writer.db.View(func(tx *bolt.Tx) error {
+			_, err := tx.WriteTo(out)
+			return err
+		})
+	} else {
+		err = copyFile(out, dbFile)
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// copyFile copies the given database file to out, an error is
+// returned if the database was modified while it was being copied
+func copyFile(out io.Writer, dbFile string) error {
+	in, err := os.Open(dbFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	before, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(dbFile)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(before, after) || before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		return fmt.Errorf("%s was modified while it was being copied", dbFile)
+	}
+	return nil
+}
+
+// checkTx returns the first consistency error of the database
+func checkTx(tx *bolt.Tx) error {
+	var first error
+	for err := range tx.Check() {
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,96 @@
+// read_only_test.go - read only Store tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/bbolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "read_only_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "client.db")
+	store, err := New(dbFile)
+	require.NoError(err, "unexpected New() error")
+	err = store.CreateAccountBuckets([]string{"alice@acme.com"})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutMessage("alice@acme.com", []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	// the writer holds the lock, so a snapshot is opened
+	readOnly, err := OpenReadOnly(dbFile)
+	require.NoError(err, "unexpected OpenReadOnly() error")
+	require.True(readOnly.snapshot)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(1, len(files), "the snapshot was left on disk")
+	messages, err := readOnly.Messages("alice@acme.com")
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(1, len(messages))
+	err = readOnly.PutMessage("alice@acme.com", []byte("hello again"))
+	require.Equal(bolt.ErrDatabaseReadOnly, err)
+	require.Error(readOnly.CheckWritable(), "read only database reported writable")
+	require.NoError(store.CheckWritable(), "unexpected CheckWritable() error")
+	err = readOnly.Close()
+	require.NoError(err, "unexpected Close() error")
+
+	err = store.Close()
+	require.NoError(err, "unexpected Close() error")
+	readOnly, err = OpenReadOnly(dbFile)
+	require.NoError(err, "unexpected OpenReadOnly() error")
+	require.False(readOnly.snapshot)
+	err = readOnly.Close()
+	require.NoError(err, "unexpected Close() error")
+}
+
+func TestOpenReadOnlyCopy(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "read_only_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "client.db")
+	store, err := New(dbFile)
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+	err = store.CreateAccountBuckets([]string{"alice@acme.com"})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	err = store.PutMessage("alice@acme.com", []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	// the database held by another process is copied
+	unregisterStore(store)
+	readOnly, err := OpenReadOnly(dbFile)
+	require.NoError(err, "unexpected OpenReadOnly() error")
+	defer readOnly.Close()
+	require.True(readOnly.snapshot)
+	messages, err := readOnly.Messages("alice@acme.com")
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(1, len(messages))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err, "unexpected ReadDir error")
+	require.Equal(1, len(files), "the snapshot was left on disk")
+}
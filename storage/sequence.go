@@ -0,0 +1,245 @@
+// sequence.go - in order delivery of conversations
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+const (
+	// SequenceHeader is the message header carrying the sequence
+	// number of a message within a conversation. Sequence numbers
+	// start at 1 for each sender and recipient pair.
+	SequenceHeader = "X-Mix-Sequence"
+
+	// SequenceGapHeader is the message header which is prepended to
+	// a message that was delivered after giving up waiting for the
+	// preceding messages of the conversation. It's value is the
+	// range of missing sequence numbers.
+	SequenceGapHeader = "X-Mix-Sequence-Gap"
+)
+
+// sequenceBucketName is the name of the bucket
+// which persists the account's outgoing and expected incoming
+// sequence numbers per correspondent
+var sequenceBucketName = []byte("sequence")
+
+// heldBucketName is the name of the bucket which
+// persists out of order messages held back from the pop3 bucket
+var heldBucketName = []byte("held")
+
+// sequenceKey returns the sequence bucket key for the given
+// direction, "in" or "out", and correspondent
+func sequenceKey(direction, peer string) []byte {
+	return []byte(fmt.Sprintf("%s\x00%s", direction, strings.ToLower(peer)))
+}
+
+// heldKeyPrefix returns the held bucket key prefix of
+// all the held messages of the given correspondent
+func heldKeyPrefix(peer string) []byte {
+	return []byte(fmt.Sprintf("%s\x00", strings.ToLower(peer)))
+}
+
+// heldKey returns the held bucket key of a message, the sequence
+// number is big endian encoded so that held messages are sorted
+func heldKey(peer string, seq uint64) []byte {
+	key := heldKeyPrefix(peer)
+	seqBytes := [8]byte{}
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	return append(key, seqBytes[:]...)
+}
+
+// getSequence returns the sequence number stored under the given key
+// or the first sequence number of a conversation if there is none
+func getSequence(b *bolt.Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if v == nil {
+		return 1
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// putSequence stores the sequence number under the given key
+func putSequence(b *bolt.Bucket, key []byte, seq uint64) error {
+	v := [8]byte{}
+	binary.BigEndian.PutUint64(v[:], seq)
+	return b.Put(key, v[:])
+}
+
+// parseSequence returns the sender and the sequence number of the given
+// message, ok is false if the message doesn't carry a sequence number
+func parseSequence(message []byte) (sender string, seq uint64, ok bool) {
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return "", 0, false
+	}
+	value := m.Header.Get(SequenceHeader)
+	if value == "" {
+		return "", 0, false
+	}
+	seq, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil || seq == 0 {
+		return "", 0, false
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToLower(from.Address), seq, true
+}
+
+// SetOrdering enables in order delivery of conversations. Messages
+// carrying a SequenceHeader which arrive out of order are held back
+// for at most holdDuration waiting for the preceding messages, after
+// which they are delivered with a SequenceGapHeader.
+func (s *Store) SetOrdering(holdDuration time.Duration) {
+	s.ordering = true
+	s.holdDuration = holdDuration
+}
+
+// NextOutgoingSequence returns the sequence number to use for the
+// next message sent from the given account to the given recipient
+func (s *Store) NextOutgoingSequence(accountName, recipient string) (uint64, error) {
+	seq := uint64(0)
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, sequenceBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		key := sequenceKey("out", recipient)
+		seq = getSequence(b, key)
+		return putSequence(b, key, seq+1)
+	}
+	err := s.db.Update(transaction)
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// deliverMessage puts the message into the account's mailbox
+// unless ordering is enabled and the message arrived before some of
+// the preceding messages of its conversation, in which case it's held
+// back until they arrive or until the hold duration expires.
+func (s *Store) deliverMessage(tx *bolt.Tx, accountName string, message []byte) error {
+	if !s.ordering {
+		return s.deliverToMailbox(tx, accountName, message)
+	}
+	peer, seq, ok := parseSequence(message)
+	if !ok {
+		return s.deliverToMailbox(tx, accountName, message)
+	}
+	sequences := accountBucket(tx, accountName, sequenceBucketName)
+	held := accountBucket(tx, accountName, heldBucketName)
+	if sequences == nil || held == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	expected := getSequence(sequences, sequenceKey("in", peer))
+	if seq > expected {
+		arrival := [8]byte{}
+		binary.BigEndian.PutUint64(arrival[:], uint64(s.now().Unix()))
+		return held.Put(heldKey(peer, seq), append(arrival[:], message...))
+	}
+	err := s.deliverToMailbox(tx, accountName, message)
+	if err != nil {
+		return err
+	}
+	if seq < expected {
+		// a late message for which a gap was already flagged
+		return nil
+	}
+	err = putSequence(sequences, sequenceKey("in", peer), expected+1)
+	if err != nil {
+		return err
+	}
+	return s.releaseHeld(tx, accountName, peer)
+}
+
+// releaseHeld delivers the held messages of the given correspondent
+// which are either next in sequence or were held for longer than the
+// hold duration
+func (s *Store) releaseHeld(tx *bolt.Tx, accountName, peer string) error {
+	sequences := accountBucket(tx, accountName, sequenceBucketName)
+	held := accountBucket(tx, accountName, heldBucketName)
+	if sequences == nil || held == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	prefix := heldKeyPrefix(peer)
+	expected := getSequence(sequences, sequenceKey("in", peer))
+	c := held.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Seek(prefix) {
+		seq := binary.BigEndian.Uint64(k[len(prefix):])
+		arrival := time.Unix(int64(binary.BigEndian.Uint64(v[:8])), 0)
+		message := make([]byte, len(v)-8)
+		copy(message, v[8:])
+		if seq > expected {
+			if s.now().Sub(arrival) < s.holdDuration {
+				break
+			}
+			gap := fmt.Sprintf("%s: %d-%d\n", SequenceGapHeader, expected, seq-1)
+			message = append([]byte(gap), message...)
+		}
+		err := s.deliverToMailbox(tx, accountName, message)
+		if err != nil {
+			return err
+		}
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+		if seq >= expected {
+			expected = seq + 1
+		}
+	}
+	return putSequence(sequences, sequenceKey("in", peer), expected)
+}
+
+// FlushHeldMessages delivers the account's held messages whose
+// hold duration has expired, flagging the gaps in their conversations
+func (s *Store) FlushHeldMessages(accountName string) error {
+	transaction := func(tx *bolt.Tx) error {
+		held := accountBucket(tx, accountName, heldBucketName)
+		if held == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		peers := []string{}
+		c := held.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			peer := string(k[:bytes.IndexByte(k, 0)])
+			if len(peers) == 0 || peers[len(peers)-1] != peer {
+				peers = append(peers, peer)
+			}
+		}
+		for _, peer := range peers {
+			err := s.releaseHeld(tx, accountName, peer)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
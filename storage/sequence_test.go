@@ -0,0 +1,120 @@
+// sequence_test.go - in order delivery tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sequencedMessage(seq int) []byte {
+	return []byte(fmt.Sprintf("From: bob@nsa.gov\nTo: alice@acme.com\n%s: %d\n\nmessage %d\n", SequenceHeader, seq, seq))
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "sequence_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+	store.SetOrdering(time.Minute)
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	for _, seq := range []int{1, 3, 2} {
+		err = store.PutMessage(account, sequencedMessage(seq))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	err = store.PutMessage(account, []byte("From: carol@fsb.ru\n\nunsequenced\n"))
+	require.NoError(err, "unexpected PutMessage() error")
+	err = store.PutMessage(account, sequencedMessage(6))
+	require.NoError(err, "unexpected PutMessage() error")
+
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(4, len(messages))
+	for i := 0; i < 3; i++ {
+		require.True(strings.HasSuffix(string(messages[i]), fmt.Sprintf("message %d\n", i+1)))
+	}
+
+	// the held message is released with a gap flag once it's hold time expires
+	err = store.FlushHeldMessages(account)
+	require.NoError(err, "unexpected FlushHeldMessages() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(4, len(messages))
+
+	now = now.Add(time.Minute)
+	err = store.FlushHeldMessages(account)
+	require.NoError(err, "unexpected FlushHeldMessages() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(5, len(messages))
+	require.True(strings.HasPrefix(string(messages[4]), SequenceGapHeader+": 4-5\n"))
+
+	// a late message is delivered immediately
+	err = store.PutMessage(account, sequencedMessage(4))
+	require.NoError(err, "unexpected PutMessage() error")
+	err = store.PutMessage(account, sequencedMessage(7))
+	require.NoError(err, "unexpected PutMessage() error")
+	messages, err = store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Equal(7, len(messages))
+}
+
+func TestNextOutgoingSequence(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "sequence_test2")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	for i := uint64(1); i < 4; i++ {
+		seq, err := store.NextOutgoingSequence(account, "Bob@nsa.gov")
+		require.NoError(err, "unexpected NextOutgoingSequence() error")
+		require.Equal(i, seq)
+	}
+	seq, err := store.NextOutgoingSequence(account, "carol@fsb.ru")
+	require.NoError(err, "unexpected NextOutgoingSequence() error")
+	require.Equal(uint64(1), seq)
+}
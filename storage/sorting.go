@@ -0,0 +1,60 @@
+// sorting.go - filing of the received messages into folders
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+// Disposition is the decision of a Sorter on a received message
+type Disposition struct {
+	// Folder is the folder the message is filed into,
+	// the INBOX if empty or not one of Folders
+	Folder string
+
+	// Seen marks the message as read
+	Seen bool
+
+	// Discard drops the message
+	Discard bool
+}
+
+// Sorter files the received messages into the folders
+type Sorter interface {
+	Sort(accountName string, message []byte) *Disposition
+}
+
+// SetSorter sets the Sorter filing the received messages into the
+// folders. It's consulted within the transaction delivering each
+// message, so that a message is atomically filed once reassembled,
+// and therefore it must not access the Store.
+func (s *Store) SetSorter(sorter Sorter) {
+	s.sorter = sorter
+}
+
+// sort returns the Disposition of the given message,
+// the INBOX unless a Sorter files it elsewhere
+func (s *Store) sort(accountName string, message []byte) *Disposition {
+	d := Disposition{}
+	if s.sorter != nil {
+		if sorted := s.sorter.Sort(accountName, message); sorted != nil {
+			d = *sorted
+		}
+	}
+	folder, err := folderName(d.Folder)
+	if err != nil {
+		folder = FolderInbox
+	}
+	d.Folder = folder
+	return &d
+}
@@ -0,0 +1,85 @@
+// sorting_test.go - received message sorting tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// subjectSorter files the messages by their subject
+type subjectSorter struct{}
+
+func (subjectSorter) Sort(accountName string, message []byte) *Disposition {
+	switch {
+	case bytes.Contains(message, []byte("Subject: spam")):
+		return &Disposition{Folder: "junk"}
+	case bytes.Contains(message, []byte("Subject: read")):
+		return &Disposition{Seen: true}
+	case bytes.Contains(message, []byte("Subject: drop")):
+		return &Disposition{Discard: true}
+	case bytes.Contains(message, []byte("Subject: bogus")):
+		return &Disposition{Folder: "Archive"}
+	}
+	return nil
+}
+
+func TestSorter(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "sorting_test1")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	store.SetSorter(subjectSorter{})
+
+	for _, subject := range []string{"hi", "spam", "read", "drop", "bogus"} {
+		err = store.PutMessage(account, []byte("Subject: "+subject+"\n\nhello\n"))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	junk, err := store.FolderMessages(account, FolderJunk)
+	require.NoError(err, "unexpected FolderMessages() error")
+	require.Len(junk, 1)
+	require.Contains(string(junk[0].Message), "Subject: spam")
+	messages, err := store.Messages(account)
+	require.NoError(err, "unexpected Messages() error")
+	require.Len(messages, 3, "wrong INBOX")
+	require.Contains(string(messages[2]), "Subject: bogus", "unknown folder not defaulted to the INBOX")
+	metadata, err := store.MessageMetadata(account)
+	require.NoError(err, "unexpected MessageMetadata() error")
+	require.Equal([]Flags{0, FlagSeen, 0}, []Flags{metadata[0].Flags, metadata[1].Flags, metadata[2].Flags})
+	require.Equal([]bool{false, true, false}, []bool{metadata[0].Seen, metadata[1].Seen, metadata[2].Seen})
+
+	// the messages marked as read go into the cur directory of a Maildir
+	root, err := ioutil.TempDir("", "sorting_test")
+	require.NoError(err, "unexpected TempDir error")
+	defer os.RemoveAll(root)
+	store.SetMaildir(root, false)
+	err = store.PutMessage(account, []byte("Subject: read\n\nhello\n"))
+	require.NoError(err, "unexpected PutMessage() error")
+	cur, err := ioutil.ReadDir(filepath.Join(root, account, "cur"))
+	require.NoError(err, "unexpected ReadDir error")
+	require.Len(cur, 1)
+	require.True(strings.HasSuffix(cur[0].Name(), ":2,S"), "wrong Maildir flags")
+}
@@ -0,0 +1,275 @@
+// split.go - parts of messages split into several mixnet messages
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// SplitPartRetention is how long the parts of a split message
+// are kept waiting for it's missing parts
+const SplitPartRetention = 7 * 24 * time.Hour
+
+// SplitPart is a part of a message which was split into several
+// mixnet messages because it exceeds the number of Blocks allowed
+// per message ID, see PutSplitPart
+type SplitPart struct {
+	// ID identifies the split message
+	ID [constants.MessageIDLength]byte
+	// Index is the position of the part in the split message
+	Index uint16
+	// Total is the number of parts of the split message
+	Total uint16
+	// S is the sender's static key authenticated by
+	// the decryption of the Blocks of the part
+	S [32]byte
+	// Blocks is the number of Blocks of the part
+	Blocks int
+	// Compressed is true if the split message was sent compressed
+	Compressed bool `json:",omitempty"`
+	// Payload is the part of the split message
+	Payload []byte
+	// Time is when the part was received
+	Time time.Time
+}
+
+// splitPartsBucketName is the name of the bucket
+// which persists the received parts of the account's split messages
+var splitPartsBucketName = []byte("split_parts")
+
+// splitPartKey returns the key of the given part, the parts of
+// a split message are adjacent and ordered by their index
+func splitPartKey(id [constants.MessageIDLength]byte, index uint16) []byte {
+	k := make([]byte, constants.MessageIDLength+2)
+	copy(k, id[:])
+	binary.BigEndian.PutUint16(k[constants.MessageIDLength:], index)
+	return k
+}
+
+// PutSplitPart stores the given part of a split message, which was
+// received as the mixnet message with the given message ID, and
+// removes the ingress blocks of that mixnet message within the
+// same transaction. See JoinSplitMessage.
+func (s *Store) PutSplitPart(accountName string, messageID [constants.MessageIDLength]byte, part *SplitPart) error {
+	if part.Total == 0 || part.Index >= part.Total {
+		return errors.New("invalid split message part index")
+	}
+	transaction := func(tx *bolt.Tx) error {
+		parts := accountBucket(tx, accountName, splitPartsBucketName)
+		ingressBucket := accountBucket(tx, accountName, ingressBucketName)
+		if parts == nil || ingressBucket == nil {
+			return ErrBucketMissing
+		}
+		p := *part
+		p.Time = s.now()
+		value, err := json.Marshal(&p)
+		if err != nil {
+			return err
+		}
+		err = parts.Put(splitPartKey(part.ID, part.Index), value)
+		if err != nil {
+			return err
+		}
+		_, keys, err := ingressBlocks(ingressBucket, messageID, nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err = ingressBucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
+
+// splitParts returns the stored parts of the split message with the
+// given ID ordered by index, and their keys
+func splitParts(b *bolt.Bucket, id [constants.MessageIDLength]byte) ([]*SplitPart, [][]byte, error) {
+	parts := []*SplitPart{}
+	keys := [][]byte{}
+	c := b.Cursor()
+	for k, v := c.Seek(id[:]); k != nil && bytes.HasPrefix(k, id[:]); k, v = c.Next() {
+		part := SplitPart{}
+		err := json.Unmarshal(v, &part)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts = append(parts, &part)
+		keys = append(keys, append([]byte{}, k...))
+	}
+	return parts, keys, nil
+}
+
+// CompleteSplitMessages returns the IDs of the account's split
+// messages of which all the parts were received
+func (s *Store) CompleteSplitMessages(accountName string) ([][constants.MessageIDLength]byte, error) {
+	complete := [][constants.MessageIDLength]byte{}
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, splitPartsBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		count := make(map[[constants.MessageIDLength]byte]int)
+		return b.ForEach(func(k, v []byte) error {
+			part := SplitPart{}
+			err := json.Unmarshal(v, &part)
+			if err != nil {
+				return err
+			}
+			count[part.ID]++
+			if count[part.ID] == int(part.Total) {
+				complete = append(complete, part.ID)
+			}
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return complete, nil
+}
+
+// JoinSplitMessage passes the parts of the split message with the
+// given ID to joinFn once all of them were received. If joinFn
+// returns a message, the message is put into the pop3 bucket and
+// the parts are removed, within a single transaction as with
+// ReassembleMessage. Nothing is modified while parts are missing
+// or if joinFn returns a nil message, the parts are removed without
+// delivering the message if it returns ErrDiscardMessage.
+func (s *Store) JoinSplitMessage(accountName string, id [constants.MessageIDLength]byte, joinFn func([]*SplitPart) ([]byte, error)) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, splitPartsBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		parts, keys, err := splitParts(b, id)
+		if err != nil {
+			return err
+		}
+		if len(parts) == 0 || len(parts) != int(parts[0].Total) {
+			return nil
+		}
+		for i, part := range parts {
+			if int(part.Index) != i || part.Total != parts[0].Total {
+				return errors.New("inconsistent split message parts")
+			}
+		}
+		message, err := joinFn(parts)
+		switch {
+		case err == ErrDiscardMessage:
+		case err != nil:
+			return err
+		case message == nil:
+			return nil
+		default:
+			err = s.deliverMessage(tx, accountName, message)
+			if err != nil {
+				return err
+			}
+		}
+		for _, k := range keys {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.db.Update(transaction)
+}
+
+// SplitMessageParts returns the parts of the split message with the
+// given ID ordered by index and their keys once all of them were
+// received, nil while parts are missing. See CommitSplitMessage.
+func (s *Store) SplitMessageParts(accountName string, id [constants.MessageIDLength]byte) ([]*SplitPart, [][]byte, error) {
+	var parts []*SplitPart
+	var keys [][]byte
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, splitPartsBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		var err error
+		parts, keys, err = splitParts(b, id)
+		if err != nil {
+			return err
+		}
+		if len(parts) == 0 || len(parts) != int(parts[0].Total) {
+			parts, keys = nil, nil
+			return nil
+		}
+		for i, part := range parts {
+			if int(part.Index) != i || part.Total != parts[0].Total {
+				return errors.New("inconsistent split message parts")
+			}
+		}
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parts, keys, nil
+}
+
+// CommitSplitMessage removes the parts with the given keys, as
+// returned by SplitMessageParts, and delivers the message joined
+// from them as CommitReassembly does with the ingress blocks
+func (s *Store) CommitSplitMessage(accountName string, keys [][]byte, message []byte, folder string) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, splitPartsBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		return s.commitMessage(tx, accountName, b, keys, message, folder)
+	}
+	return s.db.Update(transaction)
+}
+
+// pruneSplitParts removes the parts of the given bucket older
+// than the SplitPartRetention and returns their number
+func (s *Store) pruneSplitParts(b *bolt.Bucket) (int, error) {
+	expired := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		part := SplitPart{}
+		if json.Unmarshal(v, &part) != nil || s.now().Sub(part.Time) >= SplitPartRetention {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range expired {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
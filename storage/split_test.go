@@ -0,0 +1,107 @@
+// split_test.go - split message part storage tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitParts(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "split_test1")
+	defer cleanup()
+	account := "alice@acme"
+	require.NoError(store.CreateAccountBuckets([]string{account}))
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+
+	id := [16]byte{1}
+	put := func(index uint16, messageID byte) {
+		b := &block.Block{
+			MessageID:   [16]byte{messageID},
+			TotalBlocks: 1,
+			Block:       []byte{messageID},
+		}
+		require.NoError(store.PutIngressBlock(account, &IngressBlock{Block: b}))
+		err := store.PutSplitPart(account, b.MessageID, &SplitPart{
+			ID:      id,
+			Index:   index,
+			Total:   2,
+			Blocks:  1,
+			Payload: []byte{byte('a' + index)},
+		})
+		require.NoError(err, "PutSplitPart failed")
+		blocks, _, err := store.GetIngressBlocks(account, b.MessageID)
+		require.NoError(err, "GetIngressBlocks failed")
+		require.Empty(blocks)
+	}
+	join := func(parts []*SplitPart) ([]byte, error) {
+		message := []byte{}
+		for _, part := range parts {
+			message = append(message, part.Payload...)
+		}
+		return message, nil
+	}
+	require.Error(store.PutSplitPart(account, [16]byte{}, &SplitPart{ID: id, Index: 2, Total: 2}))
+
+	put(1, 10)
+	complete, err := store.CompleteSplitMessages(account)
+	require.NoError(err, "CompleteSplitMessages failed")
+	require.Empty(complete)
+	require.NoError(store.JoinSplitMessage(account, id, join))
+	messages, err := store.Messages(account)
+	require.NoError(err, "Messages failed")
+	require.Empty(messages)
+	parts, _, err := store.SplitMessageParts(account, id)
+	require.NoError(err, "SplitMessageParts failed")
+	require.Nil(parts)
+
+	put(0, 11)
+	complete, err = store.CompleteSplitMessages(account)
+	require.NoError(err, "CompleteSplitMessages failed")
+	require.Equal([][16]byte{id}, complete)
+	// nothing is delivered if joinFn returns nil
+	require.NoError(store.JoinSplitMessage(account, id, func([]*SplitPart) ([]byte, error) { return nil, nil }))
+	parts, keys, err := store.SplitMessageParts(account, id)
+	require.NoError(err, "SplitMessageParts failed")
+	require.Len(parts, 2)
+	require.Equal([]byte("b"), parts[1].Payload)
+	require.NoError(store.JoinSplitMessage(account, id, join))
+	messages, err = store.Messages(account)
+	require.NoError(err, "Messages failed")
+	require.Equal([][]byte{[]byte("ab")}, messages)
+	// the parts were already joined
+	require.Equal(ErrKeyNotFound, store.CommitSplitMessage(account, keys, []byte("ab"), ""))
+	complete, err = store.CompleteSplitMessages(account)
+	require.NoError(err, "CompleteSplitMessages failed")
+	require.Empty(complete)
+
+	// incomplete split messages are collected after the retention
+	put(0, 12)
+	report, err := store.CollectGarbage([]string{account}, 0)
+	require.NoError(err, "CollectGarbage failed")
+	require.Equal(0, report.SplitParts)
+	now = now.Add(SplitPartRetention)
+	report, err = store.CollectGarbage([]string{account}, 0)
+	require.NoError(err, "CollectGarbage failed")
+	require.Equal(1, report.SplitParts)
+}
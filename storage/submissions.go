@@ -0,0 +1,130 @@
+// submissions.go - recent submissions for idempotent sending
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// SubmissionWindow is how long a submission is remembered by
+// it's idempotency key, a resubmission with the same key within
+// this window is a duplicate and isn't sent again
+const SubmissionWindow = 24 * time.Hour
+
+// submissionsBucketName is the name of the bucket
+// which persists the account's recent submissions keyed by
+// idempotency key
+var submissionsBucketName = []byte("submissions")
+
+// Submission is the record of a submitted message with an idempotency
+// key, it's persisted in the transaction enqueueing the message, see
+// PutSubmittedEgressBlock and PutSubmittedDeferredMessage
+type Submission struct {
+	// Key is the idempotency key of the submission
+	Key string
+	// MessageID is the ID of the submitted message, it's
+	// zero for a deferred message which wasn't sent yet
+	MessageID [constants.MessageIDLength]byte
+}
+
+// LookupSubmission returns the message ID of the account's recent
+// submission with the given idempotency key, or nil if there is none
+func (s *Store) LookupSubmission(accountName, key string) (*[constants.MessageIDLength]byte, error) {
+	var messageID *[constants.MessageIDLength]byte
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, submissionsBucketName)
+		if b == nil {
+			return errors.New("boltdb bucket for that account doesn't exist")
+		}
+		v := b.Get([]byte(key))
+		if v == nil || s.submissionExpired(v) {
+			return nil
+		}
+		messageID = new([constants.MessageIDLength]byte)
+		copy(messageID[:], v[8:])
+		return nil
+	}
+	err := s.db.View(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return messageID, nil
+}
+
+// RecordSubmission records the submission of the given message with
+// the given idempotency key by the account, and forgets the
+// submissions which are older than the SubmissionWindow
+func (s *Store) RecordSubmission(accountName, key string, messageID [constants.MessageIDLength]byte) error {
+	transaction := func(tx *bolt.Tx) error {
+		return s.putSubmission(tx, accountName, &Submission{Key: key, MessageID: messageID})
+	}
+	return s.db.Update(transaction)
+}
+
+// putSubmission records the given submission by the account in the
+// given transaction, as RecordSubmission does
+func (s *Store) putSubmission(tx *bolt.Tx, accountName string, submission *Submission) error {
+	b := accountBucket(tx, accountName, submissionsBucketName)
+	if b == nil {
+		return errors.New("boltdb bucket for that account doesn't exist")
+	}
+	_, err := s.pruneSubmissions(b)
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 8+constants.MessageIDLength)
+	binary.BigEndian.PutUint64(v, uint64(s.now().Unix()))
+	copy(v[8:], submission.MessageID[:])
+	return b.Put([]byte(submission.Key), v)
+}
+
+// pruneSubmissions removes the expired entries of the given
+// submissions bucket and returns their number
+func (s *Store) pruneSubmissions(b *bolt.Bucket) (int, error) {
+	expired := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		if s.submissionExpired(v) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range expired {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// submissionExpired returns true if the given submissions bucket
+// value was recorded before the SubmissionWindow
+func (s *Store) submissionExpired(v []byte) bool {
+	if len(v) != 8+constants.MessageIDLength {
+		return true
+	}
+	submitted := time.Unix(int64(binary.BigEndian.Uint64(v[:8])), 0)
+	return s.now().Sub(submitted) >= SubmissionWindow
+}
@@ -0,0 +1,108 @@
+// submissions_test.go - recent submissions tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentSubmissions(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "submissions_test1")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+
+	messageID, err := store.LookupSubmission(account, "retry-1")
+	require.NoError(err, "unexpected LookupSubmission() error")
+	require.Nil(messageID)
+
+	first := [constants.MessageIDLength]byte{1}
+	err = store.RecordSubmission(account, "retry-1", first)
+	require.NoError(err, "unexpected RecordSubmission() error")
+	messageID, err = store.LookupSubmission(account, "retry-1")
+	require.NoError(err, "unexpected LookupSubmission() error")
+	require.Equal(&first, messageID)
+	messageID, err = store.LookupSubmission("bob@nsa.gov", "retry-1")
+	require.Error(err, "unknown account not detected")
+
+	// submissions are forgotten after the submission window
+	now = now.Add(SubmissionWindow)
+	messageID, err = store.LookupSubmission(account, "retry-1")
+	require.NoError(err, "unexpected LookupSubmission() error")
+	require.Nil(messageID)
+	second := [constants.MessageIDLength]byte{2}
+	err = store.RecordSubmission(account, "retry-2", second)
+	require.NoError(err, "unexpected RecordSubmission() error")
+	keys := 0
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return accountBucket(tx, account, submissionsBucketName).ForEach(func(k, v []byte) error {
+			keys++
+			return nil
+		})
+	})
+	require.NoError(err, "unexpected View() error")
+	require.Equal(1, keys, "expired submission was not pruned")
+}
+
+func TestSubmittedEgressBlock(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "submissions_test2")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	// the submission is recorded with the Block
+	messageID := [constants.MessageIDLength]byte{1}
+	b := &EgressBlock{Sender: account, Recipient: "bob@nsa.gov"}
+	b.Block.MessageID = messageID
+	_, err = store.PutSubmittedEgressBlock(b, &Submission{Key: "retry-1", MessageID: messageID})
+	require.NoError(err, "unexpected PutSubmittedEgressBlock() error")
+	recorded, err := store.LookupSubmission(account, "retry-1")
+	require.NoError(err, "unexpected LookupSubmission() error")
+	require.Equal(&messageID, recorded)
+
+	// neither is persisted if the submission can't be recorded
+	b = &EgressBlock{Sender: "mallory@acme.com", Recipient: "bob@nsa.gov"}
+	_, err = store.PutSubmittedEgressBlock(b, &Submission{Key: "retry-2"})
+	require.Error(err, "unknown account not detected")
+	blocks, err := store.EgressBlocks()
+	require.NoError(err, "unexpected EgressBlocks() error")
+	require.Len(blocks, 1)
+
+	_, err = store.PutSubmittedDeferredMessage(&DeferredMessage{Sender: account, Message: []byte("later")}, &Submission{Key: "retry-3"})
+	require.NoError(err, "unexpected PutSubmittedDeferredMessage() error")
+	recorded, err = store.LookupSubmission(account, "retry-3")
+	require.NoError(err, "unexpected LookupSubmission() error")
+	require.Equal(&[constants.MessageIDLength]byte{}, recorded)
+	_, err = store.PutSubmittedDeferredMessage(&DeferredMessage{Sender: "mallory@acme.com"}, &Submission{Key: "retry-4"})
+	require.Error(err, "unknown account not detected")
+	deferred, err := store.DeferredMessages()
+	require.NoError(err, "unexpected DeferredMessages() error")
+	require.Len(deferred, 1)
+}
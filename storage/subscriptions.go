@@ -0,0 +1,124 @@
+// subscriptions.go - notification of committed changes
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// SubscriptionBufferSize is the number of Notifications buffered
+// by each subscription, further Notifications are dropped until
+// the subscriber catches up
+const SubscriptionBufferSize = 64
+
+// NotificationType is the type of a Notification
+type NotificationType string
+
+const (
+	// MessageAdded is notified when a message
+	// is delivered to an account's mailbox
+	MessageAdded NotificationType = "message_added"
+
+	// MessageDeleted is notified when a message is
+	// removed from an account's mailbox
+	MessageDeleted NotificationType = "message_deleted"
+
+	// MessageFlagsChanged is notified when the flags of
+	// a message in an account's mailbox are changed
+	MessageFlagsChanged NotificationType = "message_flags_changed"
+
+	// EgressBlockAcked is notified when an egress Block
+	// of an account is removed once it's ACK arrived
+	EgressBlockAcked NotificationType = "egress_block_acked"
+)
+
+// mailboxNotifications are the Notification types
+// of the mailbox change journal operations
+var mailboxNotifications = map[MailboxOp]NotificationType{
+	MailboxAdd:    MessageAdded,
+	MailboxDelete: MessageDeleted,
+	MailboxFlags:  MessageFlagsChanged,
+}
+
+// Notification is a change of an account's data
+// notified to the subscribers once committed
+type Notification struct {
+	// Type is the type of the change
+	Type NotificationType
+
+	// Account is the name of the account
+	Account string
+
+	// Key is the key of the message in the pop3
+	// bucket, zero for EgressBlockAcked
+	Key uint64
+
+	// ModSeq is the modification sequence of the mailbox
+	// change, see Changes, zero for EgressBlockAcked
+	ModSeq uint64
+
+	// MessageID is the ID of the message of the
+	// acked Block, zero for the mailbox changes
+	MessageID [constants.MessageIDLength]byte
+}
+
+// Subscribe returns a channel receiving the Notifications of the
+// changes of the given account, or of all the accounts if it's
+// empty, after each committed transaction. Notifications are
+// dropped while the channel is full, a subscriber which falls
+// behind may resync the mailbox with Changes. The channel is
+// closed by Unsubscribe.
+func (s *Store) Subscribe(accountName string) <-chan *Notification {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[chan *Notification]string)
+	}
+	ch := make(chan *Notification, SubscriptionBufferSize)
+	s.subscriptions[ch] = accountName
+	return ch
+}
+
+// Unsubscribe cancels the subscription of
+// the given channel returned by Subscribe
+func (s *Store) Unsubscribe(ch <-chan *Notification) {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	for c := range s.subscriptions {
+		if c == ch {
+			delete(s.subscriptions, c)
+			close(c)
+			return
+		}
+	}
+}
+
+// publish sends the Notification to the subscribers
+// of it's account without blocking
+func (s *Store) publish(n *Notification) {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	for ch, accountName := range s.subscriptions {
+		if accountName != "" && accountName != n.Account {
+			continue
+		}
+		select {
+		case ch <- n:
+		default:
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// subscriptions_test.go - change notification tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/katzenpost/client/crypto/block"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "subscriptions_test1")
+	defer cleanup()
+	alice, bob := "alice@acme.com", "bob@nsa.gov"
+	err := store.CreateAccountBuckets([]string{alice, bob})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+	aliceCh := store.Subscribe(alice)
+	allCh := store.Subscribe("")
+
+	err = store.PutMessage(alice, []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+	err = store.PutMessage(bob, []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+	_, err = store.UpdateMessageFlags(alice, 1, FlagSeen, 0)
+	require.NoError(err, "unexpected UpdateMessageFlags() error")
+	err = store.DeleteMessages(alice, []int{1})
+	require.NoError(err, "unexpected DeleteMessages() error")
+	egressBlock := EgressBlock{
+		Sender: alice,
+		Block: block.Block{
+			MessageID:   [16]byte{7},
+			TotalBlocks: 1,
+			Block:       []byte("queued"),
+		},
+	}
+	_, err = store.PutEgressBlock(&egressBlock)
+	require.NoError(err, "unexpected PutEgressBlock() error")
+	_, err = store.RemoveEgressBlock(&egressBlock)
+	require.NoError(err, "unexpected RemoveEgressBlock() error")
+
+	// a failed transaction notifies nothing
+	err = store.PutMessage("mallory@acme.com", []byte("hello"))
+	require.Error(err, "expected PutMessage() error")
+
+	require.Len(aliceCh, 4)
+	for _, expected := range []NotificationType{MessageAdded, MessageFlagsChanged, MessageDeleted} {
+		n := <-aliceCh
+		require.Equal(expected, n.Type)
+		require.Equal(alice, n.Account)
+		require.Equal(uint64(1), n.Key)
+	}
+	n := <-aliceCh
+	require.Equal(EgressBlockAcked, n.Type)
+	require.Equal([16]byte{7}, n.MessageID)
+	require.Len(allCh, 5, "the subscription to all accounts missed changes")
+
+	// a full channel drops the notifications
+	for i := 0; i < SubscriptionBufferSize+1; i++ {
+		err = store.PutMessage(alice, []byte("hello"))
+		require.NoError(err, "unexpected PutMessage() error")
+	}
+	require.Len(aliceCh, SubscriptionBufferSize)
+
+	store.Unsubscribe(aliceCh)
+	for range aliceCh {
+	}
+	_, ok := <-aliceCh
+	require.False(ok, "channel not closed")
+	err = store.PutMessage(alice, []byte("hello"))
+	require.NoError(err, "unexpected PutMessage() error")
+}
@@ -0,0 +1,366 @@
+// surb_pool.go - persistence of the pre-generated SURBs
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/katzenpost/client/internal/constants"
+)
+
+// ErrNoPooledSURB is the error returned when
+// no usable SURB is left in a pool
+var ErrNoPooledSURB = errors.New("no pooled SURB available")
+
+// PooledSURB is a SURB pre-generated by an account, the replies
+// or ACKs sent with it travel from it's correspondent's Provider
+// to the account
+type PooledSURB struct {
+	// ID is the SURB ID
+	ID [constants.SURBIDLength]byte
+
+	// Correspondent is the e-mail address the SURB was generated for
+	Correspondent string
+
+	// Epoch is the epoch whose mix keys the SURB's path uses,
+	// the SURB expires with it
+	Epoch uint64
+
+	// Delay is the total mixing delay of the SURB's path
+	Delay time.Duration
+
+	// SURB is the SURB header, it's nil once the SURB
+	// was issued to it's correspondent
+	SURB []byte
+
+	// Keys are the keys decrypting the payload sent with the SURB
+	Keys []byte
+}
+
+// ReceivedSURB is a SURB received from a correspondent,
+// it's used to send to the correspondent without the PKI
+type ReceivedSURB struct {
+	// Correspondent is the e-mail address which issued the SURB
+	Correspondent string
+
+	// Epoch is the epoch during which the SURB may be used
+	Epoch uint64
+
+	// Delay is the total mixing delay of the SURB's path, the SURB
+	// must be used at least that long before the end of the epoch
+	Delay time.Duration
+
+	// SURB is the SURB header
+	SURB []byte
+}
+
+// surbPoolBucketName is the name of the
+// bucket which persists the SURBs generated by the account
+var surbPoolBucketName = []byte("surb_pool")
+
+// receivedSURBsBucketName is the name of the
+// bucket which persists the SURBs received by the account
+var receivedSURBsBucketName = []byte("surbs_received")
+
+// PutPooledSURB adds the given SURB to the account's pool
+func (s *Store) PutPooledSURB(accountName string, surb *PooledSURB) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, surbPoolBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		value, err := json.Marshal(surb)
+		if err != nil {
+			return err
+		}
+		return b.Put(surb.ID[:], value)
+	}
+	return s.db.Update(transaction)
+}
+
+// takePooledSURB finds an unissued SURB of the given correspondent
+// and epoch whose path delay doesn't exceed maxDelay, the SURB is
+// removed from the pool or, if issue is true, it's header is
+func (s *Store) takePooledSURB(accountName, correspondent string, epoch uint64, maxDelay time.Duration, issue bool) (*PooledSURB, error) {
+	var surb *PooledSURB
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, surbPoolBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			p := PooledSURB{}
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return err
+			}
+			if p.SURB == nil || p.Correspondent != correspondent || p.Epoch != epoch || p.Delay > maxDelay {
+				continue
+			}
+			surb = &p
+			if !issue {
+				return b.Delete(k)
+			}
+			issued := p
+			issued.SURB = nil
+			value, err := json.Marshal(&issued)
+			if err != nil {
+				return err
+			}
+			return b.Put(k, value)
+		}
+		return ErrNoPooledSURB
+	}
+	err := s.db.Update(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return surb, nil
+}
+
+// TakePooledSURB removes and returns an unissued SURB of the given
+// correspondent and epoch whose path delay doesn't exceed maxDelay,
+// ErrNoPooledSURB is returned if there is none
+func (s *Store) TakePooledSURB(accountName, correspondent string, epoch uint64, maxDelay time.Duration) (*PooledSURB, error) {
+	return s.takePooledSURB(accountName, correspondent, epoch, maxDelay, false)
+}
+
+// IssuePooledSURB is like TakePooledSURB but only the SURB header is
+// removed from the pool, the keys are kept to decrypt the payload
+// the correspondent sends with it, see RedeemSURB
+func (s *Store) IssuePooledSURB(accountName, correspondent string, epoch uint64, maxDelay time.Duration) (*PooledSURB, error) {
+	return s.takePooledSURB(accountName, correspondent, epoch, maxDelay, true)
+}
+
+// PooledSURBCount returns the number of unissued
+// SURBs of the given correspondent and epoch
+func (s *Store) PooledSURBCount(accountName, correspondent string, epoch uint64) (int, error) {
+	count := 0
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, surbPoolBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		return b.ForEach(func(k, v []byte) error {
+			p := PooledSURB{}
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return err
+			}
+			if p.SURB != nil && p.Correspondent == correspondent && p.Epoch == epoch {
+				count++
+			}
+			return nil
+		})
+	}
+	err := s.db.View(transaction)
+	return count, err
+}
+
+// RedeemSURB removes and returns the issued SURB with the given ID,
+// ErrKeyNotFound is returned if it isn't an issued pooled SURB
+func (s *Store) RedeemSURB(accountName string, surbID [constants.SURBIDLength]byte) (*PooledSURB, error) {
+	surb := PooledSURB{}
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, surbPoolBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		v := b.Get(surbID[:])
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		err := json.Unmarshal(v, &surb)
+		if err != nil {
+			return err
+		}
+		if surb.SURB != nil {
+			return ErrKeyNotFound
+		}
+		return b.Delete(surbID[:])
+	}
+	err := s.db.Update(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &surb, nil
+}
+
+// PutReceivedSURB persists a SURB received from a correspondent, once
+// constants.MaxReceivedSURBs of the correspondent's SURBs are kept the
+// one of the earliest epoch is evicted
+func (s *Store) PutReceivedSURB(accountName string, surb *ReceivedSURB) error {
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, receivedSURBsBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		count := 0
+		var earliestKey []byte
+		var earliest uint64
+		err := b.ForEach(func(k, v []byte) error {
+			r := ReceivedSURB{}
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			if r.Correspondent != surb.Correspondent {
+				return nil
+			}
+			count++
+			if earliestKey == nil || r.Epoch < earliest {
+				earliestKey = append([]byte{}, k...)
+				earliest = r.Epoch
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count >= constants.MaxReceivedSURBs {
+			err = b.Delete(earliestKey)
+			if err != nil {
+				return err
+			}
+		}
+		value, err := json.Marshal(surb)
+		if err != nil {
+			return err
+		}
+		key := sha256.Sum256(surb.SURB)
+		return b.Put(key[:], value)
+	}
+	return s.db.Update(transaction)
+}
+
+// TakeReceivedSURB removes and returns a SURB received from the given
+// correspondent usable during the given epoch whose path delay doesn't
+// exceed maxDelay, ErrNoPooledSURB is returned if there is none. The
+// correspondent's SURBs of earlier epochs are removed.
+func (s *Store) TakeReceivedSURB(accountName, correspondent string, epoch uint64, maxDelay time.Duration) (*ReceivedSURB, error) {
+	var surb *ReceivedSURB
+	transaction := func(tx *bolt.Tx) error {
+		b := accountBucket(tx, accountName, receivedSURBsBucketName)
+		if b == nil {
+			return ErrBucketMissing
+		}
+		remove := [][]byte{}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			r := ReceivedSURB{}
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			if r.Correspondent != correspondent {
+				continue
+			}
+			if r.Epoch < epoch {
+				remove = append(remove, k)
+				continue
+			}
+			if surb == nil && r.Epoch == epoch && r.Delay <= maxDelay {
+				surb = &r
+				remove = append(remove, k)
+			}
+		}
+		for _, k := range remove {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := s.db.Update(transaction)
+	if err != nil {
+		return nil, err
+	}
+	if surb == nil {
+		return nil, ErrNoPooledSURB
+	}
+	return surb, nil
+}
+
+// ExpirePooledSURBs removes the SURBs which expired by the given
+// epoch and returns their number. The keys of the issued SURBs are
+// kept one more epoch, for the replies still in the mix network.
+func (s *Store) ExpirePooledSURBs(accountName string, epoch uint64) (int, error) {
+	expired := 0
+	transaction := func(tx *bolt.Tx) error {
+		pool := accountBucket(tx, accountName, surbPoolBucketName)
+		received := accountBucket(tx, accountName, receivedSURBsBucketName)
+		if pool == nil || received == nil {
+			return ErrBucketMissing
+		}
+		expiredPool := [][]byte{}
+		err := pool.ForEach(func(k, v []byte) error {
+			p := PooledSURB{}
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return err
+			}
+			lifetime := p.Epoch
+			if p.SURB == nil {
+				lifetime++
+			}
+			if lifetime < epoch {
+				expiredPool = append(expiredPool, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		expiredReceived := [][]byte{}
+		err = received.ForEach(func(k, v []byte) error {
+			r := ReceivedSURB{}
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			if r.Epoch < epoch {
+				expiredReceived = append(expiredReceived, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expiredPool {
+			err = pool.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		for _, k := range expiredReceived {
+			err = received.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		expired = len(expiredPool) + len(expiredReceived)
+		return nil
+	}
+	err := s.db.Update(transaction)
+	return expired, err
+}
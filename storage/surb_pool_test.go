@@ -0,0 +1,145 @@
+// surb_pool_test.go - tests of the SURB pools
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSURBPool(t *testing.T) {
+	require := require.New(t)
+
+	dbFile, err := ioutil.TempFile("", "surb_pool_test1")
+	require.NoError(err, "unexpected TempFile error")
+	defer func() {
+		err := os.Remove(dbFile.Name())
+		require.NoError(err, "unexpected os.Remove error")
+	}()
+	store, err := New(dbFile.Name())
+	require.NoError(err, "unexpected New() error")
+	defer store.Close()
+
+	account := "alice@acme.com"
+	err = store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	for i := 0; i < 3; i++ {
+		surb := PooledSURB{
+			Correspondent: "bob@nsa.gov",
+			Epoch:         uint64(10 + i%2),
+			Delay:         time.Duration(i+1) * time.Minute,
+			SURB:          []byte{1, 2, byte(i)},
+			Keys:          []byte{3, 4, byte(i)},
+		}
+		surb.ID[0] = byte(i)
+		err = store.PutPooledSURB(account, &surb)
+		require.NoError(err, "unexpected PutPooledSURB() error")
+	}
+	count, err := store.PooledSURBCount(account, "bob@nsa.gov", 10)
+	require.NoError(err, "unexpected PooledSURBCount() error")
+	require.Equal(2, count)
+
+	// the delay of the SURB's path must fit
+	_, err = store.TakePooledSURB(account, "bob@nsa.gov", 10, time.Minute/2)
+	require.Equal(ErrNoPooledSURB, err)
+	surb, err := store.TakePooledSURB(account, "bob@nsa.gov", 10, 2*time.Minute)
+	require.NoError(err, "unexpected TakePooledSURB() error")
+	require.Equal(byte(0), surb.ID[0])
+	require.Equal([]byte{3, 4, 0}, surb.Keys)
+
+	// taken SURBs can't be redeemed, issued ones are kept until then
+	_, err = store.RedeemSURB(account, surb.ID)
+	require.Equal(ErrKeyNotFound, err)
+	surb, err = store.IssuePooledSURB(account, "bob@nsa.gov", 10, time.Hour)
+	require.NoError(err, "unexpected IssuePooledSURB() error")
+	require.Equal([]byte{1, 2, 2}, surb.SURB)
+	count, err = store.PooledSURBCount(account, "bob@nsa.gov", 10)
+	require.NoError(err, "unexpected PooledSURBCount() error")
+	require.Equal(0, count)
+	redeemed, err := store.RedeemSURB(account, surb.ID)
+	require.NoError(err, "unexpected RedeemSURB() error")
+	require.Equal([]byte{3, 4, 2}, redeemed.Keys)
+	require.Nil(redeemed.SURB)
+	_, err = store.RedeemSURB(account, surb.ID)
+	require.Equal(ErrKeyNotFound, err)
+
+	err = store.PutReceivedSURB(account, &ReceivedSURB{
+		Correspondent: "bob@nsa.gov",
+		Epoch:         11,
+		Delay:         time.Minute,
+		SURB:          []byte{5, 6},
+	})
+	require.NoError(err, "unexpected PutReceivedSURB() error")
+	_, err = store.TakeReceivedSURB(account, "bob@nsa.gov", 10, time.Hour)
+	require.Equal(ErrNoPooledSURB, err)
+
+	// the SURBs of epoch 11 outlive epoch 11
+	expired, err := store.ExpirePooledSURBs(account, 11)
+	require.NoError(err, "unexpected ExpirePooledSURBs() error")
+	require.Equal(0, expired)
+	expired, err = store.ExpirePooledSURBs(account, 12)
+	require.NoError(err, "unexpected ExpirePooledSURBs() error")
+	require.Equal(2, expired)
+	_, err = store.TakeReceivedSURB(account, "bob@nsa.gov", 11, time.Hour)
+	require.Equal(ErrNoPooledSURB, err)
+}
+
+func TestReceivedSURBLimits(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := newTestStore(require, "received_surbs")
+	defer cleanup()
+	account := "alice@acme.com"
+	err := store.CreateAccountBuckets([]string{account})
+	require.NoError(err, "unexpected CreateAccountBuckets() error")
+
+	// the SURBs of the earliest epochs are evicted
+	for i := 0; i <= constants.MaxReceivedSURBs; i++ {
+		err = store.PutReceivedSURB(account, &ReceivedSURB{
+			Correspondent: "bob@nsa.gov",
+			Epoch:         uint64(10 + i),
+			Delay:         time.Minute,
+			SURB:          []byte{byte(i)},
+		})
+		require.NoError(err, "unexpected PutReceivedSURB() error")
+	}
+	err = store.PutReceivedSURB(account, &ReceivedSURB{
+		Correspondent: "carol@nsa.gov",
+		Epoch:         10,
+		Delay:         time.Minute,
+		SURB:          []byte{0xff},
+	})
+	require.NoError(err, "unexpected PutReceivedSURB() error")
+	_, err = store.TakeReceivedSURB(account, "bob@nsa.gov", 10, time.Hour)
+	require.Equal(ErrNoPooledSURB, err)
+	surb, err := store.TakeReceivedSURB(account, "carol@nsa.gov", 10, time.Hour)
+	require.NoError(err, "unexpected TakeReceivedSURB() error")
+	require.Equal([]byte{0xff}, surb.SURB)
+
+	// taking a SURB removes the correspondent's SURBs of earlier epochs
+	surb, err = store.TakeReceivedSURB(account, "bob@nsa.gov", 15, time.Hour)
+	require.NoError(err, "unexpected TakeReceivedSURB() error")
+	require.Equal([]byte{5}, surb.SURB)
+	_, err = store.TakeReceivedSURB(account, "bob@nsa.gov", 14, time.Hour)
+	require.Equal(ErrNoPooledSURB, err)
+}
@@ -0,0 +1,298 @@
+// directory.go - remote key directory user PKI
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package user_pki
+
+import (
+	"crypto/mlkem"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/pelletier/go-toml"
+)
+
+// maxDirectoryResponseSize is the maximum size in
+// bytes of a key directory response we will read
+const maxDirectoryResponseSize = 4096
+
+// DirectoryEntry is a key directory response, binding
+// an e-mail address to a key until the expiration time.
+// It is signed by the directory's signing key.
+type DirectoryEntry struct {
+	Email      string
+	Key        string
+	Expiration int64
+	Signature  string
+
+	// KEMKey is the optional base64 encoded ML-KEM-768
+	// encapsulation key advertising support for the
+	// experimental hybrid envelopes
+	KEMKey string `json:",omitempty"`
+}
+
+// signedBytes returns the bytes covered by the entry's signature
+func (e *DirectoryEntry) signedBytes() []byte {
+	signed := fmt.Sprintf("%s\x00%s\x00%d", strings.ToLower(e.Email), e.Key, e.Expiration)
+	if e.KEMKey != "" {
+		signed += "\x00" + e.KEMKey
+	}
+	return []byte(signed)
+}
+
+// SignDirectoryEntry creates a new DirectoryEntry signed with
+// the given directory signing key
+func SignDirectoryEntry(signingKey *eddsa.PrivateKey, email string, key *ecdh.PublicKey, expiration time.Time) *DirectoryEntry {
+	e := DirectoryEntry{
+		Email:      strings.ToLower(email),
+		Key:        base64.StdEncoding.EncodeToString(key.Bytes()),
+		Expiration: expiration.Unix(),
+	}
+	e.Signature = base64.StdEncoding.EncodeToString(signingKey.Sign(e.signedBytes()))
+	return &e
+}
+
+// SignHybridDirectoryEntry creates a new DirectoryEntry which also
+// advertises the given ML-KEM-768 encapsulation key
+func SignHybridDirectoryEntry(signingKey *eddsa.PrivateKey, email string, key *ecdh.PublicKey, kemKey *mlkem.EncapsulationKey768, expiration time.Time) *DirectoryEntry {
+	e := DirectoryEntry{
+		Email:      strings.ToLower(email),
+		Key:        base64.StdEncoding.EncodeToString(key.Bytes()),
+		KEMKey:     base64.StdEncoding.EncodeToString(kemKey.Bytes()),
+		Expiration: expiration.Unix(),
+	}
+	e.Signature = base64.StdEncoding.EncodeToString(signingKey.Sign(e.signedBytes()))
+	return &e
+}
+
+// Contact is used to deserialize the contact
+// sections of the TOML contacts file
+type Contact struct {
+	// Email is the e-mail address of the contact
+	Email string
+	// Key is the base64 encoded pinned key of the contact
+	Key string
+}
+
+// contactsFile is used to deserialize the TOML contacts file
+type contactsFile struct {
+	Contact []Contact
+}
+
+// cachedKey is a directory key cached until it expires
+type cachedKey struct {
+	key     *ecdh.PublicKey
+	kemKey  *mlkem.EncapsulationKey768
+	expires time.Time
+}
+
+// DirectoryUserPKI is a UserPKI which queries a remote key
+// directory for the keys of recipients. Directory responses must be
+// signed by the pinned directory signing key and are cached for at
+// most the configured TTL. Keys pinned in a local contacts file take
+// precedence over the directory.
+type DirectoryUserPKI struct {
+	sync.Mutex
+
+	baseURL    string
+	signingKey *eddsa.PublicKey
+	ttl        time.Duration
+	client     *http.Client
+	cache      map[string]*cachedKey
+	pins       map[string]*ecdh.PublicKey
+	now        func() time.Time
+}
+
+// NewDirectoryUserPKI creates a new DirectoryUserPKI which queries
+// the key directory at the given base URL, verifying the responses
+// with the given directory signing key
+func NewDirectoryUserPKI(baseURL string, signingKey *eddsa.PublicKey, ttl time.Duration) *DirectoryUserPKI {
+	d := DirectoryUserPKI{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		signingKey: signingKey,
+		ttl:        ttl,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		cache:      make(map[string]*cachedKey),
+		pins:       make(map[string]*ecdh.PublicKey),
+		now:        time.Now,
+	}
+	return &d
+}
+
+// LoadContacts loads the pinned contact keys from the given
+// TOML contacts file, pinned keys override the directory
+func (d *DirectoryUserPKI) LoadContacts(filePath string) error {
+	fileData, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	contacts := contactsFile{}
+	err = toml.Unmarshal(fileData, &contacts)
+	if err != nil {
+		return err
+	}
+	pins := make(map[string]*ecdh.PublicKey)
+	for _, contact := range contacts.Contact {
+		if len(contact.Email) == 0 {
+			return errors.New("nil contact email error")
+		}
+		key, err := decodeKey(contact.Key)
+		if err != nil {
+			return err
+		}
+		pins[strings.ToLower(contact.Email)] = key
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.pins = pins
+	return nil
+}
+
+// decodeKey decodes a base64 encoded key
+func decodeKey(encodedKey string) (*ecdh.PublicKey, error) {
+	keyRaw, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New("failed to base64 decode user key")
+	}
+	key := ecdh.PublicKey{}
+	err = key.FromBytes(keyRaw)
+	if err != nil {
+		return nil, errors.New("failed to get key from given bytes")
+	}
+	return &key, nil
+}
+
+// GetKey returns the key of the given e-mail address
+func (d *DirectoryUserPKI) GetKey(email string) (*ecdh.PublicKey, error) {
+	email = strings.ToLower(email)
+	d.Lock()
+	if key, ok := d.pins[email]; ok {
+		d.Unlock()
+		return key, nil
+	}
+	d.Unlock()
+	cached, err := d.lookup(email)
+	if err != nil {
+		return nil, err
+	}
+	return cached.key, nil
+}
+
+// GetKEMKey returns the ML-KEM-768 encapsulation key advertised by
+// the given e-mail address or nil if it doesn't advertise one.
+// Contacts whose key is pinned never advertise one.
+func (d *DirectoryUserPKI) GetKEMKey(email string) (*mlkem.EncapsulationKey768, error) {
+	email = strings.ToLower(email)
+	d.Lock()
+	if _, ok := d.pins[email]; ok {
+		d.Unlock()
+		return nil, nil
+	}
+	d.Unlock()
+	cached, err := d.lookup(email)
+	if err != nil {
+		return nil, err
+	}
+	return cached.kemKey, nil
+}
+
+// lookup returns the cached directory entry of the given
+// e-mail address, querying the directory if it has expired
+func (d *DirectoryUserPKI) lookup(email string) (*cachedKey, error) {
+	d.Lock()
+	if cached, ok := d.cache[email]; ok && d.now().Before(cached.expires) {
+		d.Unlock()
+		return cached, nil
+	}
+	d.Unlock()
+
+	cached, expiration, err := d.query(email)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	cached.expires = d.now().Add(d.ttl)
+	if expiration.Before(cached.expires) {
+		cached.expires = expiration
+	}
+	d.cache[email] = cached
+	return cached, nil
+}
+
+// query retrieves the key of the given e-mail address from the
+// directory and verifies the directory's signature
+func (d *DirectoryUserPKI) query(email string) (*cachedKey, time.Time, error) {
+	resp, err := d.client.Get(fmt.Sprintf("%s/%s", d.baseURL, url.PathEscape(email)))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("key directory lookup of %s failed: %s", email, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDirectoryResponseSize))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	entry := DirectoryEntry{}
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if strings.ToLower(entry.Email) != email {
+		return nil, time.Time{}, errors.New("key directory returned an entry for the wrong email")
+	}
+	signature, err := base64.StdEncoding.DecodeString(entry.Signature)
+	if err != nil {
+		return nil, time.Time{}, errors.New("failed to base64 decode directory signature")
+	}
+	if !d.signingKey.Verify(signature, entry.signedBytes()) {
+		return nil, time.Time{}, errors.New("key directory signature verification failed")
+	}
+	expiration := time.Unix(entry.Expiration, 0)
+	if !d.now().Before(expiration) {
+		return nil, time.Time{}, errors.New("key directory entry has expired")
+	}
+	key, err := decodeKey(entry.Key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cached := cachedKey{
+		key: key,
+	}
+	if entry.KEMKey != "" {
+		kemKeyRaw, err := base64.StdEncoding.DecodeString(entry.KEMKey)
+		if err != nil {
+			return nil, time.Time{}, errors.New("failed to base64 decode user KEM key")
+		}
+		cached.kemKey, err = mlkem.NewEncapsulationKey768(kemKeyRaw)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return &cached, expiration, nil
+}
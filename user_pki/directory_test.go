@@ -0,0 +1,125 @@
+// directory_test.go - remote key directory user PKI tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package user_pki
+
+import (
+	"crypto/mlkem"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryUserPKI(t *testing.T) {
+	require := require.New(t)
+
+	directoryKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	forgeryKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+
+	aliceKey := newPublicKey(require)
+	expiration := time.Now().Add(24 * time.Hour)
+	entries := map[string]*DirectoryEntry{
+		"alice@acme.com":   SignDirectoryEntry(directoryKey, "alice@acme.com", aliceKey, expiration),
+		"mallory@acme.com": SignDirectoryEntry(forgeryKey, "mallory@acme.com", newPublicKey(require), expiration),
+	}
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries += 1
+		entry, ok := entries[strings.TrimPrefix(r.URL.Path, "/keys/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(entry)
+	}))
+	defer server.Close()
+
+	d := NewDirectoryUserPKI(server.URL+"/keys/", directoryKey.PublicKey(), time.Hour)
+	key, err := d.GetKey("Alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.True(aliceKey.Equal(key))
+	_, err = d.GetKey("alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.Equal(1, queries, "cached key was not used")
+
+	d.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = d.GetKey("alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.Equal(2, queries, "expired cache entry was used")
+
+	_, err = d.GetKey("mallory@acme.com")
+	require.Error(err, "GetKey should've failed signature verification")
+	_, err = d.GetKey("bob@nsa.gov")
+	require.Error(err, "GetKey should've failed")
+
+	bobKey := newPublicKey(require)
+	contactsFile, err := ioutil.TempFile("", "contacts.toml")
+	require.NoError(err, "TempFile failed")
+	defer os.Remove(contactsFile.Name())
+	_, err = fmt.Fprintf(contactsFile, "[[Contact]]\nEmail = \"bob@nsa.gov\"\nKey = \"%s\"\n",
+		base64.StdEncoding.EncodeToString(bobKey.Bytes()))
+	require.NoError(err, "Write failed")
+	contactsFile.Close()
+	err = d.LoadContacts(contactsFile.Name())
+	require.NoError(err, "LoadContacts failed")
+	key, err = d.GetKey("bob@nsa.gov")
+	require.NoError(err, "GetKey failed")
+	require.True(bobKey.Equal(key))
+}
+
+func TestDirectoryKEMKey(t *testing.T) {
+	require := require.New(t)
+
+	directoryKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	kemKey, err := mlkem.GenerateKey768()
+	require.NoError(err, "GenerateKey768 failed")
+	expiration := time.Now().Add(24 * time.Hour)
+	tampered := SignDirectoryEntry(directoryKey, "mallory@acme.com", newPublicKey(require), expiration)
+	tampered.KEMKey = base64.StdEncoding.EncodeToString(kemKey.EncapsulationKey().Bytes())
+	entries := map[string]*DirectoryEntry{
+		"alice@acme.com":   SignDirectoryEntry(directoryKey, "alice@acme.com", newPublicKey(require), expiration),
+		"carol@fsb.ru":     SignHybridDirectoryEntry(directoryKey, "carol@fsb.ru", newPublicKey(require), kemKey.EncapsulationKey(), expiration),
+		"mallory@acme.com": tampered,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(entries[strings.TrimPrefix(r.URL.Path, "/")])
+	}))
+	defer server.Close()
+
+	d := NewDirectoryUserPKI(server.URL, directoryKey.PublicKey(), time.Hour)
+	key, err := d.GetKEMKey("carol@fsb.ru")
+	require.NoError(err, "GetKEMKey failed")
+	require.Equal(kemKey.EncapsulationKey().Bytes(), key.Bytes())
+	key, err = d.GetKEMKey("alice@acme.com")
+	require.NoError(err, "GetKEMKey failed")
+	require.Nil(key, "classical entry advertised a KEM key")
+	_, err = d.GetKEMKey("mallory@acme.com")
+	require.Error(err, "GetKEMKey should've failed signature verification")
+}
@@ -0,0 +1,96 @@
+// pinned.go - user PKI with pinned key overrides
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package user_pki
+
+import (
+	"crypto/mlkem"
+	"errors"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+// PinnedKeySource is an interface that represents a source of
+// pinned keys such as the contact book, PinnedKey returns nil
+// if no key is pinned for the given e-mail address
+type PinnedKeySource interface {
+	PinnedKey(email string) (*ecdh.PublicKey, error)
+}
+
+// errNoUserPKI is the error returned by a PinnedUserPKI
+// without a wrapped UserPKI for the keys which aren't pinned
+var errNoUserPKI = errors.New("no user PKI to look the key up")
+
+// PinnedUserPKI is a UserPKI which returns pinned keys
+// in preference to the keys of the wrapped UserPKI
+type PinnedUserPKI struct {
+	pins PinnedKeySource
+	pki  UserPKI
+}
+
+// NewPinnedUserPKI creates a new PinnedUserPKI, either of
+// the pinned keys and the wrapped UserPKI may be nil
+func NewPinnedUserPKI(pins PinnedKeySource, pki UserPKI) *PinnedUserPKI {
+	p := PinnedUserPKI{
+		pins: pins,
+		pki:  pki,
+	}
+	return &p
+}
+
+// GetKey returns the pinned key of the given e-mail address
+// if there is one, otherwise the wrapped UserPKI is queried
+func (p *PinnedUserPKI) GetKey(email string) (*ecdh.PublicKey, error) {
+	key, err := p.pinnedKey(email)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		return key, nil
+	}
+	if p.pki == nil {
+		return nil, errNoUserPKI
+	}
+	return p.pki.GetKey(email)
+}
+
+// pinnedKey returns the pinned key of the given e-mail
+// address, nil if there is none or no pinned keys
+func (p *PinnedUserPKI) pinnedKey(email string) (*ecdh.PublicKey, error) {
+	if p.pins == nil {
+		return nil, nil
+	}
+	return p.pins.PinnedKey(email)
+}
+
+// GetKEMKey returns the ML-KEM-768 encapsulation key advertised
+// by the given e-mail address if the wrapped UserPKI supports
+// them, nil is returned if no key is advertised or if a
+// classical key is pinned for the given e-mail address
+func (p *PinnedUserPKI) GetKEMKey(email string) (*mlkem.EncapsulationKey768, error) {
+	source, ok := p.pki.(KEMKeySource)
+	if !ok {
+		return nil, nil
+	}
+	key, err := p.pinnedKey(email)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		return nil, nil
+	}
+	return source.GetKEMKey(email)
+}
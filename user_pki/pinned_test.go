@@ -0,0 +1,55 @@
+// pinned_test.go - pinned key user PKI tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package user_pki
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/stretchr/testify/require"
+)
+
+type mapPins map[string]*ecdh.PublicKey
+
+func (m mapPins) PinnedKey(email string) (*ecdh.PublicKey, error) {
+	return m[email], nil
+}
+
+func TestPinnedUserPKI(t *testing.T) {
+	require := require.New(t)
+
+	aliceKey := newPublicKey(require)
+	pinnedKey := newPublicKey(require)
+	p := NewPinnedUserPKI(mapPins{"alice@acme.com": pinnedKey}, mapUserPKI{"alice@acme.com": aliceKey})
+	key, err := p.GetKey("alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.Equal(pinnedKey, key)
+
+	// without pinned keys the wrapped UserPKI is queried
+	p = NewPinnedUserPKI(nil, mapUserPKI{"alice@acme.com": aliceKey})
+	key, err = p.GetKey("alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.Equal(aliceKey, key)
+
+	// without a wrapped UserPKI only the pinned keys are known
+	p = NewPinnedUserPKI(nil, nil)
+	_, err = p.GetKey("alice@acme.com")
+	require.Equal(errNoUserPKI, err)
+	kemKey, err := p.GetKEMKey("alice@acme.com")
+	require.NoError(err, "GetKEMKey failed")
+	require.Nil(kemKey)
+}
@@ -0,0 +1,181 @@
+// refresh.go - periodic contact key refresh
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package user_pki
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/client/internal/constants"
+	"github.com/katzenpost/client/internal/entropy"
+	"github.com/katzenpost/client/internal/scheduler"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mixclient")
+
+// KeyChangeHandler is called when the key server returns a
+// different key for a pinned contact than the one in our cache
+type KeyChangeHandler func(email string, cachedKey, newKey *ecdh.PublicKey)
+
+// KeyRefresher is a caching UserPKI which periodically re-queries
+// the key server for the keys of all contacts so that stale keys
+// don't cause silent delivery failures. Each contact is refreshed
+// independently at a random time within every refresh interval so
+// that the order and timing of the queries doesn't reveal the
+// contact list as a batch.
+type KeyRefresher struct {
+	sync.RWMutex
+
+	source   UserPKI
+	interval time.Duration
+	sched    *scheduler.PriorityScheduler
+	rng      *rand.Rand
+	cache    map[string]*ecdh.PublicKey
+	pinned   map[string]bool
+	onChange KeyChangeHandler
+}
+
+// NewKeyRefresher creates a new KeyRefresher which caches the keys
+// of the given contacts, retrieved from the source key server, and
+// refreshes each of them once per interval on average
+func NewKeyRefresher(source UserPKI, contacts []string, interval time.Duration) *KeyRefresher {
+	r := KeyRefresher{
+		source:   source,
+		interval: interval,
+		rng:      entropy.NewMath(),
+		cache:    make(map[string]*ecdh.PublicKey),
+		pinned:   make(map[string]bool),
+	}
+	for _, email := range contacts {
+		r.cache[strings.ToLower(email)] = nil
+	}
+	r.sched = scheduler.New(r.handleRefresh)
+	return &r
+}
+
+// Pin marks the contact's key as pinned, a pinned key is never
+// replaced by a refresh, instead the KeyChangeHandler is called
+func (r *KeyRefresher) Pin(email string) {
+	r.Lock()
+	defer r.Unlock()
+	r.pinned[strings.ToLower(email)] = true
+}
+
+// SetKeyChangeHandler sets the function which is called
+// when a pinned contact's key changes
+func (r *KeyRefresher) SetKeyChangeHandler(handler KeyChangeHandler) {
+	r.Lock()
+	defer r.Unlock()
+	r.onChange = handler
+}
+
+// GetKey returns the cached key of the given contact,
+// querying the key server on a cache miss
+func (r *KeyRefresher) GetKey(email string) (*ecdh.PublicKey, error) {
+	email = strings.ToLower(email)
+	r.RLock()
+	key, ok := r.cache[email]
+	r.RUnlock()
+	if ok && key != nil {
+		return key, nil
+	}
+	err := r.refresh(email)
+	if err != nil {
+		return nil, err
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return r.cache[email], nil
+}
+
+// SetLowPower enables or disables the low power mode, which
+// coalesces the refreshes of the contacts into batches so that
+// the radio wakes up less often. The batches reveal more about
+// the contact list to the key server than independent refreshes.
+func (r *KeyRefresher) SetLowPower(enabled bool) {
+	if enabled {
+		r.sched.SetGranularity(constants.LowPowerTimerGranularity)
+	} else {
+		r.sched.SetGranularity(0)
+	}
+}
+
+// Start schedules the periodic refresh of all the contacts
+func (r *KeyRefresher) Start() {
+	r.Lock()
+	defer r.Unlock()
+	for email := range r.cache {
+		r.sched.Add(r.jitter(r.interval), email)
+	}
+}
+
+// jitter returns a random duration in the range [0, max)
+func (r *KeyRefresher) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(r.rng.Int63n(int64(max)))
+}
+
+// handleRefresh is called by our scheduler when a contact's key
+// must be refreshed, afterwards the next refresh of the contact
+// is scheduled at a random time within the next interval
+func (r *KeyRefresher) handleRefresh(task interface{}) {
+	email, ok := task.(string)
+	if !ok {
+		log.Error("KeyRefresher got invalid task from priority scheduler.")
+		return
+	}
+	err := r.refresh(email)
+	if err != nil {
+		log.Errorf("failed to refresh key of %s: %s", email, err)
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.sched.Add(r.interval/2+r.jitter(r.interval), email)
+}
+
+// refresh queries the key server for the contact's key and updates
+// the cache, unless the contact is pinned and the key has changed
+func (r *KeyRefresher) refresh(email string) error {
+	newKey, err := r.source.GetKey(email)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	cachedKey := r.cache[email]
+	changed := cachedKey != nil && !cachedKey.Equal(newKey)
+	if changed && r.pinned[email] {
+		onChange := r.onChange
+		r.Unlock()
+		log.Warningf("key server returned a different key for pinned contact %s", email)
+		if onChange != nil {
+			onChange(email, cachedKey, newKey)
+		}
+		return nil
+	}
+	if changed {
+		log.Noticef("key of contact %s has changed", email)
+	}
+	r.cache[email] = newKey
+	r.Unlock()
+	return nil
+}
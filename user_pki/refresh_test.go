@@ -0,0 +1,87 @@
+// refresh_test.go - periodic contact key refresh tests
+// Copyright (C) 2017  David Anthony Stainton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package user_pki
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+type mapUserPKI map[string]*ecdh.PublicKey
+
+func (m mapUserPKI) GetKey(email string) (*ecdh.PublicKey, error) {
+	key, ok := m[strings.ToLower(email)]
+	if !ok {
+		return nil, errors.New("email lookup failed")
+	}
+	return key, nil
+}
+
+func newPublicKey(require *require.Assertions) *ecdh.PublicKey {
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair failed")
+	return privKey.PublicKey()
+}
+
+func TestKeyRefresher(t *testing.T) {
+	require := require.New(t)
+
+	aliceKey := newPublicKey(require)
+	bobKey := newPublicKey(require)
+	source := mapUserPKI{
+		"alice@acme.com": aliceKey,
+		"bob@nsa.gov":    bobKey,
+	}
+	r := NewKeyRefresher(source, []string{"alice@acme.com", "Bob@nsa.gov"}, time.Hour)
+	r.Pin("bob@nsa.gov")
+	changes := []string{}
+	r.SetKeyChangeHandler(func(email string, cachedKey, newKey *ecdh.PublicKey) {
+		changes = append(changes, email)
+	})
+
+	key, err := r.GetKey("alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.True(aliceKey.Equal(key))
+	key, err = r.GetKey("bob@nsa.gov")
+	require.NoError(err, "GetKey failed")
+	require.True(bobKey.Equal(key))
+
+	// an unpinned key change is accepted
+	newAliceKey := newPublicKey(require)
+	source["alice@acme.com"] = newAliceKey
+	r.handleRefresh("alice@acme.com")
+	key, err = r.GetKey("alice@acme.com")
+	require.NoError(err, "GetKey failed")
+	require.True(newAliceKey.Equal(key))
+
+	// a pinned key change raises an alert and is not accepted
+	source["bob@nsa.gov"] = newPublicKey(require)
+	r.handleRefresh("bob@nsa.gov")
+	require.Equal([]string{"bob@nsa.gov"}, changes)
+	key, err = r.GetKey("bob@nsa.gov")
+	require.NoError(err, "GetKey failed")
+	require.True(bobKey.Equal(key))
+
+	_, err = r.GetKey("mallory@acme.com")
+	require.Error(err, "GetKey should've failed")
+}
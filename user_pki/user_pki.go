@@ -18,6 +18,7 @@
 package user_pki
 
 import (
+	"crypto/mlkem"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -33,6 +34,13 @@ type UserPKI interface {
 	GetKey(email string) (*ecdh.PublicKey, error)
 }
 
+// KEMKeySource is an optional interface implemented by the UserPKIs
+// which support the experimental hybrid envelopes, GetKEMKey returns
+// nil if the given e-mail address doesn't advertise an ML-KEM key
+type KEMKeySource interface {
+	GetKEMKey(email string) (*mlkem.EncapsulationKey768, error)
+}
+
 type User struct {
 	Email string
 	Key   string